@@ -0,0 +1,643 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"yunion.io/x/log"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	ErrPersistentStoreClosed = errors.Error("PersistentStoreClosed")
+	ErrPersistentStoreFormat = errors.Error("PersistentStoreFormatError")
+)
+
+const (
+	persistentStoreMagic   = "YNPS"
+	persistentStoreVersion = uint32(1)
+	persistentHeaderSize   = 8
+	persistentRecordHead   = 8
+
+	persistentOpPut    = byte(1)
+	persistentOpDelete = byte(2)
+
+	// records bigger than this are considered corrupted rather than allocated
+	persistentMaxRecordSize = 64 * 1024 * 1024
+)
+
+// PersistentCodec converts the objects kept in a PersistentStore to and from
+// their on-disk representation.
+type PersistentCodec interface {
+	Encode(obj interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+type jsonCodec struct {
+	newFunc func() interface{}
+}
+
+// NewJSONCodec returns a PersistentCodec that marshals objects as JSON.
+// newFunc must return a pointer to a fresh object to decode into, and the
+// decoded pointer is what ends up in the store, so the store should be used
+// with pointers only.
+func NewJSONCodec(newFunc func() interface{}) PersistentCodec {
+	return &jsonCodec{newFunc: newFunc}
+}
+
+func (c *jsonCodec) Encode(obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (c *jsonCodec) Decode(data []byte) (interface{}, error) {
+	obj := c.newFunc()
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// PersistentStoreOptions tunes the durability and compaction behaviour of a
+// PersistentStore. The zero value is usable.
+type PersistentStoreOptions struct {
+	// SyncWrites fsyncs the log after every mutation. Without it a crash
+	// may lose the most recent writes, but never corrupts older ones.
+	SyncWrites bool
+	// CompactMinRecords is the number of log records below which the log
+	// is never compacted. Defaults to 1024.
+	CompactMinRecords int
+	// CompactRatio compacts the log once it holds more than CompactRatio
+	// records per live entry. Defaults to 2.
+	CompactRatio float64
+}
+
+func (o *PersistentStoreOptions) normalize() {
+	if o.CompactMinRecords <= 0 {
+		o.CompactMinRecords = 1024
+	}
+	if o.CompactRatio <= 1 {
+		o.CompactRatio = 2
+	}
+}
+
+// PersistentStore is an Indexer that keeps its entries in an append-only
+// log file, so that its content survives a process restart.
+//	1. Every mutation is appended to the log as a checksummed record before
+//	   it becomes visible in memory
+//	2. On open, the log is replayed into a ThreadSafeStore, which rebuilds
+//	   all indices; a torn or corrupted tail is truncated
+//	3. Once the log grows too large compared to the live entries, it is
+//	   rewritten into a snapshot and atomically renamed over the old one
+// Reads never touch the disk.
+type PersistentStore struct {
+	cacheStorage ThreadSafeStore
+	keyFunc      KeyFunc
+	codec        PersistentCodec
+	opts         PersistentStoreOptions
+
+	path string
+
+	// lock serializes writes to the log and to cacheStorage so that the
+	// order of records matches the order of in-memory updates
+	lock    sync.Mutex
+	file    persistentFile
+	records int
+}
+
+// persistentFile is the log file opened for appending
+type persistentFile interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+var _ QueryIndexer = &PersistentStore{}
+
+// NewPersistentStore opens or creates the log at path and returns a Store
+// whose entries are reloaded from it.
+func NewPersistentStore(path string, keyFunc KeyFunc, codec PersistentCodec, opts *PersistentStoreOptions) (*PersistentStore, error) {
+	return NewPersistentIndexer(path, keyFunc, Indexers{}, codec, opts)
+}
+
+// NewPersistentIndexer is like NewPersistentStore, with indexers that are
+// rebuilt from the reloaded entries.
+func NewPersistentIndexer(path string, keyFunc KeyFunc, indexers Indexers, codec PersistentCodec, opts *PersistentStoreOptions) (*PersistentStore, error) {
+	s := &PersistentStore{
+		cacheStorage: NewThreadSafeStore(indexers, Indices{}),
+		keyFunc:      keyFunc,
+		codec:        codec,
+		path:         path,
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	s.opts.normalize()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the log into memory and leaves the file open for appending
+func (s *PersistentStore) load() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", s.path)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "stat %s", s.path)
+	}
+	if fi.Size() == 0 {
+		if _, err := file.Write(persistentHeader()); err != nil {
+			file.Close()
+			return errors.Wrap(err, "write header")
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return errors.Wrap(err, "sync header")
+		}
+		s.file = file
+		return nil
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, persistentHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		file.Close()
+		return errors.Wrapf(ErrPersistentStoreFormat, "read header of %s: %v", s.path, err)
+	}
+	if string(header[:4]) != persistentStoreMagic {
+		file.Close()
+		return errors.Wrapf(ErrPersistentStoreFormat, "%s: bad magic", s.path)
+	}
+	if ver := binary.BigEndian.Uint32(header[4:]); ver != persistentStoreVersion {
+		file.Close()
+		return errors.Wrapf(ErrPersistentStoreFormat, "%s: unsupported version %d", s.path, ver)
+	}
+
+	offset := int64(persistentHeaderSize)
+	for {
+		body, err := readPersistentRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warningf("persistent store %s: %v at offset %d, truncating", s.path, err, offset)
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return errors.Wrapf(err, "truncate %s", s.path)
+			}
+			break
+		}
+		if err := s.replay(body); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "replay record at offset %d", offset)
+		}
+		offset += int64(persistentRecordHead + len(body))
+		s.records++
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "seek %s", s.path)
+	}
+	s.file = file
+	return nil
+}
+
+func (s *PersistentStore) replay(body []byte) error {
+	op, key, value, err := decodePersistentBody(body)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case persistentOpPut:
+		obj, err := s.codec.Decode(value)
+		if err != nil {
+			return errors.Wrapf(err, "decode %s", key)
+		}
+		s.cacheStorage.Update(key, obj)
+	case persistentOpDelete:
+		s.cacheStorage.Delete(key)
+	default:
+		return errors.Wrapf(ErrPersistentStoreFormat, "unknown op %d", op)
+	}
+	return nil
+}
+
+func persistentHeader() []byte {
+	header := make([]byte, persistentHeaderSize)
+	copy(header, persistentStoreMagic)
+	binary.BigEndian.PutUint32(header[4:], persistentStoreVersion)
+	return header
+}
+
+// encodePersistentRecord lays out a record as
+//	crc32(body) | len(body) | op | uvarint(len(key)) | key | value
+func encodePersistentRecord(op byte, key string, value []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+	bodyLen := 1 + n + len(key) + len(value)
+	rec := make([]byte, persistentRecordHead+bodyLen)
+	body := rec[persistentRecordHead:]
+	body[0] = op
+	copy(body[1:], lenBuf[:n])
+	copy(body[1+n:], key)
+	copy(body[1+n+len(key):], value)
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(body))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(bodyLen))
+	return rec
+}
+
+func readPersistentRecord(reader io.Reader) ([]byte, error) {
+	head := make([]byte, persistentRecordHead)
+	n, err := io.ReadFull(reader, head)
+	if err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(ErrPersistentStoreFormat, "short record header")
+	}
+	sum := binary.BigEndian.Uint32(head[0:4])
+	size := binary.BigEndian.Uint32(head[4:8])
+	if size == 0 || size > persistentMaxRecordSize {
+		return nil, errors.Wrapf(ErrPersistentStoreFormat, "invalid record size %d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, errors.Wrap(ErrPersistentStoreFormat, "short record body")
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.Wrap(ErrPersistentStoreFormat, "checksum mismatch")
+	}
+	return body, nil
+}
+
+func decodePersistentBody(body []byte) (byte, string, []byte, error) {
+	keyLen, n := binary.Uvarint(body[1:])
+	if n <= 0 || uint64(len(body)-1-n) < keyLen {
+		return 0, "", nil, errors.Wrap(ErrPersistentStoreFormat, "invalid key length")
+	}
+	key := string(body[1+n : 1+n+int(keyLen)])
+	return body[0], key, body[1+n+int(keyLen):], nil
+}
+
+// append writes a record to the log, it must be called with s.lock held.
+// A record partially written or failing to sync is truncated, otherwise the
+// records appended after it would be dropped with the torn record on reload
+// and the log would hold a mutation that is not in memory; the store is
+// closed if the truncation fails.
+func (s *PersistentStore) append(rec []byte) error {
+	if s.file == nil {
+		return ErrPersistentStoreClosed
+	}
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "seek %s", s.path)
+	}
+	if _, err := s.file.Write(rec); err != nil {
+		return s.abortAppend(offset, errors.Wrapf(err, "append to %s", s.path))
+	}
+	if s.opts.SyncWrites {
+		if err := s.file.Sync(); err != nil {
+			return s.abortAppend(offset, errors.Wrapf(err, "sync %s", s.path))
+		}
+	}
+	s.records++
+	return nil
+}
+
+// abortAppend rolls the log back to offset after err, closing the store if
+// the rollback fails
+func (s *PersistentStore) abortAppend(offset int64, err error) error {
+	if terr := s.rollback(offset); terr != nil {
+		s.file.Close()
+		s.file = nil
+		return errors.Wrapf(err, "store closed as %v", terr)
+	}
+	return err
+}
+
+// rollback drops what is written to the log after offset
+func (s *PersistentStore) rollback(offset int64) error {
+	if err := s.file.Truncate(offset); err != nil {
+		return errors.Wrapf(err, "truncate %s", s.path)
+	}
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "seek %s", s.path)
+	}
+	return nil
+}
+
+func (s *PersistentStore) put(obj interface{}) error {
+	key, err := s.keyFunc(obj)
+	if err != nil {
+		return KeyError{obj, err}
+	}
+	value, err := s.codec.Encode(obj)
+	if err != nil {
+		return errors.Wrapf(err, "encode %s", key)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.append(encodePersistentRecord(persistentOpPut, key, value)); err != nil {
+		return err
+	}
+	s.cacheStorage.Update(key, obj)
+	s.compactAfterMutation()
+	return nil
+}
+
+// Add inserts an item into the store and persists it.
+func (s *PersistentStore) Add(obj interface{}) error {
+	return s.put(obj)
+}
+
+// Update sets an item in the store to its updated state and persists it.
+func (s *PersistentStore) Update(obj interface{}) error {
+	return s.put(obj)
+}
+
+// Delete removes an item from the store and records the removal.
+func (s *PersistentStore) Delete(obj interface{}) error {
+	key, err := s.keyFunc(obj)
+	if err != nil {
+		return KeyError{obj, err}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.cacheStorage.Get(key); !exists {
+		return nil
+	}
+	if err := s.append(encodePersistentRecord(persistentOpDelete, key, nil)); err != nil {
+		return err
+	}
+	s.cacheStorage.Delete(key)
+	s.compactAfterMutation()
+	return nil
+}
+
+// compactAfterMutation compacts the log if it has grown too large. The
+// mutation is already durable in the log, so a failed compaction is only
+// logged and retried on the next mutation.
+func (s *PersistentStore) compactAfterMutation() {
+	if err := s.maybeCompact(); err != nil {
+		log.Errorf("persistent store %s: compact: %v", s.path, err)
+	}
+}
+
+// List returns a list of all the items.
+func (s *PersistentStore) List() []interface{} {
+	return s.cacheStorage.List()
+}
+
+// ListKeys returns a list of all the keys of the objects currently in the store.
+func (s *PersistentStore) ListKeys() []string {
+	return s.cacheStorage.ListKeys()
+}
+
+// Get returns the requested item, or sets exists=false.
+func (s *PersistentStore) Get(obj interface{}) (item interface{}, exists bool, err error) {
+	key, err := s.keyFunc(obj)
+	if err != nil {
+		return nil, false, KeyError{obj, err}
+	}
+	return s.GetByKey(key)
+}
+
+// GetByKey returns the request item, or exists=false.
+func (s *PersistentStore) GetByKey(key string) (item interface{}, exists bool, err error) {
+	item, exists = s.cacheStorage.Get(key)
+	return item, exists, nil
+}
+
+// Replace will delete the contents of the store, using instead the given
+// list. The new content is written out as a fresh snapshot.
+func (s *PersistentStore) Replace(list []interface{}, resourceVersion string) error {
+	items := map[string]interface{}{}
+	values := map[string][]byte{}
+	for _, item := range list {
+		key, err := s.keyFunc(item)
+		if err != nil {
+			return KeyError{item, err}
+		}
+		value, err := s.codec.Encode(item)
+		if err != nil {
+			return errors.Wrapf(err, "encode %s", key)
+		}
+		items[key] = item
+		values[key] = value
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.writeSnapshot(values); err != nil {
+		return err
+	}
+	s.cacheStorage.Replace(items, resourceVersion)
+	return nil
+}
+
+// Resync is a no-op, the store has nothing to resynchronize with.
+func (s *PersistentStore) Resync() error {
+	return s.cacheStorage.Resync()
+}
+
+// Index returns a list of items that match on the index function
+func (s *PersistentStore) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	return s.cacheStorage.Index(indexName, obj)
+}
+
+func (s *PersistentStore) IndexKeys(indexName, indexKey string) ([]string, error) {
+	return s.cacheStorage.IndexKeys(indexName, indexKey)
+}
+
+// ListIndexFuncValues returns the list of generated values of an Index func
+func (s *PersistentStore) ListIndexFuncValues(indexName string) []string {
+	return s.cacheStorage.ListIndexFuncValues(indexName)
+}
+
+func (s *PersistentStore) ByIndex(indexName, indexKey string) ([]interface{}, error) {
+	return s.cacheStorage.ByIndex(indexName, indexKey)
+}
+
+// GetIndexers returns the indexers of the store
+func (s *PersistentStore) GetIndexers() Indexers {
+	return s.cacheStorage.GetIndexers()
+}
+
+func (s *PersistentStore) AddIndexers(newIndexers Indexers) error {
+	return s.cacheStorage.AddIndexers(newIndexers)
+}
+
+// IndexValuesInRange returns the sorted values of an index within [from, to)
+func (s *PersistentStore) IndexValuesInRange(indexName, from, to string) ([]string, error) {
+	indexer, err := rangeIndexer(s.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexValuesInRange(indexName, from, to)
+}
+
+func (s *PersistentStore) IndexKeysInRange(indexName, from, to string) ([]string, error) {
+	indexer, err := rangeIndexer(s.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexKeysInRange(indexName, from, to)
+}
+
+func (s *PersistentStore) IndexKeysWithPrefix(indexName, prefix string) ([]string, error) {
+	indexer, err := rangeIndexer(s.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexKeysWithPrefix(indexName, prefix)
+}
+
+// Query returns a page of the items matching all the conditions of query
+func (s *PersistentStore) Query(query IndexQuery) (*IndexQueryResult, error) {
+	indexer, err := rangeIndexer(s.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.Query(query)
+}
+
+// Compact rewrites the log so that it only contains the live entries.
+func (s *PersistentStore) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.compact()
+}
+
+// Close flushes and closes the log. The store must not be modified afterwards.
+func (s *PersistentStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+func (s *PersistentStore) maybeCompact() error {
+	if s.records < s.opts.CompactMinRecords {
+		return nil
+	}
+	live := len(s.cacheStorage.ListKeys())
+	if float64(s.records) <= float64(live)*s.opts.CompactRatio {
+		return nil
+	}
+	return s.compact()
+}
+
+func (s *PersistentStore) compact() error {
+	if s.file == nil {
+		return ErrPersistentStoreClosed
+	}
+	values := map[string][]byte{}
+	for _, key := range s.cacheStorage.ListKeys() {
+		obj, exists := s.cacheStorage.Get(key)
+		if !exists {
+			continue
+		}
+		value, err := s.codec.Encode(obj)
+		if err != nil {
+			return errors.Wrapf(err, "encode %s", key)
+		}
+		values[key] = value
+	}
+	return s.writeSnapshot(values)
+}
+
+// writeSnapshot atomically replaces the log with one put record per entry,
+// it must be called with s.lock held
+func (s *PersistentStore) writeSnapshot(values map[string][]byte) error {
+	if s.file == nil {
+		return ErrPersistentStoreClosed
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", tmpPath)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writer := bufio.NewWriter(tmp)
+	err = func() error {
+		if _, err := writer.Write(persistentHeader()); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := writer.Write(encodePersistentRecord(persistentOpPut, key, values[key])); err != nil {
+				return err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return tmp.Sync()
+	}()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "write snapshot %s", tmpPath)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "rename %s", tmpPath)
+	}
+	syncDir(filepath.Dir(s.path))
+
+	s.file.Close()
+	s.file = tmp
+	s.records = len(keys)
+	return nil
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
@@ -0,0 +1,295 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+type testStoreCodec struct{}
+
+func (testStoreCodec) Encode(obj interface{}) ([]byte, error) {
+	o := obj.(testStoreObject)
+	return []byte(o.id + "\x00" + o.val), nil
+}
+
+func (testStoreCodec) Decode(data []byte) (interface{}, error) {
+	parts := strings.SplitN(string(data), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad object %q", data)
+	}
+	return testStoreObject{id: parts[0], val: parts[1]}, nil
+}
+
+func newTestPersistentIndexer(t *testing.T, path string, opts *PersistentStoreOptions) *PersistentStore {
+	s, err := NewPersistentIndexer(path, testStoreKeyFunc, testStoreIndexers(), testStoreCodec{}, opts)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	return s
+}
+
+func TestPersistentStore(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestPersistentIndexer(t, filepath.Join(dir, "store"), nil)
+	defer s.Close()
+	doTestStore(t, s)
+}
+
+func TestPersistentIndex(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestPersistentIndexer(t, filepath.Join(dir, "index"), nil)
+	defer s.Close()
+	doTestIndex(t, s)
+}
+
+func TestPersistentStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.Add(testStoreObject{id: "c", val: "b"})
+	s.Add(testStoreObject{id: "e", val: "f"})
+	s.Update(testStoreObject{id: "e", val: "g"})
+	s.Delete(testStoreObject{id: "a"})
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %v", keys)
+	}
+	if item, ok, _ := s.GetByKey("e"); !ok || item.(testStoreObject).val != "g" {
+		t.Errorf("expected e=g, got %v %v", item, ok)
+	}
+	if keys, _ := s.IndexKeys("by_val", "b"); len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("expected index b=[c], got %v", keys)
+	}
+	if keys, _ := s.IndexKeys("by_val", "f"); len(keys) != 0 {
+		t.Errorf("stale index f: %v", keys)
+	}
+}
+
+func TestPersistentStoreTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.Add(testStoreObject{id: "c", val: "d"})
+	s.Close()
+
+	fi, _ := os.Stat(path)
+	// chop off the last byte to simulate a crash in the middle of a write
+	if err := os.Truncate(path, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestPersistentIndexer(t, path, nil)
+	if _, ok, _ := s.GetByKey("a"); !ok {
+		t.Errorf("lost intact record a")
+	}
+	if _, ok, _ := s.GetByKey("c"); ok {
+		t.Errorf("torn record c should be dropped")
+	}
+	// the store must remain writable after truncating the tail
+	s.Add(testStoreObject{id: "e", val: "f"})
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 2 {
+		t.Errorf("expected a and e, got %v", keys)
+	}
+}
+
+func TestPersistentStoreChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.Close()
+
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0600)
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 0 {
+		t.Errorf("corrupted record should be dropped, got %v", keys)
+	}
+}
+
+func TestPersistentStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, &PersistentStoreOptions{CompactMinRecords: 16, CompactRatio: 2})
+	for i := 0; i < 100; i++ {
+		s.Update(testStoreObject{id: "a", val: fmt.Sprintf("%d", i)})
+	}
+	if s.records >= 16 {
+		t.Errorf("log was not compacted, %d records", s.records)
+	}
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if item, ok, _ := s.GetByKey("a"); !ok || item.(testStoreObject).val != "99" {
+		t.Errorf("expected a=99, got %v %v", item, ok)
+	}
+	if keys, _ := s.IndexKeys("by_val", "99"); len(keys) != 1 {
+		t.Errorf("index not rebuilt after compaction: %v", keys)
+	}
+}
+
+func TestPersistentStoreReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.Replace([]interface{}{testStoreObject{id: "c", val: "d"}}, "0")
+	s.Add(testStoreObject{id: "e", val: "f"})
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if _, ok, _ := s.GetByKey("a"); ok {
+		t.Errorf("replaced item a still present")
+	}
+	if keys := s.ListKeys(); len(keys) != 2 {
+		t.Errorf("expected c and e, got %v", keys)
+	}
+}
+
+// shortWriteFile writes half of the next record and fails
+type shortWriteFile struct {
+	persistentFile
+	fail bool
+}
+
+func (f *shortWriteFile) Write(b []byte) (int, error) {
+	if !f.fail {
+		return f.persistentFile.Write(b)
+	}
+	f.fail = false
+	n, _ := f.persistentFile.Write(b[:len(b)/2])
+	return n, io.ErrShortWrite
+}
+
+func TestPersistentStoreShortWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.file = &shortWriteFile{persistentFile: s.file, fail: true}
+	if err := s.Add(testStoreObject{id: "c", val: "d"}); errors.Cause(err) != io.ErrShortWrite {
+		t.Errorf("expected short write, got %v", err)
+	}
+	if _, ok, _ := s.GetByKey("c"); ok {
+		t.Errorf("record c failed to persist should not be visible")
+	}
+	// the writes acknowledged after the failure must survive a reload
+	if err := s.Add(testStoreObject{id: "e", val: "f"}); err != nil {
+		t.Fatalf("Add after short write: %v", err)
+	}
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 2 {
+		t.Errorf("expected a and e, got %v", keys)
+	}
+	if _, ok, _ := s.GetByKey("e"); !ok {
+		t.Errorf("lost record e written after the short write")
+	}
+}
+
+// syncFailFile fails the next Sync
+type syncFailFile struct {
+	persistentFile
+	fail bool
+}
+
+var errTestSync = errors.Error("TestSyncError")
+
+func (f *syncFailFile) Sync() error {
+	if !f.fail {
+		return f.persistentFile.Sync()
+	}
+	f.fail = false
+	return errTestSync
+}
+
+func TestPersistentStoreSyncFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, &PersistentStoreOptions{SyncWrites: true})
+	s.Add(testStoreObject{id: "a", val: "b"})
+	s.file = &syncFailFile{persistentFile: s.file, fail: true}
+	if err := s.Add(testStoreObject{id: "c", val: "d"}); errors.Cause(err) != errTestSync {
+		t.Errorf("expected sync error, got %v", err)
+	}
+	if _, ok, _ := s.GetByKey("c"); ok {
+		t.Errorf("record c failed to sync should not be visible")
+	}
+	if err := s.Add(testStoreObject{id: "e", val: "f"}); err != nil {
+		t.Fatalf("Add after sync failure: %v", err)
+	}
+	s.Close()
+
+	// the log agrees with what was visible in memory
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 2 {
+		t.Errorf("expected a and e, got %v", keys)
+	}
+	if _, ok, _ := s.GetByKey("c"); ok {
+		t.Errorf("record c failed to sync reappears on reload")
+	}
+}
+
+func TestPersistentStoreCompactFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, &PersistentStoreOptions{CompactMinRecords: 4, CompactRatio: 2})
+	// the snapshot cannot be created over a directory
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Update(testStoreObject{id: "a", val: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatalf("Update with failing compaction: %v", err)
+		}
+	}
+	if err := s.Delete(testStoreObject{id: "a"}); err != nil {
+		t.Fatalf("Delete with failing compaction: %v", err)
+	}
+	s.Add(testStoreObject{id: "b", val: "c"})
+	s.Close()
+
+	s = newTestPersistentIndexer(t, path, nil)
+	defer s.Close()
+	if keys := s.ListKeys(); len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("expected b, got %v", keys)
+	}
+}
+
+func TestPersistentStoreClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	s := newTestPersistentIndexer(t, path, nil)
+	s.Close()
+	if err := s.Add(testStoreObject{id: "a", val: "b"}); err != ErrPersistentStoreClosed {
+		t.Errorf("expected ErrPersistentStoreClosed, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"yunion.io/x/pkg/util/sets"
+)
+
+// QueryIndexer is an Indexer whose indices are kept ordered, so that they
+// can serve range and prefix lookups as well as composite paginated queries.
+type QueryIndexer interface {
+	Indexer
+	RangeIndexer
+}
+
+// IndexCondition selects the objects having at least one value of the named
+// index matching every non-empty field of the condition.
+type IndexCondition struct {
+	IndexName string
+
+	// Values matches any of the exact index values
+	Values []string
+	// Prefix matches the index values starting with Prefix
+	Prefix string
+	// From and To match the index values v with From <= v < To
+	From string
+	To   string
+}
+
+// IndexQuery is a composite query: the results of all its Conditions are
+// intersected. Without any condition, all the objects in the store match.
+type IndexQuery struct {
+	Conditions []IndexCondition
+
+	// OrderBy sorts the results by the smallest value of the named index,
+	// then by key. Results are sorted by key only if it is empty.
+	OrderBy string
+	// Marker is the NextMarker of the previous page
+	Marker string
+	// Limit is the maximal number of items returned, 0 means no limit
+	Limit int
+}
+
+type IndexQueryResult struct {
+	Items []interface{}
+	// Total is the number of matching objects, regardless of pagination
+	Total int
+	// NextMarker is set if there are more results to fetch
+	NextMarker string
+}
+
+// TimeIndexValue formats t so that index values compare in the same order
+// as the times do, for IndexFuncs used with range queries.
+func TimeIndexValue(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func (cond *IndexCondition) match(value string) bool {
+	if len(cond.Prefix) > 0 && !strings.HasPrefix(value, cond.Prefix) {
+		return false
+	}
+	if len(cond.From) > 0 && value < cond.From {
+		return false
+	}
+	if len(cond.To) > 0 && value >= cond.To {
+		return false
+	}
+	return true
+}
+
+// values returns the index values matching the condition, sorted must be the
+// sorted values of the index
+func (cond *IndexCondition) values(sorted []string) []string {
+	if len(cond.Values) > 0 {
+		ret := make([]string, 0, len(cond.Values))
+		for _, value := range cond.Values {
+			if cond.match(value) {
+				ret = append(ret, value)
+			}
+		}
+		return ret
+	}
+	lower := cond.From
+	if cond.Prefix > lower {
+		lower = cond.Prefix
+	}
+	start := sort.SearchStrings(sorted, lower)
+	end := start
+	for end < len(sorted) && cond.match(sorted[end]) {
+		end++
+	}
+	return sorted[start:end]
+}
+
+// conditionKeys must be called with the lock held
+func (c *threadSafeMap) conditionKeys(cond *IndexCondition) (sets.String, error) {
+	if c.indexers[cond.IndexName] == nil {
+		return nil, fmt.Errorf("Index with name %s does not exist", cond.IndexName)
+	}
+	index := c.indices[cond.IndexName]
+	keys := sets.String{}
+	for _, value := range cond.values(c.sortedValues[cond.IndexName]) {
+		for key := range index[value] {
+			keys.Insert(key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *threadSafeMap) IndexValuesInRange(indexName, from, to string) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.indexers[indexName] == nil {
+		return nil, fmt.Errorf("Index with name %s does not exist", indexName)
+	}
+	cond := IndexCondition{IndexName: indexName, From: from, To: to}
+	values := cond.values(c.sortedValues[indexName])
+	return append([]string{}, values...), nil
+}
+
+func (c *threadSafeMap) IndexKeysInRange(indexName, from, to string) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	keys, err := c.conditionKeys(&IndexCondition{IndexName: indexName, From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return keys.List(), nil
+}
+
+func (c *threadSafeMap) IndexKeysWithPrefix(indexName, prefix string) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	keys, err := c.conditionKeys(&IndexCondition{IndexName: indexName, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return keys.List(), nil
+}
+
+type queryEntry struct {
+	key   string
+	order string
+}
+
+func encodeQueryMarker(e queryEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(e.order + "\x00" + e.key))
+}
+
+func decodeQueryMarker(marker string) (queryEntry, error) {
+	data, err := base64.RawURLEncoding.DecodeString(marker)
+	if err != nil {
+		return queryEntry{}, fmt.Errorf("invalid marker %q: %v", marker, err)
+	}
+	parts := strings.SplitN(string(data), "\x00", 2)
+	if len(parts) != 2 {
+		return queryEntry{}, fmt.Errorf("invalid marker %q", marker)
+	}
+	return queryEntry{order: parts[0], key: parts[1]}, nil
+}
+
+func (e queryEntry) less(o queryEntry) bool {
+	if e.order != o.order {
+		return e.order < o.order
+	}
+	return e.key < o.key
+}
+
+func (c *threadSafeMap) Query(query IndexQuery) (*IndexQueryResult, error) {
+	var marker *queryEntry
+	if len(query.Marker) > 0 {
+		e, err := decodeQueryMarker(query.Marker)
+		if err != nil {
+			return nil, err
+		}
+		marker = &e
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var orderFunc IndexFunc
+	if len(query.OrderBy) > 0 {
+		orderFunc = c.indexers[query.OrderBy]
+		if orderFunc == nil {
+			return nil, fmt.Errorf("Index with name %s does not exist", query.OrderBy)
+		}
+	}
+
+	var keys []string
+	if len(query.Conditions) == 0 {
+		keys = make([]string, 0, len(c.items))
+		for key := range c.items {
+			keys = append(keys, key)
+		}
+	} else {
+		keySets := make([]sets.String, 0, len(query.Conditions))
+		for i := range query.Conditions {
+			set, err := c.conditionKeys(&query.Conditions[i])
+			if err != nil {
+				return nil, err
+			}
+			keySets = append(keySets, set)
+		}
+		// intersect starting from the smallest set
+		sort.Slice(keySets, func(i, j int) bool { return keySets[i].Len() < keySets[j].Len() })
+		for key := range keySets[0] {
+			found := true
+			for _, set := range keySets[1:] {
+				if !set.Has(key) {
+					found = false
+					break
+				}
+			}
+			if found {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	entries := make([]queryEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := queryEntry{key: key}
+		if orderFunc != nil {
+			values, err := orderFunc(c.items[key])
+			if err != nil {
+				return nil, fmt.Errorf("unable to calculate an index entry for key %q on index %q: %v", key, query.OrderBy, err)
+			}
+			if len(values) > 0 {
+				entry.order = values[0]
+				for _, value := range values[1:] {
+					if value < entry.order {
+						entry.order = value
+					}
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+
+	result := &IndexQueryResult{
+		Total: len(entries),
+	}
+	if marker != nil {
+		start := sort.Search(len(entries), func(i int) bool { return marker.less(entries[i]) })
+		entries = entries[start:]
+	}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		result.NextMarker = encodeQueryMarker(entries[len(entries)-1])
+	}
+	result.Items = make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		result.Items = append(result.Items, c.items[entry.key])
+	}
+	return result, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testQueryObject struct {
+	id      string
+	owner   string
+	tags    []string
+	created time.Time
+}
+
+func newTestQueryIndexer() QueryIndexer {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	indexer := NewQueryIndexer(
+		func(obj interface{}) (string, error) {
+			return obj.(*testQueryObject).id, nil
+		},
+		Indexers{
+			"owner": func(obj interface{}) ([]string, error) {
+				return []string{obj.(*testQueryObject).owner}, nil
+			},
+			"tag": func(obj interface{}) ([]string, error) {
+				return obj.(*testQueryObject).tags, nil
+			},
+			"created": func(obj interface{}) ([]string, error) {
+				return []string{TimeIndexValue(obj.(*testQueryObject).created)}, nil
+			},
+		},
+	)
+	objs := []*testQueryObject{
+		{id: "vm-1", owner: "alice", tags: []string{"env:prod", "app:web"}, created: base.Add(5 * time.Hour)},
+		{id: "vm-2", owner: "bob", tags: []string{"env:dev", "app:web"}, created: base.Add(1 * time.Hour)},
+		{id: "vm-3", owner: "alice", tags: []string{"env:dev"}, created: base.Add(3 * time.Hour)},
+		{id: "vm-4", owner: "alice", tags: []string{"env:prod", "app:db"}, created: base.Add(2 * time.Hour)},
+		{id: "vm-5", owner: "carol", tags: []string{"env:prod"}, created: base.Add(4 * time.Hour)},
+	}
+	for _, obj := range objs {
+		indexer.Add(obj)
+	}
+	return indexer
+}
+
+func queryIds(items []interface{}) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.(*testQueryObject).id)
+	}
+	return ids
+}
+
+func TestIndexKeysInRange(t *testing.T) {
+	indexer := newTestQueryIndexer()
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		from, to string
+		want     []string
+	}{
+		{TimeIndexValue(base.Add(2 * time.Hour)), TimeIndexValue(base.Add(4 * time.Hour)), []string{"vm-3", "vm-4"}},
+		{"", TimeIndexValue(base.Add(2 * time.Hour)), []string{"vm-2"}},
+		{TimeIndexValue(base.Add(4 * time.Hour)), "", []string{"vm-1", "vm-5"}},
+		{"", "", []string{"vm-1", "vm-2", "vm-3", "vm-4", "vm-5"}},
+	}
+	for _, c := range cases {
+		got, err := indexer.IndexKeysInRange("created", c.from, c.to)
+		if err != nil {
+			t.Fatalf("IndexKeysInRange: %v", err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("[%s, %s): want %v, got %v", c.from, c.to, c.want, got)
+		}
+	}
+
+	if _, err := indexer.IndexKeysInRange("missing", "", ""); err == nil {
+		t.Errorf("expected error for unknown index")
+	}
+}
+
+func TestIndexKeysWithPrefix(t *testing.T) {
+	indexer := newTestQueryIndexer()
+
+	got, _ := indexer.IndexKeysWithPrefix("tag", "app:")
+	if want := []string{"vm-1", "vm-2", "vm-4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	values, _ := indexer.IndexValuesInRange("tag", "app:", "env:")
+	if want := []string{"app:db", "app:web"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("want %v, got %v", want, values)
+	}
+
+	// values no longer referenced by any object are gone from the index
+	indexer.Delete(&testQueryObject{id: "vm-4"})
+	values, _ = indexer.IndexValuesInRange("tag", "app:", "env:")
+	if want := []string{"app:web"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("want %v, got %v", want, values)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	indexer := newTestQueryIndexer()
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		query IndexQuery
+		want  []string
+	}{
+		{
+			name: "all",
+			want: []string{"vm-1", "vm-2", "vm-3", "vm-4", "vm-5"},
+		},
+		{
+			name: "intersect",
+			query: IndexQuery{
+				Conditions: []IndexCondition{
+					{IndexName: "owner", Values: []string{"alice"}},
+					{IndexName: "tag", Values: []string{"env:prod"}},
+				},
+			},
+			want: []string{"vm-1", "vm-4"},
+		},
+		{
+			name: "intersect range ordered",
+			query: IndexQuery{
+				Conditions: []IndexCondition{
+					{IndexName: "tag", Prefix: "env:"},
+					{IndexName: "created", From: TimeIndexValue(base.Add(2 * time.Hour))},
+				},
+				OrderBy: "created",
+			},
+			want: []string{"vm-4", "vm-3", "vm-5", "vm-1"},
+		},
+		{
+			name: "empty",
+			query: IndexQuery{
+				Conditions: []IndexCondition{
+					{IndexName: "owner", Values: []string{"bob"}},
+					{IndexName: "tag", Values: []string{"env:prod"}},
+				},
+			},
+			want: []string{},
+		},
+	}
+	for _, c := range cases {
+		result, err := indexer.Query(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := queryIds(result.Items); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, got)
+		}
+		if result.Total != len(c.want) {
+			t.Errorf("%s: want total %d, got %d", c.name, len(c.want), result.Total)
+		}
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	indexer := newTestQueryIndexer()
+
+	query := IndexQuery{OrderBy: "created", Limit: 2}
+	ids := []string{}
+	pages := 0
+	for {
+		result, err := indexer.Query(query)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		pages++
+		ids = append(ids, queryIds(result.Items)...)
+		if len(result.NextMarker) == 0 {
+			break
+		}
+		query.Marker = result.NextMarker
+	}
+	if want := []string{"vm-2", "vm-4", "vm-3", "vm-5", "vm-1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("want %v, got %v", want, ids)
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+
+	if _, err := indexer.Query(IndexQuery{Marker: "!"}); err == nil {
+		t.Errorf("expected error for invalid marker")
+	}
+}
+
+type testPlainThreadSafeStore struct {
+	ThreadSafeStore
+}
+
+func TestRangeIndexer(t *testing.T) {
+	if _, ok := NewThreadSafeStore(Indexers{}, Indices{}).(RangeIndexer); !ok {
+		t.Errorf("threadSafeMap should implement RangeIndexer")
+	}
+	c := &cache{
+		cacheStorage: testPlainThreadSafeStore{NewThreadSafeStore(Indexers{}, Indices{})},
+	}
+	if _, err := c.Query(IndexQuery{}); err == nil {
+		t.Errorf("expect error on a ThreadSafeStore without RangeIndexer")
+	}
+}
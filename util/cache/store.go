@@ -69,6 +69,7 @@ type cache struct {
 }
 
 var _ Store = &cache{}
+var _ QueryIndexer = &cache{}
 
 // Add inserts an item into the cache.
 func (c *cache) Add(obj interface{}) error {
@@ -140,6 +141,40 @@ func (c *cache) AddIndexers(newIndexers Indexers) error {
 	return c.cacheStorage.AddIndexers(newIndexers)
 }
 
+// IndexValuesInRange returns the sorted values of an index within [from, to)
+func (c *cache) IndexValuesInRange(indexName, from, to string) ([]string, error) {
+	indexer, err := rangeIndexer(c.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexValuesInRange(indexName, from, to)
+}
+
+func (c *cache) IndexKeysInRange(indexName, from, to string) ([]string, error) {
+	indexer, err := rangeIndexer(c.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexKeysInRange(indexName, from, to)
+}
+
+func (c *cache) IndexKeysWithPrefix(indexName, prefix string) ([]string, error) {
+	indexer, err := rangeIndexer(c.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.IndexKeysWithPrefix(indexName, prefix)
+}
+
+// Query returns a page of the items matching all the conditions of query
+func (c *cache) Query(query IndexQuery) (*IndexQueryResult, error) {
+	indexer, err := rangeIndexer(c.cacheStorage)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.Query(query)
+}
+
 // Get returns the requested item, or sets exists=false.
 // Get is completely threadsafe as long as you treat all items as immutable.
 func (c *cache) Get(obj interface{}) (item interface{}, exists bool, err error) {
@@ -193,3 +228,11 @@ func NewIndexer(keyFunc KeyFunc, indexers Indexers) Indexer {
 		keyFunc:      keyFunc,
 	}
 }
+
+// NewQueryIndexer returns a QueryIndexer implemented simply with a map and a lock.
+func NewQueryIndexer(keyFunc KeyFunc, indexers Indexers) QueryIndexer {
+	return &cache{
+		cacheStorage: NewThreadSafeStore(indexers, Indices{}),
+		keyFunc:      keyFunc,
+	}
+}
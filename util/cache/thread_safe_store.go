@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"sync"
 
+	"yunion.io/x/pkg/sortedstring"
 	"yunion.io/x/pkg/util/sets"
 )
 
@@ -52,7 +53,33 @@ type ThreadSafeStore interface {
 	Resync() error
 }
 
-// threadSafeMap implements ThreadSafeStore
+// RangeIndexer is implemented by the ThreadSafeStores whose indices are kept
+// ordered, so that they can serve range and prefix lookups as well as
+// composite paginated queries.
+type RangeIndexer interface {
+	// IndexValuesInRange returns the sorted index values v of the named
+	// index with from <= v < to, an empty bound being unbounded
+	IndexValuesInRange(indexName, from, to string) ([]string, error)
+	// IndexKeysInRange returns the sorted keys of the objects having an
+	// index value v with from <= v < to, an empty bound being unbounded
+	IndexKeysInRange(indexName, from, to string) ([]string, error)
+	// IndexKeysWithPrefix returns the sorted keys of the objects having an
+	// index value starting with prefix
+	IndexKeysWithPrefix(indexName, prefix string) ([]string, error)
+	// Query returns the objects matching all the conditions of query
+	Query(query IndexQuery) (*IndexQueryResult, error)
+}
+
+// rangeIndexer returns the RangeIndexer of store, if it supports one
+func rangeIndexer(store ThreadSafeStore) (RangeIndexer, error) {
+	indexer, ok := store.(RangeIndexer)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support range index queries", store)
+	}
+	return indexer, nil
+}
+
+// threadSafeMap implements ThreadSafeStore and RangeIndexer
 type threadSafeMap struct {
 	lock  sync.RWMutex
 	items map[string]interface{}
@@ -61,6 +88,9 @@ type threadSafeMap struct {
 	indexers Indexers
 	// indices maps a name to an Index
 	indices Indices
+	// sortedValues maps a name to the sorted values of its Index, to serve
+	// range queries
+	sortedValues map[string]sortedstring.SSortedStrings
 }
 
 func (c *threadSafeMap) Add(key string, obj interface{}) {
@@ -124,6 +154,7 @@ func (c *threadSafeMap) Replace(items map[string]interface{}, resourceVersion st
 
 	// rebuild any index
 	c.indices = Indices{}
+	c.sortedValues = map[string]sortedstring.SSortedStrings{}
 	for key, item := range c.items {
 		c.updateIndices(nil, item, key)
 	}
@@ -260,6 +291,7 @@ func (c *threadSafeMap) updateIndices(oldObj interface{}, newObj interface{}, ke
 			if set == nil {
 				set = sets.String{}
 				index[indexValue] = set
+				c.sortedValues[name] = c.sortedValues[name].Append(indexValue)
 			}
 			set.Insert(key)
 		}
@@ -283,6 +315,11 @@ func (c *threadSafeMap) deleteFromIndices(obj interface{}, key string) {
 			set := index[indexValue]
 			if set != nil {
 				set.Delete(key)
+				// drop empty sets so that range queries don't visit stale values
+				if set.Len() == 0 {
+					delete(index, indexValue)
+					c.sortedValues[name] = c.sortedValues[name].Remove(indexValue)
+				}
 			}
 		}
 	}
@@ -294,9 +331,18 @@ func (c *threadSafeMap) Resync() error {
 }
 
 func NewThreadSafeStore(indexers Indexers, indices Indices) ThreadSafeStore {
+	sortedValues := map[string]sortedstring.SSortedStrings{}
+	for name, index := range indices {
+		values := make([]string, 0, len(index))
+		for value := range index {
+			values = append(values, value)
+		}
+		sortedValues[name] = sortedstring.NewSortedStrings(values)
+	}
 	return &threadSafeMap{
-		items:    map[string]interface{}{},
-		indexers: indexers,
-		indices:  indices,
+		items:        map[string]interface{}{},
+		indexers:     indexers,
+		indices:      indices,
+		sortedValues: sortedValues,
 	}
 }
@@ -18,11 +18,13 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"reflect"
 	"strings"
 
 	"yunion.io/x/jsonutils"
 	"yunion.io/x/log"
 	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/tristate"
 	"yunion.io/x/pkg/util/seclib"
 	"yunion.io/x/pkg/utils"
 )
@@ -57,6 +59,9 @@ type SWriteFile struct {
 	Owner       string
 	Encoding    string
 	Content     string
+
+	// Extra keeps the keys not modeled above, e.g. defer
+	Extra map[string]jsonutils.JSONObject `json:"-"`
 }
 
 type SUser struct {
@@ -66,10 +71,15 @@ type SUser struct {
 	LockPasswd        bool
 	SshAuthorizedKeys []string
 	Sudo              string
+
+	// Extra keeps the keys not modeled above, e.g. groups
+	Extra map[string]jsonutils.JSONObject `json:"-"`
 }
 
 type SPhoneHome struct {
 	Url string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
 }
 
 type SCloudConfig struct {
@@ -81,6 +91,30 @@ type SCloudConfig struct {
 	PhoneHome   *SPhoneHome
 	DisableRoot int
 	SshPwauth   TSshPwauth
+
+	Hostname string
+	Fqdn     string
+	// ManageEtcHosts is a boolean, template or localhost
+	ManageEtcHosts   jsonutils.JSONObject
+	PreserveHostname tristate.TriState
+	Timezone         string
+
+	Mounts    [][]string
+	DiskSetup map[string]SDiskSetup
+	FsSetup   []SFsSetup
+
+	Ntp      *SNtp
+	CaCerts  *SCaCerts
+	Apt      *SApt
+	YumRepos map[string]SYumRepo
+
+	SshKeys       map[string]string
+	SshDeletekeys tristate.TriState
+	Chpasswd      *SChpasswd
+	PowerState    *SPowerState
+
+	// Extra keeps the cloud-config keys not modeled above
+	Extra map[string]jsonutils.JSONObject `json:"-"`
 }
 
 func NewWriteFile(path string, content string, perm string, owner string, isBase64 bool) SWriteFile {
@@ -177,13 +211,13 @@ func (u *SUser) Password(passwd string) *SUser {
 
 func (u *SUser) PowerShellScripts() []string {
 	shells := []string{}
-	shells = append(shells, fmt.Sprintf(`New-LocalUser -Name "%s" -Description "A New Local Account Created By PowerShell" -NoPassword`, u.Name))
-	shells = append(shells, fmt.Sprintf(`Add-LocalGroupMember -Group "Administrators" -Member "%s"`, u.Name))
+	shells = append(shells, fmt.Sprintf(`New-LocalUser -Name %s -Description "A New Local Account Created By PowerShell" -NoPassword`, psQuote(u.Name)))
+	shells = append(shells, fmt.Sprintf(`Add-LocalGroupMember -Group "Administrators" -Member %s`, psQuote(u.Name)))
 	if len(u.PlainTextPasswd) > 0 {
-		shells = append(shells, fmt.Sprintf(`net user "%s" "%s"`, u.Name, u.PlainTextPasswd))
+		shells = append(shells, fmt.Sprintf(`net user %s %s`, psQuote(u.Name), psQuote(u.PlainTextPasswd)))
 	}
 	// enable需要再设置密码之后，否则会出现Enable-LocalUser : Unable to update the password. The value provided for the new password does not meet the length, complexity, or history requirements of the domain
-	shells = append(shells, fmt.Sprintf(`Enable-LocalUser "%s"`, u.Name))
+	shells = append(shells, fmt.Sprintf(`Enable-LocalUser %s`, psQuote(u.Name)))
 	return shells
 }
 
@@ -214,6 +248,9 @@ func (u *SUser) ShellScripts() []string {
 func (conf *SCloudConfig) UserData() string {
 	var buf bytes.Buffer
 	jsonConf := jsonutils.Marshal(conf).(*jsonutils.JSONDict)
+	// the unmodeled keys of conf and its modules, before the default user
+	// is prepended to users
+	marshalExtra(reflect.ValueOf(conf), jsonConf)
 	if jsonConf.Contains("users") {
 		userArray := jsonutils.NewArray(jsonutils.NewString("default"))
 		users, _ := jsonConf.GetArray("users")
@@ -229,9 +266,13 @@ func (conf *SCloudConfig) UserData() string {
 
 func (conf *SCloudConfig) UserDataScript() string {
 	shells := []string{}
+	shells = append(shells, conf.hostnameShellScripts()...)
+	shells = append(shells, conf.diskShellScripts()...)
 	for _, u := range conf.Users {
 		shells = append(shells, u.ShellScripts()...)
 	}
+	shells = append(shells, conf.accountShellScripts()...)
+	shells = append(shells, conf.repoShellScripts()...)
 	shells = append(shells, conf.Runcmd...)
 
 	if conf.DisableRoot == 0 {
@@ -254,25 +295,17 @@ func (conf *SCloudConfig) UserDataScript() string {
 	for _, wf := range conf.WriteFiles {
 		shells = append(shells, wf.ShellScripts()...)
 	}
+	shells = append(shells, conf.powerStateShellScripts()...)
 	return CLOUD_SHELL_HEADER + strings.Join(shells, "\n")
 }
 
 func (conf *SCloudConfig) UserDataPowerShell() string {
-	shells := []string{}
-	for _, u := range conf.Users {
-		shells = append(shells, u.PowerShellScripts()...)
-	}
-	shells = append(shells, conf.Runcmd...)
-
+	shells := conf.PowerShellScripts(nil)
 	return CLOUD_POWER_SHELL_HEADER + strings.Join(shells, "\n")
 }
 
 func (conf *SCloudConfig) UserDataEc2() string {
-	shells := []string{}
-	for _, u := range conf.Users {
-		shells = append(shells, u.PowerShellScripts()...)
-	}
-	shells = append(shells, conf.Runcmd...)
+	shells := conf.PowerShellScripts(nil)
 	return "<powershell>\n" + strings.Join(shells, "\n") + "\n</powershell>"
 }
 
@@ -309,18 +342,39 @@ func parseShell(data string) (*SCloudConfig, error) {
 	return ret, nil
 }
 
+// ParseUserData parses a cloud-config or a shell script, or the merged
+// cloud-config of a multipart MIME archive or gzip compressed user-data
 func ParseUserData(data string) (*SCloudConfig, error) {
+	switch DetectUserDataType(data) {
+	case CONTENT_TYPE_GZIP, CONTENT_TYPE_MULTIPART:
+		m, err := ParseMultipartUserData(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "ParseMultipartUserData")
+		}
+		return m.CloudConfig()
+	}
 	if !strings.HasPrefix(data, CLOUD_CONFIG_HEADER) {
 		return parseShell(data)
 	}
+	return parseCloudConfig(data)
+}
+
+func parseCloudConfig(data string) (*SCloudConfig, error) {
 	jsonConf, err := jsonutils.ParseYAML(data)
 	if err != nil {
 		return nil, errors.Wrapf(err, "ParseYAML")
 	}
-	jsonDict := jsonConf.(*jsonutils.JSONDict)
+	jsonDict, ok := jsonConf.(*jsonutils.JSONDict)
+	if !ok {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "cloud-config is not a mapping")
+	}
+	return unmarshalCloudConfig(jsonDict)
+}
+
+func unmarshalCloudConfig(jsonDict *jsonutils.JSONDict) (*SCloudConfig, error) {
 	if jsonDict.Contains("users") {
 		userArray := jsonutils.NewArray()
-		users, _ := jsonConf.GetArray("users")
+		users, _ := jsonDict.GetArray("users")
 		if users != nil {
 			for i := 0; i < len(users); i++ {
 				if users[i].String() != `"default"` {
@@ -331,11 +385,12 @@ func ParseUserData(data string) (*SCloudConfig, error) {
 		}
 	}
 	config := SCloudConfig{}
-	err = jsonDict.Unmarshal(&config)
+	err := jsonDict.Unmarshal(&config)
 	if err != nil {
 		log.Errorf("unable to unmarchal userdata %s", err)
 		return nil, err
 	}
+	unmarshalExtra(jsonDict, reflect.ValueOf(&config))
 	return &config, nil
 }
 
@@ -427,4 +482,5 @@ func (conf *SCloudConfig) Merge(conf2 *SCloudConfig) {
 	for _, p := range conf2.Packages {
 		conf.MergePackage(p)
 	}
+	conf.mergeModules(conf2)
 }
@@ -0,0 +1,542 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * A minimal ISO9660 filesystem with Joliet extension for the seed images
+ * Reference: ECMA-119, Joliet Specification
+ *
+ */
+
+const (
+	isoSectorSize = 2048
+	// the volume descriptors start after the 16 sectors of system area
+	isoSystemAreaSectors = 16
+
+	isoVDPrimary       = 1
+	isoVDSupplementary = 2
+	isoVDTerminator    = 255
+
+	isoFlagDirectory = 0x02
+
+	isoJolietEscape = "%/E"
+)
+
+// sImageFile is a file or directory of a filesystem image
+type sImageFile struct {
+	name     string
+	isDir    bool
+	content  []byte
+	children []*sImageFile
+
+	// ISO9660 layout
+	extent       uint32
+	size         uint32
+	jolietExtent uint32
+	jolietSize   uint32
+	isoName      string
+	// FAT layout
+	cluster uint32
+}
+
+func newImageTree(files map[string][]byte) (*sImageFile, error) {
+	root := &sImageFile{isDir: true}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+		dir := root
+		for i, part := range parts {
+			var child *sImageFile
+			for _, c := range dir.children {
+				if c.name == part {
+					child = c
+					break
+				}
+			}
+			isDir := i < len(parts)-1
+			if child == nil {
+				child = &sImageFile{name: part, isDir: isDir}
+				dir.children = append(dir.children, child)
+			} else if child.isDir != isDir {
+				return nil, errors.Wrapf(errors.ErrInvalidFormat, "%s is both a file and a directory", name)
+			}
+			if !isDir {
+				child.content = files[name]
+			}
+			dir = child
+		}
+	}
+	return root, nil
+}
+
+// walk visits the directories breadth first, as the path table is ordered
+func (f *sImageFile) walkDirs(visit func(dir *sImageFile, parent int)) {
+	type sDirItem struct {
+		dir    *sImageFile
+		parent int
+	}
+	queue := []sDirItem{{f, 1}}
+	for i := 0; i < len(queue); i++ {
+		visit(queue[i].dir, queue[i].parent)
+		for _, c := range queue[i].dir.children {
+			if c.isDir {
+				queue = append(queue, sDirItem{c, i + 1})
+			}
+		}
+	}
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func isoRecordingTime(b []byte, t time.Time) {
+	b[0] = byte(t.Year() - 1900)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
+
+func isoVolumeTime(t time.Time) []byte {
+	return []byte(t.Format("20060102150405") + "00\x00")
+}
+
+func ucs2(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, c := range codes {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func fromUcs2(b []byte) string {
+	codes := make([]uint16, len(b)/2)
+	for i := range codes {
+		codes[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(codes))
+}
+
+// isoNames assigns the unique d-character names of the primary volume
+func isoNames(dir *sImageFile) {
+	used := map[string]bool{}
+	for _, c := range dir.children {
+		base, ext := c.name, ""
+		if !c.isDir {
+			if pos := strings.LastIndexByte(c.name, '.'); pos > 0 {
+				base, ext = c.name[:pos], c.name[pos+1:]
+			}
+		}
+		mangle := func(s string, max int) string {
+			s = strings.Map(func(r rune) rune {
+				switch {
+				case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+					return r
+				case r >= 'a' && r <= 'z':
+					return r - 'a' + 'A'
+				default:
+					return '_'
+				}
+			}, s)
+			if len(s) > max {
+				s = s[:max]
+			}
+			return s
+		}
+		base, ext = mangle(base, 24), mangle(ext, 5)
+		name := base
+		for i := 1; ; i++ {
+			name = base
+			if i > 1 {
+				name = fmt.Sprintf("%s_%d", base, i)
+			}
+			if !c.isDir {
+				name += "." + ext
+			}
+			if !used[name] {
+				break
+			}
+		}
+		used[name] = true
+		c.isoName = name
+		if !c.isDir {
+			c.isoName += ";1"
+		}
+	}
+}
+
+func isoDirRecord(extent, size uint32, flags byte, name []byte, t time.Time) []byte {
+	recLen := 33 + len(name)
+	if recLen%2 != 0 {
+		recLen++
+	}
+	rec := make([]byte, recLen)
+	rec[0] = byte(recLen)
+	putBoth32(rec[2:], extent)
+	putBoth32(rec[10:], size)
+	isoRecordingTime(rec[18:], t)
+	rec[25] = flags
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	return rec
+}
+
+func (f *sImageFile) isoChildName(joliet bool) []byte {
+	if joliet {
+		name := f.name
+		if !f.isDir {
+			name += ";1"
+		}
+		return ucs2(name)
+	}
+	return []byte(f.isoName)
+}
+
+func (f *sImageFile) sortedChildren(joliet bool) []*sImageFile {
+	children := make([]*sImageFile, len(f.children))
+	copy(children, f.children)
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(children[i].isoChildName(joliet), children[j].isoChildName(joliet)) < 0
+	})
+	return children
+}
+
+// isoDirectory returns the records of a directory, no record crosses a
+// sector boundary
+func isoDirectory(dir, parent *sImageFile, joliet bool, t time.Time) []byte {
+	extentOf := func(f *sImageFile) (uint32, uint32) {
+		if joliet && f.isDir {
+			return f.jolietExtent, f.jolietSize
+		}
+		return f.extent, f.size
+	}
+	var buf bytes.Buffer
+	appendRecord := func(rec []byte) {
+		if rem := isoSectorSize - buf.Len()%isoSectorSize; rem < len(rec) {
+			buf.Write(make([]byte, rem))
+		}
+		buf.Write(rec)
+	}
+	extent, size := extentOf(dir)
+	appendRecord(isoDirRecord(extent, size, isoFlagDirectory, []byte{0}, t))
+	extent, size = extentOf(parent)
+	appendRecord(isoDirRecord(extent, size, isoFlagDirectory, []byte{1}, t))
+	for _, c := range dir.sortedChildren(joliet) {
+		var flags byte
+		if c.isDir {
+			flags = isoFlagDirectory
+		}
+		extent, size := extentOf(c)
+		appendRecord(isoDirRecord(extent, size, flags, c.isoChildName(joliet), t))
+	}
+	if rem := buf.Len() % isoSectorSize; rem > 0 {
+		buf.Write(make([]byte, isoSectorSize-rem))
+	}
+	return buf.Bytes()
+}
+
+func isoPathTable(root *sImageFile, joliet bool, bigEndian bool) []byte {
+	var buf bytes.Buffer
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	root.walkDirs(func(dir *sImageFile, parent int) {
+		name := []byte{0}
+		extent := dir.extent
+		if joliet {
+			extent = dir.jolietExtent
+		}
+		if dir != root {
+			name = dir.isoChildName(joliet)
+		}
+		rec := make([]byte, 8+len(name)+len(name)%2)
+		rec[0] = byte(len(name))
+		order.PutUint32(rec[2:], extent)
+		order.PutUint16(rec[6:], uint16(parent))
+		copy(rec[8:], name)
+		buf.Write(rec)
+	})
+	return buf.Bytes()
+}
+
+func isoVolumeDescriptor(vdType byte, label string, totalSectors uint32, pathTableSize int, pathTables [4]uint32, rootRecord []byte, t time.Time) []byte {
+	vd := make([]byte, isoSectorSize)
+	vd[0] = vdType
+	copy(vd[1:], "CD001")
+	vd[6] = 1
+	fill := func(off, length int, s string) {
+		if vdType == isoVDSupplementary {
+			b := ucs2(s)
+			for i := 0; i < length; i += 2 {
+				// UCS-2 spaces
+				vd[off+i], vd[off+i+1] = 0, ' '
+			}
+			copy(vd[off:off+length], b)
+		} else {
+			copy(vd[off:off+length], strings.Repeat(" ", length))
+			copy(vd[off:off+length], s)
+		}
+	}
+	fill(8, 32, "LINUX")
+	fill(40, 32, label)
+	putBoth32(vd[80:], totalSectors)
+	if vdType == isoVDSupplementary {
+		copy(vd[88:], isoJolietEscape)
+	}
+	putBoth16(vd[120:], 1)
+	putBoth16(vd[124:], 1)
+	putBoth16(vd[128:], isoSectorSize)
+	putBoth32(vd[132:], uint32(pathTableSize))
+	binary.LittleEndian.PutUint32(vd[140:], pathTables[0])
+	binary.BigEndian.PutUint32(vd[148:], pathTables[2])
+	copy(vd[156:], rootRecord)
+	fill(190, 128, "")
+	fill(318, 128, "")
+	fill(446, 128, "")
+	fill(574, 128, "YUNION CLOUDINIT")
+	fill(702, 37, "")
+	fill(739, 37, "")
+	fill(776, 37, "")
+	copy(vd[813:], isoVolumeTime(t))
+	copy(vd[830:], isoVolumeTime(t))
+	copy(vd[847:], []byte("0000000000000000\x00"))
+	copy(vd[864:], []byte("0000000000000000\x00"))
+	vd[881] = 1
+	return vd
+}
+
+// buildISO9660 returns an ISO9660 image with Joliet names of the files
+// keyed by their paths
+func buildISO9660(label string, files map[string][]byte) ([]byte, error) {
+	root, err := newImageTree(files)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now().UTC()
+
+	// sizes of the directories, independent of the extents
+	dirs := []*sImageFile{}
+	root.walkDirs(func(dir *sImageFile, parent int) {
+		isoNames(dir)
+		dirs = append(dirs, dir)
+	})
+	for _, dir := range dirs {
+		dir.size = uint32(len(isoDirectory(dir, dir, false, t)))
+		dir.jolietSize = uint32(len(isoDirectory(dir, dir, true, t)))
+	}
+	pathTableSize := len(isoPathTable(root, false, false))
+	jolietPathTableSize := len(isoPathTable(root, true, false))
+
+	// layout: system area, PVD, SVD, terminator, path tables, directories, files
+	next := uint32(isoSystemAreaSectors + 3)
+	var pathTables, jolietPathTables [4]uint32
+	for i := 0; i < 4; i += 2 {
+		pathTables[i] = next
+		next += sectors(pathTableSize)
+	}
+	for i := 0; i < 4; i += 2 {
+		jolietPathTables[i] = next
+		next += sectors(jolietPathTableSize)
+	}
+	for _, dir := range dirs {
+		dir.extent = next
+		next += sectors(int(dir.size))
+		dir.jolietExtent = next
+		next += sectors(int(dir.jolietSize))
+	}
+	for _, dir := range dirs {
+		for _, c := range dir.children {
+			if !c.isDir {
+				c.extent = next
+				c.size = uint32(len(c.content))
+				next += sectors(len(c.content))
+			}
+		}
+	}
+	total := next
+
+	image := make([]byte, int(total)*isoSectorSize)
+	at := func(sector uint32) []byte {
+		return image[int(sector)*isoSectorSize:]
+	}
+	copy(at(isoSystemAreaSectors), isoVolumeDescriptor(isoVDPrimary, label, total, pathTableSize, pathTables,
+		isoDirRecord(root.extent, root.size, isoFlagDirectory, []byte{0}, t), t))
+	copy(at(isoSystemAreaSectors+1), isoVolumeDescriptor(isoVDSupplementary, label, total, jolietPathTableSize, jolietPathTables,
+		isoDirRecord(root.jolietExtent, root.jolietSize, isoFlagDirectory, []byte{0}, t), t))
+	at(isoSystemAreaSectors + 2)[0] = isoVDTerminator
+	copy(at(isoSystemAreaSectors + 2)[1:], "CD001")
+	at(isoSystemAreaSectors + 2)[6] = 1
+
+	copy(at(pathTables[0]), isoPathTable(root, false, false))
+	copy(at(pathTables[2]), isoPathTable(root, false, true))
+	copy(at(jolietPathTables[0]), isoPathTable(root, true, false))
+	copy(at(jolietPathTables[2]), isoPathTable(root, true, true))
+
+	parents := map[*sImageFile]*sImageFile{root: root}
+	for _, dir := range dirs {
+		for _, c := range dir.children {
+			parents[c] = dir
+		}
+		copy(at(dir.extent), isoDirectory(dir, parents[dir], false, t))
+		copy(at(dir.jolietExtent), isoDirectory(dir, parents[dir], true, t))
+		for _, c := range dir.children {
+			if !c.isDir {
+				copy(at(c.extent), c.content)
+			}
+		}
+	}
+	return image, nil
+}
+
+func isISO9660(image []byte) bool {
+	off := isoSystemAreaSectors*isoSectorSize + 1
+	return len(image) > off+5 && string(image[off:off+5]) == "CD001"
+}
+
+// readISO9660 returns the volume label and the files keyed by their paths,
+// with the Joliet names if present
+func readISO9660(image []byte) (string, map[string][]byte, error) {
+	var vd []byte
+	joliet := false
+	for sector := isoSystemAreaSectors; ; sector++ {
+		off := sector * isoSectorSize
+		if off+isoSectorSize > len(image) || string(image[off+1:off+6]) != "CD001" {
+			return "", nil, errors.Wrap(errors.ErrInvalidFormat, "invalid iso9660 volume descriptor")
+		}
+		desc := image[off : off+isoSectorSize]
+		if desc[0] == isoVDTerminator {
+			break
+		}
+		if desc[0] == isoVDPrimary && vd == nil {
+			vd = desc
+		} else if desc[0] == isoVDSupplementary && desc[88] == '%' && desc[89] == '/' && bytes.IndexByte([]byte("@CE"), desc[90]) >= 0 {
+			vd = desc
+			joliet = true
+		}
+	}
+	if vd == nil {
+		return "", nil, errors.Wrap(errors.ErrInvalidFormat, "missing primary volume descriptor")
+	}
+	label := string(vd[40:72])
+	if joliet {
+		label = fromUcs2(vd[40:72])
+	}
+	label = strings.TrimRight(label, " \x00")
+
+	files := map[string][]byte{}
+	readExtent := func(extent, size uint32) ([]byte, error) {
+		start := int(extent) * isoSectorSize
+		if start+int(size) > len(image) {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "extent %d out of image", extent)
+		}
+		return image[start : start+int(size)], nil
+	}
+	var readDir func(dirPath string, extent, size uint32, depth int) error
+	readDir = func(dirPath string, extent, size uint32, depth int) error {
+		if depth > 16 {
+			return errors.Wrap(errors.ErrInvalidFormat, "too deep directory")
+		}
+		data, err := readExtent(extent, size)
+		if err != nil {
+			return err
+		}
+		for off := 0; off < len(data); {
+			recLen := int(data[off])
+			if recLen == 0 {
+				// the rest of the sector is padding
+				off = (off/isoSectorSize + 1) * isoSectorSize
+				continue
+			}
+			if off+recLen > len(data) || recLen < 34 {
+				return errors.Wrap(errors.ErrInvalidFormat, "invalid directory record")
+			}
+			rec := data[off : off+recLen]
+			off += recLen
+			nameLen := int(rec[32])
+			if 33+nameLen > len(rec) {
+				return errors.Wrap(errors.ErrInvalidFormat, "invalid directory record name")
+			}
+			rawName := rec[33 : 33+nameLen]
+			if nameLen == 1 && rawName[0] <= 1 {
+				// . and ..
+				continue
+			}
+			name := string(rawName)
+			if joliet {
+				name = fromUcs2(rawName)
+			}
+			if pos := strings.LastIndexByte(name, ';'); pos >= 0 {
+				name = name[:pos]
+			}
+			if !joliet {
+				name = strings.TrimSuffix(strings.ToLower(name), ".")
+			}
+			childExtent := binary.LittleEndian.Uint32(rec[2:])
+			childSize := binary.LittleEndian.Uint32(rec[10:])
+			childPath := path.Join(dirPath, name)
+			if rec[25]&isoFlagDirectory != 0 {
+				if err := readDir(childPath, childExtent, childSize, depth+1); err != nil {
+					return err
+				}
+			} else {
+				content, err := readExtent(childExtent, childSize)
+				if err != nil {
+					return err
+				}
+				files[strings.TrimPrefix(childPath, "/")] = append([]byte{}, content...)
+			}
+		}
+		return nil
+	}
+	rootRec := vd[156:]
+	err := readDir("/", binary.LittleEndian.Uint32(rootRec[2:]), binary.LittleEndian.Uint32(rootRec[10:]), 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return label, files, nil
+}
@@ -0,0 +1,853 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/tristate"
+	"yunion.io/x/pkg/util/reflectutils"
+	"yunion.io/x/pkg/utils"
+)
+
+/*
+ * cloud-config modules
+ * Reference: https://cloudinit.readthedocs.io/en/latest/reference/modules.html
+ *
+ */
+
+const (
+	POWER_STATE_POWEROFF = "poweroff"
+	POWER_STATE_REBOOT   = "reboot"
+	POWER_STATE_HALT     = "halt"
+
+	CHPASSWD_TYPE_TEXT   = "text"
+	CHPASSWD_TYPE_HASH   = "hash"
+	CHPASSWD_TYPE_RANDOM = "RANDOM"
+
+	DISK_TABLE_GPT = "gpt"
+	DISK_TABLE_MBR = "mbr"
+
+	MOUNT_DEFAULT_OPTIONS = "defaults,nofail"
+
+	MANAGE_ETC_HOSTS_TEMPLATE  = "template"
+	MANAGE_ETC_HOSTS_LOCALHOST = "localhost"
+)
+
+// SDiskSetup partitions a disk, Layout is true to create a single partition
+// of the whole disk, or a list of partitions, each the percentage of the
+// disk or a list of the percentage and the partition type
+type SDiskSetup struct {
+	TableType string
+	Layout    jsonutils.JSONObject
+	Overwrite bool
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SFsSetup struct {
+	Label      string
+	Filesystem string
+	Device     string
+	// Partition is auto, any, none or the partition number
+	Partition string
+	Overwrite bool
+	ExtraOpts []string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SNtp struct {
+	Enabled   tristate.TriState
+	NtpClient string
+	Servers   []string
+	Pools     []string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SCaCerts struct {
+	RemoveDefaults bool `json:",omitfalse"`
+	Trusted        []string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SAptSource struct {
+	Source    string
+	Keyid     string
+	Key       string
+	Keyserver string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SApt struct {
+	Sources map[string]SAptSource
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SYumRepo struct {
+	Name     string
+	Baseurl  string
+	Enabled  bool
+	Gpgcheck bool
+	Gpgkey   string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SChpasswdUser struct {
+	Name     string
+	Password string
+	// Type is text, hash or RANDOM
+	Type string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SChpasswd struct {
+	Expire tristate.TriState
+	Users  []SChpasswdUser
+	// List is the deprecated form of Users, the user:password lines as a
+	// string or a list
+	List jsonutils.JSONObject
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+type SPowerState struct {
+	// Mode is poweroff, reboot or halt
+	Mode string
+	// Delay is now or +minutes
+	Delay   string
+	Message string
+	Timeout int `json:",omitzero"`
+	// Condition is a shell command, the power state changes if it succeeds
+	Condition string
+
+	Extra map[string]jsonutils.JSONObject `json:"-"`
+}
+
+var chpasswdHashRegexp = regexp.MustCompile(`^\$(1|2a|2y|5|6)(\$.+){2}$`)
+
+// allUsers returns Users and the users of the deprecated List
+func (c *SChpasswd) allUsers() []SChpasswdUser {
+	users := append([]SChpasswdUser{}, c.Users...)
+	lines := []string{}
+	switch list := c.List.(type) {
+	case *jsonutils.JSONString:
+		lines = strings.Split(list.Value(), "\n")
+	case *jsonutils.JSONArray:
+		items, _ := list.GetArray()
+		for _, item := range items {
+			line, _ := item.GetString()
+			lines = append(lines, line)
+		}
+	}
+	for _, line := range lines {
+		pos := strings.IndexByte(line, ':')
+		if pos <= 0 {
+			continue
+		}
+		u := SChpasswdUser{Name: strings.TrimSpace(line[:pos]), Password: line[pos+1:], Type: CHPASSWD_TYPE_TEXT}
+		switch {
+		case u.Password == "R" || u.Password == CHPASSWD_TYPE_RANDOM:
+			u.Type = CHPASSWD_TYPE_RANDOM
+		case chpasswdHashRegexp.MatchString(u.Password):
+			u.Type = CHPASSWD_TYPE_HASH
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+// NewMount returns a mounts entry, fstype and options are default if empty
+func NewMount(device, mountPoint, fstype, options string) []string {
+	if len(fstype) == 0 {
+		fstype = "auto"
+	}
+	if len(options) == 0 {
+		options = MOUNT_DEFAULT_OPTIONS
+	}
+	return []string{device, mountPoint, fstype, options, "0", "2"}
+}
+
+// NewDiskSetup returns a disk_setup entry of partitions of the percentages
+// of the disk, a single partition of the whole disk if none
+func NewDiskSetup(tableType string, overwrite bool, percentages ...int) SDiskSetup {
+	disk := SDiskSetup{TableType: tableType, Overwrite: overwrite}
+	if len(percentages) == 0 {
+		disk.Layout = jsonutils.JSONTrue
+	} else {
+		layout := jsonutils.NewArray()
+		for _, p := range percentages {
+			layout.Add(jsonutils.NewInt(int64(p)))
+		}
+		disk.Layout = layout
+	}
+	return disk
+}
+
+// partitions returns the percentages of the disk of the layout, nil if
+// the disk is not partitioned
+func (disk SDiskSetup) partitions() []int64 {
+	switch layout := disk.Layout.(type) {
+	case *jsonutils.JSONBool:
+		if b, _ := layout.Bool(); b {
+			return []int64{100}
+		}
+	case *jsonutils.JSONArray:
+		percentages := []int64{}
+		items, _ := layout.GetArray()
+		for _, item := range items {
+			// [percentage, partition type]
+			if part, ok := item.(*jsonutils.JSONArray); ok {
+				item, _ = part.GetAt(0)
+			}
+			if item == nil {
+				return nil
+			}
+			p, err := item.Int()
+			if err != nil || p <= 0 {
+				return nil
+			}
+			percentages = append(percentages, p)
+		}
+		return percentages
+	}
+	return nil
+}
+
+func NewYumRepo(name, baseurl, gpgkey string) SYumRepo {
+	return SYumRepo{
+		Name:     name,
+		Baseurl:  baseurl,
+		Enabled:  true,
+		Gpgcheck: len(gpgkey) > 0,
+		Gpgkey:   gpgkey,
+	}
+}
+
+var cloudConfigKeys map[string]bool
+
+func init() {
+	cloudConfigKeys = map[string]bool{}
+	t := reflect.TypeOf(SCloudConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		info := reflectutils.ParseStructFieldJsonInfo(t.Field(i))
+		if !info.Ignore {
+			cloudConfigKeys[info.MarshalName()] = true
+		}
+	}
+}
+
+// IsCloudConfigKey tells whether the key is modeled by SCloudConfig, the
+// others are kept in SCloudConfig.Extra
+func IsCloudConfigKey(key string) bool {
+	return cloudConfigKeys[key]
+}
+
+var extraMapType = reflect.TypeOf(map[string]jsonutils.JSONObject{})
+
+// jsonFields maps the marshal names of the fields of a struct type to their
+// index, the Extra field keeps the keys of the mapping not modeled
+func jsonFields(t reflect.Type) (map[string]int, int) {
+	fields := map[string]int{}
+	extra := -1
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		info := reflectutils.ParseStructFieldJsonInfo(field)
+		if info.Ignore {
+			if field.Name == "Extra" && field.Type == extraMapType {
+				extra = i
+			}
+			continue
+		}
+		fields[info.MarshalName()] = i
+	}
+	return fields, extra
+}
+
+// unmarshalExtra keeps the keys not modeled by the structs of val in their
+// Extra fields, val is the value unmarshaled from obj
+func unmarshalExtra(obj jsonutils.JSONObject, val reflect.Value) {
+	if obj == nil {
+		return
+	}
+	switch val.Kind() {
+	case reflect.Ptr:
+		if !val.IsNil() {
+			unmarshalExtra(obj, val.Elem())
+		}
+	case reflect.Struct:
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			return
+		}
+		fields, extra := jsonFields(val.Type())
+		for _, key := range dict.SortedKeys() {
+			value, _ := dict.Get(key)
+			if i, ok := fields[key]; ok {
+				unmarshalExtra(value, val.Field(i))
+			} else if extra >= 0 {
+				if val.Field(extra).IsNil() {
+					val.Field(extra).Set(reflect.ValueOf(map[string]jsonutils.JSONObject{}))
+				}
+				val.Field(extra).SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+			}
+		}
+	case reflect.Slice:
+		array, ok := obj.(*jsonutils.JSONArray)
+		if !ok {
+			return
+		}
+		items, _ := array.GetArray()
+		for i := 0; i < len(items) && i < val.Len(); i++ {
+			unmarshalExtra(items[i], val.Index(i))
+		}
+	case reflect.Map:
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok || val.Type().Elem().Kind() != reflect.Struct {
+			return
+		}
+		for _, key := range val.MapKeys() {
+			value, err := dict.Get(key.String())
+			if err != nil {
+				continue
+			}
+			// the map values are not addressable
+			elem := reflect.New(val.Type().Elem()).Elem()
+			elem.Set(val.MapIndex(key))
+			unmarshalExtra(value, elem)
+			val.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// marshalExtra adds the Extra fields of the structs of val to obj, the
+// value marshaled from val, the modeled keys take precedence
+func marshalExtra(val reflect.Value, obj jsonutils.JSONObject) jsonutils.JSONObject {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if !val.IsNil() {
+			return marshalExtra(val.Elem(), obj)
+		}
+	case reflect.Struct:
+		fields, extra := jsonFields(val.Type())
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			if obj != nil && obj != jsonutils.JSONNull {
+				return obj
+			}
+			// e.g. a struct of zero values but Extra
+			dict = jsonutils.NewDict()
+		}
+		for key, i := range fields {
+			value, _ := dict.Get(key)
+			if value2 := marshalExtra(val.Field(i), value); value2 != nil && value2 != value {
+				dict.Set(key, value2)
+			}
+		}
+		if extra >= 0 {
+			for key, value := range val.Field(extra).Interface().(map[string]jsonutils.JSONObject) {
+				if !dict.Contains(key) {
+					dict.Set(key, value)
+				}
+			}
+		}
+		if dict.Length() == 0 && dict != obj {
+			return obj
+		}
+		return dict
+	case reflect.Slice:
+		if array, ok := obj.(*jsonutils.JSONArray); ok {
+			items, _ := array.GetArray()
+			for i := 0; i < len(items) && i < val.Len(); i++ {
+				if item := marshalExtra(val.Index(i), items[i]); item != items[i] {
+					array.SetAt(i, item)
+				}
+			}
+		}
+	case reflect.Map:
+		if val.Type().Elem().Kind() != reflect.Struct {
+			return obj
+		}
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			return obj
+		}
+		for _, key := range val.MapKeys() {
+			value, _ := dict.Get(key.String())
+			if value2 := marshalExtra(val.MapIndex(key), value); value2 != nil && value2 != value {
+				dict.Set(key.String(), value2)
+			}
+		}
+	}
+	return obj
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// putFileCmd writes the content ended by a newline to path. Unlike
+// mkPutFileCmd, the content is base64 encoded so that no line of it can end
+// a heredoc or be run by the shell
+func putFileCmd(path string, content string, permission string) []string {
+	return putFileWordCmd(quote(path), content, permission)
+}
+
+// putFileWordCmd is putFileCmd for a path given as a shell word, e.g. with
+// a variable to expand, which must not contain any user value
+func putFileWordCmd(word string, content string, permission string) []string {
+	data := base64.StdEncoding.EncodeToString([]byte(strings.TrimSuffix(content, "\n") + "\n"))
+	cmds := []string{}
+	cmds = append(cmds, fmt.Sprintf(`mkdir -p "$(dirname %s)"`, word))
+	cmds = append(cmds, fmt.Sprintf("echo '%s' | base64 -d > %s", data, word))
+	return append(cmds, setFilePermission(word, permission, "")...)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// manageEtcHosts tells whether the hostname is added to /etc/hosts,
+// manage_etc_hosts is a boolean, template or localhost
+func (conf *SCloudConfig) manageEtcHosts() bool {
+	switch v := conf.ManageEtcHosts.(type) {
+	case *jsonutils.JSONBool:
+		b, _ := v.Bool()
+		return b
+	case *jsonutils.JSONString:
+		return utils.IsInStringArray(v.Value(), []string{MANAGE_ETC_HOSTS_TEMPLATE, MANAGE_ETC_HOSTS_LOCALHOST})
+	}
+	return false
+}
+
+func (conf *SCloudConfig) hostnameShellScripts() []string {
+	shells := []string{}
+	hostname := conf.Hostname
+	if len(hostname) == 0 && len(conf.Fqdn) > 0 {
+		hostname = strings.Split(conf.Fqdn, ".")[0]
+	}
+	if len(hostname) > 0 && !conf.PreserveHostname.IsTrue() {
+		shells = append(shells, fmt.Sprintf("hostnamectl set-hostname %s || (echo %s > /etc/hostname; hostname %s)", quote(hostname), quote(hostname), quote(hostname)))
+		if conf.manageEtcHosts() {
+			names := hostname
+			if len(conf.Fqdn) > 0 && conf.Fqdn != hostname {
+				names = conf.Fqdn + " " + hostname
+			}
+			shells = append(shells, `sed -i '/^127\.0\.1\.1\s/d' /etc/hosts`)
+			shells = append(shells, fmt.Sprintf("echo %s >> /etc/hosts", quote("127.0.1.1 "+names)))
+		}
+	}
+	if len(conf.Timezone) > 0 {
+		shells = append(shells, fmt.Sprintf("timedatectl set-timezone %s || ln -sf %s /etc/localtime", quote(conf.Timezone), quote("/usr/share/zoneinfo/"+conf.Timezone)))
+	}
+	return shells
+}
+
+func partitionDevice(device, partition string) string {
+	if _, err := fmt.Sscanf(partition, "%d", new(int)); err != nil {
+		return device
+	}
+	if len(device) > 0 && device[len(device)-1] >= '0' && device[len(device)-1] <= '9' {
+		// e.g. /dev/nvme0n1p1
+		return device + "p" + partition
+	}
+	return device + partition
+}
+
+func (conf *SCloudConfig) diskShellScripts() []string {
+	shells := []string{}
+	for _, dev := range sortedKeys(conf.DiskSetup) {
+		disk := conf.DiskSetup[dev]
+		percentages := disk.partitions()
+		if len(percentages) == 0 {
+			continue
+		}
+		label := "gpt"
+		if disk.TableType == DISK_TABLE_MBR {
+			label = "msdos"
+		}
+		cmd := fmt.Sprintf("parted -s %s mklabel %s", quote(dev), label)
+		start := int64(0)
+		for _, p := range percentages {
+			end := start + p
+			if end > 100 {
+				end = 100
+			}
+			cmd += fmt.Sprintf(" mkpart primary %d%% %d%%", start, end)
+			start = end
+		}
+		if !disk.Overwrite {
+			cmd = fmt.Sprintf(`[ -n "$(lsblk -no PTTYPE %s 2>/dev/null)" ] || %s`, quote(dev), cmd)
+		}
+		shells = append(shells, cmd, "partprobe "+quote(dev)+" || true")
+	}
+	for _, fs := range conf.FsSetup {
+		if len(fs.Device) == 0 || len(fs.Filesystem) == 0 {
+			continue
+		}
+		dev := partitionDevice(fs.Device, fs.Partition)
+		args := []string{quote("mkfs." + fs.Filesystem)}
+		if len(fs.Label) > 0 {
+			args = append(args, "-L", quote(fs.Label))
+		}
+		for _, opt := range fs.ExtraOpts {
+			args = append(args, quote(opt))
+		}
+		args = append(args, quote(dev))
+		cmd := strings.Join(args, " ")
+		if !fs.Overwrite {
+			cmd = fmt.Sprintf(`[ -n "$(blkid -o value -s TYPE %s)" ] || %s`, quote(dev), cmd)
+		}
+		shells = append(shells, cmd)
+	}
+	for _, mount := range conf.Mounts {
+		if len(mount) < 2 || mount[1] == "none" {
+			continue
+		}
+		entry := NewMount(mount[0], mount[1], "", "")
+		copy(entry, mount)
+		shells = append(shells, "mkdir -p "+quote(entry[1]))
+		shells = append(shells, fmt.Sprintf(`awk -v m=%s '$2 == m {found=1} END {exit !found}' /etc/fstab || echo %s >> /etc/fstab`, quote(entry[1]), quote(strings.Join(entry, "\t"))))
+	}
+	if len(conf.Mounts) > 0 {
+		shells = append(shells, "mount -a || true")
+	}
+	return shells
+}
+
+func (conf *SCloudConfig) repoShellScripts() []string {
+	shells := []string{}
+	if conf.CaCerts != nil && len(conf.CaCerts.Trusted) > 0 {
+		// remove_defaults is not rendered for the images without cloud-init
+		shells = append(shells, "CA_DIR=/usr/local/share/ca-certificates; [ -d /etc/pki/ca-trust/source/anchors ] && CA_DIR=/etc/pki/ca-trust/source/anchors")
+		for i, cert := range conf.CaCerts.Trusted {
+			shells = append(shells, putFileWordCmd(fmt.Sprintf(`"$CA_DIR"/cloud-init-ca-cert-%d.crt`, i+1), cert, "644")...)
+		}
+		shells = append(shells, "update-ca-certificates || update-ca-trust")
+	}
+	if conf.Apt != nil && len(conf.Apt.Sources) > 0 {
+		shells = append(shells, "if which apt-get &>/dev/null; then")
+		for _, name := range sortedKeys(conf.Apt.Sources) {
+			src := conf.Apt.Sources[name]
+			filename := strings.TrimSuffix(name, ".list")
+			if len(src.Key) > 0 {
+				shells = append(shells, putFileCmd("/etc/apt/trusted.gpg.d/"+filename+".asc", src.Key, "644")...)
+			} else if len(src.Keyid) > 0 {
+				keyserver := src.Keyserver
+				if len(keyserver) == 0 {
+					keyserver = "keyserver.ubuntu.com"
+				}
+				shells = append(shells, fmt.Sprintf("apt-key adv --keyserver %s --recv-keys %s", quote(keyserver), quote(src.Keyid)))
+			}
+			if len(src.Source) > 0 {
+				shells = append(shells, putFileCmd("/etc/apt/sources.list.d/"+filename+".list", src.Source, "644")...)
+			}
+		}
+		shells = append(shells, "apt-get update")
+		shells = append(shells, "fi")
+	}
+	if len(conf.YumRepos) > 0 {
+		shells = append(shells, "if [ -d /etc/yum.repos.d ]; then")
+		for _, id := range sortedKeys(conf.YumRepos) {
+			repo := conf.YumRepos[id]
+			lines := []string{"[" + id + "]"}
+			if len(repo.Name) > 0 {
+				lines = append(lines, "name="+repo.Name)
+			}
+			if len(repo.Baseurl) > 0 {
+				lines = append(lines, "baseurl="+repo.Baseurl)
+			}
+			lines = append(lines, fmt.Sprintf("enabled=%d", boolInt(repo.Enabled)))
+			lines = append(lines, fmt.Sprintf("gpgcheck=%d", boolInt(repo.Gpgcheck)))
+			if len(repo.Gpgkey) > 0 {
+				lines = append(lines, "gpgkey="+repo.Gpgkey)
+			}
+			// e.g. mirrorlist, metalink
+			for _, k := range sortedKeys(repo.Extra) {
+				lines = append(lines, k+"="+yumRepoValue(repo.Extra[k]))
+			}
+			shells = append(shells, putFileCmd("/etc/yum.repos.d/"+id+".repo", strings.Join(lines, "\n"), "644")...)
+		}
+		shells = append(shells, "fi")
+	}
+	if conf.Ntp != nil && !conf.Ntp.Enabled.IsFalse() && (len(conf.Ntp.Servers) > 0 || len(conf.Ntp.Pools) > 0) {
+		chrony := []string{}
+		for _, s := range conf.Ntp.Servers {
+			chrony = append(chrony, quote("server "+s+" iburst"))
+		}
+		for _, p := range conf.Ntp.Pools {
+			chrony = append(chrony, quote("pool "+p+" iburst"))
+		}
+		shells = append(shells, "for f in /etc/chrony.conf /etc/chrony/chrony.conf; do")
+		shells = append(shells, `[ -f $f ] && sed -i '/^\(server\|pool\)\s/d' $f && printf '%s\n' `+strings.Join(chrony, " ")+` >> $f`)
+		shells = append(shells, "done")
+		timesyncd := fmt.Sprintf("[Time]\nNTP=%s", strings.Join(append(append([]string{}, conf.Ntp.Servers...), conf.Ntp.Pools...), " "))
+		shells = append(shells, putFileCmd("/etc/systemd/timesyncd.conf.d/cloud-init.conf", timesyncd, "644")...)
+		shells = append(shells, "systemctl restart chronyd chrony systemd-timesyncd 2>/dev/null || true")
+	}
+	return shells
+}
+
+func yumRepoValue(v jsonutils.JSONObject) string {
+	switch val := v.(type) {
+	case *jsonutils.JSONString:
+		return val.Value()
+	case *jsonutils.JSONBool:
+		b, _ := val.Bool()
+		return fmt.Sprintf("%d", boolInt(b))
+	case *jsonutils.JSONArray:
+		items, _ := val.GetArray()
+		values := make([]string, len(items))
+		for i := range items {
+			values[i] = yumRepoValue(items[i])
+		}
+		return strings.Join(values, " ")
+	}
+	return v.String()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (conf *SCloudConfig) accountShellScripts() []string {
+	shells := []string{}
+	if conf.Chpasswd != nil {
+		for _, u := range conf.Chpasswd.allUsers() {
+			switch {
+			case u.Type == CHPASSWD_TYPE_HASH:
+				shells = append(shells, fmt.Sprintf("usermod -p %s %s", quote(u.Password), quote(u.Name)))
+			case u.Type == CHPASSWD_TYPE_RANDOM || u.Password == CHPASSWD_TYPE_RANDOM:
+				shells = append(shells, fmt.Sprintf(`echo %s"$(head -c 12 /dev/urandom | base64)" | chpasswd`, quote(u.Name+":")))
+			default:
+				shells = append(shells, fmt.Sprintf("echo %s | chpasswd", quote(u.Name+":"+u.Password)))
+			}
+			// the passwords expire by default
+			if !conf.Chpasswd.Expire.IsFalse() {
+				shells = append(shells, "passwd -e "+quote(u.Name))
+			}
+		}
+	}
+	if conf.SshDeletekeys.IsTrue() {
+		shells = append(shells, "rm -f /etc/ssh/ssh_host_*key*")
+	}
+	for _, name := range sortedKeys(conf.SshKeys) {
+		// e.g. rsa_private, rsa_public, rsa_certificate
+		pos := strings.LastIndexByte(name, '_')
+		if pos <= 0 {
+			continue
+		}
+		keyType, kind := name[:pos], name[pos+1:]
+		switch kind {
+		case "private":
+			shells = append(shells, putFileCmd(fmt.Sprintf("/etc/ssh/ssh_host_%s_key", keyType), conf.SshKeys[name], "600")...)
+		case "public":
+			shells = append(shells, putFileCmd(fmt.Sprintf("/etc/ssh/ssh_host_%s_key.pub", keyType), conf.SshKeys[name], "644")...)
+		case "certificate":
+			shells = append(shells, putFileCmd(fmt.Sprintf("/etc/ssh/ssh_host_%s_key-cert.pub", keyType), conf.SshKeys[name], "644")...)
+		}
+	}
+	if conf.SshDeletekeys.IsTrue() || len(conf.SshKeys) > 0 {
+		shells = append(shells, "ssh-keygen -A")
+	}
+	return shells
+}
+
+func (conf *SCloudConfig) powerStateShellScripts() []string {
+	ps := conf.PowerState
+	if ps == nil || len(ps.Mode) == 0 {
+		return nil
+	}
+	flag := map[string]string{
+		POWER_STATE_POWEROFF: "-P",
+		POWER_STATE_REBOOT:   "-r",
+		POWER_STATE_HALT:     "-H",
+	}[ps.Mode]
+	if len(flag) == 0 {
+		return nil
+	}
+	delay := ps.Delay
+	if len(delay) == 0 {
+		delay = "now"
+	}
+	cmd := fmt.Sprintf("shutdown %s %s", flag, quote(delay))
+	if len(ps.Message) > 0 {
+		cmd += " " + quote(ps.Message)
+	}
+	if len(ps.Condition) > 0 {
+		cmd = fmt.Sprintf("sh -c %s && %s", quote(ps.Condition), cmd)
+	}
+	// let the script finish before shutdown
+	return []string{fmt.Sprintf("(sleep 1; %s) &", cmd)}
+}
+
+func mergeStrings(dst []string, src []string) []string {
+	for _, s := range src {
+		if !utils.IsInStringArray(s, dst) {
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
+
+// mergeModules merges the modules of conf2 absent from conf
+func (conf *SCloudConfig) mergeModules(conf2 *SCloudConfig) {
+	for _, m := range conf2.Mounts {
+		exist := false
+		for _, m0 := range conf.Mounts {
+			if len(m0) > 1 && len(m) > 1 && m0[1] == m[1] {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			conf.Mounts = append(conf.Mounts, m)
+		}
+	}
+	for dev, disk := range conf2.DiskSetup {
+		if conf.DiskSetup == nil {
+			conf.DiskSetup = map[string]SDiskSetup{}
+		}
+		if _, ok := conf.DiskSetup[dev]; !ok {
+			conf.DiskSetup[dev] = disk
+		}
+	}
+	for _, fs := range conf2.FsSetup {
+		exist := false
+		for _, fs0 := range conf.FsSetup {
+			if fs0.Device == fs.Device && fs0.Partition == fs.Partition {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			conf.FsSetup = append(conf.FsSetup, fs)
+		}
+	}
+	if conf2.Ntp != nil {
+		if conf.Ntp == nil {
+			ntp := *conf2.Ntp
+			conf.Ntp = &ntp
+		} else {
+			conf.Ntp.Servers = mergeStrings(conf.Ntp.Servers, conf2.Ntp.Servers)
+			conf.Ntp.Pools = mergeStrings(conf.Ntp.Pools, conf2.Ntp.Pools)
+		}
+	}
+	if len(conf.Timezone) == 0 {
+		conf.Timezone = conf2.Timezone
+	}
+	if len(conf.Hostname) == 0 {
+		conf.Hostname = conf2.Hostname
+	}
+	if len(conf.Fqdn) == 0 {
+		conf.Fqdn = conf2.Fqdn
+	}
+	if conf.ManageEtcHosts == nil {
+		conf.ManageEtcHosts = conf2.ManageEtcHosts
+	}
+	if conf.PreserveHostname.IsNone() {
+		conf.PreserveHostname = conf2.PreserveHostname
+	}
+	if conf2.CaCerts != nil {
+		if conf.CaCerts == nil {
+			conf.CaCerts = &SCaCerts{}
+		}
+		conf.CaCerts.RemoveDefaults = conf.CaCerts.RemoveDefaults || conf2.CaCerts.RemoveDefaults
+		conf.CaCerts.Trusted = mergeStrings(conf.CaCerts.Trusted, conf2.CaCerts.Trusted)
+	}
+	if conf2.Apt != nil {
+		if conf.Apt == nil {
+			conf.Apt = &SApt{}
+		}
+		for name, src := range conf2.Apt.Sources {
+			if conf.Apt.Sources == nil {
+				conf.Apt.Sources = map[string]SAptSource{}
+			}
+			if _, ok := conf.Apt.Sources[name]; !ok {
+				conf.Apt.Sources[name] = src
+			}
+		}
+	}
+	for id, repo := range conf2.YumRepos {
+		if conf.YumRepos == nil {
+			conf.YumRepos = map[string]SYumRepo{}
+		}
+		if _, ok := conf.YumRepos[id]; !ok {
+			conf.YumRepos[id] = repo
+		}
+	}
+	for name, key := range conf2.SshKeys {
+		if conf.SshKeys == nil {
+			conf.SshKeys = map[string]string{}
+		}
+		if _, ok := conf.SshKeys[name]; !ok {
+			conf.SshKeys[name] = key
+		}
+	}
+	if conf.SshDeletekeys.IsNone() {
+		conf.SshDeletekeys = conf2.SshDeletekeys
+	}
+	if conf2.Chpasswd != nil {
+		if conf.Chpasswd == nil {
+			conf.Chpasswd = &SChpasswd{Expire: conf2.Chpasswd.Expire}
+		}
+		for _, u := range conf2.Chpasswd.Users {
+			exist := false
+			for _, u0 := range conf.Chpasswd.Users {
+				if u0.Name == u.Name {
+					exist = true
+					break
+				}
+			}
+			if !exist {
+				conf.Chpasswd.Users = append(conf.Chpasswd.Users, u)
+			}
+		}
+	}
+	if conf.PowerState == nil {
+		conf.PowerState = conf2.PowerState
+	}
+	for k, v := range conf2.Extra {
+		if conf.Extra == nil {
+			conf.Extra = map[string]jsonutils.JSONObject{}
+		}
+		if _, ok := conf.Extra[k]; !ok {
+			conf.Extra[k] = v
+		}
+	}
+}
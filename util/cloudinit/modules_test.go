@@ -0,0 +1,349 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+
+	"yunion.io/x/jsonutils"
+
+	"yunion.io/x/pkg/tristate"
+)
+
+const modulesUserData = `#cloud-config
+hostname: web1
+fqdn: web1.example.com
+manage_etc_hosts: true
+timezone: Asia/Shanghai
+mounts:
+- [/dev/vdb1, /data, ext4, "defaults,nofail", "0", "2"]
+disk_setup:
+  /dev/vdb:
+    table_type: gpt
+    layout: true
+    overwrite: false
+fs_setup:
+- label: data
+  filesystem: ext4
+  device: /dev/vdb
+  partition: "1"
+ntp:
+  enabled: true
+  servers: [ntp1.example.com]
+  pools: [pool.ntp.org]
+ca_certs:
+  trusted:
+  - |
+    -----BEGIN CERTIFICATE-----
+    MIIB
+    -----END CERTIFICATE-----
+yum_repos:
+  epel:
+    name: EPEL
+    baseurl: http://mirror.example.com/epel/$releasever/$basearch
+    enabled: true
+    gpgcheck: false
+apt:
+  sources:
+    docker.list:
+      source: deb [arch=amd64] https://download.docker.com/linux/ubuntu jammy stable
+      keyid: 9DC858229FC7DD38854AE2D88D81803C0EBFCD88
+ssh_deletekeys: true
+ssh_keys:
+  rsa_private: PRIVATE
+  rsa_public: ssh-rsa AAAA
+chpasswd:
+  expire: false
+  users:
+  - name: root
+    password: passw0rd
+    type: text
+power_state:
+  mode: reboot
+  delay: "+1"
+  message: rebooting
+unknown_module:
+  key: value
+`
+
+func TestModulesParse(t *testing.T) {
+	conf, err := ParseUserData(modulesUserData)
+	if err != nil {
+		t.Fatalf("ParseUserData: %s", err)
+	}
+	if conf.Hostname != "web1" || conf.Fqdn != "web1.example.com" || !conf.manageEtcHosts() || conf.Timezone != "Asia/Shanghai" {
+		t.Errorf("hostname: %#v", conf)
+	}
+	if len(conf.Mounts) != 1 || conf.Mounts[0][1] != "/data" {
+		t.Errorf("mounts: %v", conf.Mounts)
+	}
+	if len(conf.DiskSetup["/dev/vdb"].partitions()) != 1 || len(conf.FsSetup) != 1 || conf.FsSetup[0].Partition != "1" {
+		t.Errorf("disk: %v %v", conf.DiskSetup, conf.FsSetup)
+	}
+	if conf.Ntp == nil || len(conf.Ntp.Servers) != 1 || len(conf.Ntp.Pools) != 1 {
+		t.Errorf("ntp: %v", conf.Ntp)
+	}
+	if conf.CaCerts == nil || len(conf.CaCerts.Trusted) != 1 {
+		t.Errorf("ca_certs: %v", conf.CaCerts)
+	}
+	if conf.YumRepos["epel"].Baseurl == "" || conf.Apt == nil || conf.Apt.Sources["docker.list"].Keyid == "" {
+		t.Errorf("repos: %v %v", conf.YumRepos, conf.Apt)
+	}
+	if !conf.SshDeletekeys.IsTrue() || conf.SshKeys["rsa_public"] != "ssh-rsa AAAA" {
+		t.Errorf("ssh_keys: %v", conf.SshKeys)
+	}
+	if conf.Chpasswd == nil || !conf.Chpasswd.Expire.IsFalse() || len(conf.Chpasswd.Users) != 1 {
+		t.Errorf("chpasswd: %v", conf.Chpasswd)
+	}
+	if conf.PowerState == nil || conf.PowerState.Mode != POWER_STATE_REBOOT {
+		t.Errorf("power_state: %v", conf.PowerState)
+	}
+	if _, ok := conf.Extra["unknown_module"]; !ok || len(conf.Extra) != 1 {
+		t.Errorf("extra: %v", conf.Extra)
+	}
+
+	// round trip
+	conf2, err := ParseUserData(conf.UserData())
+	if err != nil {
+		t.Fatalf("ParseUserData round trip: %s", err)
+	}
+	if conf.UserData() != conf2.UserData() {
+		t.Errorf("round trip mismatch:\n%s\n%s", conf.UserData(), conf2.UserData())
+	}
+	if !strings.Contains(conf2.UserData(), "unknown_module:") {
+		t.Errorf("unknown key lost: %s", conf2.UserData())
+	}
+}
+
+func TestModulesMerge(t *testing.T) {
+	conf := &SCloudConfig{
+		Timezone: "UTC",
+		Ntp:      &SNtp{Servers: []string{"a"}},
+	}
+	conf2, err := ParseUserData(modulesUserData)
+	if err != nil {
+		t.Fatalf("ParseUserData: %s", err)
+	}
+	conf.Merge(conf2)
+	if conf.Timezone != "UTC" || conf.Hostname != "web1" {
+		t.Errorf("scalar merge: %s %s", conf.Timezone, conf.Hostname)
+	}
+	if len(conf.Ntp.Servers) != 2 || len(conf.Ntp.Pools) != 1 {
+		t.Errorf("ntp merge: %v", conf.Ntp)
+	}
+	if len(conf.Mounts) != 1 || len(conf.YumRepos) != 1 || conf.Extra["unknown_module"] == nil {
+		t.Errorf("merge: %#v", conf)
+	}
+	conf.Merge(conf2)
+	if len(conf.Mounts) != 1 || len(conf.FsSetup) != 1 || len(conf.Chpasswd.Users) != 1 {
+		t.Errorf("merge twice duplicates: %#v", conf)
+	}
+}
+
+var testPutFileRegexp = regexp.MustCompile(`echo '([A-Za-z0-9+/=]*)' \| base64 -d > `)
+
+// decodeTestScript appends the decoded content to the commands writing a
+// file, so that the content can be looked for in the script
+func decodeTestScript(script string) string {
+	return testPutFileRegexp.ReplaceAllStringFunc(script, func(cmd string) string {
+		data, _ := base64.StdEncoding.DecodeString(testPutFileRegexp.FindStringSubmatch(cmd)[1])
+		return string(data) + cmd
+	})
+}
+
+func TestModulesShellScripts(t *testing.T) {
+	conf, err := ParseUserData(modulesUserData)
+	if err != nil {
+		t.Fatalf("ParseUserData: %s", err)
+	}
+	script := decodeTestScript(conf.UserDataScript())
+	for _, want := range []string{
+		"hostnamectl set-hostname 'web1'",
+		"127.0.1.1 web1.example.com web1",
+		"timedatectl set-timezone 'Asia/Shanghai'",
+		"parted -s '/dev/vdb' mklabel gpt",
+		"'mkfs.ext4' -L 'data' '/dev/vdb1'",
+		"/dev/vdb1\t/data\text4\tdefaults,nofail\t0\t2",
+		"update-ca-certificates || update-ca-trust",
+		"/etc/yum.repos.d/epel.repo",
+		"baseurl=http://mirror.example.com/epel/$releasever/$basearch",
+		"/etc/apt/sources.list.d/docker.list",
+		"printf '%s\\n' 'server ntp1.example.com iburst' 'pool pool.ntp.org iburst' >> $f",
+		"rm -f /etc/ssh/ssh_host_*key*",
+		"/etc/ssh/ssh_host_rsa_key.pub",
+		"echo 'root:passw0rd' | chpasswd",
+		"(sleep 1; shutdown -r '+1' 'rebooting') &",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q", want)
+		}
+	}
+	if strings.Contains(script, "passwd -e root") {
+		t.Errorf("password should not expire")
+	}
+	if !strings.HasSuffix(script, "&") {
+		t.Errorf("power state should be last")
+	}
+
+	conf = &SCloudConfig{
+		Chpasswd: &SChpasswd{Expire: tristate.None, Users: []SChpasswdUser{{Name: "bob", Password: "$6$x", Type: CHPASSWD_TYPE_HASH}}},
+	}
+	script = conf.UserDataScript()
+	if !strings.Contains(script, "usermod -p '$6$x' 'bob'") || !strings.Contains(script, "passwd -e 'bob'") {
+		t.Errorf("chpasswd hash: %s", script)
+	}
+}
+
+const unmodeledUserData = `#cloud-config
+manage_etc_hosts: localhost
+hostname: web1
+users:
+- default
+- name: ops
+  groups: [wheel, docker]
+write_files:
+- path: /etc/motd
+  content: hello
+  defer: true
+disk_setup:
+  /dev/vdb:
+    table_type: gpt
+    layout: [50, [50, 82]]
+chpasswd:
+  expire: false
+  list: |
+    root:passw0rd
+    bob:RANDOM
+ntp:
+  ntp_client: chrony
+  servers: [ntp1.example.com]
+yum_repos:
+  epel:
+    name: EPEL
+    mirrorlist: https://mirrors.example.com/metalink?repo=epel-$releasever
+apt:
+  preserve_sources_list: true
+  primary:
+  - arches: [default]
+    uri: http://mirror.example.com/ubuntu
+`
+
+func TestModulesRoundTripUnmodeled(t *testing.T) {
+	conf, err := ParseUserData(unmodeledUserData)
+	if err != nil {
+		t.Fatalf("ParseUserData: %s", err)
+	}
+	if p := conf.DiskSetup["/dev/vdb"].partitions(); len(p) != 2 || p[0] != 50 || p[1] != 50 {
+		t.Errorf("layout: %v", p)
+	}
+	if !conf.manageEtcHosts() || conf.Ntp.NtpClient != "chrony" {
+		t.Errorf("manage_etc_hosts %s, ntp_client %s", conf.ManageEtcHosts, conf.Ntp.NtpClient)
+	}
+	userData := conf.UserData()
+	conf2, err := ParseUserData(userData)
+	if err != nil {
+		t.Fatalf("ParseUserData round trip: %s", err)
+	}
+	if userData != conf2.UserData() {
+		t.Errorf("round trip mismatch:\n%s\n%s", userData, conf2.UserData())
+	}
+	for _, want := range []string{
+		"manage_etc_hosts: localhost",
+		"groups:",
+		"defer: true",
+		"- 50\n",
+		"- 82\n",
+		"root:passw0rd",
+		"ntp_client: chrony",
+		"mirrorlist: https://mirrors.example.com/metalink?repo=epel-$releasever",
+		"preserve_sources_list: true",
+		"uri: http://mirror.example.com/ubuntu",
+	} {
+		if !strings.Contains(userData, want) {
+			t.Errorf("user data missing %q:\n%s", want, userData)
+		}
+	}
+
+	script := decodeTestScript(conf.UserDataScript())
+	for _, want := range []string{
+		"127.0.1.1 web1",
+		"mkpart primary 0% 50% mkpart primary 50% 100%",
+		"mirrorlist=https://mirrors.example.com/metalink?repo=epel-$releasever",
+		"echo 'root:passw0rd' | chpasswd",
+		"echo 'bob:'\"$(head -c 12 /dev/urandom | base64)\" | chpasswd",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestNewDiskSetup(t *testing.T) {
+	conf := &SCloudConfig{DiskSetup: map[string]SDiskSetup{
+		"/dev/vdb": NewDiskSetup(DISK_TABLE_GPT, false),
+		"/dev/vdc": NewDiskSetup(DISK_TABLE_MBR, true, 30, 70),
+	}}
+	userData := conf.UserData()
+	if !strings.Contains(userData, "layout: true") || !strings.Contains(userData, "- 30\n") {
+		t.Errorf("user data: %s", userData)
+	}
+	conf2, err := ParseUserData(userData)
+	if err != nil {
+		t.Fatalf("ParseUserData: %s", err)
+	}
+	if p := conf2.DiskSetup["/dev/vdc"].partitions(); len(p) != 2 || p[1] != 70 {
+		t.Errorf("layout: %v", p)
+	}
+	if p := conf2.DiskSetup["/dev/vdb"].partitions(); len(p) != 1 || p[0] != 100 {
+		t.Errorf("layout: %v", p)
+	}
+}
+
+func TestModulesShellQuote(t *testing.T) {
+	conf := &SCloudConfig{
+		Hostname:       "a;reboot",
+		ManageEtcHosts: jsonutils.JSONTrue,
+		Timezone:       "UTC$(reboot)",
+		DiskSetup:      map[string]SDiskSetup{"/dev/vdb;reboot": NewDiskSetup(DISK_TABLE_GPT, false)},
+		FsSetup:        []SFsSetup{{Device: "/dev/vdb;reboot", Filesystem: "ext4", Partition: "1"}},
+		Mounts:         [][]string{{"/dev/vdb1", "/data'; reboot; '"}},
+		Chpasswd:       &SChpasswd{Expire: tristate.False, Users: []SChpasswdUser{{Name: "bob;reboot", Password: "$6$x", Type: CHPASSWD_TYPE_HASH}}},
+		CaCerts:        &SCaCerts{Trusted: []string{"-----BEGIN\n_END\nreboot"}},
+	}
+	script := decodeTestScript(conf.UserDataScript())
+	for _, want := range []string{
+		"hostnamectl set-hostname 'a;reboot' || (echo 'a;reboot' > /etc/hostname; hostname 'a;reboot')",
+		"echo '127.0.1.1 a;reboot' >> /etc/hosts",
+		"timedatectl set-timezone 'UTC$(reboot)' || ln -sf '/usr/share/zoneinfo/UTC$(reboot)' /etc/localtime",
+		"parted -s '/dev/vdb;reboot' mklabel gpt",
+		"partprobe '/dev/vdb;reboot' || true",
+		"'mkfs.ext4' '/dev/vdb;reboot1'",
+		`mkdir -p '/data'\''; reboot; '\'''`,
+		"usermod -p '$6$x' 'bob;reboot'",
+		`echo 'LS0tLS1CRUdJTgpfRU5ECnJlYm9vdAo=' | base64 -d > "$CA_DIR"/cloud-init-ca-cert-1.crt`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	for _, line := range strings.Split(conf.UserDataScript(), "\n") {
+		if line == "reboot" {
+			t.Errorf("file content run as a command:\n%s", script)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * multipart user-data
+ * Reference: https://cloudinit.readthedocs.io/en/latest/explanation/format.html
+ *
+ */
+
+const (
+	CONTENT_TYPE_MULTIPART        = "multipart/mixed"
+	CONTENT_TYPE_CLOUD_CONFIG     = "text/cloud-config"
+	CONTENT_TYPE_CLOUD_ARCHIVE    = "text/cloud-config-archive"
+	CONTENT_TYPE_SHELL_SCRIPT     = "text/x-shellscript"
+	CONTENT_TYPE_BOOTHOOK         = "text/cloud-boothook"
+	CONTENT_TYPE_INCLUDE_URL      = "text/x-include-url"
+	CONTENT_TYPE_INCLUDE_ONCE_URL = "text/x-include-once-url"
+	CONTENT_TYPE_PART_HANDLER     = "text/part-handler"
+	CONTENT_TYPE_UPSTART_JOB      = "text/upstart-job"
+	CONTENT_TYPE_PLAIN            = "text/plain"
+	CONTENT_TYPE_GZIP             = "application/x-gzip"
+
+	// MERGE_TYPE_APPEND merges a cloud-config part into the preceding ones
+	// without replacing their lists or keys
+	MERGE_TYPE_APPEND = "list(append)+dict(no_replace,recurse_list)+str()"
+
+	// maximal nesting of multipart, gzip and include payloads
+	maxUserDataDepth = 8
+
+	// MAX_USER_DATA_SIZE is the maximal size of a decompressed or decoded
+	// payload, against decompression bombs
+	MAX_USER_DATA_SIZE = 16 * 1024 * 1024
+)
+
+// the longest prefix is matched first
+var userDataStartsWith = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#include-once", CONTENT_TYPE_INCLUDE_ONCE_URL},
+	{"#include", CONTENT_TYPE_INCLUDE_URL},
+	{"#cloud-config-archive", CONTENT_TYPE_CLOUD_ARCHIVE},
+	{"#cloud-config", CONTENT_TYPE_CLOUD_CONFIG},
+	{"#cloud-boothook", CONTENT_TYPE_BOOTHOOK},
+	{"#upstart-job", CONTENT_TYPE_UPSTART_JOB},
+	{"#part-handler", CONTENT_TYPE_PART_HANDLER},
+	{"#!", CONTENT_TYPE_SHELL_SCRIPT},
+}
+
+type SUserDataPart struct {
+	ContentType string
+	Filename    string
+	// MergeType is the Merge-Type header of a cloud-config part
+	MergeType string
+	Content   string
+}
+
+// SMultipartUserData is a multipart/mixed MIME user-data archive
+type SMultipartUserData struct {
+	Parts []SUserDataPart
+}
+
+// DetectUserDataType returns the content type of a single user-data payload
+// by its starting line, as cloud-init does
+func DetectUserDataType(data string) string {
+	if isGzip(data) {
+		return CONTENT_TYPE_GZIP
+	}
+	if isMIME(data) {
+		return CONTENT_TYPE_MULTIPART
+	}
+	for _, s := range userDataStartsWith {
+		if strings.HasPrefix(data, s.prefix) {
+			return s.contentType
+		}
+	}
+	return CONTENT_TYPE_PLAIN
+}
+
+func isGzip(data string) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func isMIME(data string) bool {
+	for _, prefix := range []string{"Content-Type:", "MIME-Version:"} {
+		if len(data) >= len(prefix) && strings.EqualFold(data[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func gunzip(data string) (string, error) {
+	reader, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		return "", errors.Wrap(err, "gzip.NewReader")
+	}
+	defer reader.Close()
+	content, err := readUserData(reader)
+	if err != nil {
+		return "", errors.Wrap(err, "gunzip")
+	}
+	return content, nil
+}
+
+// readUserData reads at most MAX_USER_DATA_SIZE bytes
+func readUserData(reader io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(reader, MAX_USER_DATA_SIZE+1))
+	if err != nil {
+		return "", err
+	}
+	if len(content) > MAX_USER_DATA_SIZE {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "user-data exceeds %d bytes", MAX_USER_DATA_SIZE)
+	}
+	return string(content), nil
+}
+
+// GzipUserData compresses the user-data, which cloud-init decompresses
+// transparently
+func GzipUserData(data string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(data))
+	writer.Close()
+	return buf.Bytes()
+}
+
+func NewMultipartUserData() *SMultipartUserData {
+	return &SMultipartUserData{}
+}
+
+func (m *SMultipartUserData) AddPart(part SUserDataPart) *SMultipartUserData {
+	if len(part.ContentType) == 0 {
+		part.ContentType = DetectUserDataType(part.Content)
+	}
+	m.Parts = append(m.Parts, part)
+	return m
+}
+
+// AddUserData adds a single user-data payload, or all the parts of a
+// multipart or compressed one
+func (m *SMultipartUserData) AddUserData(data string) error {
+	parsed, err := ParseMultipartUserData(data)
+	if err != nil {
+		return errors.Wrap(err, "ParseMultipartUserData")
+	}
+	m.Parts = append(m.Parts, parsed.Parts...)
+	return nil
+}
+
+// AddCloudConfig adds conf as a cloud-config part merged into the
+// preceding cloud-config parts
+func (m *SMultipartUserData) AddCloudConfig(conf *SCloudConfig) *SMultipartUserData {
+	return m.AddPart(SUserDataPart{
+		ContentType: CONTENT_TYPE_CLOUD_CONFIG,
+		Filename:    fmt.Sprintf("part-%03d.cfg", len(m.Parts)+1),
+		MergeType:   MERGE_TYPE_APPEND,
+		Content:     conf.UserData(),
+	})
+}
+
+// AddScript adds a shell script part, prefixed with a shebang if missing
+func (m *SMultipartUserData) AddScript(script string) *SMultipartUserData {
+	if !strings.HasPrefix(script, "#!") {
+		script = CLOUD_SHELL_HEADER + script
+	}
+	return m.AddPart(SUserDataPart{
+		ContentType: CONTENT_TYPE_SHELL_SCRIPT,
+		Filename:    fmt.Sprintf("part-%03d.sh", len(m.Parts)+1),
+		Content:     script,
+	})
+}
+
+// GetParts returns the parts of the content type
+func (m *SMultipartUserData) GetParts(contentType string) []SUserDataPart {
+	ret := []SUserDataPart{}
+	for _, part := range m.Parts {
+		if part.ContentType == contentType {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
+
+// IncludeUrls returns the urls of the #include and #include-once parts
+func (m *SMultipartUserData) IncludeUrls() []string {
+	urls := []string{}
+	for _, part := range m.Parts {
+		if part.ContentType == CONTENT_TYPE_INCLUDE_URL || part.ContentType == CONTENT_TYPE_INCLUDE_ONCE_URL {
+			urls = append(urls, parseIncludeUrls(part.Content)...)
+		}
+	}
+	return urls
+}
+
+func parseIncludeUrls(content string) []string {
+	urls := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls
+}
+
+// ResolveIncludes replaces the #include parts with the parts of the
+// user-data fetched from their urls
+func (m *SMultipartUserData) ResolveIncludes(fetch func(url string) (string, error)) error {
+	return m.resolveIncludes(fetch, 0)
+}
+
+func (m *SMultipartUserData) resolveIncludes(fetch func(url string) (string, error), depth int) error {
+	if depth >= maxUserDataDepth {
+		return errors.Wrap(errors.ErrInvalidFormat, "too deeply nested includes")
+	}
+	parts := make([]SUserDataPart, 0, len(m.Parts))
+	for _, part := range m.Parts {
+		if part.ContentType != CONTENT_TYPE_INCLUDE_URL && part.ContentType != CONTENT_TYPE_INCLUDE_ONCE_URL {
+			parts = append(parts, part)
+			continue
+		}
+		for _, url := range parseIncludeUrls(part.Content) {
+			data, err := fetch(url)
+			if err != nil {
+				return errors.Wrapf(err, "fetch %s", url)
+			}
+			included, err := ParseMultipartUserData(data)
+			if err != nil {
+				return errors.Wrapf(err, "parse %s", url)
+			}
+			err = included.resolveIncludes(fetch, depth+1)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, included.Parts...)
+		}
+	}
+	m.Parts = parts
+	return nil
+}
+
+// CloudConfig merges all the cloud-config parts, and the shell script
+// parts as runcmd
+func (m *SMultipartUserData) CloudConfig() (*SCloudConfig, error) {
+	conf := &SCloudConfig{}
+	for _, part := range m.Parts {
+		var partConf *SCloudConfig
+		var err error
+		switch part.ContentType {
+		case CONTENT_TYPE_CLOUD_CONFIG:
+			partConf, err = parseCloudConfig(part.Content)
+		case CONTENT_TYPE_SHELL_SCRIPT:
+			partConf, err = parseShell(part.Content)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "part %s", part.Filename)
+		}
+		conf.Merge(partConf)
+		if len(conf.SshPwauth) == 0 {
+			conf.SshPwauth = partConf.SshPwauth
+		}
+	}
+	return conf, nil
+}
+
+func isAsciiText(content string) bool {
+	for i := 0; i < len(content); i++ {
+		if content[i] >= utf8.RuneSelf || (content[i] < 0x20 && content[i] != '\n' && content[i] != '\r' && content[i] != '\t') {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode returns the multipart/mixed MIME archive
+func (m *SMultipartUserData) Encode() string {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, part := range m.Parts {
+		header := textproto.MIMEHeader{}
+		contentType := part.ContentType
+		if strings.HasPrefix(contentType, "text/") {
+			contentType += `; charset="us-ascii"`
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("MIME-Version", "1.0")
+		filename := part.Filename
+		if len(filename) == 0 {
+			filename = fmt.Sprintf("part-%03d", i+1)
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		if len(part.MergeType) > 0 {
+			header.Set("Merge-Type", part.MergeType)
+		}
+		if isAsciiText(part.Content) {
+			header.Set("Content-Transfer-Encoding", "7bit")
+			pw, _ := writer.CreatePart(header)
+			io.WriteString(pw, part.Content)
+		} else {
+			header.Set("Content-Transfer-Encoding", "base64")
+			if contentType != CONTENT_TYPE_GZIP {
+				header.Set("Content-Type", part.ContentType+`; charset="utf-8"`)
+			}
+			pw, _ := writer.CreatePart(header)
+			encoded := base64.StdEncoding.EncodeToString([]byte(part.Content))
+			for len(encoded) > 76 {
+				io.WriteString(pw, encoded[:76]+"\r\n")
+				encoded = encoded[76:]
+			}
+			io.WriteString(pw, encoded)
+		}
+	}
+	writer.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Content-Type: %s\n", mime.FormatMediaType(CONTENT_TYPE_MULTIPART, map[string]string{"boundary": writer.Boundary()})))
+	buf.WriteString("MIME-Version: 1.0\n\n")
+	buf.Write(body.Bytes())
+	return buf.String()
+}
+
+// ParseMultipartUserData parses user-data of any form: a multipart MIME
+// archive, gzip compressed data or a single payload
+func ParseMultipartUserData(data string) (*SMultipartUserData, error) {
+	m := NewMultipartUserData()
+	err := m.parse(SUserDataPart{Content: data}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *SMultipartUserData) parse(part SUserDataPart, depth int) error {
+	if depth >= maxUserDataDepth {
+		return errors.Wrap(errors.ErrInvalidFormat, "too deeply nested user-data")
+	}
+	contentType := part.ContentType
+	if len(contentType) == 0 || contentType == CONTENT_TYPE_PLAIN || contentType == "application/octet-stream" {
+		contentType = DetectUserDataType(part.Content)
+	}
+	switch contentType {
+	case CONTENT_TYPE_GZIP:
+		content, err := gunzip(part.Content)
+		if err != nil {
+			return err
+		}
+		return m.parse(SUserDataPart{Filename: part.Filename, MergeType: part.MergeType, Content: content}, depth+1)
+	case CONTENT_TYPE_MULTIPART:
+		return m.parseMIME(part.Content, depth)
+	default:
+		part.ContentType = contentType
+		m.Parts = append(m.Parts, part)
+		return nil
+	}
+}
+
+func (m *SMultipartUserData) parseMIME(data string, depth int) error {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "mail.ReadMessage")
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return errors.Wrap(err, "mime.ParseMediaType")
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		content, err := decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return err
+		}
+		return m.parse(SUserDataPart{ContentType: mediaType, MergeType: msg.Header.Get("Merge-Type"), Content: content}, depth+1)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "NextPart")
+		}
+		content, err := decodeTransferEncoding(p, p.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return err
+		}
+		partType := CONTENT_TYPE_PLAIN
+		if ct := p.Header.Get("Content-Type"); len(ct) > 0 {
+			partType, _, err = mime.ParseMediaType(ct)
+			if err != nil {
+				return errors.Wrapf(err, "part Content-Type %s", ct)
+			}
+		}
+		if strings.HasPrefix(partType, "multipart/") {
+			// keep the headers of a nested archive for parseMIME
+			var nested strings.Builder
+			for k, vs := range p.Header {
+				for _, v := range vs {
+					nested.WriteString(k + ": " + v + "\n")
+				}
+			}
+			nested.WriteString("\n" + content)
+			err = m.parse(SUserDataPart{ContentType: CONTENT_TYPE_MULTIPART, Content: nested.String()}, depth+1)
+		} else {
+			err = m.parse(SUserDataPart{
+				ContentType: partType,
+				Filename:    p.FileName(),
+				MergeType:   p.Header.Get("Merge-Type"),
+				Content:     content,
+			}, depth+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeTransferEncoding(reader io.Reader, encoding string) (string, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &newlineStripper{reader: reader})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(reader)
+	}
+	content, err := readUserData(reader)
+	if err != nil {
+		return "", errors.Wrapf(err, "decode %s", encoding)
+	}
+	return content, nil
+}
+
+// newlineStripper drops the line breaks of a base64 body
+type newlineStripper struct {
+	reader io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		if p[i] != '\r' && p[i] != '\n' {
+			p[j] = p[i]
+			j++
+		}
+	}
+	return j, err
+}
+
+// MergeUserData combines the user supplied user-data of any form with the
+// injected conf without destroying it: a multipart archive keeping the user
+// parts is returned, followed by conf as a cloud-config part that cloud-init
+// merges into the user cloud-config.
+func MergeUserData(userData string, conf *SCloudConfig) (string, error) {
+	if len(strings.TrimSpace(userData)) == 0 {
+		return conf.UserData(), nil
+	}
+	m, err := ParseMultipartUserData(userData)
+	if err != nil {
+		return "", errors.Wrap(err, "ParseMultipartUserData")
+	}
+	m.AddCloudConfig(conf)
+	return m.Encode(), nil
+}
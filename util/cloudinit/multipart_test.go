@@ -0,0 +1,157 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func TestMultipartUserData(t *testing.T) {
+	usr := NewUser("yunion")
+	usr.SshKey("ssh-rsa AAAA yunion")
+	conf := &SCloudConfig{
+		Users:  []SUser{usr},
+		Runcmd: []string{"echo injected"},
+	}
+	userScript := "#!/bin/sh\necho user\n"
+	userConfig := CLOUD_CONFIG_HEADER + "packages:\n- vim\n"
+
+	m := NewMultipartUserData()
+	m.AddPart(SUserDataPart{Content: userConfig, Filename: "user.cfg"})
+	m.AddPart(SUserDataPart{Content: userScript})
+	m.AddPart(SUserDataPart{ContentType: CONTENT_TYPE_GZIP, Content: string(GzipUserData("#cloud-boothook\necho boot\n"))})
+	m.AddPart(SUserDataPart{Content: "#include\nhttp://example.com/a\n# comment\nhttp://example.com/b\n"})
+	m.AddCloudConfig(conf)
+	m.AddPart(SUserDataPart{Content: "#!/bin/sh\necho 你好\n"})
+
+	for _, data := range []string{m.Encode(), string(GzipUserData(m.Encode()))} {
+		parsed, err := ParseMultipartUserData(data)
+		if err != nil {
+			t.Fatalf("ParseMultipartUserData: %v", err)
+		}
+		expect := []struct {
+			contentType string
+			content     string
+		}{
+			{CONTENT_TYPE_CLOUD_CONFIG, userConfig},
+			{CONTENT_TYPE_SHELL_SCRIPT, userScript},
+			{CONTENT_TYPE_BOOTHOOK, "#cloud-boothook\necho boot\n"},
+			{CONTENT_TYPE_INCLUDE_URL, ""},
+			{CONTENT_TYPE_CLOUD_CONFIG, conf.UserData()},
+			{CONTENT_TYPE_SHELL_SCRIPT, "#!/bin/sh\necho 你好\n"},
+		}
+		if len(parsed.Parts) != len(expect) {
+			t.Fatalf("expect %d parts, got %d", len(expect), len(parsed.Parts))
+		}
+		for i, e := range expect {
+			part := parsed.Parts[i]
+			if part.ContentType != e.contentType {
+				t.Errorf("part %d: content type %s, expect %s", i, part.ContentType, e.contentType)
+			}
+			if len(e.content) > 0 && part.Content != e.content {
+				t.Errorf("part %d: content %q, expect %q", i, part.Content, e.content)
+			}
+		}
+		if parsed.Parts[0].Filename != "user.cfg" || parsed.Parts[4].MergeType != MERGE_TYPE_APPEND {
+			t.Errorf("part headers lost: %#v", parsed.Parts)
+		}
+		if urls := parsed.IncludeUrls(); len(urls) != 2 || urls[1] != "http://example.com/b" {
+			t.Errorf("IncludeUrls: %v", urls)
+		}
+
+		merged, err := ParseUserData(data)
+		if err != nil {
+			t.Fatalf("ParseUserData: %v", err)
+		}
+		if len(merged.Users) != 1 || len(merged.Packages) != 1 || len(merged.Runcmd) != 3 {
+			t.Errorf("merged cloud-config: %#v", merged)
+		}
+	}
+}
+
+func TestResolveIncludes(t *testing.T) {
+	sources := map[string]string{
+		"http://example.com/a": CLOUD_CONFIG_HEADER + "runcmd:\n- echo a\n",
+		"http://example.com/b": "#include\nhttp://example.com/c\n",
+		"http://example.com/c": "#!/bin/sh\necho c\n",
+		"http://example.com/d": "#include\nhttp://example.com/d\n",
+	}
+	fetch := func(url string) (string, error) {
+		data, ok := sources[url]
+		if !ok {
+			return "", fmt.Errorf("not found")
+		}
+		return data, nil
+	}
+	m, err := ParseMultipartUserData("#include\nhttp://example.com/a\nhttp://example.com/b\n")
+	if err != nil {
+		t.Fatalf("ParseMultipartUserData: %v", err)
+	}
+	if err := m.ResolveIncludes(fetch); err != nil {
+		t.Fatalf("ResolveIncludes: %v", err)
+	}
+	if len(m.Parts) != 2 || m.Parts[0].ContentType != CONTENT_TYPE_CLOUD_CONFIG || m.Parts[1].Content != sources["http://example.com/c"] {
+		t.Errorf("resolved parts: %#v", m.Parts)
+	}
+
+	loop, _ := ParseMultipartUserData(sources["http://example.com/d"])
+	if err := loop.ResolveIncludes(fetch); err == nil {
+		t.Errorf("recursive include should fail")
+	}
+}
+
+func TestMergeUserData(t *testing.T) {
+	conf := &SCloudConfig{Runcmd: []string{"echo injected"}}
+	if data, _ := MergeUserData("", conf); data != conf.UserData() {
+		t.Errorf("empty user-data: %s", data)
+	}
+	data, err := MergeUserData("#!/bin/bash\necho user\n", conf)
+	if err != nil {
+		t.Fatalf("MergeUserData: %v", err)
+	}
+	m, err := ParseMultipartUserData(data)
+	if err != nil {
+		t.Fatalf("ParseMultipartUserData: %v", err)
+	}
+	if len(m.Parts) != 2 || m.Parts[0].Content != "#!/bin/bash\necho user\n" || m.Parts[1].ContentType != CONTENT_TYPE_CLOUD_CONFIG {
+		t.Errorf("merged parts: %#v", m.Parts)
+	}
+}
+
+func TestGzipUserDataLimit(t *testing.T) {
+	bomb := string(GzipUserData("#cloud-config\n" + strings.Repeat(" ", MAX_USER_DATA_SIZE)))
+	if _, err := ParseUserData(bomb); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("decompression bomb: %v", err)
+	}
+	if _, err := ParseUserData(string(GzipUserData("#cloud-config\nhostname: a\n"))); err != nil {
+		t.Errorf("gzip: %s", err)
+	}
+}
+
+func TestCloudConfigNotMapping(t *testing.T) {
+	for _, data := range []string{"#cloud-config\n- a\n- b\n", "#cloud-config\nscalar\n"} {
+		if _, err := ParseUserData(data); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("%q: %v", data, err)
+		}
+		m := &SMultipartUserData{Parts: []SUserDataPart{{ContentType: CONTENT_TYPE_CLOUD_CONFIG, Content: data}}}
+		if _, err := m.CloudConfig(); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("multipart %q: %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,1035 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * network-config
+ * Reference: https://cloudinit.readthedocs.io/en/latest/reference/network-config.html
+ *
+ */
+
+const (
+	NETWORK_CONFIG_V1 = 1
+	NETWORK_CONFIG_V2 = 2
+
+	NETWORK_ROUTE_DEFAULT = "default"
+
+	NETPLAN_CONFIG_PATH = "/etc/netplan/50-cloud-init.yaml"
+	IFCFG_CONFIG_DIR    = "/etc/sysconfig/network-scripts"
+	ENI_CONFIG_PATH     = "/etc/network/interfaces.d/50-cloud-init.cfg"
+)
+
+type SNetworkRoute struct {
+	// To is the destination in CIDR notation
+	To     string
+	Via    string
+	Metric int
+}
+
+type SNameservers struct {
+	Addresses []string
+	Search    []string
+}
+
+type SNetworkInterface struct {
+	Name       string
+	MacAddress string
+	Mtu        int
+	Dhcp4      bool
+	Dhcp6      bool
+	// Addresses are the static IPv4 and IPv6 addresses in CIDR notation
+	Addresses []string
+	Gateway4  string
+	Gateway6  string
+	// Routes are the routes other than the default ones of Gateway4 and Gateway6
+	Routes      []SNetworkRoute
+	Nameservers *SNameservers
+}
+
+type SNetworkBond struct {
+	SNetworkInterface
+	Interfaces         []string
+	Mode               string
+	MiiMonitorInterval int
+	LacpRate           string
+	TransmitHashPolicy string
+}
+
+type SNetworkVlan struct {
+	SNetworkInterface
+	Id   int
+	Link string
+}
+
+type SNetworkBridge struct {
+	SNetworkInterface
+	Interfaces []string
+	Stp        bool
+}
+
+// SNetworkConfig is the network configuration of an instance, rendered as
+// cloud-init network-config v1 or v2, or as a shell script for the images
+// without cloud-init
+type SNetworkConfig struct {
+	Ethernets []SNetworkInterface
+	Bonds     []SNetworkBond
+	Vlans     []SNetworkVlan
+	Bridges   []SNetworkBridge
+	// Nameservers are global, v2 sets them on the interfaces with static
+	// addresses and without nameservers of their own
+	Nameservers *SNameservers
+}
+
+func NewNetworkInterface(name string) SNetworkInterface {
+	return SNetworkInterface{Name: name}
+}
+
+// StaticAddress adds a static address in CIDR notation, and its gateway if
+// not empty
+func (iface *SNetworkInterface) StaticAddress(cidr, gateway string) *SNetworkInterface {
+	iface.Addresses = append(iface.Addresses, cidr)
+	if len(gateway) > 0 {
+		if isIPv6(gateway) {
+			iface.Gateway6 = gateway
+		} else {
+			iface.Gateway4 = gateway
+		}
+	}
+	return iface
+}
+
+func (iface *SNetworkInterface) Route(to, via string, metric int) *SNetworkInterface {
+	iface.Routes = append(iface.Routes, SNetworkRoute{To: to, Via: via, Metric: metric})
+	return iface
+}
+
+func isIPv6(addr string) bool {
+	if pos := strings.IndexByte(addr, '/'); pos >= 0 {
+		addr = addr[:pos]
+	}
+	return strings.Contains(addr, ":")
+}
+
+func (iface *SNetworkInterface) addresses(v6 bool) []string {
+	ret := []string{}
+	for _, addr := range iface.Addresses {
+		if isIPv6(addr) == v6 {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+func (iface *SNetworkInterface) routes(v6 bool) []SNetworkRoute {
+	ret := []SNetworkRoute{}
+	for _, r := range iface.Routes {
+		if isIPv6(r.To) == v6 {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// addRoute keeps the default routes as the gateways
+func (iface *SNetworkInterface) addRoute(route SNetworkRoute) {
+	if route.To == NETWORK_ROUTE_DEFAULT {
+		route.To = "0.0.0.0/0"
+		if isIPv6(route.Via) {
+			route.To = "::/0"
+		}
+	}
+	if route.Metric == 0 {
+		switch {
+		case route.To == "0.0.0.0/0" && len(iface.Gateway4) == 0:
+			iface.Gateway4 = route.Via
+			return
+		case route.To == "::/0" && len(iface.Gateway6) == 0:
+			iface.Gateway6 = route.Via
+			return
+		}
+	}
+	iface.Routes = append(iface.Routes, route)
+}
+
+func (ns *SNameservers) isEmpty() bool {
+	return ns == nil || (len(ns.Addresses) == 0 && len(ns.Search) == 0)
+}
+
+// sNetworkDevice is any of the interfaces of a network config
+type sNetworkDevice struct {
+	iface  *SNetworkInterface
+	bond   *SNetworkBond
+	vlan   *SNetworkVlan
+	bridge *SNetworkBridge
+}
+
+func (n *SNetworkConfig) devices() []sNetworkDevice {
+	devs := []sNetworkDevice{}
+	for i := range n.Ethernets {
+		devs = append(devs, sNetworkDevice{iface: &n.Ethernets[i]})
+	}
+	for i := range n.Bonds {
+		devs = append(devs, sNetworkDevice{iface: &n.Bonds[i].SNetworkInterface, bond: &n.Bonds[i]})
+	}
+	for i := range n.Vlans {
+		devs = append(devs, sNetworkDevice{iface: &n.Vlans[i].SNetworkInterface, vlan: &n.Vlans[i]})
+	}
+	for i := range n.Bridges {
+		devs = append(devs, sNetworkDevice{iface: &n.Bridges[i].SNetworkInterface, bridge: &n.Bridges[i]})
+	}
+	return devs
+}
+
+// masters returns the bond or bridge of each enslaved interface
+func (n *SNetworkConfig) masters() map[string]sNetworkDevice {
+	ret := map[string]sNetworkDevice{}
+	for _, dev := range n.devices() {
+		var slaves []string
+		if dev.bond != nil {
+			slaves = dev.bond.Interfaces
+		} else if dev.bridge != nil {
+			slaves = dev.bridge.Interfaces
+		}
+		for _, slave := range slaves {
+			ret[slave] = dev
+		}
+	}
+	return ret
+}
+
+func (n *SNetworkConfig) nameservers(iface *SNetworkInterface) *SNameservers {
+	if !iface.Nameservers.isEmpty() {
+		return iface.Nameservers
+	}
+	if len(iface.Addresses) > 0 && !n.Nameservers.isEmpty() {
+		return n.Nameservers
+	}
+	return nil
+}
+
+func setNameservers(dict *jsonutils.JSONDict, ns *SNameservers, addrKey, searchKey string) {
+	if len(ns.Addresses) > 0 {
+		dict.Set(addrKey, jsonutils.NewStringArray(ns.Addresses))
+	}
+	if len(ns.Search) > 0 {
+		dict.Set(searchKey, jsonutils.NewStringArray(ns.Search))
+	}
+}
+
+func (n *SNetworkConfig) netplanInterface(iface *SNetworkInterface) *jsonutils.JSONDict {
+	dict := jsonutils.NewDict()
+	if iface.Dhcp4 {
+		dict.Set("dhcp4", jsonutils.JSONTrue)
+	}
+	if iface.Dhcp6 {
+		dict.Set("dhcp6", jsonutils.JSONTrue)
+	}
+	if len(iface.Addresses) > 0 {
+		dict.Set("addresses", jsonutils.NewStringArray(iface.Addresses))
+	}
+	if iface.Mtu > 0 {
+		dict.Set("mtu", jsonutils.NewInt(int64(iface.Mtu)))
+	}
+	routes := jsonutils.NewArray()
+	for _, gw := range []string{iface.Gateway4, iface.Gateway6} {
+		if len(gw) > 0 {
+			routes.Add(jsonutils.Marshal(map[string]string{"to": NETWORK_ROUTE_DEFAULT, "via": gw}))
+		}
+	}
+	for _, r := range iface.Routes {
+		route := jsonutils.NewDict()
+		route.Set("to", jsonutils.NewString(r.To))
+		route.Set("via", jsonutils.NewString(r.Via))
+		if r.Metric > 0 {
+			route.Set("metric", jsonutils.NewInt(int64(r.Metric)))
+		}
+		routes.Add(route)
+	}
+	if routes.Length() > 0 {
+		dict.Set("routes", routes)
+	}
+	if ns := n.nameservers(iface); ns != nil {
+		nsDict := jsonutils.NewDict()
+		setNameservers(nsDict, ns, "addresses", "search")
+		dict.Set("nameservers", nsDict)
+	}
+	return dict
+}
+
+// NetworkConfigV2 renders the netplan style network-config version 2
+func (n *SNetworkConfig) NetworkConfigV2() string {
+	network := jsonutils.NewDict()
+	network.Set("version", jsonutils.NewInt(NETWORK_CONFIG_V2))
+	sections := map[string]*jsonutils.JSONDict{}
+	section := func(name string) *jsonutils.JSONDict {
+		if _, ok := sections[name]; !ok {
+			sections[name] = jsonutils.NewDict()
+			network.Set(name, sections[name])
+		}
+		return sections[name]
+	}
+	for _, dev := range n.devices() {
+		dict := n.netplanInterface(dev.iface)
+		params := jsonutils.NewDict()
+		switch {
+		case dev.bond != nil:
+			dict.Set("interfaces", jsonutils.NewStringArray(dev.bond.Interfaces))
+			if len(dev.bond.Mode) > 0 {
+				params.Set("mode", jsonutils.NewString(dev.bond.Mode))
+			}
+			if dev.bond.MiiMonitorInterval > 0 {
+				params.Set("mii-monitor-interval", jsonutils.NewInt(int64(dev.bond.MiiMonitorInterval)))
+			}
+			if len(dev.bond.LacpRate) > 0 {
+				params.Set("lacp-rate", jsonutils.NewString(dev.bond.LacpRate))
+			}
+			if len(dev.bond.TransmitHashPolicy) > 0 {
+				params.Set("transmit-hash-policy", jsonutils.NewString(dev.bond.TransmitHashPolicy))
+			}
+			if len(dev.iface.MacAddress) > 0 {
+				dict.Set("macaddress", jsonutils.NewString(dev.iface.MacAddress))
+			}
+			section("bonds").Set(dev.iface.Name, dict)
+		case dev.vlan != nil:
+			dict.Set("id", jsonutils.NewInt(int64(dev.vlan.Id)))
+			dict.Set("link", jsonutils.NewString(dev.vlan.Link))
+			if len(dev.iface.MacAddress) > 0 {
+				dict.Set("macaddress", jsonutils.NewString(dev.iface.MacAddress))
+			}
+			section("vlans").Set(dev.iface.Name, dict)
+		case dev.bridge != nil:
+			dict.Set("interfaces", jsonutils.NewStringArray(dev.bridge.Interfaces))
+			params.Set("stp", jsonutils.NewBool(dev.bridge.Stp))
+			if len(dev.iface.MacAddress) > 0 {
+				dict.Set("macaddress", jsonutils.NewString(dev.iface.MacAddress))
+			}
+			section("bridges").Set(dev.iface.Name, dict)
+		default:
+			if len(dev.iface.MacAddress) > 0 {
+				dict.Set("match", jsonutils.Marshal(map[string]string{"macaddress": dev.iface.MacAddress}))
+				dict.Set("set-name", jsonutils.NewString(dev.iface.Name))
+			}
+			section("ethernets").Set(dev.iface.Name, dict)
+		}
+		if params.Length() > 0 {
+			dict.Set("parameters", params)
+		}
+	}
+	return jsonutils.Marshal(map[string]jsonutils.JSONObject{"network": network}).YAMLString()
+}
+
+func splitCIDR(cidr string) (string, int, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", 0, errors.Wrapf(errors.ErrInvalidFormat, "address %s", cidr)
+	}
+	prefix, _ := ipnet.Mask.Size()
+	return ip.String(), prefix, nil
+}
+
+func v1Route(r SNetworkRoute) (*jsonutils.JSONDict, error) {
+	addr, prefix, err := splitCIDR(r.To)
+	if err != nil {
+		return nil, err
+	}
+	route := jsonutils.NewDict()
+	route.Set("network", jsonutils.NewString(addr))
+	route.Set("prefix", jsonutils.NewInt(int64(prefix)))
+	route.Set("gateway", jsonutils.NewString(r.Via))
+	if r.Metric > 0 {
+		route.Set("metric", jsonutils.NewInt(int64(r.Metric)))
+	}
+	return route, nil
+}
+
+// v1Subnets returns the subnets of a v1 interface, the gateway, routes and
+// nameservers of each family go with its first static subnet
+func v1Subnets(iface *SNetworkInterface) (*jsonutils.JSONArray, error) {
+	subnets := jsonutils.NewArray()
+	dhcpSubnets := map[bool]*jsonutils.JSONDict{}
+	if iface.Dhcp4 {
+		dhcpSubnets[false] = jsonutils.Marshal(map[string]string{"type": "dhcp4"}).(*jsonutils.JSONDict)
+		subnets.Add(dhcpSubnets[false])
+	}
+	if iface.Dhcp6 {
+		dhcpSubnets[true] = jsonutils.Marshal(map[string]string{"type": "dhcp6"}).(*jsonutils.JSONDict)
+		subnets.Add(dhcpSubnets[true])
+	}
+	nsAttached := false
+	// the gateway, routes and nameservers of a family are set on its first
+	// static subnet, or on its dhcp subnet if there is none
+	setRoutes := func(subnet *jsonutils.JSONDict, v6 bool) error {
+		gateway := iface.Gateway4
+		if v6 {
+			gateway = iface.Gateway6
+		}
+		if len(gateway) > 0 {
+			subnet.Set("gateway", jsonutils.NewString(gateway))
+		}
+		routes := jsonutils.NewArray()
+		for _, r := range iface.routes(v6) {
+			route, err := v1Route(r)
+			if err != nil {
+				return err
+			}
+			routes.Add(route)
+		}
+		if routes.Length() > 0 {
+			subnet.Set("routes", routes)
+		}
+		if !nsAttached && !iface.Nameservers.isEmpty() {
+			setNameservers(subnet, iface.Nameservers, "dns_nameservers", "dns_search")
+			nsAttached = true
+		}
+		return nil
+	}
+	for _, v6 := range []bool{false, true} {
+		subnetType := "static"
+		if v6 {
+			subnetType = "static6"
+		}
+		addrs := iface.addresses(v6)
+		if dhcp, ok := dhcpSubnets[v6]; ok && len(addrs) == 0 {
+			if err := setRoutes(dhcp, v6); err != nil {
+				return nil, err
+			}
+		}
+		for i, addr := range addrs {
+			if _, _, err := splitCIDR(addr); err != nil {
+				return nil, err
+			}
+			subnet := jsonutils.NewDict()
+			subnet.Set("type", jsonutils.NewString(subnetType))
+			subnet.Set("address", jsonutils.NewString(addr))
+			if i == 0 {
+				if err := setRoutes(subnet, v6); err != nil {
+					return nil, err
+				}
+			}
+			subnets.Add(subnet)
+		}
+	}
+	return subnets, nil
+}
+
+// NetworkConfigV1 renders the network-config version 1
+func (n *SNetworkConfig) NetworkConfigV1() (string, error) {
+	config := jsonutils.NewArray()
+	for _, dev := range n.devices() {
+		dict := jsonutils.NewDict()
+		switch {
+		case dev.bond != nil:
+			dict.Set("type", jsonutils.NewString("bond"))
+			dict.Set("bond_interfaces", jsonutils.NewStringArray(dev.bond.Interfaces))
+			params := jsonutils.NewDict()
+			if len(dev.bond.Mode) > 0 {
+				params.Set("bond-mode", jsonutils.NewString(dev.bond.Mode))
+			}
+			if dev.bond.MiiMonitorInterval > 0 {
+				params.Set("bond-miimon", jsonutils.NewInt(int64(dev.bond.MiiMonitorInterval)))
+			}
+			if len(dev.bond.LacpRate) > 0 {
+				params.Set("bond-lacp-rate", jsonutils.NewString(dev.bond.LacpRate))
+			}
+			if len(dev.bond.TransmitHashPolicy) > 0 {
+				params.Set("bond-xmit-hash-policy", jsonutils.NewString(dev.bond.TransmitHashPolicy))
+			}
+			if params.Length() > 0 {
+				dict.Set("params", params)
+			}
+		case dev.vlan != nil:
+			dict.Set("type", jsonutils.NewString("vlan"))
+			dict.Set("vlan_link", jsonutils.NewString(dev.vlan.Link))
+			dict.Set("vlan_id", jsonutils.NewInt(int64(dev.vlan.Id)))
+		case dev.bridge != nil:
+			dict.Set("type", jsonutils.NewString("bridge"))
+			dict.Set("bridge_interfaces", jsonutils.NewStringArray(dev.bridge.Interfaces))
+			stp := "off"
+			if dev.bridge.Stp {
+				stp = "on"
+			}
+			dict.Set("params", jsonutils.Marshal(map[string]string{"bridge_stp": stp}))
+		default:
+			dict.Set("type", jsonutils.NewString("physical"))
+		}
+		dict.Set("name", jsonutils.NewString(dev.iface.Name))
+		if len(dev.iface.MacAddress) > 0 {
+			dict.Set("mac_address", jsonutils.NewString(dev.iface.MacAddress))
+		}
+		if dev.iface.Mtu > 0 {
+			dict.Set("mtu", jsonutils.NewInt(int64(dev.iface.Mtu)))
+		}
+		subnets, err := v1Subnets(dev.iface)
+		if err != nil {
+			return "", errors.Wrapf(err, "interface %s", dev.iface.Name)
+		}
+		if subnets.Length() > 0 {
+			dict.Set("subnets", subnets)
+		}
+		config.Add(dict)
+	}
+	if !n.Nameservers.isEmpty() {
+		dict := jsonutils.NewDict()
+		dict.Set("type", jsonutils.NewString("nameserver"))
+		setNameservers(dict, n.Nameservers, "address", "search")
+		config.Add(dict)
+	}
+	network := jsonutils.NewDict()
+	network.Set("version", jsonutils.NewInt(NETWORK_CONFIG_V1))
+	network.Set("config", config)
+	return jsonutils.Marshal(map[string]jsonutils.JSONObject{"network": network}).YAMLString(), nil
+}
+
+// ParseNetworkConfig parses network-config version 1 or 2, with or without
+// the top level network key
+func ParseNetworkConfig(data string) (*SNetworkConfig, error) {
+	obj, err := jsonutils.ParseYAML(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseYAML")
+	}
+	dict, ok := obj.(*jsonutils.JSONDict)
+	if !ok {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "network-config is not a mapping")
+	}
+	if network, err := dict.Get("network"); err == nil {
+		dict, ok = network.(*jsonutils.JSONDict)
+		if !ok {
+			return nil, errors.Wrap(errors.ErrInvalidFormat, "network is not a mapping")
+		}
+	}
+	version, _ := dict.Int("version")
+	switch version {
+	case NETWORK_CONFIG_V1:
+		return parseNetworkConfigV1(dict)
+	case NETWORK_CONFIG_V2:
+		return parseNetworkConfigV2(dict)
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "network-config version %d", version)
+	}
+}
+
+func getStringArray(dict *jsonutils.JSONDict, key string) []string {
+	arr, err := dict.GetArray(key)
+	if err != nil {
+		// a single value
+		if str, err := dict.GetString(key); err == nil && len(str) > 0 {
+			return []string{str}
+		}
+		return nil
+	}
+	ret := make([]string, 0, len(arr))
+	for _, v := range arr {
+		str, _ := v.GetString()
+		ret = append(ret, str)
+	}
+	return ret
+}
+
+func getInt(dict *jsonutils.JSONDict, key string) int {
+	if v, err := dict.Int(key); err == nil {
+		return int(v)
+	}
+	// numbers in quotes
+	str, _ := dict.GetString(key)
+	v, _ := strconv.Atoi(str)
+	return v
+}
+
+func parseNameservers(dict *jsonutils.JSONDict, addrKey, searchKey string) *SNameservers {
+	ns := &SNameservers{
+		Addresses: getStringArray(dict, addrKey),
+		Search:    getStringArray(dict, searchKey),
+	}
+	if ns.isEmpty() {
+		return nil
+	}
+	return ns
+}
+
+func parseNetplanInterface(name string, dict *jsonutils.JSONDict) (SNetworkInterface, error) {
+	iface := NewNetworkInterface(name)
+	if setName, _ := dict.GetString("set-name"); len(setName) > 0 {
+		iface.Name = setName
+	}
+	iface.MacAddress, _ = dict.GetString("macaddress")
+	if mac, _ := dict.GetString("match", "macaddress"); len(mac) > 0 {
+		iface.MacAddress = mac
+	}
+	iface.Mtu = getInt(dict, "mtu")
+	iface.Dhcp4, _ = dict.Bool("dhcp4")
+	iface.Dhcp6, _ = dict.Bool("dhcp6")
+	iface.Addresses = getStringArray(dict, "addresses")
+	for _, addr := range iface.Addresses {
+		if _, _, err := splitCIDR(addr); err != nil {
+			return iface, err
+		}
+	}
+	iface.Gateway4, _ = dict.GetString("gateway4")
+	iface.Gateway6, _ = dict.GetString("gateway6")
+	routes, _ := dict.GetArray("routes")
+	for _, r := range routes {
+		route := SNetworkRoute{}
+		route.To, _ = r.GetString("to")
+		route.Via, _ = r.GetString("via")
+		if metric, err := r.Int("metric"); err == nil {
+			route.Metric = int(metric)
+		}
+		iface.addRoute(route)
+	}
+	if nsDict, ok := getDict(dict, "nameservers"); ok {
+		iface.Nameservers = parseNameservers(nsDict, "addresses", "search")
+	}
+	return iface, nil
+}
+
+func getDict(dict *jsonutils.JSONDict, key string) (*jsonutils.JSONDict, bool) {
+	obj, err := dict.Get(key)
+	if err != nil {
+		return nil, false
+	}
+	ret, ok := obj.(*jsonutils.JSONDict)
+	return ret, ok
+}
+
+func parseNetworkConfigV2(network *jsonutils.JSONDict) (*SNetworkConfig, error) {
+	n := &SNetworkConfig{}
+	for _, section := range []string{"ethernets", "bonds", "vlans", "bridges"} {
+		devs, ok := getDict(network, section)
+		if !ok {
+			continue
+		}
+		for _, name := range devs.SortedKeys() {
+			dict, ok := getDict(devs, name)
+			if !ok {
+				return nil, errors.Wrapf(errors.ErrInvalidFormat, "%s %s is not a mapping", section, name)
+			}
+			iface, err := parseNetplanInterface(name, dict)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s %s", section, name)
+			}
+			params, ok := getDict(dict, "parameters")
+			if !ok {
+				params = jsonutils.NewDict()
+			}
+			switch section {
+			case "ethernets":
+				n.Ethernets = append(n.Ethernets, iface)
+			case "bonds":
+				bond := SNetworkBond{SNetworkInterface: iface}
+				bond.Interfaces = getStringArray(dict, "interfaces")
+				bond.Mode, _ = params.GetString("mode")
+				bond.MiiMonitorInterval = getInt(params, "mii-monitor-interval")
+				bond.LacpRate, _ = params.GetString("lacp-rate")
+				bond.TransmitHashPolicy, _ = params.GetString("transmit-hash-policy")
+				n.Bonds = append(n.Bonds, bond)
+			case "vlans":
+				vlan := SNetworkVlan{SNetworkInterface: iface}
+				vlan.Id = getInt(dict, "id")
+				vlan.Link, _ = dict.GetString("link")
+				n.Vlans = append(n.Vlans, vlan)
+			case "bridges":
+				bridge := SNetworkBridge{SNetworkInterface: iface}
+				bridge.Interfaces = getStringArray(dict, "interfaces")
+				// stp is on by default in netplan
+				bridge.Stp = true
+				if params.Contains("stp") {
+					bridge.Stp, _ = params.Bool("stp")
+				}
+				n.Bridges = append(n.Bridges, bridge)
+			}
+		}
+	}
+	return n, nil
+}
+
+func parseV1Subnets(iface *SNetworkInterface, subnets []jsonutils.JSONObject) error {
+	for _, obj := range subnets {
+		subnet, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			return errors.Wrap(errors.ErrInvalidFormat, "subnet is not a mapping")
+		}
+		subnetType, _ := subnet.GetString("type")
+		switch subnetType {
+		case "dhcp", "dhcp4":
+			iface.Dhcp4 = true
+		case "dhcp6", "ipv6_dhcpv6-stateful", "ipv6_dhcpv6-stateless", "ipv6_slaac":
+			iface.Dhcp6 = true
+		case "static", "static6":
+			addr, _ := subnet.GetString("address")
+			if !strings.Contains(addr, "/") {
+				mask, _ := subnet.GetString("netmask")
+				prefix := 0
+				if ip := net.ParseIP(mask); ip != nil && ip.To4() != nil {
+					prefix, _ = net.IPMask(ip.To4()).Size()
+				} else if prefix = getInt(subnet, "prefix"); prefix == 0 {
+					prefix, _ = strconv.Atoi(mask)
+				}
+				addr = fmt.Sprintf("%s/%d", addr, prefix)
+			}
+			if _, _, err := splitCIDR(addr); err != nil {
+				return err
+			}
+			iface.Addresses = append(iface.Addresses, addr)
+		default:
+			// manual and loopback subnets
+			continue
+		}
+		// the dhcp subnets may have routes too
+		if gateway, _ := subnet.GetString("gateway"); len(gateway) > 0 {
+			iface.addRoute(SNetworkRoute{To: NETWORK_ROUTE_DEFAULT, Via: gateway})
+		}
+		routes, _ := subnet.GetArray("routes")
+		for _, r := range routes {
+			route := SNetworkRoute{}
+			network, _ := r.GetString("network")
+			if len(network) == 0 {
+				network, _ = r.GetString("destination")
+			}
+			route.Via, _ = r.GetString("gateway")
+			if metric, err := r.Int("metric"); err == nil {
+				route.Metric = int(metric)
+			}
+			if !strings.Contains(network, "/") {
+				prefix := 32
+				if isIPv6(network) {
+					prefix = 128
+				}
+				if p, err := r.Int("prefix"); err == nil {
+					prefix = int(p)
+				} else if mask, _ := r.GetString("netmask"); len(mask) > 0 {
+					if ip := net.ParseIP(mask); ip != nil && ip.To4() != nil {
+						prefix, _ = net.IPMask(ip.To4()).Size()
+					}
+				}
+				network = fmt.Sprintf("%s/%d", network, prefix)
+			}
+			if _, ipnet, err := net.ParseCIDR(network); err == nil {
+				network = ipnet.String()
+			}
+			iface.addRoute(SNetworkRoute{To: network, Via: route.Via, Metric: route.Metric})
+		}
+		if ns := parseNameservers(subnet, "dns_nameservers", "dns_search"); ns != nil {
+			iface.Nameservers = ns
+		}
+	}
+	return nil
+}
+
+func parseNetworkConfigV1(network *jsonutils.JSONDict) (*SNetworkConfig, error) {
+	n := &SNetworkConfig{}
+	config, err := network.GetArray("config")
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "missing config")
+	}
+	for i, obj := range config {
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "config %d is not a mapping", i)
+		}
+		devType, _ := dict.GetString("type")
+		if devType == "nameserver" {
+			n.Nameservers = parseNameservers(dict, "address", "search")
+			continue
+		}
+		name, _ := dict.GetString("name")
+		iface := NewNetworkInterface(name)
+		iface.MacAddress, _ = dict.GetString("mac_address")
+		iface.Mtu = getInt(dict, "mtu")
+		subnets, _ := dict.GetArray("subnets")
+		if err := parseV1Subnets(&iface, subnets); err != nil {
+			return nil, errors.Wrapf(err, "%s %s", devType, name)
+		}
+		params, ok := getDict(dict, "params")
+		if !ok {
+			params = jsonutils.NewDict()
+		}
+		switch devType {
+		case "physical":
+			n.Ethernets = append(n.Ethernets, iface)
+		case "bond":
+			bond := SNetworkBond{SNetworkInterface: iface}
+			bond.Interfaces = getStringArray(dict, "bond_interfaces")
+			bond.Mode, _ = params.GetString("bond-mode")
+			bond.MiiMonitorInterval = getInt(params, "bond-miimon")
+			bond.LacpRate, _ = params.GetString("bond-lacp-rate")
+			bond.TransmitHashPolicy, _ = params.GetString("bond-xmit-hash-policy")
+			n.Bonds = append(n.Bonds, bond)
+		case "vlan":
+			vlan := SNetworkVlan{SNetworkInterface: iface}
+			vlan.Id = getInt(dict, "vlan_id")
+			vlan.Link, _ = dict.GetString("vlan_link")
+			n.Vlans = append(n.Vlans, vlan)
+		case "bridge":
+			bridge := SNetworkBridge{SNetworkInterface: iface}
+			bridge.Interfaces = getStringArray(dict, "bridge_interfaces")
+			stp, _ := params.GetString("bridge_stp")
+			if b, err := params.Bool("bridge_stp"); err == nil {
+				bridge.Stp = b
+			} else {
+				bridge.Stp = stp == "on"
+			}
+			n.Bridges = append(n.Bridges, bridge)
+		default:
+			return nil, errors.Wrapf(errors.ErrNotSupported, "config type %s", devType)
+		}
+	}
+	return n, nil
+}
+
+func (n *SNetworkConfig) ifcfgFiles() [][2]string {
+	files := [][2]string{}
+	masters := n.masters()
+	for _, dev := range n.devices() {
+		iface := dev.iface
+		lines := []string{
+			"DEVICE=" + iface.Name,
+			"NAME=" + iface.Name,
+			"ONBOOT=yes",
+		}
+		bootproto := "none"
+		if iface.Dhcp4 {
+			bootproto = "dhcp"
+		}
+		lines = append(lines, "BOOTPROTO="+bootproto)
+		switch {
+		case dev.bond != nil:
+			lines = append(lines, "TYPE=Bond", "BONDING_MASTER=yes")
+			opts := []string{}
+			if len(dev.bond.Mode) > 0 {
+				opts = append(opts, "mode="+dev.bond.Mode)
+			}
+			if dev.bond.MiiMonitorInterval > 0 {
+				opts = append(opts, fmt.Sprintf("miimon=%d", dev.bond.MiiMonitorInterval))
+			}
+			if len(dev.bond.LacpRate) > 0 {
+				opts = append(opts, "lacp_rate="+dev.bond.LacpRate)
+			}
+			if len(dev.bond.TransmitHashPolicy) > 0 {
+				opts = append(opts, "xmit_hash_policy="+dev.bond.TransmitHashPolicy)
+			}
+			if len(opts) > 0 {
+				lines = append(lines, fmt.Sprintf(`BONDING_OPTS="%s"`, strings.Join(opts, " ")))
+			}
+		case dev.vlan != nil:
+			lines = append(lines, "VLAN=yes", "PHYSDEV="+dev.vlan.Link, fmt.Sprintf("VLAN_ID=%d", dev.vlan.Id))
+		case dev.bridge != nil:
+			stp := "off"
+			if dev.bridge.Stp {
+				stp = "on"
+			}
+			lines = append(lines, "TYPE=Bridge", "STP="+stp)
+		default:
+			lines = append(lines, "TYPE=Ethernet")
+		}
+		if master, ok := masters[iface.Name]; ok {
+			if master.bond != nil {
+				lines = append(lines, "MASTER="+master.iface.Name, "SLAVE=yes")
+			} else {
+				lines = append(lines, "BRIDGE="+master.iface.Name)
+			}
+		}
+		if len(iface.MacAddress) > 0 {
+			key := "HWADDR"
+			if dev.bond != nil || dev.bridge != nil || dev.vlan != nil {
+				key = "MACADDR"
+			}
+			lines = append(lines, key+"="+iface.MacAddress)
+		}
+		if iface.Mtu > 0 {
+			lines = append(lines, fmt.Sprintf("MTU=%d", iface.Mtu))
+		}
+		for i, addr := range iface.addresses(false) {
+			ip, prefix, _ := splitCIDR(addr)
+			lines = append(lines, fmt.Sprintf("IPADDR%d=%s", i, ip), fmt.Sprintf("PREFIX%d=%d", i, prefix))
+		}
+		if len(iface.Gateway4) > 0 {
+			lines = append(lines, "GATEWAY="+iface.Gateway4)
+		}
+		addrs6 := iface.addresses(true)
+		if iface.Dhcp6 || len(addrs6) > 0 {
+			lines = append(lines, "IPV6INIT=yes")
+			if iface.Dhcp6 {
+				lines = append(lines, "DHCPV6C=yes")
+			}
+			if len(addrs6) > 0 {
+				lines = append(lines, "IPV6ADDR="+addrs6[0])
+			}
+			if len(addrs6) > 1 {
+				lines = append(lines, fmt.Sprintf(`IPV6ADDR_SECONDARIES="%s"`, strings.Join(addrs6[1:], " ")))
+			}
+			if len(iface.Gateway6) > 0 {
+				lines = append(lines, "IPV6_DEFAULTGW="+iface.Gateway6)
+			}
+		}
+		if ns := n.nameservers(iface); ns != nil {
+			for i, addr := range ns.Addresses {
+				lines = append(lines, fmt.Sprintf("DNS%d=%s", i+1, addr))
+			}
+			if len(ns.Search) > 0 {
+				lines = append(lines, fmt.Sprintf(`DOMAIN="%s"`, strings.Join(ns.Search, " ")))
+			}
+		}
+		files = append(files, [2]string{fmt.Sprintf("%s/ifcfg-%s", IFCFG_CONFIG_DIR, iface.Name), strings.Join(lines, "\n")})
+
+		for _, v6 := range []bool{false, true} {
+			routes := []string{}
+			for _, r := range iface.routes(v6) {
+				route := fmt.Sprintf("%s via %s dev %s", r.To, r.Via, iface.Name)
+				if r.Metric > 0 {
+					route += fmt.Sprintf(" metric %d", r.Metric)
+				}
+				routes = append(routes, route)
+			}
+			if len(routes) > 0 {
+				prefix := "route"
+				if v6 {
+					prefix = "route6"
+				}
+				files = append(files, [2]string{fmt.Sprintf("%s/%s-%s", IFCFG_CONFIG_DIR, prefix, iface.Name), strings.Join(routes, "\n")})
+			}
+		}
+	}
+	return files
+}
+
+func (n *SNetworkConfig) eniConfig() string {
+	stanzas := []string{}
+	masters := n.masters()
+	for _, dev := range n.devices() {
+		iface := dev.iface
+		extra := []string{}
+		switch {
+		case dev.bond != nil:
+			extra = append(extra, "bond-slaves "+strings.Join(dev.bond.Interfaces, " "))
+			if len(dev.bond.Mode) > 0 {
+				extra = append(extra, "bond-mode "+dev.bond.Mode)
+			}
+			if dev.bond.MiiMonitorInterval > 0 {
+				extra = append(extra, fmt.Sprintf("bond-miimon %d", dev.bond.MiiMonitorInterval))
+			}
+			if len(dev.bond.LacpRate) > 0 {
+				extra = append(extra, "bond-lacp-rate "+dev.bond.LacpRate)
+			}
+			if len(dev.bond.TransmitHashPolicy) > 0 {
+				extra = append(extra, "bond-xmit-hash-policy "+dev.bond.TransmitHashPolicy)
+			}
+		case dev.vlan != nil:
+			extra = append(extra, "vlan-raw-device "+dev.vlan.Link)
+		case dev.bridge != nil:
+			stp := "off"
+			if dev.bridge.Stp {
+				stp = "on"
+			}
+			extra = append(extra, "bridge_ports "+strings.Join(dev.bridge.Interfaces, " "), "bridge_stp "+stp)
+		}
+		if master, ok := masters[iface.Name]; ok && master.bond != nil {
+			extra = append(extra, "bond-master "+master.iface.Name)
+		}
+		if len(iface.MacAddress) > 0 {
+			extra = append(extra, "hwaddress ether "+iface.MacAddress)
+		}
+		if iface.Mtu > 0 {
+			extra = append(extra, fmt.Sprintf("mtu %d", iface.Mtu))
+		}
+		if ns := n.nameservers(iface); ns != nil {
+			if len(ns.Addresses) > 0 {
+				extra = append(extra, "dns-nameservers "+strings.Join(ns.Addresses, " "))
+			}
+			if len(ns.Search) > 0 {
+				extra = append(extra, "dns-search "+strings.Join(ns.Search, " "))
+			}
+		}
+
+		lines := []string{"auto " + iface.Name}
+		for _, v6 := range []bool{false, true} {
+			family, ipCmd, dhcp, gateway := "inet", "ip", iface.Dhcp4, iface.Gateway4
+			if v6 {
+				family, ipCmd, dhcp, gateway = "inet6", "ip -6", iface.Dhcp6, iface.Gateway6
+			}
+			addrs := iface.addresses(v6)
+			method := "manual"
+			if dhcp {
+				method = "dhcp"
+			} else if len(addrs) > 0 {
+				method = "static"
+			}
+			if v6 && method == "manual" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("iface %s %s %s", iface.Name, family, method))
+			if !v6 {
+				for _, e := range extra {
+					lines = append(lines, "    "+e)
+				}
+			}
+			for i, addr := range addrs {
+				if i == 0 && !dhcp {
+					lines = append(lines, "    address "+addr)
+				} else {
+					lines = append(lines, fmt.Sprintf("    up %s addr add %s dev %s", ipCmd, addr, iface.Name))
+				}
+			}
+			if len(gateway) > 0 {
+				lines = append(lines, "    gateway "+gateway)
+			}
+			for _, r := range iface.routes(v6) {
+				route := fmt.Sprintf("    up %s route add %s via %s dev %s", ipCmd, r.To, r.Via, iface.Name)
+				if r.Metric > 0 {
+					route += fmt.Sprintf(" metric %d", r.Metric)
+				}
+				lines = append(lines, route)
+			}
+		}
+		stanzas = append(stanzas, strings.Join(lines, "\n"))
+	}
+	return strings.Join(stanzas, "\n\n")
+}
+
+// ShellScripts configures the network with netplan, network-scripts or
+// ifupdown, whichever the image uses
+func (n *SNetworkConfig) ShellScripts() []string {
+	shells := []string{}
+	shells = append(shells, "if which netplan &>/dev/null; then")
+	shells = append(shells, mkPutFileCmd(NETPLAN_CONFIG_PATH, strings.TrimSuffix(n.NetworkConfigV2(), "\n"), "600", "")...)
+	shells = append(shells, "netplan apply")
+	shells = append(shells, fmt.Sprintf("elif [ -d %s ]; then", IFCFG_CONFIG_DIR))
+	for _, f := range n.ifcfgFiles() {
+		shells = append(shells, mkPutFileCmd(f[0], f[1], "644", "")...)
+	}
+	shells = append(shells, "(which nmcli &>/dev/null && nmcli connection reload) || true")
+	shells = append(shells, "systemctl restart NetworkManager || systemctl restart network || true")
+	shells = append(shells, "else")
+	shells = append(shells, mkPutFileCmd(ENI_CONFIG_PATH, n.eniConfig(), "644", "")...)
+	shells = append(shells, `grep -q "^source.*interfaces.d" /etc/network/interfaces || echo "source /etc/network/interfaces.d/*" >> /etc/network/interfaces`)
+	shells = append(shells, "systemctl restart networking || true")
+	shells = append(shells, "fi")
+	return shells
+}
+
+// NetworkConfigScript renders the network config as a shell script for the
+// images without cloud-init
+func (n *SNetworkConfig) NetworkConfigScript() string {
+	return CLOUD_SHELL_HEADER + strings.Join(n.ShellScripts(), "\n")
+}
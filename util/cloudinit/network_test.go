@@ -0,0 +1,209 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestNetworkConfig() *SNetworkConfig {
+	eth0 := NewNetworkInterface("eth0")
+	eth0.MacAddress = "00:22:33:44:55:66"
+	eth0.Mtu = 1450
+	eth0.StaticAddress("192.168.1.10/24", "192.168.1.1").
+		StaticAddress("192.168.1.11/24", "").
+		StaticAddress("fd00::10/64", "fd00::1").
+		Route("10.0.0.0/8", "192.168.1.254", 100).
+		Route("fd01::/64", "fd00::fe", 0)
+	eth0.Nameservers = &SNameservers{Addresses: []string{"8.8.8.8"}, Search: []string{"yunion.io"}}
+
+	eth1 := NewNetworkInterface("eth1")
+	eth1.Dhcp4 = true
+	eth1.Dhcp6 = true
+
+	bond0 := SNetworkBond{
+		SNetworkInterface:  NewNetworkInterface("bond0"),
+		Interfaces:         []string{"eth2", "eth3"},
+		Mode:               "802.3ad",
+		MiiMonitorInterval: 100,
+		LacpRate:           "fast",
+		TransmitHashPolicy: "layer3+4",
+	}
+	vlan := SNetworkVlan{SNetworkInterface: NewNetworkInterface("bond0.100"), Id: 100, Link: "bond0"}
+	br0 := SNetworkBridge{SNetworkInterface: NewNetworkInterface("br0"), Interfaces: []string{"bond0.100"}}
+	br0.StaticAddress("172.16.0.2/16", "")
+
+	return &SNetworkConfig{
+		Ethernets: []SNetworkInterface{eth0, eth1, NewNetworkInterface("eth2"), NewNetworkInterface("eth3")},
+		Bonds:     []SNetworkBond{bond0},
+		Vlans:     []SNetworkVlan{vlan},
+		Bridges:   []SNetworkBridge{br0},
+	}
+}
+
+func TestNetworkConfigRoundTrip(t *testing.T) {
+	conf := newTestNetworkConfig()
+
+	v2 := conf.NetworkConfigV2()
+	parsed, err := ParseNetworkConfig(v2)
+	if err != nil {
+		t.Fatalf("ParseNetworkConfig v2: %v\n%s", err, v2)
+	}
+	if !reflect.DeepEqual(parsed, conf) {
+		t.Errorf("v2 round trip:\n%s\n%#v", v2, parsed)
+	}
+
+	conf.Nameservers = &SNameservers{Addresses: []string{"114.114.114.114"}}
+	v1, err := conf.NetworkConfigV1()
+	if err != nil {
+		t.Fatalf("NetworkConfigV1: %v", err)
+	}
+	parsed, err = ParseNetworkConfig(v1)
+	if err != nil {
+		t.Fatalf("ParseNetworkConfig v1: %v\n%s", err, v1)
+	}
+	if !reflect.DeepEqual(parsed, conf) {
+		t.Errorf("v1 round trip:\n%s\n%#v", v1, parsed)
+	}
+
+	// v2 has no global nameservers
+	parsed, _ = ParseNetworkConfig(conf.NetworkConfigV2())
+	if !reflect.DeepEqual(parsed.Bridges[0].Nameservers, conf.Nameservers) || parsed.Ethernets[1].Nameservers != nil {
+		t.Errorf("v2 global nameservers: %#v", parsed)
+	}
+}
+
+func TestParseNetworkConfig(t *testing.T) {
+	v1 := `version: 1
+config:
+- type: physical
+  name: eth0
+  mac_address: "52:54:00:12:34:00"
+  subnets:
+  - type: static
+    address: 192.168.1.10
+    netmask: 255.255.255.0
+    gateway: 192.168.1.1
+    dns_nameservers: [192.168.1.2]
+    routes:
+    - network: 10.0.0.0
+      netmask: 255.0.0.0
+      gateway: 192.168.1.254
+- type: bridge
+  name: br0
+  bridge_interfaces: [eth0]
+  params:
+    bridge_stp: "on"
+`
+	conf, err := ParseNetworkConfig(v1)
+	if err != nil {
+		t.Fatalf("ParseNetworkConfig v1: %v", err)
+	}
+	eth0 := conf.Ethernets[0]
+	if eth0.Addresses[0] != "192.168.1.10/24" || eth0.Gateway4 != "192.168.1.1" || eth0.Routes[0].To != "10.0.0.0/8" || eth0.Nameservers.Addresses[0] != "192.168.1.2" {
+		t.Errorf("v1 eth0: %#v", eth0)
+	}
+	if !conf.Bridges[0].Stp {
+		t.Errorf("v1 bridge stp off")
+	}
+
+	v2 := `network:
+  version: 2
+  ethernets:
+    id0:
+      match:
+        macaddress: "52:54:00:12:34:00"
+      set-name: eth0
+      addresses: [192.168.1.10/24]
+      gateway4: 192.168.1.1
+      routes:
+      - to: 0.0.0.0/0
+        via: 192.168.1.2
+        metric: 200
+  bridges:
+    br0:
+      interfaces: [eth0]
+`
+	conf, err = ParseNetworkConfig(v2)
+	if err != nil {
+		t.Fatalf("ParseNetworkConfig v2: %v", err)
+	}
+	eth0 = conf.Ethernets[0]
+	if eth0.Name != "eth0" || eth0.MacAddress != "52:54:00:12:34:00" || eth0.Gateway4 != "192.168.1.1" || len(eth0.Routes) != 1 || eth0.Routes[0].Metric != 200 {
+		t.Errorf("v2 eth0: %#v", eth0)
+	}
+	if !conf.Bridges[0].Stp {
+		t.Errorf("v2 bridge stp defaults to on")
+	}
+
+	for _, data := range []string{"version: 3\n", "version: 2\nethernets:\n  eth0:\n    addresses: [1.2.3]\n", "- a\n"} {
+		if _, err := ParseNetworkConfig(data); err == nil {
+			t.Errorf("%q should fail", data)
+		}
+	}
+}
+
+func TestNetworkConfigScript(t *testing.T) {
+	script := newTestNetworkConfig().NetworkConfigScript()
+	for _, expect := range []string{
+		"cat > " + NETPLAN_CONFIG_PATH,
+		"IPADDR1=192.168.1.11",
+		"IPV6ADDR=fd00::10/64",
+		`BONDING_OPTS="mode=802.3ad miimon=100 lacp_rate=fast xmit_hash_policy=layer3+4"`,
+		"MASTER=bond0",
+		"BRIDGE=br0",
+		"10.0.0.0/8 via 192.168.1.254 dev eth0 metric 100",
+		"iface eth0 inet6 static",
+		"    up ip addr add 192.168.1.11/24 dev eth0",
+		"    bond-master bond0",
+		"    vlan-raw-device bond0",
+	} {
+		if !strings.Contains(script, expect) {
+			t.Errorf("missing %q in\n%s", expect, script)
+		}
+	}
+}
+
+func TestNetworkConfigV1DhcpRoutes(t *testing.T) {
+	eth0 := NewNetworkInterface("eth0")
+	eth0.Dhcp4 = true
+	eth0.Dhcp6 = true
+	eth0.Route("10.0.0.0/8", "192.168.1.254", 100).
+		Route("fd01::/64", "fd00::fe", 0)
+	eth0.Nameservers = &SNameservers{Addresses: []string{"8.8.8.8"}}
+	eth1 := NewNetworkInterface("eth1")
+	eth1.Dhcp4 = true
+	eth1.StaticAddress("fd00::10/64", "fd00::1").Route("172.16.0.0/12", "192.168.2.254", 0)
+	conf := &SNetworkConfig{Ethernets: []SNetworkInterface{eth0, eth1}}
+
+	v1, err := conf.NetworkConfigV1()
+	if err != nil {
+		t.Fatalf("NetworkConfigV1: %v", err)
+	}
+	for _, want := range []string{"network: 10.0.0.0", "network: 172.16.0.0", "8.8.8.8", "fd01::"} {
+		if !strings.Contains(v1, want) {
+			t.Errorf("v1 missing %q:\n%s", want, v1)
+		}
+	}
+	parsed, err := ParseNetworkConfig(v1)
+	if err != nil {
+		t.Fatalf("ParseNetworkConfig v1: %v\n%s", err, v1)
+	}
+	if !reflect.DeepEqual(parsed, conf) {
+		t.Errorf("v1 round trip:\n%s\n%#v", v1, parsed)
+	}
+}
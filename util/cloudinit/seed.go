@@ -0,0 +1,595 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * seed images for the datasources without metadata service
+ * Reference: https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+ *            https://cloudinit.readthedocs.io/en/latest/reference/datasources/configdrive.html
+ *
+ */
+
+type TSeedFormat string
+type TSeedFilesystem string
+
+const (
+	SEED_FORMAT_NOCLOUD      = TSeedFormat("nocloud")
+	SEED_FORMAT_CONFIG_DRIVE = TSeedFormat("configdrive")
+
+	SEED_FS_ISO9660 = TSeedFilesystem("iso9660")
+	SEED_FS_VFAT    = TSeedFilesystem("vfat")
+
+	NOCLOUD_LABEL      = "cidata"
+	CONFIG_DRIVE_LABEL = "config-2"
+
+	NOCLOUD_META_DATA      = "meta-data"
+	NOCLOUD_USER_DATA      = "user-data"
+	NOCLOUD_NETWORK_CONFIG = "network-config"
+	NOCLOUD_VENDOR_DATA    = "vendor-data"
+
+	CONFIG_DRIVE_DIR          = "openstack/latest"
+	CONFIG_DRIVE_META_DATA    = CONFIG_DRIVE_DIR + "/meta_data.json"
+	CONFIG_DRIVE_USER_DATA    = CONFIG_DRIVE_DIR + "/user_data"
+	CONFIG_DRIVE_NETWORK_DATA = CONFIG_DRIVE_DIR + "/network_data.json"
+	CONFIG_DRIVE_VENDOR_DATA  = CONFIG_DRIVE_DIR + "/vendor_data.json"
+)
+
+type SInstanceMetadata struct {
+	InstanceId       string
+	Hostname         string
+	AvailabilityZone string
+	PublicKeys       []string
+	// Meta are the other key value pairs of the metadata
+	Meta map[string]string
+}
+
+// SSeed is the content of a NoCloud or ConfigDrive seed image
+type SSeed struct {
+	Metadata SInstanceMetadata
+	// CloudConfig is the user-data, overridden by UserData if not empty
+	CloudConfig *SCloudConfig
+	// UserData is the raw user-data, e.g. a multipart archive
+	UserData   string
+	Network    *SNetworkConfig
+	VendorData string
+}
+
+func (seed *SSeed) userData() string {
+	if len(seed.UserData) > 0 {
+		return seed.UserData
+	}
+	if seed.CloudConfig != nil {
+		return seed.CloudConfig.UserData()
+	}
+	return ""
+}
+
+func (seed *SSeed) nocloudFiles() (map[string][]byte, error) {
+	meta := jsonutils.NewDict()
+	for k, v := range seed.Metadata.Meta {
+		meta.Set(k, jsonutils.NewString(v))
+	}
+	meta.Set("instance-id", jsonutils.NewString(seed.Metadata.InstanceId))
+	if len(seed.Metadata.Hostname) > 0 {
+		meta.Set("local-hostname", jsonutils.NewString(seed.Metadata.Hostname))
+	}
+	if len(seed.Metadata.AvailabilityZone) > 0 {
+		meta.Set("availability-zone", jsonutils.NewString(seed.Metadata.AvailabilityZone))
+	}
+	if len(seed.Metadata.PublicKeys) > 0 {
+		meta.Set("public-keys", jsonutils.NewStringArray(seed.Metadata.PublicKeys))
+	}
+	files := map[string][]byte{
+		NOCLOUD_META_DATA: []byte(meta.YAMLString()),
+		NOCLOUD_USER_DATA: []byte(seed.userData()),
+	}
+	if seed.Network != nil {
+		network, err := seed.Network.NetworkConfigV1()
+		if err != nil {
+			return nil, errors.Wrap(err, "NetworkConfigV1")
+		}
+		files[NOCLOUD_NETWORK_CONFIG] = []byte(network)
+	}
+	if len(seed.VendorData) > 0 {
+		files[NOCLOUD_VENDOR_DATA] = []byte(seed.VendorData)
+	}
+	return files, nil
+}
+
+func (seed *SSeed) configDriveFiles() (map[string][]byte, error) {
+	meta := jsonutils.NewDict()
+	meta.Set("uuid", jsonutils.NewString(seed.Metadata.InstanceId))
+	if len(seed.Metadata.Hostname) > 0 {
+		meta.Set("hostname", jsonutils.NewString(seed.Metadata.Hostname))
+		meta.Set("name", jsonutils.NewString(seed.Metadata.Hostname))
+	}
+	if len(seed.Metadata.AvailabilityZone) > 0 {
+		meta.Set("availability_zone", jsonutils.NewString(seed.Metadata.AvailabilityZone))
+	}
+	if len(seed.Metadata.PublicKeys) > 0 {
+		keys := jsonutils.NewDict()
+		for i, key := range seed.Metadata.PublicKeys {
+			keys.Set(fmt.Sprintf("key-%d", i), jsonutils.NewString(key))
+		}
+		meta.Set("public_keys", keys)
+	}
+	if len(seed.Metadata.Meta) > 0 {
+		meta.Set("meta", jsonutils.Marshal(seed.Metadata.Meta))
+	}
+	files := map[string][]byte{
+		CONFIG_DRIVE_META_DATA: []byte(meta.String()),
+	}
+	if userData := seed.userData(); len(userData) > 0 {
+		files[CONFIG_DRIVE_USER_DATA] = []byte(userData)
+	}
+	if seed.Network != nil {
+		network, err := seed.Network.networkData()
+		if err != nil {
+			return nil, errors.Wrap(err, "networkData")
+		}
+		files[CONFIG_DRIVE_NETWORK_DATA] = []byte(network.String())
+	}
+	if len(seed.VendorData) > 0 {
+		vendor := jsonutils.NewDict()
+		vendor.Set("cloud-init", jsonutils.NewString(seed.VendorData))
+		files[CONFIG_DRIVE_VENDOR_DATA] = []byte(vendor.String())
+	}
+	return files, nil
+}
+
+// Files returns the files of the seed keyed by their paths in the image
+func (seed *SSeed) Files(format TSeedFormat) (map[string][]byte, error) {
+	if len(seed.Metadata.InstanceId) == 0 {
+		return nil, errors.Wrap(errors.ErrEmpty, "missing instance id")
+	}
+	switch format {
+	case SEED_FORMAT_NOCLOUD:
+		return seed.nocloudFiles()
+	case SEED_FORMAT_CONFIG_DRIVE:
+		return seed.configDriveFiles()
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "seed format %s", format)
+	}
+}
+
+// BuildImage returns the seed image in the filesystem
+func (seed *SSeed) BuildImage(format TSeedFormat, fs TSeedFilesystem) ([]byte, error) {
+	files, err := seed.Files(format)
+	if err != nil {
+		return nil, err
+	}
+	label := NOCLOUD_LABEL
+	if format == SEED_FORMAT_CONFIG_DRIVE {
+		label = CONFIG_DRIVE_LABEL
+	}
+	switch fs {
+	case SEED_FS_ISO9660:
+		return buildISO9660(label, files)
+	case SEED_FS_VFAT:
+		return buildVFAT(label, files)
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "seed filesystem %s", fs)
+	}
+}
+
+// WriteImage writes the seed image to the file
+func (seed *SSeed) WriteImage(filename string, format TSeedFormat, fs TSeedFilesystem) error {
+	image, err := seed.BuildImage(format, fs)
+	if err != nil {
+		return errors.Wrap(err, "BuildImage")
+	}
+	return ioutil.WriteFile(filename, image, 0644)
+}
+
+// ReadSeedImage extracts and parses the seed image file
+func ReadSeedImage(filename string) (*SSeed, TSeedFormat, error) {
+	image, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "ReadFile")
+	}
+	return ParseSeedImage(image)
+}
+
+// ParseSeedImage parses a NoCloud or ConfigDrive seed in an ISO9660 or
+// VFAT image
+func ParseSeedImage(image []byte) (*SSeed, TSeedFormat, error) {
+	var files map[string][]byte
+	var err error
+	switch {
+	case isISO9660(image):
+		_, files, err = readISO9660(image)
+	case isVFAT(image):
+		_, files, err = readVFAT(image)
+	default:
+		return nil, "", errors.Wrap(errors.ErrNotSupported, "unknown seed filesystem")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := files[CONFIG_DRIVE_META_DATA]; ok {
+		seed, err := parseConfigDriveFiles(files)
+		return seed, SEED_FORMAT_CONFIG_DRIVE, err
+	}
+	if _, ok := files[NOCLOUD_META_DATA]; ok {
+		seed, err := parseNocloudFiles(files)
+		return seed, SEED_FORMAT_NOCLOUD, err
+	}
+	return nil, "", errors.Wrap(errors.ErrNotFound, "no seed metadata")
+}
+
+func (seed *SSeed) parseUserData(data string) error {
+	seed.UserData = data
+	if len(data) == 0 {
+		return nil
+	}
+	conf, err := ParseUserData(data)
+	if err != nil {
+		return errors.Wrap(err, "ParseUserData")
+	}
+	seed.CloudConfig = conf
+	return nil
+}
+
+func parseNocloudFiles(files map[string][]byte) (*SSeed, error) {
+	seed := &SSeed{}
+	meta, err := jsonutils.ParseYAML(string(files[NOCLOUD_META_DATA]))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse meta-data")
+	}
+	metaDict, ok := meta.(*jsonutils.JSONDict)
+	if !ok {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "meta-data is not a mapping")
+	}
+	for k, v := range metaDict.Value() {
+		str, _ := v.GetString()
+		switch k {
+		case "instance-id":
+			seed.Metadata.InstanceId = str
+		case "local-hostname":
+			seed.Metadata.Hostname = str
+		case "availability-zone":
+			seed.Metadata.AvailabilityZone = str
+		case "public-keys":
+			seed.Metadata.PublicKeys = getStringArray(metaDict, k)
+		default:
+			if seed.Metadata.Meta == nil {
+				seed.Metadata.Meta = map[string]string{}
+			}
+			seed.Metadata.Meta[k] = str
+		}
+	}
+	if err := seed.parseUserData(string(files[NOCLOUD_USER_DATA])); err != nil {
+		return nil, err
+	}
+	if network, ok := files[NOCLOUD_NETWORK_CONFIG]; ok {
+		seed.Network, err = ParseNetworkConfig(string(network))
+		if err != nil {
+			return nil, errors.Wrap(err, "parse network-config")
+		}
+	}
+	seed.VendorData = string(files[NOCLOUD_VENDOR_DATA])
+	return seed, nil
+}
+
+func parseConfigDriveFiles(files map[string][]byte) (*SSeed, error) {
+	seed := &SSeed{}
+	meta, err := jsonutils.Parse(files[CONFIG_DRIVE_META_DATA])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse meta_data.json")
+	}
+	seed.Metadata.InstanceId, _ = meta.GetString("uuid")
+	seed.Metadata.Hostname, _ = meta.GetString("hostname")
+	seed.Metadata.AvailabilityZone, _ = meta.GetString("availability_zone")
+	if keys, err := meta.GetMap("public_keys"); err == nil {
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key, _ := keys[name].GetString()
+			seed.Metadata.PublicKeys = append(seed.Metadata.PublicKeys, key)
+		}
+	}
+	if m, err := meta.GetMap("meta"); err == nil {
+		seed.Metadata.Meta = map[string]string{}
+		for k, v := range m {
+			seed.Metadata.Meta[k], _ = v.GetString()
+		}
+	}
+	if err := seed.parseUserData(string(files[CONFIG_DRIVE_USER_DATA])); err != nil {
+		return nil, err
+	}
+	if network, ok := files[CONFIG_DRIVE_NETWORK_DATA]; ok {
+		seed.Network, err = parseNetworkData(network)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse network_data.json")
+		}
+	}
+	if vendor, ok := files[CONFIG_DRIVE_VENDOR_DATA]; ok {
+		vendorJson, err := jsonutils.Parse(vendor)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse vendor_data.json")
+		}
+		seed.VendorData, _ = vendorJson.GetString("cloud-init")
+	}
+	return seed, nil
+}
+
+// networkData returns the OpenStack network_data.json of the config, which
+// has no bridge
+func (n *SNetworkConfig) networkData() (*jsonutils.JSONDict, error) {
+	links := jsonutils.NewArray()
+	networks := jsonutils.NewArray()
+	services := jsonutils.NewArray()
+	addDns := func(ns *SNameservers) {
+		if ns == nil {
+			return
+		}
+		for _, addr := range ns.Addresses {
+			services.Add(jsonutils.Marshal(map[string]string{"type": "dns", "address": addr}))
+		}
+	}
+	addDns(n.Nameservers)
+	for _, dev := range n.devices() {
+		iface := dev.iface
+		link := jsonutils.NewDict()
+		link.Set("id", jsonutils.NewString(iface.Name))
+		link.Set("name", jsonutils.NewString(iface.Name))
+		switch {
+		case dev.bond != nil:
+			link.Set("type", jsonutils.NewString("bond"))
+			link.Set("bond_links", jsonutils.NewStringArray(dev.bond.Interfaces))
+			if len(dev.bond.Mode) > 0 {
+				link.Set("bond_mode", jsonutils.NewString(dev.bond.Mode))
+			}
+			if dev.bond.MiiMonitorInterval > 0 {
+				link.Set("bond_miimon", jsonutils.NewInt(int64(dev.bond.MiiMonitorInterval)))
+			}
+			if len(dev.bond.TransmitHashPolicy) > 0 {
+				link.Set("bond_xmit_hash_policy", jsonutils.NewString(dev.bond.TransmitHashPolicy))
+			}
+			if len(dev.bond.LacpRate) > 0 {
+				link.Set("bond_lacp_rate", jsonutils.NewString(dev.bond.LacpRate))
+			}
+		case dev.vlan != nil:
+			link.Set("type", jsonutils.NewString("vlan"))
+			link.Set("vlan_link", jsonutils.NewString(dev.vlan.Link))
+			link.Set("vlan_id", jsonutils.NewInt(int64(dev.vlan.Id)))
+			if len(iface.MacAddress) > 0 {
+				link.Set("vlan_mac_address", jsonutils.NewString(iface.MacAddress))
+			}
+		case dev.bridge != nil:
+			return nil, errors.Wrapf(errors.ErrNotSupported, "bridge %s in network_data.json", iface.Name)
+		default:
+			link.Set("type", jsonutils.NewString("phy"))
+		}
+		if len(iface.MacAddress) > 0 {
+			link.Set("ethernet_mac_address", jsonutils.NewString(iface.MacAddress))
+		}
+		if iface.Mtu > 0 {
+			link.Set("mtu", jsonutils.NewInt(int64(iface.Mtu)))
+		}
+		links.Add(link)
+
+		addNetwork := func(network *jsonutils.JSONDict) {
+			network.Set("id", jsonutils.NewString(fmt.Sprintf("network%d", networks.Length())))
+			network.Set("link", jsonutils.NewString(iface.Name))
+			networks.Add(network)
+		}
+		if iface.Dhcp4 {
+			addNetwork(jsonutils.Marshal(map[string]string{"type": "ipv4_dhcp"}).(*jsonutils.JSONDict))
+		}
+		if iface.Dhcp6 {
+			addNetwork(jsonutils.Marshal(map[string]string{"type": "ipv6_dhcp"}).(*jsonutils.JSONDict))
+		}
+		for _, v6 := range []bool{false, true} {
+			netType, gateway, defaultNet := "ipv4", iface.Gateway4, "0.0.0.0/0"
+			if v6 {
+				netType, gateway, defaultNet = "ipv6", iface.Gateway6, "::/0"
+			}
+			for i, addr := range iface.addresses(v6) {
+				ip, ipnet, err := net.ParseCIDR(addr)
+				if err != nil {
+					return nil, errors.Wrapf(errors.ErrInvalidFormat, "address %s", addr)
+				}
+				network := jsonutils.NewDict()
+				network.Set("type", jsonutils.NewString(netType))
+				network.Set("ip_address", jsonutils.NewString(ip.String()))
+				network.Set("netmask", jsonutils.NewString(net.IP(ipnet.Mask).String()))
+				if i == 0 {
+					routes := jsonutils.NewArray()
+					allRoutes := iface.routes(v6)
+					if len(gateway) > 0 {
+						allRoutes = append([]SNetworkRoute{{To: defaultNet, Via: gateway}}, allRoutes...)
+					}
+					for _, r := range allRoutes {
+						_, dst, err := net.ParseCIDR(r.To)
+						if err != nil {
+							return nil, errors.Wrapf(errors.ErrInvalidFormat, "route %s", r.To)
+						}
+						route := jsonutils.NewDict()
+						route.Set("network", jsonutils.NewString(dst.IP.String()))
+						route.Set("netmask", jsonutils.NewString(net.IP(dst.Mask).String()))
+						route.Set("gateway", jsonutils.NewString(r.Via))
+						if r.Metric > 0 {
+							route.Set("metric", jsonutils.NewInt(int64(r.Metric)))
+						}
+						routes.Add(route)
+					}
+					if routes.Length() > 0 {
+						network.Set("routes", routes)
+					}
+				}
+				addNetwork(network)
+			}
+		}
+		addDns(iface.Nameservers)
+	}
+	ret := jsonutils.NewDict()
+	ret.Set("links", links)
+	ret.Set("networks", networks)
+	ret.Set("services", services)
+	return ret, nil
+}
+
+func maskPrefix(mask string) int {
+	ip := net.ParseIP(mask)
+	if ip == nil {
+		return 0
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(mask, ":") {
+		ones, _ := net.IPMask(ip4).Size()
+		return ones
+	}
+	ones, _ := net.IPMask(ip).Size()
+	return ones
+}
+
+// parseNetworkData parses the OpenStack network_data.json, its dns services
+// become the global nameservers
+func parseNetworkData(data []byte) (*SNetworkConfig, error) {
+	obj, err := jsonutils.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "jsonutils.Parse")
+	}
+	n := &SNetworkConfig{}
+	ifaces := map[string]*SNetworkInterface{}
+	links, _ := obj.GetArray("links")
+	for _, link := range links {
+		id, _ := link.GetString("id")
+		linkType, _ := link.GetString("type")
+		iface := NewNetworkInterface(id)
+		if name, _ := link.GetString("name"); len(name) > 0 {
+			iface.Name = name
+		}
+		iface.MacAddress, _ = link.GetString("ethernet_mac_address")
+		if mtu, err := link.Int("mtu"); err == nil {
+			iface.Mtu = int(mtu)
+		}
+		switch linkType {
+		case "bond":
+			bond := SNetworkBond{SNetworkInterface: iface}
+			bondLinks, _ := link.GetArray("bond_links")
+			for _, l := range bondLinks {
+				name, _ := l.GetString()
+				bond.Interfaces = append(bond.Interfaces, name)
+			}
+			bond.Mode, _ = link.GetString("bond_mode")
+			if miimon, err := link.Int("bond_miimon"); err == nil {
+				bond.MiiMonitorInterval = int(miimon)
+			}
+			bond.TransmitHashPolicy, _ = link.GetString("bond_xmit_hash_policy")
+			bond.LacpRate, _ = link.GetString("bond_lacp_rate")
+			n.Bonds = append(n.Bonds, bond)
+		case "vlan":
+			vlan := SNetworkVlan{SNetworkInterface: iface}
+			vlan.Link, _ = link.GetString("vlan_link")
+			if vid, err := link.Int("vlan_id"); err == nil {
+				vlan.Id = int(vid)
+			}
+			if mac, _ := link.GetString("vlan_mac_address"); len(mac) > 0 {
+				vlan.MacAddress = mac
+			}
+			n.Vlans = append(n.Vlans, vlan)
+		default:
+			n.Ethernets = append(n.Ethernets, iface)
+		}
+	}
+	for _, dev := range n.devices() {
+		ifaces[dev.iface.Name] = dev.iface
+	}
+	// bond and vlan links refer to the ids
+	for _, link := range links {
+		id, _ := link.GetString("id")
+		name, _ := link.GetString("name")
+		if iface, ok := ifaces[name]; ok && len(name) > 0 {
+			ifaces[id] = iface
+		}
+	}
+
+	networks, _ := obj.GetArray("networks")
+	for _, network := range networks {
+		linkId, _ := network.GetString("link")
+		iface, ok := ifaces[linkId]
+		if !ok {
+			return nil, errors.Wrapf(errors.ErrNotFound, "link %s", linkId)
+		}
+		netType, _ := network.GetString("type")
+		switch netType {
+		case "ipv4_dhcp":
+			iface.Dhcp4 = true
+			continue
+		case "ipv6_dhcp", "ipv6_slaac", "ipv6_dhcpv6-stateful", "ipv6_dhcpv6-stateless":
+			iface.Dhcp6 = true
+			continue
+		case "ipv4", "ipv6":
+		default:
+			continue
+		}
+		ip, _ := network.GetString("ip_address")
+		mask, _ := network.GetString("netmask")
+		if strings.Contains(ip, "/") {
+			iface.Addresses = append(iface.Addresses, ip)
+		} else {
+			iface.Addresses = append(iface.Addresses, fmt.Sprintf("%s/%d", ip, maskPrefix(mask)))
+		}
+		routes, _ := network.GetArray("routes")
+		for _, r := range routes {
+			dst, _ := r.GetString("network")
+			mask, _ := r.GetString("netmask")
+			route := SNetworkRoute{To: fmt.Sprintf("%s/%d", dst, maskPrefix(mask))}
+			route.Via, _ = r.GetString("gateway")
+			if metric, err := r.Int("metric"); err == nil {
+				route.Metric = int(metric)
+			}
+			iface.addRoute(route)
+		}
+	}
+	for _, link := range links {
+		id, _ := link.GetString("id")
+		if linkType, _ := link.GetString("type"); linkType == "vlan" {
+			vlanLink, _ := link.GetString("vlan_link")
+			for i := range n.Vlans {
+				if target, ok := ifaces[vlanLink]; ok && ifaces[id] == &n.Vlans[i].SNetworkInterface {
+					n.Vlans[i].Link = target.Name
+				}
+			}
+		}
+	}
+
+	services, _ := obj.GetArray("services")
+	for _, svc := range services {
+		if svcType, _ := svc.GetString("type"); svcType == "dns" {
+			addr, _ := svc.GetString("address")
+			if n.Nameservers == nil {
+				n.Nameservers = &SNameservers{}
+			}
+			n.Nameservers.Addresses = append(n.Nameservers.Addresses, addr)
+		}
+	}
+	return n, nil
+}
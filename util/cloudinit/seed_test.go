@@ -0,0 +1,145 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestSeed() *SSeed {
+	usr := NewUser("yunion")
+	usr.SshKey("ssh-rsa AAAA yunion")
+	network := newTestNetworkConfig()
+	// ConfigDrive has neither bridges nor nameservers of the interfaces
+	network.Bridges = nil
+	network.Ethernets[0].Nameservers = nil
+	network.Nameservers = &SNameservers{Addresses: []string{"8.8.8.8", "fd00::53"}}
+	return &SSeed{
+		Metadata: SInstanceMetadata{
+			InstanceId:       "i-0123456789",
+			Hostname:         "vm-01",
+			AvailabilityZone: "zone1",
+			PublicKeys:       []string{"ssh-rsa AAAA yunion"},
+			Meta:             map[string]string{"project": "system"},
+		},
+		CloudConfig: &SCloudConfig{
+			Users:  []SUser{usr},
+			Runcmd: []string{"echo hello"},
+		},
+		Network:    network,
+		VendorData: CLOUD_CONFIG_HEADER + "packages:\n- vim\n",
+	}
+}
+
+func TestSeedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	seed := newTestSeed()
+	for _, format := range []TSeedFormat{SEED_FORMAT_NOCLOUD, SEED_FORMAT_CONFIG_DRIVE} {
+		for _, fs := range []TSeedFilesystem{SEED_FS_ISO9660, SEED_FS_VFAT} {
+			name := string(format) + "-" + string(fs)
+			filename := filepath.Join(dir, name+".img")
+			if err := seed.WriteImage(filename, format, fs); err != nil {
+				t.Fatalf("%s: WriteImage: %v", name, err)
+			}
+			parsed, parsedFormat, err := ReadSeedImage(filename)
+			if err != nil {
+				t.Fatalf("%s: ReadSeedImage: %v", name, err)
+			}
+			if parsedFormat != format {
+				t.Errorf("%s: format %s", name, parsedFormat)
+			}
+			if !reflect.DeepEqual(parsed.Metadata, seed.Metadata) {
+				t.Errorf("%s: metadata %#v", name, parsed.Metadata)
+			}
+			if parsed.UserData != seed.CloudConfig.UserData() || parsed.CloudConfig.UserData() != seed.CloudConfig.UserData() {
+				t.Errorf("%s: user-data %s", name, parsed.UserData)
+			}
+			if !reflect.DeepEqual(parsed.Network, seed.Network) {
+				t.Errorf("%s: network %#v", name, parsed.Network)
+			}
+			if parsed.VendorData != seed.VendorData {
+				t.Errorf("%s: vendor-data %q", name, parsed.VendorData)
+			}
+		}
+	}
+
+	seed.Network = newTestNetworkConfig()
+	if _, err := seed.BuildImage(SEED_FORMAT_CONFIG_DRIVE, SEED_FS_ISO9660); err == nil {
+		t.Errorf("bridge in ConfigDrive should fail")
+	}
+	seed.Metadata.InstanceId = ""
+	if _, err := seed.BuildImage(SEED_FORMAT_NOCLOUD, SEED_FS_ISO9660); err == nil {
+		t.Errorf("seed without instance id should fail")
+	}
+}
+
+func TestSeedFilesystems(t *testing.T) {
+	files := map[string][]byte{
+		"meta-data": []byte("instance-id: test\n"),
+		"README":    []byte("short name"),
+		"a very long file name of many chars.txt": []byte("long name"),
+		"openstack/latest/meta_data.json":         []byte("{}"),
+		"openstack/2012-08-10/user_data":          bytes.Repeat([]byte("0123456789abcdef"), 1000),
+		"empty":                                   {},
+		"ünïcode":                                 []byte("unicode"),
+	}
+	for i := 0; i < 40; i++ {
+		files[filepath.Join("many", strings.Repeat("x", i+1))] = []byte{byte(i)}
+	}
+	for _, fs := range []struct {
+		name  string
+		label string
+		build func(string, map[string][]byte) ([]byte, error)
+		read  func([]byte) (string, map[string][]byte, error)
+	}{
+		{"iso9660", "cidata", buildISO9660, readISO9660},
+		{"vfat", "CIDATA", buildVFAT, readVFAT},
+	} {
+		image, err := fs.build("cidata", files)
+		if err != nil {
+			t.Fatalf("%s: build: %v", fs.name, err)
+		}
+		label, parsed, err := fs.read(image)
+		if err != nil {
+			t.Fatalf("%s: read: %v", fs.name, err)
+		}
+		if label != fs.label {
+			t.Errorf("%s: label %q", fs.name, label)
+		}
+		if len(parsed) != len(files) {
+			t.Errorf("%s: %d files, expect %d", fs.name, len(parsed), len(files))
+		}
+		for name, content := range files {
+			if !bytes.Equal(parsed[name], content) {
+				t.Errorf("%s: %s content mismatch", fs.name, name)
+			}
+		}
+	}
+
+	if _, err := newImageTree(map[string][]byte{"a": nil, "a/b": nil}); err == nil {
+		t.Errorf("file and directory of the same name should fail")
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * sysprep unattend.xml
+ * Reference: https://learn.microsoft.com/en-us/windows-hardware/customize/desktop/unattend/
+ *
+ */
+
+const (
+	UNATTEND_ARCH_AMD64 = "amd64"
+	UNATTEND_ARCH_X86   = "x86"
+	UNATTEND_ARCH_ARM64 = "arm64"
+
+	UNATTEND_SCRIPTS_DIR = `C:\Windows\Setup\Scripts`
+
+	// unattendCommandMaxLen is the limit of a FirstLogonCommands command line
+	unattendCommandMaxLen = 1024
+	unattendChunkLen      = 960
+)
+
+type sUnattendSecret struct {
+	Value     string
+	PlainText bool
+}
+
+// encodeUnattendSecret encodes the password as Windows System Image Manager
+// does, the UTF-16LE of the password and the element name in base64
+func encodeUnattendSecret(password string, element string) *sUnattendSecret {
+	codes := utf16.Encode([]rune(password + element))
+	buf := make([]byte, len(codes)*2)
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(buf[i*2:], c)
+	}
+	return &sUnattendSecret{Value: base64.StdEncoding.EncodeToString(buf), PlainText: false}
+}
+
+// DecodeUnattendSecret returns the password of an encoded unattend secret
+func DecodeUnattendSecret(value string, element string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", errors.Wrap(err, "DecodeString")
+	}
+	if len(buf)%2 != 0 {
+		return "", errors.Wrap(errors.ErrInvalidFormat, "odd UTF-16 length")
+	}
+	codes := make([]uint16, len(buf)/2)
+	for i := range codes {
+		codes[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	str := string(utf16.Decode(codes))
+	if !strings.HasSuffix(str, element) {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "not a %s secret", element)
+	}
+	return strings.TrimSuffix(str, element), nil
+}
+
+type sUnattendCommand struct {
+	Action      string `xml:"wcm:action,attr"`
+	Order       int
+	CommandLine string
+	Description string `xml:",omitempty"`
+}
+
+type sUnattendFirstLogonCommands struct {
+	SynchronousCommand []sUnattendCommand
+}
+
+type sUnattendAutoLogon struct {
+	Password   *sUnattendSecret
+	Enabled    bool
+	LogonCount int
+	Username   string
+}
+
+type sUnattendOOBE struct {
+	HideEULAPage              bool
+	HideOnlineAccountScreens  bool
+	HideWirelessSetupInOOBE   bool
+	NetworkLocation           string
+	ProtectYourPC             int
+	HideLocalAccountScreen    bool
+	HideOEMRegistrationScreen bool
+}
+
+type sUnattendUserAccounts struct {
+	AdministratorPassword *sUnattendSecret
+}
+
+type sUnattendComponent struct {
+	Name                  string `xml:"name,attr"`
+	ProcessorArchitecture string `xml:"processorArchitecture,attr"`
+	PublicKeyToken        string `xml:"publicKeyToken,attr"`
+	Language              string `xml:"language,attr"`
+	VersionScope          string `xml:"versionScope,attr"`
+	XmlnsWcm              string `xml:"xmlns:wcm,attr"`
+	XmlnsXsi              string `xml:"xmlns:xsi,attr"`
+
+	AutoLogon          *sUnattendAutoLogon          `xml:",omitempty"`
+	ComputerName       string                       `xml:",omitempty"`
+	FirstLogonCommands *sUnattendFirstLogonCommands `xml:",omitempty"`
+	OOBE               *sUnattendOOBE               `xml:",omitempty"`
+	TimeZone           string                       `xml:",omitempty"`
+	UserAccounts       *sUnattendUserAccounts       `xml:",omitempty"`
+}
+
+type sUnattendSettings struct {
+	Pass       string               `xml:"pass,attr"`
+	Components []sUnattendComponent `xml:"component"`
+}
+
+type sUnattend struct {
+	XMLName  xml.Name            `xml:"urn:schemas-microsoft-com:unattend unattend"`
+	Settings []sUnattendSettings `xml:"settings"`
+}
+
+func newShellSetupComponent(arch string) sUnattendComponent {
+	return sUnattendComponent{
+		Name:                  "Microsoft-Windows-Shell-Setup",
+		ProcessorArchitecture: arch,
+		PublicKeyToken:        "31bf3856ad364e35",
+		Language:              "neutral",
+		VersionScope:          "nonSxS",
+		XmlnsWcm:              "http://schemas.microsoft.com/WMIConfig/2002/State",
+		XmlnsXsi:              "http://www.w3.org/2001/XMLSchema-instance",
+	}
+}
+
+// SUnattendOptions are the settings of unattend.xml not in SCloudConfig
+type SUnattendOptions struct {
+	// Arch is the processorArchitecture of the components, amd64 by default
+	Arch string
+	// Network is optionally configured by the first logon script
+	Network *SNetworkConfig
+	// FirstLogonCommands run after the first logon script
+	FirstLogonCommands []string
+}
+
+// firstLogonScriptCommands writes the PowerShell script by chunks of base64
+// under the command line limit, then runs and removes it
+func firstLogonScriptCommands(script string) []string {
+	b64Path := UNATTEND_SCRIPTS_DIR + `\cloudconfig.b64`
+	psPath := UNATTEND_SCRIPTS_DIR + `\cloudconfig.ps1`
+	// with BOM so that Windows PowerShell reads the script as UTF-8
+	data := base64.StdEncoding.EncodeToString(append([]byte{0xef, 0xbb, 0xbf}, []byte(script)...))
+	cmds := []string{
+		fmt.Sprintf(`cmd /c if not exist %s mkdir %s`, UNATTEND_SCRIPTS_DIR, UNATTEND_SCRIPTS_DIR),
+		fmt.Sprintf(`cmd /c type nul > %s`, b64Path),
+	}
+	for len(data) > 0 {
+		n := unattendChunkLen
+		if n > len(data) {
+			n = len(data)
+		}
+		// base64 has no cmd metacharacters, the redirection goes first lest
+		// a trailing digit is taken as a file handle
+		cmds = append(cmds, fmt.Sprintf(`cmd /c >>%s echo %s`, b64Path, data[:n]))
+		data = data[n:]
+	}
+	cmds = append(cmds,
+		fmt.Sprintf(`powershell -NoProfile -ExecutionPolicy Bypass -Command "[IO.File]::WriteAllBytes('%s', [Convert]::FromBase64String((Get-Content '%s') -join ''))"`, psPath, b64Path),
+		fmt.Sprintf(`powershell -NoProfile -ExecutionPolicy Bypass -File %s`, psPath),
+		fmt.Sprintf(`cmd /c del /f /q %s %s`, b64Path, psPath),
+	)
+	return cmds
+}
+
+// UnattendXML renders a sysprep unattend.xml for the Windows images without
+// cloudbase-init, it sets the computer name, timezone and Administrator
+// password, the rest of the config runs as first logon commands
+func (conf *SCloudConfig) UnattendXML(opts SUnattendOptions) (string, error) {
+	arch := opts.Arch
+	if len(arch) == 0 {
+		arch = UNATTEND_ARCH_AMD64
+	}
+
+	specialize := newShellSetupComponent(arch)
+	specialize.ComputerName = conf.WindowsComputerName()
+	if len(conf.Timezone) > 0 {
+		specialize.TimeZone = WindowsTimezone(conf.Timezone)
+	}
+
+	oobe := newShellSetupComponent(arch)
+	oobe.OOBE = &sUnattendOOBE{
+		HideEULAPage:              true,
+		HideOnlineAccountScreens:  true,
+		HideWirelessSetupInOOBE:   true,
+		NetworkLocation:           "Work",
+		ProtectYourPC:             3,
+		HideLocalAccountScreen:    true,
+		HideOEMRegistrationScreen: true,
+	}
+	password := conf.WindowsAdminPassword()
+	if len(password) > 0 {
+		oobe.UserAccounts = &sUnattendUserAccounts{
+			AdministratorPassword: encodeUnattendSecret(password, "AdministratorPassword"),
+		}
+	}
+
+	cmds := []string{}
+	// computer name and timezone are set in the specialize pass already
+	script := *conf
+	script.Hostname, script.Fqdn, script.Timezone = "", "", ""
+	if shells := script.powerShellScripts(opts.Network, true); len(shells) > 0 {
+		cmds = append(cmds, firstLogonScriptCommands(strings.Join(shells, "\r\n"))...)
+	}
+	cmds = append(cmds, opts.FirstLogonCommands...)
+	if len(cmds) > 0 {
+		commands := make([]sUnattendCommand, len(cmds))
+		for i, cmd := range cmds {
+			if len(cmd) > unattendCommandMaxLen {
+				return "", errors.Wrapf(errors.ErrNotSupported, "first logon command %d longer than %d", i+1, unattendCommandMaxLen)
+			}
+			commands[i] = sUnattendCommand{Action: "add", Order: i + 1, CommandLine: cmd}
+		}
+		oobe.FirstLogonCommands = &sUnattendFirstLogonCommands{SynchronousCommand: commands}
+		if len(password) == 0 {
+			return "", errors.Wrap(errors.ErrEmpty, "first logon commands need the Administrator password to auto logon")
+		}
+		// the first logon commands run once Administrator logs on
+		oobe.AutoLogon = &sUnattendAutoLogon{
+			Password:   encodeUnattendSecret(password, "Password"),
+			Enabled:    true,
+			LogonCount: 1,
+			Username:   WINDOWS_ADMINISTRATOR,
+		}
+	}
+
+	unattend := sUnattend{
+		Settings: []sUnattendSettings{
+			{Pass: "specialize", Components: []sUnattendComponent{specialize}},
+			{Pass: "oobeSystem", Components: []sUnattendComponent{oobe}},
+		},
+	}
+	data, err := xml.MarshalIndent(unattend, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "xml.MarshalIndent")
+	}
+	return xml.Header + string(data) + "\n", nil
+}
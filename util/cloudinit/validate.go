@@ -0,0 +1,620 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/tristate"
+	"yunion.io/x/pkg/util/reflectutils"
+	"yunion.io/x/pkg/utils"
+)
+
+type TValidationCode string
+
+const (
+	VALIDATION_SYNTAX        = TValidationCode("syntax")
+	VALIDATION_UNKNOWN_KEY   = TValidationCode("unknown_key")
+	VALIDATION_WRONG_TYPE    = TValidationCode("wrong_type")
+	VALIDATION_INVALID_VALUE = TValidationCode("invalid_value")
+	VALIDATION_DUPLICATE     = TValidationCode("duplicate")
+)
+
+// SValidationError is a problem of cloud-config, Line and Column are 1-based
+// positions in the original YAML and 0 if unknown. The positions are found
+// by scanning the lines of block style YAML: a value in a flow collection or
+// a block scalar is located at the collection or the scalar, and no
+// position is known in a document indented by tabs or using anchors and
+// aliases.
+type SValidationError struct {
+	Code TValidationCode
+	// Warning is set for the problems cloud-init tolerates, e.g. the
+	// unknown keys of a module
+	Warning bool
+	// Part is the filename of the multipart user-data part
+	Part    string
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e SValidationError) Error() string {
+	var buf strings.Builder
+	if e.Warning {
+		buf.WriteString("warning: ")
+	}
+	if len(e.Part) > 0 {
+		buf.WriteString(e.Part + ": ")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, "line %d, column %d: ", e.Line, e.Column)
+	}
+	if len(e.Path) > 0 {
+		buf.WriteString(e.Path + ": ")
+	}
+	buf.WriteString(e.Message)
+	return buf.String()
+}
+
+type SValidationErrors []SValidationError
+
+func (errs SValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// cloudInitKeys are the cloud-config keys known to cloud-init but not
+// modeled by SCloudConfig, they are kept without validation
+var cloudInitKeys = map[string]bool{
+	"ansible": true, "apk_repos": true, "byobu_by_default": true,
+	"ca-certs": true, "chef": true, "create_hostname_file": true, "device_aliases": true,
+	"disable_ec2_metadata": true, "drivers": true, "final_message": true, "groups": true,
+	"growpart": true, "keyboard": true, "landscape": true, "locale": true,
+	"locale_configfile": true, "lxd": true, "manage_resolv_conf": true, "mcollective": true,
+	"merge_how": true, "merge_type": true, "mount_default_fields": true, "output": true,
+	"package_reboot_if_required": true, "package_update": true, "package_upgrade": true,
+	"password": true, "prefer_fqdn_over_hostname": true, "puppet": true, "random_seed": true,
+	"reporting": true, "resize_rootfs": true, "resolv_conf": true, "rh_subscription": true,
+	"rsyslog": true, "salt_minion": true, "seed_random": true, "snap": true,
+	"spacewalk": true, "ssh_authorized_keys": true, "ssh_fp_console_blacklist": true,
+	"ssh_genkeytypes": true, "ssh_import_id": true, "ssh_key_console_blacklist": true,
+	"ssh_publish_hostkeys": true, "ssh_quiet_keygen": true, "swap": true, "system_info": true,
+	"ubuntu_pro": true, "updates": true, "vendor_data": true, "wireguard": true,
+	"yum_repo_dir": true, "zypper": true,
+	"allow_public_ssh_keys": true, "apt_pipelining": true, "apt_reboot_if_required": true,
+	"apt_update": true, "apt_upgrade": true, "autoinstall": true, "disable_root_opts": true,
+	"fan": true, "grub_dpkg": true, "grub-dpkg": true, "launch-index": true,
+	"no_ssh_fingerprints": true, "ssh": true, "ubuntu_advantage": true, "user": true,
+}
+
+// cloudInitModuleKeys are the keys of the cloud-config mappings documented
+// by cloud-init but not modeled, "*" allows any key, the other keys are
+// warned about
+var cloudInitModuleKeys = map[reflect.Type][]string{
+	reflect.TypeOf(SUser{}): {
+		"create_groups", "doas", "expiredate", "gecos", "groups", "homedir", "inactive",
+		"no_create_home", "no_log_init", "no_user_group", "passwd", "primary_group",
+		"selinux_user", "shell", "snapuser", "ssh_import_id", "ssh_redirect_user", "system", "uid",
+	},
+	reflect.TypeOf(SWriteFile{}):    {"append", "defer", "source"},
+	reflect.TypeOf(SPhoneHome{}):    {"post", "tries"},
+	reflect.TypeOf(SFsSetup{}):      {"cmd", "replace_fs"},
+	reflect.TypeOf(SNtp{}):          {"allow", "config", "peers"},
+	reflect.TypeOf(SCaCerts{}):      {"remove-defaults"},
+	reflect.TypeOf(SAptSource{}):    {"append", "filename"},
+	reflect.TypeOf(SYumRepo{}):      {"*"},
+	reflect.TypeOf(SChpasswdUser{}): {},
+	reflect.TypeOf(SApt{}): {
+		"add_apt_repo_match", "conf", "debconf_selections", "disable_suites", "ftp_proxy",
+		"http_proxy", "https_proxy", "preserve_sources_list", "primary", "proxy", "security",
+		"sources_list",
+	},
+}
+
+func isCloudInitModuleKey(t reflect.Type, key string) bool {
+	keys := cloudInitModuleKeys[t]
+	return utils.IsInStringArray("*", keys) || utils.IsInStringArray(key, keys)
+}
+
+var (
+	permissionsRegexp = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+	userNameRegexp    = `[A-Za-z_][A-Za-z0-9_.-]*\$?`
+	ownerRegexp       = regexp.MustCompile(`^` + userNameRegexp + `(:` + userNameRegexp + `)?$`)
+	userRegexp        = regexp.MustCompile(`^` + userNameRegexp + `$`)
+	// e.g. ALL=(ALL) NOPASSWD:ALL
+	sudoRuleRegexp = regexp.MustCompile(`^\S+\s*=\s*(\([^)]*\)\s*)?((NO)?(PASSWD|SETENV|EXEC|LOG_INPUT|LOG_OUTPUT):\s*)*\S.*$`)
+	delayRegexp    = regexp.MustCompile(`^(now|\+?[0-9]+)$`)
+
+	writeFileEncodings = []string{"", "b64", "base64", "gz", "gzip", "gz+b64", "gz+base64", "gzip+b64", "gzip+base64", "text/plain"}
+
+	jsonObjectType = reflect.TypeOf((*jsonutils.JSONObject)(nil)).Elem()
+	tristateType   = reflect.TypeOf(tristate.None)
+)
+
+type sCloudConfigValidator struct {
+	part      string
+	positions map[string]sYamlPosition
+	errs      SValidationErrors
+	warnings  SValidationErrors
+	// userIndex maps the users to their index in the YAML, where the
+	// "default" user is kept
+	userIndex []int
+	// typeErrors are the paths of wrong types, their values are not checked
+	typeErrors map[string]bool
+}
+
+func (v *sCloudConfigValidator) hasTypeError(path string) bool {
+	for len(path) > 0 {
+		if v.typeErrors[path] {
+			return true
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return false
+}
+
+func (v *sCloudConfigValidator) addError(code TValidationCode, path string, format string, args ...interface{}) {
+	if code == VALIDATION_WRONG_TYPE || code == VALIDATION_UNKNOWN_KEY {
+		if v.typeErrors == nil {
+			v.typeErrors = map[string]bool{}
+		}
+		v.typeErrors[path] = true
+	} else if v.hasTypeError(path) {
+		return
+	}
+	pos := lookupYamlPosition(v.positions, path)
+	v.errs = append(v.errs, SValidationError{
+		Code:    code,
+		Part:    v.part,
+		Path:    path,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *sCloudConfigValidator) addWarning(code TValidationCode, path string, format string, args ...interface{}) {
+	pos := lookupYamlPosition(v.positions, path)
+	v.warnings = append(v.warnings, SValidationError{
+		Code:    code,
+		Warning: true,
+		Part:    v.part,
+		Path:    path,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func joinPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonTypeName(obj jsonutils.JSONObject) string {
+	switch obj.(type) {
+	case *jsonutils.JSONString:
+		return "string"
+	case *jsonutils.JSONInt, *jsonutils.JSONFloat:
+		return "number"
+	case *jsonutils.JSONBool:
+		return "boolean"
+	case *jsonutils.JSONArray:
+		return "list"
+	case *jsonutils.JSONDict:
+		return "mapping"
+	}
+	return "null"
+}
+
+func isJSONScalar(obj jsonutils.JSONObject) bool {
+	switch obj.(type) {
+	case *jsonutils.JSONString, *jsonutils.JSONInt, *jsonutils.JSONFloat, *jsonutils.JSONBool:
+		return true
+	}
+	return false
+}
+
+// validateType checks the YAML value against the type it unmarshals to, the
+// values of wrong types inside are pruned so that the rest unmarshals
+func (v *sCloudConfigValidator) validateType(path string, obj jsonutils.JSONObject, t reflect.Type) bool {
+	if obj == nil || obj == jsonutils.JSONNull {
+		return true
+	}
+	if t == jsonObjectType {
+		return true
+	}
+	if t == tristateType {
+		if _, ok := obj.(*jsonutils.JSONBool); !ok {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect boolean, got %s", jsonTypeName(obj))
+			return false
+		}
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return v.validateType(path, obj, t.Elem())
+	case reflect.String:
+		if !isJSONScalar(obj) {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect string, got %s", jsonTypeName(obj))
+			return false
+		}
+	case reflect.Bool:
+		if _, ok := obj.(*jsonutils.JSONBool); !ok {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect boolean, got %s", jsonTypeName(obj))
+			return false
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// e.g. disable_root: true
+		switch obj.(type) {
+		case *jsonutils.JSONInt, *jsonutils.JSONBool:
+		default:
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect integer, got %s", jsonTypeName(obj))
+			return false
+		}
+	case reflect.Slice:
+		array, ok := obj.(*jsonutils.JSONArray)
+		if !ok {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect list, got %s", jsonTypeName(obj))
+			return false
+		}
+		items, _ := array.GetArray()
+		for i, item := range items {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			ok := true
+			switch {
+			case path == "users" && item.String() == `"default"`:
+			case (path == "runcmd" || path == "bootcmd") && t.Elem().Kind() == reflect.String:
+				// a command is a string or a list of arguments
+				if args, isArray := item.(*jsonutils.JSONArray); isArray {
+					ok = v.validateType(itemPath, args, reflect.TypeOf([]string{}))
+				} else {
+					ok = v.validateType(itemPath, item, t.Elem())
+				}
+			default:
+				ok = v.validateType(itemPath, item, t.Elem())
+			}
+			if !ok {
+				array.SetAt(i, jsonutils.JSONNull)
+			}
+		}
+	case reflect.Map:
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect mapping, got %s", jsonTypeName(obj))
+			return false
+		}
+		for _, key := range dict.SortedKeys() {
+			value, _ := dict.Get(key)
+			if !v.validateType(joinPath(path, key), value, t.Elem()) {
+				dict.Remove(key)
+			}
+		}
+	case reflect.Struct:
+		dict, ok := obj.(*jsonutils.JSONDict)
+		if !ok {
+			v.addError(VALIDATION_WRONG_TYPE, path, "expect mapping, got %s", jsonTypeName(obj))
+			return false
+		}
+		fields := map[string]reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			info := reflectutils.ParseStructFieldJsonInfo(t.Field(i))
+			if !info.Ignore {
+				fields[info.MarshalName()] = t.Field(i)
+			}
+		}
+		for _, key := range dict.SortedKeys() {
+			value, _ := dict.Get(key)
+			keyPath := joinPath(path, key)
+			field, ok := fields[key]
+			if !ok {
+				switch {
+				case len(path) == 0:
+					if !cloudInitKeys[key] {
+						v.addError(VALIDATION_UNKNOWN_KEY, keyPath, "unknown key %q", key)
+					}
+				case !isCloudInitModuleKey(t, key):
+					// kept in Extra
+					v.addWarning(VALIDATION_UNKNOWN_KEY, keyPath, "unknown key %q", key)
+				}
+				continue
+			}
+			if t == reflect.TypeOf(SWriteFile{}) && field.Name == "Permissions" {
+				if _, ok := value.(*jsonutils.JSONString); !ok && value != jsonutils.JSONNull {
+					// YAML takes 0644 as the octal number 420
+					v.addError(VALIDATION_WRONG_TYPE, keyPath, "permissions must be a quoted octal string, e.g. '0644'")
+					dict.Remove(key)
+					continue
+				}
+			}
+			if !v.validateType(keyPath, value, field.Type) {
+				dict.Remove(key)
+			}
+		}
+	}
+	return true
+}
+
+func (v *sCloudConfigValidator) userPath(i int) string {
+	if i < len(v.userIndex) {
+		i = v.userIndex[i]
+	}
+	return fmt.Sprintf("users[%d]", i)
+}
+
+func isValidSudo(sudo string) bool {
+	if len(sudo) == 0 || strings.EqualFold(sudo, "false") {
+		return true
+	}
+	return sudoRuleRegexp.MatchString(sudo)
+}
+
+// validateValues checks the values of a well typed config
+func (v *sCloudConfigValidator) validateValues(conf *SCloudConfig) {
+	users := map[string]string{}
+	for i, u := range conf.Users {
+		path := v.userPath(i)
+		if len(u.Name) == 0 {
+			v.addError(VALIDATION_INVALID_VALUE, path, "user name is required")
+		} else if !userRegexp.MatchString(u.Name) {
+			v.addError(VALIDATION_INVALID_VALUE, path+".name", "invalid user name %q", u.Name)
+		} else if first, ok := users[u.Name]; ok {
+			v.addError(VALIDATION_DUPLICATE, path+".name", "duplicate user %q, first defined in %s", u.Name, first)
+		} else {
+			users[u.Name] = path
+		}
+		if !isValidSudo(u.Sudo) {
+			hint := ""
+			switch TSudoPolicy(u.Sudo) {
+			case USER_SUDO_NOPASSWD, USER_SUDO, USER_SUDO_DENY:
+				hint = fmt.Sprintf(", set by SudoPolicy(%q) instead", u.Sudo)
+			}
+			v.addError(VALIDATION_INVALID_VALUE, path+".sudo", "invalid sudo rule %q, e.g. ALL=(ALL) NOPASSWD:ALL%s", u.Sudo, hint)
+		}
+		if len(u.HashedPasswd) > 0 && !strings.HasPrefix(u.HashedPasswd, "$") {
+			v.addError(VALIDATION_INVALID_VALUE, path+".hashed_passwd", "hashed password is not in crypt format")
+		}
+	}
+
+	files := map[string]string{}
+	for i, wf := range conf.WriteFiles {
+		path := fmt.Sprintf("write_files[%d]", i)
+		if len(wf.Path) == 0 {
+			v.addError(VALIDATION_INVALID_VALUE, path, "path is required")
+		} else if first, ok := files[wf.Path]; ok {
+			v.addError(VALIDATION_DUPLICATE, path+".path", "duplicate path %q, first defined in %s", wf.Path, first)
+		} else {
+			files[wf.Path] = path
+		}
+		if len(wf.Permissions) > 0 && !permissionsRegexp.MatchString(wf.Permissions) {
+			v.addError(VALIDATION_INVALID_VALUE, path+".permissions", "invalid permissions %q, expect octal e.g. '0644'", wf.Permissions)
+		}
+		if len(wf.Owner) > 0 && !ownerRegexp.MatchString(wf.Owner) {
+			v.addError(VALIDATION_INVALID_VALUE, path+".owner", "invalid owner %q, expect user or user:group", wf.Owner)
+		}
+		encoding := strings.ToLower(wf.Encoding)
+		if !utils.IsInStringArray(encoding, writeFileEncodings) {
+			v.addError(VALIDATION_INVALID_VALUE, path+".encoding", "unsupported encoding %q", wf.Encoding)
+		} else if strings.Contains(encoding, "b64") || strings.Contains(encoding, "base64") {
+			if _, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(wf.Content), "")); err != nil {
+				v.addError(VALIDATION_INVALID_VALUE, path+".content", "content is not valid base64")
+			}
+		}
+	}
+
+	switch strings.ToLower(string(conf.SshPwauth)) {
+	case "", "true", "false", "yes", "no", "1", "0", string(SSH_PASSWORD_AUTH_UNCHANGED):
+	default:
+		v.addError(VALIDATION_INVALID_VALUE, "ssh_pwauth", "invalid ssh_pwauth %q", conf.SshPwauth)
+	}
+
+	mounts := map[string]string{}
+	for i, m := range conf.Mounts {
+		path := fmt.Sprintf("mounts[%d]", i)
+		if len(m) == 0 || len(m) > 6 {
+			v.addError(VALIDATION_INVALID_VALUE, path, "a mount has 1 to 6 fields")
+			continue
+		}
+		if len(m) < 2 || m[1] == "none" || m[1] == "swap" {
+			continue
+		}
+		if !strings.HasPrefix(m[1], "/") {
+			v.addError(VALIDATION_INVALID_VALUE, fmt.Sprintf("%s[1]", path), "mount point %q is not absolute", m[1])
+		} else if first, ok := mounts[m[1]]; ok {
+			v.addError(VALIDATION_DUPLICATE, fmt.Sprintf("%s[1]", path), "duplicate mount point %q, first defined in %s", m[1], first)
+		} else {
+			mounts[m[1]] = path
+		}
+	}
+	switch m := conf.ManageEtcHosts.(type) {
+	case nil, *jsonutils.JSONBool:
+	case *jsonutils.JSONString:
+		if !utils.IsInStringArray(m.Value(), []string{MANAGE_ETC_HOSTS_TEMPLATE, MANAGE_ETC_HOSTS_LOCALHOST}) {
+			v.addError(VALIDATION_INVALID_VALUE, "manage_etc_hosts", "invalid manage_etc_hosts %q, expect boolean, template or localhost", m.Value())
+		}
+	default:
+		if m != jsonutils.JSONNull {
+			v.addError(VALIDATION_WRONG_TYPE, "manage_etc_hosts", "expect boolean, template or localhost, got %s", jsonTypeName(m))
+		}
+	}
+	for _, dev := range sortedKeys(conf.DiskSetup) {
+		disk := conf.DiskSetup[dev]
+		path := joinPath("disk_setup", dev)
+		switch disk.TableType {
+		case "", DISK_TABLE_GPT, DISK_TABLE_MBR:
+		default:
+			v.addError(VALIDATION_INVALID_VALUE, path+".table_type", "invalid table type %q", disk.TableType)
+		}
+		switch layout := disk.Layout.(type) {
+		case nil, *jsonutils.JSONBool:
+		case *jsonutils.JSONArray:
+			percentages := disk.partitions()
+			total := int64(0)
+			for _, p := range percentages {
+				total += p
+			}
+			if len(percentages) == 0 || len(percentages) != layout.Size() {
+				v.addError(VALIDATION_INVALID_VALUE, path+".layout", "a partition is a percentage or a list of the percentage and the partition type")
+			} else if total > 100 {
+				v.addError(VALIDATION_INVALID_VALUE, path+".layout", "partitions take %d%% of the disk", total)
+			}
+		default:
+			if layout != jsonutils.JSONNull {
+				v.addError(VALIDATION_WRONG_TYPE, path+".layout", "expect boolean or list, got %s", jsonTypeName(layout))
+			}
+		}
+	}
+	for i, fs := range conf.FsSetup {
+		if len(fs.Device) == 0 || len(fs.Filesystem) == 0 {
+			v.addError(VALIDATION_INVALID_VALUE, fmt.Sprintf("fs_setup[%d]", i), "device and filesystem are required")
+		}
+	}
+	if conf.Chpasswd != nil {
+		switch list := conf.Chpasswd.List.(type) {
+		case nil, *jsonutils.JSONString:
+		case *jsonutils.JSONArray:
+			items, _ := list.GetArray()
+			for i, item := range items {
+				if line, ok := item.(*jsonutils.JSONString); !ok || !strings.Contains(line.Value(), ":") {
+					v.addError(VALIDATION_INVALID_VALUE, fmt.Sprintf("chpasswd.list[%d]", i), "expect user:password")
+				}
+			}
+		default:
+			if list != jsonutils.JSONNull {
+				v.addError(VALIDATION_WRONG_TYPE, "chpasswd.list", "expect string or list, got %s", jsonTypeName(list))
+			}
+		}
+		for i, u := range conf.Chpasswd.Users {
+			switch u.Type {
+			case "", CHPASSWD_TYPE_TEXT, CHPASSWD_TYPE_HASH, CHPASSWD_TYPE_RANDOM:
+			default:
+				v.addError(VALIDATION_INVALID_VALUE, fmt.Sprintf("chpasswd.users[%d].type", i), "invalid type %q", u.Type)
+			}
+		}
+	}
+	if ps := conf.PowerState; ps != nil {
+		switch ps.Mode {
+		case POWER_STATE_POWEROFF, POWER_STATE_REBOOT, POWER_STATE_HALT:
+		default:
+			v.addError(VALIDATION_INVALID_VALUE, "power_state.mode", "invalid mode %q", ps.Mode)
+		}
+		if len(ps.Delay) > 0 && !delayRegexp.MatchString(ps.Delay) {
+			v.addError(VALIDATION_INVALID_VALUE, "power_state.delay", "invalid delay %q, expect now or +minutes", ps.Delay)
+		}
+	}
+}
+
+// Validate checks the values of the config, e.g. as merged, the errors
+// have no positions
+func (conf *SCloudConfig) Validate() SValidationErrors {
+	v := &sCloudConfigValidator{}
+	v.validateValues(conf)
+	return v.errs
+}
+
+var yamlLineRegexp = regexp.MustCompile(`line ([0-9]+)`)
+
+func (v *sCloudConfigValidator) validateCloudConfig(data string) {
+	v.positions = indexYamlPositions(data)
+	obj, err := jsonutils.ParseYAML(data)
+	if err != nil {
+		verr := SValidationError{Code: VALIDATION_SYNTAX, Part: v.part, Message: err.Error()}
+		if m := yamlLineRegexp.FindStringSubmatch(err.Error()); m != nil {
+			verr.Line, _ = strconv.Atoi(m[1])
+		}
+		v.errs = append(v.errs, verr)
+		return
+	}
+	if obj == jsonutils.JSONNull {
+		return
+	}
+	nerrs, nwarnings := len(v.errs), len(v.warnings)
+	defer func() {
+		for _, errs := range []SValidationErrors{v.errs[nerrs:], v.warnings[nwarnings:]} {
+			sort.SliceStable(errs, func(i, j int) bool {
+				if errs[i].Line != errs[j].Line {
+					return errs[i].Line < errs[j].Line
+				}
+				return errs[i].Column < errs[j].Column
+			})
+		}
+	}()
+	v.typeErrors = nil
+	if !v.validateType("", obj, reflect.TypeOf(SCloudConfig{})) {
+		return
+	}
+	v.userIndex = nil
+	if users, _ := obj.GetArray("users"); users != nil {
+		for i := range users {
+			if users[i].String() != `"default"` {
+				v.userIndex = append(v.userIndex, i)
+			}
+		}
+	}
+	conf, err := unmarshalCloudConfig(obj.(*jsonutils.JSONDict))
+	if err != nil {
+		v.errs = append(v.errs, SValidationError{Code: VALIDATION_WRONG_TYPE, Part: v.part, Message: err.Error()})
+		return
+	}
+	v.validateValues(conf)
+}
+
+// ValidateUserData checks the cloud-config of user data, including the
+// cloud-config parts of multipart and gzip user data, the other formats
+// are not checked. See SValidationError for the limits of the positions
+func ValidateUserData(data string) SValidationErrors {
+	errs, _ := ValidateUserDataWithWarnings(data)
+	return errs
+}
+
+// ValidateUserDataWithWarnings is ValidateUserData, besides it returns the
+// problems cloud-init tolerates as warnings
+func ValidateUserDataWithWarnings(data string) (SValidationErrors, SValidationErrors) {
+	v := &sCloudConfigValidator{}
+	switch DetectUserDataType(data) {
+	case CONTENT_TYPE_CLOUD_CONFIG:
+		v.validateCloudConfig(data)
+	case CONTENT_TYPE_GZIP, CONTENT_TYPE_MULTIPART:
+		m, err := ParseMultipartUserData(data)
+		if err != nil {
+			return SValidationErrors{{Code: VALIDATION_SYNTAX, Message: err.Error()}}, nil
+		}
+		for i, part := range m.GetParts(CONTENT_TYPE_CLOUD_CONFIG) {
+			v.part = part.Filename
+			if len(v.part) == 0 {
+				v.part = fmt.Sprintf("part-%d", i+1)
+			}
+			v.validateCloudConfig(part.Content)
+		}
+	}
+	return v.errs, v.warnings
+}
@@ -0,0 +1,314 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"strings"
+	"testing"
+)
+
+const invalidUserData = `#cloud-config
+users:
+- default
+- name: bob
+  sudo: sudo_nopasswd
+  ssh_authorized_keys:
+    - ssh-rsa AAAA
+- name: bob
+  lock_passwd: "yes"
+write_files:
+  - path: /etc/a
+    permissions: 0644
+    content: |
+      key: value
+      - item
+  - path: /etc/a
+    owner: "root:bad group"
+    permissions: '0999'
+runcmd:
+  - [ls, -l]
+  - echo hi
+disk_setup:
+  /dev/vdb: {table_type: dos, layout: true}
+power_state:
+  mode: sleep
+unknown_module: 1
+package_update: true
+ntp: [pool.ntp.org]
+`
+
+func TestValidateUserData(t *testing.T) {
+	errs := ValidateUserData(invalidUserData)
+	want := []struct {
+		code   TValidationCode
+		path   string
+		line   int
+		column int
+	}{
+		{VALIDATION_INVALID_VALUE, "users[1].sudo", 5, 3},
+		{VALIDATION_DUPLICATE, "users[2].name", 8, 3},
+		{VALIDATION_WRONG_TYPE, "users[2].lock_passwd", 9, 3},
+		{VALIDATION_WRONG_TYPE, "write_files[0].permissions", 12, 5},
+		{VALIDATION_DUPLICATE, "write_files[1].path", 16, 5},
+		{VALIDATION_INVALID_VALUE, "write_files[1].owner", 17, 5},
+		{VALIDATION_INVALID_VALUE, "write_files[1].permissions", 18, 5},
+		{VALIDATION_INVALID_VALUE, "disk_setup./dev/vdb.table_type", 23, 3},
+		{VALIDATION_INVALID_VALUE, "power_state.mode", 25, 3},
+		{VALIDATION_UNKNOWN_KEY, "unknown_module", 26, 1},
+		{VALIDATION_WRONG_TYPE, "ntp", 28, 1},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("want %d errors, got %d: %s", len(want), len(errs), errs)
+	}
+	for i := range want {
+		e := errs[i]
+		if e.Code != want[i].code || e.Path != want[i].path || e.Line != want[i].line || e.Column != want[i].column {
+			t.Errorf("error %d: want %s %s at %d:%d, got %s %s", i, want[i].code, want[i].path, want[i].line, want[i].column, e.Code, e.Error())
+		}
+	}
+	if !strings.Contains(errs[0].Error(), "line 5, column 3: users[1].sudo: invalid sudo rule") {
+		t.Errorf("error message: %s", errs[0].Error())
+	}
+}
+
+func TestValidateUserDataValid(t *testing.T) {
+	for _, data := range []string{
+		strings.Replace(modulesUserData, "unknown_module:\n  key: value\n", "", 1),
+		"#cloud-config\nusers:\n- default\n- name: ops\n  sudo: ALL=(ALL) NOPASSWD:ALL\nwrite_files:\n- path: /etc/motd\n  permissions: '0644'\n  owner: root:root\n  encoding: b64\n  content: aGVsbG8=\nssh_pwauth: true\ndisable_root: false\n",
+		"#!/bin/bash\necho not cloud-config\n",
+		"#cloud-config\n",
+	} {
+		if errs := ValidateUserData(data); len(errs) > 0 {
+			t.Errorf("%s: %s", data, errs)
+		}
+	}
+}
+
+func TestValidateUserDataSyntax(t *testing.T) {
+	errs := ValidateUserData("#cloud-config\nusers:\n  - name: a\n   bad: indent\n")
+	if len(errs) != 1 || errs[0].Code != VALIDATION_SYNTAX || errs[0].Line == 0 {
+		t.Errorf("syntax error: %s", errs)
+	}
+	errs = ValidateUserData("#cloud-config\n- a\n- b\n")
+	if len(errs) != 1 || errs[0].Code != VALIDATION_WRONG_TYPE {
+		t.Errorf("top level list: %s", errs)
+	}
+}
+
+func TestValidateMultipart(t *testing.T) {
+	m := NewMultipartUserData()
+	m.AddScript("#!/bin/sh\necho hi\n")
+	m.AddPart(SUserDataPart{ContentType: CONTENT_TYPE_CLOUD_CONFIG, Filename: "bad.cfg", Content: "#cloud-config\ntimezone: [UTC]\n"})
+	errs := ValidateUserData(m.Encode())
+	if len(errs) != 1 || errs[0].Part != "bad.cfg" || errs[0].Path != "timezone" || errs[0].Line != 2 {
+		t.Errorf("multipart: %s", errs)
+	}
+}
+
+func TestCloudConfigValidate(t *testing.T) {
+	conf := &SCloudConfig{}
+	u := NewUser("ops")
+	u.SudoPolicy(USER_SUDO_NOPASSWD)
+	conf.MergeUser(u)
+	conf.MergeWriteFile(NewWriteFile("/etc/a", "a", "0644", "root", false), false)
+	if errs := conf.Validate(); len(errs) > 0 {
+		t.Errorf("valid config: %s", errs)
+	}
+	conf.Users = append(conf.Users, SUser{Name: "ops", Sudo: string(USER_SUDO)})
+	conf.WriteFiles = append(conf.WriteFiles, SWriteFile{Path: "/etc/a", Permissions: "rw-r--r--"})
+	errs := conf.Validate()
+	if len(errs) != 4 {
+		t.Fatalf("want 4 errors, got %s", errs)
+	}
+	if errs[0].Path != "users[1].name" || errs[0].Line != 0 || errs[1].Path != "users[1].sudo" {
+		t.Errorf("errors: %s", errs)
+	}
+}
+
+func TestIndexYamlPositions(t *testing.T) {
+	data := "a:\n  b: |\n    c: d\n  e:\n  - f: 1\n    g: [1,\n      2]\n  - - x\n    - y\nh: \"i: j\"\n'k l': m\n"
+	positions := indexYamlPositions(data)
+	for path, pos := range map[string]sYamlPosition{
+		"a":         {1, 1},
+		"a.b":       {2, 3},
+		"a.e":       {4, 3},
+		"a.e[0].f":  {5, 5},
+		"a.e[0].g":  {6, 5},
+		"a.e[1][0]": {8, 7},
+		"a.e[1][1]": {9, 7},
+		"h":         {10, 1},
+		"k l":       {11, 1},
+	} {
+		if positions[path] != pos {
+			t.Errorf("%s: want %v, got %v", path, pos, positions[path])
+		}
+	}
+	if _, ok := positions["a.b.c"]; ok {
+		t.Errorf("block scalar indexed")
+	}
+	if pos := lookupYamlPosition(positions, "a.e[0].f.z"); pos != (sYamlPosition{5, 5}) {
+		t.Errorf("lookup ancestor: %v", pos)
+	}
+}
+
+func TestIndexYamlPositionsUnsupported(t *testing.T) {
+	for _, data := range []string{
+		"a:\n\tb: c\n",
+		"a: &x\n  b: c\nd: *x\n",
+		"a:\n- &x b\n- *x\n",
+	} {
+		if positions := indexYamlPositions(data); len(positions) > 0 {
+			t.Errorf("%q: want no positions, got %v", data, positions)
+		}
+	}
+	data := "a:\n  b: |\n    x:\n    \ty\n  c: \"*x\"\n  d: 2 * 3\n"
+	if pos := indexYamlPositions(data)["a.c"]; pos != (sYamlPosition{5, 3}) {
+		t.Errorf("tabs in block scalar: %v", pos)
+	}
+}
+
+// cloudInitExamples are taken from the cloud-init module documentation
+var cloudInitExamples = []string{
+	`#cloud-config
+user: ubuntu
+ssh:
+  emit_keys_to_console: false
+allow_public_ssh_keys: true
+disable_root_opts: no-port-forwarding,no-agent-forwarding,no-X11-forwarding
+manage_etc_hosts: localhost
+users:
+  - default
+  - name: foobar
+    gecos: Foo B. Bar
+    primary_group: foobar
+    groups: users
+    selinux_user: staff_u
+    expiredate: '2032-09-01'
+    ssh_import_id:
+      - lp:falcojr
+      - gh:TheRealFalcon
+    lock_passwd: false
+    passwd: $6$j212wezy$7H/1LT4f9/N3wpgNunhsIqtMj62OKiS3nyNwuizouQc3u7MbYCarYeAHWYPYb2FT.lbioDm2RrkJPb9BZMN1O/
+`,
+	`#cloud-config
+write_files:
+- path: /usr/bin/hello
+  content: |
+    #!/bin/sh
+    echo "Hello world!"
+  permissions: '0755'
+  defer: true
+- path: /etc/motd
+  content: Welcome
+  append: true
+`,
+	`#cloud-config
+chpasswd:
+  expire: false
+  list:
+    - root:password
+    - user1:R
+`,
+	`#cloud-config
+chpasswd:
+  expire: false
+  list: |
+    root:password
+    user1:RANDOM
+`,
+	`#cloud-config
+ntp:
+  enabled: true
+  ntp_client: chrony
+  servers: [ntp.example.com]
+  pools: [0.int.pool.ntp.org, 1.int.pool.ntp.org]
+`,
+	`#cloud-config
+manage_etc_hosts: true
+disk_setup:
+  /dev/sdb:
+    table_type: mbr
+    layout: [[33, 82], 66]
+    overwrite: true
+  /dev/sdc:
+    table_type: gpt
+    layout: true
+fs_setup:
+- label: fs1
+  filesystem: ext4
+  device: /dev/sdb1
+  cmd: mkfs -t %(filesystem)s -L %(label)s %(device)s
+  replace_fs: ntfs
+`,
+	`#cloud-config
+apt:
+  preserve_sources_list: false
+  primary:
+    - arches: [default]
+      uri: http://us.archive.ubuntu.com/ubuntu/
+  sources:
+    curtin-dev-ppa.list:
+      source: "deb http://ppa.launchpad.net/curtin-dev/test-archive/ubuntu $RELEASE main"
+      keyid: F430BBA5
+      filename: curtin-dev-ppa.list
+yum_repos:
+  epel-testing:
+    baseurl: http://download.fedoraproject.org/pub/epel/testing/5/$basearch
+    enabled: false
+    failovermethod: priority
+    gpgcheck: true
+    gpgkey: file:///etc/pki/rpm-gpg/RPM-GPG-KEY-EPEL
+    name: Extra Packages for Enterprise Linux 5 - Testing
+  epel:
+    mirrorlist: https://mirrors.fedoraproject.org/metalink?repo=epel-9&arch=$basearch
+`,
+}
+
+func TestValidateCloudInitExamples(t *testing.T) {
+	for _, data := range cloudInitExamples {
+		errs, warnings := ValidateUserDataWithWarnings(data)
+		if len(errs) > 0 || len(warnings) > 0 {
+			t.Errorf("%s: %s %s", data, errs, warnings)
+		}
+		if _, err := ParseUserData(data); err != nil {
+			t.Errorf("%s: ParseUserData: %s", data, err)
+		}
+	}
+}
+
+func TestValidateUserDataWarnings(t *testing.T) {
+	data := "#cloud-config\nntp:\n  servers: [a]\n  flavor: b\nusers:\n- name: ops\n  color: blue\n"
+	errs, warnings := ValidateUserDataWithWarnings(data)
+	if len(errs) > 0 {
+		t.Errorf("errors: %s", errs)
+	}
+	if len(warnings) != 2 || warnings[0].Path != "ntp.flavor" || warnings[0].Line != 4 || warnings[1].Path != "users[0].color" || !warnings[1].Warning {
+		t.Errorf("warnings: %s", warnings)
+	}
+	if !strings.HasPrefix(warnings[0].Error(), "warning: line 4") {
+		t.Errorf("warning message: %s", warnings[0].Error())
+	}
+
+	errs = ValidateUserData("#cloud-config\nmanage_etc_hosts: always\ndisk_setup:\n  /dev/sdb:\n    layout: [60, 60]\n  /dev/sdc:\n    layout: half\nchpasswd:\n  list: [root]\n")
+	want := []string{"manage_etc_hosts", "disk_setup./dev/sdb.layout", "disk_setup./dev/sdc.layout", "chpasswd.list[0]"}
+	if len(errs) != len(want) {
+		t.Fatalf("want %d errors, got %s", len(want), errs)
+	}
+	for i := range want {
+		if errs[i].Path != want[i] {
+			t.Errorf("error %d: want %s, got %s", i, want[i], errs[i].Error())
+		}
+	}
+}
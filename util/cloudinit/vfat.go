@@ -0,0 +1,503 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/binary"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * A minimal FAT16 filesystem with long file names for the seed images
+ * Reference: Microsoft FAT Specification
+ *
+ */
+
+const (
+	fatSectorSize     = 512
+	fatDirEntrySize   = 32
+	fatRootEntries    = 512
+	fatReservedSector = 1
+	fatNumFATs        = 2
+
+	fatMinClusters16 = 4085
+	fatMaxClusters16 = 65524
+	// the smallest image that makes FAT16 with one sector clusters
+	fatMinImageSize = 8 * 1024 * 1024
+
+	fatAttrReadOnly  = 0x01
+	fatAttrVolumeId  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatAttrLongName  = 0x0f
+
+	fatLongNameChars = 13
+	fatEOC16         = 0xffff
+)
+
+func fatDateTime(t time.Time) (uint16, uint16) {
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	tm := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, tm
+}
+
+// fatShortName returns the 8.3 name, and whether a long name is needed
+func fatShortName(name string, used map[string]bool) (string, bool) {
+	base, ext := name, ""
+	if pos := strings.LastIndexByte(name, '.'); pos > 0 {
+		base, ext = name[:pos], name[pos+1:]
+	}
+	lossy := false
+	mangle := func(s string, max int) string {
+		ret := strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+				return r
+			case r >= 'a' && r <= 'z':
+				lossy = true
+				return r - 'a' + 'A'
+			default:
+				lossy = true
+				return '_'
+			}
+		}, s)
+		if len(ret) > max {
+			lossy = true
+			ret = ret[:max]
+		}
+		return ret
+	}
+	base, ext = mangle(base, 8), mangle(ext, 3)
+	short := padShortName(base, ext)
+	if !lossy && !used[short] {
+		used[short] = true
+		return short, false
+	}
+	for i := 1; ; i++ {
+		tail := "~" + strconv.Itoa(i)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		short = padShortName(b+tail, ext)
+		if !used[short] {
+			used[short] = true
+			return short, true
+		}
+	}
+}
+
+func padShortName(base, ext string) string {
+	return base + strings.Repeat(" ", 8-len(base)) + ext + strings.Repeat(" ", 3-len(ext))
+}
+
+func fatShortNameChecksum(short string) byte {
+	var sum byte
+	for i := 0; i < 11; i++ {
+		sum = (sum>>1 | sum<<7) + short[i]
+	}
+	return sum
+}
+
+// fatLongNameEntries returns the long name entries preceding the short
+// entry, in the order on disk
+func fatLongNameEntries(name, short string) [][]byte {
+	codes := utf16.Encode([]rune(name))
+	count := (len(codes) + fatLongNameChars - 1) / fatLongNameChars
+	if len(codes)%fatLongNameChars != 0 {
+		codes = append(codes, 0)
+	}
+	for len(codes)%fatLongNameChars != 0 {
+		codes = append(codes, 0xffff)
+	}
+	checksum := fatShortNameChecksum(short)
+	entries := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		entry := make([]byte, fatDirEntrySize)
+		ord := byte(i + 1)
+		if i == count-1 {
+			ord |= 0x40
+		}
+		entry[0] = ord
+		entry[11] = fatAttrLongName
+		entry[13] = checksum
+		chunk := codes[i*fatLongNameChars : (i+1)*fatLongNameChars]
+		offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+		for j, c := range chunk {
+			binary.LittleEndian.PutUint16(entry[offsets[j]:], c)
+		}
+		entries[count-1-i] = entry
+	}
+	return entries
+}
+
+func fatDirEntry(short string, attr byte, cluster uint32, size uint32, t time.Time) []byte {
+	entry := make([]byte, fatDirEntrySize)
+	copy(entry, short)
+	entry[11] = attr
+	date, tm := fatDateTime(t)
+	binary.LittleEndian.PutUint16(entry[14:], tm)
+	binary.LittleEndian.PutUint16(entry[16:], date)
+	binary.LittleEndian.PutUint16(entry[18:], date)
+	binary.LittleEndian.PutUint16(entry[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(entry[22:], tm)
+	binary.LittleEndian.PutUint16(entry[24:], date)
+	binary.LittleEndian.PutUint16(entry[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(entry[28:], size)
+	return entry
+}
+
+// fatDirectory returns the entries of a directory, the root directory has
+// the volume label and no dot entries
+func fatDirectory(dir, parent *sImageFile, isRoot bool, label string, t time.Time) []byte {
+	entries := []byte{}
+	if isRoot {
+		entries = append(entries, fatDirEntry(padShortName(label, ""), fatAttrVolumeId, 0, 0, t)...)
+	} else {
+		parentCluster := parent.cluster
+		entries = append(entries, fatDirEntry(padShortName(".", ""), fatAttrDirectory, dir.cluster, 0, t)...)
+		entries = append(entries, fatDirEntry(padShortName("..", ""), fatAttrDirectory, parentCluster, 0, t)...)
+	}
+	used := map[string]bool{}
+	for _, c := range dir.children {
+		short, long := fatShortName(c.name, used)
+		if long {
+			for _, e := range fatLongNameEntries(c.name, short) {
+				entries = append(entries, e...)
+			}
+		}
+		attr := byte(fatAttrArchive)
+		size := uint32(len(c.content))
+		if c.isDir {
+			attr, size = fatAttrDirectory, 0
+		}
+		entries = append(entries, fatDirEntry(short, attr, c.cluster, size, t)...)
+	}
+	return entries
+}
+
+// buildVFAT returns a FAT16 image of the files keyed by their paths
+func buildVFAT(label string, files map[string][]byte) ([]byte, error) {
+	root, err := newImageTree(files)
+	if err != nil {
+		return nil, err
+	}
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	t := time.Now()
+
+	dirs := []*sImageFile{}
+	root.walkDirs(func(dir *sImageFile, parent int) {
+		dirs = append(dirs, dir)
+	})
+	rootSize := len(fatDirectory(root, root, true, label, t))
+	if rootSize > fatRootEntries*fatDirEntrySize {
+		return nil, errors.Wrap(errors.ErrNotSupported, "too many files in the root directory")
+	}
+
+	// the data size decides the image size and the cluster size
+	dataSize := 0
+	for _, dir := range dirs {
+		if dir != root {
+			dataSize += len(fatDirectory(dir, dir, false, label, t)) + fatSectorSize
+		}
+		for _, c := range dir.children {
+			dataSize += len(c.content) + fatSectorSize
+		}
+	}
+	imageSize := dataSize + dataSize/4 + 1024*1024
+	if imageSize < fatMinImageSize {
+		imageSize = fatMinImageSize
+	}
+	totalSectors := uint32((imageSize + fatSectorSize - 1) / fatSectorSize)
+	sectorsPerCluster := uint32(1)
+	for totalSectors/sectorsPerCluster > fatMaxClusters16 {
+		sectorsPerCluster *= 2
+	}
+	if sectorsPerCluster > 128 {
+		return nil, errors.Wrap(errors.ErrNotSupported, "too large for FAT16")
+	}
+	rootDirSectors := uint32(fatRootEntries * fatDirEntrySize / fatSectorSize)
+	fatSectors := uint32(1)
+	var clusters uint32
+	for {
+		clusters = (totalSectors - fatReservedSector - fatNumFATs*fatSectors - rootDirSectors) / sectorsPerCluster
+		need := ((clusters+2)*2 + fatSectorSize - 1) / fatSectorSize
+		if need <= fatSectors {
+			break
+		}
+		fatSectors = need
+	}
+	if clusters < fatMinClusters16 || clusters > fatMaxClusters16 {
+		return nil, errors.Wrapf(errors.ErrNotSupported, "%d clusters not FAT16", clusters)
+	}
+	clusterSize := int(sectorsPerCluster) * fatSectorSize
+	dataStart := int(fatReservedSector+fatNumFATs*fatSectors+rootDirSectors) * fatSectorSize
+
+	// allocate the clusters of the directories and files in chains
+	fat := make([]uint16, clusters+2)
+	fat[0], fat[1] = 0xfff8, fatEOC16
+	next := uint32(2)
+	alloc := func(size int) (uint32, error) {
+		if size == 0 {
+			return 0, nil
+		}
+		count := uint32((size + clusterSize - 1) / clusterSize)
+		if next+count > clusters+2 {
+			return 0, errors.Wrap(errors.ErrNotSupported, "no space left")
+		}
+		first := next
+		for i := uint32(0); i < count; i++ {
+			fat[next] = uint16(next + 1)
+			next++
+		}
+		fat[next-1] = fatEOC16
+		return first, nil
+	}
+	for _, dir := range dirs {
+		if dir != root {
+			dir.cluster, err = alloc(len(fatDirectory(dir, dir, false, label, t)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, c := range dir.children {
+			if !c.isDir {
+				c.cluster, err = alloc(len(c.content))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	image := make([]byte, int(totalSectors)*fatSectorSize)
+	boot := image[:fatSectorSize]
+	copy(boot, []byte{0xeb, 0x3c, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(boot[11:], fatSectorSize)
+	boot[13] = byte(sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:], fatReservedSector)
+	boot[16] = fatNumFATs
+	binary.LittleEndian.PutUint16(boot[17:], fatRootEntries)
+	if totalSectors < 0x10000 {
+		binary.LittleEndian.PutUint16(boot[19:], uint16(totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(boot[32:], totalSectors)
+	}
+	boot[21] = 0xf8
+	binary.LittleEndian.PutUint16(boot[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(boot[24:], 32)
+	binary.LittleEndian.PutUint16(boot[26:], 64)
+	boot[36] = 0x80
+	boot[38] = 0x29
+	binary.LittleEndian.PutUint32(boot[39:], uint32(t.Unix()))
+	copy(boot[43:], padShortName(label, ""))
+	copy(boot[54:], "FAT16   ")
+	boot[510], boot[511] = 0x55, 0xaa
+
+	for i := 0; i < fatNumFATs; i++ {
+		off := int(fatReservedSector+uint32(i)*fatSectors) * fatSectorSize
+		for j, v := range fat {
+			binary.LittleEndian.PutUint16(image[off+2*j:], v)
+		}
+	}
+	clusterAt := func(cluster uint32) []byte {
+		return image[dataStart+int(cluster-2)*clusterSize:]
+	}
+	parents := map[*sImageFile]*sImageFile{root: root}
+	for _, dir := range dirs {
+		for _, c := range dir.children {
+			parents[c] = dir
+		}
+		if dir == root {
+			copy(image[int(fatReservedSector+fatNumFATs*fatSectors)*fatSectorSize:], fatDirectory(root, root, true, label, t))
+		} else {
+			copy(clusterAt(dir.cluster), fatDirectory(dir, parents[dir], false, label, t))
+		}
+		for _, c := range dir.children {
+			if !c.isDir && c.cluster > 0 {
+				copy(clusterAt(c.cluster), c.content)
+			}
+		}
+	}
+	return image, nil
+}
+
+func isVFAT(image []byte) bool {
+	return len(image) >= fatSectorSize && image[510] == 0x55 && image[511] == 0xaa &&
+		binary.LittleEndian.Uint16(image[11:]) == fatSectorSize && !isISO9660(image)
+}
+
+// readVFAT returns the volume label and the files keyed by their paths of
+// a FAT12 or FAT16 image
+func readVFAT(image []byte) (string, map[string][]byte, error) {
+	if len(image) < fatSectorSize {
+		return "", nil, errors.Wrap(errors.ErrInvalidFormat, "image too small")
+	}
+	bytesPerSector := int(binary.LittleEndian.Uint16(image[11:]))
+	sectorsPerCluster := int(image[13])
+	reserved := int(binary.LittleEndian.Uint16(image[14:]))
+	numFATs := int(image[16])
+	rootEntries := int(binary.LittleEndian.Uint16(image[17:]))
+	totalSectors := int(binary.LittleEndian.Uint16(image[19:]))
+	if totalSectors == 0 {
+		totalSectors = int(binary.LittleEndian.Uint32(image[32:]))
+	}
+	fatSectors := int(binary.LittleEndian.Uint16(image[22:]))
+	if bytesPerSector == 0 || sectorsPerCluster == 0 || fatSectors == 0 || rootEntries == 0 {
+		return "", nil, errors.Wrap(errors.ErrNotSupported, "not a FAT12/FAT16 filesystem")
+	}
+	rootStart := (reserved + numFATs*fatSectors) * bytesPerSector
+	rootDirSectors := (rootEntries*fatDirEntrySize + bytesPerSector - 1) / bytesPerSector
+	dataStart := rootStart + rootDirSectors*bytesPerSector
+	clusters := (totalSectors*bytesPerSector - dataStart) / (sectorsPerCluster * bytesPerSector)
+	if totalSectors*bytesPerSector > len(image) || dataStart > len(image) {
+		return "", nil, errors.Wrap(errors.ErrInvalidFormat, "truncated image")
+	}
+	fat := image[reserved*bytesPerSector:]
+	fat12 := clusters < fatMinClusters16
+	nextCluster := func(cluster int) int {
+		if fat12 {
+			v := int(binary.LittleEndian.Uint16(fat[cluster+cluster/2:]))
+			if cluster%2 == 1 {
+				v >>= 4
+			}
+			v &= 0xfff
+			if v >= 0xff8 {
+				return -1
+			}
+			return v
+		}
+		v := int(binary.LittleEndian.Uint16(fat[2*cluster:]))
+		if v >= 0xfff8 {
+			return -1
+		}
+		return v
+	}
+	clusterSize := sectorsPerCluster * bytesPerSector
+	readChain := func(cluster int, size int) ([]byte, error) {
+		data := []byte{}
+		for cluster >= 2 {
+			if cluster >= clusters+2 || len(data) > len(image) {
+				return nil, errors.Wrapf(errors.ErrInvalidFormat, "invalid cluster %d", cluster)
+			}
+			off := dataStart + (cluster-2)*clusterSize
+			data = append(data, image[off:off+clusterSize]...)
+			cluster = nextCluster(cluster)
+		}
+		if size >= 0 {
+			if size > len(data) {
+				return nil, errors.Wrap(errors.ErrInvalidFormat, "truncated file")
+			}
+			data = data[:size]
+		}
+		return data, nil
+	}
+
+	label := strings.TrimRight(string(image[43:54]), " ")
+	files := map[string][]byte{}
+	var readDir func(dirPath string, entries []byte, depth int) error
+	readDir = func(dirPath string, entries []byte, depth int) error {
+		if depth > 16 {
+			return errors.Wrap(errors.ErrInvalidFormat, "too deep directory")
+		}
+		longName := []uint16{}
+		for off := 0; off+fatDirEntrySize <= len(entries); off += fatDirEntrySize {
+			entry := entries[off : off+fatDirEntrySize]
+			if entry[0] == 0 {
+				break
+			}
+			if entry[0] == 0xe5 {
+				longName = longName[:0]
+				continue
+			}
+			attr := entry[11]
+			if attr == fatAttrLongName {
+				if entry[0]&0x40 != 0 {
+					longName = longName[:0]
+				}
+				chunk := []uint16{}
+				for _, o := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					c := binary.LittleEndian.Uint16(entry[o:])
+					if c == 0 || c == 0xffff {
+						break
+					}
+					chunk = append(chunk, c)
+				}
+				// entries are in the reverse order
+				longName = append(chunk, longName...)
+				continue
+			}
+			if attr&fatAttrVolumeId != 0 {
+				if dirPath == "/" {
+					label = strings.TrimRight(string(entry[:11]), " ")
+				}
+				longName = longName[:0]
+				continue
+			}
+			name := string(utf16.Decode(longName))
+			longName = longName[:0]
+			if len(name) == 0 {
+				base := strings.TrimRight(string(entry[:8]), " ")
+				ext := strings.TrimRight(string(entry[8:11]), " ")
+				// the lower case flags of Windows NT
+				if entry[12]&0x08 != 0 {
+					base = strings.ToLower(base)
+				}
+				if entry[12]&0x10 != 0 {
+					ext = strings.ToLower(ext)
+				}
+				name = base
+				if len(ext) > 0 {
+					name += "." + ext
+				}
+				if name == "." || name == ".." {
+					continue
+				}
+			}
+			cluster := int(binary.LittleEndian.Uint16(entry[26:])) | int(binary.LittleEndian.Uint16(entry[20:]))<<16
+			childPath := path.Join(dirPath, name)
+			if attr&fatAttrDirectory != 0 {
+				data, err := readChain(cluster, -1)
+				if err != nil {
+					return err
+				}
+				if err := readDir(childPath, data, depth+1); err != nil {
+					return err
+				}
+			} else {
+				data, err := readChain(cluster, int(binary.LittleEndian.Uint32(entry[28:])))
+				if err != nil {
+					return err
+				}
+				files[strings.TrimPrefix(childPath, "/")] = data
+			}
+		}
+		return nil
+	}
+	if err := readDir("/", image[rootStart:dataStart], 0); err != nil {
+		return "", nil, err
+	}
+	return label, files, nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/*
+ * PowerShell rendering for the Windows images with cloudbase-init
+ * Reference: https://cloudbase-init.readthedocs.io/en/latest/userdata.html
+ *
+ */
+
+const (
+	// WINDOWS_COMPUTER_NAME_MAX_LEN is the NetBIOS name limit
+	WINDOWS_COMPUTER_NAME_MAX_LEN = 15
+
+	WINDOWS_ADMINISTRATOR = "Administrator"
+)
+
+// windowsTimezones maps the common IANA time zones to the Windows ones
+var windowsTimezones = map[string]string{
+	"UTC":                 "UTC",
+	"Etc/UTC":             "UTC",
+	"GMT":                 "GMT Standard Time",
+	"Asia/Shanghai":       "China Standard Time",
+	"Asia/Chongqing":      "China Standard Time",
+	"Asia/Hong_Kong":      "China Standard Time",
+	"Asia/Taipei":         "Taipei Standard Time",
+	"Asia/Tokyo":          "Tokyo Standard Time",
+	"Asia/Seoul":          "Korea Standard Time",
+	"Asia/Singapore":      "Singapore Standard Time",
+	"Asia/Kolkata":        "India Standard Time",
+	"Asia/Dubai":          "Arabian Standard Time",
+	"Asia/Bangkok":        "SE Asia Standard Time",
+	"Asia/Jakarta":        "SE Asia Standard Time",
+	"Europe/London":       "GMT Standard Time",
+	"Europe/Dublin":       "GMT Standard Time",
+	"Europe/Berlin":       "W. Europe Standard Time",
+	"Europe/Amsterdam":    "W. Europe Standard Time",
+	"Europe/Rome":         "W. Europe Standard Time",
+	"Europe/Paris":        "Romance Standard Time",
+	"Europe/Madrid":       "Romance Standard Time",
+	"Europe/Moscow":       "Russian Standard Time",
+	"America/New_York":    "Eastern Standard Time",
+	"America/Chicago":     "Central Standard Time",
+	"America/Denver":      "Mountain Standard Time",
+	"America/Phoenix":     "US Mountain Standard Time",
+	"America/Los_Angeles": "Pacific Standard Time",
+	"America/Sao_Paulo":   "E. South America Standard Time",
+	"Australia/Sydney":    "AUS Eastern Standard Time",
+	"Australia/Melbourne": "AUS Eastern Standard Time",
+	"Pacific/Auckland":    "New Zealand Standard Time",
+}
+
+// WindowsTimezone returns the Windows time zone of an IANA one, the
+// unknown ones are taken as Windows time zones already
+func WindowsTimezone(tz string) string {
+	if wtz, ok := windowsTimezones[tz]; ok {
+		return wtz
+	}
+	return tz
+}
+
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func psArray(items []string) string {
+	quoted := make([]string, len(items))
+	for i := range items {
+		quoted[i] = psQuote(items[i])
+	}
+	return "@(" + strings.Join(quoted, ",") + ")"
+}
+
+// WindowsComputerName returns the NetBIOS computer name of the config,
+// truncated as Windows does
+func (conf *SCloudConfig) WindowsComputerName() string {
+	name := conf.Hostname
+	if len(name) == 0 && len(conf.Fqdn) > 0 {
+		name = strings.Split(conf.Fqdn, ".")[0]
+	}
+	if len(name) > WINDOWS_COMPUTER_NAME_MAX_LEN {
+		name = name[:WINDOWS_COMPUTER_NAME_MAX_LEN]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// PowerShellScripts writes the file, the permissions and owner are not
+// applicable to Windows
+func (wf *SWriteFile) PowerShellScripts() []string {
+	content := wf.Content
+	if wf.Encoding != "b64" {
+		content = base64.StdEncoding.EncodeToString([]byte(wf.Content))
+	}
+	return []string{
+		fmt.Sprintf("New-Item -ItemType Directory -Force -Path (Split-Path -Parent %s) | Out-Null", psQuote(wf.Path)),
+		fmt.Sprintf("[IO.File]::WriteAllBytes(%s, [Convert]::FromBase64String(%s))", psQuote(wf.Path), psQuote(content)),
+	}
+}
+
+func (iface *SNetworkInterface) powerShellScripts(ns *SNameservers) []string {
+	shells := []string{}
+	if len(iface.MacAddress) > 0 {
+		mac := strings.ToUpper(strings.Replace(iface.MacAddress, ":", "-", -1))
+		shells = append(shells, fmt.Sprintf("$adapter = Get-NetAdapter | Where-Object { $_.MacAddress -eq %s } | Select-Object -First 1", psQuote(mac)))
+	} else {
+		shells = append(shells, fmt.Sprintf("$adapter = Get-NetAdapter -Name %s -ErrorAction SilentlyContinue", psQuote(iface.Name)))
+	}
+	shells = append(shells, "if ($adapter) {")
+	if iface.Mtu > 0 {
+		shells = append(shells, fmt.Sprintf("Set-NetIPInterface -InterfaceIndex $adapter.ifIndex -NlMtuBytes %d", iface.Mtu))
+	}
+	for _, family := range []struct {
+		v6      bool
+		name    string
+		dhcp    bool
+		gateway string
+		def     string
+	}{
+		{false, "IPv4", iface.Dhcp4, iface.Gateway4, "0.0.0.0/0"},
+		{true, "IPv6", iface.Dhcp6, iface.Gateway6, "::/0"},
+	} {
+		addrs := iface.addresses(family.v6)
+		if family.dhcp {
+			shells = append(shells, fmt.Sprintf("Set-NetIPInterface -InterfaceIndex $adapter.ifIndex -AddressFamily %s -Dhcp Enabled", family.name))
+		} else if len(addrs) > 0 {
+			shells = append(shells, fmt.Sprintf("Set-NetIPInterface -InterfaceIndex $adapter.ifIndex -AddressFamily %s -Dhcp Disabled", family.name))
+			shells = append(shells, fmt.Sprintf("Get-NetIPAddress -InterfaceIndex $adapter.ifIndex -AddressFamily %s -PrefixOrigin Manual -ErrorAction SilentlyContinue | Remove-NetIPAddress -Confirm:$false", family.name))
+			shells = append(shells, fmt.Sprintf("Get-NetRoute -InterfaceIndex $adapter.ifIndex -DestinationPrefix %s -ErrorAction SilentlyContinue | Remove-NetRoute -Confirm:$false", psQuote(family.def)))
+			gateway := family.gateway
+			for _, addr := range addrs {
+				ip, prefix, err := splitCIDR(addr)
+				if err != nil {
+					continue
+				}
+				cmd := fmt.Sprintf("New-NetIPAddress -InterfaceIndex $adapter.ifIndex -IPAddress %s -PrefixLength %d", psQuote(ip), prefix)
+				if len(gateway) > 0 {
+					// the default gateway goes with the first address
+					cmd += " -DefaultGateway " + psQuote(gateway)
+					gateway = ""
+				}
+				shells = append(shells, cmd+" | Out-Null")
+			}
+		}
+		for _, r := range iface.routes(family.v6) {
+			cmd := fmt.Sprintf("New-NetRoute -InterfaceIndex $adapter.ifIndex -DestinationPrefix %s -NextHop %s", psQuote(r.To), psQuote(r.Via))
+			if r.Metric > 0 {
+				cmd += fmt.Sprintf(" -RouteMetric %d", r.Metric)
+			}
+			shells = append(shells, cmd+" | Out-Null")
+		}
+	}
+	if ns != nil && len(ns.Addresses) > 0 {
+		shells = append(shells, fmt.Sprintf("Set-DnsClientServerAddress -InterfaceIndex $adapter.ifIndex -ServerAddresses %s", psArray(ns.Addresses)))
+	} else if iface.Dhcp4 || iface.Dhcp6 {
+		shells = append(shells, "Set-DnsClientServerAddress -InterfaceIndex $adapter.ifIndex -ResetServerAddresses")
+	}
+	shells = append(shells, "}")
+	return shells
+}
+
+// PowerShellScripts configures the ethernets matched by MAC address or name,
+// the bonds, vlans and bridges are not rendered for Windows
+func (n *SNetworkConfig) PowerShellScripts() []string {
+	shells := []string{}
+	search := []string{}
+	for i := range n.Ethernets {
+		ns := n.nameservers(&n.Ethernets[i])
+		shells = append(shells, n.Ethernets[i].powerShellScripts(ns)...)
+		if ns != nil {
+			search = mergeStrings(search, ns.Search)
+		}
+	}
+	if len(search) > 0 {
+		shells = append(shells, fmt.Sprintf("Set-DnsClientGlobalSetting -SuffixSearchList %s", psArray(search)))
+	}
+	return shells
+}
+
+// NetworkConfigPowerShell renders the network config as a PowerShell
+// script for the Windows images
+func (n *SNetworkConfig) NetworkConfigPowerShell() string {
+	return CLOUD_POWER_SHELL_HEADER + strings.Join(n.PowerShellScripts(), "\n")
+}
+
+func isWindowsAdministrator(name string) bool {
+	return strings.EqualFold(name, WINDOWS_ADMINISTRATOR)
+}
+
+// powerShellScripts renders the config for Windows, the Administrator
+// account is skipped if the password is set otherwise, e.g. by unattend.xml
+func (conf *SCloudConfig) powerShellScripts(network *SNetworkConfig, skipAdmin bool) []string {
+	shells := []string{}
+	if name := conf.WindowsComputerName(); len(name) > 0 && !conf.PreserveHostname.IsTrue() {
+		// takes effect after reboot
+		shells = append(shells, fmt.Sprintf("if ($env:COMPUTERNAME -ne %s) { Rename-Computer -NewName %s -Force }", psQuote(name), psQuote(name)))
+	}
+	if len(conf.Timezone) > 0 {
+		shells = append(shells, "tzutil /s "+psQuote(WindowsTimezone(conf.Timezone)))
+	}
+	for _, u := range conf.Users {
+		if isWindowsAdministrator(u.Name) {
+			if !skipAdmin && len(u.PlainTextPasswd) > 0 {
+				shells = append(shells, fmt.Sprintf("net user %s %s", psQuote(u.Name), psQuote(u.PlainTextPasswd)))
+			}
+			continue
+		}
+		shells = append(shells, u.PowerShellScripts()...)
+	}
+	if conf.Chpasswd != nil {
+		for _, u := range conf.Chpasswd.Users {
+			if (skipAdmin && isWindowsAdministrator(u.Name)) || u.Type == CHPASSWD_TYPE_HASH || u.Type == CHPASSWD_TYPE_RANDOM || u.Password == CHPASSWD_TYPE_RANDOM {
+				continue
+			}
+			shells = append(shells, fmt.Sprintf("net user %s %s", psQuote(u.Name), psQuote(u.Password)))
+		}
+	}
+	for i := range conf.WriteFiles {
+		shells = append(shells, conf.WriteFiles[i].PowerShellScripts()...)
+	}
+	if network != nil {
+		shells = append(shells, network.PowerShellScripts()...)
+	}
+	shells = append(shells, conf.Runcmd...)
+	return shells
+}
+
+// PowerShellScripts renders the hostname, timezone, users, files, network
+// and runcmd for Windows, network is optional
+func (conf *SCloudConfig) PowerShellScripts(network *SNetworkConfig) []string {
+	return conf.powerShellScripts(network, false)
+}
+
+// WindowsAdminPassword returns the plain text password of Administrator
+// from users or chpasswd
+func (conf *SCloudConfig) WindowsAdminPassword() string {
+	for _, u := range conf.Users {
+		if isWindowsAdministrator(u.Name) && len(u.PlainTextPasswd) > 0 {
+			return u.PlainTextPasswd
+		}
+	}
+	if conf.Chpasswd != nil {
+		for _, u := range conf.Chpasswd.Users {
+			if isWindowsAdministrator(u.Name) && (len(u.Type) == 0 || u.Type == CHPASSWD_TYPE_TEXT) && u.Password != CHPASSWD_TYPE_RANDOM {
+				return u.Password
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func newWindowsTestConfig() (*SCloudConfig, *SNetworkConfig) {
+	conf := &SCloudConfig{
+		Hostname: "windows-server-2022",
+		Timezone: "Asia/Shanghai",
+		Runcmd:   []string{"Write-Output done"},
+	}
+	conf.MergeUser(SUser{Name: "Administrator", PlainTextPasswd: "P@ssw0rd"})
+	conf.MergeUser(SUser{Name: "ops", PlainTextPasswd: "0ps-P@ss"})
+	conf.MergeWriteFile(NewWriteFile(`C:\ProgramData\app\config.ini`, "[app]\nkey=value\n", "", "", false), false)
+
+	network := &SNetworkConfig{}
+	eth := NewNetworkInterface("eth0")
+	eth.MacAddress = "00:22:aa:bb:cc:dd"
+	eth.StaticAddress("10.0.0.5/24", "10.0.0.1").Route("192.168.0.0/16", "10.0.0.254", 10)
+	eth.Nameservers = &SNameservers{Addresses: []string{"10.0.0.2", "10.0.0.3"}, Search: []string{"example.com"}}
+	eth1 := NewNetworkInterface("Ethernet 2")
+	eth1.Dhcp4 = true
+	network.Ethernets = append(network.Ethernets, eth, eth1)
+	return conf, network
+}
+
+func TestPowerShellScripts(t *testing.T) {
+	conf, network := newWindowsTestConfig()
+	script := strings.Join(conf.PowerShellScripts(network), "\n")
+	for _, want := range []string{
+		"Rename-Computer -NewName 'windows-server' -Force",
+		"tzutil /s 'China Standard Time'",
+		"net user 'Administrator' 'P@ssw0rd'",
+		"New-LocalUser -Name 'ops'",
+		"[IO.File]::WriteAllBytes('C:\\ProgramData\\app\\config.ini', [Convert]::FromBase64String('" + base64.StdEncoding.EncodeToString([]byte("[app]\nkey=value\n")) + "'))",
+		"$_.MacAddress -eq '00-22-AA-BB-CC-DD'",
+		"New-NetIPAddress -InterfaceIndex $adapter.ifIndex -IPAddress '10.0.0.5' -PrefixLength 24 -DefaultGateway '10.0.0.1'",
+		"New-NetRoute -InterfaceIndex $adapter.ifIndex -DestinationPrefix '192.168.0.0/16' -NextHop '10.0.0.254' -RouteMetric 10",
+		"Set-DnsClientServerAddress -InterfaceIndex $adapter.ifIndex -ServerAddresses @('10.0.0.2','10.0.0.3')",
+		"Get-NetAdapter -Name 'Ethernet 2'",
+		"-AddressFamily IPv4 -Dhcp Enabled",
+		"Set-DnsClientGlobalSetting -SuffixSearchList @('example.com')",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "New-LocalUser -Name 'Administrator'") {
+		t.Errorf("Administrator should not be created")
+	}
+	if !strings.HasSuffix(script, "Write-Output done") {
+		t.Errorf("runcmd should be last")
+	}
+	if !strings.HasPrefix(conf.UserDataPowerShell(), CLOUD_POWER_SHELL_HEADER) {
+		t.Errorf("UserDataPowerShell header")
+	}
+}
+
+func TestPowerShellPasswordQuote(t *testing.T) {
+	conf := &SCloudConfig{Timezone: "UTC$(Stop-Computer)"}
+	conf.MergeUser(SUser{Name: "Administrator", PlainTextPasswd: `P@$$w0rd"; Stop-Computer; "`})
+	conf.MergeUser(SUser{Name: "dev", PlainTextPasswd: `pa$HOME"; Stop-Computer; "`})
+	conf.Chpasswd = &SChpasswd{
+		Users: []SChpasswdUser{{Name: "ops", Password: "it's`$env:PATH"}},
+	}
+	script := strings.Join(conf.PowerShellScripts(nil), "\n")
+	for _, want := range []string{
+		`net user 'Administrator' 'P@$$w0rd"; Stop-Computer; "'`,
+		"net user 'ops' 'it''s`$env:PATH'",
+		`net user 'dev' 'pa$HOME"; Stop-Computer; "'`,
+		"tzutil /s 'UTC$(Stop-Computer)'",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+}
+
+type testUnattend struct {
+	Settings []struct {
+		Pass      string `xml:"pass,attr"`
+		Component []struct {
+			ComputerName string
+			TimeZone     string
+			Commands     []struct {
+				Order       int
+				CommandLine string
+			} `xml:"FirstLogonCommands>SynchronousCommand"`
+			AdminPassword string `xml:"UserAccounts>AdministratorPassword>Value"`
+			AutoLogonUser string `xml:"AutoLogon>Username"`
+		} `xml:"component"`
+	} `xml:"settings"`
+}
+
+func TestUnattendXML(t *testing.T) {
+	conf, network := newWindowsTestConfig()
+	data, err := conf.UnattendXML(SUnattendOptions{Network: network, FirstLogonCommands: []string{"shutdown /r /t 0"}})
+	if err != nil {
+		t.Fatalf("UnattendXML: %s", err)
+	}
+	unattend := testUnattend{}
+	if err := xml.Unmarshal([]byte(data), &unattend); err != nil {
+		t.Fatalf("xml.Unmarshal: %s", err)
+	}
+	if len(unattend.Settings) != 2 || unattend.Settings[0].Pass != "specialize" || unattend.Settings[1].Pass != "oobeSystem" {
+		t.Fatalf("settings: %#v", unattend.Settings)
+	}
+	specialize := unattend.Settings[0].Component[0]
+	if specialize.ComputerName != "windows-server" || specialize.TimeZone != "China Standard Time" {
+		t.Errorf("specialize: %#v", specialize)
+	}
+	if strings.Contains(data, "<FirstLogonCommands></FirstLogonCommands>") {
+		t.Errorf("empty FirstLogonCommands rendered")
+	}
+	oobe := unattend.Settings[1].Component[0]
+	password, err := DecodeUnattendSecret(oobe.AdminPassword, "AdministratorPassword")
+	if err != nil || password != "P@ssw0rd" {
+		t.Errorf("admin password %q: %v", password, err)
+	}
+	if oobe.AutoLogonUser != WINDOWS_ADMINISTRATOR {
+		t.Errorf("auto logon user %q", oobe.AutoLogonUser)
+	}
+
+	// reassemble the first logon script
+	b64 := ""
+	for i, cmd := range oobe.Commands {
+		if cmd.Order != i+1 {
+			t.Errorf("command %d order %d", i, cmd.Order)
+		}
+		if len(cmd.CommandLine) > 1024 {
+			t.Errorf("command %d too long", cmd.Order)
+		}
+		if strings.HasPrefix(cmd.CommandLine, `cmd /c >>`) {
+			b64 += cmd.CommandLine[strings.LastIndex(cmd.CommandLine, " ")+1:]
+		}
+	}
+	if last := oobe.Commands[len(oobe.Commands)-1].CommandLine; last != "shutdown /r /t 0" {
+		t.Errorf("last command %q", last)
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatalf("decode script: %s", err)
+	}
+	script := strings.TrimPrefix(string(raw), "\xef\xbb\xbf")
+	if !strings.Contains(script, "New-LocalUser -Name 'ops'") || !strings.Contains(script, "New-NetIPAddress") || !strings.HasSuffix(script, "Write-Output done") {
+		t.Errorf("script: %s", script)
+	}
+	if strings.Contains(script, "net user 'Administrator'") || strings.Contains(script, "Rename-Computer") || strings.Contains(script, "tzutil") {
+		t.Errorf("script should not set what unattend.xml sets: %s", script)
+	}
+
+	conf.Users = conf.Users[1:]
+	if _, err := conf.UnattendXML(SUnattendOptions{}); err == nil {
+		t.Errorf("first logon commands without Administrator password should fail")
+	}
+}
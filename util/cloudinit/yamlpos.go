@@ -0,0 +1,287 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sYamlPosition is the 1-based line and column of a YAML node
+type sYamlPosition struct {
+	Line   int
+	Column int
+}
+
+type sYamlContainer struct {
+	indent int
+	path   string
+	seq    bool
+	count  int
+}
+
+// sYamlIndexer locates the keys and sequence items of block style YAML by
+// path, e.g. users[1].name, which is all a cloud-config needs, by scanning
+// the lines instead of parsing a node tree. The flow collections and block
+// scalars are located as a whole. The documents indented by tabs or with
+// anchors and aliases, whose nodes can not be located from their lines, are
+// not indexed at all, so that no position points at the wrong node.
+type sYamlIndexer struct {
+	positions map[string]sYamlPosition
+	stack     []*sYamlContainer
+
+	pending       string
+	hasPending    bool
+	pendingIndent int
+
+	// the more indented lines belong to a block scalar
+	scalarIndent int
+	// the unclosed brackets of a multiline flow collection
+	flowDepth int
+	// a line is indented by tabs or has an anchor or alias
+	unsupported bool
+}
+
+func indexYamlPositions(data string) map[string]sYamlPosition {
+	idx := &sYamlIndexer{
+		positions:    map[string]sYamlPosition{},
+		scalarIndent: -1,
+	}
+	for i, line := range strings.Split(data, "\n") {
+		idx.line(i+1, strings.TrimRight(line, "\r"))
+		if idx.unsupported {
+			return map[string]sYamlPosition{}
+		}
+	}
+	return idx.positions
+}
+
+// isYamlContentIndexable tells if the content of a line is not indented by
+// tabs, and has no anchor or alias as an item or value
+func isYamlContentIndexable(content string) bool {
+	if content[0] == '\t' {
+		rest := strings.TrimLeft(content, " \t")
+		return len(rest) == 0 || rest[0] == '#'
+	}
+	for isYamlItem(content) {
+		content = strings.TrimLeft(content[1:], " \t")
+	}
+	if _, value, ok := splitYamlKey(content); ok {
+		content = value
+	}
+	return !(len(content) > 1 && (content[0] == '&' || content[0] == '*') && content[1] != ' ')
+}
+
+func (idx *sYamlIndexer) line(lineno int, text string) {
+	if idx.flowDepth > 0 {
+		idx.flowDepth += flowBracketDelta(text)
+		return
+	}
+	content := strings.TrimLeft(text, " ")
+	indent := len(text) - len(content)
+	if len(content) == 0 || content[0] == '#' {
+		return
+	}
+	if idx.scalarIndent >= 0 {
+		if indent > idx.scalarIndent {
+			return
+		}
+		idx.scalarIndent = -1
+	}
+	if strings.HasPrefix(content, "---") || strings.HasPrefix(content, "...") {
+		idx.stack = nil
+		idx.hasPending = false
+		return
+	}
+	if !isYamlContentIndexable(content) {
+		idx.unsupported = true
+		return
+	}
+	idx.entry(lineno, indent, content)
+}
+
+func isYamlItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+func (idx *sYamlIndexer) top() *sYamlContainer {
+	if len(idx.stack) == 0 {
+		return nil
+	}
+	return idx.stack[len(idx.stack)-1]
+}
+
+func (idx *sYamlIndexer) entry(lineno int, col int, content string) {
+	isItem := isYamlItem(content)
+	for top := idx.top(); top != nil; top = idx.top() {
+		if top.indent < col {
+			break
+		}
+		if top.indent == col && top.seq == isItem {
+			break
+		}
+		if top.indent == col && isItem && idx.hasPending && idx.pendingIndent == col {
+			// a sequence may be as indented as its key
+			break
+		}
+		idx.stack = idx.stack[:len(idx.stack)-1]
+	}
+	top := idx.top()
+	if top == nil || top.indent < col || top.seq != isItem {
+		if !idx.hasPending && top != nil {
+			// continuation of a multiline plain scalar
+			return
+		}
+		path := ""
+		if idx.hasPending {
+			path = idx.pending
+		}
+		top = &sYamlContainer{indent: col, path: path, seq: isItem}
+		idx.stack = append(idx.stack, top)
+	}
+	idx.hasPending = false
+
+	if isItem {
+		path := fmt.Sprintf("%s[%d]", top.path, top.count)
+		top.count++
+		rest := strings.TrimLeft(content[1:], " ")
+		restCol := col + len(content) - len(rest)
+		if len(rest) == 0 || rest[0] == '#' {
+			idx.positions[path] = sYamlPosition{Line: lineno, Column: col + 1}
+			idx.setPending(path, -1)
+			return
+		}
+		idx.positions[path] = sYamlPosition{Line: lineno, Column: restCol + 1}
+		if _, _, ok := splitYamlKey(rest); ok || isYamlItem(rest) {
+			idx.setPending(path, -1)
+			idx.entry(lineno, restCol, rest)
+			return
+		}
+		idx.value(col, rest)
+		return
+	}
+
+	key, value, ok := splitYamlKey(content)
+	if !ok {
+		return
+	}
+	path := key
+	if len(top.path) > 0 {
+		path = top.path + "." + key
+	}
+	idx.positions[path] = sYamlPosition{Line: lineno, Column: col + 1}
+	if len(value) == 0 || value[0] == '#' {
+		idx.setPending(path, col)
+		return
+	}
+	idx.value(col, value)
+}
+
+func (idx *sYamlIndexer) setPending(path string, indent int) {
+	idx.pending = path
+	idx.hasPending = true
+	idx.pendingIndent = indent
+}
+
+func (idx *sYamlIndexer) value(col int, value string) {
+	switch value[0] {
+	case '|', '>':
+		idx.scalarIndent = col
+	case '[', '{':
+		idx.flowDepth = flowBracketDelta(value)
+	}
+}
+
+// splitYamlKey splits a mapping entry into its unquoted key and value
+func splitYamlKey(content string) (string, string, bool) {
+	if len(content) == 0 {
+		return "", "", false
+	}
+	var key, rest string
+	switch content[0] {
+	case '"', '\'':
+		end := strings.IndexByte(content[1:], content[0])
+		if end < 0 {
+			return "", "", false
+		}
+		key, rest = content[1:end+1], content[end+2:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		rest = rest[1:]
+	case '[', '{', '#', '|', '>', '&', '*', '!', '?':
+		return "", "", false
+	default:
+		pos := -1
+		for i := 0; i < len(content); i++ {
+			if content[i] == '#' && i > 0 && content[i-1] == ' ' {
+				break
+			}
+			if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ' || content[i+1] == '\t') {
+				pos = i
+				break
+			}
+		}
+		if pos <= 0 {
+			return "", "", false
+		}
+		key, rest = strings.TrimRight(content[:pos], " "), content[pos+1:]
+	}
+	if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(rest), true
+}
+
+// flowBracketDelta counts the brackets opened and not closed in a line of
+// a flow collection
+func flowBracketDelta(text string) int {
+	delta := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return delta
+		case c == '[' || c == '{':
+			delta++
+		case c == ']' || c == '}':
+			delta--
+		}
+	}
+	return delta
+}
+
+// lookup returns the position of the path, or of its nearest located
+// ancestor
+func lookupYamlPosition(positions map[string]sYamlPosition, path string) sYamlPosition {
+	for len(path) > 0 {
+		if pos, ok := positions[path]; ok {
+			return pos
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return sYamlPosition{}
+}
@@ -0,0 +1,410 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/osprofile"
+	"yunion.io/x/pkg/util/qemuimgfmt"
+)
+
+const (
+	maxConfigSize = 64 * 1024
+)
+
+// sDetectedOs is what is found in a filesystem, the values are passed to
+// the normalization of the image name
+type sDetectedOs struct {
+	osType      string
+	dist        string
+	version     string
+	fullVersion string
+	arch        string
+	lang        string
+	server      bool
+}
+
+// DetectImageInfo reads the operating system of an image file of the
+// formats of qemuimgfmt.OpenImageFile, see DetectImageInfoFromDisk
+func DetectImageInfo(imagePath string, imageName string) (ImageInfo, error) {
+	img, err := qemuimgfmt.OpenImageFile(imagePath, "")
+	if err != nil {
+		return NormalizeImageInfo(imageName, "", "", "", ""), err
+	}
+	defer img.Close()
+	return DetectImageInfoFromDisk(img, img.Size(), imageName)
+}
+
+// DetectImageInfoFromDisk reads the partitions and filesystems of a disk
+// to find the distribution, version, arch, language and boot mode of the
+// operating system installed. The values not found are guessed from the
+// image name as NormalizeImageInfo, and the info guessed is returned with
+// the error if no operating system is found.
+func DetectImageInfoFromDisk(disk io.ReaderAt, size int64, imageName string) (ImageInfo, error) {
+	info := NormalizeImageInfo(imageName, "", "", "", "")
+	table, parts, err := ReadPartitions(disk, size)
+	if err != nil {
+		return info, errors.Wrap(err, "ReadPartitions")
+	}
+	uefi := false
+	if table != PARTITION_TABLE_NONE {
+		hasESP, hasBiosBoot := false, false
+		for _, part := range parts {
+			hasESP = hasESP || part.IsESP()
+			hasBiosBoot = hasBiosBoot || part.IsBiosBoot()
+		}
+		uefi = hasESP && !hasBiosBoot
+	}
+	var detected *sDetectedOs
+	errs := []error{}
+	for _, part := range parts {
+		if detected, err = detectPartition(io.NewSectionReader(disk, part.Start, part.Size)); err == nil {
+			break
+		}
+		errs = append(errs, errors.Wrapf(err, "partition %d", part.Index))
+	}
+	if detected == nil {
+		if uefi {
+			info.OsBios = osprofile.OS_BOOT_UEFI
+		}
+		if len(errs) == 0 {
+			return info, errors.Wrap(errors.ErrNotFound, "no partitions")
+		}
+		return info, errors.Wrap(errors.NewAggregate(errs), "no operating system found")
+	}
+	info = NormalizeImageInfo(imageName, detected.arch, detected.osType, detected.dist, detected.version)
+	if detected.server {
+		info.OsDistro = OS_DIST_WINDOWS_SERVER
+		info.OsVersion = normalizeOsVersion(imageName, info.OsDistro, detected.version)
+	}
+	if len(info.OsVersion) == 0 {
+		info.OsVersion = detected.version
+	}
+	if len(detected.fullVersion) > 0 {
+		info.OsFullVersion = detected.fullVersion
+	}
+	if len(detected.lang) > 0 {
+		info.OsLang = detected.lang
+	}
+	if uefi {
+		info.OsBios = osprofile.OS_BOOT_UEFI
+	} else {
+		// arm boots by UEFI only
+		info.OsBios = normalizeOsBios("", info.OsArch)
+	}
+	return info, nil
+}
+
+func detectPartition(part io.ReaderAt) (*sDetectedOs, error) {
+	fsType := ProbeFilesystem(part)
+	fs, err := openFilesystem(part, fsType)
+	if err != nil {
+		return nil, err
+	}
+	if fsType == FS_NTFS {
+		return detectWindows(fs)
+	}
+	return detectLinux(fs)
+}
+
+// parseShellVars parses the assignments of os-release and the like
+func parseShellVars(data []byte) map[string]string {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		pos := strings.IndexByte(line, '=')
+		if pos <= 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[pos+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[strings.TrimSpace(line[:pos])] = value
+	}
+	return vars
+}
+
+func firstLine(data []byte) string {
+	line, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine()
+	return strings.TrimSpace(string(line))
+}
+
+var (
+	releaseVersionRegexp = regexp.MustCompile(`release\s+(\d[\d.]*)`)
+	suseVersionRegexp    = regexp.MustCompile(`(?m)^\s*VERSION\s*=\s*(\S+)`)
+	susePatchRegexp      = regexp.MustCompile(`(?m)^\s*PATCHLEVEL\s*=\s*(\d+)`)
+)
+
+func detectLinux(fs iFilesystem) (*sDetectedOs, error) {
+	detected := &sDetectedOs{osType: osprofile.OS_TYPE_LINUX}
+	redhatRelease, _ := readFile(fs, "/etc/redhat-release", maxConfigSize)
+	debianVersion, _ := readFile(fs, "/etc/debian_version", maxConfigSize)
+	osRelease, err := readFile(fs, "/etc/os-release", maxConfigSize)
+	if err != nil {
+		osRelease, err = readFile(fs, "/usr/lib/os-release", maxConfigSize)
+	}
+	switch {
+	case err == nil:
+		vars := parseShellVars(osRelease)
+		detected.dist = strings.TrimSpace(vars["NAME"] + " " + vars["ID"])
+		if vars["ID"] == "sles" || vars["ID"] == "sled" {
+			detected.dist = OS_DIST_SUSE
+		}
+		// SLES 15-SP5
+		detected.version = strings.Replace(vars["VERSION_ID"], "-SP", " SP", 1)
+		detected.fullVersion = detected.version
+		refined := ""
+		if m := releaseVersionRegexp.FindSubmatch(redhatRelease); m != nil {
+			refined = string(m[1])
+		} else if len(debianVersion) > 0 && strings.Contains(strings.ToLower(detected.dist), "debian") {
+			refined = firstLine(debianVersion)
+		}
+		if len(refined) > len(detected.version) && strings.HasPrefix(refined, detected.version) {
+			detected.fullVersion = refined
+		}
+	case len(redhatRelease) > 0:
+		line := firstLine(redhatRelease)
+		detected.dist = strings.TrimSpace(strings.SplitN(line, " release", 2)[0])
+		if strings.HasPrefix(detected.dist, "Red Hat") {
+			detected.dist = OS_DIST_RHEL
+		}
+		if m := releaseVersionRegexp.FindStringSubmatch(line); m != nil {
+			detected.version = m[1]
+		}
+		detected.fullVersion = detected.version
+	case len(debianVersion) > 0:
+		detected.dist = OS_DIST_DEBIAN
+		detected.version = firstLine(debianVersion)
+		detected.fullVersion = detected.version
+	default:
+		suseRelease, err := readFile(fs, "/etc/SuSE-release", maxConfigSize)
+		if err != nil {
+			return nil, errors.Wrap(errors.ErrNotFound, "no os-release")
+		}
+		detected.dist = firstLine(suseRelease)
+		if m := suseVersionRegexp.FindSubmatch(suseRelease); m != nil {
+			detected.version = string(m[1])
+			if m := susePatchRegexp.FindSubmatch(suseRelease); m != nil && string(m[1]) != "0" {
+				detected.version += " SP" + string(m[1])
+			}
+		}
+		detected.fullVersion = detected.version
+	}
+	for _, path := range []string{"/bin/sh", "/usr/bin/bash", "/sbin/init", "/usr/lib/systemd/systemd"} {
+		if arch, err := elfArch(fs, path); err == nil {
+			detected.arch = arch
+			break
+		}
+	}
+	for _, path := range []string{"/etc/locale.conf", "/etc/default/locale", "/etc/sysconfig/i18n"} {
+		if data, err := readFile(fs, path, maxConfigSize); err == nil {
+			if lang, ok := parseShellVars(data)["LANG"]; ok {
+				detected.lang = normalizeLocale(lang)
+				break
+			}
+		}
+	}
+	return detected, nil
+}
+
+// normalizeLocale strips the encoding and modifier of a POSIX locale
+func normalizeLocale(locale string) string {
+	if pos := strings.IndexAny(locale, ".@"); pos >= 0 {
+		locale = locale[:pos]
+	}
+	switch locale {
+	case "C", "POSIX":
+		return ""
+	}
+	return locale
+}
+
+func elfArch(fs iFilesystem, path string) (string, error) {
+	hdr, err := readFile(fs, path, 64)
+	if err != nil {
+		return "", err
+	}
+	if len(hdr) < 20 || string(hdr[:4]) != "\x7fELF" {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "%s is not ELF", path)
+	}
+	var machine uint16
+	if hdr[5] == 2 {
+		machine = binary.BigEndian.Uint16(hdr[18:])
+	} else {
+		machine = binary.LittleEndian.Uint16(hdr[18:])
+	}
+	switch machine {
+	case 0x3e:
+		return osprofile.OS_ARCH_X86_64, nil
+	case 0x03:
+		return osprofile.OS_ARCH_X86_32, nil
+	case 0xb7:
+		return osprofile.OS_ARCH_AARCH64, nil
+	case 0x28:
+		return osprofile.OS_ARCH_AARCH32, nil
+	case 0xf3:
+		return "riscv64", nil
+	case 0x102:
+		return "loongarch64", nil
+	}
+	return "", errors.Wrapf(errors.ErrNotSupported, "ELF machine 0x%x", machine)
+}
+
+func peArch(fs iFilesystem, path string) (string, error) {
+	r, size, err := openFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	dos, err := readAt(r, 64, 0)
+	if err != nil || string(dos[:2]) != "MZ" {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "%s is not PE", path)
+	}
+	peOffset := int64(binary.LittleEndian.Uint32(dos[0x3c:]))
+	if peOffset+6 > size {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "%s PE offset", path)
+	}
+	pe, err := readAt(r, 6, peOffset)
+	if err != nil || string(pe[:4]) != "PE\x00\x00" {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "%s PE signature", path)
+	}
+	switch machine := binary.LittleEndian.Uint16(pe[4:]); machine {
+	case 0x8664:
+		return osprofile.OS_ARCH_X86_64, nil
+	case 0x14c:
+		return osprofile.OS_ARCH_X86_32, nil
+	case 0xaa64:
+		return osprofile.OS_ARCH_AARCH64, nil
+	default:
+		return "", errors.Wrapf(errors.ErrNotSupported, "PE machine 0x%x", machine)
+	}
+}
+
+// windowsLanguages maps the LCID of the installation language
+var windowsLanguages = map[string]string{
+	"0409": "en_US",
+	"0809": "en_GB",
+	"0804": "zh_CN",
+	"0404": "zh_TW",
+	"0c04": "zh_HK",
+	"0411": "ja_JP",
+	"0412": "ko_KR",
+	"0407": "de_DE",
+	"040c": "fr_FR",
+	"0410": "it_IT",
+	"0419": "ru_RU",
+	"0c0a": "es_ES",
+	"0416": "pt_BR",
+}
+
+var (
+	windowsServerVersionRegexp  = regexp.MustCompile(`\b(20\d\d( R2)?)\b`)
+	windowsDesktopVersionRegexp = regexp.MustCompile(`Windows (XP|Vista|7|8\.1|8|10|11)\b`)
+)
+
+func openHive(fs iFilesystem, path string) (*sRegistryHive, error) {
+	r, _, err := openFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	return openRegistryHive(r)
+}
+
+func detectWindows(fs iFilesystem) (*sDetectedOs, error) {
+	software, err := openHive(fs, "/Windows/System32/config/SOFTWARE")
+	if err != nil {
+		return nil, errors.Wrap(err, "open SOFTWARE hive")
+	}
+	key, err := software.lookupKey(`Microsoft\Windows NT\CurrentVersion`)
+	if err != nil {
+		return nil, err
+	}
+	product, err := software.stringValue(key, "ProductName")
+	if err != nil {
+		return nil, errors.Wrap(err, "ProductName")
+	}
+	detected := &sDetectedOs{osType: osprofile.OS_TYPE_WINDOWS, dist: product}
+	build, _ := software.stringValue(key, "CurrentBuildNumber")
+	// Windows 11 keeps the product name of Windows 10
+	if buildNo, _ := strconv.Atoi(build); buildNo >= 22000 && strings.Contains(product, "Windows 10") {
+		product = strings.Replace(product, "Windows 10", "Windows 11", 1)
+		detected.dist = product
+	}
+	installType, _ := software.stringValue(key, "InstallationType")
+	detected.server = installType == "Server" || strings.Contains(product, "Server")
+	if detected.server {
+		if m := windowsServerVersionRegexp.FindStringSubmatch(product); m != nil {
+			detected.version = m[1]
+		}
+	} else if m := windowsDesktopVersionRegexp.FindStringSubmatch(product); m != nil {
+		detected.version = m[1]
+	}
+	major, err := software.dwordValue(key, "CurrentMajorVersionNumber")
+	if err == nil {
+		minor, _ := software.dwordValue(key, "CurrentMinorVersionNumber")
+		detected.fullVersion = fmt.Sprintf("%d.%d", major, minor)
+	} else {
+		detected.fullVersion, _ = software.stringValue(key, "CurrentVersion")
+	}
+	if len(build) > 0 && len(detected.fullVersion) > 0 {
+		detected.fullVersion += "." + build
+	}
+	for _, path := range []string{"/Windows/System32/ntoskrnl.exe", "/Windows/System32/cmd.exe", "/Windows/explorer.exe"} {
+		if arch, err := peArch(fs, path); err == nil {
+			detected.arch = arch
+			break
+		}
+	}
+	detected.lang = windowsLanguage(fs)
+	return detected, nil
+}
+
+func windowsLanguage(fs iFilesystem) string {
+	system, err := openHive(fs, "/Windows/System32/config/SYSTEM")
+	if err != nil {
+		return ""
+	}
+	key, err := system.lookupKey("Select")
+	if err != nil {
+		return ""
+	}
+	current, err := system.dwordValue(key, "Current")
+	if err != nil {
+		return ""
+	}
+	key, err = system.lookupKey(fmt.Sprintf(`ControlSet%03d\Control\Nls\Language`, current))
+	if err != nil {
+		return ""
+	}
+	lcid, err := system.stringValue(key, "InstallLanguage")
+	if err != nil {
+		return ""
+	}
+	return windowsLanguages[strings.ToLower(lcid)]
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/util/osprofile"
+)
+
+func testElf(machine uint16) string {
+	elf := make([]byte, 64)
+	copy(elf, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(elf[18:], machine)
+	return string(elf)
+}
+
+// guidBytes encodes a GUID of mixed endian as in GPT
+func guidBytes(guid string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+type sTestPartition struct {
+	ptype string
+	data  []byte
+}
+
+// buildTestDisk places the partitions at 1M aligned offsets of a GPT disk,
+// or of an MBR disk if the types are MBR types
+func buildTestDisk(gpt bool, parts []sTestPartition) []byte {
+	const align = 2048
+	le := binary.LittleEndian
+	disk := make([]byte, align*512)
+	gptEntries := make([]byte, 128*128)
+	for i, part := range parts {
+		start := int64(len(disk) / 512)
+		sectors := int64(len(part.data)+align*512-1) / (align * 512) * align
+		disk = append(disk, part.data...)
+		disk = append(disk, make([]byte, sectors*512-int64(len(part.data)))...)
+		if gpt {
+			entry := gptEntries[i*128:]
+			copy(entry, guidBytes(part.ptype))
+			le.PutUint64(entry[32:], uint64(start))
+			le.PutUint64(entry[40:], uint64(start+sectors-1))
+			copy(entry[56:], utf16Bytes("part"))
+		} else {
+			ptype, _ := hex.DecodeString(strings.TrimPrefix(part.ptype, "0x"))
+			entry := disk[446+i*16:]
+			entry[4] = ptype[0]
+			le.PutUint32(entry[8:], uint32(start))
+			le.PutUint32(entry[12:], uint32(sectors))
+		}
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	if gpt {
+		disk[446+4] = MBR_TYPE_GPT
+		le.PutUint32(disk[446+8:], 1)
+		le.PutUint32(disk[446+12:], 0xffffffff)
+		copy(disk[512:], "EFI PART")
+		le.PutUint64(disk[512+72:], 2)
+		le.PutUint32(disk[512+80:], 128)
+		le.PutUint32(disk[512+84:], 128)
+		copy(disk[1024:], gptEntries)
+	}
+	return disk
+}
+
+func TestDetectImageInfoFromDisk(t *testing.T) {
+	ubuntu := []sTestFsEntry{
+		{path: "/etc/os-release", data: "NAME=\"Ubuntu\"\nVERSION=\"22.04.3 LTS (Jammy Jellyfish)\"\nID=ubuntu\nVERSION_ID=\"22.04\"\n"},
+		{path: "/etc/debian_version", data: "bookworm/sid\n"},
+		{path: "/etc/default/locale", data: "LANG=en_US.UTF-8\n"},
+		{path: "/usr/bin/dash", data: testElf(0xb7)},
+		{path: "/bin", link: "usr/bin"},
+		{path: "/usr/bin/sh", link: "dash"},
+	}
+	centos := []sTestFsEntry{
+		{path: "/etc/os-release", data: "NAME=\"CentOS Linux\"\nVERSION=\"7 (Core)\"\nID=\"centos\"\nVERSION_ID=\"7\"\n"},
+		{path: "/etc/redhat-release", data: "CentOS Linux release 7.9.2009 (Core)\n"},
+		{path: "/etc/locale.conf", data: "LANG=\"C.UTF-8\"\n"},
+		{path: "/bin/sh", data: testElf(0x3e)},
+	}
+	for _, c := range []struct {
+		name      string
+		imageName string
+		disk      []byte
+		want      ImageInfo
+		wantErr   bool
+	}{
+		{
+			name:      "ubuntu gpt",
+			imageName: "image",
+			disk: buildTestDisk(true, []sTestPartition{
+				{ptype: GPT_TYPE_ESP, data: make([]byte, 1024*1024)},
+				{ptype: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", data: buildTestExt(ubuntu)},
+			}),
+			want: ImageInfo{
+				Name: "image", OsArch: osprofile.OS_ARCH_AARCH64, OsType: osprofile.OS_TYPE_LINUX,
+				OsDistro: OS_DIST_UBUNTU, OsVersion: "22.04", OsFullVersion: "22.04", OsLang: "en_US", OsBios: osprofile.OS_BOOT_UEFI,
+			},
+		},
+		{
+			name:      "centos xfs",
+			imageName: "image-uefi",
+			disk:      buildTestXfs(centos),
+			want: ImageInfo{
+				Name: "image-uefi", OsArch: osprofile.OS_ARCH_X86_64, OsType: osprofile.OS_TYPE_LINUX,
+				OsDistro: OS_DIST_CENTOS, OsVersion: "7", OsFullVersion: "7.9.2009", OsBios: osprofile.OS_BOOT_BIOS,
+			},
+		},
+		{
+			name:      "windows server mbr",
+			imageName: "win",
+			disk: buildTestDisk(false, []sTestPartition{
+				{ptype: "0x07", data: make([]byte, 1024*1024)},
+				{ptype: "0x07", data: buildTestNtfs(testWindowsEntries("Windows Server 2019 Datacenter", "Server", "17763", "0804"))},
+			}),
+			want: ImageInfo{
+				Name: "win", OsArch: osprofile.OS_ARCH_X86_64, OsType: osprofile.OS_TYPE_WINDOWS,
+				OsDistro: OS_DIST_WINDOWS_SERVER, OsVersion: "2019", OsFullVersion: "10.0.17763", OsLang: "zh_CN", OsBios: osprofile.OS_BOOT_BIOS,
+			},
+		},
+		{
+			name:      "windows 11",
+			imageName: "win",
+			disk: buildTestDisk(true, []sTestPartition{
+				{ptype: GPT_TYPE_ESP, data: make([]byte, 1024*1024)},
+				{ptype: GPT_TYPE_MS_RESERVED, data: make([]byte, 1024*1024)},
+				{ptype: GPT_TYPE_BASIC_DATA, data: buildTestNtfs(testWindowsEntries("Windows 10 Pro", "Client", "22631", "0409"))},
+			}),
+			want: ImageInfo{
+				Name: "win", OsArch: osprofile.OS_ARCH_X86_64, OsType: osprofile.OS_TYPE_WINDOWS,
+				OsDistro: OS_DIST_WINDOWS, OsVersion: "11", OsFullVersion: "10.0.22631", OsLang: "en_US", OsBios: osprofile.OS_BOOT_UEFI,
+			},
+		},
+		{
+			name:      "empty",
+			imageName: "CentOS-8-x86_64",
+			disk:      make([]byte, 1024*1024),
+			want:      NormalizeImageInfo("CentOS-8-x86_64", "", "", "", ""),
+			wantErr:   true,
+		},
+	} {
+		got, err := DetectImageInfoFromDisk(bytes.NewReader(c.disk), int64(len(c.disk)), c.imageName)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDetectImageInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	disk := buildTestDisk(false, []sTestPartition{{ptype: "0x83", data: buildTestExt(testFsEntries)}})
+	if err := ioutil.WriteFile(path, disk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := DetectImageInfo(path, "image")
+	if err != nil {
+		t.Fatalf("DetectImageInfo: %v", err)
+	}
+	if info.OsType != osprofile.OS_TYPE_LINUX || info.OsDistro != OS_DIST_OTHER_LINUX || info.OsBios != osprofile.OS_BOOT_BIOS {
+		t.Errorf("DetectImageInfo = %+v", info)
+	}
+	if _, err := DetectImageInfo(path+".missing", "image"); err == nil {
+		t.Errorf("DetectImageInfo of a missing file succeeded")
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * ext2/3/4
+ * Reference: https://www.kernel.org/doc/html/latest/filesystems/ext4/
+ *
+ */
+
+const (
+	extSuperblockOffset = 1024
+	extRootInode        = 2
+
+	extIncompatFiletype = 0x2
+	extIncompat64bit    = 0x80
+
+	extFlagExtents    = 0x80000
+	extFlagInlineData = 0x10000000
+
+	extExtentMagic = 0xf30a
+
+	extModeTypeMask = 0xf000
+	extModeDir      = 0x4000
+	extModeFile     = 0x8000
+	extModeSymlink  = 0xa000
+
+	// the block map depth of extents is at most 5
+	extMaxExtentDepth = 5
+)
+
+type sExtFs struct {
+	dev            io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup int64
+	descSize       int64
+	descOffset     int64
+	incompat       uint32
+}
+
+type sExtInode struct {
+	ino   uint64
+	mode  uint16
+	fsize int64
+	flags uint32
+	block [60]byte
+}
+
+func (i *sExtInode) nodeType() tFsNodeType {
+	switch i.mode & extModeTypeMask {
+	case extModeDir:
+		return fsNodeDir
+	case extModeFile:
+		return fsNodeFile
+	case extModeSymlink:
+		return fsNodeSymlink
+	}
+	return fsNodeOther
+}
+
+func (i *sExtInode) size() int64 {
+	return i.fsize
+}
+
+func openExtFs(dev io.ReaderAt) (*sExtFs, error) {
+	sb, err := readAt(dev, 1024, extSuperblockOffset)
+	if err != nil {
+		return nil, errors.Wrap(err, "read superblock")
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[56:]) != 0xef53 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not ext")
+	}
+	logBlockSize := le.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "log block size %d", logBlockSize)
+	}
+	fs := &sExtFs{
+		dev:            dev,
+		blockSize:      int64(1024) << logBlockSize,
+		inodesPerGroup: int64(le.Uint32(sb[40:])),
+		inodeSize:      128,
+		descSize:       32,
+		incompat:       le.Uint32(sb[96:]),
+	}
+	if le.Uint32(sb[76:]) >= 1 {
+		fs.inodeSize = int64(le.Uint16(sb[88:]))
+	}
+	if fs.incompat&extIncompat64bit != 0 {
+		if descSize := int64(le.Uint16(sb[254:])); descSize >= 64 {
+			fs.descSize = descSize
+		}
+	}
+	if fs.inodesPerGroup == 0 || fs.inodeSize < 128 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "inode geometry")
+	}
+	// the group descriptors follow the superblock
+	fs.descOffset = (int64(le.Uint32(sb[20:])) + 1) * fs.blockSize
+	return fs, nil
+}
+
+func (fs *sExtFs) readInode(ino uint64) (*sExtInode, error) {
+	if ino == 0 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "inode 0")
+	}
+	group := int64(ino-1) / fs.inodesPerGroup
+	index := int64(ino-1) % fs.inodesPerGroup
+	desc, err := readAt(fs.dev, int(fs.descSize), fs.descOffset+group*fs.descSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read group descriptor %d", group)
+	}
+	le := binary.LittleEndian
+	table := int64(le.Uint32(desc[8:]))
+	if fs.descSize >= 64 {
+		table |= int64(le.Uint32(desc[0x28:])) << 32
+	}
+	buf, err := readAt(fs.dev, 160, table*fs.blockSize+index*fs.inodeSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read inode %d", ino)
+	}
+	inode := &sExtInode{
+		ino:   ino,
+		mode:  le.Uint16(buf[0:]),
+		fsize: int64(le.Uint32(buf[4:])) | int64(le.Uint32(buf[108:]))<<32,
+		flags: le.Uint32(buf[32:]),
+	}
+	if inode.fsize < 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "inode %d size %d", ino, inode.fsize)
+	}
+	copy(inode.block[:], buf[40:100])
+	return inode, nil
+}
+
+func (fs *sExtFs) root() (iFsNode, error) {
+	return fs.readInode(extRootInode)
+}
+
+type sExtExtent struct {
+	logical  int64
+	length   int64
+	physical int64
+	// uninitialized extents read as zeros
+	uninit bool
+}
+
+func (fs *sExtFs) collectExtents(node []byte, depth int, extents []sExtExtent) ([]sExtExtent, error) {
+	le := binary.LittleEndian
+	if le.Uint16(node[0:]) != extExtentMagic {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "extent header magic")
+	}
+	entries := int(le.Uint16(node[2:]))
+	treeDepth := int(le.Uint16(node[6:]))
+	if depth > extMaxExtentDepth || 12+entries*12 > len(node) {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "extent tree")
+	}
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12:]
+		if treeDepth == 0 {
+			length := int64(le.Uint16(e[4:]))
+			uninit := false
+			if length > 32768 {
+				length -= 32768
+				uninit = true
+			}
+			extents = append(extents, sExtExtent{
+				logical:  int64(le.Uint32(e[0:])),
+				length:   length,
+				physical: int64(le.Uint16(e[6:]))<<32 | int64(le.Uint32(e[8:])),
+				uninit:   uninit,
+			})
+			continue
+		}
+		leaf := int64(le.Uint32(e[4:])) | int64(le.Uint16(e[8:]))<<32
+		child, err := readAt(fs.dev, int(fs.blockSize), leaf*fs.blockSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read extent block %d", leaf)
+		}
+		if extents, err = fs.collectExtents(child, depth+1, extents); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+// indirectBlock maps a block through the indirect blocks of the levels
+func (fs *sExtFs) indirectBlock(table int64, block int64, level int) (int64, error) {
+	perBlock := fs.blockSize / 4
+	for ; level > 0; level-- {
+		if table == 0 {
+			return -1, nil
+		}
+		span := int64(1)
+		for i := 1; i < level; i++ {
+			span *= perBlock
+		}
+		buf, err := readAt(fs.dev, 4, table*fs.blockSize+(block/span)*4)
+		if err != nil {
+			return -1, err
+		}
+		table = int64(binary.LittleEndian.Uint32(buf))
+		block %= span
+	}
+	if table == 0 {
+		return -1, nil
+	}
+	return table, nil
+}
+
+func (fs *sExtFs) blockMapper(inode *sExtInode) (func(int64) (int64, error), error) {
+	le := binary.LittleEndian
+	if inode.flags&extFlagExtents != 0 {
+		extents, err := fs.collectExtents(inode.block[:], 0, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "extents of inode %d", inode.ino)
+		}
+		sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+		return func(block int64) (int64, error) {
+			i := sort.Search(len(extents), func(i int) bool { return extents[i].logical+extents[i].length > block })
+			if i == len(extents) || extents[i].logical > block || extents[i].uninit {
+				return -1, nil
+			}
+			return (extents[i].physical + block - extents[i].logical) * fs.blockSize, nil
+		}, nil
+	}
+	var ptrs [15]int64
+	for i := range ptrs {
+		ptrs[i] = int64(le.Uint32(inode.block[i*4:]))
+	}
+	perBlock := fs.blockSize / 4
+	return func(block int64) (int64, error) {
+		var phys int64
+		var err error
+		switch {
+		case block < 12:
+			phys = ptrs[block]
+			if phys == 0 {
+				phys = -1
+			}
+		case block < 12+perBlock:
+			phys, err = fs.indirectBlock(ptrs[12], block-12, 1)
+		case block < 12+perBlock+perBlock*perBlock:
+			phys, err = fs.indirectBlock(ptrs[13], block-12-perBlock, 2)
+		default:
+			phys, err = fs.indirectBlock(ptrs[14], block-12-perBlock-perBlock*perBlock, 3)
+		}
+		if err != nil || phys < 0 {
+			return -1, err
+		}
+		return phys * fs.blockSize, nil
+	}, nil
+}
+
+func (fs *sExtFs) open(node iFsNode) (io.ReaderAt, error) {
+	inode := node.(*sExtInode)
+	if inode.flags&extFlagInlineData != 0 {
+		if inode.fsize > int64(len(inode.block)) {
+			return nil, errors.Wrap(errors.ErrNotSupported, "inline data in extended attributes")
+		}
+		return &sBytesReader{data: inode.block[:inode.fsize]}, nil
+	}
+	mapper, err := fs.blockMapper(inode)
+	if err != nil {
+		return nil, err
+	}
+	return &sBlockReader{dev: fs.dev, blockSize: fs.blockSize, fileSize: inode.fsize, mapBlock: mapper}, nil
+}
+
+func (fs *sExtFs) readlink(node iFsNode) (string, error) {
+	inode := node.(*sExtInode)
+	if inode.fsize < 0 || inode.fsize > maxSymlinkSize {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "symlink %d length %d", inode.ino, inode.fsize)
+	}
+	if inode.fsize < int64(len(inode.block)) && inode.flags&(extFlagExtents|extFlagInlineData) == 0 {
+		// fast symlink
+		return string(inode.block[:inode.fsize]), nil
+	}
+	r, err := fs.open(inode)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, inode.fsize)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// lookup scans the directory entries linearly, the hash tree nodes look
+// like unused entries
+func (fs *sExtFs) lookup(dir iFsNode, name string) (iFsNode, error) {
+	r, err := fs.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	inode := dir.(*sExtInode)
+	if inode.flags&extFlagInlineData != 0 {
+		// the inline directory starts with the parent inode number
+		if inode.fsize < 4 || inode.fsize > int64(len(inode.block)) {
+			return nil, errors.Wrap(errors.ErrNotSupported, "inline directory")
+		}
+		return fs.lookupBlock(inode.block[4:inode.fsize], name)
+	}
+	block := make([]byte, fs.blockSize)
+	for off := int64(0); off < inode.fsize; off += fs.blockSize {
+		n, err := r.ReadAt(block, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if node, err := fs.lookupBlock(block[:n], name); err == nil || errors.Cause(err) != errors.ErrNotFound {
+			return node, err
+		}
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, name)
+}
+
+func (fs *sExtFs) lookupBlock(block []byte, name string) (iFsNode, error) {
+	le := binary.LittleEndian
+	for pos := 0; pos+8 <= len(block); {
+		ino := le.Uint32(block[pos:])
+		recLen := int(le.Uint16(block[pos+4:]))
+		nameLen := int(block[pos+6])
+		if fs.incompat&extIncompatFiletype == 0 {
+			nameLen |= int(block[pos+7]) << 8
+		}
+		if recLen < 8 || pos+recLen > len(block) {
+			break
+		}
+		if ino != 0 && nameLen == len(name) && pos+8+nameLen <= len(block) && string(block[pos+8:pos+8+nameLen]) == name {
+			return fs.readInode(uint64(ino))
+		}
+		pos += recLen
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, name)
+}
+
+type sBytesReader struct {
+	data []byte
+}
+
+func (r *sBytesReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	FS_EXT     = "ext"
+	FS_XFS     = "xfs"
+	FS_NTFS    = "ntfs"
+	FS_FAT     = "vfat"
+	FS_BTRFS   = "btrfs"
+	FS_LVM2_PV = "LVM2_member"
+	FS_SWAP    = "swap"
+
+	// maxSymlinkFollows is the limit of Linux
+	maxSymlinkFollows = 40
+	// maxSymlinkSize is PATH_MAX of Linux, a longer target is corrupted
+	maxSymlinkSize = 4096
+)
+
+type tFsNodeType int
+
+const (
+	fsNodeOther = tFsNodeType(iota)
+	fsNodeFile
+	fsNodeDir
+	fsNodeSymlink
+)
+
+type iFsNode interface {
+	nodeType() tFsNodeType
+	size() int64
+}
+
+// iFilesystem is a read-only filesystem driver, lookup returns
+// errors.ErrNotFound if the directory has no such entry
+type iFilesystem interface {
+	root() (iFsNode, error)
+	lookup(dir iFsNode, name string) (iFsNode, error)
+	open(node iFsNode) (io.ReaderAt, error)
+	readlink(node iFsNode) (string, error)
+}
+
+// ProbeFilesystem identifies the filesystem of a partition by its
+// superblock
+func ProbeFilesystem(part io.ReaderAt) string {
+	buf := make([]byte, 4096)
+	n, _ := part.ReadAt(buf, 0)
+	buf = buf[:n]
+	switch {
+	case len(buf) >= 4 && string(buf[:4]) == "XFSB":
+		return FS_XFS
+	case len(buf) >= 11 && string(buf[3:11]) == "NTFS    ":
+		return FS_NTFS
+	case len(buf) >= 1024+58 && binary.LittleEndian.Uint16(buf[1024+56:]) == 0xef53:
+		return FS_EXT
+	case len(buf) >= 520 && string(buf[512:520]) == "LABELONE":
+		return FS_LVM2_PV
+	case len(buf) >= 4096 && string(buf[4086:4096]) == "SWAPSPACE2":
+		return FS_SWAP
+	case len(buf) >= 512 && buf[510] == 0x55 && buf[511] == 0xaa && (string(buf[82:87]) == "FAT32" || bytes.HasPrefix(buf[54:62], []byte("FAT"))):
+		return FS_FAT
+	}
+	magic := make([]byte, 8)
+	if _, err := part.ReadAt(magic, 0x10040); err == nil && string(magic) == "_BHRfS_M" {
+		return FS_BTRFS
+	}
+	return ""
+}
+
+// openFilesystem returns the driver of the filesystems whose files can be
+// read
+func openFilesystem(part io.ReaderAt, fsType string) (iFilesystem, error) {
+	switch fsType {
+	case FS_EXT:
+		return openExtFs(part)
+	case FS_XFS:
+		return openXfs(part)
+	case FS_NTFS:
+		return openNtfs(part)
+	}
+	return nil, errors.Wrapf(errors.ErrNotSupported, "filesystem %q", fsType)
+}
+
+// resolvePath looks up an absolute path, following the symlinks relative
+// to the filesystem root
+func resolvePath(fs iFilesystem, path string) (iFsNode, error) {
+	follows := 0
+	return resolvePathFollows(fs, path, &follows)
+}
+
+func resolvePathFollows(fs iFilesystem, path string, follows *int) (iFsNode, error) {
+	root, err := fs.root()
+	if err != nil {
+		return nil, errors.Wrap(err, "root")
+	}
+	// the directories walked through and their names, for ".." and the
+	// relative symlinks
+	dirs := []iFsNode{root}
+	names := []string{}
+	parts := strings.Split(path, "/")
+	for i, name := range parts {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(names) > 0 {
+				dirs, names = dirs[:len(dirs)-1], names[:len(names)-1]
+			}
+			continue
+		}
+		dir := dirs[len(dirs)-1]
+		if dir.nodeType() != fsNodeDir {
+			return nil, errors.Wrapf(errors.ErrNotFound, "/%s is not a directory", strings.Join(names, "/"))
+		}
+		node, err := fs.lookup(dir, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup %s", name)
+		}
+		if node.nodeType() == fsNodeSymlink {
+			*follows++
+			if *follows > maxSymlinkFollows {
+				return nil, errors.Wrapf(errors.ErrInvalidStatus, "too many symlinks in %s", path)
+			}
+			target, err := fs.readlink(node)
+			if err != nil {
+				return nil, errors.Wrapf(err, "readlink %s", name)
+			}
+			if !strings.HasPrefix(target, "/") {
+				target = "/" + strings.Join(append(names, target), "/")
+			}
+			return resolvePathFollows(fs, target+"/"+strings.Join(parts[i+1:], "/"), follows)
+		}
+		dirs, names = append(dirs, node), append(names, name)
+	}
+	return dirs[len(dirs)-1], nil
+}
+
+// readFile reads at most limit bytes of a file
+func readFile(fs iFilesystem, path string, limit int64) ([]byte, error) {
+	node, err := resolvePath(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if node.nodeType() != fsNodeFile {
+		return nil, errors.Wrapf(errors.ErrNotFound, "%s is not a regular file", path)
+	}
+	size := node.size()
+	if size < 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "%s size %d", path, size)
+	}
+	if size > limit {
+		size = limit
+	}
+	r, err := fs.open(node)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", path)
+	}
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !(err == io.EOF && int64(n) == size) {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+	return buf, nil
+}
+
+// openFile opens a regular file for random access
+func openFile(fs iFilesystem, path string) (io.ReaderAt, int64, error) {
+	node, err := resolvePath(fs, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if node.nodeType() != fsNodeFile {
+		return nil, 0, errors.Wrapf(errors.ErrNotFound, "%s is not a regular file", path)
+	}
+	if node.size() < 0 {
+		return nil, 0, errors.Wrapf(errors.ErrInvalidFormat, "%s size %d", path, node.size())
+	}
+	r, err := fs.open(node)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "open %s", path)
+	}
+	return r, node.size(), nil
+}
+
+// sBlockReader reads a file of mapped blocks, the holes are zeros
+type sBlockReader struct {
+	dev       io.ReaderAt
+	blockSize int64
+	fileSize  int64
+	// mapBlock returns the device offset of a file block, -1 for a hole
+	mapBlock func(block int64) (int64, error)
+}
+
+func (r *sBlockReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.fileSize {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > r.fileSize {
+		p = p[:r.fileSize-off]
+		eof = io.EOF
+	}
+	read := 0
+	for read < len(p) {
+		cur := off + int64(read)
+		inBlock := cur % r.blockSize
+		n := int(r.blockSize - inBlock)
+		if n > len(p)-read {
+			n = len(p) - read
+		}
+		devOffset, err := r.mapBlock(cur / r.blockSize)
+		if err != nil {
+			return read, err
+		}
+		if devOffset < 0 {
+			for i := read; i < read+n; i++ {
+				p[i] = 0
+			}
+		} else if _, err := r.dev.ReadAt(p[read:read+n], devOffset+inBlock); err != nil {
+			return read, err
+		}
+		read += n
+	}
+	return read, eof
+}
@@ -0,0 +1,376 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// sTestFsEntry is a file of the test filesystems, a symlink if link is
+// set, the parent directories are created
+type sTestFsEntry struct {
+	path string
+	data string
+	link string
+}
+
+type sTestFsNode struct {
+	name     string
+	data     []byte
+	link     string
+	isDir    bool
+	children []*sTestFsNode
+	ino      uint64
+}
+
+func newTestFsTree(entries []sTestFsEntry) *sTestFsNode {
+	root := &sTestFsNode{isDir: true}
+	for _, entry := range entries {
+		dir := root
+		names := strings.Split(strings.Trim(entry.path, "/"), "/")
+		for _, name := range names[:len(names)-1] {
+			var child *sTestFsNode
+			for _, c := range dir.children {
+				if c.name == name {
+					child = c
+				}
+			}
+			if child == nil {
+				child = &sTestFsNode{name: name, isDir: true}
+				dir.children = append(dir.children, child)
+			}
+			dir = child
+		}
+		dir.children = append(dir.children, &sTestFsNode{name: names[len(names)-1], data: []byte(entry.data), link: entry.link})
+	}
+	return root
+}
+
+func (n *sTestFsNode) walk(f func(n *sTestFsNode)) {
+	f(n)
+	for _, c := range n.children {
+		c.walk(f)
+	}
+}
+
+func (n *sTestFsNode) mode() uint16 {
+	switch {
+	case n.isDir:
+		return extModeDir | 0755
+	case len(n.link) > 0:
+		return extModeSymlink | 0777
+	}
+	return extModeFile | 0644
+}
+
+// the file types of the directory entries of ext and xfs
+func (n *sTestFsNode) ftype() byte {
+	switch {
+	case n.isDir:
+		return 2
+	case len(n.link) > 0:
+		return 7
+	}
+	return 1
+}
+
+// buildTestExt builds an ext2 filesystem of a single group and 1K blocks
+func buildTestExt(entries []sTestFsEntry) []byte {
+	const (
+		blockSize  = 1024
+		blocks     = 2048
+		inodes     = 64
+		inodeSize  = 128
+		inodeTable = 3
+	)
+	img := make([]byte, blocks*blockSize)
+	le := binary.LittleEndian
+	sb := img[extSuperblockOffset:]
+	le.PutUint32(sb[0:], inodes)
+	le.PutUint32(sb[4:], blocks)
+	le.PutUint32(sb[20:], 1)
+	le.PutUint32(sb[32:], 8192)
+	le.PutUint32(sb[40:], inodes)
+	le.PutUint16(sb[56:], 0xef53)
+	le.PutUint32(sb[76:], 1)
+	le.PutUint16(sb[88:], inodeSize)
+	le.PutUint32(sb[96:], extIncompatFiletype)
+	le.PutUint32(img[2*blockSize+8:], inodeTable)
+
+	root := newTestFsTree(entries)
+	nextIno := uint64(12)
+	root.walk(func(n *sTestFsNode) {
+		if n == root {
+			n.ino = extRootInode
+		} else {
+			n.ino, nextIno = nextIno, nextIno+1
+		}
+	})
+	nextBlock := uint32(inodeTable + inodes*inodeSize/blockSize)
+	var write func(n, parent *sTestFsNode)
+	write = func(n, parent *sTestFsNode) {
+		data := n.data
+		if n.isDir {
+			data = make([]byte, blockSize)
+			pos := 0
+			children := append([]*sTestFsNode{{name: ".", isDir: true, ino: n.ino}, {name: "..", isDir: true, ino: parent.ino}}, n.children...)
+			for i, c := range children {
+				recLen := (8 + len(c.name) + 3) &^ 3
+				if i == len(children)-1 {
+					recLen = blockSize - pos
+				}
+				le.PutUint32(data[pos:], uint32(c.ino))
+				le.PutUint16(data[pos+4:], uint16(recLen))
+				data[pos+6] = byte(len(c.name))
+				data[pos+7] = c.ftype()
+				copy(data[pos+8:], c.name)
+				pos += recLen
+			}
+		} else if len(n.link) > 0 {
+			data = []byte(n.link)
+		}
+		inode := img[inodeTable*blockSize+int(n.ino-1)*inodeSize:]
+		le.PutUint16(inode[0:], n.mode())
+		le.PutUint32(inode[4:], uint32(len(data)))
+		if len(n.link) > 0 && len(n.link) < 60 {
+			copy(inode[40:], n.link)
+		} else {
+			for i := 0; i*blockSize < len(data); i++ {
+				copy(img[int(nextBlock)*blockSize:], data[i*blockSize:])
+				le.PutUint32(inode[40+i*4:], nextBlock)
+				nextBlock++
+			}
+		}
+		for _, c := range n.children {
+			write(c, n)
+		}
+	}
+	write(root, root)
+	return img
+}
+
+// buildTestXfs builds a v5 XFS of a single allocation group, the
+// directories of more than 3 entries are single block directories
+func buildTestXfs(entries []sTestFsEntry) []byte {
+	const (
+		blockSize  = 4096
+		agBlocks   = 64
+		agBlkLog   = 6
+		inodeSize  = 512
+		inoPBlkLog = 3
+		dataBlock  = 16
+	)
+	img := make([]byte, agBlocks*blockSize)
+	be := binary.BigEndian
+	root := newTestFsTree(entries)
+	nextIno := uint64(1 << inoPBlkLog)
+	root.walk(func(n *sTestFsNode) {
+		n.ino, nextIno = nextIno, nextIno+1
+	})
+	copy(img, "XFSB")
+	be.PutUint32(img[4:], blockSize)
+	be.PutUint64(img[8:], agBlocks)
+	be.PutUint64(img[56:], root.ino)
+	be.PutUint32(img[84:], agBlocks)
+	be.PutUint32(img[88:], 1)
+	be.PutUint16(img[100:], 0xb4a0|xfsSbVersion5)
+	be.PutUint16(img[104:], inodeSize)
+	be.PutUint16(img[106:], 1<<inoPBlkLog)
+	img[120] = 12
+	img[123] = inoPBlkLog
+	img[124] = agBlkLog
+	be.PutUint32(img[216:], xfsSbIncompatFtype)
+
+	nextBlock := uint64(dataBlock)
+	putExtent := func(fork []byte, data []byte) {
+		count := uint64(len(data)+blockSize-1) / blockSize
+		copy(img[nextBlock*blockSize:], data)
+		be.PutUint64(fork, nextBlock>>43)
+		be.PutUint64(fork[8:], nextBlock<<21|count)
+		nextBlock += count
+	}
+	var write func(n, parent *sTestFsNode)
+	write = func(n, parent *sTestFsNode) {
+		inode := img[n.ino*inodeSize:]
+		copy(inode, "IN")
+		be.PutUint16(inode[2:], n.mode())
+		inode[4] = 3
+		fork := inode[xfsDinodeV3CoreSize:inodeSize]
+		switch {
+		case n.isDir && len(n.children) <= 3:
+			inode[5] = xfsDinodeFmtLocal
+			fork[0] = byte(len(n.children))
+			be.PutUint32(fork[2:], uint32(parent.ino))
+			pos := 6
+			for _, c := range n.children {
+				fork[pos] = byte(len(c.name))
+				copy(fork[pos+3:], c.name)
+				pos += 3 + len(c.name)
+				fork[pos] = c.ftype()
+				be.PutUint32(fork[pos+1:], uint32(c.ino))
+				pos += 5
+			}
+			be.PutUint64(inode[56:], uint64(pos))
+		case n.isDir:
+			inode[5] = xfsDinodeFmtExtents
+			block := make([]byte, blockSize)
+			copy(block, "XDB3")
+			pos := xfsDirDataV5Header
+			children := append([]*sTestFsNode{{name: ".", isDir: true, ino: n.ino}, {name: "..", isDir: true, ino: parent.ino}}, n.children...)
+			for _, c := range children {
+				be.PutUint64(block[pos:], c.ino)
+				block[pos+8] = byte(len(c.name))
+				copy(block[pos+9:], c.name)
+				block[pos+9+len(c.name)] = c.ftype()
+				pos += (8 + 1 + len(c.name) + 1 + 2 + 7) &^ 7
+			}
+			end := blockSize - xfsDirBlockTailSize - len(children)*xfsDirLeafEntrySize
+			be.PutUint16(block[pos:], xfsDirDataFreeTag)
+			be.PutUint16(block[pos+2:], uint16(end-pos))
+			be.PutUint32(block[blockSize-xfsDirBlockTailSize:], uint32(len(children)))
+			putExtent(fork, block)
+			be.PutUint64(inode[56:], blockSize)
+			be.PutUint32(inode[76:], 1)
+		case len(n.link) > 0:
+			inode[5] = xfsDinodeFmtLocal
+			copy(fork, n.link)
+			be.PutUint64(inode[56:], uint64(len(n.link)))
+		default:
+			inode[5] = xfsDinodeFmtExtents
+			putExtent(fork, n.data)
+			be.PutUint64(inode[56:], uint64(len(n.data)))
+			be.PutUint32(inode[76:], 1)
+		}
+		for _, c := range n.children {
+			write(c, n)
+		}
+	}
+	write(root, root)
+	return img
+}
+
+var testFsEntries = []sTestFsEntry{
+	{path: "/usr/lib/os-release", data: "NAME=\"Test Linux\"\nID=test\n"},
+	{path: "/etc/os-release", link: "../usr/lib/os-release"},
+	{path: "/etc/hostname", data: "test\n"},
+	{path: "/etc/hosts", data: "127.0.0.1 localhost\n"},
+	{path: "/etc/large", data: strings.Repeat("0123456789abcdef", 700)},
+	{path: "/bin", link: "usr/bin"},
+	{path: "/usr/bin/sh", link: "/usr/bin/bash"},
+	{path: "/usr/bin/bash", data: "bash"},
+	{path: "/loop", link: "loop"},
+}
+
+func TestFilesystems(t *testing.T) {
+	for _, c := range []struct {
+		fsType string
+		image  []byte
+	}{
+		{FS_EXT, buildTestExt(testFsEntries)},
+		{FS_XFS, buildTestXfs(testFsEntries)},
+	} {
+		part := bytes.NewReader(c.image)
+		if got := ProbeFilesystem(part); got != c.fsType {
+			t.Fatalf("ProbeFilesystem = %q, want %q", got, c.fsType)
+		}
+		fs, err := openFilesystem(part, c.fsType)
+		if err != nil {
+			t.Fatalf("%s openFilesystem: %v", c.fsType, err)
+		}
+		for path, want := range map[string]string{
+			"/etc/os-release":        testFsEntries[0].data,
+			"/etc/../etc/./hostname": "test\n",
+			"/etc/large":             testFsEntries[4].data,
+			"/bin/sh":                "bash",
+		} {
+			got, err := readFile(fs, path, 1<<20)
+			if err != nil {
+				t.Errorf("%s readFile %s: %v", c.fsType, path, err)
+			} else if string(got) != want {
+				t.Errorf("%s readFile %s = %q, want %q", c.fsType, path, got, want)
+			}
+		}
+		if got, err := readFile(fs, "/etc/large", 10); err != nil || string(got) != "0123456789" {
+			t.Errorf("%s readFile limited = %q, %v", c.fsType, got, err)
+		}
+		if _, err := readFile(fs, "/etc/missing", 10); errors.Cause(err) != errors.ErrNotFound {
+			t.Errorf("%s readFile missing: %v", c.fsType, err)
+		}
+		if _, err := readFile(fs, "/loop", 10); errors.Cause(err) != errors.ErrInvalidStatus {
+			t.Errorf("%s readFile loop: %v", c.fsType, err)
+		}
+	}
+}
+
+func TestReadPartitions(t *testing.T) {
+	disk := make([]byte, 4*1024*1024)
+	le := binary.LittleEndian
+	// a primary partition and two logical partitions
+	mbr := disk[446:]
+	mbr[4] = 0x83
+	le.PutUint32(mbr[8:], 2048)
+	le.PutUint32(mbr[12:], 2048)
+	mbr[16+4] = MBR_TYPE_EXTENDED
+	le.PutUint32(mbr[16+8:], 4096)
+	le.PutUint32(mbr[16+12:], 4096)
+	disk[510], disk[511] = 0x55, 0xaa
+	for i, ebr := range []int64{4096, 6144} {
+		entry := disk[ebr*512+446:]
+		entry[4] = 0x82
+		le.PutUint32(entry[8:], 2048)
+		le.PutUint32(entry[12:], 1024)
+		if i == 0 {
+			entry[16+4] = MBR_TYPE_EXTENDED
+			le.PutUint32(entry[16+8:], 2048)
+			le.PutUint32(entry[16+12:], 2048)
+		}
+		disk[ebr*512+510], disk[ebr*512+511] = 0x55, 0xaa
+	}
+	table, parts, err := ReadPartitions(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatalf("ReadPartitions: %v", err)
+	}
+	want := []SPartition{
+		{Index: 1, Start: 2048 * 512, Size: 2048 * 512, Type: "0x83"},
+		{Index: 5, Start: 6144 * 512, Size: 1024 * 512, Type: "0x82"},
+		{Index: 6, Start: 8192 * 512, Size: 1024 * 512, Type: "0x82"},
+	}
+	if table != PARTITION_TABLE_MBR || len(parts) != len(want) {
+		t.Fatalf("ReadPartitions = %s %+v", table, parts)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Index < parts[j].Index })
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("partition %d = %+v, want %+v", i, parts[i], want[i])
+		}
+	}
+}
+
+func TestReadlinkCorrupted(t *testing.T) {
+	for _, fsize := range []int64{-1, -1 << 62, maxSymlinkSize + 1, 1 << 40} {
+		if _, err := (&sExtFs{}).readlink(&sExtInode{fsize: fsize}); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("ext readlink size %d: %v", fsize, err)
+		}
+		if _, err := (&sXfs{}).readlink(&sXfsInode{fsize: fsize}); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("xfs readlink size %d: %v", fsize, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * Windows registry hive
+ * Reference: https://github.com/msuhanov/regf/blob/master/Windows%20registry%20file%20format%20specification.md
+ *
+ */
+
+const (
+	regTypeSz       = 1
+	regTypeExpandSz = 2
+	regTypeDword    = 4
+
+	regfBinsOffset = 4096
+	regfMaxCell    = 1 << 20
+
+	regKeyCompName   = 0x20
+	regValueCompName = 0x1
+	regDataInline    = 0x80000000
+)
+
+// sRegistryHive reads the keys and values of a hive file without loading
+// it into memory
+type sRegistryHive struct {
+	r    io.ReaderAt
+	root uint32
+}
+
+func openRegistryHive(r io.ReaderAt) (*sRegistryHive, error) {
+	base, err := readAt(r, 512, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "read base block")
+	}
+	if string(base[:4]) != "regf" {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not a registry hive")
+	}
+	return &sRegistryHive{r: r, root: binary.LittleEndian.Uint32(base[0x24:])}, nil
+}
+
+// cell returns the data of the cell at an offset from the hive bins
+func (h *sRegistryHive) cell(offset uint32) ([]byte, error) {
+	buf, err := readAt(h.r, 4, regfBinsOffset+int64(offset))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read cell 0x%x", offset)
+	}
+	size := int32(binary.LittleEndian.Uint32(buf))
+	if size < 0 {
+		size = -size
+	}
+	if size < 8 || size > regfMaxCell {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "cell 0x%x size %d", offset, size)
+	}
+	return readAt(h.r, int(size)-4, regfBinsOffset+int64(offset)+4)
+}
+
+func regName(buf []byte, compressed bool) string {
+	if compressed {
+		// the compressed names are Latin-1
+		runes := make([]rune, len(buf))
+		for i, b := range buf {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return utf16String(buf)
+}
+
+func (h *sRegistryHive) keyName(key []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(key) < 0x4c || string(key[:2]) != "nk" {
+		return "", errors.Wrap(errors.ErrInvalidFormat, "key node")
+	}
+	nameLen := int(le.Uint16(key[0x48:]))
+	if 0x4c+nameLen > len(key) {
+		return "", errors.Wrap(errors.ErrInvalidFormat, "key name")
+	}
+	return regName(key[0x4c:0x4c+nameLen], le.Uint16(key[2:])&regKeyCompName != 0), nil
+}
+
+// subkeyOffsets lists the key nodes of a subkey list, the index roots
+// point to other lists
+func (h *sRegistryHive) subkeyOffsets(offset uint32, depth int) ([]uint32, error) {
+	if depth > 2 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "subkey list depth")
+	}
+	list, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint16(list[2:]))
+	stride := 8
+	switch string(list[:2]) {
+	case "lf", "lh":
+	case "li", "ri":
+		stride = 4
+	default:
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "subkey list 0x%x", offset)
+	}
+	if 4+count*stride > len(list) {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "subkey list 0x%x count", offset)
+	}
+	offsets := []uint32{}
+	for i := 0; i < count; i++ {
+		off := le.Uint32(list[4+i*stride:])
+		if string(list[:2]) != "ri" {
+			offsets = append(offsets, off)
+			continue
+		}
+		sub, err := h.subkeyOffsets(off, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, sub...)
+	}
+	return offsets, nil
+}
+
+// subkey finds a child key by its case-insensitive name
+func (h *sRegistryHive) subkey(offset uint32, name string) (uint32, error) {
+	key, err := h.cell(offset)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := h.keyName(key); err != nil {
+		return 0, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(key[0x14:]) == 0 {
+		return 0, errors.Wrap(errors.ErrNotFound, name)
+	}
+	offsets, err := h.subkeyOffsets(le.Uint32(key[0x1c:]), 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, off := range offsets {
+		sub, err := h.cell(off)
+		if err != nil {
+			return 0, err
+		}
+		subName, err := h.keyName(sub)
+		if err != nil {
+			return 0, err
+		}
+		if strings.EqualFold(subName, name) {
+			return off, nil
+		}
+	}
+	return 0, errors.Wrap(errors.ErrNotFound, name)
+}
+
+// lookupKey finds a key by its path separated by backslashes
+func (h *sRegistryHive) lookupKey(path string) (uint32, error) {
+	offset := h.root
+	for _, name := range strings.Split(path, `\`) {
+		if len(name) == 0 {
+			continue
+		}
+		var err error
+		if offset, err = h.subkey(offset, name); err != nil {
+			return 0, errors.Wrapf(err, "key %s", path)
+		}
+	}
+	return offset, nil
+}
+
+// value returns the type and the data of a value of a key
+func (h *sRegistryHive) value(keyOffset uint32, name string) (uint32, []byte, error) {
+	key, err := h.cell(keyOffset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := h.keyName(key); err != nil {
+		return 0, nil, err
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint32(key[0x24:]))
+	if count == 0 {
+		return 0, nil, errors.Wrap(errors.ErrNotFound, name)
+	}
+	list, err := h.cell(le.Uint32(key[0x28:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	if count*4 > len(list) {
+		return 0, nil, errors.Wrap(errors.ErrInvalidFormat, "value list")
+	}
+	for i := 0; i < count; i++ {
+		vk, err := h.cell(le.Uint32(list[i*4:]))
+		if err != nil {
+			return 0, nil, err
+		}
+		nameLen := int(le.Uint16(vk[2:]))
+		if len(vk) < 20+nameLen || string(vk[:2]) != "vk" {
+			return 0, nil, errors.Wrap(errors.ErrInvalidFormat, "value")
+		}
+		if !strings.EqualFold(regName(vk[20:20+nameLen], le.Uint16(vk[16:])&regValueCompName != 0), name) {
+			continue
+		}
+		typ := le.Uint32(vk[12:])
+		size := le.Uint32(vk[4:])
+		if size&regDataInline != 0 {
+			size &^= regDataInline
+			if size > 4 {
+				return 0, nil, errors.Wrapf(errors.ErrInvalidFormat, "value %s inline size", name)
+			}
+			return typ, vk[8 : 8+size], nil
+		}
+		data, err := h.cell(le.Uint32(vk[8:]))
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "value %s", name)
+		}
+		if int(size) > len(data) {
+			// the big data segments
+			return 0, nil, errors.Wrapf(errors.ErrNotSupported, "value %s size %d", name, size)
+		}
+		return typ, data[:size], nil
+	}
+	return 0, nil, errors.Wrap(errors.ErrNotFound, name)
+}
+
+func (h *sRegistryHive) stringValue(keyOffset uint32, name string) (string, error) {
+	typ, data, err := h.value(keyOffset, name)
+	if err != nil {
+		return "", err
+	}
+	if typ != regTypeSz && typ != regTypeExpandSz {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "value %s type %d", name, typ)
+	}
+	u := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+func (h *sRegistryHive) dwordValue(keyOffset uint32, name string) (uint32, error) {
+	typ, data, err := h.value(keyOffset, name)
+	if err != nil {
+		return 0, err
+	}
+	if typ != regTypeDword || len(data) < 4 {
+		return 0, errors.Wrapf(errors.ErrInvalidFormat, "value %s type %d", name, typ)
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
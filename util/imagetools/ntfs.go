@@ -0,0 +1,512 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * NTFS
+ * Reference: https://flatcap.github.io/linux-ntfs/ntfs/
+ *
+ */
+
+const (
+	ntfsMftRecord  = 0
+	ntfsRootRecord = 5
+
+	ntfsAttrAttributeList   = 0x20
+	ntfsAttrData            = 0x80
+	ntfsAttrIndexRoot       = 0x90
+	ntfsAttrIndexAllocation = 0xa0
+	ntfsAttrBitmap          = 0xb0
+	ntfsAttrReparsePoint    = 0xc0
+	ntfsAttrEnd             = 0xffffffff
+
+	ntfsAttrFlagCompressed = 0x1
+	ntfsAttrFlagEncrypted  = 0x4000
+
+	ntfsRecordFlagInUse = 0x1
+	ntfsRecordFlagDir   = 0x2
+
+	ntfsIndexEntryLast = 0x2
+
+	ntfsNamespaceDos = 2
+
+	ntfsFixupStride = 512
+	ntfsRefMask     = 1<<48 - 1
+	ntfsIndexName   = "$I30"
+)
+
+type sNtfsRun struct {
+	vcn    int64
+	length int64
+	// lcn is -1 for the sparse runs
+	lcn int64
+}
+
+type sNtfsAttr struct {
+	typ      uint32
+	name     string
+	flags    uint16
+	resident bool
+	data     []byte
+	dataSize int64
+	runs     []sNtfsRun
+}
+
+type sNtfs struct {
+	dev             io.ReaderAt
+	clusterSize     int64
+	mftRecordSize   int64
+	indexRecordSize int64
+	mft             io.ReaderAt
+}
+
+type sNtfsNode struct {
+	record uint64
+	flags  uint16
+	attrs  []*sNtfsAttr
+}
+
+func (n *sNtfsNode) attr(typ uint32, name string) *sNtfsAttr {
+	return findAttr(n.attrs, typ, name)
+}
+
+func (n *sNtfsNode) nodeType() tFsNodeType {
+	if n.flags&ntfsRecordFlagDir != 0 {
+		return fsNodeDir
+	}
+	if n.attr(ntfsAttrData, "") != nil {
+		return fsNodeFile
+	}
+	return fsNodeOther
+}
+
+func (n *sNtfsNode) size() int64 {
+	if attr := n.attr(ntfsAttrData, ""); attr != nil {
+		return attr.dataSize
+	}
+	return 0
+}
+
+// ntfsRecordSize decodes the clusters per record, the negative values are
+// the log2 of the bytes
+func ntfsRecordSize(v int8, clusterSize int64) int64 {
+	if v < 0 {
+		return int64(1) << uint(-v)
+	}
+	return int64(v) * clusterSize
+}
+
+func openNtfs(dev io.ReaderAt) (*sNtfs, error) {
+	boot, err := readAt(dev, 512, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "read boot sector")
+	}
+	if string(boot[3:11]) != "NTFS    " {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not ntfs")
+	}
+	le := binary.LittleEndian
+	sectorSize := int64(le.Uint16(boot[0x0b:]))
+	sectorsPerCluster := int64(boot[0x0d])
+	if sectorsPerCluster > 0x80 {
+		sectorsPerCluster = int64(1) << (256 - uint(sectorsPerCluster))
+	}
+	fs := &sNtfs{dev: dev, clusterSize: sectorSize * sectorsPerCluster}
+	fs.mftRecordSize = ntfsRecordSize(int8(boot[0x40]), fs.clusterSize)
+	fs.indexRecordSize = ntfsRecordSize(int8(boot[0x44]), fs.clusterSize)
+	if sectorSize < 256 || fs.clusterSize == 0 || fs.mftRecordSize < ntfsFixupStride || fs.mftRecordSize > 1<<16 ||
+		fs.indexRecordSize < ntfsFixupStride || fs.indexRecordSize > 1<<20 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "boot sector geometry")
+	}
+	// the first records of $MFT are read directly until its runs are known
+	mftStart := int64(le.Uint64(boot[0x30:])) * fs.clusterSize
+	fs.mft = io.NewSectionReader(dev, mftStart, 16*fs.mftRecordSize)
+	mft, err := fs.readNode(ntfsMftRecord)
+	if err != nil {
+		return nil, errors.Wrap(err, "read $MFT")
+	}
+	if fs.mft, err = fs.openAttr(mft, ntfsAttrData, ""); err != nil {
+		return nil, errors.Wrap(err, "open $MFT")
+	}
+	return fs, nil
+}
+
+// applyFixups checks and restores the last bytes of each sector of a
+// multi-sector record
+func applyFixups(buf []byte, magic string) error {
+	if string(buf[:4]) != magic {
+		return errors.Wrapf(errors.ErrInvalidFormat, "%s magic", magic)
+	}
+	le := binary.LittleEndian
+	usaOffset := int(le.Uint16(buf[4:]))
+	usaCount := int(le.Uint16(buf[6:]))
+	if usaCount == 0 || usaOffset+usaCount*2 > len(buf) || (usaCount-1)*ntfsFixupStride > len(buf) {
+		return errors.Wrapf(errors.ErrInvalidFormat, "%s update sequence", magic)
+	}
+	usn := buf[usaOffset : usaOffset+2]
+	for i := 1; i < usaCount; i++ {
+		pos := i*ntfsFixupStride - 2
+		if buf[pos] != usn[0] || buf[pos+1] != usn[1] {
+			return errors.Wrapf(errors.ErrInvalidFormat, "%s torn write", magic)
+		}
+		copy(buf[pos:pos+2], buf[usaOffset+i*2:usaOffset+i*2+2])
+	}
+	return nil
+}
+
+func (fs *sNtfs) readRecord(record uint64) ([]byte, error) {
+	buf := make([]byte, fs.mftRecordSize)
+	if _, err := fs.mft.ReadAt(buf, int64(record)*fs.mftRecordSize); err != nil {
+		return nil, errors.Wrapf(err, "read record %d", record)
+	}
+	if err := applyFixups(buf, "FILE"); err != nil {
+		return nil, errors.Wrapf(err, "record %d", record)
+	}
+	return buf, nil
+}
+
+func decodeRunlist(buf []byte, vcn int64) ([]sNtfsRun, error) {
+	runs := []sNtfsRun{}
+	lcn := int64(0)
+	for pos := 0; pos < len(buf) && buf[pos] != 0; {
+		lenBytes := int(buf[pos] & 0xf)
+		offBytes := int(buf[pos] >> 4)
+		pos++
+		if lenBytes == 0 || lenBytes > 8 || offBytes > 8 || pos+lenBytes+offBytes > len(buf) {
+			return nil, errors.Wrap(errors.ErrInvalidFormat, "runlist")
+		}
+		length := int64(0)
+		for i := lenBytes - 1; i >= 0; i-- {
+			length = length<<8 | int64(buf[pos+i])
+		}
+		pos += lenBytes
+		run := sNtfsRun{vcn: vcn, length: length, lcn: -1}
+		if offBytes > 0 {
+			delta := int64(int8(buf[pos+offBytes-1]))
+			for i := offBytes - 2; i >= 0; i-- {
+				delta = delta<<8 | int64(buf[pos+i])
+			}
+			lcn += delta
+			run.lcn = lcn
+		}
+		pos += offBytes
+		runs = append(runs, run)
+		vcn += length
+	}
+	return runs, nil
+}
+
+func utf16String(buf []byte) string {
+	u := make([]uint16, len(buf)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// parseAttrs parses the attributes of a record, the fragments of the
+// non-resident attributes have their starting VCN
+func parseAttrs(buf []byte) ([]*sNtfsAttr, []int64, error) {
+	le := binary.LittleEndian
+	attrs := []*sNtfsAttr{}
+	vcns := []int64{}
+	for pos := int(le.Uint16(buf[0x14:])); pos+16 <= len(buf); {
+		typ := le.Uint32(buf[pos:])
+		if typ == ntfsAttrEnd {
+			break
+		}
+		length := int(le.Uint32(buf[pos+4:]))
+		if length < 16 || pos+length > len(buf) {
+			return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "attribute length")
+		}
+		a := buf[pos : pos+length]
+		nameLen := int(a[9])
+		nameOff := int(le.Uint16(a[0x0a:]))
+		if nameOff+nameLen*2 > length {
+			return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "attribute name")
+		}
+		attr := &sNtfsAttr{
+			typ:      typ,
+			name:     utf16String(a[nameOff : nameOff+nameLen*2]),
+			flags:    le.Uint16(a[0x0c:]),
+			resident: a[8] == 0,
+		}
+		vcn := int64(0)
+		if attr.resident {
+			valueLen := int(le.Uint32(a[0x10:]))
+			valueOff := int(le.Uint16(a[0x14:]))
+			if valueOff+valueLen > length {
+				return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "resident attribute")
+			}
+			attr.data = a[valueOff : valueOff+valueLen]
+			attr.dataSize = int64(valueLen)
+		} else {
+			if length < 0x40 {
+				return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "non-resident attribute")
+			}
+			vcn = int64(le.Uint64(a[0x10:]))
+			runsOff := int(le.Uint16(a[0x20:]))
+			if runsOff > length {
+				return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "runlist offset")
+			}
+			runs, err := decodeRunlist(a[runsOff:], vcn)
+			if err != nil {
+				return nil, nil, err
+			}
+			attr.runs = runs
+			attr.dataSize = int64(le.Uint64(a[0x30:]))
+		}
+		attrs = append(attrs, attr)
+		vcns = append(vcns, vcn)
+		pos += length
+	}
+	return attrs, vcns, nil
+}
+
+func (fs *sNtfs) readNode(record uint64) (*sNtfsNode, error) {
+	buf, err := fs.readRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	node := &sNtfsNode{record: record, flags: le.Uint16(buf[0x16:])}
+	if node.flags&ntfsRecordFlagInUse == 0 {
+		return nil, errors.Wrapf(errors.ErrNotFound, "record %d not in use", record)
+	}
+	attrs, vcns, err := parseAttrs(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "record %d", record)
+	}
+	if list := findAttr(attrs, ntfsAttrAttributeList, ""); list != nil {
+		if attrs, vcns, err = fs.readAttrList(record, list, attrs, vcns); err != nil {
+			return nil, errors.Wrapf(err, "record %d attribute list", record)
+		}
+	}
+	node.attrs = mergeAttrs(attrs, vcns)
+	return node, nil
+}
+
+func findAttr(attrs []*sNtfsAttr, typ uint32, name string) *sNtfsAttr {
+	for _, attr := range attrs {
+		if attr.typ == typ && attr.name == name {
+			return attr
+		}
+	}
+	return nil
+}
+
+// readAttrList adds the attributes in the extension records
+func (fs *sNtfs) readAttrList(record uint64, list *sNtfsAttr, attrs []*sNtfsAttr, vcns []int64) ([]*sNtfsAttr, []int64, error) {
+	data := list.data
+	if !list.resident {
+		r, err := fs.attrReader(list)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = make([]byte, list.dataSize)
+		if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+	}
+	le := binary.LittleEndian
+	read := map[uint64]bool{record: true}
+	for pos := 0; pos+0x1a <= len(data); {
+		length := int(le.Uint16(data[pos+4:]))
+		if length < 0x1a {
+			return nil, nil, errors.Wrap(errors.ErrInvalidFormat, "attribute list entry")
+		}
+		ext := le.Uint64(data[pos+0x10:]) & ntfsRefMask
+		pos += length
+		if read[ext] {
+			continue
+		}
+		read[ext] = true
+		buf, err := fs.readRecord(ext)
+		if err != nil {
+			return nil, nil, err
+		}
+		extAttrs, extVcns, err := parseAttrs(buf)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "record %d", ext)
+		}
+		attrs, vcns = append(attrs, extAttrs...), append(vcns, extVcns...)
+	}
+	return attrs, vcns, nil
+}
+
+// mergeAttrs joins the runs of the fragments of the non-resident attributes
+func mergeAttrs(attrs []*sNtfsAttr, vcns []int64) []*sNtfsAttr {
+	merged := []*sNtfsAttr{}
+	firsts := map[*sNtfsAttr]bool{}
+	for i, attr := range attrs {
+		first := findAttr(merged, attr.typ, attr.name)
+		if first == nil {
+			merged = append(merged, attr)
+			firsts[attr] = vcns[i] == 0
+			continue
+		}
+		if attr.resident || first.resident {
+			continue
+		}
+		first.runs = append(first.runs, attr.runs...)
+		if vcns[i] == 0 && !firsts[first] {
+			first.dataSize, first.flags = attr.dataSize, attr.flags
+			firsts[first] = true
+		}
+	}
+	for _, attr := range merged {
+		runs := attr.runs
+		sort.Slice(runs, func(i, j int) bool { return runs[i].vcn < runs[j].vcn })
+	}
+	return merged
+}
+
+func (fs *sNtfs) attrReader(attr *sNtfsAttr) (io.ReaderAt, error) {
+	if attr.flags&(ntfsAttrFlagCompressed|ntfsAttrFlagEncrypted) != 0 {
+		return nil, errors.Wrap(errors.ErrNotSupported, "compressed or encrypted attribute")
+	}
+	if attr.resident {
+		return &sBytesReader{data: attr.data}, nil
+	}
+	runs := attr.runs
+	mapper := func(vcn int64) (int64, error) {
+		i := sort.Search(len(runs), func(i int) bool { return runs[i].vcn+runs[i].length > vcn })
+		if i == len(runs) || runs[i].vcn > vcn || runs[i].lcn < 0 {
+			return -1, nil
+		}
+		return (runs[i].lcn + vcn - runs[i].vcn) * fs.clusterSize, nil
+	}
+	return &sBlockReader{dev: fs.dev, blockSize: fs.clusterSize, fileSize: attr.dataSize, mapBlock: mapper}, nil
+}
+
+func (fs *sNtfs) openAttr(node *sNtfsNode, typ uint32, name string) (io.ReaderAt, error) {
+	attr := node.attr(typ, name)
+	if attr == nil {
+		return nil, errors.Wrapf(errors.ErrNotFound, "record %d attribute 0x%x %q", node.record, typ, name)
+	}
+	return fs.attrReader(attr)
+}
+
+func (fs *sNtfs) root() (iFsNode, error) {
+	return fs.readNode(ntfsRootRecord)
+}
+
+func (fs *sNtfs) open(node iFsNode) (io.ReaderAt, error) {
+	n := node.(*sNtfsNode)
+	if n.attr(ntfsAttrReparsePoint, "") != nil {
+		// the files compressed by WOF and the reparsed files have no
+		// readable data
+		return nil, errors.Wrapf(errors.ErrNotSupported, "record %d is a reparse point", n.record)
+	}
+	return fs.openAttr(n, ntfsAttrData, "")
+}
+
+func (fs *sNtfs) readlink(node iFsNode) (string, error) {
+	return "", errors.Wrap(errors.ErrNotSupported, "ntfs readlink")
+}
+
+// lookupEntries matches the file names of the index entries in a node,
+// the DOS names are skipped as the long names are always present
+func lookupEntries(node []byte, name string) (uint64, bool, error) {
+	le := binary.LittleEndian
+	if len(node) < 16 {
+		return 0, false, errors.Wrap(errors.ErrInvalidFormat, "index node")
+	}
+	start := int(le.Uint32(node[0:]))
+	end := int(le.Uint32(node[4:]))
+	if end > len(node) {
+		end = len(node)
+	}
+	for pos := start; pos+16 <= end; {
+		length := int(le.Uint16(node[pos+8:]))
+		keyLen := int(le.Uint16(node[pos+10:]))
+		flags := le.Uint16(node[pos+12:])
+		if flags&ntfsIndexEntryLast != 0 {
+			break
+		}
+		if length < 16 || pos+length > end || keyLen < 0x42 || 16+keyLen > length {
+			return 0, false, errors.Wrap(errors.ErrInvalidFormat, "index entry")
+		}
+		key := node[pos+16 : pos+16+keyLen]
+		nameLen := int(key[0x40])
+		if key[0x41] != ntfsNamespaceDos && 0x42+nameLen*2 <= keyLen && strings.EqualFold(utf16String(key[0x42:0x42+nameLen*2]), name) {
+			return le.Uint64(node[pos:]) & ntfsRefMask, true, nil
+		}
+		pos += length
+	}
+	return 0, false, nil
+}
+
+// lookup scans the index root and every index record in use instead of
+// walking down the B+ tree, the NTFS collation of upper case names is not
+// needed then
+func (fs *sNtfs) lookup(dir iFsNode, name string) (iFsNode, error) {
+	n := dir.(*sNtfsNode)
+	root := n.attr(ntfsAttrIndexRoot, ntfsIndexName)
+	if root == nil || !root.resident || len(root.data) < 16 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "record %d index root", n.record)
+	}
+	if ref, ok, err := lookupEntries(root.data[16:], name); err != nil {
+		return nil, errors.Wrapf(err, "record %d index root", n.record)
+	} else if ok {
+		return fs.readNode(ref)
+	}
+	alloc := n.attr(ntfsAttrIndexAllocation, ntfsIndexName)
+	if alloc == nil {
+		return nil, errors.Wrap(errors.ErrNotFound, name)
+	}
+	r, err := fs.attrReader(alloc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "record %d index allocation", n.record)
+	}
+	var bitmap []byte
+	if attr := n.attr(ntfsAttrBitmap, ntfsIndexName); attr != nil {
+		br, err := fs.attrReader(attr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "record %d index bitmap", n.record)
+		}
+		bitmap = make([]byte, attr.dataSize)
+		if _, err := br.ReadAt(bitmap, 0); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "record %d index bitmap", n.record)
+		}
+	}
+	buf := make([]byte, fs.indexRecordSize)
+	for i := int64(0); (i+1)*fs.indexRecordSize <= alloc.dataSize; i++ {
+		if bitmap != nil && (i/8 >= int64(len(bitmap)) || bitmap[i/8]&(1<<uint(i%8)) == 0) {
+			continue
+		}
+		if _, err := r.ReadAt(buf, i*fs.indexRecordSize); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "record %d index record %d", n.record, i)
+		}
+		if err := applyFixups(buf, "INDX"); err != nil {
+			return nil, errors.Wrapf(err, "record %d index record %d", n.record, i)
+		}
+		if ref, ok, err := lookupEntries(buf[0x18:], name); err != nil {
+			return nil, errors.Wrapf(err, "record %d index record %d", n.record, i)
+		} else if ok {
+			return fs.readNode(ref)
+		}
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, name)
+}
@@ -0,0 +1,381 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+func utf16Bytes(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	buf := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(buf[i*2:], c)
+	}
+	return buf
+}
+
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+func ntfsResidentAttr(typ uint32, name string, value []byte) []byte {
+	le := binary.LittleEndian
+	valueOff := align8(0x18 + len(name)*2)
+	attr := make([]byte, align8(valueOff+len(value)))
+	le.PutUint32(attr[0:], typ)
+	le.PutUint32(attr[4:], uint32(len(attr)))
+	attr[9] = byte(len(name))
+	le.PutUint16(attr[0x0a:], 0x18)
+	copy(attr[0x18:], utf16Bytes(name))
+	le.PutUint32(attr[0x10:], uint32(len(value)))
+	le.PutUint16(attr[0x14:], uint16(valueOff))
+	copy(attr[valueOff:], value)
+	return attr
+}
+
+// ntfsNonResidentAttr is an attribute of a single run
+func ntfsNonResidentAttr(typ uint32, name string, lcn, clusters, size, clusterSize int64) []byte {
+	le := binary.LittleEndian
+	runsOff := align8(0x40 + len(name)*2)
+	attr := make([]byte, align8(runsOff+8))
+	le.PutUint32(attr[0:], typ)
+	le.PutUint32(attr[4:], uint32(len(attr)))
+	attr[8] = 1
+	attr[9] = byte(len(name))
+	le.PutUint16(attr[0x0a:], 0x40)
+	copy(attr[0x40:], utf16Bytes(name))
+	le.PutUint64(attr[0x18:], uint64(clusters-1))
+	le.PutUint16(attr[0x20:], uint16(runsOff))
+	le.PutUint64(attr[0x28:], uint64(clusters*clusterSize))
+	le.PutUint64(attr[0x30:], uint64(size))
+	le.PutUint64(attr[0x38:], uint64(size))
+	// 2 bytes of length and 4 bytes of LCN
+	attr[runsOff] = 0x42
+	le.PutUint16(attr[runsOff+1:], uint16(clusters))
+	le.PutUint32(attr[runsOff+3:], uint32(lcn))
+	return attr
+}
+
+func ntfsIndexEntry(ref uint64, name string) []byte {
+	le := binary.LittleEndian
+	keyLen := 0x42 + len(name)*2
+	entry := make([]byte, align8(16+keyLen))
+	le.PutUint64(entry[0:], ref)
+	le.PutUint16(entry[8:], uint16(len(entry)))
+	le.PutUint16(entry[10:], uint16(keyLen))
+	entry[16+0x40] = byte(len(name))
+	entry[16+0x41] = 1
+	copy(entry[16+0x42:], utf16Bytes(name))
+	return entry
+}
+
+// ntfsIndexNode returns the node header and the entries ending with the
+// last entry, the entries start at the offset from the header
+func ntfsIndexNode(entries []byte, subnode bool, offset int) []byte {
+	le := binary.LittleEndian
+	last := make([]byte, 16)
+	le.PutUint16(last[8:], 16)
+	le.PutUint16(last[12:], ntfsIndexEntryLast)
+	if subnode {
+		last = append(last, make([]byte, 8)...)
+		le.PutUint16(last[8:], 24)
+		le.PutUint16(last[12:], ntfsIndexEntryLast|1)
+	}
+	node := make([]byte, offset)
+	entries = append(append([]byte{}, entries...), last...)
+	le.PutUint32(node[0:], uint32(offset))
+	le.PutUint32(node[4:], uint32(offset+len(entries)))
+	le.PutUint32(node[8:], uint32(offset+len(entries)))
+	if subnode {
+		node[12] = 1
+	}
+	return append(node, entries...)
+}
+
+func ntfsFixup(buf []byte, usaOffset int) {
+	le := binary.LittleEndian
+	count := len(buf)/ntfsFixupStride + 1
+	le.PutUint16(buf[4:], uint16(usaOffset))
+	le.PutUint16(buf[6:], uint16(count))
+	le.PutUint16(buf[usaOffset:], 0x55aa)
+	for i := 1; i < count; i++ {
+		copy(buf[usaOffset+i*2:], buf[i*ntfsFixupStride-2:i*ntfsFixupStride])
+		le.PutUint16(buf[i*ntfsFixupStride-2:], 0x55aa)
+	}
+}
+
+// buildTestNtfs builds an NTFS of 4K clusters and 1K records, the small
+// files are resident and the directories of more than 3 entries have an
+// index record
+func buildTestNtfs(entries []sTestFsEntry) []byte {
+	const (
+		clusterSize = 4096
+		clusters    = 512
+		recordSize  = 1024
+		records     = 64
+		mftLcn      = 4
+	)
+	img := make([]byte, clusters*clusterSize)
+	le := binary.LittleEndian
+	copy(img[3:], "NTFS    ")
+	le.PutUint16(img[0x0b:], 512)
+	img[0x0d] = clusterSize / 512
+	le.PutUint64(img[0x30:], mftLcn)
+	img[0x40] = 0xf6 // -10, 1K
+	img[0x44] = 1
+
+	nextLcn := int64(mftLcn + records*recordSize/clusterSize)
+	putData := func(data []byte) (int64, int64) {
+		lcn := nextLcn
+		n := int64(len(data)+clusterSize-1) / clusterSize
+		copy(img[lcn*clusterSize:], data)
+		nextLcn += n
+		return lcn, n
+	}
+	writeRecord := func(record uint64, flags uint16, attrs ...[]byte) {
+		buf := img[mftLcn*clusterSize+record*recordSize : mftLcn*clusterSize+(record+1)*recordSize]
+		copy(buf, "FILE")
+		le.PutUint16(buf[0x14:], 0x38)
+		le.PutUint16(buf[0x16:], flags)
+		pos := 0x38
+		for _, attr := range attrs {
+			copy(buf[pos:], attr)
+			pos += len(attr)
+		}
+		le.PutUint32(buf[pos:], ntfsAttrEnd)
+		ntfsFixup(buf, 0x30)
+	}
+	writeRecord(ntfsMftRecord, ntfsRecordFlagInUse,
+		ntfsNonResidentAttr(ntfsAttrData, "", mftLcn, records*recordSize/clusterSize, records*recordSize, clusterSize))
+
+	root := newTestFsTree(entries)
+	nextRecord := uint64(16)
+	root.walk(func(n *sTestFsNode) {
+		if n == root {
+			n.ino = ntfsRootRecord
+		} else {
+			n.ino, nextRecord = nextRecord, nextRecord+1
+		}
+	})
+	var write func(n *sTestFsNode)
+	write = func(n *sTestFsNode) {
+		if !n.isDir {
+			if len(n.data) <= 512 {
+				writeRecord(n.ino, ntfsRecordFlagInUse, ntfsResidentAttr(ntfsAttrData, "", n.data))
+			} else {
+				lcn, count := putData(n.data)
+				writeRecord(n.ino, ntfsRecordFlagInUse, ntfsNonResidentAttr(ntfsAttrData, "", lcn, count, int64(len(n.data)), clusterSize))
+			}
+			return
+		}
+		indexEntries := []byte{}
+		for _, c := range n.children {
+			// the sequence number is in the high bits of the reference
+			indexEntries = append(indexEntries, ntfsIndexEntry(1<<48|c.ino, c.name)...)
+		}
+		indexHeader := make([]byte, 16)
+		le.PutUint32(indexHeader[0:], 0x30)
+		le.PutUint32(indexHeader[8:], clusterSize)
+		flags := uint16(ntfsRecordFlagInUse | ntfsRecordFlagDir)
+		if len(n.children) <= 3 {
+			writeRecord(n.ino, flags, ntfsResidentAttr(ntfsAttrIndexRoot, ntfsIndexName, append(indexHeader, ntfsIndexNode(indexEntries, false, 16)...)))
+		} else {
+			indx := make([]byte, clusterSize)
+			copy(indx, "INDX")
+			copy(indx[0x18:], ntfsIndexNode(indexEntries, false, 0x28))
+			ntfsFixup(indx, 0x28)
+			lcn, count := putData(indx)
+			writeRecord(n.ino, flags,
+				ntfsResidentAttr(ntfsAttrIndexRoot, ntfsIndexName, append(indexHeader, ntfsIndexNode(nil, true, 16)...)),
+				ntfsNonResidentAttr(ntfsAttrIndexAllocation, ntfsIndexName, lcn, count, clusterSize, clusterSize),
+				ntfsResidentAttr(ntfsAttrBitmap, ntfsIndexName, []byte{1, 0, 0, 0, 0, 0, 0, 0}))
+		}
+		for _, c := range n.children {
+			write(c)
+		}
+	}
+	write(root)
+	return img
+}
+
+type sTestRegValue struct {
+	name string
+	typ  uint32
+	data []byte
+}
+
+type sTestRegKey struct {
+	name    string
+	values  []sTestRegValue
+	subkeys []*sTestRegKey
+}
+
+func regSzValue(name, value string) sTestRegValue {
+	return sTestRegValue{name: name, typ: regTypeSz, data: append(utf16Bytes(value), 0, 0)}
+}
+
+func regDwordValue(name string, value uint32) sTestRegValue {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, value)
+	return sTestRegValue{name: name, typ: regTypeDword, data: data}
+}
+
+// buildTestHive builds a hive of a single bin, the names are ASCII
+func buildTestHive(root *sTestRegKey) []byte {
+	le := binary.LittleEndian
+	bins := make([]byte, 0x20)
+	copy(bins, "hbin")
+	alloc := func(data []byte) uint32 {
+		offset := uint32(len(bins))
+		cell := make([]byte, align8(4+len(data)))
+		le.PutUint32(cell, uint32(-int32(len(cell))))
+		copy(cell[4:], data)
+		bins = append(bins, cell...)
+		return offset
+	}
+	var writeKey func(k *sTestRegKey) uint32
+	writeKey = func(k *sTestRegKey) uint32 {
+		nk := make([]byte, 0x4c+len(k.name))
+		copy(nk, "nk")
+		le.PutUint16(nk[2:], regKeyCompName)
+		copy(nk[0x4c:], k.name)
+		le.PutUint16(nk[0x48:], uint16(len(k.name)))
+		if len(k.subkeys) > 0 {
+			list := make([]byte, 4+len(k.subkeys)*8)
+			copy(list, "lf")
+			le.PutUint16(list[2:], uint16(len(k.subkeys)))
+			for i, sub := range k.subkeys {
+				le.PutUint32(list[4+i*8:], writeKey(sub))
+			}
+			le.PutUint32(nk[0x14:], uint32(len(k.subkeys)))
+			le.PutUint32(nk[0x1c:], alloc(list))
+		}
+		if len(k.values) > 0 {
+			list := make([]byte, len(k.values)*4)
+			for i, v := range k.values {
+				vk := make([]byte, 20+len(v.name))
+				copy(vk, "vk")
+				le.PutUint16(vk[2:], uint16(len(v.name)))
+				if len(v.data) <= 4 {
+					le.PutUint32(vk[4:], uint32(len(v.data))|regDataInline)
+					copy(vk[8:], v.data)
+				} else {
+					le.PutUint32(vk[4:], uint32(len(v.data)))
+					le.PutUint32(vk[8:], alloc(v.data))
+				}
+				le.PutUint32(vk[12:], v.typ)
+				le.PutUint16(vk[16:], regValueCompName)
+				copy(vk[20:], v.name)
+				le.PutUint32(list[i*4:], alloc(vk))
+			}
+			le.PutUint32(nk[0x24:], uint32(len(k.values)))
+			le.PutUint32(nk[0x28:], alloc(list))
+		}
+		return alloc(nk)
+	}
+	rootOffset := writeKey(root)
+	base := make([]byte, regfBinsOffset)
+	copy(base, "regf")
+	le.PutUint32(base[0x24:], rootOffset)
+	return append(base, bins...)
+}
+
+func testWindowsEntries(product, installType, build string, lang string) []sTestFsEntry {
+	software := buildTestHive(&sTestRegKey{name: "ROOT", subkeys: []*sTestRegKey{{
+		name: "Microsoft",
+		subkeys: []*sTestRegKey{{name: "Windows"}, {
+			name: "Windows NT",
+			subkeys: []*sTestRegKey{{name: "CurrentVersion", values: []sTestRegValue{
+				regSzValue("ProductName", product),
+				regSzValue("InstallationType", installType),
+				regSzValue("CurrentBuildNumber", build),
+				regDwordValue("CurrentMajorVersionNumber", 10),
+				regDwordValue("CurrentMinorVersionNumber", 0),
+			}}},
+		}},
+	}}})
+	system := buildTestHive(&sTestRegKey{name: "ROOT", subkeys: []*sTestRegKey{
+		{name: "ControlSet001", subkeys: []*sTestRegKey{{name: "Control", subkeys: []*sTestRegKey{{name: "Nls", subkeys: []*sTestRegKey{
+			{name: "Language", values: []sTestRegValue{regSzValue("InstallLanguage", lang)}},
+		}}}}}},
+		{name: "Select", values: []sTestRegValue{regDwordValue("Current", 1)}},
+	}})
+	pe := make([]byte, 0x100)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x80)
+	copy(pe[0x80:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(pe[0x84:], 0x8664)
+	return []sTestFsEntry{
+		{path: "/Windows/System32/config/SOFTWARE", data: string(software)},
+		{path: "/Windows/System32/config/SYSTEM", data: string(system)},
+		{path: "/Windows/System32/ntoskrnl.exe", data: string(pe)},
+		{path: "/Windows/System32/cmd.exe", data: string(pe)},
+		{path: "/Windows/System32/drivers/etc/hosts", data: "127.0.0.1 localhost\r\n"},
+		{path: "/Windows/explorer.exe", data: string(pe)},
+	}
+}
+
+func TestNtfs(t *testing.T) {
+	entries := testWindowsEntries("Windows 10 Pro", "Client", "19045", "0409")
+	part := bytes.NewReader(buildTestNtfs(entries))
+	if got := ProbeFilesystem(part); got != FS_NTFS {
+		t.Fatalf("ProbeFilesystem = %q", got)
+	}
+	fs, err := openFilesystem(part, FS_NTFS)
+	if err != nil {
+		t.Fatalf("openFilesystem: %v", err)
+	}
+	for path, want := range map[string]string{
+		"/windows/system32/drivers/etc/HOSTS": entries[4].data,
+		"/Windows/System32/config/SYSTEM":     entries[1].data,
+	} {
+		got, err := readFile(fs, path, 1<<20)
+		if err != nil {
+			t.Errorf("readFile %s: %v", path, err)
+		} else if string(got) != want {
+			t.Errorf("readFile %s mismatch", path)
+		}
+	}
+	if _, err := readFile(fs, "/Windows/System32/missing.exe", 10); err == nil {
+		t.Errorf("readFile missing file succeeded")
+	}
+}
+
+func TestRegistryHive(t *testing.T) {
+	hive, err := openRegistryHive(bytes.NewReader([]byte(testWindowsEntries("Windows Server 2019 Datacenter", "Server", "17763", "0804")[0].data)))
+	if err != nil {
+		t.Fatalf("openRegistryHive: %v", err)
+	}
+	key, err := hive.lookupKey(`microsoft\WINDOWS NT\CurrentVersion`)
+	if err != nil {
+		t.Fatalf("lookupKey: %v", err)
+	}
+	if got, err := hive.stringValue(key, "productname"); err != nil || got != "Windows Server 2019 Datacenter" {
+		t.Errorf("ProductName = %q, %v", got, err)
+	}
+	if got, err := hive.dwordValue(key, "CurrentMajorVersionNumber"); err != nil || got != 10 {
+		t.Errorf("CurrentMajorVersionNumber = %d, %v", got, err)
+	}
+	if _, err := hive.stringValue(key, "CurrentMajorVersionNumber"); err == nil {
+		t.Errorf("stringValue of a DWORD succeeded")
+	}
+	if _, err := hive.lookupKey(`Microsoft\Missing`); err == nil {
+		t.Errorf("lookupKey missing key succeeded")
+	}
+}
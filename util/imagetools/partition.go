@@ -0,0 +1,227 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	PARTITION_TABLE_NONE = "none"
+	PARTITION_TABLE_MBR  = "mbr"
+	PARTITION_TABLE_GPT  = "gpt"
+
+	GPT_TYPE_ESP         = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	GPT_TYPE_BIOS_BOOT   = "21686148-6449-6E6F-744E-656564454649"
+	GPT_TYPE_LINUX_LVM   = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+	GPT_TYPE_BASIC_DATA  = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	GPT_TYPE_MS_RESERVED = "E3C9E316-0B5C-4DB8-817D-F92DF00215AE"
+
+	MBR_TYPE_EXTENDED     = 0x05
+	MBR_TYPE_EXTENDED_LBA = 0x0f
+	MBR_TYPE_EXTENDED_LNX = 0x85
+	MBR_TYPE_GPT          = 0xee
+	MBR_TYPE_ESP          = 0xef
+
+	sectorSize = 512
+	// the logical partitions of a corrupted EBR chain are bounded
+	maxLogicalPartitions = 128
+)
+
+// SPartition is a partition of a disk, Start and Size are in bytes
+type SPartition struct {
+	Index int
+	Start int64
+	Size  int64
+	// Type is the MBR type, e.g. 0x83, or the GPT type GUID
+	Type string
+	Name string
+}
+
+func (p SPartition) IsESP() bool {
+	return p.Type == GPT_TYPE_ESP || p.Type == mbrType(MBR_TYPE_ESP)
+}
+
+func (p SPartition) IsBiosBoot() bool {
+	return p.Type == GPT_TYPE_BIOS_BOOT
+}
+
+func mbrType(t byte) string {
+	return fmt.Sprintf("0x%02x", t)
+}
+
+func readAt(r io.ReaderAt, size int, offset int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, offset)
+	if n == size {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// ReadPartitions reads the MBR or GPT partition table of a disk, a disk
+// without partition table is a single partition of the whole disk
+func ReadPartitions(disk io.ReaderAt, size int64) (string, []SPartition, error) {
+	mbr, err := readAt(disk, sectorSize, 0)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "read MBR")
+	}
+	for _, ss := range []int64{512, 4096} {
+		hdr, err := readAt(disk, 92, ss)
+		if err == nil && string(hdr[:8]) == "EFI PART" {
+			parts, err := readGPT(disk, hdr, ss)
+			if err != nil {
+				return "", nil, errors.Wrap(err, "read GPT")
+			}
+			return PARTITION_TABLE_GPT, parts, nil
+		}
+	}
+	if mbr[510] == 0x55 && mbr[511] == 0xaa && isMBRPartitionTable(mbr) {
+		parts, err := readMBR(disk, mbr)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "read MBR")
+		}
+		return PARTITION_TABLE_MBR, parts, nil
+	}
+	return PARTITION_TABLE_NONE, []SPartition{{Index: 0, Start: 0, Size: size}}, nil
+}
+
+// isMBRPartitionTable tells MBR from the boot sector of a filesystem, e.g.
+// FAT and NTFS, which have the same signature
+func isMBRPartitionTable(mbr []byte) bool {
+	if string(mbr[3:11]) == "NTFS    " || string(mbr[82:87]) == "FAT32" || string(mbr[54:59]) == "FAT16" || string(mbr[54:59]) == "FAT12" {
+		return false
+	}
+	found := false
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		if entry[0] != 0 && entry[0] != 0x80 {
+			return false
+		}
+		if entry[4] != 0 {
+			found = true
+		}
+	}
+	return found
+}
+
+func readMBR(disk io.ReaderAt, mbr []byte) ([]SPartition, error) {
+	parts := []SPartition{}
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		ptype := entry[4]
+		start := int64(binary.LittleEndian.Uint32(entry[8:])) * sectorSize
+		length := int64(binary.LittleEndian.Uint32(entry[12:])) * sectorSize
+		if ptype == 0 || length == 0 {
+			continue
+		}
+		switch ptype {
+		case MBR_TYPE_EXTENDED, MBR_TYPE_EXTENDED_LBA, MBR_TYPE_EXTENDED_LNX:
+			logical, err := readEBR(disk, start)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read extended partition %d", i+1)
+			}
+			parts = append(parts, logical...)
+		default:
+			parts = append(parts, SPartition{Index: i + 1, Start: start, Size: length, Type: mbrType(ptype)})
+		}
+	}
+	return parts, nil
+}
+
+// readEBR follows the chain of extended boot records, the logical
+// partitions are numbered from 5
+func readEBR(disk io.ReaderAt, extStart int64) ([]SPartition, error) {
+	parts := []SPartition{}
+	ebrStart := extStart
+	for i := 0; i < maxLogicalPartitions; i++ {
+		ebr, err := readAt(disk, sectorSize, ebrStart)
+		if err != nil {
+			return nil, err
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "EBR signature at %d", ebrStart)
+		}
+		entry := ebr[446:462]
+		if length := int64(binary.LittleEndian.Uint32(entry[12:])) * sectorSize; entry[4] != 0 && length > 0 {
+			parts = append(parts, SPartition{
+				Index: 5 + i,
+				Start: ebrStart + int64(binary.LittleEndian.Uint32(entry[8:]))*sectorSize,
+				Size:  length,
+				Type:  mbrType(entry[4]),
+			})
+		}
+		next := ebr[462:478]
+		if next[4] == 0 {
+			return parts, nil
+		}
+		ebrStart = extStart + int64(binary.LittleEndian.Uint32(next[8:]))*sectorSize
+	}
+	return parts, nil
+}
+
+// guidString formats a GUID of mixed endian as in GPT
+func guidString(b []byte) string {
+	return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16]))
+}
+
+func readGPT(disk io.ReaderAt, hdr []byte, ss int64) ([]SPartition, error) {
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	count := int(binary.LittleEndian.Uint32(hdr[80:]))
+	entrySize := int(binary.LittleEndian.Uint32(hdr[84:]))
+	if entrySize < 128 || count > 1024 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "%d entries of size %d", count, entrySize)
+	}
+	entries, err := readAt(disk, count*entrySize, entriesLBA*ss)
+	if err != nil {
+		return nil, err
+	}
+	parts := []SPartition{}
+	for i := 0; i < count; i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		ptype := guidString(entry[0:16])
+		if ptype == "00000000-0000-0000-0000-000000000000" {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(entry[32:]))
+		last := int64(binary.LittleEndian.Uint64(entry[40:]))
+		codes := make([]uint16, 0, 36)
+		for j := 56; j+1 < 128; j += 2 {
+			c := binary.LittleEndian.Uint16(entry[j:])
+			if c == 0 {
+				break
+			}
+			codes = append(codes, c)
+		}
+		parts = append(parts, SPartition{
+			Index: i + 1,
+			Start: first * ss,
+			Size:  (last - first + 1) * ss,
+			Type:  ptype,
+			Name:  string(utf16.Decode(codes)),
+		})
+	}
+	return parts, nil
+}
@@ -0,0 +1,455 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetools
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * XFS
+ * Reference: https://mirrors.edge.kernel.org/pub/linux/utils/fs/xfs/docs/xfs_filesystem_structure.pdf
+ *
+ */
+
+const (
+	xfsDinodeFmtLocal   = 1
+	xfsDinodeFmtExtents = 2
+	xfsDinodeFmtBtree   = 3
+
+	xfsSbVersion5          = 5
+	xfsSbFeatures2Ftype    = 0x200
+	xfsSbIncompatFtype     = 0x1
+	xfsDinodeV3CoreSize    = 176
+	xfsDinodeCoreSize      = 100
+	xfsBmbtBlockHeader     = 24
+	xfsBmbtBlockV5Header   = 72
+	xfsDirDataHeader       = 16
+	xfsDirDataV5Header     = 64
+	xfsSymlinkV5Header     = 56
+	xfsDirLeafOffset       = int64(1) << 35
+	xfsMaxBtreeDepth       = 9
+	xfsDirDataFreeTag      = 0xffff
+	xfsDirBlockTailSize    = 8
+	xfsDirLeafEntrySize    = 8
+	xfsExtentRecordSize    = 16
+	xfsBmbtKeyOrPtrSize    = 8
+	xfsBmdrBlockHeaderSize = 4
+)
+
+type sXfs struct {
+	dev          io.ReaderAt
+	blockSize    int64
+	dirBlockSize int64
+	inodeSize    int64
+	rootIno      uint64
+	agBlocks     int64
+	agBlkLog     uint
+	inoPBlkLog   uint
+	v5           bool
+	ftype        bool
+}
+
+type sXfsExtent struct {
+	offset int64
+	block  int64
+	count  int64
+	// unwritten extents read as zeros
+	unwritten bool
+}
+
+type sXfsInode struct {
+	ino    uint64
+	mode   uint16
+	format uint8
+	fsize  int64
+	// fork is the data fork in the inode
+	fork []byte
+}
+
+func (i *sXfsInode) nodeType() tFsNodeType {
+	switch i.mode & extModeTypeMask {
+	case extModeDir:
+		return fsNodeDir
+	case extModeFile:
+		return fsNodeFile
+	case extModeSymlink:
+		return fsNodeSymlink
+	}
+	return fsNodeOther
+}
+
+func (i *sXfsInode) size() int64 {
+	return i.fsize
+}
+
+func openXfs(dev io.ReaderAt) (*sXfs, error) {
+	sb, err := readAt(dev, 512, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "read superblock")
+	}
+	if string(sb[:4]) != "XFSB" {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not xfs")
+	}
+	be := binary.BigEndian
+	fs := &sXfs{
+		dev:        dev,
+		blockSize:  int64(be.Uint32(sb[4:])),
+		rootIno:    be.Uint64(sb[56:]),
+		agBlocks:   int64(be.Uint32(sb[84:])),
+		inodeSize:  int64(be.Uint16(sb[104:])),
+		inoPBlkLog: uint(sb[123]),
+		agBlkLog:   uint(sb[124]),
+		v5:         be.Uint16(sb[100:])&0xf == xfsSbVersion5,
+	}
+	fs.dirBlockSize = fs.blockSize << sb[192]
+	if fs.v5 {
+		fs.ftype = be.Uint32(sb[216:])&xfsSbIncompatFtype != 0
+	} else {
+		fs.ftype = be.Uint32(sb[200:])&xfsSbFeatures2Ftype != 0
+	}
+	if fs.blockSize < 512 || fs.inodeSize < 256 && fs.v5 || fs.inodeSize < xfsDinodeCoreSize || fs.agBlocks == 0 || fs.agBlkLog > 31 || fs.inoPBlkLog > 16 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "superblock geometry")
+	}
+	return fs, nil
+}
+
+// fsbOffset returns the device offset of a filesystem block, whose number
+// is the allocation group number and the block number in the group
+func (fs *sXfs) fsbOffset(fsb int64) int64 {
+	agno := fsb >> fs.agBlkLog
+	agbno := fsb & (int64(1)<<fs.agBlkLog - 1)
+	return (agno*fs.agBlocks + agbno) * fs.blockSize
+}
+
+func (fs *sXfs) readInode(ino uint64) (*sXfsInode, error) {
+	agino := ino & (uint64(1)<<(fs.agBlkLog+fs.inoPBlkLog) - 1)
+	agno := int64(ino >> (fs.agBlkLog + fs.inoPBlkLog))
+	agbno := int64(agino >> fs.inoPBlkLog)
+	index := int64(agino & (uint64(1)<<fs.inoPBlkLog - 1))
+	offset := (agno*fs.agBlocks+agbno)*fs.blockSize + index*fs.inodeSize
+	buf, err := readAt(fs.dev, int(fs.inodeSize), offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read inode %d", ino)
+	}
+	if string(buf[:2]) != "IN" {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "inode %d magic", ino)
+	}
+	be := binary.BigEndian
+	core := int64(xfsDinodeCoreSize)
+	if buf[4] >= 3 {
+		core = xfsDinodeV3CoreSize
+	}
+	forkEnd := fs.inodeSize
+	if forkOff := int64(buf[82]) * 8; forkOff > 0 && core+forkOff < forkEnd {
+		forkEnd = core + forkOff
+	}
+	if core > forkEnd {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "inode %d size", ino)
+	}
+	if fsize := int64(be.Uint64(buf[56:])); fsize < 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "inode %d file size %d", ino, fsize)
+	}
+	return &sXfsInode{
+		ino:    ino,
+		mode:   be.Uint16(buf[2:]),
+		format: buf[5],
+		fsize:  int64(be.Uint64(buf[56:])),
+		fork:   buf[core:forkEnd],
+	}, nil
+}
+
+func (fs *sXfs) root() (iFsNode, error) {
+	return fs.readInode(fs.rootIno)
+}
+
+func xfsExtent(rec []byte) sXfsExtent {
+	be := binary.BigEndian
+	l0, l1 := be.Uint64(rec), be.Uint64(rec[8:])
+	return sXfsExtent{
+		unwritten: l0>>63 != 0,
+		offset:    int64(l0&(1<<63-1)) >> 9,
+		block:     int64(l0&0x1ff)<<43 | int64(l1>>21),
+		count:     int64(l1 & 0x1fffff),
+	}
+}
+
+func (fs *sXfs) collectBtree(fsb int64, depth int, extents []sXfsExtent) ([]sXfsExtent, error) {
+	if depth > xfsMaxBtreeDepth {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "bmap btree depth")
+	}
+	buf, err := readAt(fs.dev, int(fs.blockSize), fs.fsbOffset(fsb))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read bmap block %d", fsb)
+	}
+	header := int64(xfsBmbtBlockHeader)
+	switch string(buf[:4]) {
+	case "BMAP":
+	case "BMA3":
+		header = xfsBmbtBlockV5Header
+	default:
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "bmap block %d magic", fsb)
+	}
+	be := binary.BigEndian
+	level := be.Uint16(buf[4:])
+	numrecs := int64(be.Uint16(buf[6:]))
+	if level == 0 {
+		if header+numrecs*xfsExtentRecordSize > fs.blockSize {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "bmap block %d records", fsb)
+		}
+		for i := int64(0); i < numrecs; i++ {
+			extents = append(extents, xfsExtent(buf[header+i*xfsExtentRecordSize:]))
+		}
+		return extents, nil
+	}
+	maxrecs := (fs.blockSize - header) / (2 * xfsBmbtKeyOrPtrSize)
+	return fs.collectBtreePtrs(buf[header+maxrecs*xfsBmbtKeyOrPtrSize:], numrecs, depth, extents)
+}
+
+func (fs *sXfs) collectBtreePtrs(ptrs []byte, numrecs int64, depth int, extents []sXfsExtent) ([]sXfsExtent, error) {
+	if numrecs*xfsBmbtKeyOrPtrSize > int64(len(ptrs)) {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "bmap btree pointers")
+	}
+	var err error
+	for i := int64(0); i < numrecs; i++ {
+		ptr := int64(binary.BigEndian.Uint64(ptrs[i*xfsBmbtKeyOrPtrSize:]))
+		if extents, err = fs.collectBtree(ptr, depth+1, extents); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+func (fs *sXfs) extents(inode *sXfsInode) ([]sXfsExtent, error) {
+	var extents []sXfsExtent
+	switch inode.format {
+	case xfsDinodeFmtExtents:
+		for off := 0; off+xfsExtentRecordSize <= len(inode.fork); off += xfsExtentRecordSize {
+			extent := xfsExtent(inode.fork[off:])
+			if extent.count == 0 {
+				break
+			}
+			extents = append(extents, extent)
+		}
+	case xfsDinodeFmtBtree:
+		if len(inode.fork) < xfsBmdrBlockHeaderSize {
+			return nil, errors.Wrap(errors.ErrInvalidFormat, "bmap btree root")
+		}
+		numrecs := int64(binary.BigEndian.Uint16(inode.fork[2:]))
+		maxrecs := (int64(len(inode.fork)) - xfsBmdrBlockHeaderSize) / (2 * xfsBmbtKeyOrPtrSize)
+		var err error
+		extents, err = fs.collectBtreePtrs(inode.fork[xfsBmdrBlockHeaderSize+maxrecs*xfsBmbtKeyOrPtrSize:], numrecs, 0, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inode %d", inode.ino)
+		}
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "inode %d format %d", inode.ino, inode.format)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+	return extents, nil
+}
+
+func (fs *sXfs) open(node iFsNode) (io.ReaderAt, error) {
+	inode := node.(*sXfsInode)
+	if inode.format == xfsDinodeFmtLocal {
+		if inode.fsize > int64(len(inode.fork)) {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "inode %d local size", inode.ino)
+		}
+		return &sBytesReader{data: inode.fork[:inode.fsize]}, nil
+	}
+	extents, err := fs.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	mapper := func(block int64) (int64, error) {
+		i := sort.Search(len(extents), func(i int) bool { return extents[i].offset+extents[i].count > block })
+		if i == len(extents) || extents[i].offset > block || extents[i].unwritten {
+			return -1, nil
+		}
+		return fs.fsbOffset(extents[i].block) + (block-extents[i].offset)*fs.blockSize, nil
+	}
+	return &sBlockReader{dev: fs.dev, blockSize: fs.blockSize, fileSize: inode.fsize, mapBlock: mapper}, nil
+}
+
+func (fs *sXfs) readlink(node iFsNode) (string, error) {
+	inode := node.(*sXfsInode)
+	if inode.fsize < 0 || inode.fsize > maxSymlinkSize {
+		return "", errors.Wrapf(errors.ErrInvalidFormat, "symlink %d length %d", inode.ino, inode.fsize)
+	}
+	if inode.format == xfsDinodeFmtLocal || !fs.v5 {
+		r, err := fs.open(inode)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, inode.fsize)
+		if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	// each remote symlink block of v5 starts with a header
+	extents, err := fs.extents(inode)
+	if err != nil {
+		return "", err
+	}
+	target := []byte{}
+	block := make([]byte, fs.blockSize)
+	for _, extent := range extents {
+		for i := int64(0); i < extent.count && int64(len(target)) < inode.fsize; i++ {
+			if _, err := fs.dev.ReadAt(block, fs.fsbOffset(extent.block+i)); err != nil {
+				return "", err
+			}
+			if string(block[:4]) != "XSLM" {
+				return "", errors.Wrapf(errors.ErrInvalidFormat, "symlink %d magic", inode.ino)
+			}
+			n := int64(binary.BigEndian.Uint32(block[8:]))
+			if n > fs.blockSize-xfsSymlinkV5Header {
+				return "", errors.Wrapf(errors.ErrInvalidFormat, "symlink %d length", inode.ino)
+			}
+			target = append(target, block[xfsSymlinkV5Header:xfsSymlinkV5Header+n]...)
+		}
+	}
+	if int64(len(target)) > inode.fsize {
+		target = target[:inode.fsize]
+	}
+	return string(target), nil
+}
+
+func (fs *sXfs) lookup(dir iFsNode, name string) (iFsNode, error) {
+	inode := dir.(*sXfsInode)
+	if inode.format == xfsDinodeFmtLocal {
+		return fs.lookupShortform(inode, name)
+	}
+	extents, err := fs.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, fs.dirBlockSize)
+	for _, extent := range extents {
+		start := extent.offset * fs.blockSize
+		end := (extent.offset + extent.count) * fs.blockSize
+		if extent.unwritten || start >= xfsDirLeafOffset {
+			continue
+		}
+		if end > xfsDirLeafOffset {
+			end = xfsDirLeafOffset
+		}
+		// the directory blocks are contiguous in an extent
+		devStart := fs.fsbOffset(extent.block)
+		for off := start; off+fs.dirBlockSize <= end; off += fs.dirBlockSize {
+			if _, err := fs.dev.ReadAt(block, devStart+off-start); err != nil {
+				return nil, errors.Wrapf(err, "read directory %d block", inode.ino)
+			}
+			ino, err := fs.lookupDataBlock(block, name)
+			if err == nil {
+				return fs.readInode(ino)
+			}
+			if errors.Cause(err) != errors.ErrNotFound {
+				return nil, errors.Wrapf(err, "directory %d", inode.ino)
+			}
+		}
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, name)
+}
+
+func (fs *sXfs) lookupShortform(inode *sXfsInode, name string) (iFsNode, error) {
+	fork := inode.fork
+	if len(fork) < 2 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "directory %d", inode.ino)
+	}
+	be := binary.BigEndian
+	count := int(fork[0])
+	inoSize := 4
+	if fork[1] > 0 {
+		count = int(fork[1])
+		inoSize = 8
+	}
+	pos := 2 + inoSize
+	for i := 0; i < count; i++ {
+		if pos+3 > len(fork) {
+			break
+		}
+		nameLen := int(fork[pos])
+		entryName := pos + 3
+		inoPos := entryName + nameLen
+		if fs.ftype {
+			inoPos++
+		}
+		if inoPos+inoSize > len(fork) {
+			break
+		}
+		if string(fork[entryName:entryName+nameLen]) == name {
+			if inoSize == 8 {
+				return fs.readInode(be.Uint64(fork[inoPos:]))
+			}
+			return fs.readInode(uint64(be.Uint32(fork[inoPos:])))
+		}
+		pos = inoPos + inoSize
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, name)
+}
+
+func (fs *sXfs) lookupDataBlock(block []byte, name string) (uint64, error) {
+	be := binary.BigEndian
+	header := xfsDirDataHeader
+	end := len(block)
+	switch string(block[:4]) {
+	case "XD2D":
+	case "XDD3":
+		header = xfsDirDataV5Header
+	case "XD2B", "XDB3":
+		if string(block[:4]) == "XDB3" {
+			header = xfsDirDataV5Header
+		}
+		// the leaf entries and the tail are at the end of a single block
+		// directory
+		count := int(be.Uint32(block[end-xfsDirBlockTailSize:]))
+		end -= xfsDirBlockTailSize + count*xfsDirLeafEntrySize
+		if end < header {
+			return 0, errors.Wrap(errors.ErrInvalidFormat, "block directory tail")
+		}
+	default:
+		// holes and the free index
+		return 0, errors.Wrap(errors.ErrNotFound, name)
+	}
+	for pos := header; pos+xfsDirLeafEntrySize <= end; {
+		if be.Uint16(block[pos:]) == xfsDirDataFreeTag {
+			length := int(be.Uint16(block[pos+2:]))
+			if length < xfsDirLeafEntrySize || length%8 != 0 {
+				return 0, errors.Wrap(errors.ErrInvalidFormat, "directory free entry")
+			}
+			pos += length
+			continue
+		}
+		nameLen := int(block[pos+8])
+		entrySize := 8 + 1 + nameLen + 2
+		if fs.ftype {
+			entrySize++
+		}
+		entrySize = (entrySize + 7) &^ 7
+		if pos+entrySize > end {
+			return 0, errors.Wrap(errors.ErrInvalidFormat, "directory entry")
+		}
+		if string(block[pos+9:pos+9+nameLen]) == name {
+			return be.Uint64(block[pos:]), nil
+		}
+		pos += entrySize
+	}
+	return 0, errors.Wrap(errors.ErrNotFound, name)
+}
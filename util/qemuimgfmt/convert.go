@@ -0,0 +1,515 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/fileutils"
+)
+
+const (
+	defaultConvertClusterBits = 16
+	rawConvertChunkSize       = 64 * 1024
+
+	// qemu inflates the compressed clusters with a window of 4K
+	qcow2CompressWindow = 4096
+
+	vmdkStreamGrainSectors = 128
+	vmdkStreamGTEsPerGT    = 512
+	vmdkStreamOverHead     = 128
+	vmdkStreamDescSectors  = 20
+
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+type SConvertOptions struct {
+	// Compress compresses the clusters of qcow2, the grains of a stream
+	// optimized VMDK are always compressed
+	Compress bool
+	// ClusterBits of qcow2, 16 for clusters of 64K by default
+	ClusterBits uint32
+}
+
+type sConvertProgress struct {
+	total    int64
+	callback func(savedTotal int64, savedOnce int64)
+}
+
+func (p *sConvertProgress) add(n int64) {
+	p.total += n
+	if p.callback != nil {
+		p.callback(p.total, n)
+	}
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readChunk reads the virtual disk at off to buf, the part beyond the end
+// of the disk is zero
+func readChunk(src IVirtualDisk, buf []byte, off int64) error {
+	n := int64(len(buf))
+	if off+n > src.Size() {
+		n = src.Size() - off
+		for i := n; i < int64(len(buf)); i++ {
+			buf[i] = 0
+		}
+	}
+	m, err := src.ReadAt(buf[:n], off)
+	if err != nil && !(err == io.EOF && int64(m) == n) {
+		return errors.Wrapf(err, "read at %d", off)
+	}
+	return nil
+}
+
+// ConvertImage writes the virtual disk of src to the empty file out in the
+// format of raw, qcow2 or stream optimized VMDK, the blocks of zeros are
+// not written. The callback is called with the size of the virtual disk
+// converted as the callback of streamutils.StreamPipe2
+func ConvertImage(src IVirtualDisk, out *os.File, format TImageFormat, opts SConvertOptions, callback func(savedTotal int64, savedOnce int64)) error {
+	progress := &sConvertProgress{callback: callback}
+	switch format {
+	case RAW:
+		return convertToRaw(src, out, progress)
+	case QCOW2:
+		return convertToQcow2(src, out, opts, progress)
+	case VMDK:
+		return convertToVMDKStream(src, out, progress)
+	}
+	return errors.Wrapf(errors.ErrNotSupported, "convert to %s", format)
+}
+
+// ConvertImageFile converts the image file of the source format, or
+// detected if empty, to the file of target in the format, the target is
+// removed if failed
+func ConvertImageFile(source string, sourceFormat TImageFormat, target string, format TImageFormat, opts SConvertOptions, callback func(savedTotal int64, savedOnce int64)) error {
+	src, err := OpenImageFile(source, sourceFormat)
+	if err != nil {
+		return errors.Wrap(err, "OpenImageFile")
+	}
+	defer src.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", target)
+	}
+	err = ConvertImage(src, out, format, opts, callback)
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "close %s", target)
+	}
+	if err != nil {
+		os.Remove(target)
+		return errors.Wrapf(err, "convert %s to %s", source, format)
+	}
+	return nil
+}
+
+func convertToRaw(src IVirtualDisk, out *os.File, progress *sConvertProgress) error {
+	w := fileutils.NewSparseFileWriter(out)
+	buf := make([]byte, rawConvertChunkSize)
+	size := src.Size()
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		if size-off < int64(len(buf)) {
+			buf = buf[:size-off]
+		}
+		if err := readChunk(src, buf, off); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return errors.Wrapf(err, "write at %d", off)
+		}
+		progress.add(int64(len(buf)))
+	}
+	return w.PreClose()
+}
+
+// sQcow2Writer writes the clusters of data after the header and the
+// metadata at the end
+type sQcow2Writer struct {
+	out         *os.File
+	clusterBits uint32
+	clusterSize int64
+	// offset is the end of the image
+	offset    int64
+	refcounts []uint16
+	l2Tables  [][]uint64
+}
+
+func (w *sQcow2Writer) write(buf []byte) (int64, error) {
+	offset := w.offset
+	if _, err := w.out.WriteAt(buf, offset); err != nil {
+		return 0, errors.Wrapf(err, "write at %d", offset)
+	}
+	w.offset += int64(len(buf))
+	for c := offset / w.clusterSize; c*w.clusterSize < w.offset; c++ {
+		for int64(len(w.refcounts)) <= c {
+			w.refcounts = append(w.refcounts, 0)
+		}
+		w.refcounts[c]++
+	}
+	return offset, nil
+}
+
+func (w *sQcow2Writer) align() {
+	w.offset = (w.offset + w.clusterSize - 1) / w.clusterSize * w.clusterSize
+}
+
+// compress deflates a cluster by the window of 4K, a new window is
+// started after each flush
+func (w *sQcow2Writer) compress(cluster []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(cluster); i += qcow2CompressWindow {
+		end := i + qcow2CompressWindow
+		if end > len(cluster) {
+			end = len(cluster)
+		}
+		zw.Reset(&buf)
+		if _, err := zw.Write(cluster[i:end]); err != nil {
+			return nil, err
+		}
+		if end < len(cluster) {
+			err = zw.Flush()
+		} else {
+			err = zw.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *sQcow2Writer) writeCluster(cluster []byte, compress bool) (uint64, error) {
+	if compress {
+		compressed, err := w.compress(cluster)
+		if err != nil {
+			return 0, errors.Wrap(err, "compress")
+		}
+		if int64(len(compressed)) < w.clusterSize {
+			offset, err := w.write(compressed)
+			if err != nil {
+				return 0, err
+			}
+			x := 62 - (w.clusterBits - 8)
+			sectors := uint64((offset+int64(len(compressed))-1)>>9 - offset>>9)
+			return qcow2FlagCompressed | sectors<<x | uint64(offset), nil
+		}
+	}
+	w.align()
+	offset, err := w.write(cluster)
+	if err != nil {
+		return 0, err
+	}
+	return qcow2FlagCopied | uint64(offset), nil
+}
+
+// writeMetadata writes the L2 tables, the L1 table and the refcounts
+// of all clusters
+func (w *sQcow2Writer) writeMetadata() (int64, int64, int64, error) {
+	be := binary.BigEndian
+	w.align()
+	l1 := make([]byte, (int64(len(w.l2Tables))*8+w.clusterSize-1)/w.clusterSize*w.clusterSize)
+	for i, table := range w.l2Tables {
+		if table == nil {
+			continue
+		}
+		buf := make([]byte, w.clusterSize)
+		for j, entry := range table {
+			be.PutUint64(buf[j*8:], entry)
+		}
+		offset, err := w.write(buf)
+		if err != nil {
+			return 0, 0, 0, errors.Wrap(err, "write l2 table")
+		}
+		be.PutUint64(l1[i*8:], qcow2FlagCopied|uint64(offset))
+	}
+	l1Offset := int64(0)
+	if len(l1) > 0 {
+		var err error
+		if l1Offset, err = w.write(l1); err != nil {
+			return 0, 0, 0, errors.Wrap(err, "write l1 table")
+		}
+	}
+
+	// the refcount blocks and table count themselves
+	entries := w.clusterSize / 2
+	clusters := w.offset / w.clusterSize
+	blocks, tableClusters := int64(0), int64(0)
+	for {
+		newBlocks := (clusters + blocks + tableClusters + entries - 1) / entries
+		newTableClusters := (newBlocks*8 + w.clusterSize - 1) / w.clusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	blocksOffset := w.offset
+	tableOffset := blocksOffset + blocks*w.clusterSize
+	for c := blocksOffset / w.clusterSize; c < tableOffset/w.clusterSize+tableClusters; c++ {
+		w.refcounts = append(w.refcounts, 1)
+	}
+	buf := make([]byte, (blocks+tableClusters)*w.clusterSize)
+	for c, count := range w.refcounts {
+		be.PutUint16(buf[c*2:], count)
+	}
+	for i := int64(0); i < blocks; i++ {
+		be.PutUint64(buf[blocks*w.clusterSize+i*8:], uint64(blocksOffset+i*w.clusterSize))
+	}
+	if _, err := w.out.WriteAt(buf, blocksOffset); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "write refcounts")
+	}
+	w.offset += int64(len(buf))
+	return l1Offset, tableOffset, tableClusters, nil
+}
+
+func convertToQcow2(src IVirtualDisk, out *os.File, opts SConvertOptions, progress *sConvertProgress) error {
+	clusterBits := opts.ClusterBits
+	if clusterBits == 0 {
+		clusterBits = defaultConvertClusterBits
+	}
+	if clusterBits < 9 || clusterBits > 21 {
+		return errors.Wrapf(errors.ErrInvalidFormat, "cluster bits %d", clusterBits)
+	}
+	w := &sQcow2Writer{
+		out:         out,
+		clusterBits: clusterBits,
+		clusterSize: int64(1) << clusterBits,
+	}
+	size := src.Size()
+	l2Entries := w.clusterSize / 8
+	clusters := (size + w.clusterSize - 1) / w.clusterSize
+	w.l2Tables = make([][]uint64, (clusters+l2Entries-1)/l2Entries)
+	// the header
+	if _, err := w.write(make([]byte, w.clusterSize)); err != nil {
+		return err
+	}
+	cluster := make([]byte, w.clusterSize)
+	for i := int64(0); i < clusters; i++ {
+		off := i * w.clusterSize
+		if err := readChunk(src, cluster, off); err != nil {
+			return err
+		}
+		if !isZero(cluster) {
+			entry, err := w.writeCluster(cluster, opts.Compress)
+			if err != nil {
+				return errors.Wrapf(err, "write cluster %d", i)
+			}
+			if w.l2Tables[i/l2Entries] == nil {
+				w.l2Tables[i/l2Entries] = make([]uint64, l2Entries)
+			}
+			w.l2Tables[i/l2Entries][i%l2Entries] = entry
+		}
+		n := w.clusterSize
+		if off+n > size {
+			n = size - off
+		}
+		progress.add(n)
+	}
+	l1Offset, tableOffset, tableClusters, err := w.writeMetadata()
+	if err != nil {
+		return err
+	}
+
+	be := binary.BigEndian
+	hdr := make([]byte, 120)
+	copy(hdr, QCOW2_MAGIC)
+	be.PutUint32(hdr[4:], 3)
+	be.PutUint32(hdr[20:], clusterBits)
+	be.PutUint64(hdr[24:], uint64(size))
+	be.PutUint32(hdr[36:], uint32(len(w.l2Tables)))
+	be.PutUint64(hdr[40:], uint64(l1Offset))
+	be.PutUint64(hdr[48:], uint64(tableOffset))
+	be.PutUint32(hdr[56:], uint32(tableClusters))
+	be.PutUint32(hdr[96:], 4)
+	be.PutUint32(hdr[100:], 112)
+	hdr[qcow2HeaderV3Len] = QCOW2_COMPRESSION_ZLIB
+	if _, err := out.WriteAt(hdr, 0); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	return nil
+}
+
+// sVMDKStreamWriter writes a stream optimized VMDK sequentially
+type sVMDKStreamWriter struct {
+	out    *os.File
+	sector int64
+}
+
+func (w *sVMDKStreamWriter) write(buf []byte) error {
+	if rem := len(buf) % vmdkSectorSize; rem != 0 {
+		buf = append(buf, make([]byte, vmdkSectorSize-rem)...)
+	}
+	if _, err := w.out.Write(buf); err != nil {
+		return errors.Wrapf(err, "write at sector %d", w.sector)
+	}
+	w.sector += int64(len(buf)) / vmdkSectorSize
+	return nil
+}
+
+func (w *sVMDKStreamWriter) writeMarker(value uint64, markerType uint32) error {
+	marker := make([]byte, vmdkSectorSize)
+	binary.LittleEndian.PutUint64(marker, value)
+	binary.LittleEndian.PutUint32(marker[12:], markerType)
+	return w.write(marker)
+}
+
+func vmdkStreamHeader(capacity int64, gdOffset uint64) []byte {
+	le := binary.LittleEndian
+	hdr := make([]byte, vmdkSectorSize)
+	copy(hdr, VMDK_SPARSE_MAGIC)
+	le.PutUint32(hdr[4:], 3)
+	le.PutUint32(hdr[8:], VMDK_FLAG_NL_DETECT|VMDK_FLAG_COMPRESSED_GRAINS|VMDK_FLAG_MARKERS)
+	le.PutUint64(hdr[12:], uint64(capacity))
+	le.PutUint64(hdr[20:], vmdkStreamGrainSectors)
+	le.PutUint64(hdr[28:], 1)
+	le.PutUint64(hdr[36:], vmdkStreamDescSectors)
+	le.PutUint32(hdr[44:], vmdkStreamGTEsPerGT)
+	le.PutUint64(hdr[56:], gdOffset)
+	le.PutUint64(hdr[64:], vmdkStreamOverHead)
+	copy(hdr[73:], "\n \r\n")
+	le.PutUint16(hdr[77:], VMDK_COMPRESSION_DEFLATE)
+	return hdr
+}
+
+func vmdkStreamDescriptor(capacity int64, extentFile string) []byte {
+	cylinders := capacity / (16 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+	desc := fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="%s"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`, rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(), VMDK_SUBFORMAT_STREAM_OPTIMIZED, capacity, extentFile, cylinders)
+	buf := make([]byte, vmdkStreamDescSectors*vmdkSectorSize)
+	copy(buf, desc)
+	return buf
+}
+
+func convertToVMDKStream(src IVirtualDisk, out *os.File, progress *sConvertProgress) error {
+	w := &sVMDKStreamWriter{out: out}
+	size := src.Size()
+	capacity := (size + vmdkSectorSize - 1) / vmdkSectorSize
+	grainSize := int64(vmdkStreamGrainSectors * vmdkSectorSize)
+	grains := (size + grainSize - 1) / grainSize
+	gdEntries := (grains + vmdkStreamGTEsPerGT - 1) / vmdkStreamGTEsPerGT
+	gtSize := int64(vmdkStreamGTEsPerGT * 4)
+	gt := make([]byte, gdEntries*gtSize)
+	gd := make([]byte, gdEntries*4)
+
+	head := vmdkStreamHeader(capacity, vmdkGDAtEnd)
+	head = append(head, vmdkStreamDescriptor(capacity, filepath.Base(out.Name()))...)
+	head = append(head, make([]byte, (vmdkStreamOverHead-1-vmdkStreamDescSectors)*vmdkSectorSize)...)
+	if err := w.write(head); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	le := binary.LittleEndian
+	grain := make([]byte, grainSize)
+	var compressed bytes.Buffer
+	for i := int64(0); i < grains; i++ {
+		off := i * grainSize
+		buf := grain
+		if off+grainSize > size {
+			// the last grain is partial
+			buf = grain[:size-off]
+		}
+		if err := readChunk(src, buf, off); err != nil {
+			return err
+		}
+		if !isZero(buf) {
+			compressed.Reset()
+			compressed.Write(make([]byte, vmdkGrainMarkerSize))
+			zw := zlib.NewWriter(&compressed)
+			if _, err := zw.Write(buf); err != nil {
+				return errors.Wrapf(err, "compress grain %d", i)
+			}
+			if err := zw.Close(); err != nil {
+				return errors.Wrapf(err, "compress grain %d", i)
+			}
+			data := compressed.Bytes()
+			le.PutUint64(data, uint64(off/vmdkSectorSize))
+			le.PutUint32(data[8:], uint32(len(data)-vmdkGrainMarkerSize))
+			le.PutUint32(gt[i*4:], uint32(w.sector))
+			if err := w.write(data); err != nil {
+				return errors.Wrapf(err, "write grain %d", i)
+			}
+		}
+		progress.add(int64(len(buf)))
+	}
+
+	for i := int64(0); i < gdEntries; i++ {
+		if err := w.writeMarker(uint64(gtSize/vmdkSectorSize), vmdkMarkerGT); err != nil {
+			return errors.Wrap(err, "write grain table marker")
+		}
+		le.PutUint32(gd[i*4:], uint32(w.sector))
+		if err := w.write(gt[i*gtSize : (i+1)*gtSize]); err != nil {
+			return errors.Wrap(err, "write grain table")
+		}
+	}
+	if err := w.writeMarker(uint64((int64(len(gd))+vmdkSectorSize-1)/vmdkSectorSize), vmdkMarkerGD); err != nil {
+		return errors.Wrap(err, "write grain directory marker")
+	}
+	gdOffset := uint64(w.sector)
+	if err := w.write(gd); err != nil {
+		return errors.Wrap(err, "write grain directory")
+	}
+	if err := w.writeMarker(1, vmdkMarkerFooter); err != nil {
+		return errors.Wrap(err, "write footer marker")
+	}
+	if err := w.write(vmdkStreamHeader(capacity, gdOffset)); err != nil {
+		return errors.Wrap(err, "write footer")
+	}
+	if err := w.writeMarker(0, vmdkMarkerEOS); err != nil {
+		return errors.Wrap(err, "write end-of-stream marker")
+	}
+	return nil
+}
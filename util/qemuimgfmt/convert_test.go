@@ -0,0 +1,125 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// not aligned to clusters or grains
+	data := newTestDisk(3*1024*1024 + 4096)
+	sources := map[string][]byte{
+		"src.raw":   data,
+		"src.qcow2": buildTestQcow2(data, sTestQcow2Options{clusterBits: 16}),
+		"src.vhd":   buildTestVHD(data, VHD_TYPE_DYNAMIC, 2*1024*1024, ""),
+		"src.vmdk":  buildTestVMDK(data, true),
+	}
+	targets := []struct {
+		name   string
+		format TImageFormat
+		opts   SConvertOptions
+	}{
+		{"raw", RAW, SConvertOptions{}},
+		{"qcow2", QCOW2, SConvertOptions{}},
+		{"compressed qcow2", QCOW2, SConvertOptions{Compress: true, ClusterBits: 12}},
+		{"vmdk", VMDK, SConvertOptions{}},
+	}
+	for name, src := range sources {
+		source := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(source, src, 0644); err != nil {
+			t.Fatalf("WriteFile %v", err)
+		}
+		for _, target := range targets {
+			t.Run(name+" to "+target.name, func(t *testing.T) {
+				dst := filepath.Join(dir, "dst")
+				total := int64(0)
+				err := ConvertImageFile(source, "", dst, target.format, target.opts, func(savedTotal int64, savedOnce int64) {
+					total += savedOnce
+					if total != savedTotal {
+						t.Fatalf("progress %d of %d", savedTotal, total)
+					}
+				})
+				if err != nil {
+					t.Fatalf("ConvertImageFile %v", err)
+				}
+				if total != int64(len(data)) {
+					t.Errorf("progress total %d", total)
+				}
+				img, err := OpenImageFile(dst, "")
+				if err != nil {
+					t.Fatalf("OpenImageFile %v", err)
+				}
+				defer img.Close()
+				if img.Format != target.format {
+					t.Errorf("format %s", img.Format)
+				}
+				got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+				if err != nil {
+					t.Fatalf("read %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("content mismatch")
+				}
+				if qcow2, ok := img.IVirtualDisk.(*SQcow2Image); ok {
+					result, err := qcow2.Check()
+					if err != nil || !result.IsClean() {
+						t.Errorf("Check %#v %v", result, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestConvertImageSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 4*1024*1024)
+	copy(data[1024*1024:], "sparse")
+	for _, format := range []TImageFormat{RAW, QCOW2, VMDK} {
+		out, err := os.Create(filepath.Join(dir, "out."+string(format)))
+		if err != nil {
+			t.Fatalf("Create %v", err)
+		}
+		err = ConvertImage(bytes.NewReader(data), out, format, SConvertOptions{}, nil)
+		stat, _ := out.Stat()
+		out.Close()
+		if err != nil {
+			t.Fatalf("ConvertImage to %s %v", format, err)
+		}
+		if format == RAW && stat.Size() != int64(len(data)) {
+			t.Errorf("raw size %d", stat.Size())
+		}
+		if format != RAW && stat.Size() > 1024*1024 {
+			t.Errorf("%s of size %d", format, stat.Size())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"io"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/vmdkutils"
+)
+
+const (
+	VMDK_SUBFORMAT_DESCRIPTOR       = "descriptor"
+	VMDK_SUBFORMAT_SPARSE           = "monolithicSparse"
+	VMDK_SUBFORMAT_STREAM_OPTIMIZED = "streamOptimized"
+
+	VHD_SUBFORMAT_FIXED        = "fixed"
+	VHD_SUBFORMAT_DYNAMIC      = "dynamic"
+	VHD_SUBFORMAT_DIFFERENCING = "differencing"
+
+	VHDX_MAGIC = "vhdxfile"
+
+	isoMagicOffset = 0x8001
+	isoMagic       = "CD001"
+
+	// a descriptor file is small text
+	maxVMDKDescriptorSize = 64 * 1024
+)
+
+// DetectImageFormat detects the format of an image by its content, the
+// subformat is the VMDK or VHD subformat, size is the size of the image
+// file, for the VHD footer at the end
+func DetectImageFormat(r io.ReaderAt, size int64) (TImageFormat, string, error) {
+	head := make([]byte, 512)
+	n, err := r.ReadAt(head, 0)
+	if n == 0 && err != nil && err != io.EOF {
+		return "", "", errors.Wrap(err, "read header")
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte(QCOW2_MAGIC)):
+		return QCOW2, "", nil
+	case bytes.HasPrefix(head, []byte(VHDX_MAGIC)):
+		return VHDX, "", nil
+	case bytes.HasPrefix(head, []byte(VMDK_SPARSE_MAGIC)):
+		hdr, err := readVMDKSparseHeader(r, 0)
+		if err != nil {
+			return "", "", err
+		}
+		if hdr.IsStreamOptimized() {
+			return VMDK, VMDK_SUBFORMAT_STREAM_OPTIMIZED, nil
+		}
+		return VMDK, VMDK_SUBFORMAT_SPARSE, nil
+	case bytes.HasPrefix(head, []byte(VHD_COOKIE)):
+		// the copy of the footer of the dynamic disks
+		footer, err := parseVHDFooter(head)
+		if err != nil {
+			return "", "", err
+		}
+		return VHD, footer.Subformat(), nil
+	}
+	if size > 0 && size <= maxVMDKDescriptorSize && isVMDKDescriptor(r, size) {
+		return VMDK, VMDK_SUBFORMAT_DESCRIPTOR, nil
+	}
+	if footer, err := readVHDFooter(r, size); err == nil {
+		return VHD, footer.Subformat(), nil
+	}
+	magic := make([]byte, len(isoMagic))
+	if _, err := r.ReadAt(magic, isoMagicOffset); err == nil && string(magic) == isoMagic {
+		return ISO, "", nil
+	}
+	return RAW, "", nil
+}
+
+func isVMDKDescriptor(r io.ReaderAt, size int64) bool {
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return false
+	}
+	if !bytes.Contains(buf, []byte("# Disk DescriptorFile")) && !bytes.Contains(buf, []byte("createType")) {
+		return false
+	}
+	_, err := vmdkutils.ParseStream(bytes.NewReader(buf))
+	return err == nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectImageFormat(t *testing.T) {
+	data := newTestDisk(256 * 1024)
+	iso := make([]byte, 0x9000)
+	copy(iso[isoMagicOffset:], isoMagic)
+	vhdx := make([]byte, 1024*1024)
+	copy(vhdx, VHDX_MAGIC)
+	descriptor := []byte("# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n\n" +
+		"# Extent description\nRW 2048 FLAT \"test-flat.vmdk\" 0\n")
+
+	cases := []struct {
+		name      string
+		image     []byte
+		format    TImageFormat
+		subformat string
+	}{
+		{"qcow2", buildTestQcow2(data, sTestQcow2Options{clusterBits: 16}), QCOW2, ""},
+		{"vhdx", vhdx, VHDX, ""},
+		{"vmdk descriptor", descriptor, VMDK, VMDK_SUBFORMAT_DESCRIPTOR},
+		{"iso", iso, ISO, ""},
+		{"raw", data, RAW, ""},
+		{"empty", nil, RAW, ""},
+	}
+	for _, c := range cases {
+		format, subformat, err := DetectImageFormat(bytes.NewReader(c.image), int64(len(c.image)))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if format != c.format || subformat != c.subformat {
+			t.Errorf("%s: got %s %q want %s %q", c.name, format, subformat, c.format, c.subformat)
+		}
+	}
+}
@@ -24,13 +24,14 @@ const (
 	QCOW2 = TImageFormat("qcow2")
 	VMDK  = TImageFormat("vmdk")
 	VHD   = TImageFormat("vhd")
+	VHDX  = TImageFormat("vhdx")
 	ISO   = TImageFormat("iso")
 	RAW   = TImageFormat("raw")
 	TGZ   = TImageFormat("tgz")
 )
 
 var supportedImageFormats = []TImageFormat{
-	QCOW2, VMDK, VHD, ISO, RAW, TGZ,
+	QCOW2, VMDK, VHD, VHDX, ISO, RAW, TGZ,
 }
 
 func IsSupportedImageFormat(fmtStr string) bool {
@@ -59,6 +60,8 @@ func String2ImageFormat(fmt string) TImageFormat {
 		return QCOW2
 	case "vmdk":
 		return VMDK
+	case "vhdx":
+		return VHDX
 	case "iso":
 		return ISO
 	case "raw":
@@ -0,0 +1,289 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/vmdkutils"
+)
+
+const (
+	maxBackingChain = 16
+)
+
+// IVirtualDisk is the virtual disk content of an image
+type IVirtualDisk interface {
+	io.ReaderAt
+	Size() int64
+}
+
+type iBackingImage interface {
+	IVirtualDisk
+	SetBacking(backing io.ReaderAt)
+}
+
+// OpenImage opens the virtual disk of an image of the size in the format,
+// the format is detected if empty. The backing image of the qcow2, VHD
+// differencing and VMDK sparse images should be set by SetBacking, or the
+// data not allocated reads zero
+func OpenImage(r io.ReaderAt, size int64, format TImageFormat) (IVirtualDisk, error) {
+	subformat := ""
+	if len(format) == 0 {
+		var err error
+		format, subformat, err = DetectImageFormat(r, size)
+		if err != nil {
+			return nil, errors.Wrap(err, "DetectImageFormat")
+		}
+	}
+	var (
+		disk IVirtualDisk
+		err  error
+	)
+	switch format {
+	case QCOW2:
+		disk, err = OpenQcow2(r)
+	case VHD:
+		disk, err = OpenVHD(r, size)
+	case VMDK:
+		if subformat == VMDK_SUBFORMAT_DESCRIPTOR {
+			return nil, errors.Wrap(errors.ErrNotSupported, "vmdk descriptor without extent files")
+		}
+		disk, err = OpenVMDKSparse(r, size)
+	case RAW, ISO:
+		return io.NewSectionReader(r, 0, size), nil
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "image format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return disk, nil
+}
+
+// SImageFile is an image file opened with its backing files
+type SImageFile struct {
+	IVirtualDisk
+
+	Format TImageFormat
+
+	files []*os.File
+}
+
+// OpenImageFile opens an image file in the format, or detected if empty,
+// the backing files and the extent files of a VMDK descriptor are opened
+// relative to the directory of the image
+func OpenImageFile(path string, format TImageFormat) (*SImageFile, error) {
+	img := &SImageFile{}
+	disk, format, err := img.open(path, format, 0)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	img.IVirtualDisk = disk
+	img.Format = format
+	return img, nil
+}
+
+func (img *SImageFile) Close() error {
+	errs := []error{}
+	for _, f := range img.files {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	img.files = nil
+	return errors.NewAggregate(errs)
+}
+
+func relativePath(path string, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+func (img *SImageFile) openFile(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "open %s", path)
+	}
+	img.files = append(img.files, f)
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "stat %s", path)
+	}
+	return f, stat.Size(), nil
+}
+
+func (img *SImageFile) open(path string, format TImageFormat, depth int) (IVirtualDisk, TImageFormat, error) {
+	if depth > maxBackingChain {
+		return nil, "", errors.Wrapf(errors.ErrInvalidStatus, "backing chain of %s too long", path)
+	}
+	f, size, err := img.openFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	subformat := ""
+	if len(format) == 0 {
+		format, subformat, err = DetectImageFormat(f, size)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "detect format of %s", path)
+		}
+	} else if format == VMDK && size <= maxVMDKDescriptorSize && isVMDKDescriptor(f, size) {
+		subformat = VMDK_SUBFORMAT_DESCRIPTOR
+	}
+	if subformat == VMDK_SUBFORMAT_DESCRIPTOR {
+		disk, err := img.openVMDKDescriptor(path, f, size, depth)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "open vmdk descriptor %s", path)
+		}
+		return disk, format, nil
+	}
+	disk, err := OpenImage(f, size, format)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "open %s image %s", format, path)
+	}
+	backingFile, backingFormat := "", TImageFormat("")
+	switch disk := disk.(type) {
+	case *SQcow2Image:
+		backingFile, backingFormat = disk.BackingFile, String2ImageFormat(disk.BackingFormat)
+	case *SVHDImage:
+		if disk.Footer.DiskType == VHD_TYPE_DIFFERENCING {
+			backingFile = disk.ParentName
+		}
+	case *SVMDKSparseImage:
+		if disk.Descriptor != nil {
+			backingFile = disk.Descriptor.ParentFileName
+		}
+	}
+	if len(backingFile) > 0 {
+		if err := img.openBacking(disk.(iBackingImage), relativePath(path, backingFile), backingFormat, depth); err != nil {
+			return nil, "", err
+		}
+	}
+	return disk, format, nil
+}
+
+func (img *SImageFile) openBacking(disk iBackingImage, path string, format TImageFormat, depth int) error {
+	backing, _, err := img.open(path, format, depth+1)
+	if err != nil {
+		return errors.Wrap(err, "open backing file")
+	}
+	disk.SetBacking(backing)
+	return nil
+}
+
+// openVMDKDescriptor opens the extents of a descriptor file as a disk
+func (img *SImageFile) openVMDKDescriptor(path string, f *os.File, size int64, depth int) (IVirtualDisk, error) {
+	info, err := vmdkutils.ParseStream(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse descriptor")
+	}
+	var parent IVirtualDisk
+	if len(info.ParentFileName) > 0 {
+		parent, _, err = img.open(relativePath(path, info.ParentFileName), VMDK, depth+1)
+		if err != nil {
+			return nil, errors.Wrap(err, "open parent")
+		}
+	}
+	disk := &sVMDKExtents{}
+	for _, extent := range info.Extents {
+		var r io.ReaderAt
+		size := extent.Sectors * vmdkSectorSize
+		switch extent.Type {
+		case vmdkutils.EXTENT_TYPE_ZERO:
+		case vmdkutils.EXTENT_TYPE_FLAT, vmdkutils.EXTENT_TYPE_VMFS:
+			ef, _, err := img.openFile(relativePath(path, extent.File))
+			if err != nil {
+				return nil, err
+			}
+			r = io.NewSectionReader(ef, extent.Offset*vmdkSectorSize, size)
+		case vmdkutils.EXTENT_TYPE_SPARSE:
+			ef, efSize, err := img.openFile(relativePath(path, extent.File))
+			if err != nil {
+				return nil, err
+			}
+			sparse, err := OpenVMDKSparse(ef, efSize)
+			if err != nil {
+				return nil, errors.Wrapf(err, "open extent %s", extent.File)
+			}
+			if parent != nil {
+				sparse.SetBacking(io.NewSectionReader(parent, disk.size, size))
+			}
+			r = sparse
+		default:
+			return nil, errors.Wrapf(errors.ErrNotSupported, "extent type %s", extent.Type)
+		}
+		disk.extents = append(disk.extents, sVMDKExtentReader{start: disk.size, size: size, r: r})
+		disk.size += size
+	}
+	return disk, nil
+}
+
+type sVMDKExtentReader struct {
+	start int64
+	size  int64
+	// r is nil for the ZERO extents
+	r io.ReaderAt
+}
+
+// sVMDKExtents is the disk of the extents of a descriptor one after another
+type sVMDKExtents struct {
+	extents []sVMDKExtentReader
+	size    int64
+}
+
+func (disk *sVMDKExtents) Size() int64 {
+	return disk.size
+}
+
+func (disk *sVMDKExtents) ReadAt(p []byte, off int64) (int, error) {
+	if off >= disk.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > disk.size {
+		p = p[:disk.size-off]
+		eof = io.EOF
+	}
+	read := 0
+	for _, extent := range disk.extents {
+		cur := off + int64(read)
+		if read >= len(p) {
+			break
+		}
+		if cur >= extent.start+extent.size {
+			continue
+		}
+		n := extent.start + extent.size - cur
+		if n > int64(len(p)-read) {
+			n = int64(len(p) - read)
+		}
+		buf := p[read : read+int(n)]
+		if extent.r == nil {
+			for i := range buf {
+				buf[i] = 0
+			}
+		} else if m, err := extent.r.ReadAt(buf, cur-extent.start); err != nil && !(err == io.EOF && m == len(buf)) {
+			return read, errors.Wrapf(err, "read extent at %d", extent.start)
+		}
+		read += int(n)
+	}
+	return read, eof
+}
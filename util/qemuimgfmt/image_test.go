@@ -0,0 +1,84 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenImageFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := bytes.Repeat([]byte{0x11}, 64*1024)
+	child := make([]byte, len(base))
+	copy(child[8192:], bytes.Repeat([]byte{0x22}, 4096))
+	merged := append([]byte{}, base...)
+	copy(merged[8192:], child[8192:12288])
+
+	files := map[string][]byte{
+		"base-flat.vmdk": base,
+		"base.vmdk": []byte("# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n\n" +
+			"RW 64 FLAT \"base-flat.vmdk\" 0\nRW 32 ZERO\nRW 32 FLAT \"base-flat.vmdk\" 64\n"),
+		"base.raw":     base,
+		"child.vhd":    buildTestVHD(child, VHD_TYPE_DIFFERENCING, 4096, "base.raw"),
+		"base.qcow2":   buildTestQcow2(base, sTestQcow2Options{clusterBits: 16}),
+		"child.qcow2":  buildTestQcow2(child, sTestQcow2Options{clusterBits: 12, backingFile: "base.qcow2"}),
+		"invalid.vmdk": []byte("# Disk DescriptorFile\ncreateType=\"monolithicFlat\"\nRW 64 FLAT \"missing.vmdk\" 0\n"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("WriteFile %v", err)
+		}
+	}
+
+	descriptor := append([]byte{}, base[:32768]...)
+	descriptor = append(descriptor, make([]byte, 16384)...)
+	descriptor = append(descriptor, base[32768:49152]...)
+	cases := []struct {
+		name   string
+		format TImageFormat
+		want   []byte
+	}{
+		{"base.vmdk", VMDK, descriptor},
+		{"child.vhd", VHD, merged},
+		{"child.qcow2", QCOW2, merged},
+	}
+	for _, c := range cases {
+		img, err := OpenImageFile(filepath.Join(dir, c.name), "")
+		if err != nil {
+			t.Fatalf("OpenImageFile %s %v", c.name, err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		img.Close()
+		if err != nil {
+			t.Fatalf("read %s %v", c.name, err)
+		}
+		if img.Format != c.format || !bytes.Equal(got, c.want) {
+			t.Errorf("%s: format %s content mismatch %v", c.name, img.Format, bytes.Equal(got, c.want))
+		}
+	}
+	if _, err := OpenImageFile(filepath.Join(dir, "invalid.vmdk"), ""); err == nil {
+		t.Errorf("missing extent file opened")
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * qcow2
+ * Reference: https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+ *
+ */
+
+const (
+	QCOW2_MAGIC = "QFI\xfb"
+
+	QCOW2_INCOMPAT_DIRTY          = 1 << 0
+	QCOW2_INCOMPAT_CORRUPT        = 1 << 1
+	QCOW2_INCOMPAT_DATA_FILE      = 1 << 2
+	QCOW2_INCOMPAT_COMPRESSION    = 1 << 3
+	QCOW2_INCOMPAT_EXTENDED_L2    = 1 << 4
+	QCOW2_COMPAT_LAZY_REFCOUNTS   = 1 << 0
+	QCOW2_AUTOCLEAR_BITMAPS       = 1 << 0
+	QCOW2_AUTOCLEAR_DATA_FILE_RAW = 1 << 1
+
+	QCOW2_CRYPT_NONE = 0
+	QCOW2_CRYPT_AES  = 1
+	QCOW2_CRYPT_LUKS = 2
+
+	QCOW2_COMPRESSION_ZLIB = 0
+	QCOW2_COMPRESSION_ZSTD = 1
+
+	qcow2HeaderV2Len = 72
+	qcow2HeaderV3Len = 104
+
+	qcow2ExtEnd           = 0x00000000
+	qcow2ExtBackingFormat = 0xe2792aca
+	qcow2ExtFeatureTable  = 0x6803f857
+	qcow2ExtBitmaps       = 0x23852875
+	qcow2ExtEncryption    = 0x0537be77
+	qcow2ExtDataFile      = 0x44415441
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2FlagCopied     = uint64(1) << 63
+	qcow2FlagCompressed = uint64(1) << 62
+	qcow2FlagZero       = uint64(1) << 0
+
+	qcow2L2CacheSize = 64
+)
+
+// SQcow2Header is the qcow2 header, the fields of version 3 are zero for
+// version 2
+type SQcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+// SQcow2Image reads the virtual disk of a qcow2 image, the clusters not
+// allocated are read from the backing image, or as zeros without one
+type SQcow2Image struct {
+	Header SQcow2Header
+
+	BackingFile   string
+	BackingFormat string
+	DataFile      string
+
+	r       io.ReaderAt
+	backing io.ReaderAt
+	l1      []uint64
+
+	// the feature names of the feature name table extension
+	featureNames map[[2]uint8]string
+	// the locations of the bitmap directory and the encryption header
+	bitmapDirectoryOffset uint64
+	bitmapDirectorySize   uint64
+	cryptoHeaderOffset    uint64
+	cryptoHeaderLength    uint64
+
+	lock    sync.Mutex
+	l2Cache map[uint64][]uint64
+	l2Order []uint64
+}
+
+func IsQcow2(r io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == QCOW2_MAGIC
+}
+
+func readQcow2Header(r io.ReaderAt) (*SQcow2Header, error) {
+	buf := make([]byte, qcow2HeaderV3Len+8)
+	n, err := r.ReadAt(buf, 0)
+	if n < qcow2HeaderV2Len {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "short qcow2 header: %v", err)
+	}
+	buf = buf[:n]
+	hdr := &SQcow2Header{}
+	copy(hdr.Magic[:], buf)
+	if string(hdr.Magic[:]) != QCOW2_MAGIC {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not qcow2")
+	}
+	be := binary.BigEndian
+	hdr.Version = be.Uint32(buf[4:])
+	hdr.BackingFileOffset = be.Uint64(buf[8:])
+	hdr.BackingFileSize = be.Uint32(buf[16:])
+	hdr.ClusterBits = be.Uint32(buf[20:])
+	hdr.Size = be.Uint64(buf[24:])
+	hdr.CryptMethod = be.Uint32(buf[32:])
+	hdr.L1Size = be.Uint32(buf[36:])
+	hdr.L1TableOffset = be.Uint64(buf[40:])
+	hdr.RefcountTableOffset = be.Uint64(buf[48:])
+	hdr.RefcountTableClusters = be.Uint32(buf[56:])
+	hdr.NbSnapshots = be.Uint32(buf[60:])
+	hdr.SnapshotsOffset = be.Uint64(buf[64:])
+	switch hdr.Version {
+	case 2:
+		hdr.RefcountOrder = 4
+		hdr.HeaderLength = qcow2HeaderV2Len
+	case 3:
+		if len(buf) < qcow2HeaderV3Len {
+			return nil, errors.Wrap(errors.ErrInvalidFormat, "short qcow2 v3 header")
+		}
+		hdr.IncompatibleFeatures = be.Uint64(buf[72:])
+		hdr.CompatibleFeatures = be.Uint64(buf[80:])
+		hdr.AutoclearFeatures = be.Uint64(buf[88:])
+		hdr.RefcountOrder = be.Uint32(buf[96:])
+		hdr.HeaderLength = be.Uint32(buf[100:])
+		if hdr.HeaderLength < qcow2HeaderV3Len {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "header length %d", hdr.HeaderLength)
+		}
+		if hdr.HeaderLength > qcow2HeaderV3Len && len(buf) > qcow2HeaderV3Len {
+			hdr.CompressionType = buf[qcow2HeaderV3Len]
+		}
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "qcow2 version %d", hdr.Version)
+	}
+	if hdr.ClusterBits < 9 || hdr.ClusterBits > 21 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "cluster bits %d", hdr.ClusterBits)
+	}
+	return hdr, nil
+}
+
+func (hdr *SQcow2Header) ClusterSize() int64 {
+	return int64(1) << hdr.ClusterBits
+}
+
+func (hdr *SQcow2Header) ExtendedL2() bool {
+	return hdr.IncompatibleFeatures&QCOW2_INCOMPAT_EXTENDED_L2 != 0
+}
+
+// L2Entries is the number of entries of an L2 table
+func (hdr *SQcow2Header) L2Entries() int64 {
+	if hdr.ExtendedL2() {
+		return hdr.ClusterSize() / 16
+	}
+	return hdr.ClusterSize() / 8
+}
+
+// OpenQcow2 reads the header, header extensions and L1 table of a qcow2
+// image
+func OpenQcow2(r io.ReaderAt) (*SQcow2Image, error) {
+	hdr, err := readQcow2Header(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &SQcow2Image{
+		Header:  *hdr,
+		r:       r,
+		l2Cache: map[uint64][]uint64{},
+
+		featureNames: map[[2]uint8]string{},
+	}
+	if err := img.readExtensions(); err != nil {
+		return nil, errors.Wrap(err, "readExtensions")
+	}
+	if hdr.BackingFileOffset > 0 && hdr.BackingFileSize > 0 {
+		if hdr.BackingFileSize > 1023 {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "backing file name length %d", hdr.BackingFileSize)
+		}
+		name := make([]byte, hdr.BackingFileSize)
+		if _, err := r.ReadAt(name, int64(hdr.BackingFileOffset)); err != nil {
+			return nil, errors.Wrap(err, "read backing file name")
+		}
+		img.BackingFile = string(name)
+	}
+	l1Entries := (int64(hdr.Size) + hdr.ClusterSize()*hdr.L2Entries() - 1) / (hdr.ClusterSize() * hdr.L2Entries())
+	if int64(hdr.L1Size) < l1Entries {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "L1 size %d less than %d", hdr.L1Size, l1Entries)
+	}
+	if hdr.L1Size > 32*1024*1024 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "L1 size %d too large", hdr.L1Size)
+	}
+	img.l1, err = readUint64Table(r, int64(hdr.L1TableOffset), int(hdr.L1Size))
+	if err != nil {
+		return nil, errors.Wrap(err, "read L1 table")
+	}
+	return img, nil
+}
+
+func readUint64Table(r io.ReaderAt, offset int64, count int) ([]uint64, error) {
+	buf := make([]byte, count*8)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, count)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+func (img *SQcow2Image) readExtensions() error {
+	offset := int64(img.Header.HeaderLength)
+	end := img.Header.ClusterSize()
+	head := make([]byte, 8)
+	for offset+8 <= end {
+		if _, err := img.r.ReadAt(head, offset); err != nil {
+			return err
+		}
+		extType := binary.BigEndian.Uint32(head)
+		extLen := int64(binary.BigEndian.Uint32(head[4:]))
+		if extType == qcow2ExtEnd {
+			return nil
+		}
+		if offset+8+extLen > end {
+			return errors.Wrapf(errors.ErrInvalidFormat, "header extension %x overflows", extType)
+		}
+		data := make([]byte, extLen)
+		if _, err := img.r.ReadAt(data, offset+8); err != nil {
+			return err
+		}
+		switch extType {
+		case qcow2ExtBackingFormat:
+			img.BackingFormat = string(data)
+		case qcow2ExtDataFile:
+			img.DataFile = string(data)
+		case qcow2ExtFeatureTable:
+			for i := 0; i+48 <= len(data); i += 48 {
+				img.featureNames[[2]uint8{data[i], data[i+1]}] = string(bytes.TrimRight(data[i+2:i+48], "\x00"))
+			}
+		case qcow2ExtBitmaps:
+			if len(data) >= 24 {
+				img.bitmapDirectorySize = binary.BigEndian.Uint64(data[8:])
+				img.bitmapDirectoryOffset = binary.BigEndian.Uint64(data[16:])
+			}
+		case qcow2ExtEncryption:
+			if len(data) >= 16 {
+				img.cryptoHeaderOffset = binary.BigEndian.Uint64(data)
+				img.cryptoHeaderLength = binary.BigEndian.Uint64(data[8:])
+			}
+		}
+		offset += 8 + (extLen+7)/8*8
+	}
+	return nil
+}
+
+// SetBacking sets the backing image of the clusters not allocated
+func (img *SQcow2Image) SetBacking(backing io.ReaderAt) {
+	img.backing = backing
+}
+
+func (img *SQcow2Image) Size() int64 {
+	return int64(img.Header.Size)
+}
+
+func (img *SQcow2Image) checkReadable() error {
+	hdr := &img.Header
+	switch {
+	case hdr.CryptMethod != QCOW2_CRYPT_NONE:
+		return errors.Wrap(errors.ErrNotSupported, "encrypted qcow2")
+	case hdr.IncompatibleFeatures&QCOW2_INCOMPAT_DATA_FILE != 0:
+		return errors.Wrap(errors.ErrNotSupported, "qcow2 with external data file")
+	case hdr.IncompatibleFeatures&^(QCOW2_INCOMPAT_DIRTY|QCOW2_INCOMPAT_COMPRESSION|QCOW2_INCOMPAT_EXTENDED_L2) != 0:
+		return errors.Wrapf(errors.ErrNotSupported, "qcow2 incompatible features %x", hdr.IncompatibleFeatures)
+	}
+	return nil
+}
+
+// l2Table returns the L2 table at the offset, the entries of extended L2
+// are pairs of the cluster descriptor and subcluster bitmap
+func (img *SQcow2Image) l2Table(offset uint64) ([]uint64, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	if table, ok := img.l2Cache[offset]; ok {
+		return table, nil
+	}
+	count := int(img.Header.ClusterSize() / 8)
+	table, err := readUint64Table(img.r, int64(offset), count)
+	if err != nil {
+		return nil, err
+	}
+	if len(img.l2Order) >= qcow2L2CacheSize {
+		delete(img.l2Cache, img.l2Order[0])
+		img.l2Order = img.l2Order[1:]
+	}
+	img.l2Cache[offset] = table
+	img.l2Order = append(img.l2Order, offset)
+	return table, nil
+}
+
+// l2Entry returns the L2 entry and subcluster bitmap of a virtual cluster,
+// 0 if not allocated
+func (img *SQcow2Image) l2Entry(cluster int64) (uint64, uint64, error) {
+	l2Entries := img.Header.L2Entries()
+	l1Index := cluster / l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return 0, 0, nil
+	}
+	l2Offset := img.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, 0, nil
+	}
+	table, err := img.l2Table(l2Offset)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "read L2 table at %d", l2Offset)
+	}
+	index := cluster % l2Entries
+	if img.Header.ExtendedL2() {
+		return table[index*2], table[index*2+1], nil
+	}
+	return table[index], 0, nil
+}
+
+func (img *SQcow2Image) readCompressed(entry uint64, buf []byte, inCluster int64) error {
+	hdr := &img.Header
+	if hdr.CompressionType != QCOW2_COMPRESSION_ZLIB {
+		return errors.Wrapf(errors.ErrNotSupported, "compression type %d", hdr.CompressionType)
+	}
+	x := 62 - (hdr.ClusterBits - 8)
+	offset := int64(entry & (uint64(1)<<x - 1))
+	sectors := int64((entry>>x)&(uint64(1)<<(hdr.ClusterBits-8)-1)) + 1
+	size := sectors*512 - offset%512
+	compressed := make([]byte, size)
+	n, err := img.r.ReadAt(compressed, offset)
+	if err != nil && !(err == io.EOF && n > 0) {
+		return errors.Wrapf(err, "read compressed cluster at %d", offset)
+	}
+	cluster := make([]byte, hdr.ClusterSize())
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), cluster); err != nil {
+		return errors.Wrapf(err, "inflate cluster at %d", offset)
+	}
+	copy(buf, cluster[inCluster:])
+	return nil
+}
+
+func (img *SQcow2Image) readUnallocated(buf []byte, off int64) error {
+	if img.backing == nil {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+	n, err := img.backing.ReadAt(buf, off)
+	if err == io.EOF {
+		// the backing image may be smaller
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+// readSubclusters reads within a cluster of extended L2, whose 32
+// subclusters are allocated or zero by the bitmap
+func (img *SQcow2Image) readSubclusters(entry, bitmap uint64, buf []byte, off int64, inCluster int64) error {
+	subSize := img.Header.ClusterSize() / 32
+	for len(buf) > 0 {
+		sub := inCluster / subSize
+		n := subSize - inCluster%subSize
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		switch {
+		case bitmap&(uint64(1)<<(32+sub)) != 0:
+			for i := int64(0); i < n; i++ {
+				buf[i] = 0
+			}
+		case bitmap&(uint64(1)<<sub) != 0:
+			if _, err := img.r.ReadAt(buf[:n], int64(entry&qcow2OffsetMask)+inCluster); err != nil {
+				return err
+			}
+		default:
+			if err := img.readUnallocated(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		buf, off, inCluster = buf[n:], off+n, inCluster+n
+	}
+	return nil
+}
+
+func (img *SQcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if err := img.checkReadable(); err != nil {
+		return 0, err
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	clusterSize := img.Header.ClusterSize()
+	read := 0
+	for read < len(p) {
+		cur := off + int64(read)
+		inCluster := cur % clusterSize
+		n := clusterSize - inCluster
+		if n > int64(len(p)-read) {
+			n = int64(len(p) - read)
+		}
+		buf := p[read : read+int(n)]
+		entry, bitmap, err := img.l2Entry(cur / clusterSize)
+		if err != nil {
+			return read, err
+		}
+		switch {
+		case entry&qcow2FlagCompressed != 0:
+			err = img.readCompressed(entry&^(qcow2FlagCopied|qcow2FlagCompressed), buf, inCluster)
+		case img.Header.ExtendedL2():
+			err = img.readSubclusters(entry, bitmap, buf, cur, inCluster)
+		case entry&qcow2FlagZero != 0 && img.Header.Version >= 3:
+			for i := range buf {
+				buf[i] = 0
+			}
+		case entry&qcow2OffsetMask == 0:
+			err = img.readUnallocated(buf, cur)
+		default:
+			_, err = img.r.ReadAt(buf, int64(entry&qcow2OffsetMask)+inCluster)
+		}
+		if err != nil {
+			return read, errors.Wrapf(err, "read cluster at %d", cur)
+		}
+		read += int(n)
+	}
+	return read, eof
+}
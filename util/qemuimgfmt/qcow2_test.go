@@ -0,0 +1,194 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type sTestQcow2Options struct {
+	clusterBits uint32
+	// compressed are the virtual clusters stored compressed
+	compressed map[int64]bool
+	// zero are the virtual clusters with the zero flag
+	zero        map[int64]bool
+	backingFile string
+}
+
+// buildTestQcow2 builds a qcow2 v3 image of data with valid refcounts, the
+// clusters of zeros are not allocated
+func buildTestQcow2(data []byte, opts sTestQcow2Options) []byte {
+	clusterSize := int64(1) << opts.clusterBits
+	be := binary.BigEndian
+	clusters := (int64(len(data)) + clusterSize - 1) / clusterSize
+	l2Entries := clusterSize / 8
+	l1Size := (clusters + l2Entries - 1) / l2Entries
+
+	img := make([]byte, 4*clusterSize)
+	refcounts := map[int64]uint16{0: 1, 1: 1, 2: 1, 3: 1}
+	alloc := func(size int64) int64 {
+		offset := int64(len(img))
+		size = (size + clusterSize - 1) / clusterSize * clusterSize
+		img = append(img, make([]byte, size)...)
+		for c := offset / clusterSize; c < (offset+size)/clusterSize; c++ {
+			refcounts[c]++
+		}
+		return offset
+	}
+	l1 := make([]uint64, l1Size)
+	for i := int64(0); i < clusters; i++ {
+		chunk := data[i*clusterSize:]
+		if int64(len(chunk)) > clusterSize {
+			chunk = chunk[:clusterSize]
+		}
+		var entry uint64
+		switch {
+		case opts.zero[i]:
+			entry = qcow2FlagZero
+		case bytes.Count(chunk, []byte{0}) == len(chunk):
+			continue
+		case opts.compressed[i]:
+			var buf bytes.Buffer
+			w, _ := flate.NewWriter(&buf, flate.BestCompression)
+			w.Write(chunk)
+			w.Close()
+			offset := alloc(int64(buf.Len()))
+			copy(img[offset:], buf.Bytes())
+			x := 62 - (opts.clusterBits - 8)
+			sectors := uint64((int64(buf.Len())+511)/512 - 1)
+			entry = qcow2FlagCompressed | sectors<<x | uint64(offset)
+		default:
+			offset := alloc(clusterSize)
+			copy(img[offset:], chunk)
+			entry = qcow2FlagCopied | uint64(offset)
+		}
+		l1Index := i / l2Entries
+		if l1[l1Index] == 0 {
+			l1[l1Index] = qcow2FlagCopied | uint64(alloc(clusterSize))
+		}
+		l2Offset := int64(l1[l1Index] & qcow2OffsetMask)
+		be.PutUint64(img[l2Offset+(i%l2Entries)*8:], entry)
+	}
+
+	copy(img, QCOW2_MAGIC)
+	be.PutUint32(img[4:], 3)
+	be.PutUint32(img[20:], opts.clusterBits)
+	be.PutUint64(img[24:], uint64(len(data)))
+	be.PutUint32(img[36:], uint32(l1Size))
+	be.PutUint64(img[40:], uint64(3*clusterSize))
+	be.PutUint64(img[48:], uint64(clusterSize))
+	be.PutUint32(img[56:], 1)
+	be.PutUint32(img[96:], 4)
+	be.PutUint32(img[100:], 112)
+	ext := int64(112)
+	if len(opts.backingFile) > 0 {
+		be.PutUint32(img[ext:], qcow2ExtBackingFormat)
+		be.PutUint32(img[ext+4:], 5)
+		copy(img[ext+8:], "qcow2")
+		ext += 16
+		be.PutUint64(img[8:], uint64(ext+8))
+		be.PutUint32(img[16:], uint32(len(opts.backingFile)))
+		copy(img[ext+8:], opts.backingFile)
+	}
+	for i, entry := range l1 {
+		be.PutUint64(img[3*clusterSize+int64(i)*8:], entry)
+	}
+	be.PutUint64(img[clusterSize:], uint64(2*clusterSize))
+	for c, count := range refcounts {
+		be.PutUint16(img[2*clusterSize+c*2:], count)
+	}
+	return img
+}
+
+func newTestDisk(size int) []byte {
+	data := make([]byte, size)
+	for i := 0; i < size; i += 4096 {
+		// every other 64K is zero
+		if (i/65536)%2 == 0 {
+			binary.LittleEndian.PutUint64(data[i:], uint64(i)+1)
+			copy(data[i+8:], "qcow2 test data")
+		}
+	}
+	return data
+}
+
+func TestQcow2ReadAt(t *testing.T) {
+	data := newTestDisk(1024 * 1024)
+	raw := buildTestQcow2(data, sTestQcow2Options{
+		clusterBits: 16,
+		compressed:  map[int64]bool{2: true},
+		zero:        map[int64]bool{4: true},
+		backingFile: "base.qcow2",
+	})
+	data = append([]byte{}, data...)
+	for i := 4 * 65536; i < 5*65536; i++ {
+		data[i] = 0
+	}
+	if !IsQcow2(bytes.NewReader(raw)) {
+		t.Fatalf("not qcow2")
+	}
+	img, err := OpenQcow2(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("OpenQcow2: %s", err)
+	}
+	if img.Size() != int64(len(data)) || img.Header.ClusterSize() != 65536 || img.Header.Version != 3 {
+		t.Errorf("header: %#v", img.Header)
+	}
+	if img.BackingFile != "base.qcow2" || img.BackingFormat != "qcow2" {
+		t.Errorf("backing %q %q", img.BackingFile, img.BackingFormat)
+	}
+	got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content mismatch")
+	}
+
+	// unaligned read across clusters
+	buf := make([]byte, 70000)
+	if n, err := img.ReadAt(buf, 65536*2-100); err != nil || n != len(buf) || !bytes.Equal(buf, data[65536*2-100:65536*2-100+70000]) {
+		t.Errorf("unaligned read: %d %v", n, err)
+	}
+	if n, err := img.ReadAt(buf, img.Size()-10); err != io.EOF || n != 10 {
+		t.Errorf("read at end: %d %v", n, err)
+	}
+
+	// the unallocated clusters are read from the backing image
+	backing := bytes.Repeat([]byte{0xaa}, len(data))
+	img.SetBacking(bytes.NewReader(backing))
+	if _, err := img.ReadAt(buf[:16], 65536+8); err != nil || !bytes.Equal(buf[:16], backing[:16]) {
+		t.Errorf("backing read: %v %x", err, buf[:16])
+	}
+	if _, err := img.ReadAt(buf[:16], 4*65536); err != nil || !bytes.Equal(buf[:16], make([]byte, 16)) {
+		t.Errorf("zero cluster read from backing: %v %x", err, buf[:16])
+	}
+}
+
+func TestOpenQcow2Invalid(t *testing.T) {
+	if _, err := OpenQcow2(bytes.NewReader(make([]byte, 512))); err == nil {
+		t.Errorf("zero image should fail")
+	}
+	raw := buildTestQcow2(newTestDisk(65536), sTestQcow2Options{clusterBits: 16})
+	binary.BigEndian.PutUint32(raw[4:], 4)
+	if _, err := OpenQcow2(bytes.NewReader(raw)); err == nil {
+		t.Errorf("version 4 should fail")
+	}
+}
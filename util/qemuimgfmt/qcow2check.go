@@ -0,0 +1,376 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	qcow2OwnerHeader          = "header"
+	qcow2OwnerL1Table         = "L1 table"
+	qcow2OwnerL2Table         = "L2 table"
+	qcow2OwnerRefcountTable   = "refcount table"
+	qcow2OwnerRefcountBlock   = "refcount block"
+	qcow2OwnerData            = "data"
+	qcow2OwnerCompressed      = "compressed data"
+	qcow2OwnerSnapshotTable   = "snapshot table"
+	qcow2OwnerBitmapDirectory = "bitmap directory"
+	qcow2OwnerBitmapTable     = "bitmap table"
+	qcow2OwnerBitmapData      = "bitmap data"
+	qcow2OwnerCryptoHeader    = "encryption header"
+
+	qcow2RefcountTableOffsetMask = ^uint64(0x1ff)
+	qcow2BitmapTableOffsetMask   = 0x00fffffffffffe00
+	qcow2BitmapEntryFixedLen     = 24
+)
+
+// SQcow2ClusterError is a host cluster whose refcount does not match the
+// references of the metadata, or which is referenced by the metadata that
+// can not share clusters
+type SQcow2ClusterError struct {
+	Offset     int64
+	Refcount   uint64
+	References uint64
+	Owners     []string
+}
+
+func (e SQcow2ClusterError) String() string {
+	return fmt.Sprintf("cluster at 0x%x refcount=%d references=%d %v", e.Offset, e.Refcount, e.References, e.Owners)
+}
+
+// SQcow2CheckResult is the result of the consistency check as qemu-img
+// check, the refcounts of a dirty image of lazy refcounts are expected
+// to mismatch
+type SQcow2CheckResult struct {
+	// Leaks are the clusters of refcounts more than the references
+	Leaks []SQcow2ClusterError
+	// Corruptions are the clusters of refcounts less than the references
+	Corruptions []SQcow2ClusterError
+	// Overlaps are the clusters referenced by different metadata, or
+	// referenced twice by the same table
+	Overlaps []SQcow2ClusterError
+	// Errors are the invalid offsets in the metadata
+	Errors []string
+
+	TotalClusters      int64
+	AllocatedClusters  int64
+	CompressedClusters int64
+	ImageEndOffset     int64
+}
+
+func (r *SQcow2CheckResult) IsClean() bool {
+	return len(r.Leaks) == 0 && len(r.Corruptions) == 0 && len(r.Overlaps) == 0 && len(r.Errors) == 0
+}
+
+type sQcow2ClusterRef struct {
+	count  uint64
+	owner  string
+	source int
+	owners []string
+}
+
+// sQcow2Checker counts the references of the host clusters, the source of
+// a reference is the L1 table it is found by, 0 for the image-wide metadata
+type sQcow2Checker struct {
+	img      *SQcow2Image
+	fileSize int64
+	refs     map[int64]*sQcow2ClusterRef
+	result   *SQcow2CheckResult
+}
+
+// readerSize returns the size of the file, -1 if unknown
+func readerSize(r io.ReaderAt) int64 {
+	switch f := r.(type) {
+	case interface{ Size() int64 }:
+		return f.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if stat, err := f.Stat(); err == nil {
+			return stat.Size()
+		}
+	}
+	return -1
+}
+
+func (c *sQcow2Checker) errorf(format string, args ...interface{}) {
+	c.result.Errors = append(c.result.Errors, fmt.Sprintf(format, args...))
+}
+
+// reference counts a reference to the clusters of a host range, the L2
+// tables and the data can be shared by the L1 tables of the snapshots
+func (c *sQcow2Checker) reference(offset, length int64, owner string, source int) bool {
+	clusterSize := c.img.Header.ClusterSize()
+	if length <= 0 {
+		return true
+	}
+	if offset%clusterSize != 0 && owner != qcow2OwnerCompressed {
+		c.errorf("%s at 0x%x is not aligned to cluster", owner, offset)
+		return false
+	}
+	if offset < 0 || (c.fileSize >= 0 && offset >= c.fileSize) {
+		c.errorf("%s at 0x%x is out of the image file", owner, offset)
+		return false
+	}
+	for cluster := offset / clusterSize; cluster <= (offset+length-1)/clusterSize; cluster++ {
+		ref, ok := c.refs[cluster]
+		if !ok {
+			c.refs[cluster] = &sQcow2ClusterRef{count: 1, owner: owner, source: source}
+			continue
+		}
+		ref.count++
+		shared := ref.owner == owner && (owner == qcow2OwnerCompressed ||
+			(ref.source != source && (owner == qcow2OwnerL2Table || owner == qcow2OwnerData)))
+		if !shared {
+			if len(ref.owners) == 0 {
+				ref.owners = []string{ref.owner}
+			}
+			ref.owners = append(ref.owners, owner)
+		}
+	}
+	return true
+}
+
+func (c *sQcow2Checker) readTable(offset int64, count int, owner string, source int) ([]uint64, error) {
+	if !c.reference(offset, int64(count)*8, owner, source) {
+		return nil, nil
+	}
+	table, err := readUint64Table(c.img.r, offset, count)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s at 0x%x", owner, offset)
+	}
+	return table, nil
+}
+
+// checkL1 counts the L2 tables and the data clusters of an L1 table
+func (c *sQcow2Checker) checkL1(l1 []uint64, source int) error {
+	hdr := &c.img.Header
+	clusterSize := hdr.ClusterSize()
+	l2Entries := hdr.L2Entries()
+	dataInFile := hdr.IncompatibleFeatures&QCOW2_INCOMPAT_DATA_FILE == 0
+	for l1Index, l1Entry := range l1 {
+		l2Offset := int64(l1Entry & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		table, err := c.readTable(l2Offset, int(clusterSize/8), qcow2OwnerL2Table, source)
+		if err != nil || table == nil {
+			return err
+		}
+		for i := int64(0); i < l2Entries; i++ {
+			entry := table[i]
+			if hdr.ExtendedL2() {
+				entry = table[i*2]
+			}
+			switch {
+			case entry&qcow2FlagCompressed != 0:
+				x := 62 - (hdr.ClusterBits - 8)
+				offset := int64(entry & (uint64(1)<<x - 1))
+				sectors := int64((entry>>x)&(uint64(1)<<(hdr.ClusterBits-8)-1)) + 1
+				c.reference(offset, sectors*512-offset%512, qcow2OwnerCompressed, source)
+				if source == 1 {
+					c.result.CompressedClusters++
+					c.result.AllocatedClusters++
+				}
+			case entry&qcow2OffsetMask != 0:
+				if entry&^(qcow2FlagCopied|qcow2OffsetMask|qcow2FlagZero) != 0 {
+					c.errorf("L2 entry 0x%x of virtual cluster %d has reserved bits", entry, int64(l1Index)*l2Entries+i)
+				}
+				if dataInFile {
+					c.reference(int64(entry&qcow2OffsetMask), clusterSize, qcow2OwnerData, source)
+				}
+				if source == 1 {
+					c.result.AllocatedClusters++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *sQcow2Checker) checkBitmaps() error {
+	img := c.img
+	if img.bitmapDirectorySize == 0 {
+		return nil
+	}
+	if img.bitmapDirectorySize > 64*1024*1024 {
+		c.errorf("bitmap directory size %d", img.bitmapDirectorySize)
+		return nil
+	}
+	if !c.reference(int64(img.bitmapDirectoryOffset), int64(img.bitmapDirectorySize), qcow2OwnerBitmapDirectory, 0) {
+		return nil
+	}
+	dir := make([]byte, img.bitmapDirectorySize)
+	if _, err := img.r.ReadAt(dir, int64(img.bitmapDirectoryOffset)); err != nil {
+		return errors.Wrap(err, "read bitmap directory")
+	}
+	be := binary.BigEndian
+	for pos := 0; pos+qcow2BitmapEntryFixedLen <= len(dir); {
+		tableOffset := int64(be.Uint64(dir[pos:]))
+		tableSize := int(be.Uint32(dir[pos+8:]))
+		nameLen := int(be.Uint16(dir[pos+18:]))
+		extraLen := int(be.Uint32(dir[pos+20:]))
+		table, err := c.readTable(tableOffset, tableSize, qcow2OwnerBitmapTable, 0)
+		if err != nil {
+			return err
+		}
+		for _, entry := range table {
+			if offset := int64(entry & qcow2BitmapTableOffsetMask); offset != 0 {
+				c.reference(offset, img.Header.ClusterSize(), qcow2OwnerBitmapData, 0)
+			}
+		}
+		pos += (qcow2BitmapEntryFixedLen + extraLen + nameLen + 7) / 8 * 8
+	}
+	return nil
+}
+
+// refcounts decodes the refcounts of the host clusters of a refcount block
+func refcounts(block []byte, bits uint32) []uint64 {
+	counts := make([]uint64, uint32(len(block))*8/bits)
+	for i := range counts {
+		switch bits {
+		case 1, 2, 4:
+			perByte := 8 / bits
+			counts[i] = uint64(block[uint32(i)/perByte]>>(uint32(i)%perByte*bits)) & (1<<bits - 1)
+		case 8:
+			counts[i] = uint64(block[i])
+		case 16:
+			counts[i] = uint64(binary.BigEndian.Uint16(block[i*2:]))
+		case 32:
+			counts[i] = uint64(binary.BigEndian.Uint32(block[i*4:]))
+		case 64:
+			counts[i] = binary.BigEndian.Uint64(block[i*8:])
+		}
+	}
+	return counts
+}
+
+// Check verifies the refcounts of all clusters against the references of
+// the header, L1 and L2 tables, refcount structures, snapshots, bitmaps and
+// encryption header
+func (img *SQcow2Image) Check() (*SQcow2CheckResult, error) {
+	hdr := &img.Header
+	if hdr.RefcountOrder > 6 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "refcount order %d", hdr.RefcountOrder)
+	}
+	clusterSize := hdr.ClusterSize()
+	c := &sQcow2Checker{
+		img:      img,
+		fileSize: readerSize(img.r),
+		refs:     map[int64]*sQcow2ClusterRef{},
+		result: &SQcow2CheckResult{
+			TotalClusters: (int64(hdr.Size) + clusterSize - 1) / clusterSize,
+		},
+	}
+	// the header and its extensions are in the first cluster
+	c.refs[0] = &sQcow2ClusterRef{count: 1, owner: qcow2OwnerHeader}
+
+	refcountTable, err := c.readTable(int64(hdr.RefcountTableOffset), int(int64(hdr.RefcountTableClusters)*clusterSize/8), qcow2OwnerRefcountTable, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range refcountTable {
+		if offset := int64(entry & qcow2RefcountTableOffsetMask); offset != 0 {
+			c.reference(offset, clusterSize, qcow2OwnerRefcountBlock, 0)
+		}
+	}
+
+	if hdr.CryptMethod == QCOW2_CRYPT_LUKS && img.cryptoHeaderLength > 0 {
+		c.reference(int64(img.cryptoHeaderOffset), int64(img.cryptoHeaderLength), qcow2OwnerCryptoHeader, 0)
+	}
+	if err := c.checkBitmaps(); err != nil {
+		return nil, err
+	}
+
+	c.reference(int64(hdr.L1TableOffset), int64(hdr.L1Size)*8, qcow2OwnerL1Table, 1)
+	if err := c.checkL1(img.l1, 1); err != nil {
+		return nil, errors.Wrap(err, "active L1 table")
+	}
+	snapshots, tableSize, err := img.Snapshots()
+	if err != nil {
+		return nil, errors.Wrap(err, "read snapshot table")
+	}
+	c.reference(int64(hdr.SnapshotsOffset), tableSize, qcow2OwnerSnapshotTable, 0)
+	for i, snapshot := range snapshots {
+		if snapshot.L1Size > 32*1024*1024 {
+			c.errorf("snapshot %s L1 size %d", snapshot.Id, snapshot.L1Size)
+			continue
+		}
+		l1, err := c.readTable(int64(snapshot.L1TableOffset), int(snapshot.L1Size), qcow2OwnerL1Table, 2+i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "snapshot %s", snapshot.Id)
+		}
+		if err := c.checkL1(l1, 2+i); err != nil {
+			return nil, errors.Wrapf(err, "snapshot %s L1 table", snapshot.Id)
+		}
+	}
+
+	// compare with the refcounts
+	bits := uint32(1) << hdr.RefcountOrder
+	counts := map[int64]uint64{}
+	perBlock := clusterSize * 8 / int64(bits)
+	block := make([]byte, clusterSize)
+	for i, entry := range refcountTable {
+		offset := int64(entry & qcow2RefcountTableOffsetMask)
+		if offset == 0 || (c.fileSize >= 0 && offset >= c.fileSize) || offset%clusterSize != 0 {
+			continue
+		}
+		if _, err := img.r.ReadAt(block, offset); err != nil {
+			return nil, errors.Wrapf(err, "read refcount block at 0x%x", offset)
+		}
+		for j, count := range refcounts(block, bits) {
+			if count > 0 {
+				counts[int64(i)*perBlock+int64(j)] = count
+			}
+		}
+	}
+	clusters := map[int64]bool{}
+	for cluster := range counts {
+		clusters[cluster] = true
+	}
+	for cluster, ref := range c.refs {
+		clusters[cluster] = true
+		if end := (cluster + 1) * clusterSize; end > c.result.ImageEndOffset {
+			c.result.ImageEndOffset = end
+		}
+		if len(ref.owners) > 0 {
+			c.result.Overlaps = append(c.result.Overlaps, SQcow2ClusterError{Offset: cluster * clusterSize, Refcount: counts[cluster], References: ref.count, Owners: ref.owners})
+		}
+	}
+	for cluster := range clusters {
+		var references uint64
+		owners := []string{}
+		if ref, ok := c.refs[cluster]; ok {
+			references = ref.count
+			owners = append(owners, ref.owner)
+		}
+		clusterErr := SQcow2ClusterError{Offset: cluster * clusterSize, Refcount: counts[cluster], References: references, Owners: owners}
+		switch {
+		case clusterErr.Refcount > references:
+			c.result.Leaks = append(c.result.Leaks, clusterErr)
+		case clusterErr.Refcount < references:
+			c.result.Corruptions = append(c.result.Corruptions, clusterErr)
+		}
+	}
+	for _, errs := range [][]SQcow2ClusterError{c.result.Leaks, c.result.Corruptions, c.result.Overlaps} {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Offset < errs[j].Offset })
+	}
+	return c.result, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func checkTestQcow2(t *testing.T, raw []byte) *SQcow2CheckResult {
+	img, err := OpenQcow2(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("OpenQcow2: %v", err)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	return result
+}
+
+func TestQcow2Check(t *testing.T) {
+	const clusterSize = 65536
+	opts := sTestQcow2Options{
+		clusterBits: 16,
+		compressed:  map[int64]bool{2: true},
+		zero:        map[int64]bool{5: true},
+	}
+	raw := buildTestQcow2(newTestDisk(8*clusterSize), opts)
+	result := checkTestQcow2(t, raw)
+	if !result.IsClean() {
+		t.Errorf("clean image: %+v", result)
+	}
+	if result.TotalClusters != 8 || result.AllocatedClusters != 4 || result.CompressedClusters != 1 || result.ImageEndOffset != int64(len(raw)) {
+		t.Errorf("clusters %+v", result)
+	}
+
+	// the clusters shared with a snapshot
+	if result := checkTestQcow2(t, addTestSnapshot(append([]byte{}, raw...), "1", "snap")); !result.IsClean() {
+		t.Errorf("image with snapshot: %+v", result)
+	}
+
+	be := binary.BigEndian
+	// a cluster of refcount 1 not referenced
+	leaked := append(append([]byte{}, raw...), make([]byte, clusterSize)...)
+	be.PutUint16(leaked[2*clusterSize+int64(len(raw))/clusterSize*2:], 1)
+	result = checkTestQcow2(t, leaked)
+	if len(result.Leaks) != 1 || result.Leaks[0].Offset != int64(len(raw)) || len(result.Corruptions) != 0 || len(result.Overlaps) != 0 {
+		t.Errorf("leaked image: %+v", result)
+	}
+
+	// a data cluster mapped onto the L1 table
+	overlapped := append([]byte{}, raw...)
+	l2Offset := int64(be.Uint64(overlapped[3*clusterSize:]) & qcow2OffsetMask)
+	be.PutUint64(overlapped[l2Offset+8:], qcow2FlagCopied|3*clusterSize)
+	result = checkTestQcow2(t, overlapped)
+	if len(result.Overlaps) != 1 || result.Overlaps[0].Offset != 3*clusterSize || len(result.Overlaps[0].Owners) != 2 {
+		t.Errorf("overlapped image: %+v", result)
+	}
+	if len(result.Corruptions) != 1 || result.Corruptions[0].Refcount != 1 || result.Corruptions[0].References != 2 {
+		t.Errorf("overlapped image refcount: %+v", result.Corruptions)
+	}
+
+	// an L2 entry out of the file
+	outside := append([]byte{}, raw...)
+	be.PutUint64(outside[l2Offset+8:], qcow2FlagCopied|uint64(len(raw)+clusterSize))
+	if result := checkTestQcow2(t, outside); len(result.Errors) != 1 {
+		t.Errorf("image of an invalid offset: %+v", result)
+	}
+}
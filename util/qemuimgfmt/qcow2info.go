@@ -0,0 +1,303 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+type TQcow2ClusterType string
+
+const (
+	QCOW2_CLUSTER_UNALLOCATED = TQcow2ClusterType("unallocated")
+	QCOW2_CLUSTER_ZERO        = TQcow2ClusterType("zero")
+	QCOW2_CLUSTER_NORMAL      = TQcow2ClusterType("normal")
+	QCOW2_CLUSTER_COMPRESSED  = TQcow2ClusterType("compressed")
+
+	QCOW2_FEATURE_INCOMPATIBLE = 0
+	QCOW2_FEATURE_COMPATIBLE   = 1
+	QCOW2_FEATURE_AUTOCLEAR    = 2
+
+	// the limit of qemu
+	qcow2MaxSnapshots     = 65536
+	qcow2SnapshotFixedLen = 40
+)
+
+// qcow2FeatureNames are the names of the feature bits known by qemu, an
+// image may name them in the feature name table extension
+var qcow2FeatureNames = map[[2]uint8]string{
+	{QCOW2_FEATURE_INCOMPATIBLE, 0}: "dirty bit",
+	{QCOW2_FEATURE_INCOMPATIBLE, 1}: "corrupt bit",
+	{QCOW2_FEATURE_INCOMPATIBLE, 2}: "external data file",
+	{QCOW2_FEATURE_INCOMPATIBLE, 3}: "compression type",
+	{QCOW2_FEATURE_INCOMPATIBLE, 4}: "extended L2 entries",
+	{QCOW2_FEATURE_COMPATIBLE, 0}:   "lazy refcounts",
+	{QCOW2_FEATURE_AUTOCLEAR, 0}:    "bitmaps",
+	{QCOW2_FEATURE_AUTOCLEAR, 1}:    "raw external data",
+}
+
+type SQcow2Snapshot struct {
+	Id            string
+	Name          string
+	L1TableOffset uint64
+	L1Size        uint32
+	VmStateSize   uint64
+	// DiskSize is the virtual size when the snapshot was taken, 0 if not
+	// recorded
+	DiskSize uint64
+	Date     time.Time
+	VmClock  time.Duration
+}
+
+// SQcow2Info is the metadata of a qcow2 image as shown by qemu-img info
+type SQcow2Info struct {
+	Version       uint32
+	VirtualSize   int64
+	ClusterSize   int64
+	RefcountBits  int
+	BackingFile   string
+	BackingFormat string
+	DataFile      string
+	// CompressionType is zlib or zstd
+	CompressionType string
+	Encrypted       bool
+	// EncryptFormat is aes or luks
+	EncryptFormat string
+
+	Dirty         bool
+	Corrupt       bool
+	LazyRefcounts bool
+	ExtendedL2    bool
+
+	IncompatibleFeatures []string
+	CompatibleFeatures   []string
+	AutoclearFeatures    []string
+
+	Snapshots []SQcow2Snapshot
+}
+
+// SQcow2Extent is a range of the virtual disk of the same cluster type,
+// Offset is the host offset of the normal clusters
+type SQcow2Extent struct {
+	Start  int64
+	Length int64
+	Type   TQcow2ClusterType
+	Offset int64
+}
+
+func (img *SQcow2Image) featureName(featureType, bit uint8) string {
+	if name, ok := img.featureNames[[2]uint8{featureType, bit}]; ok && len(name) > 0 {
+		return name
+	}
+	if name, ok := qcow2FeatureNames[[2]uint8{featureType, bit}]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown feature bit %d", bit)
+}
+
+func (img *SQcow2Image) featureList(featureType uint8, bits uint64) []string {
+	names := []string{}
+	for bit := uint8(0); bit < 64; bit++ {
+		if bits&(uint64(1)<<bit) != 0 {
+			names = append(names, img.featureName(featureType, bit))
+		}
+	}
+	return names
+}
+
+// InspectQcow2 reads the metadata of a qcow2 image
+func InspectQcow2(r io.ReaderAt) (*SQcow2Info, error) {
+	img, err := OpenQcow2(r)
+	if err != nil {
+		return nil, err
+	}
+	return img.Info()
+}
+
+func (img *SQcow2Image) Info() (*SQcow2Info, error) {
+	hdr := &img.Header
+	info := &SQcow2Info{
+		Version:       hdr.Version,
+		VirtualSize:   int64(hdr.Size),
+		ClusterSize:   hdr.ClusterSize(),
+		RefcountBits:  1 << hdr.RefcountOrder,
+		BackingFile:   img.BackingFile,
+		BackingFormat: img.BackingFormat,
+		DataFile:      img.DataFile,
+		Encrypted:     hdr.CryptMethod != QCOW2_CRYPT_NONE,
+
+		Dirty:         hdr.IncompatibleFeatures&QCOW2_INCOMPAT_DIRTY != 0,
+		Corrupt:       hdr.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT != 0,
+		LazyRefcounts: hdr.CompatibleFeatures&QCOW2_COMPAT_LAZY_REFCOUNTS != 0,
+		ExtendedL2:    hdr.ExtendedL2(),
+
+		IncompatibleFeatures: img.featureList(QCOW2_FEATURE_INCOMPATIBLE, hdr.IncompatibleFeatures),
+		CompatibleFeatures:   img.featureList(QCOW2_FEATURE_COMPATIBLE, hdr.CompatibleFeatures),
+		AutoclearFeatures:    img.featureList(QCOW2_FEATURE_AUTOCLEAR, hdr.AutoclearFeatures),
+	}
+	switch hdr.CompressionType {
+	case QCOW2_COMPRESSION_ZLIB:
+		info.CompressionType = "zlib"
+	case QCOW2_COMPRESSION_ZSTD:
+		info.CompressionType = "zstd"
+	}
+	switch hdr.CryptMethod {
+	case QCOW2_CRYPT_AES:
+		info.EncryptFormat = "aes"
+	case QCOW2_CRYPT_LUKS:
+		info.EncryptFormat = "luks"
+	}
+	snapshots, _, err := img.Snapshots()
+	if err != nil {
+		return nil, errors.Wrap(err, "read snapshot table")
+	}
+	info.Snapshots = snapshots
+	return info, nil
+}
+
+// Snapshots reads the snapshot table, and returns its size in bytes
+func (img *SQcow2Image) Snapshots() ([]SQcow2Snapshot, int64, error) {
+	hdr := &img.Header
+	if hdr.NbSnapshots == 0 {
+		return nil, 0, nil
+	}
+	if hdr.NbSnapshots > qcow2MaxSnapshots {
+		return nil, 0, errors.Wrapf(errors.ErrInvalidFormat, "%d snapshots", hdr.NbSnapshots)
+	}
+	be := binary.BigEndian
+	snapshots := make([]SQcow2Snapshot, 0, hdr.NbSnapshots)
+	offset := int64(hdr.SnapshotsOffset)
+	for i := uint32(0); i < hdr.NbSnapshots; i++ {
+		buf := make([]byte, qcow2SnapshotFixedLen)
+		if _, err := img.r.ReadAt(buf, offset); err != nil {
+			return nil, 0, errors.Wrapf(err, "read snapshot %d", i)
+		}
+		idLen := int64(be.Uint16(buf[12:]))
+		nameLen := int64(be.Uint16(buf[14:]))
+		extraLen := int64(be.Uint32(buf[36:]))
+		if extraLen > 1024 {
+			return nil, 0, errors.Wrapf(errors.ErrInvalidFormat, "snapshot %d extra data size %d", i, extraLen)
+		}
+		snapshot := SQcow2Snapshot{
+			L1TableOffset: be.Uint64(buf[0:]),
+			L1Size:        be.Uint32(buf[8:]),
+			Date:          time.Unix(int64(be.Uint32(buf[16:])), int64(be.Uint32(buf[20:]))),
+			VmClock:       time.Duration(be.Uint64(buf[24:])),
+			VmStateSize:   uint64(be.Uint32(buf[32:])),
+		}
+		rest := make([]byte, extraLen+idLen+nameLen)
+		if _, err := img.r.ReadAt(rest, offset+qcow2SnapshotFixedLen); err != nil {
+			return nil, 0, errors.Wrapf(err, "read snapshot %d", i)
+		}
+		if extraLen >= 8 {
+			snapshot.VmStateSize = be.Uint64(rest)
+		}
+		if extraLen >= 16 {
+			snapshot.DiskSize = be.Uint64(rest[8:])
+		}
+		snapshot.Id = string(rest[extraLen : extraLen+idLen])
+		snapshot.Name = string(rest[extraLen+idLen:])
+		snapshots = append(snapshots, snapshot)
+		offset += (qcow2SnapshotFixedLen + int64(len(rest)) + 7) / 8 * 8
+	}
+	return snapshots, offset - int64(hdr.SnapshotsOffset), nil
+}
+
+// clusterType returns the type and host offset of an L2 entry, the
+// subclusters of extended L2 are of the type of the bit
+func (img *SQcow2Image) clusterType(entry, bitmap uint64, sub int) (TQcow2ClusterType, int64) {
+	switch {
+	case entry&qcow2FlagCompressed != 0:
+		return QCOW2_CLUSTER_COMPRESSED, 0
+	case img.Header.ExtendedL2():
+		switch {
+		case bitmap&(uint64(1)<<(32+sub)) != 0:
+			return QCOW2_CLUSTER_ZERO, 0
+		case bitmap&(uint64(1)<<sub) != 0:
+			return QCOW2_CLUSTER_NORMAL, int64(entry & qcow2OffsetMask)
+		}
+	case entry&qcow2FlagZero != 0 && img.Header.Version >= 3:
+		return QCOW2_CLUSTER_ZERO, 0
+	case entry&qcow2OffsetMask != 0:
+		return QCOW2_CLUSTER_NORMAL, int64(entry & qcow2OffsetMask)
+	}
+	return QCOW2_CLUSTER_UNALLOCATED, 0
+}
+
+// AllocationMap maps the virtual disk by the L1 and L2 tables as qemu-img
+// map, the adjacent extents of the same type and contiguous host offsets
+// are merged
+func (img *SQcow2Image) AllocationMap() ([]SQcow2Extent, error) {
+	hdr := &img.Header
+	size := img.Size()
+	clusterSize := hdr.ClusterSize()
+	l2Entries := hdr.L2Entries()
+	subclusters, subSize := 1, clusterSize
+	if hdr.ExtendedL2() {
+		subclusters, subSize = 32, clusterSize/32
+	}
+	extents := []SQcow2Extent{}
+	add := func(start, length int64, clusterType TQcow2ClusterType, offset int64) {
+		if start+length > size {
+			length = size - start
+		}
+		if length <= 0 {
+			return
+		}
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if last.Type == clusterType && last.Start+last.Length == start &&
+				(clusterType != QCOW2_CLUSTER_NORMAL || last.Offset+last.Length == offset) {
+				last.Length += length
+				return
+			}
+		}
+		extents = append(extents, SQcow2Extent{Start: start, Length: length, Type: clusterType, Offset: offset})
+	}
+	for l1Index, l1Entry := range img.l1 {
+		start := int64(l1Index) * l2Entries * clusterSize
+		if start >= size {
+			break
+		}
+		l2Offset := l1Entry & qcow2OffsetMask
+		if l2Offset == 0 {
+			add(start, l2Entries*clusterSize, QCOW2_CLUSTER_UNALLOCATED, 0)
+			continue
+		}
+		table, err := readUint64Table(img.r, int64(l2Offset), int(clusterSize/8))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read L2 table at %d", l2Offset)
+		}
+		for i := int64(0); i < l2Entries && start+i*clusterSize < size; i++ {
+			entry, bitmap := table[i], uint64(0)
+			if hdr.ExtendedL2() {
+				entry, bitmap = table[i*2], table[i*2+1]
+			}
+			for sub := 0; sub < subclusters; sub++ {
+				clusterType, offset := img.clusterType(entry, bitmap, sub)
+				if offset > 0 {
+					offset += int64(sub) * subSize
+				}
+				add(start+i*clusterSize+int64(sub)*subSize, subSize, clusterType, offset)
+			}
+		}
+	}
+	return extents, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// addTestSnapshot adds a snapshot of the active L1 table to an image of
+// buildTestQcow2, and increases the refcounts of the clusters it shares
+func addTestSnapshot(img []byte, id, name string) []byte {
+	be := binary.BigEndian
+	clusterBits := be.Uint32(img[20:])
+	clusterSize := int64(1) << clusterBits
+	l1Offset := int64(be.Uint64(img[40:]))
+	l1Size := int64(be.Uint32(img[36:]))
+	incref := func(offset int64) {
+		pos := 2*clusterSize + offset/clusterSize*2
+		be.PutUint16(img[pos:], be.Uint16(img[pos:])+1)
+	}
+	for i := int64(0); i < l1Size; i++ {
+		l2Offset := int64(be.Uint64(img[l1Offset+i*8:]) & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		incref(l2Offset)
+		for j := int64(0); j < clusterSize/8; j++ {
+			entry := be.Uint64(img[l2Offset+j*8:])
+			switch {
+			case entry&qcow2FlagCompressed != 0:
+				// a compressed cluster of buildTestQcow2 is within a host cluster
+				incref(int64(entry & (uint64(1)<<(62-(clusterBits-8)) - 1)))
+			case entry&qcow2OffsetMask != 0:
+				incref(int64(entry & qcow2OffsetMask))
+			}
+			// the shared clusters are not copied
+			be.PutUint64(img[l2Offset+j*8:], entry&^qcow2FlagCopied)
+		}
+	}
+	snapshotL1 := int64(len(img))
+	img = append(img, make([]byte, clusterSize)...)
+	copy(img[snapshotL1:], img[l1Offset:l1Offset+l1Size*8])
+	incref(snapshotL1)
+
+	table := int64(len(img))
+	img = append(img, make([]byte, clusterSize)...)
+	entry := img[table:]
+	be.PutUint64(entry[0:], uint64(snapshotL1))
+	be.PutUint32(entry[8:], uint32(l1Size))
+	be.PutUint16(entry[12:], uint16(len(id)))
+	be.PutUint16(entry[14:], uint16(len(name)))
+	be.PutUint32(entry[16:], 1700000000)
+	be.PutUint32(entry[36:], 16)
+	be.PutUint64(entry[48:], be.Uint64(img[24:]))
+	copy(entry[56:], id)
+	copy(entry[56+len(id):], name)
+	incref(table)
+
+	be.PutUint32(img[60:], 1)
+	be.PutUint64(img[64:], uint64(table))
+	return img
+}
+
+func TestQcow2Info(t *testing.T) {
+	raw := buildTestQcow2(newTestDisk(1024*1024), sTestQcow2Options{
+		clusterBits: 16,
+		backingFile: "base.qcow2",
+	})
+	raw = addTestSnapshot(raw, "1", "before upgrade")
+	binary.BigEndian.PutUint64(raw[72:], QCOW2_INCOMPAT_DIRTY)
+	binary.BigEndian.PutUint64(raw[80:], QCOW2_COMPAT_LAZY_REFCOUNTS)
+	info, err := InspectQcow2(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("InspectQcow2: %v", err)
+	}
+	if info.Version != 3 || info.VirtualSize != 1024*1024 || info.ClusterSize != 65536 || info.RefcountBits != 16 ||
+		info.BackingFile != "base.qcow2" || info.BackingFormat != "qcow2" || info.CompressionType != "zlib" || info.Encrypted {
+		t.Errorf("info %#v", info)
+	}
+	if !info.Dirty || info.Corrupt || !info.LazyRefcounts || info.ExtendedL2 {
+		t.Errorf("flags %#v", info)
+	}
+	if !reflect.DeepEqual(info.IncompatibleFeatures, []string{"dirty bit"}) || !reflect.DeepEqual(info.CompatibleFeatures, []string{"lazy refcounts"}) {
+		t.Errorf("features %v %v", info.IncompatibleFeatures, info.CompatibleFeatures)
+	}
+	if len(info.Snapshots) != 1 {
+		t.Fatalf("snapshots %#v", info.Snapshots)
+	}
+	snapshot := info.Snapshots[0]
+	if snapshot.Id != "1" || snapshot.Name != "before upgrade" || snapshot.L1Size != 1 || snapshot.DiskSize != 1024*1024 || snapshot.Date.Unix() != 1700000000 {
+		t.Errorf("snapshot %#v", snapshot)
+	}
+}
+
+func TestQcow2AllocationMap(t *testing.T) {
+	raw := buildTestQcow2(newTestDisk(8*65536), sTestQcow2Options{
+		clusterBits: 16,
+		compressed:  map[int64]bool{2: true},
+		zero:        map[int64]bool{5: true},
+	})
+	img, err := OpenQcow2(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("OpenQcow2: %v", err)
+	}
+	extents, err := img.AllocationMap()
+	if err != nil {
+		t.Fatalf("AllocationMap: %v", err)
+	}
+	// clusters 0, 2, 4 and 6 have data, 2 compressed and 5 zero
+	want := []SQcow2Extent{
+		{Start: 0, Length: 65536, Type: QCOW2_CLUSTER_NORMAL, Offset: 4 * 65536},
+		{Start: 65536, Length: 65536, Type: QCOW2_CLUSTER_UNALLOCATED},
+		{Start: 2 * 65536, Length: 65536, Type: QCOW2_CLUSTER_COMPRESSED},
+		{Start: 3 * 65536, Length: 65536, Type: QCOW2_CLUSTER_UNALLOCATED},
+		{Start: 4 * 65536, Length: 65536, Type: QCOW2_CLUSTER_NORMAL, Offset: 7 * 65536},
+		{Start: 5 * 65536, Length: 65536, Type: QCOW2_CLUSTER_ZERO},
+		{Start: 6 * 65536, Length: 65536, Type: QCOW2_CLUSTER_NORMAL, Offset: 8 * 65536},
+		{Start: 7 * 65536, Length: 65536, Type: QCOW2_CLUSTER_UNALLOCATED},
+	}
+	if !reflect.DeepEqual(extents, want) {
+		t.Errorf("AllocationMap:\n got %+v\nwant %+v", extents, want)
+	}
+}
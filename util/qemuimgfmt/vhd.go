@@ -0,0 +1,330 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+/*
+ * VHD
+ * Reference: Virtual Hard Disk Image Format Specification
+ *
+ */
+
+const (
+	VHD_COOKIE         = "conectix"
+	VHD_DYNAMIC_COOKIE = "cxsparse"
+
+	VHD_TYPE_FIXED        = 2
+	VHD_TYPE_DYNAMIC      = 3
+	VHD_TYPE_DIFFERENCING = 4
+
+	vhdFooterSize        = 512
+	vhdDynamicHeaderSize = 1024
+	vhdSectorSize        = 512
+	vhdBatUnused         = 0xffffffff
+	vhdMaxBlockSize      = 256 * 1024 * 1024
+	vhdBitmapCacheSize   = 64
+
+	// vhdMaxBatEntries covers the maximum 2040 GiB of the spec with the
+	// default block size of 2 MiB many times over
+	vhdMaxBatEntries = 16 * 1024 * 1024
+)
+
+type SVHDFooter struct {
+	Features      uint32
+	FormatVersion uint32
+	DataOffset    uint64
+	Timestamp     uint32
+	CreatorApp    string
+	OriginalSize  uint64
+	CurrentSize   uint64
+	Cylinders     uint16
+	Heads         uint8
+	Sectors       uint8
+	DiskType      uint32
+	Checksum      uint32
+	UniqueId      [16]byte
+}
+
+func (f *SVHDFooter) Subformat() string {
+	switch f.DiskType {
+	case VHD_TYPE_DYNAMIC:
+		return VHD_SUBFORMAT_DYNAMIC
+	case VHD_TYPE_DIFFERENCING:
+		return VHD_SUBFORMAT_DIFFERENCING
+	}
+	return VHD_SUBFORMAT_FIXED
+}
+
+func parseVHDFooter(buf []byte) (*SVHDFooter, error) {
+	if len(buf) < vhdFooterSize-1 || string(buf[:8]) != VHD_COOKIE {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not vhd")
+	}
+	be := binary.BigEndian
+	footer := &SVHDFooter{
+		Features:      be.Uint32(buf[8:]),
+		FormatVersion: be.Uint32(buf[12:]),
+		DataOffset:    be.Uint64(buf[16:]),
+		Timestamp:     be.Uint32(buf[24:]),
+		CreatorApp:    strings.TrimRight(string(buf[28:32]), "\x00 "),
+		OriginalSize:  be.Uint64(buf[40:]),
+		CurrentSize:   be.Uint64(buf[48:]),
+		Cylinders:     be.Uint16(buf[56:]),
+		Heads:         buf[58],
+		Sectors:       buf[59],
+		DiskType:      be.Uint32(buf[60:]),
+		Checksum:      be.Uint32(buf[64:]),
+	}
+	copy(footer.UniqueId[:], buf[68:84])
+	switch footer.DiskType {
+	case VHD_TYPE_FIXED, VHD_TYPE_DYNAMIC, VHD_TYPE_DIFFERENCING:
+	default:
+		return nil, errors.Wrapf(errors.ErrNotSupported, "vhd disk type %d", footer.DiskType)
+	}
+	return footer, nil
+}
+
+// readVHDFooter reads the footer at the end, the footers of some old
+// images are of 511 bytes
+func readVHDFooter(r io.ReaderAt, size int64) (*SVHDFooter, error) {
+	for _, footerSize := range []int64{vhdFooterSize, vhdFooterSize - 1} {
+		if size < footerSize {
+			break
+		}
+		buf := make([]byte, vhdFooterSize)
+		if _, err := r.ReadAt(buf[:footerSize], size-footerSize); err != nil {
+			return nil, errors.Wrap(err, "read vhd footer")
+		}
+		if footer, err := parseVHDFooter(buf); err == nil {
+			return footer, nil
+		}
+	}
+	return nil, errors.Wrap(errors.ErrInvalidFormat, "no vhd footer")
+}
+
+// SVHDImage reads the virtual disk of a VHD image, the sectors not present
+// in a differencing image are read from the parent image
+type SVHDImage struct {
+	Footer SVHDFooter
+
+	BlockSize  uint32
+	ParentName string
+
+	r       io.ReaderAt
+	backing io.ReaderAt
+	bat     []uint32
+
+	lock        sync.Mutex
+	bitmapCache map[uint32][]byte
+	bitmapOrder []uint32
+}
+
+// OpenVHD reads the footer, dynamic disk header and block allocation
+// table of a VHD image of the size
+func OpenVHD(r io.ReaderAt, size int64) (*SVHDImage, error) {
+	footer, err := readVHDFooter(r, size)
+	if err != nil {
+		// the copy at the beginning of a dynamic disk
+		head := make([]byte, vhdFooterSize)
+		if _, err2 := r.ReadAt(head, 0); err2 != nil {
+			return nil, err
+		}
+		if footer, err = parseVHDFooter(head); err != nil {
+			return nil, err
+		}
+	}
+	img := &SVHDImage{Footer: *footer, r: r, bitmapCache: map[uint32][]byte{}}
+	if footer.DiskType == VHD_TYPE_FIXED {
+		if int64(footer.CurrentSize) > size-vhdFooterSize+1 {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "fixed vhd of size %d in file of %d", footer.CurrentSize, size)
+		}
+		return img, nil
+	}
+	hdr := make([]byte, vhdDynamicHeaderSize)
+	if _, err := r.ReadAt(hdr, int64(footer.DataOffset)); err != nil {
+		return nil, errors.Wrap(err, "read dynamic disk header")
+	}
+	if string(hdr[:8]) != VHD_DYNAMIC_COOKIE {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "dynamic disk header cookie")
+	}
+	be := binary.BigEndian
+	batOffset := int64(be.Uint64(hdr[16:]))
+	batEntries := be.Uint32(hdr[28:])
+	img.BlockSize = be.Uint32(hdr[32:])
+	if img.BlockSize < vhdSectorSize || img.BlockSize > vhdMaxBlockSize || img.BlockSize&(img.BlockSize-1) != 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "block size %d", img.BlockSize)
+	}
+	if batEntries > vhdMaxBatEntries || batOffset < 0 || batOffset+int64(batEntries)*4 > size {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "block allocation table of %d entries at %d", batEntries, batOffset)
+	}
+	if int64(batEntries)*int64(img.BlockSize) < int64(footer.CurrentSize) {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "%d blocks less than size %d", batEntries, footer.CurrentSize)
+	}
+	parentName := make([]uint16, 0, 256)
+	for i := 64; i < 64+512; i += 2 {
+		c := be.Uint16(hdr[i:])
+		if c == 0 {
+			break
+		}
+		parentName = append(parentName, c)
+	}
+	img.ParentName = string(utf16.Decode(parentName))
+	buf := make([]byte, int64(batEntries)*4)
+	if _, err := r.ReadAt(buf, batOffset); err != nil {
+		return nil, errors.Wrap(err, "read block allocation table")
+	}
+	img.bat = make([]uint32, batEntries)
+	for i := range img.bat {
+		img.bat[i] = be.Uint32(buf[i*4:])
+	}
+	return img, nil
+}
+
+// SetBacking sets the parent image of a differencing image
+func (img *SVHDImage) SetBacking(backing io.ReaderAt) {
+	img.backing = backing
+}
+
+func (img *SVHDImage) Size() int64 {
+	return int64(img.Footer.CurrentSize)
+}
+
+// bitmapSize is the size of the sector bitmap before the data of a block,
+// padded to sectors
+func (img *SVHDImage) bitmapSize() int64 {
+	bytes := int64(img.BlockSize) / vhdSectorSize / 8
+	return (bytes + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+}
+
+func (img *SVHDImage) bitmap(sector uint32) ([]byte, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	if bitmap, ok := img.bitmapCache[sector]; ok {
+		return bitmap, nil
+	}
+	bitmap := make([]byte, img.bitmapSize())
+	if _, err := img.r.ReadAt(bitmap, int64(sector)*vhdSectorSize); err != nil {
+		return nil, err
+	}
+	if len(img.bitmapOrder) >= vhdBitmapCacheSize {
+		delete(img.bitmapCache, img.bitmapOrder[0])
+		img.bitmapOrder = img.bitmapOrder[1:]
+	}
+	img.bitmapCache[sector] = bitmap
+	img.bitmapOrder = append(img.bitmapOrder, sector)
+	return bitmap, nil
+}
+
+func (img *SVHDImage) readAbsent(buf []byte, off int64) error {
+	if img.backing == nil {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+	n, err := img.backing.ReadAt(buf, off)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+// readSectors reads within a block of a differencing disk, the sectors
+// are present in the block or in the parent by the bitmap
+func (img *SVHDImage) readSectors(buf []byte, off int64, blockSector uint32, inBlock int64) error {
+	bitmap, err := img.bitmap(blockSector)
+	if err != nil {
+		return errors.Wrap(err, "read bitmap")
+	}
+	present := func(sector int64) bool {
+		return bitmap[sector/8]&(0x80>>uint(sector%8)) != 0
+	}
+	for len(buf) > 0 {
+		sector := inBlock / vhdSectorSize
+		n := vhdSectorSize - inBlock%vhdSectorSize
+		// the following sectors of the same state are read at once
+		for int64(len(buf)) > n && present((inBlock+n)/vhdSectorSize) == present(sector) {
+			n += vhdSectorSize
+		}
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if present(sector) {
+			if _, err := img.r.ReadAt(buf[:n], int64(blockSector)*vhdSectorSize+img.bitmapSize()+inBlock); err != nil {
+				return err
+			}
+		} else if err := img.readAbsent(buf[:n], off); err != nil {
+			return err
+		}
+		buf, off, inBlock = buf[n:], off+n, inBlock+n
+	}
+	return nil
+}
+
+func (img *SVHDImage) ReadAt(p []byte, off int64) (int, error) {
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	if img.Footer.DiskType == VHD_TYPE_FIXED {
+		n, err := img.r.ReadAt(p, off)
+		if err == nil {
+			err = eof
+		}
+		return n, err
+	}
+	read := 0
+	for read < len(p) {
+		cur := off + int64(read)
+		block := cur / int64(img.BlockSize)
+		inBlock := cur % int64(img.BlockSize)
+		n := int64(img.BlockSize) - inBlock
+		if n > int64(len(p)-read) {
+			n = int64(len(p) - read)
+		}
+		blockSector := img.bat[block]
+		var err error
+		switch {
+		case blockSector == vhdBatUnused:
+			err = img.readAbsent(p[read:read+int(n)], cur)
+		case img.Footer.DiskType == VHD_TYPE_DIFFERENCING:
+			err = img.readSectors(p[read:read+int(n)], cur, blockSector, inBlock)
+		default:
+			// the bitmap of dynamic disks is ignored as qemu
+			_, err = img.r.ReadAt(p[read:read+int(n)], int64(blockSector)*vhdSectorSize+img.bitmapSize()+inBlock)
+		}
+		if err != nil {
+			return read, errors.Wrapf(err, "read block %d", block)
+		}
+		read += int(n)
+	}
+	return read, eof
+}
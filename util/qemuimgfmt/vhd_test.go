@@ -0,0 +1,174 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"unicode/utf16"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func buildTestVHDFooter(diskType uint32, size int64, dataOffset uint64) []byte {
+	be := binary.BigEndian
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, VHD_COOKIE)
+	be.PutUint32(footer[8:], 2)
+	be.PutUint32(footer[12:], 0x00010000)
+	be.PutUint64(footer[16:], dataOffset)
+	copy(footer[28:], "test")
+	be.PutUint64(footer[40:], uint64(size))
+	be.PutUint64(footer[48:], uint64(size))
+	be.PutUint32(footer[60:], diskType)
+	sum := uint32(0)
+	for _, b := range footer {
+		sum += uint32(b)
+	}
+	be.PutUint32(footer[64:], ^sum)
+	return footer
+}
+
+// buildTestVHD builds a dynamic or differencing VHD image of data, the
+// blocks of zeros are not allocated, the sectors of zeros of a differencing
+// image are not present
+func buildTestVHD(data []byte, diskType uint32, blockSize int64, parentName string) []byte {
+	if diskType == VHD_TYPE_FIXED {
+		return append(append([]byte{}, data...), buildTestVHDFooter(diskType, int64(len(data)), ^uint64(0))...)
+	}
+	be := binary.BigEndian
+	blocks := (int64(len(data)) + blockSize - 1) / blockSize
+	batSize := (blocks*4 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+	bitmapSize := (blockSize/vhdSectorSize/8 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+
+	footer := buildTestVHDFooter(diskType, int64(len(data)), vhdFooterSize)
+	img := append([]byte{}, footer...)
+	hdr := make([]byte, vhdDynamicHeaderSize)
+	copy(hdr, VHD_DYNAMIC_COOKIE)
+	be.PutUint64(hdr[8:], ^uint64(0))
+	be.PutUint64(hdr[16:], vhdFooterSize+vhdDynamicHeaderSize)
+	be.PutUint32(hdr[24:], 0x00010000)
+	be.PutUint32(hdr[28:], uint32(blocks))
+	be.PutUint32(hdr[32:], uint32(blockSize))
+	for i, c := range utf16.Encode([]rune(parentName)) {
+		be.PutUint16(hdr[64+2*i:], c)
+	}
+	img = append(img, hdr...)
+	bat := make([]byte, batSize)
+	for i := int64(0); i < blocks; i++ {
+		be.PutUint32(bat[i*4:], vhdBatUnused)
+	}
+	batOffset := len(img)
+	img = append(img, bat...)
+	for i := int64(0); i < blocks; i++ {
+		chunk := make([]byte, blockSize)
+		copy(chunk, data[i*blockSize:])
+		if isZero(chunk) {
+			continue
+		}
+		be.PutUint32(img[batOffset+int(i)*4:], uint32(len(img)/vhdSectorSize))
+		bitmap := make([]byte, bitmapSize)
+		for s := int64(0); s < blockSize/vhdSectorSize; s++ {
+			if diskType == VHD_TYPE_DYNAMIC || !isZero(chunk[s*vhdSectorSize:(s+1)*vhdSectorSize]) {
+				bitmap[s/8] |= 0x80 >> uint(s%8)
+			}
+		}
+		img = append(img, bitmap...)
+		img = append(img, chunk...)
+	}
+	return append(img, footer...)
+}
+
+func TestVHD(t *testing.T) {
+	data := make([]byte, 5*4096+1024)
+	for i := 4096; i < 2*4096; i++ {
+		data[i] = byte(i)
+	}
+	copy(data[3*4096+512:], bytes.Repeat([]byte("vhd"), 100))
+	copy(data[5*4096:], "tail")
+
+	parent := bytes.Repeat([]byte{0x5a}, len(data))
+	// the sectors present in the differencing image, the others are from
+	// the parent
+	merged := append([]byte{}, parent...)
+	for s := 0; s < len(data); s += vhdSectorSize {
+		if !isZero(data[s : s+vhdSectorSize]) {
+			copy(merged[s:], data[s:s+vhdSectorSize])
+		}
+	}
+
+	cases := []struct {
+		name      string
+		diskType  uint32
+		subformat string
+		parent    []byte
+		want      []byte
+	}{
+		{"fixed", VHD_TYPE_FIXED, VHD_SUBFORMAT_FIXED, nil, data},
+		{"dynamic", VHD_TYPE_DYNAMIC, VHD_SUBFORMAT_DYNAMIC, nil, data},
+		{"differencing", VHD_TYPE_DIFFERENCING, VHD_SUBFORMAT_DIFFERENCING, parent, merged},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := buildTestVHD(data, c.diskType, 4096, "parent.vhd")
+			format, subformat, err := DetectImageFormat(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil || format != VHD || subformat != c.subformat {
+				t.Fatalf("detect %s %s %v", format, subformat, err)
+			}
+			img, err := OpenVHD(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil {
+				t.Fatalf("OpenVHD %v", err)
+			}
+			if img.Size() != int64(len(data)) {
+				t.Fatalf("size %d", img.Size())
+			}
+			if c.diskType == VHD_TYPE_DIFFERENCING {
+				if img.ParentName != "parent.vhd" {
+					t.Errorf("parent name %q", img.ParentName)
+				}
+				img.SetBacking(bytes.NewReader(c.parent))
+			}
+			got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+			if err != nil {
+				t.Fatalf("read %v", err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Errorf("content mismatch")
+			}
+			// unaligned reads across blocks
+			buf := make([]byte, 5000)
+			if _, err := img.ReadAt(buf, 3000); err != nil {
+				t.Fatalf("ReadAt %v", err)
+			}
+			if !bytes.Equal(buf, c.want[3000:8000]) {
+				t.Errorf("unaligned read mismatch")
+			}
+		})
+	}
+}
+
+func TestVHDCorruptedBAT(t *testing.T) {
+	data := make([]byte, 4*4096)
+	for _, batEntries := range []uint32{0xffffffff, vhdMaxBatEntries, 1024 * 1024} {
+		raw := buildTestVHD(data, VHD_TYPE_DYNAMIC, 4096, "")
+		binary.BigEndian.PutUint32(raw[vhdFooterSize+28:], batEntries)
+		if _, err := OpenVHD(bytes.NewReader(raw), int64(len(raw))); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("%d BAT entries: %v", batEntries, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/vmdkutils"
+)
+
+/*
+ * VMDK hosted sparse extent
+ * Reference: Virtual Disk Format 5.0
+ *
+ */
+
+const (
+	VMDK_SPARSE_MAGIC = "KDMV"
+
+	VMDK_FLAG_NL_DETECT         = 1 << 0
+	VMDK_FLAG_REDUNDANT_GT      = 1 << 1
+	VMDK_FLAG_ZEROED_GTE        = 1 << 2
+	VMDK_FLAG_COMPRESSED_GRAINS = 1 << 16
+	VMDK_FLAG_MARKERS           = 1 << 17
+
+	VMDK_COMPRESSION_NONE    = 0
+	VMDK_COMPRESSION_DEFLATE = 1
+
+	vmdkSectorSize     = 512
+	vmdkGDAtEnd        = ^uint64(0)
+	vmdkGrainTableZero = 1
+	vmdkMaxGrainSize   = 128 * 1024 * 1024
+	vmdkMaxGTEsPerGT   = 4096
+	vmdkGTCacheSize    = 64
+	// the grain marker of a compressed grain is LBA and size
+	vmdkGrainMarkerSize = 12
+)
+
+type SVMDKSparseHeader struct {
+	Version           uint32
+	Flags             uint32
+	Capacity          uint64
+	GrainSize         uint64
+	DescriptorOffset  uint64
+	DescriptorSize    uint64
+	NumGTEsPerGT      uint32
+	RgdOffset         uint64
+	GdOffset          uint64
+	OverHead          uint64
+	UncleanShutdown   bool
+	CompressAlgorithm uint16
+}
+
+func (hdr *SVMDKSparseHeader) IsStreamOptimized() bool {
+	return hdr.CompressAlgorithm == VMDK_COMPRESSION_DEFLATE || hdr.Flags&VMDK_FLAG_COMPRESSED_GRAINS != 0
+}
+
+func readVMDKSparseHeader(r io.ReaderAt, offset int64) (*SVMDKSparseHeader, error) {
+	buf := make([]byte, vmdkSectorSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, errors.Wrap(err, "read sparse header")
+	}
+	if string(buf[:4]) != VMDK_SPARSE_MAGIC {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "not vmdk sparse extent")
+	}
+	le := binary.LittleEndian
+	hdr := &SVMDKSparseHeader{
+		Version:           le.Uint32(buf[4:]),
+		Flags:             le.Uint32(buf[8:]),
+		Capacity:          le.Uint64(buf[12:]),
+		GrainSize:         le.Uint64(buf[20:]),
+		DescriptorOffset:  le.Uint64(buf[28:]),
+		DescriptorSize:    le.Uint64(buf[36:]),
+		NumGTEsPerGT:      le.Uint32(buf[44:]),
+		RgdOffset:         le.Uint64(buf[48:]),
+		GdOffset:          le.Uint64(buf[56:]),
+		OverHead:          le.Uint64(buf[64:]),
+		UncleanShutdown:   buf[72] != 0,
+		CompressAlgorithm: le.Uint16(buf[77:]),
+	}
+	if hdr.Version < 1 || hdr.Version > 3 {
+		return nil, errors.Wrapf(errors.ErrNotSupported, "vmdk sparse version %d", hdr.Version)
+	}
+	if hdr.GrainSize == 0 || hdr.GrainSize*vmdkSectorSize > vmdkMaxGrainSize || hdr.GrainSize&(hdr.GrainSize-1) != 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "grain size %d", hdr.GrainSize)
+	}
+	if hdr.NumGTEsPerGT == 0 || hdr.NumGTEsPerGT > vmdkMaxGTEsPerGT {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "%d entries per grain table", hdr.NumGTEsPerGT)
+	}
+	return hdr, nil
+}
+
+// SVMDKSparseImage reads the virtual disk of a monolithic sparse or stream
+// optimized VMDK, the grains not allocated are read from the parent image
+type SVMDKSparseImage struct {
+	Header SVMDKSparseHeader
+	// Descriptor is the embedded descriptor, nil if not found
+	Descriptor *vmdkutils.SVMDKInfo
+
+	r       io.ReaderAt
+	backing io.ReaderAt
+	gd      []uint32
+
+	lock    sync.Mutex
+	gtCache map[uint32][]uint32
+	gtOrder []uint32
+	// the last grain inflated, as the compressed grains are read
+	// sequentially
+	grainOffset uint32
+	grain       []byte
+}
+
+// OpenVMDKSparse reads the header and grain directory of a sparse extent
+// of the size, the header of a stream optimized extent is at the end
+func OpenVMDKSparse(r io.ReaderAt, size int64) (*SVMDKSparseImage, error) {
+	hdr, err := readVMDKSparseHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.GdOffset == vmdkGDAtEnd {
+		if size < 3*vmdkSectorSize {
+			return nil, errors.Wrap(errors.ErrInvalidFormat, "no footer")
+		}
+		// the footer is followed by the end-of-stream marker
+		footer, err := readVMDKSparseHeader(r, size-2*vmdkSectorSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "read footer")
+		}
+		hdr = footer
+	}
+	img := &SVMDKSparseImage{Header: *hdr, r: r, gtCache: map[uint32][]uint32{}}
+	if hdr.DescriptorOffset > 0 && hdr.DescriptorSize > 0 && hdr.DescriptorSize*vmdkSectorSize <= maxVMDKDescriptorSize {
+		desc := make([]byte, hdr.DescriptorSize*vmdkSectorSize)
+		if _, err := r.ReadAt(desc, int64(hdr.DescriptorOffset)*vmdkSectorSize); err != nil {
+			return nil, errors.Wrap(err, "read embedded descriptor")
+		}
+		img.Descriptor, _ = vmdkutils.ParseStream(bytes.NewReader(bytes.TrimRight(desc, "\x00")))
+	}
+	grainBytes := hdr.GrainSize * vmdkSectorSize
+	gtCoverage := grainBytes * uint64(hdr.NumGTEsPerGT)
+	gdEntries := (hdr.Capacity*vmdkSectorSize + gtCoverage - 1) / gtCoverage
+	if gdEntries > 16*1024*1024 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "capacity %d", hdr.Capacity)
+	}
+	buf := make([]byte, gdEntries*4)
+	if _, err := r.ReadAt(buf, int64(hdr.GdOffset)*vmdkSectorSize); err != nil {
+		return nil, errors.Wrap(err, "read grain directory")
+	}
+	img.gd = make([]uint32, gdEntries)
+	for i := range img.gd {
+		img.gd[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return img, nil
+}
+
+// SetBacking sets the parent image of the grains not allocated
+func (img *SVMDKSparseImage) SetBacking(backing io.ReaderAt) {
+	img.backing = backing
+}
+
+func (img *SVMDKSparseImage) Size() int64 {
+	return int64(img.Header.Capacity) * vmdkSectorSize
+}
+
+func (img *SVMDKSparseImage) grainTable(sector uint32) ([]uint32, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	if table, ok := img.gtCache[sector]; ok {
+		return table, nil
+	}
+	buf := make([]byte, img.Header.NumGTEsPerGT*4)
+	if _, err := img.r.ReadAt(buf, int64(sector)*vmdkSectorSize); err != nil {
+		return nil, err
+	}
+	table := make([]uint32, img.Header.NumGTEsPerGT)
+	for i := range table {
+		table[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	if len(img.gtOrder) >= vmdkGTCacheSize {
+		delete(img.gtCache, img.gtOrder[0])
+		img.gtOrder = img.gtOrder[1:]
+	}
+	img.gtCache[sector] = table
+	img.gtOrder = append(img.gtOrder, sector)
+	return table, nil
+}
+
+// grainEntry returns the sector of a grain, 0 if not allocated
+func (img *SVMDKSparseImage) grainEntry(grain int64) (uint32, error) {
+	gtes := int64(img.Header.NumGTEsPerGT)
+	gdIndex := grain / gtes
+	if gdIndex >= int64(len(img.gd)) || img.gd[gdIndex] == 0 {
+		return 0, nil
+	}
+	table, err := img.grainTable(img.gd[gdIndex])
+	if err != nil {
+		return 0, errors.Wrapf(err, "read grain table at sector %d", img.gd[gdIndex])
+	}
+	return table[grain%gtes], nil
+}
+
+func (img *SVMDKSparseImage) readCompressed(sector uint32, buf []byte, inGrain int64) error {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	if img.grain == nil || img.grainOffset != sector {
+		marker := make([]byte, vmdkGrainMarkerSize)
+		if _, err := img.r.ReadAt(marker, int64(sector)*vmdkSectorSize); err != nil {
+			return errors.Wrap(err, "read grain marker")
+		}
+		grainBytes := int64(img.Header.GrainSize) * vmdkSectorSize
+		size := int64(binary.LittleEndian.Uint32(marker[8:]))
+		if size == 0 || size > 2*grainBytes {
+			return errors.Wrapf(errors.ErrInvalidFormat, "compressed grain size %d", size)
+		}
+		compressed := make([]byte, size)
+		if _, err := img.r.ReadAt(compressed, int64(sector)*vmdkSectorSize+vmdkGrainMarkerSize); err != nil {
+			return errors.Wrap(err, "read compressed grain")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return errors.Wrap(err, "inflate grain")
+		}
+		grain := make([]byte, grainBytes)
+		// the last grain may be partial
+		if _, err := io.ReadFull(zr, grain); err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "inflate grain")
+		}
+		img.grain, img.grainOffset = grain, sector
+	}
+	copy(buf, img.grain[inGrain:])
+	return nil
+}
+
+func (img *SVMDKSparseImage) readUnallocated(buf []byte, off int64) error {
+	if img.backing == nil {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+	n, err := img.backing.ReadAt(buf, off)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+func (img *SVMDKSparseImage) ReadAt(p []byte, off int64) (int, error) {
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	grainBytes := int64(img.Header.GrainSize) * vmdkSectorSize
+	read := 0
+	for read < len(p) {
+		cur := off + int64(read)
+		inGrain := cur % grainBytes
+		n := grainBytes - inGrain
+		if n > int64(len(p)-read) {
+			n = int64(len(p) - read)
+		}
+		buf := p[read : read+int(n)]
+		sector, err := img.grainEntry(cur / grainBytes)
+		if err != nil {
+			return read, err
+		}
+		switch {
+		case sector == 0:
+			err = img.readUnallocated(buf, cur)
+		case sector == vmdkGrainTableZero && (img.Header.Flags&VMDK_FLAG_ZEROED_GTE != 0 || img.Header.IsStreamOptimized()):
+			for i := range buf {
+				buf[i] = 0
+			}
+		case img.Header.Flags&VMDK_FLAG_COMPRESSED_GRAINS != 0:
+			err = img.readCompressed(sector, buf, inGrain)
+		default:
+			_, err = img.r.ReadAt(buf, int64(sector)*vmdkSectorSize+inGrain)
+		}
+		if err != nil {
+			return read, errors.Wrapf(err, "read grain at %d", cur)
+		}
+		read += int(n)
+	}
+	return read, eof
+}
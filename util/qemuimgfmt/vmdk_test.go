@@ -0,0 +1,209 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemuimgfmt
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+const testVMDKGrainSectors = 8
+
+func buildTestVMDKHeader(capacity int64, flags uint32, compress uint16, gdOffset uint64) []byte {
+	le := binary.LittleEndian
+	hdr := make([]byte, vmdkSectorSize)
+	copy(hdr, VMDK_SPARSE_MAGIC)
+	le.PutUint32(hdr[4:], 1)
+	if compress != VMDK_COMPRESSION_NONE {
+		le.PutUint32(hdr[4:], 3)
+	}
+	le.PutUint32(hdr[8:], flags)
+	le.PutUint64(hdr[12:], uint64(capacity/vmdkSectorSize))
+	le.PutUint64(hdr[20:], testVMDKGrainSectors)
+	le.PutUint64(hdr[28:], 1)
+	le.PutUint64(hdr[36:], 1)
+	le.PutUint32(hdr[44:], 512)
+	le.PutUint64(hdr[56:], gdOffset)
+	copy(hdr[73:], "\n \r\n")
+	le.PutUint16(hdr[77:], compress)
+	return hdr
+}
+
+func buildTestVMDKDescriptor(capacity int64, createType string) []byte {
+	desc := fmt.Sprintf("# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"%s\"\n\n"+
+		"# Extent description\nRW %d SPARSE \"test.vmdk\"\n\n"+
+		"# The Disk Data Base\n#DDB\n\nddb.virtualHWVersion = \"4\"\n", createType, capacity/vmdkSectorSize)
+	buf := make([]byte, vmdkSectorSize)
+	copy(buf, desc)
+	return buf
+}
+
+func padTestSector(buf []byte) []byte {
+	if rem := len(buf) % vmdkSectorSize; rem != 0 {
+		buf = append(buf, make([]byte, vmdkSectorSize-rem)...)
+	}
+	return buf
+}
+
+// buildTestVMDK builds a monolithic sparse or stream optimized VMDK of
+// data, the grains of zeros are not allocated
+func buildTestVMDK(data []byte, streamOptimized bool) []byte {
+	le := binary.LittleEndian
+	grainSize := int64(testVMDKGrainSectors * vmdkSectorSize)
+	capacity := int64(len(data))
+	grains := (capacity + grainSize - 1) / grainSize
+	gtes := int64(512)
+	gdEntries := (grains + gtes - 1) / gtes
+	gt := make([]byte, gdEntries*gtes*4)
+	gd := make([]byte, gdEntries*4)
+
+	grain := func(i int64) []byte {
+		chunk := make([]byte, grainSize)
+		copy(chunk, data[i*grainSize:])
+		return chunk
+	}
+	if !streamOptimized {
+		const gdSector = 2
+		gtSector := gdSector + int64(len(padTestSector(append([]byte{}, gd...))))/vmdkSectorSize
+		img := buildTestVMDKHeader(capacity, VMDK_FLAG_NL_DETECT, VMDK_COMPRESSION_NONE, gdSector)
+		img = append(img, buildTestVMDKDescriptor(capacity, VMDK_SUBFORMAT_SPARSE)...)
+		for i := int64(0); i < gdEntries; i++ {
+			le.PutUint32(gd[i*4:], uint32(gtSector+i*gtes*4/vmdkSectorSize))
+		}
+		img = append(img, padTestSector(gd)...)
+		gtOffset := len(img)
+		img = append(img, gt...)
+		for i := int64(0); i < grains; i++ {
+			chunk := grain(i)
+			if isZero(chunk) {
+				continue
+			}
+			le.PutUint32(img[gtOffset+int(i)*4:], uint32(len(img)/vmdkSectorSize))
+			img = append(img, chunk...)
+		}
+		return img
+	}
+
+	flags := uint32(VMDK_FLAG_NL_DETECT | VMDK_FLAG_COMPRESSED_GRAINS | VMDK_FLAG_MARKERS)
+	img := buildTestVMDKHeader(capacity, flags, VMDK_COMPRESSION_DEFLATE, vmdkGDAtEnd)
+	img = append(img, buildTestVMDKDescriptor(capacity, VMDK_SUBFORMAT_STREAM_OPTIMIZED)...)
+	for i := int64(0); i < grains; i++ {
+		chunk := grain(i)
+		if isZero(chunk) {
+			continue
+		}
+		if i == grains-1 {
+			// the last grain is partial
+			chunk = chunk[:capacity-i*grainSize]
+		}
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(chunk)
+		zw.Close()
+		le.PutUint32(gt[i*4:], uint32(len(img)/vmdkSectorSize))
+		marker := make([]byte, vmdkGrainMarkerSize)
+		le.PutUint64(marker, uint64(i*testVMDKGrainSectors))
+		le.PutUint32(marker[8:], uint32(compressed.Len()))
+		img = append(img, padTestSector(append(marker, compressed.Bytes()...))...)
+	}
+	for i := int64(0); i < gdEntries; i++ {
+		// the grain table marker
+		img = append(img, make([]byte, vmdkSectorSize)...)
+		le.PutUint32(gd[i*4:], uint32(len(img)/vmdkSectorSize))
+		img = append(img, gt[i*gtes*4:(i+1)*gtes*4]...)
+	}
+	img = append(img, make([]byte, vmdkSectorSize)...)
+	gdSector := uint64(len(img) / vmdkSectorSize)
+	img = append(img, padTestSector(gd)...)
+	// the footer marker, footer and end-of-stream marker
+	img = append(img, make([]byte, vmdkSectorSize)...)
+	img = append(img, buildTestVMDKHeader(capacity, flags, VMDK_COMPRESSION_DEFLATE, gdSector)...)
+	return append(img, make([]byte, vmdkSectorSize)...)
+}
+
+func TestVMDKSparse(t *testing.T) {
+	data := make([]byte, 600*4096+1024)
+	for i := 0; i < len(data); i += 4096 {
+		// every third grain is zero
+		if (i/4096)%3 != 0 {
+			binary.LittleEndian.PutUint64(data[i:], uint64(i)+1)
+			copy(data[i+8:], "vmdk test data")
+		}
+	}
+	copy(data[len(data)-4:], "tail")
+
+	for _, streamOptimized := range []bool{false, true} {
+		subformat := VMDK_SUBFORMAT_SPARSE
+		if streamOptimized {
+			subformat = VMDK_SUBFORMAT_STREAM_OPTIMIZED
+		}
+		t.Run(subformat, func(t *testing.T) {
+			raw := buildTestVMDK(data, streamOptimized)
+			format, sub, err := DetectImageFormat(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil || format != VMDK || sub != subformat {
+				t.Fatalf("detect %s %s %v", format, sub, err)
+			}
+			img, err := OpenVMDKSparse(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil {
+				t.Fatalf("OpenVMDKSparse %v", err)
+			}
+			if img.Size() != int64(len(data)) {
+				t.Fatalf("size %d", img.Size())
+			}
+			if img.Descriptor == nil || img.Descriptor.CreateType != subformat {
+				t.Errorf("embedded descriptor %#v", img.Descriptor)
+			}
+			got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+			if err != nil {
+				t.Fatalf("read %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("content mismatch")
+			}
+			buf := make([]byte, 5000)
+			if _, err := img.ReadAt(buf, 3000); err != nil {
+				t.Fatalf("ReadAt %v", err)
+			}
+			if !bytes.Equal(buf, data[3000:8000]) {
+				t.Errorf("unaligned read mismatch")
+			}
+		})
+	}
+}
+
+func TestVMDKSparseBacking(t *testing.T) {
+	data := make([]byte, 4*4096)
+	copy(data[4096:], "child")
+	parent := bytes.Repeat([]byte{0xa5}, len(data))
+	img, err := OpenVMDKSparse(bytes.NewReader(buildTestVMDK(data, false)), -1)
+	if err != nil {
+		t.Fatalf("OpenVMDKSparse %v", err)
+	}
+	img.SetBacking(bytes.NewReader(parent))
+	got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("read %v", err)
+	}
+	want := append([]byte{}, parent...)
+	copy(want[4096:], data[4096:8192])
+	if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// HmacSHA256 calculate hmac-sha256 of data with the given key
+func HmacSHA256(key []byte, data []byte) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+// HexSHA256 returns the lowercase hex encoded sha256 sum of data
+func HexSHA256(data []byte) string {
+	return hex.EncodeToString(sum256(data))
+}
+
+// TrimHeaderValue trims leading and trailing spaces and replaces sequential
+// spaces with one space, following Trimall() in
+// http://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+func TrimHeaderValue(input string) string {
+	// Compress adjacent spaces (a space is determined by
+	// unicode.IsSpace() internally here) to one space and return
+	return strings.Join(strings.Fields(input), " ")
+}
+
+// CanonicalQueryString returns the query sorted by key with values encoded
+// as RFC 3986 requires, leaving out the keys in exclude
+func CanonicalQueryString(query url.Values, exclude ...string) string {
+	if len(exclude) > 0 {
+		q := make(url.Values, len(query))
+		for k, v := range query {
+			q[k] = v
+		}
+		for _, k := range exclude {
+			q.Del(k)
+		}
+		query = q
+	}
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// CanonicalHeaders generate a list of request headers for signature, in
+// the form <header>:<value> newline separated for each header.
+func CanonicalHeaders(req http.Request, signedHeaders []string) string {
+	var buf bytes.Buffer
+	for _, k := range signedHeaders {
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		switch {
+		case k == "host":
+			buf.WriteString(getHostAddr(req))
+			fallthrough
+		default:
+			for idx, v := range req.Header[http.CanonicalHeaderKey(k)] {
+				if idx > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(TrimHeaderValue(v))
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
+
+// SignedHeaders generate all signed request headers, i.e lexically sorted
+// lowercase request header names. Headers in ignoredHeaders are skipped and
+// headers in required are always included even if absent from the request.
+func SignedHeaders(req http.Request, ignoredHeaders map[string]bool, required ...string) []string {
+	var headers []string
+	seen := make(map[string]bool)
+	for k := range req.Header {
+		if _, ok := ignoredHeaders[http.CanonicalHeaderKey(k)]; ok {
+			continue // Ignored header found continue.
+		}
+		lk := strings.ToLower(k)
+		seen[lk] = true
+		headers = append(headers, lk)
+	}
+	for _, k := range required {
+		lk := strings.ToLower(k)
+		if !seen[lk] {
+			seen[lk] = true
+			headers = append(headers, lk)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
@@ -0,0 +1,345 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// Streaming payload signing, in accordance with
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html.
+const (
+	streamingPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	streamingContentEncoding  = "aws-chunked"
+
+	chunkSignaturePrefix = ";chunk-signature="
+
+	// DefaultStreamingChunkSize is the size of the chunks of SignV4Streaming
+	DefaultStreamingChunkSize = 64 * 1024
+	// MaxStreamingChunkSize is the largest chunk accepted by the verifying
+	// reader
+	MaxStreamingChunkSize = 16 * 1024 * 1024
+
+	maxChunkHeaderLength = 4096
+)
+
+const (
+	ErrChunkSignatureMismatch = errors.Error("chunk signature mismatch")
+	ErrInvalidChunk           = errors.Error("invalid aws-chunked payload")
+)
+
+// emptySHA256 is the hex SHA256 of an empty string
+var emptySHA256 = hex.EncodeToString(sum256(nil))
+
+type sChunkSigner struct {
+	signingKey []byte
+	signDate   time.Time
+	scope      string
+
+	// prevSignature is the signature of the previous chunk, or the seed
+	// signature of the request headers
+	prevSignature string
+}
+
+// sign returns the signature of the next chunk of data
+func (s *sChunkSigner) sign(data []byte) string {
+	stringToSign := strings.Join([]string{
+		streamingPayloadAlgorithm,
+		s.signDate.Format(iso8601DateFormat),
+		s.scope,
+		s.prevSignature,
+		emptySHA256,
+		hex.EncodeToString(sum256(data)),
+	}, "\n")
+	s.prevSignature = getSignature(s.signingKey, stringToSign)
+	return s.prevSignature
+}
+
+func chunkHeaderLength(size int64) int64 {
+	return int64(len(strconv.FormatInt(size, 16))+len(chunkSignaturePrefix)+64) + 2
+}
+
+// StreamingContentLength returns the encoded length of a payload of
+// decodedLength bytes, sent in chunks of chunkSize bytes
+func StreamingContentLength(decodedLength int64, chunkSize int64) int64 {
+	full := decodedLength / chunkSize
+	length := full * (chunkHeaderLength(chunkSize) + chunkSize + 2)
+	if rest := decodedLength % chunkSize; rest > 0 {
+		length += chunkHeaderLength(rest) + rest + 2
+	}
+	// final empty chunk
+	length += chunkHeaderLength(0) + 2
+	return length
+}
+
+// SChunkedWriter encodes the data written to it into signed aws-chunked
+// chunks of a fixed size. Close must be called to write the final chunk.
+type SChunkedWriter struct {
+	signer    sChunkSigner
+	w         io.Writer
+	chunkSize int
+	buf       []byte
+	closed    bool
+	// anonymous writes the payload as is, without chunk signatures
+	anonymous bool
+}
+
+func (cw *SChunkedWriter) writeChunk(data []byte) error {
+	signature := cw.signer.sign(data)
+	header := strconv.FormatInt(int64(len(data)), 16) + chunkSignaturePrefix + signature + "\r\n"
+	if _, err := io.WriteString(cw.w, header); err != nil {
+		return errors.Wrap(err, "write chunk header")
+	}
+	if _, err := cw.w.Write(data); err != nil {
+		return errors.Wrap(err, "write chunk")
+	}
+	if _, err := io.WriteString(cw.w, "\r\n"); err != nil {
+		return errors.Wrap(err, "write chunk trailer")
+	}
+	return nil
+}
+
+func (cw *SChunkedWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.Error("write to closed chunked writer")
+	}
+	if cw.anonymous {
+		return cw.w.Write(p)
+	}
+	n := 0
+	for len(p) > 0 {
+		free := cw.chunkSize - len(cw.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		cw.buf = append(cw.buf, p[:free]...)
+		p = p[free:]
+		n += free
+		if len(cw.buf) == cw.chunkSize {
+			if err := cw.writeChunk(cw.buf); err != nil {
+				return n, err
+			}
+			cw.buf = cw.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close flushes the buffered data and writes the final chunk, it does not
+// close the underlying writer
+func (cw *SChunkedWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	if cw.anonymous {
+		return nil
+	}
+	if len(cw.buf) > 0 {
+		if err := cw.writeChunk(cw.buf); err != nil {
+			return err
+		}
+	}
+	return cw.writeChunk(nil)
+}
+
+// SignV4Streaming signs the headers of a request whose payload of
+// decodedLength bytes is sent with STREAMING-AWS4-HMAC-SHA256-PAYLOAD, and
+// returns the writer encoding the payload into w, to be used as the body of
+// the request. For anonymous credentials, the request is not signed and the
+// writer writes the payload as is.
+func SignV4Streaming(req http.Request, accessKey, secretAccessKey, location string, decodedLength int64, w io.Writer) (*http.Request, *SChunkedWriter) {
+	// Signature calculation is not needed for anonymous credentials.
+	if accessKey == "" || secretAccessKey == "" {
+		return &req, &SChunkedWriter{w: w, anonymous: true}
+	}
+	t := time.Now().UTC()
+
+	req.Header = req.Header.Clone()
+	req.Header.Set("X-Amz-Content-Sha256", streamingPayload)
+	// aws-chunked comes first, the payload keeps its own encoding, e.g. gzip
+	encoding := streamingContentEncoding
+	if existing := req.Header.Get("Content-Encoding"); len(existing) > 0 {
+		encoding += "," + existing
+	}
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(decodedLength, 10))
+	req.ContentLength = StreamingContentLength(decodedLength, DefaultStreamingChunkSize)
+	req.Header.Set("X-Amz-Date", t.Format(iso8601DateFormat))
+
+	signedHeaders := getSignedHeadersV4(req)
+	canonicalRequest := getCanonicalRequest(req, signedHeaders)
+	stringToSign := getStringToSignV4(t, location, signV4Service, canonicalRequest)
+	signingKey := getSigningKey(secretAccessKey, location, signV4Service, t)
+	signature := getSignature(signingKey, stringToSign)
+
+	parts := []string{
+		signV4Algorithm + " Credential=" + getCredential(accessKey, location, t),
+		"SignedHeaders=" + strings.Join(signedHeaders, ";"),
+		"Signature=" + signature,
+	}
+	req.Header.Set("Authorization", strings.Join(parts, ","))
+
+	return &req, &SChunkedWriter{
+		signer: sChunkSigner{
+			signingKey:    signingKey,
+			signDate:      t,
+			scope:         getScope(location, signV4Service, t),
+			prevSignature: signature,
+		},
+		w:         w,
+		chunkSize: DefaultStreamingChunkSize,
+		buf:       make([]byte, 0, DefaultStreamingChunkSize),
+	}
+}
+
+// sChunkedReader decodes an aws-chunked payload and only returns the data of
+// a chunk after its signature is verified
+type sChunkedReader struct {
+	signer sChunkSigner
+	r      *bufio.Reader
+
+	// decodedLength is the expected payload length, -1 if unknown
+	decodedLength int64
+	total         int64
+
+	// chunk is the data of the last chunk read, its buffer is reused by
+	// the next chunk, offset is where it is read up to
+	chunk  []byte
+	offset int
+	err    error
+}
+
+func (cr *sChunkedReader) readLine() (string, error) {
+	line := make([]byte, 0, 128)
+	for {
+		frag, err := cr.r.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > maxChunkHeaderLength {
+			return "", errors.Wrap(ErrInvalidChunk, "chunk header too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			return "", errors.Wrap(ErrInvalidChunk, "chunk header not ended by CRLF")
+		}
+		return string(line[:len(line)-2]), nil
+	}
+}
+
+func (cr *sChunkedReader) readChunk() error {
+	header, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	pos := strings.Index(header, chunkSignaturePrefix)
+	if pos <= 0 {
+		return errors.Wrapf(ErrInvalidChunk, "illegal chunk header %q", header)
+	}
+	size, err := strconv.ParseInt(header[:pos], 16, 64)
+	if err != nil || size < 0 || size > MaxStreamingChunkSize {
+		return errors.Wrapf(ErrInvalidChunk, "illegal chunk size %q", header[:pos])
+	}
+	signature := header[pos+len(chunkSignaturePrefix):]
+
+	if int64(cap(cr.chunk)) < size {
+		cr.chunk = make([]byte, size)
+	}
+	cr.chunk = cr.chunk[:size]
+	cr.offset = 0
+	if _, err := io.ReadFull(cr.r, cr.chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(cr.r, crlf); err != nil || string(crlf) != "\r\n" {
+		return errors.Wrap(ErrInvalidChunk, "chunk data not ended by CRLF")
+	}
+	if !hmac.Equal([]byte(cr.signer.sign(cr.chunk)), []byte(signature)) {
+		return ErrChunkSignatureMismatch
+	}
+
+	cr.total += size
+	if cr.decodedLength >= 0 && cr.total > cr.decodedLength {
+		return errors.Wrapf(ErrInvalidChunk, "payload longer than %d", cr.decodedLength)
+	}
+	if size == 0 {
+		if cr.decodedLength >= 0 && cr.total != cr.decodedLength {
+			return errors.Wrapf(ErrInvalidChunk, "payload of %d bytes, expect %d", cr.total, cr.decodedLength)
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+func (cr *sChunkedReader) Read(p []byte) (int, error) {
+	for cr.offset >= len(cr.chunk) {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.readChunk()
+		if cr.err != nil {
+			// the data of an invalid chunk is never returned
+			cr.chunk, cr.offset = cr.chunk[:0], 0
+		}
+	}
+	n := copy(p, cr.chunk[cr.offset:])
+	cr.offset += n
+	return n, nil
+}
+
+// IsStreaming tells whether the payload of the request is signed in chunks
+func (aksk SAccessKeyRequestV4) IsStreaming() bool {
+	return aksk.ContentSha256 == streamingPayload
+}
+
+// NewChunkedReader returns the reader decoding the aws-chunked body of a
+// streaming request whose headers have been verified, each chunk signature
+// being verified in the chain seeded by the request signature.
+func (aksk SAccessKeyRequestV4) NewChunkedReader(body io.Reader, secret string) (io.Reader, error) {
+	if !aksk.IsStreaming() {
+		return nil, errors.Wrapf(ErrInvalidChunk, "payload %s not streaming", aksk.ContentSha256)
+	}
+	return &sChunkedReader{
+		signer: sChunkSigner{
+			signingKey:    getSigningKey(secret, aksk.Location, aksk.service(), aksk.SignDate),
+			signDate:      aksk.SignDate,
+			scope:         getScope(aksk.Location, aksk.service(), aksk.SignDate),
+			prevSignature: aksk.Signature,
+		},
+		r:             bufio.NewReader(body),
+		decodedLength: aksk.DecodedContentLength,
+	}, nil
+}
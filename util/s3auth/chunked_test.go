@@ -0,0 +1,206 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func TestChunkSigner(t *testing.T) {
+	// example of https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+	signDate, _ := time.Parse(iso8601DateFormat, "20130524T000000Z")
+	signer := sChunkSigner{
+		signingKey:    getSigningKey(testSecret, "us-east-1", signV4Service, signDate),
+		signDate:      signDate,
+		scope:         getScope("us-east-1", signV4Service, signDate),
+		prevSignature: "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+	for _, c := range []struct {
+		size      int
+		signature string
+	}{
+		{65536, "ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648"},
+		{1024, "0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497"},
+		{0, "b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9"},
+	} {
+		if sig := signer.sign(bytes.Repeat([]byte("a"), c.size)); sig != c.signature {
+			t.Errorf("chunk of %d: expect %s, got %s", c.size, c.signature, sig)
+		}
+	}
+	if length := StreamingContentLength(66560, 65536); length != 66824 {
+		t.Errorf("expect content length 66824, got %d", length)
+	}
+}
+
+func newTestStreamingRequest(t *testing.T, payload []byte) (http.Request, []byte) {
+	req, _ := http.NewRequest(http.MethodPut, "https://s3.yunion.io/bucket/large.bin", nil)
+	body := &bytes.Buffer{}
+	signed, w := SignV4Streaming(*req, testAccessKey, testSecret, "cn-beijing", int64(len(payload)), body)
+	// written in uneven pieces
+	for rest := payload; len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if int64(body.Len()) != signed.ContentLength {
+		t.Errorf("expect content length %d, got %d", signed.ContentLength, body.Len())
+	}
+	return *signed, body.Bytes()
+}
+
+func openTestChunkedBody(t *testing.T, req http.Request, body []byte) io.Reader {
+	aksk, err := DecodeAccessKeyRequest(req, false)
+	if err != nil {
+		t.Fatalf("DecodeAccessKeyRequest: %v", err)
+	}
+	if err := aksk.Verify(testSecret); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	v4 := aksk.(*SAccessKeyRequestV4)
+	if !v4.IsStreaming() {
+		t.Fatalf("expect streaming request")
+	}
+	reader, err := v4.NewChunkedReader(bytes.NewReader(body), testSecret)
+	if err != nil {
+		t.Fatalf("NewChunkedReader: %v", err)
+	}
+	return reader
+}
+
+func TestChunkedPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), DefaultStreamingChunkSize/16*2+100)
+	req, body := newTestStreamingRequest(t, payload)
+
+	decoded, err := ioutil.ReadAll(openTestChunkedBody(t, req, body))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Errorf("decoded payload of %d bytes differs", len(decoded))
+	}
+
+	// a modified second chunk: the first chunk is returned, not the second
+	tampered := append([]byte{}, body...)
+	secondChunk := int(chunkHeaderLength(DefaultStreamingChunkSize)) + DefaultStreamingChunkSize + 2
+	tampered[secondChunk+int(chunkHeaderLength(DefaultStreamingChunkSize))+10] ^= 1
+	decoded, err = ioutil.ReadAll(openTestChunkedBody(t, req, tampered))
+	if errors.Cause(err) != ErrChunkSignatureMismatch {
+		t.Errorf("expect chunk signature mismatch, got %v", err)
+	}
+	if len(decoded) != DefaultStreamingChunkSize {
+		t.Errorf("expect only the first chunk, got %d bytes", len(decoded))
+	}
+
+	// a truncated payload
+	_, err = ioutil.ReadAll(openTestChunkedBody(t, req, body[:len(body)-int(chunkHeaderLength(0))-2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF, got %v", err)
+	}
+
+	// the chunks can not be reordered
+	reordered := append([]byte{}, body[secondChunk:2*secondChunk]...)
+	reordered = append(reordered, body[:secondChunk]...)
+	reordered = append(reordered, body[2*secondChunk:]...)
+	_, err = ioutil.ReadAll(openTestChunkedBody(t, req, reordered))
+	if errors.Cause(err) != ErrChunkSignatureMismatch {
+		t.Errorf("expect chunk signature mismatch for reordered chunks, got %v", err)
+	}
+
+	// the decoded length is enforced
+	req.Header.Set("X-Amz-Decoded-Content-Length", "10")
+	aksk, _ := DecodeAccessKeyRequest(req, false)
+	if err := aksk.Verify(testSecret); err == nil {
+		t.Errorf("expect signature mismatch for a modified decoded length")
+	}
+}
+
+func TestChunkedReaderBuffer(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), DefaultStreamingChunkSize/16*3)
+	req, body := newTestStreamingRequest(t, payload)
+	cr := openTestChunkedBody(t, req, body).(*sChunkedReader)
+
+	buf := make([]byte, 1000)
+	if _, err := io.ReadFull(cr, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	chunk := cr.chunk[:1]
+	decoded := append([]byte{}, buf...)
+	for {
+		n, err := cr.Read(buf)
+		decoded = append(decoded, buf[:n]...)
+		if &cr.chunk[:1][0] != &chunk[0] {
+			t.Fatalf("expect the chunk buffer to be reused")
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Errorf("decoded payload of %d bytes differs", len(decoded))
+	}
+}
+
+func TestChunkedReaderNotStreaming(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "https://s3.yunion.io/bucket/obj", nil)
+	signed := SignV4(*req, testAccessKey, testSecret, "cn-beijing", strings.NewReader("data"))
+	aksk, err := DecodeAccessKeyRequest(*signed, false)
+	if err != nil {
+		t.Fatalf("DecodeAccessKeyRequest: %v", err)
+	}
+	if _, err := aksk.(*SAccessKeyRequestV4).NewChunkedReader(strings.NewReader("data"), testSecret); errors.Cause(err) != ErrInvalidChunk {
+		t.Errorf("expect invalid chunk, got %v", err)
+	}
+}
+
+func TestSignV4StreamingHeaders(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "https://s3.yunion.io/bucket/obj.gz", nil)
+	req.Header.Set("Content-Encoding", "gzip")
+	signed, _ := SignV4Streaming(*req, testAccessKey, testSecret, "cn-beijing", 4, &bytes.Buffer{})
+	if got := signed.Header.Get("Content-Encoding"); got != "aws-chunked,gzip" {
+		t.Errorf("Content-Encoding %q", got)
+	}
+	if req.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("original request modified")
+	}
+
+	// anonymous requests are not signed, the payload is sent as is
+	body := &bytes.Buffer{}
+	signed, w := SignV4Streaming(*req, "", "", "cn-beijing", 4, body)
+	if len(signed.Header.Get("Authorization")) > 0 || signed.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("anonymous request signed: %v", signed.Header)
+	}
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil || body.String() != "data" {
+		t.Errorf("anonymous payload %q: %v", body.String(), err)
+	}
+}
@@ -16,12 +16,17 @@ package s3auth
 
 import (
 	"net/http"
-	"strings"
 
 	"yunion.io/x/jsonutils"
 	"yunion.io/x/pkg/errors"
 )
 
+const (
+	ErrRequestExpired       = errors.Error("request has expired")
+	ErrUnsupportedAlgorithm = errors.Error("unsupported signing algorithm")
+	ErrSignatureMismatch    = errors.Error("signature mismatch")
+)
+
 type IAccessKeySecretRequest interface {
 	GetAccessKey() string
 	Validate() error
@@ -51,38 +56,20 @@ func (aksk SAccessKeyRequest) Validate() error {
 	return nil
 }
 
-func decodeAuthHeader(authHeader string) (IAccessKeySecretRequest, error) {
-	pos := strings.IndexByte(authHeader, ' ')
-	if pos <= 0 {
-		return nil, errors.Error("illegal authorization header")
-	}
-	algo := authHeader[:pos]
-	switch algo {
-	case signV2Algorithm:
-		req, err := decodeAuthHeaderV2(authHeader[pos+1:])
-		if err != nil {
-			return nil, errors.Wrap(err, "decodeAuthHeaderV2")
-		}
-		return req, nil
-	case signV4Algorithm:
-		req, err := decodeAuthHeaderV4(authHeader[pos+1:])
-		if err != nil {
-			return nil, errors.Wrap(err, "decodeAuthHeaderV4")
-		}
-		return req, nil
-	default:
-		return nil, errors.Error("unsupported signing algorithm")
-	}
-}
-
+// DecodeAccessKeyRequest decodes the signature of a request with the first
+// registered signature scheme that detects it, either from its
+// Authorization header or from its query string for a presigned URL
 func DecodeAccessKeyRequest(req http.Request, virtualHost bool) (IAccessKeySecretRequest, error) {
-	authHeader := req.Header.Get("Authorization")
-	if len(authHeader) == 0 {
+	scheme := detectSignatureScheme(req)
+	if scheme == nil {
+		if len(req.Header.Get("Authorization")) > 0 {
+			return nil, ErrUnsupportedAlgorithm
+		}
 		return nil, errors.Error("missing authorization header")
 	}
-	akskReq, err := decodeAuthHeader(authHeader)
+	akskReq, err := scheme.Decode(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "decodeAuthHeader")
+		return nil, errors.Wrapf(err, "decode %s", scheme.GetAlgorithm())
 	}
 	err = akskReq.ParseRequest(req, virtualHost)
 	if err != nil {
@@ -102,15 +89,11 @@ func Decode(reqStr string) (IAccessKeySecretRequest, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "reqJson.Unmarshal rawReq")
 	}
-	var ret IAccessKeySecretRequest
-	switch rawReq.Algorithm {
-	case signV2Algorithm:
-		ret = &SAccessKeyRequestV2{}
-	case signV4Algorithm:
-		ret = &SAccessKeyRequestV4{}
-	default:
-		return nil, errors.Error("unsupported sign algorithm")
+	scheme := GetSignatureScheme(rawReq.Algorithm)
+	if scheme == nil {
+		return nil, errors.Wrap(ErrUnsupportedAlgorithm, rawReq.Algorithm)
 	}
+	ret := scheme.NewRequest()
 	err = reqJson.Unmarshal(ret)
 	if err != nil {
 		return nil, errors.Wrap(err, "reqJson.Unmarshal")
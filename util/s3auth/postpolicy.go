@@ -0,0 +1,412 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/errors"
+)
+
+// Browser-based upload with a POST policy, in accordance with
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html.
+const (
+	policyExpirationFormat = "2006-01-02T15:04:05.000Z"
+
+	policyCondEq                 = "eq"
+	policyCondStartsWith         = "starts-with"
+	policyCondContentLengthRange = "content-length-range"
+
+	policyFieldBucket = "bucket"
+
+	formPolicy          = "policy"
+	formFile            = "file"
+	formV2AccessKeyId   = "awsaccesskeyid"
+	formV2Signature     = "signature"
+	formV4Algorithm     = "x-amz-algorithm"
+	formV4Credential    = "x-amz-credential"
+	formV4Date          = "x-amz-date"
+	formV4Signature     = "x-amz-signature"
+	formIgnoredPrefix   = "x-ignore-"
+	formFieldValueLimit = 1024 * 1024
+)
+
+const (
+	ErrPolicyCondition = errors.Error("post policy condition not met")
+)
+
+type sPolicyCondition struct {
+	op string
+	// field is the lowercase form field name, without the leading $
+	field string
+	value string
+
+	min int64
+	max int64
+}
+
+// SPostPolicy is the policy document of a browser-based upload
+type SPostPolicy struct {
+	expiration time.Time
+	conditions []sPolicyCondition
+}
+
+func NewPostPolicy(expiration time.Time) *SPostPolicy {
+	return &SPostPolicy{
+		expiration: expiration.UTC(),
+	}
+}
+
+func (p *SPostPolicy) GetExpiration() time.Time {
+	return p.expiration
+}
+
+// AddCondition adds a eq or starts-with condition on a form field
+func (p *SPostPolicy) AddCondition(op string, field string, value string) *SPostPolicy {
+	p.conditions = append(p.conditions, sPolicyCondition{
+		op:    op,
+		field: strings.ToLower(strings.TrimPrefix(field, "$")),
+		value: value,
+	})
+	return p
+}
+
+func (p *SPostPolicy) SetBucket(bucket string) *SPostPolicy {
+	return p.AddCondition(policyCondEq, policyFieldBucket, bucket)
+}
+
+func (p *SPostPolicy) SetKey(key string) *SPostPolicy {
+	return p.AddCondition(policyCondEq, "key", key)
+}
+
+func (p *SPostPolicy) SetKeyStartsWith(prefix string) *SPostPolicy {
+	return p.AddCondition(policyCondStartsWith, "key", prefix)
+}
+
+func (p *SPostPolicy) SetContentType(contentType string) *SPostPolicy {
+	return p.AddCondition(policyCondEq, "Content-Type", contentType)
+}
+
+func (p *SPostPolicy) SetContentLengthRange(min, max int64) *SPostPolicy {
+	p.conditions = append(p.conditions, sPolicyCondition{
+		op:  policyCondContentLengthRange,
+		min: min,
+		max: max,
+	})
+	return p
+}
+
+func (p *SPostPolicy) toJSON() jsonutils.JSONObject {
+	conds := jsonutils.NewArray()
+	for _, cond := range p.conditions {
+		switch cond.op {
+		case policyCondContentLengthRange:
+			conds.Add(jsonutils.NewArray(jsonutils.NewString(cond.op), jsonutils.NewInt(cond.min), jsonutils.NewInt(cond.max)))
+		default:
+			conds.Add(jsonutils.NewArray(jsonutils.NewString(cond.op), jsonutils.NewString("$"+cond.field), jsonutils.NewString(cond.value)))
+		}
+	}
+	policy := jsonutils.NewDict()
+	policy.Set("expiration", jsonutils.NewString(p.expiration.Format(policyExpirationFormat)))
+	policy.Set("conditions", conds)
+	return policy
+}
+
+// Encode returns the base64 policy document
+func (p *SPostPolicy) Encode() string {
+	return base64.StdEncoding.EncodeToString([]byte(p.toJSON().String()))
+}
+
+// formFields returns the form fields fixed by the eq conditions
+func (p *SPostPolicy) formFields() map[string]string {
+	fields := make(map[string]string)
+	for _, cond := range p.conditions {
+		if cond.op == policyCondEq && cond.field != policyFieldBucket {
+			fields[cond.field] = cond.value
+		}
+	}
+	return fields
+}
+
+// SignV2 returns the form fields of a policy signed with signature V2,
+// including the fields fixed by the policy
+func (p *SPostPolicy) SignV2(accessKey, secretAccessKey string) map[string]string {
+	fields := p.formFields()
+	policy := p.Encode()
+	fields[formPolicy] = policy
+	fields[v2AccessKeyId] = accessKey
+	fields[formV2Signature] = signV2(secretAccessKey, policy)
+	return fields
+}
+
+// SignV4 returns the form fields of a policy signed with signature V4,
+// including the fields fixed by the policy. The conditions on the
+// x-amz-algorithm, x-amz-credential and x-amz-date fields are added to the
+// signed policy, p is left unchanged.
+func (p *SPostPolicy) SignV4(accessKey, secretAccessKey, location string) map[string]string {
+	t := time.Now().UTC()
+	p = &SPostPolicy{
+		expiration: p.expiration,
+		conditions: append([]sPolicyCondition{}, p.conditions...),
+	}
+	p.AddCondition(policyCondEq, formV4Algorithm, signV4Algorithm)
+	p.AddCondition(policyCondEq, formV4Credential, getCredential(accessKey, location, t))
+	p.AddCondition(policyCondEq, formV4Date, t.Format(iso8601DateFormat))
+
+	fields := p.formFields()
+	policy := p.Encode()
+	fields[formPolicy] = policy
+	fields[formV4Signature] = getSignature(getSigningKey(secretAccessKey, location, signV4Service, t), policy)
+	return fields
+}
+
+func policyInt(obj jsonutils.JSONObject) (int64, error) {
+	if val, err := obj.Int(); err == nil {
+		return val, nil
+	}
+	str, err := obj.GetString()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+func parsePolicyCondition(obj jsonutils.JSONObject) (sPolicyCondition, error) {
+	cond := sPolicyCondition{}
+	if dict, ok := obj.(*jsonutils.JSONDict); ok {
+		// {"field": "value"} is an exact match
+		m, _ := dict.GetMap()
+		if len(m) != 1 {
+			return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+		}
+		for k, v := range m {
+			value, err := v.GetString()
+			if err != nil {
+				return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+			}
+			cond.op = policyCondEq
+			cond.field = strings.ToLower(k)
+			cond.value = value
+		}
+		return cond, nil
+	}
+	arr, ok := obj.(*jsonutils.JSONArray)
+	if !ok || arr.Length() != 3 {
+		return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+	}
+	items, _ := arr.GetArray()
+	op, err := items[0].GetString()
+	if err != nil {
+		return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+	}
+	cond.op = strings.ToLower(op)
+	switch cond.op {
+	case policyCondEq, policyCondStartsWith:
+		field, err := items[1].GetString()
+		if err != nil || !strings.HasPrefix(field, "$") {
+			return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+		}
+		cond.field = strings.ToLower(field[1:])
+		cond.value, err = items[2].GetString()
+		if err != nil {
+			return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+		}
+	case policyCondContentLengthRange:
+		cond.min, err = policyInt(items[1])
+		if err != nil {
+			return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+		}
+		cond.max, err = policyInt(items[2])
+		if err != nil || cond.min < 0 || cond.max < cond.min {
+			return cond, errors.Wrapf(errors.ErrInvalidFormat, "illegal condition %s", obj)
+		}
+	default:
+		return cond, errors.Wrapf(errors.ErrNotSupported, "condition %s", op)
+	}
+	return cond, nil
+}
+
+// ParsePostPolicy decodes a base64 policy document
+func ParsePostPolicy(policy string) (*SPostPolicy, error) {
+	data, err := base64.StdEncoding.DecodeString(policy)
+	if err != nil {
+		return nil, errors.Wrap(err, "base64.StdEncoding.DecodeString")
+	}
+	obj, err := jsonutils.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "jsonutils.Parse")
+	}
+	expStr, err := obj.GetString("expiration")
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "missing expiration")
+	}
+	p := &SPostPolicy{}
+	p.expiration, err = time.Parse(time.RFC3339Nano, expStr)
+	if err != nil {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "illegal expiration %s", expStr)
+	}
+	conds, err := obj.GetArray("conditions")
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "missing conditions")
+	}
+	for _, condObj := range conds {
+		cond, err := parsePolicyCondition(condObj)
+		if err != nil {
+			return nil, err
+		}
+		p.conditions = append(p.conditions, cond)
+	}
+	return p, nil
+}
+
+func isPolicyExemptField(field string) bool {
+	switch field {
+	case formPolicy, formFile, formV2AccessKeyId, formV2Signature, formV4Signature:
+		return true
+	}
+	return strings.HasPrefix(field, formIgnoredPrefix)
+}
+
+// lowerForm returns the form with lowercase field names
+func lowerForm(form url.Values) map[string]string {
+	fields := make(map[string]string, len(form))
+	for k, v := range form {
+		if len(v) > 0 {
+			fields[strings.ToLower(k)] = v[0]
+		}
+	}
+	return fields
+}
+
+// CheckConditions checks that the form fields of an upload of
+// contentLength bytes to bucket satisfy every condition of the policy, and
+// that every form field is covered by a condition
+func (p *SPostPolicy) CheckConditions(form url.Values, bucket string, contentLength int64) error {
+	fields := lowerForm(form)
+	fields[policyFieldBucket] = bucket
+	covered := make(map[string]bool)
+	for _, cond := range p.conditions {
+		switch cond.op {
+		case policyCondContentLengthRange:
+			if contentLength < cond.min || contentLength > cond.max {
+				return errors.Wrapf(ErrPolicyCondition, "content length %d not in [%d, %d]", contentLength, cond.min, cond.max)
+			}
+			continue
+		}
+		covered[cond.field] = true
+		value, ok := fields[cond.field]
+		if !ok {
+			if cond.op == policyCondStartsWith && len(cond.value) == 0 {
+				continue
+			}
+			return errors.Wrapf(ErrPolicyCondition, "missing field %s", cond.field)
+		}
+		switch cond.op {
+		case policyCondEq:
+			if value != cond.value {
+				return errors.Wrapf(ErrPolicyCondition, "%s is %q, expect %q", cond.field, value, cond.value)
+			}
+		case policyCondStartsWith:
+			if !strings.HasPrefix(value, cond.value) {
+				return errors.Wrapf(ErrPolicyCondition, "%s %q does not start with %q", cond.field, value, cond.value)
+			}
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if k != policyFieldBucket && !covered[k] && !isPolicyExemptField(k) {
+			return errors.Wrapf(ErrPolicyCondition, "field %s not covered by the policy", k)
+		}
+	}
+	return nil
+}
+
+// decodePostPolicyForm returns the signature of a POST policy form, whose
+// Request is the base64 policy document
+func decodePostPolicyForm(fields map[string]string) (IAccessKeySecretRequest, error) {
+	policy := fields[formPolicy]
+	if len(policy) == 0 {
+		return nil, errors.Error("missing policy")
+	}
+	if algo, ok := fields[formV4Algorithm]; ok {
+		if algo != signV4Algorithm {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		req := NewV4Request()
+		if err := req.parseCredential(fields[formV4Credential]); err != nil {
+			return nil, errors.Wrap(err, "illegal x-amz-credential")
+		}
+		signDate, err := time.Parse(iso8601DateFormat, fields[formV4Date])
+		if err != nil {
+			return nil, errors.Error("illegal x-amz-date")
+		}
+		req.SignDate = signDate
+		req.Signature = fields[formV4Signature]
+		req.Request = policy
+		return &req, nil
+	}
+	req := NewV2Request()
+	req.AccessKey = fields[formV2AccessKeyId]
+	req.Signature = fields[formV2Signature]
+	req.Request = policy
+	return &req, nil
+}
+
+// ValidatePostPolicyForm checks the policy of the form fields of a
+// browser-based upload of contentLength bytes to bucket, and returns the
+// signature to be verified with the secret of its access key. The key field
+// must have been substituted for ${filename} by the caller.
+func ValidatePostPolicyForm(form url.Values, bucket string, contentLength int64) (IAccessKeySecretRequest, error) {
+	fields := lowerForm(form)
+	for k, v := range fields {
+		if len(v) > formFieldValueLimit {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "field %s too long", k)
+		}
+	}
+	aksk, err := decodePostPolicyForm(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "decodePostPolicyForm")
+	}
+	if err := aksk.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParsePostPolicy(fields[formPolicy])
+	if err != nil {
+		return nil, errors.Wrap(err, "ParsePostPolicy")
+	}
+	if time.Now().After(policy.expiration) {
+		return nil, errors.Wrapf(ErrRequestExpired, "policy expired at %s", policy.expiration)
+	}
+	switch req := aksk.(type) {
+	case *SAccessKeyRequestV2:
+		req.Expires = policy.expiration
+	case *SAccessKeyRequestV4:
+		req.Expires = policy.expiration
+	}
+	if err := policy.CheckConditions(form, bucket, contentLength); err != nil {
+		return nil, err
+	}
+	return aksk, nil
+}
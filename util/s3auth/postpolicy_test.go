@@ -0,0 +1,161 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func newTestPostPolicy(expiration time.Time) *SPostPolicy {
+	return NewPostPolicy(expiration).
+		SetBucket("uploads").
+		SetKeyStartsWith("user/alice/").
+		SetContentType("image/jpeg").
+		SetContentLengthRange(1, 1024*1024).
+		AddCondition("starts-with", "$x-amz-meta-tag", "")
+}
+
+func toForm(fields map[string]string) url.Values {
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	return form
+}
+
+func TestPostPolicy(t *testing.T) {
+	policy := newTestPostPolicy(time.Now().Add(time.Hour))
+	signers := []struct {
+		name string
+		sign func() map[string]string
+	}{
+		{"v2", func() map[string]string { return policy.SignV2(testAccessKey, testSecret) }},
+		{"v4", func() map[string]string { return policy.SignV4(testAccessKey, testSecret, "cn-beijing") }},
+	}
+	for _, signer := range signers {
+		fields := signer.sign()
+		if fields["content-type"] != "image/jpeg" {
+			t.Errorf("%s: fixed field missing in %v", signer.name, fields)
+		}
+		form := toForm(fields)
+		form.Set("key", "user/alice/photo.jpg")
+		form.Set("x-ignore-debug", "1")
+
+		aksk, err := ValidatePostPolicyForm(form, "uploads", 2048)
+		if err != nil {
+			t.Fatalf("%s: ValidatePostPolicyForm: %v", signer.name, err)
+		}
+		if aksk.GetAccessKey() != testAccessKey {
+			t.Errorf("%s: access key %s", signer.name, aksk.GetAccessKey())
+		}
+		if err := aksk.Verify(testSecret); err != nil {
+			t.Errorf("%s: Verify: %v", signer.name, err)
+		}
+		if err := aksk.Verify("wrong"); err == nil {
+			t.Errorf("%s: Verify with a wrong secret", signer.name)
+		}
+
+		cases := []struct {
+			name   string
+			modify func(form url.Values) (string, int64)
+		}{
+			{"wrong bucket", func(form url.Values) (string, int64) { return "other", 2048 }},
+			{"wrong key prefix", func(form url.Values) (string, int64) {
+				form.Set("key", "user/bob/photo.jpg")
+				return "uploads", 2048
+			}},
+			{"missing key", func(form url.Values) (string, int64) {
+				form.Del("key")
+				return "uploads", 2048
+			}},
+			{"wrong content type", func(form url.Values) (string, int64) {
+				form.Del("content-type")
+				form.Set("Content-Type", "text/html")
+				return "uploads", 2048
+			}},
+			{"too large", func(form url.Values) (string, int64) { return "uploads", 1024*1024 + 1 }},
+			{"empty", func(form url.Values) (string, int64) { return "uploads", 0 }},
+			{"uncovered field", func(form url.Values) (string, int64) {
+				form.Set("acl", "public-read")
+				return "uploads", 2048
+			}},
+		}
+		for _, c := range cases {
+			modified := url.Values{}
+			for k, v := range form {
+				modified[k] = append([]string{}, v...)
+			}
+			bucket, length := c.modify(modified)
+			if _, err := ValidatePostPolicyForm(modified, bucket, length); errors.Cause(err) != ErrPolicyCondition {
+				t.Errorf("%s %s: expect policy condition error, got %v", signer.name, c.name, err)
+			}
+		}
+	}
+	if len(policy.conditions) != 5 {
+		t.Errorf("SignV4 modified the policy: %d conditions", len(policy.conditions))
+	}
+}
+
+func TestPostPolicyExpired(t *testing.T) {
+	policy := newTestPostPolicy(time.Now().Add(-time.Minute))
+	form := toForm(policy.SignV4(testAccessKey, testSecret, "cn-beijing"))
+	form.Set("key", "user/alice/photo.jpg")
+	if _, err := ValidatePostPolicyForm(form, "uploads", 2048); errors.Cause(err) != ErrRequestExpired {
+		t.Errorf("expect expired, got %v", err)
+	}
+}
+
+func TestParsePostPolicy(t *testing.T) {
+	doc := `{ "expiration": "2007-12-01T12:00:00.000Z",
+  "conditions": [
+    {"bucket": "johnsmith"},
+    ["starts-with", "$key", "user/eric/"],
+    {"acl": "public-read"},
+    ["eq", "$Content-Type", "image/jpeg"],
+    ["content-length-range", "0", 1048576]
+  ]
+}`
+	policy, err := ParsePostPolicy(base64.StdEncoding.EncodeToString([]byte(doc)))
+	if err != nil {
+		t.Fatalf("ParsePostPolicy: %v", err)
+	}
+	if !policy.GetExpiration().Equal(time.Date(2007, 12, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiration %s", policy.GetExpiration())
+	}
+	form := url.Values{
+		"key":          []string{"user/eric/a.jpg"},
+		"acl":          []string{"public-read"},
+		"Content-Type": []string{"image/jpeg"},
+	}
+	if err := policy.CheckConditions(form, "johnsmith", 10); err != nil {
+		t.Errorf("CheckConditions: %v", err)
+	}
+
+	for _, doc := range []string{
+		`{"conditions": []}`,
+		`{"expiration": "2007-12-01T12:00:00.000Z", "conditions": [["in", "$key", "a"]]}`,
+		`{"expiration": "2007-12-01T12:00:00.000Z", "conditions": [["content-length-range", 10, 1]]}`,
+		`{"expiration": "2007-12-01T12:00:00.000Z", "conditions": [["eq", "key", "a"]]}`,
+	} {
+		if _, err := ParsePostPolicy(base64.StdEncoding.EncodeToString([]byte(doc))); err == nil {
+			t.Errorf("expect error for %s", doc)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// SSignInput is the credential and options used to sign a request
+type SSignInput struct {
+	AccessKey string
+	Secret    string
+	// Location is the region of the scheme that scopes the credential
+	Location string
+	// VirtualHost tells whether the bucket is addressed by host name
+	VirtualHost bool
+	// Body is the payload of the request, nil for empty payload
+	Body io.Reader
+	// Expires signs the query string as a presigned URL if positive,
+	// otherwise the Authorization header is signed
+	Expires time.Duration
+}
+
+// ISignatureScheme is a request signing scheme, e.g. S3 signature V2 or V4
+type ISignatureScheme interface {
+	// GetAlgorithm returns the algorithm name, also the value of
+	// SAccessKeyRequest.Algorithm
+	GetAlgorithm() string
+	// Detect tells whether the request is signed with this scheme
+	Detect(req http.Request) bool
+	// Decode decodes the signature of a request detected by this scheme
+	Decode(req http.Request) (IAccessKeySecretRequest, error)
+	// NewRequest returns an empty request to unmarshal an encoded request into
+	NewRequest() IAccessKeySecretRequest
+	// Sign returns a signed copy of the request
+	Sign(req http.Request, input SSignInput) *http.Request
+}
+
+var (
+	signatureSchemes     []ISignatureScheme
+	signatureSchemeMap   = make(map[string]ISignatureScheme)
+	signatureSchemeMutex sync.RWMutex
+)
+
+func init() {
+	RegisterSignatureScheme(sSignatureSchemeV4{})
+	RegisterSignatureScheme(sSignatureSchemeV2{})
+}
+
+// RegisterSignatureScheme registers a signing scheme. Schemes are detected
+// in the order of registration. It panics if the algorithm is already
+// registered.
+func RegisterSignatureScheme(scheme ISignatureScheme) {
+	signatureSchemeMutex.Lock()
+	defer signatureSchemeMutex.Unlock()
+
+	algo := scheme.GetAlgorithm()
+	if _, ok := signatureSchemeMap[algo]; ok {
+		panic(fmt.Sprintf("signature scheme %s already registered", algo))
+	}
+	signatureSchemeMap[algo] = scheme
+	signatureSchemes = append(signatureSchemes, scheme)
+}
+
+// GetSignatureScheme returns the scheme of the algorithm, nil if not registered
+func GetSignatureScheme(algo string) ISignatureScheme {
+	signatureSchemeMutex.RLock()
+	defer signatureSchemeMutex.RUnlock()
+
+	return signatureSchemeMap[algo]
+}
+
+func detectSignatureScheme(req http.Request) ISignatureScheme {
+	signatureSchemeMutex.RLock()
+	defer signatureSchemeMutex.RUnlock()
+
+	for _, scheme := range signatureSchemes {
+		if scheme.Detect(req) {
+			return scheme
+		}
+	}
+	return nil
+}
+
+// Sign signs the request with the scheme of the algorithm
+func Sign(algo string, req http.Request, input SSignInput) (*http.Request, error) {
+	scheme := GetSignatureScheme(algo)
+	if scheme == nil {
+		return nil, errors.Wrap(ErrUnsupportedAlgorithm, algo)
+	}
+	return scheme.Sign(req, input), nil
+}
+
+// AuthHeaderAlgorithm returns the algorithm and the credential part of the
+// Authorization header, i.e. "<algorithm> <credential>"
+func AuthHeaderAlgorithm(req http.Request) (string, string) {
+	authHeader := req.Header.Get("Authorization")
+	pos := strings.IndexByte(authHeader, ' ')
+	if pos <= 0 {
+		return "", ""
+	}
+	return authHeader[:pos], authHeader[pos+1:]
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/errors"
+)
+
+const testHmacAlgorithm = "TEST-HMAC-SHA256"
+
+type sTestHmacRequest struct {
+	SAccessKeyRequest
+}
+
+func testHmacStringToSign(req http.Request) string {
+	return strings.Join([]string{
+		req.Method,
+		EncodePath(req.URL.Path),
+		CanonicalQueryString(req.URL.Query()),
+		CanonicalHeaders(req, SignedHeaders(req, map[string]bool{"Authorization": true}, "host")),
+	}, "\n")
+}
+
+func (aksk *sTestHmacRequest) ParseRequest(req http.Request, virtualHost bool) error {
+	aksk.Request = testHmacStringToSign(req)
+	return nil
+}
+
+func (aksk sTestHmacRequest) Verify(secret string) error {
+	if hex.EncodeToString(HmacSHA256([]byte(secret), []byte(aksk.Request))) != aksk.Signature {
+		return errors.Error("signature mismatch")
+	}
+	return nil
+}
+
+func (aksk sTestHmacRequest) Encode() string {
+	return jsonutils.Marshal(aksk).String()
+}
+
+type sTestHmacScheme struct{}
+
+func (sTestHmacScheme) GetAlgorithm() string {
+	return testHmacAlgorithm
+}
+
+func (sTestHmacScheme) Detect(req http.Request) bool {
+	algo, _ := AuthHeaderAlgorithm(req)
+	return algo == testHmacAlgorithm
+}
+
+func (sTestHmacScheme) Decode(req http.Request) (IAccessKeySecretRequest, error) {
+	_, cred := AuthHeaderAlgorithm(req)
+	pos := strings.IndexByte(cred, ':')
+	if pos <= 0 {
+		return nil, errors.Error("illegal authorization header")
+	}
+	ret := &sTestHmacRequest{}
+	ret.Algorithm = testHmacAlgorithm
+	ret.AccessKey = cred[:pos]
+	ret.Signature = cred[pos+1:]
+	return ret, nil
+}
+
+func (sTestHmacScheme) NewRequest() IAccessKeySecretRequest {
+	return &sTestHmacRequest{}
+}
+
+func (sTestHmacScheme) Sign(req http.Request, input SSignInput) *http.Request {
+	req.Header = req.Header.Clone()
+	signature := hex.EncodeToString(HmacSHA256([]byte(input.Secret), []byte(testHmacStringToSign(req))))
+	req.Header.Set("Authorization", testHmacAlgorithm+" "+input.AccessKey+":"+signature)
+	return &req
+}
+
+func init() {
+	RegisterSignatureScheme(sTestHmacScheme{})
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	input := SSignInput{
+		AccessKey: testAccessKey,
+		Secret:    testSecret,
+		Location:  "cn-beijing",
+	}
+	for _, algo := range []string{signV4Algorithm, signV2Algorithm, testHmacAlgorithm} {
+		req, _ := http.NewRequest(http.MethodGet, "https://s3.yunion.io/bucket/a%20b?acl&x=1+2", nil)
+		req.Header.Set("X-Amz-Meta-Name", "  some   value ")
+		signed, err := Sign(algo, *req, input)
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", algo, err)
+		}
+		if len(req.Header.Get("Authorization")) > 0 {
+			t.Errorf("%s: original header modified", algo)
+		}
+		aksk, err := DecodeAccessKeyRequest(*signed, false)
+		if err != nil {
+			t.Fatalf("%s: DecodeAccessKeyRequest: %v", algo, err)
+		}
+		if err := aksk.Verify(testSecret); err != nil {
+			t.Errorf("%s: Verify: %v", algo, err)
+		}
+		if err := aksk.Verify("wrong"); err == nil {
+			t.Errorf("%s: Verify with a wrong secret", algo)
+		}
+		decoded, err := Decode(aksk.Encode())
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", algo, err)
+		}
+		if _, ok := decoded.(*sTestHmacRequest); ok != (algo == testHmacAlgorithm) {
+			t.Errorf("%s: decoded as %T", algo, decoded)
+		}
+		if err := decoded.Verify(testSecret); err != nil {
+			t.Errorf("%s: Verify decoded: %v", algo, err)
+		}
+	}
+
+	if _, err := Sign("NONE", http.Request{}, input); errors.Cause(err) != ErrUnsupportedAlgorithm {
+		t.Errorf("Sign unknown algorithm: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.yunion.io/bucket", nil)
+	req.Header.Set("Authorization", "NONE abc")
+	if _, err := DecodeAccessKeyRequest(*req, false); errors.Cause(err) != ErrUnsupportedAlgorithm {
+		t.Errorf("DecodeAccessKeyRequest unknown algorithm: %v", err)
+	}
+
+	presigned, _ := Sign(signV4Algorithm, *req, SSignInput{AccessKey: testAccessKey, Secret: testSecret, Expires: time.Minute})
+	if len(presigned.URL.Query().Get(amzSignature)) == 0 {
+		t.Errorf("presign by Expires: %s", presigned.URL)
+	}
+}
+
+func TestRegisterSignatureSchemeDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("duplicate registration should panic")
+		}
+	}()
+	RegisterSignatureScheme(sTestHmacScheme{})
+}
+
+func TestCanonicalHelpers(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.yunion.io/b?z=1&a=x+y&X-Amz-Signature=s", nil)
+	req.Header.Set("X-Amz-Date", "20190824T000000Z")
+	req.Header.Set("User-Agent", "test")
+	if got := CanonicalQueryString(req.URL.Query(), amzSignature); got != "a=x%20y&z=1" {
+		t.Errorf("CanonicalQueryString: %s", got)
+	}
+	if len(req.URL.Query().Get(amzSignature)) == 0 {
+		t.Errorf("CanonicalQueryString modified the query")
+	}
+	headers := SignedHeaders(*req, v4IgnoredHeaders, "host", "X-Amz-Date")
+	if got := strings.Join(headers, ";"); got != "host;x-amz-date" {
+		t.Errorf("SignedHeaders: %s", got)
+	}
+	if got := CanonicalHeaders(*req, headers); got != "host:s3.yunion.io\nx-amz-date:20190824T000000Z\n" {
+		t.Errorf("CanonicalHeaders: %q", got)
+	}
+	if got := TrimHeaderValue("  a   b  "); got != "a b" {
+		t.Errorf("TrimHeaderValue: %q", got)
+	}
+}
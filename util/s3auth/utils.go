@@ -32,7 +32,7 @@ var reservedObjectNames = regexp.MustCompile("^[a-zA-Z0-9-_.~/]+$")
 //
 // This function on the other hand is a direct replacement for url.Encode() technique to support
 // pretty much every UTF-8 character.
-func encodePath(pathName string) string {
+func EncodePath(pathName string) string {
 	if reservedObjectNames.MatchString(pathName) {
 		return pathName
 	}
@@ -80,10 +80,10 @@ func encodeURL2Path(req http.Request, virtualHost bool) (path string) {
 			bucketName := reqHost[:dotPos]
 			path = "/" + bucketName
 			path += req.URL.Path
-			path = encodePath(path)
+			path = EncodePath(path)
 			return
 		}
 	}
-	path = encodePath(req.URL.Path)
+	path = EncodePath(req.URL.Path)
 	return
 }
@@ -22,7 +22,9 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"yunion.io/x/jsonutils"
 	"yunion.io/x/pkg/errors"
@@ -42,10 +44,12 @@ const (
 //	Date + "\n" +
 //	CanonicalizedProtocolHeaders +
 //	CanonicalizedResource;
-func stringToSignV2(req http.Request, virtualHost bool) string {
+//
+// For query string authentication, Date is replaced by Expires.
+func stringToSignV2(req http.Request, virtualHost bool, date string) string {
 	buf := new(bytes.Buffer)
 	// Write standard headers.
-	writeSignV2Headers(buf, req)
+	writeSignV2Headers(buf, req, date)
 	// Write canonicalized protocol headers if any.
 	writeCanonicalizedHeaders(buf, req)
 	// Write canonicalized Query resources if any.
@@ -54,11 +58,11 @@ func stringToSignV2(req http.Request, virtualHost bool) string {
 }
 
 // writeSignV2Headers - write signV2 required headers.
-func writeSignV2Headers(buf *bytes.Buffer, req http.Request) {
+func writeSignV2Headers(buf *bytes.Buffer, req http.Request, date string) {
 	buf.WriteString(req.Method + "\n")
 	buf.WriteString(req.Header.Get("Content-Md5") + "\n")
 	buf.WriteString(req.Header.Get("Content-Type") + "\n")
-	buf.WriteString(req.Header.Get("Date") + "\n")
+	buf.WriteString(date + "\n")
 }
 
 // writeCanonicalizedHeaders - write canonicalized headers.
@@ -201,7 +205,7 @@ func writeCanonicalizedResource(buf *bytes.Buffer, req http.Request, virtualHost
 
 	signature := base64.StdEncoding.EncodeToString(hm.Sum(nil))
 
-	if aksk.Signature != signature {
+	if !hmac.Equal([]byte(aksk.Signature), []byte(signature)) {
 		return errors.Error("signature mismatch")
 	}
 
@@ -210,23 +214,49 @@ func writeCanonicalizedResource(buf *bytes.Buffer, req http.Request, virtualHost
 
 type SAccessKeyRequestV2 struct {
 	SAccessKeyRequest
+	// Expires is set for query string authentication
+	Expires time.Time
+	// SignDate is the x-amz-date or Date header of the request
+	SignDate time.Time
 }
 
 func (aksk *SAccessKeyRequestV2) ParseRequest(req http.Request, virtualHost bool) error {
-	aksk.Request = stringToSignV2(req, virtualHost)
+	date := req.Header.Get("Date")
+	signDate := req.Header.Get("X-Amz-Date")
+	if len(signDate) == 0 {
+		signDate = date
+	}
+	if len(signDate) > 0 {
+		aksk.SignDate, _ = http.ParseTime(signDate)
+	}
+	if !aksk.Expires.IsZero() {
+		date = strconv.FormatInt(aksk.Expires.Unix(), 10)
+	}
+	aksk.Request = stringToSignV2(req, virtualHost, date)
 	return nil
 }
 
-func (aksk SAccessKeyRequestV2) Verify(secret string) error {
+func signV2(secret string, stringToSign string) string {
 	hm := hmac.New(sha1.New, []byte(secret))
-	hm.Write([]byte(aksk.Request))
+	hm.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(hm.Sum(nil))
+}
 
-	signature := base64.StdEncoding.EncodeToString(hm.Sum(nil))
-	if signature != aksk.Signature {
-		return errors.Error("signature mismatch")
-	}
+func (aksk SAccessKeyRequestV2) Verify(secret string) error {
+	return aksk.VerifyWithOptions(secret, nil)
+}
 
-	return nil
+// VerifyWithOptions verifies the signature, then the expiration and the
+// checks of opts
+func (aksk SAccessKeyRequestV2) VerifyWithOptions(secret string, opts *SVerifyOptions) error {
+	signature := signV2(secret, aksk.Request)
+	if !hmac.Equal([]byte(signature), []byte(aksk.Signature)) {
+		return ErrSignatureMismatch
+	}
+	if !aksk.Expires.IsZero() && time.Now().After(aksk.Expires) {
+		return ErrRequestExpired
+	}
+	return opts.verify(aksk.SAccessKeyRequest, aksk.SignDate, aksk.Expires)
 }
 
 func (aksk SAccessKeyRequestV2) Encode() string {
@@ -249,3 +279,61 @@ func decodeAuthHeaderV2(authStr string) (*SAccessKeyRequestV2, error) {
 	akskReq.Signature = authStr[pos+1:]
 	return &akskReq, nil
 }
+
+// SignV2 sign the request before Do() with the Authorization header of
+// signature V2
+func SignV2(req http.Request, accessKey, secretAccessKey string, virtualHost bool) *http.Request {
+	if accessKey == "" || secretAccessKey == "" {
+		return &req
+	}
+	req.Header = req.Header.Clone()
+	date := req.Header.Get("Date")
+	if len(date) == 0 {
+		date = time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+	}
+	signature := signV2(secretAccessKey, stringToSignV2(req, virtualHost, date))
+	req.Header.Set("Authorization", signV2Algorithm+" "+accessKey+":"+signature)
+	return &req
+}
+
+type sSignatureSchemeV2 struct{}
+
+func (sSignatureSchemeV2) GetAlgorithm() string {
+	return signV2Algorithm
+}
+
+func (sSignatureSchemeV2) Detect(req http.Request) bool {
+	algo, _ := AuthHeaderAlgorithm(req)
+	if len(algo) > 0 {
+		return algo == signV2Algorithm
+	}
+	return len(req.URL.Query().Get(v2AccessKeyId)) > 0
+}
+
+func (sSignatureSchemeV2) Decode(req http.Request) (IAccessKeySecretRequest, error) {
+	var ret *SAccessKeyRequestV2
+	var err error
+	algo, cred := AuthHeaderAlgorithm(req)
+	if len(algo) > 0 {
+		ret, err = decodeAuthHeaderV2(cred)
+	} else {
+		ret, err = decodeAuthQueryV2(req.URL.Query())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (sSignatureSchemeV2) NewRequest() IAccessKeySecretRequest {
+	req := NewV2Request()
+	return &req
+}
+
+func (sSignatureSchemeV2) Sign(req http.Request, input SSignInput) *http.Request {
+	if input.Expires > 0 {
+		return PresignV2(req, input.AccessKey, input.Secret, input.Expires, input.VirtualHost)
+	}
+	return SignV2(req, input.AccessKey, input.Secret, input.VirtualHost)
+}
@@ -15,13 +15,13 @@
 package s3auth
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,17 +36,20 @@ const (
 	signV4Algorithm   = "AWS4-HMAC-SHA256"
 	iso8601DateFormat = "20060102T150405Z"
 	yyyymmdd          = "20060102"
+	// signV4Service is the service of the credential scope of the signed
+	// requests
+	signV4Service = "s3"
 
 	unsignedPayload = "UNSIGNED-PAYLOAD"
 )
 
 // getScope generate a string of a specific date, an AWS region, and a
 // service.
-func getScope(location string, t time.Time) string {
+func getScope(location, service string, t time.Time) string {
 	scope := strings.Join([]string{
 		t.Format(yyyymmdd),
 		location,
-		"s3",
+		service,
 		"aws4_request",
 	}, "/")
 	return scope
@@ -60,9 +63,9 @@ func sum256(data []byte) []byte {
 }
 
 // getStringToSign a string based on selected query values.
-func getStringToSignV4(t time.Time, location, canonicalRequest string) string {
+func getStringToSignV4(t time.Time, location, service, canonicalRequest string) string {
 	stringToSign := signV4Algorithm + "\n" + t.Format(iso8601DateFormat) + "\n"
-	stringToSign += getScope(location, t) + "\n"
+	stringToSign += getScope(location, service, t) + "\n"
 	stringToSign += hex.EncodeToString(sum256([]byte(canonicalRequest)))
 	return stringToSign
 }
@@ -109,25 +112,18 @@ var v4IgnoredHeaders = map[string]bool{
 	"User-Agent":     true,
 }
 
-// sumHMAC calculate hmac between two input byte array.
-func sumHMAC(key []byte, data []byte) []byte {
-	hash := hmac.New(sha256.New, key)
-	hash.Write(data)
-	return hash.Sum(nil)
-}
-
 // getSigningKey hmac seed to calculate final signature.
-func getSigningKey(secret, loc string, t time.Time) []byte {
-	date := sumHMAC([]byte("AWS4"+secret), []byte(t.Format(yyyymmdd)))
-	location := sumHMAC(date, []byte(loc))
-	service := sumHMAC(location, []byte("s3"))
-	signingKey := sumHMAC(service, []byte("aws4_request"))
+func getSigningKey(secret, loc, svc string, t time.Time) []byte {
+	date := HmacSHA256([]byte("AWS4"+secret), []byte(t.Format(yyyymmdd)))
+	location := HmacSHA256(date, []byte(loc))
+	service := HmacSHA256(location, []byte(svc))
+	signingKey := HmacSHA256(service, []byte("aws4_request"))
 	return signingKey
 }
 
 // getSignature final signature in hexadecimal form.
 func getSignature(signingKey []byte, stringToSign string) string {
-	return hex.EncodeToString(sumHMAC(signingKey, []byte(stringToSign)))
+	return hex.EncodeToString(HmacSHA256(signingKey, []byte(stringToSign)))
 }
 
 // getCanonicalRequest generate a canonical request of style.
@@ -140,79 +136,25 @@ func getSignature(signingKey []byte, stringToSign string) string {
 //	<CanonicalHeaders>\n
 //	<SignedHeaders>\n
 //	<HashedPayload>
+//
+// The X-Amz-Signature of a presigned request is excluded from the
+// canonical query string.
 func getCanonicalRequest(req http.Request, signedHeaders []string) string {
-	req.URL.RawQuery = strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
 	canonicalRequest := strings.Join([]string{
 		req.Method,
-		encodePath(req.URL.Path),
-		req.URL.RawQuery,
-		getCanonicalHeaders(req, signedHeaders),
+		EncodePath(req.URL.Path),
+		CanonicalQueryString(req.URL.Query(), amzSignature),
+		CanonicalHeaders(req, signedHeaders),
 		strings.Join(signedHeaders, ";"),
 		getHashedPayload(req),
 	}, "\n")
 	return canonicalRequest
 }
 
-// Trim leading and trailing spaces and replace sequential spaces with one space, following Trimall()
-// in http://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
-func signV4TrimAll(input string) string {
-	// Compress adjacent spaces (a space is determined by
-	// unicode.IsSpace() internally here) to one space and return
-	return strings.Join(strings.Fields(input), " ")
-}
-
-// getCanonicalHeaders generate a list of request headers for
-// signature.
-func getCanonicalHeaders(req http.Request, signedHeaders []string) string {
-	var buf bytes.Buffer
-	// Save all the headers in canonical form <header>:<value> newline
-	// separated for each header.
-	for _, k := range signedHeaders {
-		buf.WriteString(k)
-		buf.WriteByte(':')
-		switch {
-		case k == "host":
-			buf.WriteString(getHostAddr(req))
-			fallthrough
-		default:
-			for idx, v := range req.Header[http.CanonicalHeaderKey(k)] {
-				if idx > 0 {
-					buf.WriteByte(',')
-				}
-				buf.WriteString(signV4TrimAll(v))
-			}
-			buf.WriteByte('\n')
-		}
-	}
-	return buf.String()
-}
-
-// getSignedHeaders generate all signed request headers.
-// i.e lexically sorted, semicolon-separated list of lowercase
-// request header names.
-func getSignedHeaders(req http.Request, ignoredHeaders map[string]bool) []string {
-	var headers []string
-	hasHost := false
-	hasContentHash := false
-	for k := range req.Header {
-		if _, ok := ignoredHeaders[http.CanonicalHeaderKey(k)]; ok {
-			continue // Ignored header found continue.
-		}
-		if strings.EqualFold(k, "host") {
-			hasHost = true
-		} else if strings.EqualFold(k, "x-amz-content-sha256") {
-			hasContentHash = true
-		}
-		headers = append(headers, strings.ToLower(k))
-	}
-	if !hasHost {
-		headers = append(headers, "host")
-	}
-	if !hasContentHash {
-		headers = append(headers, "x-amz-content-sha256")
-	}
-	sort.Strings(headers)
-	return headers
+// getSignedHeadersV4 returns the signed headers of a V4 request, including
+// host and x-amz-content-sha256
+func getSignedHeadersV4(req http.Request) []string {
+	return SignedHeaders(req, v4IgnoredHeaders, "host", "x-amz-content-sha256")
 }
 
 // getHashedPayload get the hexadecimal value of the SHA256 hash of
@@ -228,9 +170,27 @@ func getHashedPayload(req http.Request) string {
 
 type SAccessKeyRequestV4 struct {
 	SAccessKeyRequest
-	Location      string
+	Location string
+	// ScopeDate and Service are the date and service of the credential scope
+	ScopeDate     string
+	Service       string
 	SignedHeaders []string
 	SignDate      time.Time
+	// Expires is set for a presigned request
+	Expires time.Time
+	// ContentSha256 is the x-amz-content-sha256 of the request
+	ContentSha256 string
+	// DecodedContentLength is the payload length of a streaming request,
+	// -1 if unknown
+	DecodedContentLength int64
+}
+
+// service is the service of the credential scope, s3 if not parsed
+func (aksk SAccessKeyRequestV4) service() string {
+	if len(aksk.Service) == 0 {
+		return signV4Service
+	}
+	return aksk.Service
 }
 
 func NewV4Request() SAccessKeyRequestV4 {
@@ -239,6 +199,19 @@ func NewV4Request() SAccessKeyRequestV4 {
 	return req
 }
 
+// parseCredential parses <access key>/<date>/<region>/<service>/aws4_request
+func (aksk *SAccessKeyRequestV4) parseCredential(credential string) error {
+	credParts := strings.Split(credential, "/")
+	if len(credParts) != 5 || credParts[4] != "aws4_request" {
+		return errors.Wrap(errors.ErrInvalidFormat, credential)
+	}
+	aksk.AccessKey = credParts[0]
+	aksk.ScopeDate = credParts[1]
+	aksk.Location = credParts[2]
+	aksk.Service = credParts[3]
+	return nil
+}
+
 // AWS4-HMAC-SHA256
 // Credential=xxxx/20190824/us-east-1/s3/aws4_request,SignedHeaders=date;host;x-amz-content-sha256;x-amz-date,Signature=27a135c6f51cc
 func decodeAuthHeaderV4(authStr string) (*SAccessKeyRequestV4, error) {
@@ -250,12 +223,9 @@ func decodeAuthHeaderV4(authStr string) (*SAccessKeyRequestV4, error) {
 		!strings.HasPrefix(parts[2], "Signature=") {
 		return nil, errors.Error("illegal v4 auth header")
 	}
-	credParts := strings.Split(parts[0][len("Credential="):], "/")
-	if len(credParts) != 5 {
-		return nil, errors.Error("illegal v4 auth header Credential")
+	if err := req.parseCredential(parts[0][len("Credential="):]); err != nil {
+		return nil, errors.Wrap(err, "illegal v4 auth header Credential")
 	}
-	req.AccessKey = credParts[0]
-	req.Location = credParts[2]
 	req.SignedHeaders = strings.Split(parts[1][len("SignedHeaders="):], ";")
 	sort.Strings(req.SignedHeaders)
 	req.Signature = parts[2][len("Signature="):]
@@ -264,6 +234,10 @@ func decodeAuthHeaderV4(authStr string) (*SAccessKeyRequestV4, error) {
 
 func (aksk *SAccessKeyRequestV4) ParseRequest(req http.Request, virtualHost bool) error {
 	dateStr := req.Header.Get(http.CanonicalHeaderKey("x-amz-date"))
+	if !aksk.Expires.IsZero() {
+		// presigned request
+		dateStr = req.URL.Query().Get(amzDate)
+	}
 	if len(dateStr) == 0 {
 		return errors.Error("missing x-amz-date")
 	}
@@ -273,17 +247,45 @@ func (aksk *SAccessKeyRequestV4) ParseRequest(req http.Request, virtualHost bool
 	}
 	canonicalReq := getCanonicalRequest(req, aksk.SignedHeaders)
 	aksk.SignDate = dateSign
-	aksk.Request = getStringToSignV4(dateSign, aksk.Location, canonicalReq)
+	aksk.ContentSha256 = getHashedPayload(req)
+	aksk.DecodedContentLength = -1
+	if decodedLen := req.Header.Get("X-Amz-Decoded-Content-Length"); len(decodedLen) > 0 {
+		aksk.DecodedContentLength, err = strconv.ParseInt(decodedLen, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid x-amz-decoded-content-length")
+		}
+	}
+	aksk.Request = getStringToSignV4(dateSign, aksk.Location, aksk.service(), canonicalReq)
 	return nil
 }
 
 func (aksk SAccessKeyRequestV4) Verify(secret string) error {
-	signingKey := getSigningKey(secret, aksk.Location, aksk.SignDate)
+	return aksk.VerifyWithOptions(secret, nil)
+}
+
+// VerifyWithOptions verifies the signature, then the expiration, the
+// consistency of the credential scope and the checks of opts
+func (aksk SAccessKeyRequestV4) VerifyWithOptions(secret string, opts *SVerifyOptions) error {
+	signingKey := getSigningKey(secret, aksk.Location, aksk.service(), aksk.SignDate)
 	signature := getSignature(signingKey, aksk.Request)
-	if signature != aksk.Signature {
-		return errors.Error("signature mismatch")
+	if !hmac.Equal([]byte(signature), []byte(aksk.Signature)) {
+		return ErrSignatureMismatch
 	}
-	return nil
+	if !aksk.Expires.IsZero() && time.Now().After(aksk.Expires) {
+		return ErrRequestExpired
+	}
+	if len(aksk.ScopeDate) > 0 && aksk.ScopeDate != aksk.SignDate.Format(yyyymmdd) {
+		return errors.Wrapf(ErrCredentialScope, "scope date %s, signed at %s", aksk.ScopeDate, aksk.SignDate.Format(iso8601DateFormat))
+	}
+	if opts != nil {
+		if len(opts.Region) > 0 && aksk.Location != opts.Region {
+			return errors.Wrapf(ErrRegionMismatch, "credential region %s, expect %s", aksk.Location, opts.Region)
+		}
+		if len(opts.Service) > 0 && aksk.Service != opts.Service {
+			return errors.Wrapf(ErrServiceMismatch, "credential service %s, expect %s", aksk.Service, opts.Service)
+		}
+	}
+	return opts.verify(aksk.SAccessKeyRequest, aksk.SignDate, aksk.Expires)
 }
 
 func (aksk SAccessKeyRequestV4) Encode() string {
@@ -292,7 +294,7 @@ func (aksk SAccessKeyRequestV4) Encode() string {
 
 // GetCredential generate a credential string.
 func getCredential(accessKeyID, location string, t time.Time) string {
-	scope := getScope(location, t)
+	scope := getScope(location, signV4Service, t)
 	return accessKeyID + "/" + scope
 }
 
@@ -303,6 +305,7 @@ func SignV4(req http.Request, accessKey, secretAccessKey, location string, body
 	if accessKey == "" || secretAccessKey == "" {
 		return &req
 	}
+	req.Header = req.Header.Clone()
 
 	h := sha256.New()
 	if body != nil {
@@ -317,15 +320,15 @@ func SignV4(req http.Request, accessKey, secretAccessKey, location string, body
 	req.Header.Set("X-Amz-Date", t.Format(iso8601DateFormat))
 	req.Header.Set("Date", timeutils.RFC2882Time(t))
 
-	signedHeaders := getSignedHeaders(req, v4IgnoredHeaders)
+	signedHeaders := getSignedHeadersV4(req)
 	// Get canonical request.
 	canonicalRequest := getCanonicalRequest(req, signedHeaders)
 
 	// Get string to sign from canonical request.
-	stringToSign := getStringToSignV4(t, location, canonicalRequest)
+	stringToSign := getStringToSignV4(t, location, signV4Service, canonicalRequest)
 
 	// Get hmac signing key.
-	signingKey := getSigningKey(secretAccessKey, location, t)
+	signingKey := getSigningKey(secretAccessKey, location, signV4Service, t)
 
 	// Get credential string.
 	credential := getCredential(accessKey, location, t)
@@ -346,3 +349,44 @@ func SignV4(req http.Request, accessKey, secretAccessKey, location string, body
 
 	return &req
 }
+
+type sSignatureSchemeV4 struct{}
+
+func (sSignatureSchemeV4) GetAlgorithm() string {
+	return signV4Algorithm
+}
+
+func (sSignatureSchemeV4) Detect(req http.Request) bool {
+	algo, _ := AuthHeaderAlgorithm(req)
+	if len(algo) > 0 {
+		return algo == signV4Algorithm
+	}
+	return len(req.URL.Query().Get(amzAlgorithm)) > 0
+}
+
+func (sSignatureSchemeV4) Decode(req http.Request) (IAccessKeySecretRequest, error) {
+	var ret *SAccessKeyRequestV4
+	var err error
+	algo, cred := AuthHeaderAlgorithm(req)
+	if len(algo) > 0 {
+		ret, err = decodeAuthHeaderV4(cred)
+	} else {
+		ret, err = decodeAuthQueryV4(req.URL.Query())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (sSignatureSchemeV4) NewRequest() IAccessKeySecretRequest {
+	req := NewV4Request()
+	return &req
+}
+
+func (sSignatureSchemeV4) Sign(req http.Request, input SSignInput) *http.Request {
+	if input.Expires > 0 {
+		return PresignV4(req, input.AccessKey, input.Secret, input.Location, input.Expires)
+	}
+	return SignV4(req, input.AccessKey, input.Secret, input.Location, input.Body)
+}
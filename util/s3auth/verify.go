@@ -0,0 +1,125 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"sync"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/cache"
+)
+
+const (
+	ErrMissingDate       = errors.Error("missing request date")
+	ErrRequestTimeSkewed = errors.Error("request time too skewed")
+	ErrCredentialScope   = errors.Error("inconsistent credential scope")
+	ErrRegionMismatch    = errors.Error("credential region mismatch")
+	ErrServiceMismatch   = errors.Error("credential service mismatch")
+	ErrReplayedRequest   = errors.Error("replayed request")
+
+	// DefaultMaxSkew is the allowed difference between the request time and
+	// the server time of S3
+	DefaultMaxSkew = 15 * time.Minute
+)
+
+// SVerifyOptions are the checks applied after the signature is verified
+type SVerifyOptions struct {
+	// MaxSkew is the allowed difference between the signing time and now,
+	// 0 disables the check. A presigned request is only checked not to be
+	// signed in the future.
+	MaxSkew time.Duration
+	// Region and Service are the expected credential scope of a V4
+	// request, empty to accept any
+	Region  string
+	Service string
+	// NonceCache rejects a request whose signature has been seen, nil
+	// disables the check. Presigned requests are reusable until they
+	// expire and are not checked.
+	NonceCache *SNonceCache
+}
+
+// IVerifyOptionsRequest is a request that supports verification options
+type IVerifyOptionsRequest interface {
+	VerifyWithOptions(secret string, opts *SVerifyOptions) error
+}
+
+// VerifyWithOptions verifies aksk with opts if it supports verification
+// options, otherwise only its signature is verified
+func VerifyWithOptions(aksk IAccessKeySecretRequest, secret string, opts *SVerifyOptions) error {
+	if req, ok := aksk.(IVerifyOptionsRequest); ok {
+		return req.VerifyWithOptions(secret, opts)
+	}
+	return aksk.Verify(secret)
+}
+
+func (opts *SVerifyOptions) verify(aksk SAccessKeyRequest, signDate, expires time.Time) error {
+	if opts == nil {
+		return nil
+	}
+	presigned := !expires.IsZero()
+	if opts.MaxSkew > 0 {
+		now := time.Now()
+		switch {
+		case signDate.IsZero():
+			if !presigned {
+				return ErrMissingDate
+			}
+		case signDate.After(now.Add(opts.MaxSkew)):
+			return errors.Wrapf(ErrRequestTimeSkewed, "signed at %s in the future", signDate.UTC().Format(iso8601DateFormat))
+		case !presigned && signDate.Before(now.Add(-opts.MaxSkew)):
+			return errors.Wrapf(ErrRequestTimeSkewed, "signed at %s", signDate.UTC().Format(iso8601DateFormat))
+		}
+	}
+	if opts.NonceCache != nil && !presigned {
+		if !opts.NonceCache.CheckAndAdd(aksk.Algorithm + ":" + aksk.AccessKey + ":" + aksk.Signature) {
+			return ErrReplayedRequest
+		}
+	}
+	return nil
+}
+
+// SNonceCache remembers the signatures of the verified requests for a
+// while to detect replays. Its ttl should be no less than twice the
+// MaxSkew, the window in which a request is accepted.
+type SNonceCache struct {
+	lock  sync.Mutex
+	store cache.Store
+}
+
+func nonceKeyFunc(obj interface{}) (string, error) {
+	return obj.(string), nil
+}
+
+func NewNonceCache(ttl time.Duration) *SNonceCache {
+	if ttl <= 0 {
+		ttl = 2 * DefaultMaxSkew
+	}
+	return &SNonceCache{
+		store: cache.NewTTLStore(nonceKeyFunc, ttl),
+	}
+}
+
+// CheckAndAdd adds the nonce and returns true if it has not been seen
+func (c *SNonceCache) CheckAndAdd(nonce string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exist, _ := c.store.GetByKey(nonce); exist {
+		return false
+	}
+	c.store.Add(nonce)
+	return true
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func TestVerifyWithOptions(t *testing.T) {
+	newOpts := func() *SVerifyOptions {
+		return &SVerifyOptions{
+			MaxSkew:    DefaultMaxSkew,
+			Region:     "cn-beijing",
+			Service:    "s3",
+			NonceCache: NewNonceCache(0),
+		}
+	}
+	decode := func(signed *http.Request) IAccessKeySecretRequest {
+		aksk, err := DecodeAccessKeyRequest(*signed, false)
+		if err != nil {
+			t.Fatalf("DecodeAccessKeyRequest: %v", err)
+		}
+		return aksk
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.yunion.io/bucket/object", nil)
+
+	for _, algo := range []string{signV4Algorithm, signV2Algorithm} {
+		signed, _ := Sign(algo, *req, SSignInput{AccessKey: testAccessKey, Secret: testSecret, Location: "cn-beijing"})
+		aksk := decode(signed)
+		opts := newOpts()
+		if err := VerifyWithOptions(aksk, testSecret, opts); err != nil {
+			t.Errorf("%s: VerifyWithOptions: %v", algo, err)
+		}
+		if err := VerifyWithOptions(aksk, testSecret, opts); err != ErrReplayedRequest {
+			t.Errorf("%s: replay: %v", algo, err)
+		}
+		if err := VerifyWithOptions(aksk, "wrong", newOpts()); err != ErrSignatureMismatch {
+			t.Errorf("%s: wrong secret: %v", algo, err)
+		}
+
+		presigned, _ := Sign(algo, *req, SSignInput{AccessKey: testAccessKey, Secret: testSecret, Location: "cn-beijing", Expires: time.Hour})
+		recv := receive(t, http.MethodGet, presigned.URL.String())
+		aksk = decode(&recv)
+		for i := 0; i < 2; i++ {
+			if err := VerifyWithOptions(aksk, testSecret, opts); err != nil {
+				t.Errorf("%s: presigned #%d: %v", algo, i, err)
+			}
+		}
+	}
+
+	signed := SignV4(*req, testAccessKey, testSecret, "cn-beijing", nil)
+	aksk := decode(signed).(*SAccessKeyRequestV4)
+	opts := newOpts()
+	opts.Region = "cn-shanghai"
+	if err := aksk.VerifyWithOptions(testSecret, opts); errors.Cause(err) != ErrRegionMismatch {
+		t.Errorf("region: %v", err)
+	}
+	opts = newOpts()
+	opts.Service = "sts"
+	if err := aksk.VerifyWithOptions(testSecret, opts); errors.Cause(err) != ErrServiceMismatch {
+		t.Errorf("service: %v", err)
+	}
+	scoped := *aksk
+	scoped.ScopeDate = "20000101"
+	if err := scoped.Verify(testSecret); errors.Cause(err) != ErrCredentialScope {
+		t.Errorf("scope date: %v", err)
+	}
+
+	// signed an hour ago
+	old := *req
+	old.Header = http.Header{}
+	old.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	v2 := decode(SignV2(old, testAccessKey, testSecret, false))
+	if err := VerifyWithOptions(v2, testSecret, newOpts()); errors.Cause(err) != ErrRequestTimeSkewed {
+		t.Errorf("skew: %v", err)
+	}
+	if err := VerifyWithOptions(v2, testSecret, &SVerifyOptions{MaxSkew: 2 * time.Hour}); err != nil {
+		t.Errorf("larger skew: %v", err)
+	}
+
+	undated := NewV2Request()
+	undated.AccessKey = testAccessKey
+	undated.Request = "GET\n\n\n\n/bucket/object"
+	undated.Signature = signV2(testSecret, undated.Request)
+	if err := undated.VerifyWithOptions(testSecret, newOpts()); err != ErrMissingDate {
+		t.Errorf("missing date: %v", err)
+	}
+	if err := undated.Verify(testSecret); err != nil {
+		t.Errorf("Verify without options: %v", err)
+	}
+}
+
+func TestVerifyServiceScope(t *testing.T) {
+	// the example of the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+	// the payload hash is taken from the header, not signed in the example
+	req.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request,"+
+		"SignedHeaders=content-type;host;x-amz-date,Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+	aksk, err := DecodeAccessKeyRequest(*req, false)
+	if err != nil {
+		t.Fatalf("DecodeAccessKeyRequest: %v", err)
+	}
+	secret := "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	if err := aksk.Verify(secret); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	v4 := aksk.(*SAccessKeyRequestV4)
+	if err := v4.VerifyWithOptions(secret, &SVerifyOptions{Region: "us-east-1", Service: "iam"}); err != nil {
+		t.Errorf("VerifyWithOptions: %v", err)
+	}
+	if err := v4.VerifyWithOptions(secret, &SVerifyOptions{Service: "s3"}); errors.Cause(err) != ErrServiceMismatch {
+		t.Errorf("service: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func ParseEntitiesDescriptor(data []byte) (EntitiesDescriptor, error) {
+	ed := EntitiesDescriptor{}
+	err := xml.Unmarshal(data, &ed)
+	if err != nil {
+		return ed, errors.Wrap(err, "xml.Unmarshal")
+	}
+	return ed, nil
+}
+
+func parseXSDateTime(str string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		tm, err := time.Parse(layout, str)
+		if err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, errors.Wrapf(errors.ErrInvalidFormat, "invalid dateTime %s", str)
+}
+
+var xsDurationRegexp = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseXSDuration parses a xs:duration such as PT6H or P1DT12H, years and
+// months are counted as 365 and 30 days
+func parseXSDuration(str string) (time.Duration, error) {
+	match := xsDurationRegexp.FindStringSubmatch(str)
+	if match == nil || str == "P" || str == "-P" || str[len(str)-1] == 'T' {
+		return 0, errors.Wrapf(errors.ErrInvalidFormat, "invalid duration %s", str)
+	}
+	units := []time.Duration{
+		365 * 24 * time.Hour,
+		30 * 24 * time.Hour,
+		24 * time.Hour,
+		time.Hour,
+		time.Minute,
+	}
+	var dur time.Duration
+	for i, unit := range units {
+		if len(match[i+2]) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(match[i+2], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(errors.ErrInvalidFormat, "invalid duration %s", str)
+		}
+		dur += time.Duration(n) * unit
+	}
+	if len(match[7]) > 0 {
+		secs, err := strconv.ParseFloat(match[7], 64)
+		if err != nil {
+			return 0, errors.Wrapf(errors.ErrInvalidFormat, "invalid duration %s", str)
+		}
+		dur += time.Duration(secs * float64(time.Second))
+	}
+	if len(match[1]) > 0 {
+		dur = -dur
+	}
+	return dur, nil
+}
+
+// SSAMLMetadataAggregate is the verified content of an EntitiesDescriptor
+// published by a federation, indexed by entityID.
+type SSAMLMetadataAggregate struct {
+	name string
+
+	// validUntil is zero if the aggregate does not expire
+	validUntil time.Time
+	// cacheDuration is 0 if unspecified
+	cacheDuration time.Duration
+
+	entities map[string]EntityDescriptor
+}
+
+// LoadMetadataAggregate parses an EntitiesDescriptor, verifies that its root
+// element is signed with one of the trusted federation certificates and that
+// it has not expired at now. Nested EntitiesDescriptor and EntityDescriptor
+// having expired are skipped.
+func LoadMetadataAggregate(data []byte, certs []x509.Certificate, now time.Time) (*SSAMLMetadataAggregate, error) {
+	if len(certs) == 0 {
+		return nil, errors.Wrap(ErrSAMLUntrustedCert, "no trusted federation certificate")
+	}
+	ed, err := ParseEntitiesDescriptor(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseEntitiesDescriptor")
+	}
+	if ed.Signature == nil {
+		return nil, errors.Wrap(ErrSAMLSignatureMissing, "EntitiesDescriptor")
+	}
+	if ed.ID == nil || len(*ed.ID) == 0 {
+		return nil, errors.Wrap(ErrSAMLSignatureInvalid, "EntitiesDescriptor without ID")
+	}
+	signed, err := verifyXMLSignature(certs, string(data), ed.Signature, "EntitiesDescriptor", *ed.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifyXMLSignature")
+	}
+	ed, err = ParseEntitiesDescriptor([]byte(signed))
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseEntitiesDescriptor signed")
+	}
+
+	agg := &SSAMLMetadataAggregate{
+		entities: make(map[string]EntityDescriptor),
+	}
+	if ed.Name != nil {
+		agg.name = *ed.Name
+	}
+	if ed.ValidUntil != nil {
+		agg.validUntil, err = parseXSDateTime(*ed.ValidUntil)
+		if err != nil {
+			return nil, errors.Wrap(err, "validUntil")
+		}
+		if !now.Before(agg.validUntil) {
+			return nil, errors.Wrapf(ErrSAMLExpired, "aggregate valid until %s", *ed.ValidUntil)
+		}
+	}
+	if ed.CacheDuration != nil {
+		agg.cacheDuration, err = parseXSDuration(*ed.CacheDuration)
+		if err != nil {
+			return nil, errors.Wrap(err, "cacheDuration")
+		}
+	}
+	agg.addEntities(&ed, now)
+	return agg, nil
+}
+
+func isExpired(validUntil *string, now time.Time) bool {
+	if validUntil == nil || len(*validUntil) == 0 {
+		return false
+	}
+	tm, err := parseXSDateTime(*validUntil)
+	return err != nil || !now.Before(tm)
+}
+
+func (agg *SSAMLMetadataAggregate) addEntities(ed *EntitiesDescriptor, now time.Time) {
+	for i := range ed.EntityDescriptors {
+		entity := ed.EntityDescriptors[i]
+		if len(entity.EntityId) == 0 || isExpired(entity.ValidUntil, now) {
+			continue
+		}
+		agg.entities[entity.EntityId] = entity
+	}
+	for i := range ed.EntitiesDescriptors {
+		if isExpired(ed.EntitiesDescriptors[i].ValidUntil, now) {
+			continue
+		}
+		agg.addEntities(&ed.EntitiesDescriptors[i], now)
+	}
+}
+
+func (agg *SSAMLMetadataAggregate) GetName() string {
+	return agg.name
+}
+
+// GetValidUntil returns the expiry of the aggregate, zero if it has none
+func (agg *SSAMLMetadataAggregate) GetValidUntil() time.Time {
+	return agg.validUntil
+}
+
+// GetCacheDuration returns the cacheDuration of the aggregate, 0 if it has none
+func (agg *SSAMLMetadataAggregate) GetCacheDuration() time.Duration {
+	return agg.cacheDuration
+}
+
+// IsExpired tells whether the aggregate must no longer be trusted at now
+func (agg *SSAMLMetadataAggregate) IsExpired(now time.Time) bool {
+	return !agg.validUntil.IsZero() && !now.Before(agg.validUntil)
+}
+
+// GetEntityIds returns the sorted entityIDs of the aggregate
+func (agg *SSAMLMetadataAggregate) GetEntityIds() []string {
+	ids := make([]string, 0, len(agg.entities))
+	for id := range agg.entities {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GetEntity returns the EntityDescriptor of entityId, errors.ErrNotFound if
+// the aggregate has no such entity, ErrSAMLExpired if it has expired at now
+func (agg *SSAMLMetadataAggregate) GetEntity(entityId string, now time.Time) (*EntityDescriptor, error) {
+	if agg.IsExpired(now) {
+		return nil, errors.Wrapf(ErrSAMLExpired, "aggregate valid until %s", agg.validUntil)
+	}
+	entity, ok := agg.entities[entityId]
+	if !ok {
+		return nil, errors.Wrapf(errors.ErrNotFound, "entity %s", entityId)
+	}
+	if isExpired(entity.ValidUntil, now) {
+		return nil, errors.Wrapf(ErrSAMLExpired, "entity %s valid until %s", entityId, *entity.ValidUntil)
+	}
+	return &entity, nil
+}
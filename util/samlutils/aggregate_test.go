@@ -0,0 +1,310 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/clock"
+)
+
+var testAggregateNow = time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestAggregate(t *testing.T, validUntil string, cacheDuration string, entityValidUntil string) []byte {
+	idp := NewIdpMetadata(SSAMLIdpMetadataInput{
+		EntityId:   testIdpEntityId,
+		CertString: certString,
+	})
+	if len(entityValidUntil) > 0 {
+		idp.ValidUntil = &entityValidUntil
+	}
+	sp := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:             testSpEntityId,
+		CertString:           certString,
+		AssertionConsumerUrl: testAcsUrl,
+	})
+	id := GenerateSAMLId()
+	name := "https://federation.yunion.io"
+	ed := EntitiesDescriptor{
+		XMLName: xml.Name{
+			Space: XMLNS_MD,
+			Local: "EntitiesDescriptor",
+		},
+		ID:        &id,
+		Name:      &name,
+		Signature: newSignature(id, certString),
+		EntitiesDescriptors: []EntitiesDescriptor{
+			{
+				XMLName: xml.Name{
+					Space: XMLNS_MD,
+					Local: "EntitiesDescriptor",
+				},
+				EntityDescriptors: []EntityDescriptor{sp},
+			},
+		},
+		EntityDescriptors: []EntityDescriptor{idp},
+	}
+	if len(validUntil) > 0 {
+		ed.ValidUntil = &validUntil
+	}
+	if len(cacheDuration) > 0 {
+		ed.CacheDuration = &cacheDuration
+	}
+	edXml, err := xml.Marshal(ed)
+	if err != nil {
+		t.Fatalf("xml.Marshal: %v", err)
+	}
+	saml := newTestSAMLInstance(t, name)
+	signed, err := saml.SignXML(string(edXml))
+	if err != nil {
+		t.Fatalf("SignXML: %v", err)
+	}
+	return []byte(signed)
+}
+
+func newTestFederationCerts(t *testing.T) []x509.Certificate {
+	cert, err := parseCertString(certString)
+	if err != nil {
+		t.Fatalf("parseCertString: %v", err)
+	}
+	return []x509.Certificate{*cert}
+}
+
+func newTestOtherCert(t *testing.T) x509.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "other"},
+		NotBefore:    testAggregateNow.Add(-time.Hour),
+		NotAfter:     testAggregateNow.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return *cert
+}
+
+func TestLoadMetadataAggregate(t *testing.T) {
+	certs := newTestFederationCerts(t)
+	data := newTestAggregate(t, "2020-03-08T00:00:00Z", "PT6H", "")
+
+	agg, err := LoadMetadataAggregate(data, certs, testAggregateNow)
+	if err != nil {
+		t.Fatalf("LoadMetadataAggregate: %v", err)
+	}
+	if ids := agg.GetEntityIds(); len(ids) != 2 || ids[0] != testIdpEntityId || ids[1] != testSpEntityId {
+		t.Errorf("unexpected entities %v", ids)
+	}
+	if agg.GetCacheDuration() != 6*time.Hour {
+		t.Errorf("unexpected cacheDuration %s", agg.GetCacheDuration())
+	}
+	idp, err := agg.GetEntity(testIdpEntityId, testAggregateNow)
+	if err != nil {
+		t.Fatalf("GetEntity: %v", err)
+	}
+	if idpCerts, err := idp.GetSigningCertificates(); err != nil || len(idpCerts) == 0 {
+		t.Errorf("unexpected IdP certificates %v", err)
+	}
+	if _, err := agg.GetEntity("https://unknown/", testAggregateNow); errors.Cause(err) != errors.ErrNotFound {
+		t.Errorf("expect not found, got %v", err)
+	}
+	if _, err := agg.GetEntity(testIdpEntityId, testAggregateNow.Add(8*24*time.Hour)); errors.Cause(err) != ErrSAMLExpired {
+		t.Errorf("expect expired, got %v", err)
+	}
+}
+
+func TestLoadMetadataAggregateErrors(t *testing.T) {
+	certs := newTestFederationCerts(t)
+	data := newTestAggregate(t, "2020-03-08T00:00:00Z", "", "")
+
+	unsigned := parseTestEntitiesDescriptor(t, data)
+	unsigned.Signature = nil
+	unsignedXml, _ := xml.Marshal(unsigned)
+
+	cases := []struct {
+		name  string
+		data  []byte
+		certs []x509.Certificate
+		now   time.Time
+		err   error
+	}{
+		{"untrusted", data, []x509.Certificate{newTestOtherCert(t)}, testAggregateNow, ErrSAMLUntrustedCert},
+		{"no trust", data, nil, testAggregateNow, ErrSAMLUntrustedCert},
+		{"tampered", []byte(strings.Replace(string(data), testSpEntityId, "https://evil.sp/", -1)), certs, testAggregateNow, ErrSAMLSignatureInvalid},
+		{"unsigned", unsignedXml, certs, testAggregateNow, ErrSAMLSignatureMissing},
+		{"expired", data, certs, testAggregateNow.Add(7 * 24 * time.Hour), ErrSAMLExpired},
+	}
+	for _, c := range cases {
+		_, err := LoadMetadataAggregate(c.data, c.certs, c.now)
+		if errors.Cause(err) != c.err {
+			t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func parseTestEntitiesDescriptor(t *testing.T, data []byte) EntitiesDescriptor {
+	ed, err := ParseEntitiesDescriptor(data)
+	if err != nil {
+		t.Fatalf("ParseEntitiesDescriptor: %v", err)
+	}
+	return ed
+}
+
+func TestLoadMetadataAggregateExpiredEntity(t *testing.T) {
+	data := newTestAggregate(t, "", "", "2020-02-01T00:00:00Z")
+	agg, err := LoadMetadataAggregate(data, newTestFederationCerts(t), testAggregateNow)
+	if err != nil {
+		t.Fatalf("LoadMetadataAggregate: %v", err)
+	}
+	if _, err := agg.GetEntity(testIdpEntityId, testAggregateNow); errors.Cause(err) != errors.ErrNotFound {
+		t.Errorf("expect expired entity skipped, got %v", err)
+	}
+	if agg.IsExpired(testAggregateNow.Add(365 * 24 * time.Hour)) {
+		t.Errorf("aggregate without validUntil expired")
+	}
+}
+
+func TestParseXSDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{"PT6H", 6 * time.Hour, false},
+		{"P1DT12H", 36 * time.Hour, false},
+		{"PT1M30.5S", 90*time.Second + 500*time.Millisecond, false},
+		{"-PT10M", -10 * time.Minute, false},
+		{"P", 0, true},
+		{"PT", 0, true},
+		{"6H", 0, true},
+	}
+	for _, c := range cases {
+		got, err := parseXSDuration(c.in)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("%s: expect %s err %v, got %s %v", c.in, c.want, c.err, got, err)
+		}
+	}
+}
+
+func TestFederationRefresh(t *testing.T) {
+	data := newTestAggregate(t, "2020-03-08T00:00:00Z", "PT6H", "")
+	var requests, notModified int
+	broken := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if broken {
+			w.Write([]byte("<EntitiesDescriptor/>"))
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "samlfed")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "federation.xml")
+
+	input := SSAMLFederationInput{
+		MetadataUrl: srv.URL,
+		Certs:       newTestFederationCerts(t),
+		CacheFile:   cacheFile,
+	}
+	fed := NewFederation(input)
+	fed.clock = clock.NewFakeClock(testAggregateNow)
+
+	if _, err := fed.GetEntity(testIdpEntityId); errors.Cause(err) != errors.ErrNotFound {
+		t.Errorf("expect not loaded, got %v", err)
+	}
+	if err := fed.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, err := fed.GetEntity(testIdpEntityId); err != nil {
+		t.Errorf("GetEntity: %v", err)
+	}
+	if next := fed.nextRefresh(nil); next != 6*time.Hour {
+		t.Errorf("expect refresh after cacheDuration, got %s", next)
+	}
+	if err := fed.Refresh(); err != nil || notModified != 1 {
+		t.Errorf("expect not modified, got %v %d", err, notModified)
+	}
+
+	// an invalid feed keeps the last verified aggregate
+	broken = true
+	if err := fed.Refresh(); err == nil {
+		t.Errorf("expect error for an unsigned feed")
+	}
+	if len(fed.GetEntityIds()) != 2 {
+		t.Errorf("last aggregate lost: %v", fed.GetEntityIds())
+	}
+	if next := fed.nextRefresh(errors.ErrClient); next != DefaultFederationRetryInterval {
+		t.Errorf("expect retry interval, got %s", next)
+	}
+
+	// an older feed from a stale mirror does not roll the aggregate back
+	broken = false
+	data = newTestAggregate(t, "2020-03-05T00:00:00Z", "PT6H", "")
+	fed.etag = ""
+	if err := fed.Refresh(); errors.Cause(err) != ErrSAMLExpired {
+		t.Errorf("expect rollback error, got %v", err)
+	}
+	if validUntil := fed.getAggregate().validUntil; !validUntil.Equal(time.Date(2020, 3, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("aggregate rolled back to %s", validUntil)
+	}
+	fed.input.MaxFeedSize = 1024
+	if err := fed.Refresh(); errors.Cause(err) != errors.ErrInvalidFormat {
+		t.Errorf("expect oversized feed error, got %v", err)
+	}
+
+	// a new instance starts from the cache file if the feed is broken
+	fed2 := NewFederation(input)
+	fed2.clock = clock.NewFakeClock(testAggregateNow)
+	if err := fed2.LoadCacheFile(); err != nil {
+		t.Fatalf("LoadCacheFile: %v", err)
+	}
+	if _, err := fed2.GetEntity(testSpEntityId); err != nil {
+		t.Errorf("GetEntity from cache: %v", err)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"yunion.io/x/log"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/cache"
+	"yunion.io/x/pkg/util/timeutils"
+)
+
+const (
+	DefaultArtifactTTL = 2 * time.Minute
+
+	artifactLength = 44
+)
+
+// SSAMLArtifact is a SAML 2.0 artifact of type 0x0004, referencing a
+// message kept by its issuer until it is resolved over SOAP
+type SSAMLArtifact struct {
+	TypeCode      uint16
+	EndpointIndex uint16
+	// SourceId is the SHA-1 hash of the entityID of the issuer
+	SourceId      [20]byte
+	MessageHandle [20]byte
+}
+
+func ArtifactSourceId(entityId string) [20]byte {
+	return sha1.Sum([]byte(entityId))
+}
+
+// NewArtifact returns an artifact with a random message handle, to be
+// resolved at the ArtifactResolutionService of index endpointIndex of the
+// issuer sourceEntityId
+func NewArtifact(sourceEntityId string, endpointIndex uint16) (*SSAMLArtifact, error) {
+	art := SSAMLArtifact{
+		TypeCode:      ARTIFACT_TYPE_CODE,
+		EndpointIndex: endpointIndex,
+		SourceId:      ArtifactSourceId(sourceEntityId),
+	}
+	_, err := io.ReadFull(rand.Reader, art.MessageHandle[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	return &art, nil
+}
+
+func ParseArtifact(str string) (*SSAMLArtifact, error) {
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.Wrap(err, "base64.StdEncoding.DecodeString")
+	}
+	if len(data) < 2 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "artifact too short")
+	}
+	art := SSAMLArtifact{
+		TypeCode: binary.BigEndian.Uint16(data),
+	}
+	if art.TypeCode != ARTIFACT_TYPE_CODE {
+		return nil, errors.Wrapf(errors.ErrUnsupportedProtocol, "artifact type 0x%04x", art.TypeCode)
+	}
+	if len(data) != artifactLength {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "artifact length %d", len(data))
+	}
+	art.EndpointIndex = binary.BigEndian.Uint16(data[2:])
+	copy(art.SourceId[:], data[4:24])
+	copy(art.MessageHandle[:], data[24:])
+	return &art, nil
+}
+
+func (art *SSAMLArtifact) String() string {
+	data := make([]byte, artifactLength)
+	binary.BigEndian.PutUint16(data, art.TypeCode)
+	binary.BigEndian.PutUint16(data[2:], art.EndpointIndex)
+	copy(data[4:24], art.SourceId[:])
+	copy(data[24:], art.MessageHandle[:])
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// IsFrom tells whether the artifact was issued by entityId
+func (art *SSAMLArtifact) IsFrom(entityId string) bool {
+	return art.SourceId == ArtifactSourceId(entityId)
+}
+
+// ArtifactRedirectUrl returns the location with the artifact and the relay
+// state appended to its query, for the HTTP-Artifact binding
+func ArtifactRedirectUrl(location string, art *SSAMLArtifact, relayState string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "url.Parse %s", location)
+	}
+	query := u.Query()
+	query.Set(PARAM_SAML_ART, art.String())
+	if len(relayState) > 0 {
+		query.Set(PARAM_RELAY_STATE, relayState)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// ParseArtifactBinding returns the artifact and the relay state received
+// over the HTTP-Artifact binding, either in a query or a form
+func ParseArtifactBinding(values url.Values) (*SSAMLArtifact, string, error) {
+	artStr := values.Get(PARAM_SAML_ART)
+	if len(artStr) == 0 {
+		return nil, "", errors.Wrapf(errors.ErrInvalidFormat, "no %s", PARAM_SAML_ART)
+	}
+	art, err := ParseArtifact(artStr)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "ParseArtifact")
+	}
+	return art, values.Get(PARAM_RELAY_STATE), nil
+}
+
+type sArtifactMessage struct {
+	artifact  string
+	recipient string
+	message   []byte
+}
+
+func artifactKeyFunc(obj interface{}) (string, error) {
+	return obj.(*sArtifactMessage).artifact, nil
+}
+
+// SSAMLArtifactStore keeps in memory the messages referenced by the issued
+// artifacts until they are resolved once, or expire.
+type SSAMLArtifactStore struct {
+	lock  sync.Mutex
+	store cache.Store
+}
+
+func NewArtifactStore(ttl time.Duration) *SSAMLArtifactStore {
+	if ttl <= 0 {
+		ttl = DefaultArtifactTTL
+	}
+	return &SSAMLArtifactStore{
+		store: cache.NewTTLStore(artifactKeyFunc, ttl),
+	}
+}
+
+// Add keeps the message referenced by art, only to be resolved by the
+// entity recipient
+func (store *SSAMLArtifactStore) Add(art *SSAMLArtifact, recipient string, message []byte) {
+	store.store.Add(&sArtifactMessage{
+		artifact:  art.String(),
+		recipient: recipient,
+		message:   message,
+	})
+}
+
+// Take removes and returns the message referenced by artifact if requester
+// is its recipient
+func (store *SSAMLArtifactStore) Take(artifact string, requester string) ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	obj, exist, _ := store.store.GetByKey(artifact)
+	if !exist {
+		return nil, errors.Wrap(errors.ErrNotFound, "unknown or expired artifact")
+	}
+	// an artifact is only resolved once, even by a wrong requester
+	store.store.Delete(obj)
+	msg := obj.(*sArtifactMessage)
+	if msg.recipient != requester {
+		return nil, errors.Wrapf(ErrSAMLIssuer, "artifact for %s requested by %s", msg.recipient, requester)
+	}
+	return msg.message, nil
+}
+
+// GetArtifactResolutionServiceUrl returns the location of the SOAP
+// ArtifactResolutionService of the given index, or an empty string
+func (desc *SSODescriptor) GetArtifactResolutionServiceUrl(index uint16) string {
+	for _, svc := range desc.ArtifactResolutionServices {
+		if svc.Binding != BINDING_SOAP {
+			continue
+		}
+		idx := "0"
+		if svc.Index != nil {
+			idx = *svc.Index
+		}
+		if idx == strconv.Itoa(int(index)) {
+			return svc.Location
+		}
+	}
+	return ""
+}
+
+func newArtifactResolutionServices(location string) []SSAMLService {
+	if len(location) == 0 {
+		return nil
+	}
+	index := "0"
+	isDefault := "true"
+	return []SSAMLService{
+		{
+			XMLName: xml.Name{
+				Space: XMLNS_MD,
+				Local: "ArtifactResolutionService",
+			},
+			Binding:   BINDING_SOAP,
+			Location:  location,
+			Index:     &index,
+			IsDefault: &isDefault,
+		},
+	}
+}
+
+func NewArtifactResolve(issuerEntityId string, destination string, art *SSAMLArtifact) ArtifactResolve {
+	return ArtifactResolve{
+		XMLName: xml.Name{
+			Space: XMLNS_PROTO,
+			Local: "ArtifactResolve",
+		},
+		ID:           GenerateSAMLId(),
+		Version:      SAML2_VERSION,
+		IssueInstant: timeutils.IsoTime(time.Now().UTC()),
+		Destination:  destination,
+		Issuer:       newEntityIssuer(issuerEntityId),
+		Artifact: SSAMLValue{
+			XMLName: xml.Name{
+				Space: XMLNS_PROTO,
+				Local: "Artifact",
+			},
+			Value: art.String(),
+		},
+	}
+}
+
+func newArtifactResponse(issuerEntityId string, inResponseTo string, message []byte) ArtifactResponse {
+	return ArtifactResponse{
+		XMLName: xml.Name{
+			Space: XMLNS_PROTO,
+			Local: "ArtifactResponse",
+		},
+		ID:           GenerateSAMLId(),
+		InResponseTo: &inResponseTo,
+		Version:      SAML2_VERSION,
+		IssueInstant: timeutils.IsoTime(time.Now().UTC()),
+		Issuer:       newEntityIssuer(issuerEntityId),
+		Status:       newStatus(STATUS_SUCCESS, ""),
+		Message:      message,
+	}
+}
+
+// parseArtifactResponse parses an ArtifactResponse, whose Message is set to
+// the raw XML of the resolved message
+func parseArtifactResponse(data []byte) (*ArtifactResponse, error) {
+	resp := ArtifactResponse{}
+	err := xml.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal ArtifactResponse")
+	}
+	resp.Message, err = rawChildElement(data, "Issuer", "Signature", "Extensions", "Status")
+	if err != nil {
+		return nil, errors.Wrap(err, "rawChildElement")
+	}
+	return &resp, nil
+}
+
+// HandleArtifactResolve answers the SOAP ArtifactResolve request data of a
+// peer with the message taken from store. The request must be signed by the
+// peer, whose metadata is returned by getPeer. An unknown artifact is
+// answered with an empty ArtifactResponse.
+func (saml *SSAMLInstance) HandleArtifactResolve(store *SSAMLArtifactStore, data []byte, getPeer func(entityId string) (*EntityDescriptor, error)) ([]byte, error) {
+	body, err := parseSoapBody(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseSoapBody")
+	}
+	req := ArtifactResolve{}
+	err = xml.Unmarshal(body, &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal ArtifactResolve")
+	}
+	if req.Signature == nil {
+		return nil, errors.Wrap(ErrSAMLSignatureMissing, "ArtifactResolve")
+	}
+	issuer := req.Issuer.Issuer
+	peer, err := getPeer(issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getPeer %s", issuer)
+	}
+	certs, err := peer.GetSigningCertificates()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSigningCertificates")
+	}
+	signed, err := verifyXMLSignature(certs, string(body), req.Signature, "ArtifactResolve", req.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "ArtifactResolve")
+	}
+	req = ArtifactResolve{}
+	err = xml.Unmarshal([]byte(signed), &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal signed ArtifactResolve")
+	}
+	if err := checkIssuer(req.Issuer, peer.EntityId); err != nil {
+		return nil, err
+	}
+
+	msg, err := store.Take(req.Artifact.Value, peer.EntityId)
+	if err != nil {
+		log.Warningf("resolve artifact for %s: %v", peer.EntityId, err)
+	}
+	resp := newArtifactResponse(saml.entityID, req.ID, msg)
+	resp.Signature = newSignature(resp.ID, saml.certString)
+	respXml, err := saml.signMessage(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "signMessage")
+	}
+	return soapEnvelope(respXml), nil
+}
+
+type SSAMLArtifactResolveInput struct {
+	// IdpMetadata is the metadata of the issuer of the artifact
+	IdpMetadata EntityDescriptor
+	Artifact    *SSAMLArtifact
+
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// ResolveArtifact resolves an artifact at the ArtifactResolutionService of
+// its issuer and returns the raw XML of the referenced message, whose own
+// signature is still to be verified
+func (saml *SSAMLInstance) ResolveArtifact(input SSAMLArtifactResolveInput) ([]byte, error) {
+	idp := input.IdpMetadata
+	if !input.Artifact.IsFrom(idp.EntityId) {
+		return nil, errors.Wrapf(ErrSAMLIssuer, "artifact not issued by %s", idp.EntityId)
+	}
+	if idp.IDPSSODescriptor == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no IDPSSODescriptor")
+	}
+	location := idp.IDPSSODescriptor.GetArtifactResolutionServiceUrl(input.Artifact.EndpointIndex)
+	if len(location) == 0 {
+		return nil, errors.Wrapf(errors.ErrNotFound, "no ArtifactResolutionService of index %d", input.Artifact.EndpointIndex)
+	}
+	certs, err := idp.GetSigningCertificates()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSigningCertificates")
+	}
+	client := input.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req := NewArtifactResolve(saml.entityID, location, input.Artifact)
+	req.Signature = newSignature(req.ID, saml.certString)
+	reqXml, err := saml.signMessage(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "signMessage")
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(soapEnvelope(reqXml)))
+	if err != nil {
+		return nil, errors.Wrap(err, "http.NewRequest")
+	}
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpReq.Header.Set("SOAPAction", SOAP_ACTION_SAML)
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "POST %s", location)
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadAll")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(errors.ErrClient, "POST %s: %s", location, httpResp.Status)
+	}
+
+	body, err := parseSoapBody(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseSoapBody")
+	}
+	resp, err := parseArtifactResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Signature == nil {
+		return nil, errors.Wrap(ErrSAMLSignatureMissing, "ArtifactResponse")
+	}
+	signed, err := verifyXMLSignature(certs, string(body), resp.Signature, "ArtifactResponse", resp.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "ArtifactResponse")
+	}
+	resp, err = parseArtifactResponse([]byte(signed))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIssuer(resp.Issuer, idp.EntityId); err != nil {
+		return nil, err
+	}
+	if resp.InResponseTo == nil || *resp.InResponseTo != req.ID {
+		return nil, errors.Wrapf(ErrSAMLInResponseTo, "expect %s", req.ID)
+	}
+	if resp.Status.StatusCode.Value != STATUS_SUCCESS {
+		return nil, errors.Wrapf(ErrSAMLStatus, "status %s", resp.Status.StatusCode.Value)
+	}
+	if len(resp.Message) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "artifact not resolved")
+	}
+	return resp.Message, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func TestArtifactEncoding(t *testing.T) {
+	art, err := NewArtifact(testIdpEntityId, 3)
+	if err != nil {
+		t.Fatalf("NewArtifact: %v", err)
+	}
+	parsed, err := ParseArtifact(art.String())
+	if err != nil {
+		t.Fatalf("ParseArtifact: %v", err)
+	}
+	if *parsed != *art {
+		t.Errorf("expect %#v, got %#v", art, parsed)
+	}
+	if !parsed.IsFrom(testIdpEntityId) || parsed.IsFrom(testSpEntityId) {
+		t.Errorf("unexpected source")
+	}
+
+	redirectUrl, err := ArtifactRedirectUrl(testAcsUrl, art, "state")
+	if err != nil {
+		t.Fatalf("ArtifactRedirectUrl: %v", err)
+	}
+	u, _ := url.Parse(redirectUrl)
+	received, relayState, err := ParseArtifactBinding(u.Query())
+	if err != nil {
+		t.Fatalf("ParseArtifactBinding: %v", err)
+	}
+	if *received != *art || relayState != "state" {
+		t.Errorf("unexpected artifact %#v %s", received, relayState)
+	}
+
+	wrongType := *art
+	wrongType.TypeCode = 0x0002
+	if _, err := ParseArtifact(wrongType.String()); errors.Cause(err) != errors.ErrUnsupportedProtocol {
+		t.Errorf("expect unsupported type, got %v", err)
+	}
+	if _, err := ParseArtifact("AAQAAA=="); errors.Cause(err) != errors.ErrInvalidFormat {
+		t.Errorf("expect invalid format, got %v", err)
+	}
+}
+
+func TestArtifactStore(t *testing.T) {
+	store := NewArtifactStore(0)
+	art, _ := NewArtifact(testIdpEntityId, 0)
+	store.Add(art, testSpEntityId, []byte("<Response/>"))
+
+	if _, err := store.Take(art.String(), "https://evil.sp/"); errors.Cause(err) != ErrSAMLIssuer {
+		t.Errorf("expect issuer error, got %v", err)
+	}
+	// the artifact is gone after the first attempt
+	if _, err := store.Take(art.String(), testSpEntityId); errors.Cause(err) != errors.ErrNotFound {
+		t.Errorf("expect not found, got %v", err)
+	}
+}
+
+func TestRawChildElement(t *testing.T) {
+	data := `<s:Envelope xmlns:s="urn:s" xmlns:p="urn:p"><s:Header/><s:Body><p:Msg ID="1"><p:Item/></p:Msg></s:Body></s:Envelope>`
+	msg, err := parseSoapBody([]byte(data))
+	if err != nil {
+		t.Fatalf("parseSoapBody: %v", err)
+	}
+	want := `<p:Msg xmlns:s="urn:s" xmlns:p="urn:p" ID="1"><p:Item/></p:Msg>`
+	if string(msg) != want {
+		t.Errorf("expect %s, got %s", want, msg)
+	}
+}
+
+func TestArtifactResolve(t *testing.T) {
+	idp := newTestSAMLInstance(t, testIdpEntityId)
+	sp := newTestSAMLInstance(t, testSpEntityId)
+	spMetadata := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:             testSpEntityId,
+		CertString:           certString,
+		AssertionConsumerUrl: testAcsUrl,
+	})
+	getPeer := func(entityId string) (*EntityDescriptor, error) {
+		if entityId != testSpEntityId {
+			return nil, errors.ErrNotFound
+		}
+		return &spMetadata, nil
+	}
+
+	store := NewArtifactStore(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		resp, err := idp.HandleArtifactResolve(store, data, getPeer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	idpMetadata := NewIdpMetadata(SSAMLIdpMetadataInput{
+		EntityId:              testIdpEntityId,
+		CertString:            certString,
+		ArtifactResolutionUrl: srv.URL,
+	})
+
+	respXml := newTestSignedResponse(t, "_req", nil)
+	art, _ := NewArtifact(testIdpEntityId, 0)
+	store.Add(art, testSpEntityId, respXml)
+
+	msg, err := sp.ResolveArtifact(SSAMLArtifactResolveInput{
+		IdpMetadata: idpMetadata,
+		Artifact:    art,
+	})
+	if err != nil {
+		t.Fatalf("ResolveArtifact: %v", err)
+	}
+	v := newTestValidator(t)
+	v.AddRequestId("_req")
+	if _, err := v.ValidateResponse(msg); err != nil {
+		t.Errorf("ValidateResponse of resolved message: %v", err)
+	}
+
+	// resolved only once
+	_, err = sp.ResolveArtifact(SSAMLArtifactResolveInput{
+		IdpMetadata: idpMetadata,
+		Artifact:    art,
+	})
+	if errors.Cause(err) != errors.ErrNotFound {
+		t.Errorf("expect not found, got %v", err)
+	}
+
+	// an artifact of another issuer
+	other, _ := NewArtifact("https://other.idp/", 0)
+	_, err = sp.ResolveArtifact(SSAMLArtifactResolveInput{
+		IdpMetadata: idpMetadata,
+		Artifact:    other,
+	})
+	if errors.Cause(err) != ErrSAMLIssuer {
+		t.Errorf("expect issuer error, got %v", err)
+	}
+
+	// an unknown requester is rejected by the IdP
+	evil := newTestSAMLInstance(t, "https://evil.sp/")
+	art, _ = NewArtifact(testIdpEntityId, 0)
+	store.Add(art, testSpEntityId, respXml)
+	_, err = evil.ResolveArtifact(SSAMLArtifactResolveInput{
+		IdpMetadata: idpMetadata,
+		Artifact:    art,
+	})
+	if errors.Cause(err) != errors.ErrClient {
+		t.Errorf("expect client error, got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"html"
+	"net/url"
+	"strings"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// SSAMLBindingMessage is a SAML protocol message received over the
+// HTTP-Redirect or HTTP-POST binding
+type SSAMLBindingMessage struct {
+	Binding string
+	// Param is either PARAM_SAML_REQUEST or PARAM_SAML_RESPONSE
+	Param string
+	// Message is the decoded XML of the message
+	Message []byte
+
+	RelayState string
+
+	// SigAlg and Signature are the detached signature of a HTTP-Redirect
+	// binding message, over signedQuery
+	SigAlg      string
+	Signature   []byte
+	signedQuery string
+}
+
+func (msg *SSAMLBindingMessage) IsRequest() bool {
+	return msg.Param == PARAM_SAML_REQUEST
+}
+
+func fetchBindingParam(values url.Values) (string, string, error) {
+	for _, param := range []string{PARAM_SAML_REQUEST, PARAM_SAML_RESPONSE} {
+		if value := values.Get(param); len(value) > 0 {
+			return param, value, nil
+		}
+	}
+	return "", "", errors.Wrapf(errors.ErrInvalidFormat, "neither %s nor %s found", PARAM_SAML_REQUEST, PARAM_SAML_RESPONSE)
+}
+
+// ParseRedirectBinding decodes the message of the query of a HTTP-Redirect
+// binding request. The signed query is rebuilt from the decoded values, use
+// ParseRedirectBindingQuery with the raw query to verify the signatures of
+// senders which do not encode the values the way url.QueryEscape does.
+func ParseRedirectBinding(query url.Values) (*SSAMLBindingMessage, error) {
+	param, value, err := fetchBindingParam(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchBindingParam")
+	}
+	return parseRedirectBinding(param, value, query, func(key string) string {
+		return url.QueryEscape(query.Get(key))
+	})
+}
+
+// ParseRedirectBindingQuery decodes the message of the raw query of a
+// HTTP-Redirect binding request, keeping the values as they were encoded by
+// the sender to verify the signature
+func ParseRedirectBindingQuery(rawQuery string) (*SSAMLBindingMessage, error) {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "url.ParseQuery")
+	}
+	param, value, err := fetchBindingParam(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchBindingParam")
+	}
+	rawValues := make(map[string]string)
+	for _, part := range strings.Split(rawQuery, "&") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if _, ok := rawValues[kv[0]]; !ok {
+			rawValues[kv[0]] = kv[1]
+		}
+	}
+	return parseRedirectBinding(param, value, query, func(key string) string {
+		return rawValues[key]
+	})
+}
+
+func parseRedirectBinding(param, value string, query url.Values, rawValue func(key string) string) (*SSAMLBindingMessage, error) {
+	msg, err := SAMLDecode(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "SAMLDecode")
+	}
+	ret := &SSAMLBindingMessage{
+		Binding:    BINDING_HTTP_REDIRECT,
+		Param:      param,
+		Message:    msg,
+		RelayState: query.Get(PARAM_RELAY_STATE),
+		SigAlg:     query.Get(PARAM_SIG_ALG),
+	}
+	if sig := query.Get(PARAM_SIGNATURE); len(sig) > 0 {
+		ret.Signature, err = base64.StdEncoding.DecodeString(sig)
+		if err != nil {
+			return nil, errors.Wrapf(ErrSAMLSignatureInvalid, "invalid Signature: %s", err)
+		}
+		signed := []string{param + "=" + rawValue(param)}
+		if _, ok := query[PARAM_RELAY_STATE]; ok {
+			signed = append(signed, PARAM_RELAY_STATE+"="+rawValue(PARAM_RELAY_STATE))
+		}
+		signed = append(signed, PARAM_SIG_ALG+"="+rawValue(PARAM_SIG_ALG))
+		ret.signedQuery = strings.Join(signed, "&")
+	}
+	return ret, nil
+}
+
+// ParsePostBinding decodes the message of the form of a HTTP-POST binding
+// request
+func ParsePostBinding(form url.Values) (*SSAMLBindingMessage, error) {
+	param, value, err := fetchBindingParam(form)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchBindingParam")
+	}
+	msg, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "base64.StdEncoding.DecodeString")
+	}
+	return &SSAMLBindingMessage{
+		Binding:    BINDING_HTTP_POST,
+		Param:      param,
+		Message:    msg,
+		RelayState: form.Get(PARAM_RELAY_STATE),
+	}, nil
+}
+
+func redirectSigHash(sigAlg string) (crypto.Hash, error) {
+	switch sigAlg {
+	case SIG_ALG_RSA_SHA256:
+		return crypto.SHA256, nil
+	case SIG_ALG_RSA_SHA1:
+		return crypto.SHA1, nil
+	default:
+		return 0, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported signature algorithm %s", sigAlg)
+	}
+}
+
+func redirectSigDigest(hash crypto.Hash, signed string) []byte {
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum([]byte(signed))
+		return sum[:]
+	default:
+		sum := sha256.Sum256([]byte(signed))
+		return sum[:]
+	}
+}
+
+// redirectBindingUrl returns the location with the deflated message and the
+// relay state appended to its query, signed with privateKey if not nil
+func redirectBindingUrl(location string, param string, msg []byte, relayState string, sigAlg string, privateKey *rsa.PrivateKey) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "url.Parse %s", location)
+	}
+	encoded, err := SAMLEncode(msg)
+	if err != nil {
+		return "", errors.Wrap(err, "SAMLEncode")
+	}
+	// the parameters are signed in this exact order
+	query := []string{param + "=" + url.QueryEscape(encoded)}
+	if len(relayState) > 0 {
+		query = append(query, PARAM_RELAY_STATE+"="+url.QueryEscape(relayState))
+	}
+	if privateKey != nil {
+		hash, err := redirectSigHash(sigAlg)
+		if err != nil {
+			return "", errors.Wrap(err, "redirectSigHash")
+		}
+		query = append(query, PARAM_SIG_ALG+"="+url.QueryEscape(sigAlg))
+		signed := strings.Join(query, "&")
+		sig, err := rsa.SignPKCS1v15(rand.Reader, privateKey, hash, redirectSigDigest(hash, signed))
+		if err != nil {
+			return "", errors.Wrap(err, "rsa.SignPKCS1v15")
+		}
+		query = append(query, PARAM_SIGNATURE+"="+url.QueryEscape(base64.StdEncoding.EncodeToString(sig)))
+	}
+	if len(u.RawQuery) > 0 {
+		query = append([]string{u.RawQuery}, query...)
+	}
+	u.RawQuery = strings.Join(query, "&")
+	return u.String(), nil
+}
+
+func (saml *SSAMLInstance) redirectBindingUrl(location string, param string, msg []byte, relayState string) (string, error) {
+	return redirectBindingUrl(location, param, msg, relayState, saml.redirectSigAlg, saml.privateKey)
+}
+
+// VerifySignature checks the detached signature of a HTTP-Redirect binding
+// message with the certificates of its sender
+func (msg *SSAMLBindingMessage) VerifySignature(certs []x509.Certificate) error {
+	if len(msg.Signature) == 0 {
+		return errors.Wrapf(ErrSAMLSignatureMissing, "%s binding", msg.Binding)
+	}
+	hash, err := redirectSigHash(msg.SigAlg)
+	if err != nil {
+		return errors.Wrap(err, "redirectSigHash")
+	}
+	digest := redirectSigDigest(hash, msg.signedQuery)
+	for i := range certs {
+		pubKey, ok := certs[i].PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(pubKey, hash, digest, msg.Signature) == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(ErrSAMLSignatureInvalid, "no certificate verifies the query signature")
+}
+
+// postBindingForm returns the self-submitting HTML form posting the message
+// and the relay state to location
+func postBindingForm(location string, param string, msg []byte, relayState string) string {
+	attrs := map[string]string{
+		param: base64.StdEncoding.EncodeToString(msg),
+	}
+	if len(relayState) > 0 {
+		attrs[PARAM_RELAY_STATE] = html.EscapeString(relayState)
+	}
+	return SAMLForm(html.EscapeString(location), attrs)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func TestRedirectBindingSignature(t *testing.T) {
+	sp := newTestSAMLInstance(t, testSpEntityId)
+	spMetadata := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:             testSpEntityId,
+		CertString:           certString,
+		AssertionConsumerUrl: testAcsUrl,
+	})
+
+	for _, sigAlg := range []string{SIG_ALG_RSA_SHA256, SIG_ALG_RSA_SHA1} {
+		if err := sp.SetRedirectSigAlg(sigAlg); err != nil {
+			t.Fatalf("SetRedirectSigAlg: %v", err)
+		}
+		req := NewRequest(SSAMLRequestInput{
+			AssertionConsumerServiceURL: testAcsUrl,
+			Destination:                 "https://saml.yunion.io/saml/sso",
+			RequestID:                   GenerateSAMLId(),
+			EntityID:                    testSpEntityId,
+		})
+		redirectUrl, err := sp.AuthnRequestRedirectUrl(req, "https://sp.yunion.io/?a=b c")
+		if err != nil {
+			t.Fatalf("AuthnRequestRedirectUrl: %v", err)
+		}
+		u, _ := url.Parse(redirectUrl)
+		if u.Query().Get(PARAM_SIG_ALG) != sigAlg {
+			t.Errorf("expect SigAlg %s, got %s", sigAlg, u.Query().Get(PARAM_SIG_ALG))
+		}
+
+		msg, err := ParseRedirectBindingQuery(u.RawQuery)
+		if err != nil {
+			t.Fatalf("ParseRedirectBindingQuery: %v", err)
+		}
+		recvReq, err := VerifyAuthnRequest(msg, spMetadata)
+		if err != nil {
+			t.Fatalf("%s: VerifyAuthnRequest: %v", sigAlg, err)
+		}
+		if recvReq.ID != req.ID {
+			t.Errorf("expect request %s, got %s", req.ID, recvReq.ID)
+		}
+
+		msg, err = ParseRedirectBinding(u.Query())
+		if err != nil {
+			t.Fatalf("ParseRedirectBinding: %v", err)
+		}
+		if _, err := VerifyAuthnRequest(msg, spMetadata); err != nil {
+			t.Errorf("%s: VerifyAuthnRequest from decoded query: %v", sigAlg, err)
+		}
+
+		tampered := strings.Replace(u.RawQuery, "RelayState=https", "RelayState=http", 1)
+		msg, _ = ParseRedirectBindingQuery(tampered)
+		if _, err := VerifyAuthnRequest(msg, spMetadata); errors.Cause(err) != ErrSAMLSignatureInvalid {
+			t.Errorf("expect invalid signature, got %v", err)
+		}
+
+		query := u.Query()
+		query.Del(PARAM_SIGNATURE)
+		msg, _ = ParseRedirectBinding(query)
+		if _, err := VerifyAuthnRequest(msg, spMetadata); errors.Cause(err) != ErrSAMLSignatureMissing {
+			t.Errorf("expect missing signature, got %v", err)
+		}
+	}
+}
+
+func TestSetRedirectSigAlg(t *testing.T) {
+	sp := newTestSAMLInstance(t, testSpEntityId)
+	if err := sp.SetRedirectSigAlg("http://www.w3.org/2000/09/xmldsig#dsa-sha1"); errors.Cause(err) != errors.ErrUnsupportedProtocol {
+		t.Errorf("expect unsupported algorithm, got %v", err)
+	}
+}
@@ -19,6 +19,9 @@ const (
 	XMLNS_DS     = "http://www.w3.org/2000/09/xmldsig#"
 	XMLNS_PROTO  = "urn:oasis:names:tc:SAML:2.0:protocol"
 	XMLNS_ASSERT = "urn:oasis:names:tc:SAML:2.0:assertion"
+	XMLNS_XENC   = "http://www.w3.org/2001/04/xmlenc#"
+	XMLNS_XENC11 = "http://www.w3.org/2009/xmlenc11#"
+	XMLNS_SOAP   = "http://schemas.xmlsoap.org/soap/envelope/"
 
 	PROTOCOL_SAML2 = "urn:oasis:names:tc:SAML:2.0:protocol"
 
@@ -34,12 +37,56 @@ const (
 	NAME_ID_FORMAT_KERBEROS   = "urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos"
 	NAME_ID_FORMAT_ENTITY     = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
 
+	SUBJECT_CONFIRMATION_METHOD_BEARER = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	ATTR_NAME_FORMAT_UNSPEC = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+	ATTR_NAME_FORMAT_URI    = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	ATTR_NAME_FORMAT_BASIC  = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+
 	SAML2_VERSION = "2.0"
 
-	STATUS_SUCCESS = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	STATUS_SUCCESS   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	STATUS_REQUESTER = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	STATUS_RESPONDER = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+
+	LOGOUT_REASON_USER  = "urn:oasis:names:tc:SAML:2.0:logout:user"
+	LOGOUT_REASON_ADMIN = "urn:oasis:names:tc:SAML:2.0:logout:admin"
 
 	BINDING_HTTP_POST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
 	BINDING_HTTP_REDIRECT = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	BINDING_HTTP_ARTIFACT = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+	BINDING_SOAP          = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+
+	PARAM_SAML_REQUEST  = "SAMLRequest"
+	PARAM_SAML_RESPONSE = "SAMLResponse"
+	PARAM_RELAY_STATE   = "RelayState"
+	PARAM_SIG_ALG       = "SigAlg"
+	PARAM_SIGNATURE     = "Signature"
+	PARAM_SAML_ART      = "SAMLart"
+
+	ARTIFACT_TYPE_CODE = 0x0004
+
+	SIG_ALG_RSA_SHA1   = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	SIG_ALG_RSA_SHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+
+	ENC_ALG_AES128_CBC = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	ENC_ALG_AES192_CBC = "http://www.w3.org/2001/04/xmlenc#aes192-cbc"
+	ENC_ALG_AES256_CBC = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	ENC_ALG_AES128_GCM = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	ENC_ALG_AES256_GCM = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+
+	KEY_ALG_RSA_OAEP_MGF1P = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	KEY_ALG_RSA_OAEP       = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+	// KEY_ALG_RSA_1_5 is not supported for its padding oracle
+	KEY_ALG_RSA_1_5 = "http://www.w3.org/2001/04/xmlenc#rsa-1_5"
+
+	DIGEST_ALG_SHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	DIGEST_ALG_SHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+
+	MGF_ALG_MGF1_SHA1   = "http://www.w3.org/2009/xmlenc11#mgf1sha1"
+	MGF_ALG_MGF1_SHA256 = "http://www.w3.org/2009/xmlenc11#mgf1sha256"
+
+	ENCRYPTED_TYPE_ELEMENT = "http://www.w3.org/2001/04/xmlenc#Element"
 
 	HTML_SAML_FORM_TOKEN  = "$FORM$"
 	DEFAULT_HTML_TEMPLATE = `<!DOCTYPE html><html lang="en-US"><body>$FORM$</body></html>`
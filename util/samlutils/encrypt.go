@@ -15,16 +15,24 @@
 package samlutils
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
+	"encoding/xml"
 	"hash"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"strings"
 
 	"yunion.io/x/pkg/errors"
 
@@ -68,6 +76,141 @@ func (saml *SSAMLInstance) parseKeys() error {
 	return nil
 }
 
+// oaepHashes returns the digest and the MGF1 hashes of the RSA-OAEP key
+// transport method, the MGF1 of rsa-oaep-mgf1p is always with SHA1
+func oaepHashes(method EncryptionMethod) (crypto.Hash, crypto.Hash, error) {
+	digestAlg := DIGEST_ALG_SHA1
+	if method.DigestMethod != nil && len(method.DigestMethod.Algorithm) > 0 {
+		digestAlg = method.DigestMethod.Algorithm
+	}
+	mgfAlg := MGF_ALG_MGF1_SHA1
+	if method.Algorithm == KEY_ALG_RSA_OAEP && method.MGF != nil && len(method.MGF.Algorithm) > 0 {
+		mgfAlg = method.MGF.Algorithm
+	}
+	var digest, mgf crypto.Hash
+	switch digestAlg {
+	case DIGEST_ALG_SHA1:
+		digest = crypto.SHA1
+	case DIGEST_ALG_SHA256:
+		digest = crypto.SHA256
+	default:
+		return 0, 0, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported digest algorithm %s", digestAlg)
+	}
+	switch mgfAlg {
+	case MGF_ALG_MGF1_SHA1:
+		mgf = crypto.SHA1
+	case MGF_ALG_MGF1_SHA256:
+		mgf = crypto.SHA256
+	default:
+		return 0, 0, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported mask generation %s", mgfAlg)
+	}
+	return digest, mgf, nil
+}
+
+// mgf1XOR xors out with the MGF1 mask of seed
+func mgf1XOR(out []byte, h hash.Hash, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for done < len(out) {
+		h.Reset()
+		h.Write(seed)
+		h.Write(counter[:])
+		mask := h.Sum(nil)
+		for i := 0; i < len(mask) && done < len(out); i++ {
+			out[done] ^= mask[i]
+			done++
+		}
+		binary.BigEndian.PutUint32(counter[:], binary.BigEndian.Uint32(counter[:])+1)
+	}
+}
+
+// encryptOAEP is RSAES-OAEP-ENCRYPT of RFC 8017 with an empty label, the
+// digest and the MGF1 hash may differ, which rsa.EncryptOAEP does not allow
+func encryptOAEP(digest, mgf crypto.Hash, pub *rsa.PublicKey, msg []byte) ([]byte, error) {
+	if digest == mgf {
+		return rsa.EncryptOAEP(digest.New(), rand.Reader, pub, msg, nil)
+	}
+	k := pub.Size()
+	hLen := digest.Size()
+	if len(msg) > k-2*hLen-2 {
+		return nil, rsa.ErrMessageTooLong
+	}
+	em := make([]byte, k)
+	seed := em[1 : 1+hLen]
+	db := em[1+hLen:]
+	lHash := digest.New()
+	copy(db, lHash.Sum(nil))
+	db[len(db)-len(msg)-1] = 1
+	copy(db[len(db)-len(msg):], msg)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	mgf1XOR(db, mgf.New(), seed)
+	mgf1XOR(seed, mgf.New(), db)
+	m := new(big.Int).SetBytes(em)
+	c := new(big.Int).Exp(m, big.NewInt(int64(pub.E)), pub.N)
+	return c.FillBytes(make([]byte, k)), nil
+}
+
+// decryptOAEP is RSAES-OAEP-DECRYPT of RFC 8017 with an empty label, the
+// counterpart of encryptOAEP
+func decryptOAEP(digest, mgf crypto.Hash, priv *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	if digest == mgf {
+		return rsa.DecryptOAEP(digest.New(), rand.Reader, priv, ciphertext, nil)
+	}
+	k := priv.Size()
+	hLen := digest.Size()
+	if len(ciphertext) != k || k < 2*hLen+2 {
+		return nil, rsa.ErrDecryption
+	}
+	c := new(big.Int).SetBytes(ciphertext)
+	if c.Cmp(priv.N) >= 0 {
+		return nil, rsa.ErrDecryption
+	}
+	// blind against timing attacks, m = (c*r^e)^d * r^-1
+	var r, rInv *big.Int
+	for {
+		var err error
+		r, err = rand.Int(rand.Reader, priv.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "rand.Int")
+		}
+		if r.Sign() == 0 {
+			continue
+		}
+		if rInv = new(big.Int).ModInverse(r, priv.N); rInv != nil {
+			break
+		}
+	}
+	c.Mul(c, new(big.Int).Exp(r, big.NewInt(int64(priv.E)), priv.N))
+	c.Mod(c, priv.N)
+	m := new(big.Int).Exp(c, priv.D, priv.N)
+	m.Mul(m, rInv)
+	m.Mod(m, priv.N)
+	em := m.FillBytes(make([]byte, k))
+
+	firstByteIsZero := subtle.ConstantTimeByteEq(em[0], 0)
+	seed := em[1 : 1+hLen]
+	db := em[1+hLen:]
+	mgf1XOR(seed, mgf.New(), db)
+	mgf1XOR(db, mgf.New(), seed)
+	lHashGood := subtle.ConstantTimeCompare(digest.New().Sum(nil), db[:hLen])
+	// db is lHash || PS || 0x01 || M, PS are zeros
+	lookingForIndex, index, invalid := 1, 0, 0
+	rest := db[hLen:]
+	for i := 0; i < len(rest); i++ {
+		equals0 := subtle.ConstantTimeByteEq(rest[i], 0)
+		equals1 := subtle.ConstantTimeByteEq(rest[i], 1)
+		index = subtle.ConstantTimeSelect(lookingForIndex&equals1, i, index)
+		lookingForIndex = subtle.ConstantTimeSelect(equals1, 0, lookingForIndex)
+		invalid = subtle.ConstantTimeSelect(lookingForIndex&^equals0, 1, invalid)
+	}
+	if firstByteIsZero&lHashGood&^invalid&^lookingForIndex != 1 {
+		return nil, rsa.ErrDecryption
+	}
+	return rest[index+1:], nil
+}
+
 func (key EncryptedKey) decryptKey(privateKey *rsa.PrivateKey) ([]byte, error) {
 	cipher, err := base64.StdEncoding.DecodeString(key.CipherData.CipherValue.Value)
 	if err != nil {
@@ -75,18 +218,14 @@ func (key EncryptedKey) decryptKey(privateKey *rsa.PrivateKey) ([]byte, error) {
 	}
 	encAlg := key.EncryptionMethod.Algorithm
 	switch encAlg {
-	case "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p":
-		var shaAlg hash.Hash
-		hashAlg := key.EncryptionMethod.DigestMethod.Algorithm
-		switch hashAlg {
-		case "http://www.w3.org/2000/09/xmldsig#sha1":
-			shaAlg = sha1.New()
-		default:
-			return nil, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported digest algorithm %s", hashAlg)
-		}
-		plaintext, err := rsa.DecryptOAEP(shaAlg, rand.Reader, privateKey, cipher, nil)
+	case KEY_ALG_RSA_OAEP_MGF1P, KEY_ALG_RSA_OAEP:
+		digest, mgf, err := oaepHashes(key.EncryptionMethod)
+		if err != nil {
+			return nil, errors.Wrap(err, "oaepHashes")
+		}
+		plaintext, err := decryptOAEP(digest, mgf, privateKey, cipher)
 		if err != nil {
-			return nil, errors.Wrap(err, "rsa.DecryptOAEP")
+			return nil, errors.Wrap(err, "decryptOAEP")
 		}
 		return plaintext, nil
 	default:
@@ -99,14 +238,19 @@ func (data EncryptedData) decryptData(privateKey *rsa.PrivateKey) ([]byte, error
 	if err != nil {
 		return nil, errors.Wrap(err, "base64.StdEncoding.DecodeString")
 	}
+	if data.KeyInfo.EncryptedKey == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no EncryptedKey")
+	}
 	key, err := data.KeyInfo.EncryptedKey.decryptKey(privateKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "KeyInfo.EncryptedKey.decryptKey")
 	}
 	encAlg := data.EncryptionMethod.Algorithm
 	switch encAlg {
-	case "http://www.w3.org/2001/04/xmlenc#aes128-cbc", "http://www.w3.org/2001/04/xmlenc#aes192-cbc", "http://www.w3.org/2001/04/xmlenc#aes256-cbc":
+	case ENC_ALG_AES128_CBC, ENC_ALG_AES192_CBC, ENC_ALG_AES256_CBC:
 		return decryptAesCbc(key, cipher)
+	case ENC_ALG_AES128_GCM, ENC_ALG_AES256_GCM:
+		return decryptAesGcm(key, cipher)
 	default:
 		return nil, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported encryption algorithm %s", encAlg)
 	}
@@ -118,6 +262,10 @@ func decryptAesCbc(key []byte, secret []byte) ([]byte, error) {
 		return nil, errors.Wrap(err, "aes.NewCipher")
 	}
 
+	if len(secret) < aes.BlockSize || len(secret)%aes.BlockSize != 0 {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "invalid cipher text length %d", len(secret))
+	}
+
 	decrypter := cipher.NewCBCDecrypter(c, secret[0:aes.BlockSize])
 
 	data := make([]byte, len(secret)-aes.BlockSize)
@@ -125,5 +273,379 @@ func decryptAesCbc(key []byte, secret []byte) ([]byte, error) {
 
 	decrypter.CryptBlocks(data, data)
 
+	// XML Encryption padding: the last byte is the padding length
+	if len(data) == 0 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "empty cipher text")
+	}
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "invalid padding length %d", padding)
+	}
+
+	return data[:len(data)-padding], nil
+}
+
+// decryptAesGcm decrypts the 96 bits IV, the cipher text and the 128 bits
+// authentication tag of XML Encryption 1.1
+func decryptAesGcm(key []byte, secret []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher")
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "cipher.NewGCM")
+	}
+	if len(secret) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "invalid cipher text length %d", len(secret))
+	}
+	data, err := gcm.Open(nil, secret[:gcm.NonceSize()], secret[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "gcm.Open")
+	}
 	return data, nil
 }
+
+type SSAMLEncryptionInput struct {
+	// Cert is the encryption certificate of the SP
+	Cert *x509.Certificate
+	// Recipient is the entityID of the SP, optional
+	Recipient string
+
+	// DataAlgorithm is one of ENC_ALG_*, ENC_ALG_AES256_CBC by default
+	DataAlgorithm string
+	// KeyAlgorithm is KEY_ALG_RSA_OAEP_MGF1P by default, or KEY_ALG_RSA_OAEP
+	KeyAlgorithm string
+	// KeyDigestAlgorithm is DIGEST_ALG_SHA1 or DIGEST_ALG_SHA256, by default
+	// SHA1 for KEY_ALG_RSA_OAEP_MGF1P and SHA256 for KEY_ALG_RSA_OAEP
+	KeyDigestAlgorithm string
+	// KeyMGFAlgorithm is the mask generation of KEY_ALG_RSA_OAEP, by default
+	// MGF_ALG_MGF1_SHA256, it is always MGF1 with SHA1 for
+	// KEY_ALG_RSA_OAEP_MGF1P
+	KeyMGFAlgorithm string
+}
+
+// GetEncryptionCertificate returns the certificate of the first
+// KeyDescriptor of the SSO descriptor whose use is encryption or unspecified
+func (desc *SSODescriptor) GetEncryptionCertificate() (*x509.Certificate, error) {
+	for _, kd := range desc.KeyDescriptors {
+		if len(kd.Use) > 0 && kd.Use != KEY_USE_ENCRYPTION {
+			continue
+		}
+		if kd.KeyInfo.X509Data == nil {
+			continue
+		}
+		return parseCertString(kd.KeyInfo.X509Data.X509Certificate.Cert)
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, "no encryption certificate")
+}
+
+// GetEncryptionInput returns the encryption certificate of the SSO
+// descriptor and the first of the algorithms advertised by the
+// EncryptionMethods of its KeyDescriptor that are supported, or the default
+// algorithms if none is advertised. It fails if only unsupported
+// algorithms are advertised, so that an SP is rejected when configured
+// rather than at login.
+func (desc *SSODescriptor) GetEncryptionInput(recipient string) (SSAMLEncryptionInput, error) {
+	input := SSAMLEncryptionInput{Recipient: recipient}
+	for _, kd := range desc.KeyDescriptors {
+		if len(kd.Use) > 0 && kd.Use != KEY_USE_ENCRYPTION {
+			continue
+		}
+		if kd.KeyInfo.X509Data == nil {
+			continue
+		}
+		cert, err := parseCertString(kd.KeyInfo.X509Data.X509Certificate.Cert)
+		if err != nil {
+			return input, errors.Wrap(err, "parseCertString")
+		}
+		input.Cert = cert
+		// the SP accepts one of the advertised key transports and one of
+		// the advertised data encryptions
+		unsupported := []string{}
+		keyAdvertised, dataAdvertised := false, false
+		for _, method := range kd.EncryptionMethods {
+			switch method.Algorithm {
+			case KEY_ALG_RSA_OAEP_MGF1P, KEY_ALG_RSA_OAEP:
+				keyAdvertised = true
+				digestAlg, mgfAlg := "", ""
+				if method.DigestMethod != nil {
+					digestAlg = method.DigestMethod.Algorithm
+				}
+				if method.MGF != nil {
+					mgfAlg = method.MGF.Algorithm
+				}
+				if _, err := newKeyEncryptionMethod(method.Algorithm, digestAlg, mgfAlg); err != nil {
+					unsupported = append(unsupported, err.Error())
+				} else if len(input.KeyAlgorithm) == 0 {
+					input.KeyAlgorithm = method.Algorithm
+					input.KeyDigestAlgorithm = digestAlg
+					input.KeyMGFAlgorithm = mgfAlg
+				}
+			case KEY_ALG_RSA_1_5:
+				keyAdvertised = true
+				unsupported = append(unsupported, method.Algorithm)
+			case ENC_ALG_AES128_CBC, ENC_ALG_AES192_CBC, ENC_ALG_AES256_CBC, ENC_ALG_AES128_GCM, ENC_ALG_AES256_GCM:
+				dataAdvertised = true
+				if len(input.DataAlgorithm) == 0 {
+					input.DataAlgorithm = method.Algorithm
+				}
+			default:
+				dataAdvertised = true
+				unsupported = append(unsupported, method.Algorithm)
+			}
+		}
+		if (keyAdvertised && len(input.KeyAlgorithm) == 0) || (dataAdvertised && len(input.DataAlgorithm) == 0) {
+			return input, errors.Wrapf(errors.ErrUnsupportedProtocol, "encryption methods %s", strings.Join(unsupported, ", "))
+		}
+		return input, nil
+	}
+	return input, errors.Wrap(errors.ErrNotFound, "no encryption certificate")
+}
+
+func encryptAesCbc(key []byte, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher")
+	}
+	// XML Encryption padding: arbitrary bytes ended by the padding length
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	secret := make([]byte, aes.BlockSize+len(data)+padding)
+	if _, err := rand.Read(secret[:aes.BlockSize]); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	copy(secret[aes.BlockSize:], data)
+	secret[len(secret)-1] = byte(padding)
+
+	encrypter := cipher.NewCBCEncrypter(c, secret[:aes.BlockSize])
+	encrypter.CryptBlocks(secret[aes.BlockSize:], secret[aes.BlockSize:])
+	return secret, nil
+}
+
+func encryptAesGcm(key []byte, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher")
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "cipher.NewGCM")
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func encryptData(encAlg string, data []byte) ([]byte, []byte, error) {
+	var keySize int
+	var encrypt func(key []byte, data []byte) ([]byte, error)
+	switch encAlg {
+	case ENC_ALG_AES128_CBC:
+		keySize, encrypt = 16, encryptAesCbc
+	case ENC_ALG_AES192_CBC:
+		keySize, encrypt = 24, encryptAesCbc
+	case ENC_ALG_AES256_CBC:
+		keySize, encrypt = 32, encryptAesCbc
+	case ENC_ALG_AES128_GCM:
+		keySize, encrypt = 16, encryptAesGcm
+	case ENC_ALG_AES256_GCM:
+		keySize, encrypt = 32, encryptAesGcm
+	default:
+		return nil, nil, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported encryption algorithm %s", encAlg)
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, errors.Wrap(err, "rand.Read")
+	}
+	secret, err := encrypt(key, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, secret, nil
+}
+
+func newEncryptionMethod(algorithm string) EncryptionMethod {
+	return EncryptionMethod{
+		XMLName: xml.Name{
+			Space: XMLNS_XENC,
+			Local: "EncryptionMethod",
+		},
+		Algorithm: algorithm,
+	}
+}
+
+func newKeyEncryptionMethod(keyAlg, digestAlg, mgfAlg string) (EncryptionMethod, error) {
+	method := newEncryptionMethod(keyAlg)
+	switch keyAlg {
+	case KEY_ALG_RSA_OAEP_MGF1P:
+		if len(digestAlg) == 0 {
+			digestAlg = DIGEST_ALG_SHA1
+		}
+		if len(mgfAlg) > 0 && mgfAlg != MGF_ALG_MGF1_SHA1 {
+			return method, errors.Wrapf(errors.ErrUnsupportedProtocol, "mask generation %s of %s", mgfAlg, keyAlg)
+		}
+	case KEY_ALG_RSA_OAEP:
+		if len(digestAlg) == 0 {
+			digestAlg = DIGEST_ALG_SHA256
+		}
+		if len(mgfAlg) == 0 {
+			mgfAlg = MGF_ALG_MGF1_SHA256
+		}
+		method.MGF = &DigestMethod{
+			XMLName: xml.Name{
+				Space: XMLNS_XENC11,
+				Local: "MGF",
+			},
+			Algorithm: mgfAlg,
+		}
+	default:
+		return method, errors.Wrapf(errors.ErrUnsupportedProtocol, "unsupported encryption algorithm %s", keyAlg)
+	}
+	method.DigestMethod = &DigestMethod{
+		XMLName: xml.Name{
+			Space: XMLNS_DS,
+			Local: "DigestMethod",
+		},
+		Algorithm: digestAlg,
+	}
+	if _, _, err := oaepHashes(method); err != nil {
+		return method, err
+	}
+	return method, nil
+}
+
+// EncryptAssertion encrypts the XML of an assertion to the certificate of
+// the SP, with a random key transported by RSA-OAEP. The digest and the
+// MGF1 of RSA-OAEP are SHA1 or SHA256, in any combination.
+func EncryptAssertion(assertText []byte, input SSAMLEncryptionInput) (*EncryptedAssertion, error) {
+	if input.Cert == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no encryption certificate")
+	}
+	pubKey, ok := input.Cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Wrap(errors.ErrUnsupportedProtocol, "encryption certificate without RSA public key")
+	}
+	if len(input.DataAlgorithm) == 0 {
+		input.DataAlgorithm = ENC_ALG_AES256_CBC
+	}
+	if len(input.KeyAlgorithm) == 0 {
+		input.KeyAlgorithm = KEY_ALG_RSA_OAEP_MGF1P
+	}
+
+	keyMethod, err := newKeyEncryptionMethod(input.KeyAlgorithm, input.KeyDigestAlgorithm, input.KeyMGFAlgorithm)
+	if err != nil {
+		return nil, errors.Wrap(err, "newKeyEncryptionMethod")
+	}
+	key, secret, err := encryptData(input.DataAlgorithm, assertText)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryptData")
+	}
+	digest, mgf, err := oaepHashes(keyMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "oaepHashes")
+	}
+	encKey, err := encryptOAEP(digest, mgf, pubKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryptOAEP")
+	}
+
+	return &EncryptedAssertion{
+		XMLName: xml.Name{
+			Space: XMLNS_ASSERT,
+			Local: "EncryptedAssertion",
+		},
+		EncryptedData: EncryptedData{
+			XMLName: xml.Name{
+				Space: XMLNS_XENC,
+				Local: "EncryptedData",
+			},
+			Id:               GenerateSAMLId(),
+			Type:             ENCRYPTED_TYPE_ELEMENT,
+			EncryptionMethod: newEncryptionMethod(input.DataAlgorithm),
+			KeyInfo: KeyInfo{
+				XMLName: xml.Name{
+					Space: XMLNS_DS,
+					Local: "KeyInfo",
+				},
+				EncryptedKey: &EncryptedKey{
+					XMLName: xml.Name{
+						Space: XMLNS_XENC,
+						Local: "EncryptedKey",
+					},
+					Id:               GenerateSAMLId(),
+					Recipient:        input.Recipient,
+					EncryptionMethod: keyMethod,
+					KeyInfo: KeyInfo{
+						XMLName: xml.Name{
+							Space: XMLNS_DS,
+							Local: "KeyInfo",
+						},
+						X509Data: &X509Data{
+							XMLName: xml.Name{
+								Space: XMLNS_DS,
+								Local: "X509Data",
+							},
+							X509Certificate: X509Certificate{
+								XMLName: xml.Name{
+									Space: XMLNS_DS,
+									Local: "X509Certificate",
+								},
+								Cert: base64.StdEncoding.EncodeToString(input.Cert.Raw),
+							},
+						},
+					},
+					CipherData: newCipherData(encKey),
+				},
+			},
+			CipherData: newCipherData(secret),
+		},
+	}, nil
+}
+
+func newCipherData(secret []byte) CipherData {
+	return CipherData{
+		XMLName: xml.Name{
+			Space: XMLNS_XENC,
+			Local: "CipherData",
+		},
+		CipherValue: CipherValue{
+			XMLName: xml.Name{
+				Space: XMLNS_XENC,
+				Local: "CipherValue",
+			},
+			Value: base64.StdEncoding.EncodeToString(secret),
+		},
+	}
+}
+
+// SignAndEncryptResponse signs the assertion of the response if it has a
+// signature template, as NewResponse sets, then replaces it with an
+// EncryptedAssertion and returns the XML of the response
+func (saml *SSAMLInstance) SignAndEncryptResponse(resp Response, input SSAMLEncryptionInput) (string, error) {
+	if resp.Assertion == nil {
+		return "", errors.Wrap(errors.ErrInvalidFormat, "no assertion to encrypt")
+	}
+	assertText, err := xml.Marshal(resp.Assertion)
+	if err != nil {
+		return "", errors.Wrap(err, "xml.Marshal assertion")
+	}
+	if resp.Assertion.Signature != nil {
+		signed, err := saml.SignXML(string(assertText))
+		if err != nil {
+			return "", errors.Wrap(err, "SignXML")
+		}
+		assertText = []byte(signed)
+	}
+	resp.EncryptedAssertion, err = EncryptAssertion(assertText, input)
+	if err != nil {
+		return "", errors.Wrap(err, "EncryptAssertion")
+	}
+	resp.Assertion = nil
+	respXml, err := xml.Marshal(resp)
+	if err != nil {
+		return "", errors.Wrap(err, "xml.Marshal response")
+	}
+	return string(respXml), nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/seclib"
+)
+
+func TestSignAndEncryptResponse(t *testing.T) {
+	idp := newTestSAMLInstance(t, testIdpEntityId)
+	sp := newTestSAMLInstance(t, testSpEntityId)
+
+	spMetadata := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:             testSpEntityId,
+		CertString:           certString,
+		AssertionConsumerUrl: testAcsUrl,
+	})
+	cert, err := spMetadata.SPSSODescriptor.GetEncryptionCertificate()
+	if err != nil {
+		t.Fatalf("GetEncryptionCertificate: %v", err)
+	}
+
+	cases := []struct {
+		dataAlg   string
+		keyAlg    string
+		digestAlg string
+		mgfAlg    string
+	}{
+		{ENC_ALG_AES128_CBC, KEY_ALG_RSA_OAEP_MGF1P, "", ""},
+		{ENC_ALG_AES256_CBC, KEY_ALG_RSA_OAEP, "", ""},
+		{ENC_ALG_AES128_GCM, KEY_ALG_RSA_OAEP_MGF1P, "", ""},
+		{ENC_ALG_AES256_GCM, KEY_ALG_RSA_OAEP, "", ""},
+		{ENC_ALG_AES256_GCM, KEY_ALG_RSA_OAEP, DIGEST_ALG_SHA256, MGF_ALG_MGF1_SHA1},
+		{ENC_ALG_AES128_CBC, KEY_ALG_RSA_OAEP_MGF1P, DIGEST_ALG_SHA256, ""},
+	}
+	for _, c := range cases {
+		resp := NewResponse(SSAMLResponseInput{
+			IssuerEntityId:              testIdpEntityId,
+			RequestEntityId:             testSpEntityId,
+			RequestID:                   "_req",
+			AssertionConsumerServiceURL: testAcsUrl,
+			IssuerCertString:            certString,
+		})
+		resp.AddAudienceRestriction(testSpEntityId)
+		resp.AddAttribute("email", "email", "urn:oasis:names:tc:SAML:2.0:attrname-format:uri", []string{"xxxx@yunion.io"})
+
+		respXml, err := idp.SignAndEncryptResponse(resp, SSAMLEncryptionInput{
+			Cert:               cert,
+			Recipient:          testSpEntityId,
+			DataAlgorithm:      c.dataAlg,
+			KeyAlgorithm:       c.keyAlg,
+			KeyDigestAlgorithm: c.digestAlg,
+			KeyMGFAlgorithm:    c.mgfAlg,
+		})
+		if err != nil {
+			t.Fatalf("%s %s: SignAndEncryptResponse: %v", c.dataAlg, c.keyAlg, err)
+		}
+		if strings.Contains(respXml, "xxxx@yunion.io") {
+			t.Errorf("%s: attribute in plaintext", c.dataAlg)
+		}
+
+		decrypted, err := sp.UnmarshalResponse([]byte(respXml))
+		if err != nil {
+			t.Fatalf("%s %s: UnmarshalResponse: %v", c.dataAlg, c.keyAlg, err)
+		}
+		if attrs := decrypted.FetchAttribtues(); len(attrs["email"]) != 1 || attrs["email"][0] != "xxxx@yunion.io" {
+			t.Errorf("%s: unexpected attributes %v", c.dataAlg, attrs)
+		}
+
+		// the decrypted assertion keeps its signature
+		v := newTestValidator(t)
+		v.saml = sp
+		v.AddRequestId("_req")
+		if _, err := v.ValidateResponse([]byte(respXml)); err != nil {
+			t.Errorf("%s %s: ValidateResponse: %v", c.dataAlg, c.keyAlg, err)
+		}
+	}
+}
+
+func TestEncryptAssertionUnsupported(t *testing.T) {
+	spMetadata := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:   testSpEntityId,
+		CertString: certString,
+	})
+	cert, _ := spMetadata.SPSSODescriptor.GetEncryptionCertificate()
+	_, err := EncryptAssertion([]byte("<Assertion/>"), SSAMLEncryptionInput{
+		Cert:          cert,
+		DataAlgorithm: "http://www.w3.org/2001/04/xmlenc#tripledes-cbc",
+	})
+	if errors.Cause(err) != errors.ErrUnsupportedProtocol {
+		t.Errorf("expect unsupported algorithm, got %v", err)
+	}
+}
+
+func TestEncryptOAEP(t *testing.T) {
+	key, err := seclib.DecodePrivateKey([]byte(privateKeyString))
+	if err != nil {
+		t.Fatalf("DecodePrivateKey: %v", err)
+	}
+	msg := []byte("0123456789abcdef0123456789abcdef")
+	for _, digest := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		for _, mgf := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+			cipher, err := encryptOAEP(digest, mgf, &key.PublicKey, msg)
+			if err != nil {
+				t.Fatalf("%s %s: encryptOAEP: %v", digest, mgf, err)
+			}
+			got, err := decryptOAEP(digest, mgf, key, cipher)
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("%s %s: decryptOAEP %q: %v", digest, mgf, got, err)
+			}
+			if _, err := rsa.DecryptOAEP(digest.New(), nil, key, cipher, nil); (err == nil) != (digest == mgf) {
+				t.Errorf("%s %s: rsa.DecryptOAEP: %v", digest, mgf, err)
+			}
+			cipher[len(cipher)-1] ^= 1
+			if _, err := decryptOAEP(digest, mgf, key, cipher); err == nil {
+				t.Errorf("%s %s: tampered cipher text decrypted", digest, mgf)
+			}
+		}
+	}
+}
+
+func TestGetEncryptionInput(t *testing.T) {
+	newMethod := func(alg, digest, mgf string) EncryptionMethod {
+		method := EncryptionMethod{Algorithm: alg}
+		if len(digest) > 0 {
+			method.DigestMethod = &DigestMethod{Algorithm: digest}
+		}
+		if len(mgf) > 0 {
+			method.MGF = &DigestMethod{Algorithm: mgf}
+		}
+		return method
+	}
+	cases := []struct {
+		name    string
+		methods []EncryptionMethod
+		want    SSAMLEncryptionInput
+		err     error
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "sha256 digest with mgf1sha1",
+			methods: []EncryptionMethod{
+				newMethod("http://www.w3.org/2001/04/xmlenc#tripledes-cbc", "", ""),
+				newMethod(ENC_ALG_AES128_GCM, "", ""),
+				newMethod(KEY_ALG_RSA_1_5, "", ""),
+				newMethod(KEY_ALG_RSA_OAEP, DIGEST_ALG_SHA256, MGF_ALG_MGF1_SHA1),
+			},
+			want: SSAMLEncryptionInput{
+				DataAlgorithm:      ENC_ALG_AES128_GCM,
+				KeyAlgorithm:       KEY_ALG_RSA_OAEP,
+				KeyDigestAlgorithm: DIGEST_ALG_SHA256,
+				KeyMGFAlgorithm:    MGF_ALG_MGF1_SHA1,
+			},
+		},
+		{
+			name: "unsupported key transport",
+			methods: []EncryptionMethod{
+				newMethod(ENC_ALG_AES256_CBC, "", ""),
+				newMethod(KEY_ALG_RSA_1_5, "", ""),
+				newMethod(KEY_ALG_RSA_OAEP, "http://www.w3.org/2001/04/xmlenc#sha512", ""),
+			},
+			err: errors.ErrUnsupportedProtocol,
+		},
+		{
+			name: "unsupported data encryption",
+			methods: []EncryptionMethod{
+				newMethod("http://www.w3.org/2001/04/xmlenc#tripledes-cbc", "", ""),
+			},
+			err: errors.ErrUnsupportedProtocol,
+		},
+	}
+	for _, c := range cases {
+		spMetadata := NewSpMetadata(SSAMLSpMetadataInput{
+			EntityId:   testSpEntityId,
+			CertString: certString,
+		})
+		desc := spMetadata.SPSSODescriptor
+		for i := range desc.KeyDescriptors {
+			desc.KeyDescriptors[i].EncryptionMethods = c.methods
+		}
+		input, err := desc.GetEncryptionInput(testSpEntityId)
+		if c.err != nil {
+			if errors.Cause(err) != c.err {
+				t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: GetEncryptionInput: %v", c.name, err)
+		}
+		if input.Cert == nil || input.Recipient != testSpEntityId {
+			t.Errorf("%s: no certificate or recipient", c.name)
+		}
+		input.Cert, input.Recipient = nil, ""
+		if input != c.want {
+			t.Errorf("%s: got %#v, want %#v", c.name, input, c.want)
+		}
+		if c.want.KeyDigestAlgorithm != c.want.KeyMGFAlgorithm && len(c.want.KeyAlgorithm) > 0 {
+			// the negotiated digest and MGF1 hashes decrypt
+			input.Cert, _ = desc.GetEncryptionCertificate()
+			encrypted, err := EncryptAssertion([]byte("<Assertion/>"), input)
+			if err != nil {
+				t.Fatalf("%s: EncryptAssertion: %v", c.name, err)
+			}
+			key, _ := seclib.DecodePrivateKey([]byte(privateKeyString))
+			if data, err := encrypted.EncryptedData.decryptData(key); err != nil || string(data) != "<Assertion/>" {
+				t.Errorf("%s: decryptData %q: %v", c.name, data, err)
+			}
+		}
+	}
+}
+
+func TestDecryptAesCbcPadding(t *testing.T) {
+	key := make([]byte, 16)
+	c, _ := aes.NewCipher(key)
+	for _, padding := range []byte{0, 17, 255} {
+		block := make([]byte, aes.BlockSize)
+		block[len(block)-1] = padding
+		secret := make([]byte, 2*aes.BlockSize)
+		cipher.NewCBCEncrypter(c, secret[:aes.BlockSize]).CryptBlocks(secret[aes.BlockSize:], block)
+		if _, err := decryptAesCbc(key, secret); errors.Cause(err) != errors.ErrInvalidFormat {
+			t.Errorf("padding %d: %v", padding, err)
+		}
+	}
+	block := []byte("0123456789\x06\x06\x06\x06\x06\x06")
+	secret := make([]byte, 2*aes.BlockSize)
+	cipher.NewCBCEncrypter(c, secret[:aes.BlockSize]).CryptBlocks(secret[aes.BlockSize:], block)
+	if data, err := decryptAesCbc(key, secret); err != nil || string(data) != "0123456789" {
+		t.Errorf("decryptAesCbc %q: %v", data, err)
+	}
+}
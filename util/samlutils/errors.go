@@ -0,0 +1,35 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	ErrSAMLStatus            = errors.Error("SAMLStatusError")
+	ErrSAMLIssuer            = errors.Error("SAMLIssuerMismatch")
+	ErrSAMLNoAssertion       = errors.Error("SAMLNoAssertion")
+	ErrSAMLSignatureMissing  = errors.Error("SAMLSignatureMissing")
+	ErrSAMLSignatureInvalid  = errors.Error("SAMLSignatureInvalid")
+	ErrSAMLUntrustedCert     = errors.Error("SAMLUntrustedCertificate")
+	ErrSAMLNotYetValid       = errors.Error("SAMLNotYetValid")
+	ErrSAMLExpired           = errors.Error("SAMLExpired")
+	ErrSAMLAudience          = errors.Error("SAMLAudienceMismatch")
+	ErrSAMLRecipient         = errors.Error("SAMLRecipientMismatch")
+	ErrSAMLInResponseTo      = errors.Error("SAMLInResponseToMismatch")
+	ErrSAMLReplayedAssertion = errors.Error("SAMLReplayedAssertion")
+	ErrSAMLReplayedRequest   = errors.Error("SAMLReplayedRequest")
+)
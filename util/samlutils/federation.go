@@ -0,0 +1,265 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"yunion.io/x/log"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/clock"
+	"yunion.io/x/pkg/util/runtime"
+)
+
+const (
+	DefaultFederationRefreshInterval = 6 * time.Hour
+	DefaultFederationRetryInterval   = 5 * time.Minute
+	// DefaultFederationMaxFeedSize is several times the size of the largest
+	// aggregates, e.g. eduGAIN
+	DefaultFederationMaxFeedSize = 256 * 1024 * 1024
+)
+
+type SSAMLFederationInput struct {
+	// MetadataUrl is the URL of the aggregate feed of the federation
+	MetadataUrl string
+	// Certs are the trusted certificates of the federation operator
+	Certs []x509.Certificate
+
+	// CacheFile keeps the last verified feed, so that it is available at
+	// startup if the feed is unreachable, optional
+	CacheFile string
+
+	// RefreshInterval is the maximal interval between two refreshes, a
+	// shorter cacheDuration of the feed takes precedence
+	RefreshInterval time.Duration
+	// RetryInterval is the interval before retrying a failed refresh
+	RetryInterval time.Duration
+	// MaxFeedSize is the maximal size of the feed in bytes
+	MaxFeedSize int64
+
+	Client *http.Client
+}
+
+// SSAMLFederation keeps the last verified aggregate of a federation feed,
+// refreshed periodically.
+type SSAMLFederation struct {
+	input SSAMLFederationInput
+	clock clock.Clock
+
+	lock         sync.RWMutex
+	aggregate    *SSAMLMetadataAggregate
+	etag         string
+	lastModified string
+}
+
+func NewFederation(input SSAMLFederationInput) *SSAMLFederation {
+	if input.RefreshInterval <= 0 {
+		input.RefreshInterval = DefaultFederationRefreshInterval
+	}
+	if input.RetryInterval <= 0 {
+		input.RetryInterval = DefaultFederationRetryInterval
+	}
+	if input.MaxFeedSize <= 0 {
+		input.MaxFeedSize = DefaultFederationMaxFeedSize
+	}
+	if input.Client == nil {
+		input.Client = http.DefaultClient
+	}
+	return &SSAMLFederation{
+		input: input,
+		clock: clock.RealClock{},
+	}
+}
+
+func (f *SSAMLFederation) getAggregate() *SSAMLMetadataAggregate {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.aggregate
+}
+
+// LoadCacheFile loads the feed saved in CacheFile by a previous refresh
+func (f *SSAMLFederation) LoadCacheFile() error {
+	if len(f.input.CacheFile) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.input.CacheFile)
+	if err != nil {
+		return errors.Wrapf(err, "ioutil.ReadFile %s", f.input.CacheFile)
+	}
+	agg, err := LoadMetadataAggregate(data, f.input.Certs, f.clock.Now())
+	if err != nil {
+		return errors.Wrapf(err, "LoadMetadataAggregate %s", f.input.CacheFile)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.aggregate == nil {
+		f.aggregate = agg
+	}
+	return nil
+}
+
+func (f *SSAMLFederation) saveCacheFile(data []byte) error {
+	tmpFile := f.input.CacheFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "ioutil.WriteFile %s", tmpFile)
+	}
+	err = os.Rename(tmpFile, f.input.CacheFile)
+	if err != nil {
+		return errors.Wrapf(err, "os.Rename %s", filepath.Base(tmpFile))
+	}
+	return nil
+}
+
+// Refresh fetches the feed and replaces the aggregate if it is verified and
+// not older than it, the previous aggregate is kept otherwise
+func (f *SSAMLFederation) Refresh() error {
+	req, err := http.NewRequest(http.MethodGet, f.input.MetadataUrl, nil)
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest")
+	}
+	f.lock.RLock()
+	if f.aggregate != nil {
+		if len(f.etag) > 0 {
+			req.Header.Set("If-None-Match", f.etag)
+		}
+		if len(f.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", f.lastModified)
+		}
+	}
+	f.lock.RUnlock()
+
+	resp, err := f.input.Client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "GET %s", f.input.MetadataUrl)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if agg := f.getAggregate(); agg != nil && agg.IsExpired(f.clock.Now()) {
+			return errors.Wrap(ErrSAMLExpired, "feed not modified since it expired")
+		}
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(errors.ErrClient, "GET %s: %s", f.input.MetadataUrl, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.input.MaxFeedSize+1))
+	if err != nil {
+		return errors.Wrap(err, "ioutil.ReadAll")
+	}
+	if int64(len(data)) > f.input.MaxFeedSize {
+		return errors.Wrapf(errors.ErrInvalidFormat, "feed exceeds %d bytes", f.input.MaxFeedSize)
+	}
+	agg, err := LoadMetadataAggregate(data, f.input.Certs, f.clock.Now())
+	if err != nil {
+		return errors.Wrap(err, "LoadMetadataAggregate")
+	}
+
+	f.lock.Lock()
+	// a stale mirror must not roll the aggregate back
+	if f.aggregate != nil && agg.validUntil.Before(f.aggregate.validUntil) {
+		f.lock.Unlock()
+		return errors.Wrapf(ErrSAMLExpired, "feed valid until %s, older than the loaded one valid until %s", agg.validUntil, f.aggregate.validUntil)
+	}
+	f.aggregate = agg
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	f.lock.Unlock()
+
+	log.Infof("SAML federation %s: %d entities", f.input.MetadataUrl, len(agg.entities))
+	if len(f.input.CacheFile) > 0 {
+		if err := f.saveCacheFile(data); err != nil {
+			log.Warningf("save SAML federation cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// nextRefresh returns the interval before the next refresh
+func (f *SSAMLFederation) nextRefresh(lastErr error) time.Duration {
+	agg := f.getAggregate()
+	if lastErr != nil || agg == nil {
+		return f.input.RetryInterval
+	}
+	interval := f.input.RefreshInterval
+	if agg.cacheDuration > 0 && agg.cacheDuration < interval {
+		interval = agg.cacheDuration
+	}
+	// refresh well before the aggregate expires
+	if !agg.validUntil.IsZero() {
+		remain := agg.validUntil.Sub(f.clock.Now()) / 2
+		if remain < interval {
+			interval = remain
+		}
+	}
+	if interval < f.input.RetryInterval {
+		interval = f.input.RetryInterval
+	}
+	return interval
+}
+
+// Start loads the cache file and refreshes the aggregate periodically until
+// stopCh is closed
+func (f *SSAMLFederation) Start(stopCh <-chan struct{}) {
+	if err := f.LoadCacheFile(); err != nil {
+		log.Warningf("load SAML federation cache: %v", err)
+	}
+	go func() {
+		defer runtime.HandleCrash()
+
+		for {
+			err := f.Refresh()
+			if err != nil {
+				log.Errorf("refresh SAML federation %s: %v", f.input.MetadataUrl, err)
+			}
+			select {
+			case <-stopCh:
+				return
+			case <-f.clock.After(f.nextRefresh(err)):
+			}
+		}
+	}()
+}
+
+// GetEntity returns the EntityDescriptor of entityId from the last verified
+// aggregate
+func (f *SSAMLFederation) GetEntity(entityId string) (*EntityDescriptor, error) {
+	agg := f.getAggregate()
+	if agg == nil {
+		return nil, errors.Wrapf(errors.ErrNotFound, "federation %s not loaded", f.input.MetadataUrl)
+	}
+	return agg.GetEntity(entityId, f.clock.Now())
+}
+
+// GetEntityIds returns the sorted entityIDs of the last verified aggregate
+func (f *SSAMLFederation) GetEntityIds() []string {
+	agg := f.getAggregate()
+	if agg == nil {
+		return nil
+	}
+	return agg.GetEntityIds()
+}
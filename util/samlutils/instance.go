@@ -31,6 +31,9 @@ type SSAMLInstance struct {
 	privateKey *rsa.PrivateKey
 
 	certs []*x509.Certificate
+
+	// redirectSigAlg signs the HTTP-Redirect binding messages
+	redirectSigAlg string
 }
 
 func NewSAMLInstance(entityID string, cert, key string) (*SSAMLInstance, error) {
@@ -38,6 +41,7 @@ func NewSAMLInstance(entityID string, cert, key string) (*SSAMLInstance, error)
 		privateKeyFile: key,
 		certFile:       cert,
 		entityID:       entityID,
+		redirectSigAlg: SIG_ALG_RSA_SHA256,
 	}
 	err := saml.parseKeys()
 	if err != nil {
@@ -61,3 +65,13 @@ func (saml *SSAMLInstance) SignXML(xmlstr string) (string, error) {
 func (saml *SSAMLInstance) SetEntityId(id string) {
 	saml.entityID = id
 }
+
+// SetRedirectSigAlg sets the algorithm signing the HTTP-Redirect binding
+// messages, SIG_ALG_RSA_SHA256 by default
+func (saml *SSAMLInstance) SetRedirectSigAlg(sigAlg string) error {
+	if _, err := redirectSigHash(sigAlg); err != nil {
+		return err
+	}
+	saml.redirectSigAlg = sigAlg
+	return nil
+}
@@ -0,0 +1,397 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/clock"
+	"yunion.io/x/pkg/util/timeutils"
+)
+
+type SSAMLLogoutRequestInput struct {
+	IssuerEntityId string
+	// Destination is the SingleLogoutService location of the peer
+	Destination string
+
+	NameId       string
+	NameIdFormat string
+	SessionIndex string
+
+	// Reason is one of LOGOUT_REASON_*, optional
+	Reason string
+}
+
+type SSAMLLogoutResponseInput struct {
+	IssuerEntityId string
+	// Destination is the SingleLogoutService location of the peer
+	Destination  string
+	InResponseTo string
+
+	// StatusCode defaults to STATUS_SUCCESS
+	StatusCode    string
+	StatusMessage string
+}
+
+func newEntityIssuer(entityId string) Issuer {
+	issuerFormat := NAME_ID_FORMAT_ENTITY
+	return Issuer{
+		XMLName: xml.Name{
+			Space: XMLNS_ASSERT,
+			Local: "Issuer",
+		},
+		Format: &issuerFormat,
+		Issuer: entityId,
+	}
+}
+
+func NewLogoutRequest(input SSAMLLogoutRequestInput) LogoutRequest {
+	now := timeutils.IsoTime(time.Now().UTC())
+	until := timeutils.IsoTime(time.Now().UTC().Add(time.Minute * 5))
+
+	req := LogoutRequest{
+		XMLName: xml.Name{
+			Space: XMLNS_PROTO,
+			Local: "LogoutRequest",
+		},
+		ID:           GenerateSAMLId(),
+		Version:      SAML2_VERSION,
+		IssueInstant: now,
+		Destination:  input.Destination,
+		NotOnOrAfter: &until,
+		Issuer:       newEntityIssuer(input.IssuerEntityId),
+		NameID: NameID{
+			XMLName: xml.Name{
+				Space: XMLNS_ASSERT,
+				Local: "NameID",
+			},
+			Format: input.NameIdFormat,
+			Value:  input.NameId,
+		},
+	}
+	if len(input.Reason) > 0 {
+		req.Reason = &input.Reason
+	}
+	if len(input.SessionIndex) > 0 {
+		req.SessionIndexes = []SessionIndex{
+			{
+				XMLName: xml.Name{
+					Space: XMLNS_PROTO,
+					Local: "SessionIndex",
+				},
+				Index: input.SessionIndex,
+			},
+		}
+	}
+	return req
+}
+
+func newStatus(statusCode string, statusMessage string) Status {
+	status := Status{
+		XMLName: xml.Name{
+			Space: XMLNS_PROTO,
+			Local: "Status",
+		},
+		StatusCode: StatusCode{
+			XMLName: xml.Name{
+				Space: XMLNS_PROTO,
+				Local: "StatusCode",
+			},
+			Value: statusCode,
+		},
+	}
+	if len(statusMessage) > 0 {
+		status.StatusMessage = &StatusMessage{
+			XMLName: xml.Name{
+				Space: XMLNS_PROTO,
+				Local: "StatusMessage",
+			},
+			Message: statusMessage,
+		}
+	}
+	return status
+}
+
+func NewLogoutResponse(input SSAMLLogoutResponseInput) LogoutResponse {
+	now := timeutils.IsoTime(time.Now().UTC())
+
+	statusCode := input.StatusCode
+	if len(statusCode) == 0 {
+		statusCode = STATUS_SUCCESS
+	}
+	resp := LogoutResponse{
+		XMLName: xml.Name{
+			Space: XMLNS_PROTO,
+			Local: "LogoutResponse",
+		},
+		ID:           GenerateSAMLId(),
+		Version:      SAML2_VERSION,
+		IssueInstant: now,
+		Destination:  input.Destination,
+		Issuer:       newEntityIssuer(input.IssuerEntityId),
+		Status:       newStatus(statusCode, input.StatusMessage),
+	}
+	if len(input.InResponseTo) > 0 {
+		resp.InResponseTo = &input.InResponseTo
+	}
+	return resp
+}
+
+func (resp LogoutResponse) IsSuccess() bool {
+	return resp.Status.StatusCode.Value == STATUS_SUCCESS
+}
+
+// signMessage marshals msg, whose signature template has been set, and
+// signs it
+func (saml *SSAMLInstance) signMessage(msg interface{}) ([]byte, error) {
+	msgXml, err := xml.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Marshal")
+	}
+	signed, err := saml.SignXML(string(msgXml))
+	if err != nil {
+		return nil, errors.Wrap(err, "SignXML")
+	}
+	return []byte(signed), nil
+}
+
+// LogoutRequestRedirectUrl returns the URL sending req to its destination
+// over the HTTP-Redirect binding, with a detached signature
+func (saml *SSAMLInstance) LogoutRequestRedirectUrl(req LogoutRequest, relayState string) (string, error) {
+	req.Signature = nil
+	msg, err := xml.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "xml.Marshal")
+	}
+	return saml.redirectBindingUrl(req.Destination, PARAM_SAML_REQUEST, msg, relayState)
+}
+
+// LogoutRequestPostForm returns the HTML form sending the signed req to its
+// destination over the HTTP-POST binding
+func (saml *SSAMLInstance) LogoutRequestPostForm(req LogoutRequest, relayState string) (string, error) {
+	req.Signature = newSignature(req.ID, saml.certString)
+	msg, err := saml.signMessage(req)
+	if err != nil {
+		return "", errors.Wrap(err, "signMessage")
+	}
+	return postBindingForm(req.Destination, PARAM_SAML_REQUEST, msg, relayState), nil
+}
+
+// LogoutResponseRedirectUrl returns the URL sending resp to its destination
+// over the HTTP-Redirect binding, with a detached signature
+func (saml *SSAMLInstance) LogoutResponseRedirectUrl(resp LogoutResponse, relayState string) (string, error) {
+	resp.Signature = nil
+	msg, err := xml.Marshal(resp)
+	if err != nil {
+		return "", errors.Wrap(err, "xml.Marshal")
+	}
+	return saml.redirectBindingUrl(resp.Destination, PARAM_SAML_RESPONSE, msg, relayState)
+}
+
+// LogoutResponsePostForm returns the HTML form sending the signed resp to
+// its destination over the HTTP-POST binding
+func (saml *SSAMLInstance) LogoutResponsePostForm(resp LogoutResponse, relayState string) (string, error) {
+	resp.Signature = newSignature(resp.ID, saml.certString)
+	msg, err := saml.signMessage(resp)
+	if err != nil {
+		return "", errors.Wrap(err, "signMessage")
+	}
+	return postBindingForm(resp.Destination, PARAM_SAML_RESPONSE, msg, relayState), nil
+}
+
+type SSAMLLogoutValidatorInput struct {
+	// PeerMetadata is the EntityDescriptor of the IdP for an SP, or of the
+	// SP for an IdP. The logout messages must be signed with the cert of one
+	// of its signing KeyDescriptors
+	PeerMetadata EntityDescriptor
+
+	// Destination is the own SingleLogoutService location, not checked if empty
+	Destination string
+
+	// ClockSkew is the tolerated clock difference with the peer
+	ClockSkew time.Duration
+	// RequestTTL is how long an issued LogoutRequest ID remains acceptable
+	RequestTTL time.Duration
+	// ReplayTTL is how long the received LogoutRequest IDs are remembered
+	// at least, or until their NotOnOrAfter if later
+	ReplayTTL time.Duration
+}
+
+// SSAMLLogoutValidator validates the LogoutRequest and LogoutResponse
+// messages received from a peer for both SP- and IdP-initiated logout.
+type SSAMLLogoutValidator struct {
+	peerEntityId string
+	certs        []x509.Certificate
+
+	destination string
+	clockSkew   time.Duration
+
+	clock      clock.Clock
+	requestIds *sIdCache
+	// receivedIds are the IDs of the accepted LogoutRequests
+	receivedIds *sIdCache
+}
+
+func NewLogoutValidator(input SSAMLLogoutValidatorInput) (*SSAMLLogoutValidator, error) {
+	certs, err := input.PeerMetadata.GetSigningCertificates()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSigningCertificates")
+	}
+	if len(certs) == 0 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no signing certificate in peer metadata")
+	}
+	if input.ClockSkew <= 0 {
+		input.ClockSkew = DefaultClockSkew
+	}
+	if input.RequestTTL <= 0 {
+		input.RequestTTL = DefaultRequestTTL
+	}
+	if input.ReplayTTL <= 0 {
+		input.ReplayTTL = DefaultReplayTTL
+	}
+	return &SSAMLLogoutValidator{
+		peerEntityId: input.PeerMetadata.EntityId,
+		certs:        certs,
+
+		destination: input.Destination,
+		clockSkew:   input.ClockSkew,
+
+		clock:       clock.RealClock{},
+		requestIds:  newIdCache(input.RequestTTL),
+		receivedIds: newIdCache(input.ReplayTTL),
+	}, nil
+}
+
+// AddRequestId registers the ID of an issued LogoutRequest, so that the
+// LogoutResponse to it is accepted.
+func (v *SSAMLLogoutValidator) AddRequestId(reqId string) {
+	v.requestIds.Add(reqId, v.clock.Now())
+}
+
+// verifyMessage checks the XML or the query signature of a message and
+// returns its signed content
+func (v *SSAMLLogoutValidator) verifyMessage(msg *SSAMLBindingMessage, sig *Signature, name string, id string) ([]byte, error) {
+	if sig == nil {
+		if msg.Binding != BINDING_HTTP_REDIRECT {
+			return nil, errors.Wrapf(ErrSAMLSignatureMissing, "%s binding", msg.Binding)
+		}
+		// the XML signature is replaced by the query signature
+		if err := msg.VerifySignature(v.certs); err != nil {
+			return nil, errors.Wrap(err, "VerifySignature")
+		}
+		return msg.Message, nil
+	}
+	signed, err := verifyXMLSignature(v.certs, string(msg.Message), sig, name, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifyXMLSignature")
+	}
+	return []byte(signed), nil
+}
+
+func (v *SSAMLLogoutValidator) checkDestination(destination string) error {
+	if len(v.destination) > 0 && len(destination) > 0 && destination != v.destination {
+		return errors.Wrapf(ErrSAMLRecipient, "destination %s, expect %s", destination, v.destination)
+	}
+	return nil
+}
+
+// ValidateLogoutRequest parses and validates a LogoutRequest, the returned
+// request only contains the signed content
+func (v *SSAMLLogoutValidator) ValidateLogoutRequest(msg *SSAMLBindingMessage) (*LogoutRequest, error) {
+	if !msg.IsRequest() {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "expect %s, got %s", PARAM_SAML_REQUEST, msg.Param)
+	}
+	req := LogoutRequest{}
+	err := xml.Unmarshal(msg.Message, &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal LogoutRequest")
+	}
+	signed, err := v.verifyMessage(msg, req.Signature, "LogoutRequest", req.ID)
+	if err != nil {
+		return nil, err
+	}
+	req = LogoutRequest{}
+	err = xml.Unmarshal(signed, &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal signed LogoutRequest")
+	}
+
+	if err := checkIssuer(req.Issuer, v.peerEntityId); err != nil {
+		return nil, err
+	}
+	if err := v.checkDestination(req.Destination); err != nil {
+		return nil, err
+	}
+	now := v.clock.Now()
+	notOnOrAfter := ""
+	if req.NotOnOrAfter != nil {
+		notOnOrAfter = *req.NotOnOrAfter
+	}
+	if err := checkTimeWindow(now, v.clockSkew, nil, notOnOrAfter); err != nil {
+		return nil, err
+	}
+	// a captured request must not end the sessions again
+	if len(req.ID) == 0 {
+		return nil, errors.Wrap(ErrSAMLReplayedRequest, "LogoutRequest without ID")
+	}
+	if !v.receivedIds.CheckAndAdd(req.ID, now, expireTime(notOnOrAfter, v.clockSkew)) {
+		return nil, errors.Wrapf(ErrSAMLReplayedRequest, "LogoutRequest %s", req.ID)
+	}
+	return &req, nil
+}
+
+// ValidateLogoutResponse parses and validates a LogoutResponse to a request
+// registered with AddRequestId, the returned response only contains the
+// signed content
+func (v *SSAMLLogoutValidator) ValidateLogoutResponse(msg *SSAMLBindingMessage) (*LogoutResponse, error) {
+	if msg.IsRequest() {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "expect %s, got %s", PARAM_SAML_RESPONSE, msg.Param)
+	}
+	resp := LogoutResponse{}
+	err := xml.Unmarshal(msg.Message, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal LogoutResponse")
+	}
+	signed, err := v.verifyMessage(msg, resp.Signature, "LogoutResponse", resp.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp = LogoutResponse{}
+	err = xml.Unmarshal(signed, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal signed LogoutResponse")
+	}
+
+	if err := checkIssuer(resp.Issuer, v.peerEntityId); err != nil {
+		return nil, err
+	}
+	if err := v.checkDestination(resp.Destination); err != nil {
+		return nil, err
+	}
+	if resp.InResponseTo == nil || len(*resp.InResponseTo) == 0 {
+		return nil, errors.Wrap(ErrSAMLInResponseTo, "no InResponseTo")
+	}
+	// each request is answered only once
+	if !v.requestIds.Take(*resp.InResponseTo, v.clock.Now()) {
+		return nil, errors.Wrapf(ErrSAMLInResponseTo, "unknown request %s", *resp.InResponseTo)
+	}
+	if !resp.IsSuccess() {
+		return &resp, errors.Wrapf(ErrSAMLStatus, "status %s", resp.Status.StatusCode.Value)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	testSpLogoutUrl  = "https://sp.yunion.io/saml/slo"
+	testIdpLogoutUrl = "https://saml.yunion.io/saml/slo"
+)
+
+func newTestSAMLInstance(t *testing.T, entityId string) *SSAMLInstance {
+	dir, err := ioutil.TempDir("", "samlutils")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keyFile := filepath.Join(dir, "key.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(keyFile, []byte(privateKeyString), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	certPem := "-----BEGIN CERTIFICATE-----\n" + certString + "\n-----END CERTIFICATE-----\n"
+	if err := ioutil.WriteFile(certFile, []byte(certPem), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	saml, err := NewSAMLInstance(entityId, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewSAMLInstance: %v", err)
+	}
+	return saml
+}
+
+var formInputRegexp = regexp.MustCompile(`name="([^"]+)" value="([^"]*)"`)
+
+func parseTestPostForm(t *testing.T, form string) url.Values {
+	values := url.Values{}
+	for _, match := range formInputRegexp.FindAllStringSubmatch(form, -1) {
+		values.Set(match[1], html.UnescapeString(match[2]))
+	}
+	return values
+}
+
+func TestLogoutPostBinding(t *testing.T) {
+	sp := newTestSAMLInstance(t, testSpEntityId)
+	idp := newTestSAMLInstance(t, testIdpEntityId)
+
+	idpValidator, err := NewLogoutValidator(SSAMLLogoutValidatorInput{
+		PeerMetadata: NewSpMetadata(SSAMLSpMetadataInput{
+			EntityId:      testSpEntityId,
+			CertString:    certString,
+			PostLogoutUrl: testSpLogoutUrl,
+		}),
+		Destination: testIdpLogoutUrl,
+	})
+	if err != nil {
+		t.Fatalf("NewLogoutValidator: %v", err)
+	}
+	spValidator, err := NewLogoutValidator(SSAMLLogoutValidatorInput{
+		PeerMetadata: NewIdpMetadata(SSAMLIdpMetadataInput{
+			EntityId:      testIdpEntityId,
+			CertString:    certString,
+			PostLogoutUrl: testIdpLogoutUrl,
+		}),
+		Destination: testSpLogoutUrl,
+	})
+	if err != nil {
+		t.Fatalf("NewLogoutValidator: %v", err)
+	}
+
+	// SP-initiated logout
+	req := NewLogoutRequest(SSAMLLogoutRequestInput{
+		IssuerEntityId: sp.GetEntityId(),
+		Destination:    testIdpLogoutUrl,
+		NameId:         "testUser",
+		NameIdFormat:   NAME_ID_FORMAT_TRANSIENT,
+		SessionIndex:   "_session1",
+		Reason:         LOGOUT_REASON_USER,
+	})
+	spValidator.AddRequestId(req.ID)
+	form, err := sp.LogoutRequestPostForm(req, "state&1")
+	if err != nil {
+		t.Fatalf("LogoutRequestPostForm: %v", err)
+	}
+	msg, err := ParsePostBinding(parseTestPostForm(t, form))
+	if err != nil {
+		t.Fatalf("ParsePostBinding: %v", err)
+	}
+	if msg.RelayState != "state&1" {
+		t.Errorf("relay state %q", msg.RelayState)
+	}
+	recvReq, err := idpValidator.ValidateLogoutRequest(msg)
+	if err != nil {
+		t.Fatalf("ValidateLogoutRequest: %v", err)
+	}
+	if recvReq.NameID.Value != "testUser" || len(recvReq.SessionIndexes) != 1 || recvReq.SessionIndexes[0].Index != "_session1" {
+		t.Errorf("unexpected request %#v", recvReq)
+	}
+	// a captured request is not accepted again
+	if _, err := idpValidator.ValidateLogoutRequest(msg); errors.Cause(err) != ErrSAMLReplayedRequest {
+		t.Errorf("expect replayed request, got %v", err)
+	}
+
+	resp := NewLogoutResponse(SSAMLLogoutResponseInput{
+		IssuerEntityId: idp.GetEntityId(),
+		Destination:    testSpLogoutUrl,
+		InResponseTo:   recvReq.ID,
+	})
+	form, err = idp.LogoutResponsePostForm(resp, msg.RelayState)
+	if err != nil {
+		t.Fatalf("LogoutResponsePostForm: %v", err)
+	}
+	msg, err = ParsePostBinding(parseTestPostForm(t, form))
+	if err != nil {
+		t.Fatalf("ParsePostBinding: %v", err)
+	}
+	recvResp, err := spValidator.ValidateLogoutResponse(msg)
+	if err != nil {
+		t.Fatalf("ValidateLogoutResponse: %v", err)
+	}
+	if !recvResp.IsSuccess() {
+		t.Errorf("expect success")
+	}
+	// a response is only accepted once
+	if _, err := spValidator.ValidateLogoutResponse(msg); errors.Cause(err) != ErrSAMLInResponseTo {
+		t.Errorf("expect InResponseTo error, got %v", err)
+	}
+
+	// the response is not accepted as a request, nor from an unknown issuer
+	if _, err := idpValidator.ValidateLogoutRequest(msg); err == nil {
+		t.Errorf("expect error for a response")
+	}
+	resp = NewLogoutResponse(SSAMLLogoutResponseInput{
+		IssuerEntityId: "https://evil.idp/",
+		Destination:    testSpLogoutUrl,
+		InResponseTo:   req.ID,
+	})
+	form, _ = idp.LogoutResponsePostForm(resp, "")
+	msg, _ = ParsePostBinding(parseTestPostForm(t, form))
+	if _, err := spValidator.ValidateLogoutResponse(msg); errors.Cause(err) != ErrSAMLIssuer {
+		t.Errorf("expect issuer error, got %v", err)
+	}
+}
+
+func TestLogoutRedirectBinding(t *testing.T) {
+	idp := newTestSAMLInstance(t, testIdpEntityId)
+
+	// IdP-initiated logout
+	req := NewLogoutRequest(SSAMLLogoutRequestInput{
+		IssuerEntityId: idp.GetEntityId(),
+		Destination:    testSpLogoutUrl + "?tenant=1",
+		NameId:         "testUser",
+		NameIdFormat:   NAME_ID_FORMAT_TRANSIENT,
+	})
+	redirectUrl, err := idp.LogoutRequestRedirectUrl(req, "state")
+	if err != nil {
+		t.Fatalf("LogoutRequestRedirectUrl: %v", err)
+	}
+	u, err := url.Parse(redirectUrl)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	if u.Query().Get("tenant") != "1" {
+		t.Errorf("original query lost: %s", redirectUrl)
+	}
+	msg, err := ParseRedirectBinding(u.Query())
+	if err != nil {
+		t.Fatalf("ParseRedirectBinding: %v", err)
+	}
+	if !msg.IsRequest() || msg.RelayState != "state" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+
+	spValidator, err := NewLogoutValidator(SSAMLLogoutValidatorInput{
+		PeerMetadata: NewIdpMetadata(SSAMLIdpMetadataInput{
+			EntityId:          testIdpEntityId,
+			CertString:        certString,
+			RedirectLogoutUrl: testIdpLogoutUrl,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewLogoutValidator: %v", err)
+	}
+	// the XML signature is replaced by the query signature
+	if _, err := spValidator.ValidateLogoutRequest(msg); err != nil {
+		t.Errorf("ValidateLogoutRequest: %v", err)
+	}
+	if _, err := spValidator.ValidateLogoutRequest(msg); errors.Cause(err) != ErrSAMLReplayedRequest {
+		t.Errorf("expect replayed request, got %v", err)
+	}
+	msg.Signature = nil
+	if _, err := spValidator.ValidateLogoutRequest(msg); errors.Cause(err) != ErrSAMLSignatureMissing {
+		t.Errorf("expect missing signature, got %v", err)
+	}
+}
+
+func TestSingleLogoutServices(t *testing.T) {
+	sp := NewSpMetadata(SSAMLSpMetadataInput{
+		EntityId:          testSpEntityId,
+		CertString:        certString,
+		RedirectLogoutUrl: testSpLogoutUrl,
+		PostLogoutUrl:     testSpLogoutUrl + "/post",
+	})
+	desc := sp.SPSSODescriptor
+	if len(desc.SingleLogoutServices) != 2 {
+		t.Fatalf("expect 2 SingleLogoutService, got %d", len(desc.SingleLogoutServices))
+	}
+	if url := desc.GetSingleLogoutServiceUrl(BINDING_HTTP_POST); url != testSpLogoutUrl+"/post" {
+		t.Errorf("unexpected POST SingleLogoutService %s", url)
+	}
+
+	parsed, err := ParseMetadata([]byte(sp.String()))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if url := parsed.SPSSODescriptor.GetSingleLogoutServiceUrl(BINDING_HTTP_REDIRECT); url != testSpLogoutUrl {
+		t.Errorf("unexpected Redirect SingleLogoutService %s", url)
+	}
+}
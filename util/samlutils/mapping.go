@@ -0,0 +1,251 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	ATTR_TRANSFORM_LOWERCASE = "lowercase"
+	ATTR_TRANSFORM_REGEX     = "regex"
+	ATTR_TRANSFORM_JOIN      = "join"
+)
+
+type SSAMLAttributeTransform struct {
+	// Type is one of ATTR_TRANSFORM_*
+	Type string
+
+	// Pattern of ATTR_TRANSFORM_REGEX, the first submatch of the values
+	// matching it is kept, or the whole match if it has no group. The
+	// values not matching are dropped.
+	Pattern string
+
+	// Separator of ATTR_TRANSFORM_JOIN
+	Separator string
+}
+
+// SSAMLAttributeMapping maps the values of an attribute to a field of the
+// user struct
+type SSAMLAttributeMapping struct {
+	// Field is the name of the struct field, of type string, []string,
+	// bool or int
+	Field string
+
+	// Name is matched against both the Name and the FriendlyName of the
+	// attributes
+	Name string
+	// NameFormat restricts the matched attributes to a ATTR_NAME_FORMAT_*,
+	// an attribute without NameFormat is of ATTR_NAME_FORMAT_UNSPEC
+	NameFormat string
+
+	Transforms []SSAMLAttributeTransform
+
+	Required bool
+}
+
+type sAttributeTransform struct {
+	SSAMLAttributeTransform
+
+	regexp *regexp.Regexp
+}
+
+type sAttributeMapping struct {
+	SSAMLAttributeMapping
+
+	transforms []sAttributeTransform
+}
+
+// SSAMLAttributeMapper fills a user struct with the attributes of an
+// assertion according to a list of mappings.
+type SSAMLAttributeMapper struct {
+	mappings []sAttributeMapping
+}
+
+func NewAttributeMapper(mappings []SSAMLAttributeMapping) (*SSAMLAttributeMapper, error) {
+	mapper := &SSAMLAttributeMapper{
+		mappings: make([]sAttributeMapping, len(mappings)),
+	}
+	for i := range mappings {
+		if len(mappings[i].Field) == 0 || len(mappings[i].Name) == 0 {
+			return nil, errors.Wrapf(errors.ErrInvalidFormat, "mapping %d without Field or Name", i)
+		}
+		m := sAttributeMapping{
+			SSAMLAttributeMapping: mappings[i],
+			transforms:            make([]sAttributeTransform, len(mappings[i].Transforms)),
+		}
+		for j, trans := range mappings[i].Transforms {
+			m.transforms[j].SSAMLAttributeTransform = trans
+			switch trans.Type {
+			case ATTR_TRANSFORM_LOWERCASE, ATTR_TRANSFORM_JOIN:
+			case ATTR_TRANSFORM_REGEX:
+				exp, err := regexp.Compile(trans.Pattern)
+				if err != nil {
+					return nil, errors.Wrapf(err, "mapping %s: regexp.Compile %s", m.Field, trans.Pattern)
+				}
+				m.transforms[j].regexp = exp
+			default:
+				return nil, errors.Wrapf(errors.ErrNotSupported, "mapping %s: transform %s", m.Field, trans.Type)
+			}
+		}
+		mapper.mappings[i] = m
+	}
+	return mapper, nil
+}
+
+func (m *sAttributeMapping) match(attr *Attribute) bool {
+	if attr.Name != m.Name && (attr.FriendlyName == nil || *attr.FriendlyName != m.Name) {
+		return false
+	}
+	if len(m.NameFormat) > 0 {
+		nameFormat := ATTR_NAME_FORMAT_UNSPEC
+		if attr.NameFormat != nil && len(*attr.NameFormat) > 0 {
+			nameFormat = *attr.NameFormat
+		}
+		return nameFormat == m.NameFormat
+	}
+	return true
+}
+
+func (trans *sAttributeTransform) apply(values []string) []string {
+	switch trans.Type {
+	case ATTR_TRANSFORM_LOWERCASE:
+		for i := range values {
+			values[i] = strings.ToLower(values[i])
+		}
+	case ATTR_TRANSFORM_REGEX:
+		ret := make([]string, 0, len(values))
+		for _, val := range values {
+			match := trans.regexp.FindStringSubmatch(val)
+			if match == nil {
+				continue
+			}
+			if len(match) > 1 {
+				ret = append(ret, match[1])
+			} else {
+				ret = append(ret, match[0])
+			}
+		}
+		values = ret
+	case ATTR_TRANSFORM_JOIN:
+		if len(values) > 0 {
+			values = []string{strings.Join(values, trans.Separator)}
+		}
+	}
+	return values
+}
+
+func (m *sAttributeMapping) values(attrs []Attribute) []string {
+	values := make([]string, 0)
+	for i := range attrs {
+		if !m.match(&attrs[i]) {
+			continue
+		}
+		for _, val := range attrs[i].AttributeValues {
+			values = append(values, strings.TrimSpace(val.Value))
+		}
+	}
+	for i := range m.transforms {
+		values = m.transforms[i].apply(values)
+	}
+	return values
+}
+
+func setFieldValues(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i := range values {
+			slice.Index(i).SetString(values[i])
+		}
+		field.Set(slice)
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(values[0])
+	case reflect.Bool:
+		val, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidFormat, "invalid bool %s", values[0])
+		}
+		field.SetBool(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val, err := strconv.ParseInt(values[0], 10, field.Type().Bits())
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidFormat, "invalid int %s", values[0])
+		}
+		field.SetInt(val)
+	default:
+		return errors.Wrapf(errors.ErrNotSupported, "field of type %s", field.Type())
+	}
+	return nil
+}
+
+// MapAttributes sets the fields of the struct pointed by user with the
+// values of the matching attributes
+func (mapper *SSAMLAttributeMapper) MapAttributes(attrs []Attribute, user interface{}) error {
+	val := reflect.ValueOf(user)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return errors.Wrapf(errors.ErrInvalidFormat, "expect a pointer to struct, got %T", user)
+	}
+	val = val.Elem()
+	for i := range mapper.mappings {
+		m := &mapper.mappings[i]
+		field := val.FieldByName(m.Field)
+		if !field.IsValid() || !field.CanSet() {
+			return errors.Wrapf(errors.ErrNotFound, "field %s of %s", m.Field, val.Type())
+		}
+		values := m.values(attrs)
+		if len(values) == 0 && m.Required {
+			return errors.Wrapf(errors.ErrNotFound, "attribute %s", m.Name)
+		}
+		err := setFieldValues(field, values)
+		if err != nil {
+			return errors.Wrapf(err, "field %s", m.Field)
+		}
+	}
+	return nil
+}
+
+// MapResponse maps the attributes of the assertion of a validated response
+func (mapper *SSAMLAttributeMapper) MapResponse(resp *Response, user interface{}) error {
+	var attrs []Attribute
+	if resp.Assertion != nil && resp.Assertion.AttributeStatement != nil {
+		attrs = resp.Assertion.AttributeStatement.Attributes
+	}
+	return mapper.MapAttributes(attrs, user)
+}
+
+// GeneratePersistentNameId returns the opaque persistent identifier of a
+// user for a SP: stable for the same SP and user, different across SPs, and
+// not revealing the user ID without secret
+func GeneratePersistentNameId(secret []byte, spEntityId string, userId string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(spEntityId))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
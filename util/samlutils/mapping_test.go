@@ -0,0 +1,221 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+
+	"yunion.io/x/pkg/errors"
+)
+
+type testSAMLUser struct {
+	Email    string
+	Name     string
+	Groups   []string
+	Domain   string
+	IsAdmin  bool
+	Level    int
+	Optional string
+}
+
+func newTestAttributeResponse() *Response {
+	resp := NewResponse(SSAMLResponseInput{
+		IssuerEntityId:   testIdpEntityId,
+		RequestEntityId:  testSpEntityId,
+		IssuerCertString: certString,
+	})
+	resp.AddAttribute("urn:oid:0.9.2342.19200300.100.1.3", "mail", ATTR_NAME_FORMAT_URI, []string{"Alice@Yunion.IO"})
+	resp.AddAttribute("givenName", "", "", []string{"Alice"})
+	resp.AddAttribute("sn", "", "", []string{"Liddell"})
+	resp.AddAttribute("memberOf", "", ATTR_NAME_FORMAT_BASIC, []string{"CN=dev,OU=groups", "CN=ops,OU=groups", "misc"})
+	resp.AddAttribute("isAdmin", "", ATTR_NAME_FORMAT_BASIC, []string{"true"})
+	resp.AddAttribute("level", "", ATTR_NAME_FORMAT_BASIC, []string{"3"})
+	return &resp
+}
+
+func TestAttributeMapper(t *testing.T) {
+	mapper, err := NewAttributeMapper([]SSAMLAttributeMapping{
+		{
+			Field:      "Email",
+			Name:       "mail",
+			NameFormat: ATTR_NAME_FORMAT_URI,
+			Transforms: []SSAMLAttributeTransform{{Type: ATTR_TRANSFORM_LOWERCASE}},
+			Required:   true,
+		},
+		{
+			Field: "Name",
+			Name:  "givenName",
+			Transforms: []SSAMLAttributeTransform{
+				{Type: ATTR_TRANSFORM_JOIN, Separator: " "},
+			},
+		},
+		{
+			Field: "Groups",
+			Name:  "memberOf",
+			Transforms: []SSAMLAttributeTransform{
+				{Type: ATTR_TRANSFORM_REGEX, Pattern: `^CN=([^,]+)`},
+			},
+		},
+		{
+			Field: "Domain",
+			Name:  "urn:oid:0.9.2342.19200300.100.1.3",
+			Transforms: []SSAMLAttributeTransform{
+				{Type: ATTR_TRANSFORM_REGEX, Pattern: `@(.*)$`},
+				{Type: ATTR_TRANSFORM_LOWERCASE},
+			},
+		},
+		{Field: "IsAdmin", Name: "isAdmin"},
+		{Field: "Level", Name: "level"},
+		{Field: "Optional", Name: "absent"},
+	})
+	if err != nil {
+		t.Fatalf("NewAttributeMapper: %v", err)
+	}
+
+	user := testSAMLUser{}
+	if err := mapper.MapResponse(newTestAttributeResponse(), &user); err != nil {
+		t.Fatalf("MapResponse: %v", err)
+	}
+	want := testSAMLUser{
+		Email:   "alice@yunion.io",
+		Name:    "Alice",
+		Groups:  []string{"dev", "ops"},
+		Domain:  "yunion.io",
+		IsAdmin: true,
+		Level:   3,
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("expect %#v, got %#v", want, user)
+	}
+}
+
+func TestAttributeMapperErrors(t *testing.T) {
+	resp := newTestAttributeResponse()
+	cases := []struct {
+		name     string
+		mappings []SSAMLAttributeMapping
+		newErr   error
+		mapErr   error
+	}{
+		{
+			name:     "unknown transform",
+			mappings: []SSAMLAttributeMapping{{Field: "Email", Name: "mail", Transforms: []SSAMLAttributeTransform{{Type: "upper"}}}},
+			newErr:   errors.ErrNotSupported,
+		},
+		{
+			name:     "no field",
+			mappings: []SSAMLAttributeMapping{{Name: "mail"}},
+			newErr:   errors.ErrInvalidFormat,
+		},
+		{
+			name:     "missing required",
+			mappings: []SSAMLAttributeMapping{{Field: "Email", Name: "email", Required: true}},
+			mapErr:   errors.ErrNotFound,
+		},
+		{
+			name:     "name format mismatch",
+			mappings: []SSAMLAttributeMapping{{Field: "Email", Name: "mail", NameFormat: ATTR_NAME_FORMAT_BASIC, Required: true}},
+			mapErr:   errors.ErrNotFound,
+		},
+		{
+			name:     "unknown field",
+			mappings: []SSAMLAttributeMapping{{Field: "Phone", Name: "mail"}},
+			mapErr:   errors.ErrNotFound,
+		},
+		{
+			name:     "invalid int",
+			mappings: []SSAMLAttributeMapping{{Field: "Level", Name: "givenName"}},
+			mapErr:   errors.ErrInvalidFormat,
+		},
+	}
+	for _, c := range cases {
+		mapper, err := NewAttributeMapper(c.mappings)
+		if errors.Cause(err) != errors.Cause(c.newErr) {
+			t.Errorf("%s: NewAttributeMapper expect %v, got %v", c.name, c.newErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		err = mapper.MapResponse(resp, &testSAMLUser{})
+		if errors.Cause(err) != c.mapErr {
+			t.Errorf("%s: MapResponse expect %v, got %v", c.name, c.mapErr, err)
+		}
+	}
+}
+
+func TestNameIdFormats(t *testing.T) {
+	req := NewRequest(SSAMLRequestInput{
+		EntityID:     testSpEntityId,
+		NameIdFormat: NAME_ID_FORMAT_PERSISTENT,
+	})
+	if req.NameIDPolicy.Format != NAME_ID_FORMAT_PERSISTENT {
+		t.Errorf("unexpected NameIDPolicy %s", req.NameIDPolicy.Format)
+	}
+	if req := NewRequest(SSAMLRequestInput{EntityID: testSpEntityId}); req.NameIDPolicy.Format != NAME_ID_FORMAT_TRANSIENT {
+		t.Errorf("expect transient by default, got %s", req.NameIDPolicy.Format)
+	}
+
+	idp := NewIdpMetadata(SSAMLIdpMetadataInput{
+		EntityId:      testIdpEntityId,
+		CertString:    certString,
+		NameIdFormats: []string{NAME_ID_FORMAT_PERSISTENT, NAME_ID_FORMAT_EMAIL, NAME_ID_FORMAT_UNSPEC},
+	})
+	parsed, err := ParseMetadata([]byte(idp.String()))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	formats := parsed.IDPSSODescriptor.GetNameIDFormats()
+	if !reflect.DeepEqual(formats, []string{NAME_ID_FORMAT_PERSISTENT, NAME_ID_FORMAT_EMAIL, NAME_ID_FORMAT_UNSPEC}) {
+		t.Errorf("unexpected formats %v", formats)
+	}
+}
+
+func TestPersistentNameId(t *testing.T) {
+	secret := []byte("secret")
+	id := GeneratePersistentNameId(secret, testSpEntityId, "user1")
+	if id != GeneratePersistentNameId(secret, testSpEntityId, "user1") {
+		t.Errorf("persistent id not stable")
+	}
+	for _, other := range []string{
+		GeneratePersistentNameId(secret, testSpEntityId, "user2"),
+		GeneratePersistentNameId(secret, "https://other.sp/", "user1"),
+		GeneratePersistentNameId([]byte("other"), testSpEntityId, "user1"),
+	} {
+		if other == id {
+			t.Errorf("persistent id collision %s", id)
+		}
+	}
+
+	resp := NewResponse(SSAMLResponseInput{
+		IssuerEntityId:  testIdpEntityId,
+		RequestEntityId: testSpEntityId,
+		SSAMLSpInitiatedLoginData: SSAMLSpInitiatedLoginData{
+			NameId:       id,
+			NameIdFormat: NAME_ID_FORMAT_PERSISTENT,
+		},
+	})
+	respXml, _ := xml.Marshal(resp)
+	parsed := Response{}
+	if err := xml.Unmarshal(respXml, &parsed); err != nil {
+		t.Fatalf("xml.Unmarshal: %v", err)
+	}
+	nameId := parsed.Assertion.Subject.NameID
+	if nameId.Value != id || nameId.SPNameQualifier == nil || *nameId.SPNameQualifier != testSpEntityId {
+		t.Errorf("unexpected NameID %#v", nameId)
+	}
+}
@@ -16,6 +16,7 @@ package samlutils
 
 import (
 	"encoding/xml"
+	"strings"
 
 	"yunion.io/x/pkg/errors"
 )
@@ -29,11 +30,80 @@ func ParseMetadata(data []byte) (EntityDescriptor, error) {
 	return ed, nil
 }
 
+func newSingleLogoutServices(redirectUrl, postUrl string) []SSAMLService {
+	services := make([]SSAMLService, 0)
+	for _, svc := range []struct {
+		binding  string
+		location string
+	}{
+		{BINDING_HTTP_REDIRECT, redirectUrl},
+		{BINDING_HTTP_POST, postUrl},
+	} {
+		if len(svc.location) == 0 {
+			continue
+		}
+		services = append(services, SSAMLService{
+			XMLName: xml.Name{
+				Space: XMLNS_MD,
+				Local: "SingleLogoutService",
+			},
+			Binding:  svc.binding,
+			Location: svc.location,
+		})
+	}
+	return services
+}
+
+// GetSingleLogoutServiceUrl returns the location of the SingleLogoutService
+// with the given binding, or an empty string if there is none
+func (desc *SSODescriptor) GetSingleLogoutServiceUrl(binding string) string {
+	for _, svc := range desc.SingleLogoutServices {
+		if svc.Binding == binding {
+			return svc.Location
+		}
+	}
+	return ""
+}
+
+func newNameIDFormats(formats []string) []SSAMLNameIDFormat {
+	if len(formats) == 0 {
+		formats = []string{NAME_ID_FORMAT_TRANSIENT}
+	}
+	ret := make([]SSAMLNameIDFormat, len(formats))
+	for i := range formats {
+		ret[i] = SSAMLNameIDFormat{
+			XMLName: xml.Name{
+				Space: XMLNS_MD,
+				Local: "NameIDFormat",
+			},
+			Format: formats[i],
+		}
+	}
+	return ret
+}
+
+// GetNameIDFormats returns the NameID formats supported by the descriptor
+func (desc *SSODescriptor) GetNameIDFormats() []string {
+	formats := make([]string, len(desc.NameIDFormat))
+	for i := range desc.NameIDFormat {
+		formats[i] = strings.TrimSpace(desc.NameIDFormat[i].Format)
+	}
+	return formats
+}
+
 type SSAMLIdpMetadataInput struct {
 	EntityId          string
 	CertString        string
 	RedirectLoginUrl  string
 	RedirectLogoutUrl string
+	PostLogoutUrl     string
+
+	// ArtifactResolutionUrl is the SOAP endpoint resolving artifacts of
+	// index 0, optional
+	ArtifactResolutionUrl string
+
+	// NameIdFormats are the supported NAME_ID_FORMAT_*, transient by default
+	NameIdFormats []string
 }
 
 func NewIdpMetadata(input SSAMLIdpMetadataInput) EntityDescriptor {
@@ -103,25 +173,9 @@ func NewIdpMetadata(input SSAMLIdpMetadataInput) EntityDescriptor {
 					},
 				},
 			},
-			SingleLogoutServices: []SSAMLService{
-				{
-					XMLName: xml.Name{
-						Space: XMLNS_MD,
-						Local: "SingleLogoutService",
-					},
-					Binding:  BINDING_HTTP_REDIRECT,
-					Location: input.RedirectLogoutUrl,
-				},
-			},
-			NameIDFormat: []SSAMLNameIDFormat{
-				{
-					XMLName: xml.Name{
-						Space: XMLNS_MD,
-						Local: "NameIDFormat",
-					},
-					Format: NAME_ID_FORMAT_TRANSIENT,
-				},
-			},
+			ArtifactResolutionServices: newArtifactResolutionServices(input.ArtifactResolutionUrl),
+			SingleLogoutServices:       newSingleLogoutServices(input.RedirectLogoutUrl, input.PostLogoutUrl),
+			NameIDFormat:               newNameIDFormats(input.NameIdFormats),
 			SingleSignOnServices: []SSAMLService{
 				{
 					XMLName: xml.Name{
@@ -141,8 +195,13 @@ type SSAMLSpMetadataInput struct {
 	EntityId             string
 	CertString           string
 	AssertionConsumerUrl string
+	RedirectLogoutUrl    string
+	PostLogoutUrl        string
 	ServiceName          string
 	RequestedAttributes  []RequestedAttribute
+
+	// NameIdFormats are the accepted NAME_ID_FORMAT_*, transient by default
+	NameIdFormats []string
 }
 
 func NewSpMetadata(input SSAMLSpMetadataInput) EntityDescriptor {
@@ -229,15 +288,8 @@ func NewSpMetadata(input SSAMLSpMetadataInput) EntityDescriptor {
 					},
 				},
 			},
-			NameIDFormat: []SSAMLNameIDFormat{
-				{
-					XMLName: xml.Name{
-						Space: XMLNS_MD,
-						Local: "NameIDFormat",
-					},
-					Format: NAME_ID_FORMAT_TRANSIENT,
-				},
-			},
+			NameIDFormat:         newNameIDFormats(input.NameIdFormats),
+			SingleLogoutServices: newSingleLogoutServices(input.RedirectLogoutUrl, input.PostLogoutUrl),
 			AssertionConsumerServices: []SSAMLService{
 				{
 					XMLName: xml.Name{
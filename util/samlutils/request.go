@@ -18,6 +18,7 @@ import (
 	"encoding/xml"
 	"time"
 
+	"yunion.io/x/pkg/errors"
 	"yunion.io/x/pkg/util/timeutils"
 )
 
@@ -26,9 +27,15 @@ type SSAMLRequestInput struct {
 	Destination                 string
 	RequestID                   string
 	EntityID                    string
+
+	// NameIdFormat is the requested NAME_ID_FORMAT_*, transient by default
+	NameIdFormat string
 }
 
 func NewRequest(input SSAMLRequestInput) AuthnRequest {
+	if len(input.NameIdFormat) == 0 {
+		input.NameIdFormat = NAME_ID_FORMAT_TRANSIENT
+	}
 	nowStr := timeutils.IsoTime(time.Now().UTC())
 	req := AuthnRequest{
 		XMLName: xml.Name{
@@ -56,9 +63,59 @@ func NewRequest(input SSAMLRequestInput) AuthnRequest {
 				Local: "NameIDPolicy",
 			},
 			AllowCreate: "true",
-			Format:      NAME_ID_FORMAT_TRANSIENT,
+			Format:      input.NameIdFormat,
 			// SPNameQualifier: input.EntityID,
 		},
 	}
 	return req
 }
+
+// AuthnRequestRedirectUrl returns the URL sending req to its destination
+// over the HTTP-Redirect binding, with a detached signature
+func (saml *SSAMLInstance) AuthnRequestRedirectUrl(req AuthnRequest, relayState string) (string, error) {
+	req.Signature = nil
+	msg, err := xml.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "xml.Marshal")
+	}
+	return saml.redirectBindingUrl(req.Destination, PARAM_SAML_REQUEST, msg, relayState)
+}
+
+// VerifyAuthnRequest parses an AuthnRequest received over the HTTP-Redirect
+// or HTTP-POST binding and checks its signature with the signing
+// certificates of the SP metadata
+func VerifyAuthnRequest(msg *SSAMLBindingMessage, spMetadata EntityDescriptor) (*AuthnRequest, error) {
+	if !msg.IsRequest() {
+		return nil, errors.Wrapf(errors.ErrInvalidFormat, "expect %s, got %s", PARAM_SAML_REQUEST, msg.Param)
+	}
+	certs, err := spMetadata.GetSigningCertificates()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSigningCertificates")
+	}
+	req := AuthnRequest{}
+	err = xml.Unmarshal(msg.Message, &req)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal AuthnRequest")
+	}
+	if req.Signature != nil {
+		signed, err := verifyXMLSignature(certs, string(msg.Message), req.Signature, "AuthnRequest", req.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "verifyXMLSignature")
+		}
+		req = AuthnRequest{}
+		err = xml.Unmarshal([]byte(signed), &req)
+		if err != nil {
+			return nil, errors.Wrap(err, "xml.Unmarshal signed AuthnRequest")
+		}
+	} else if msg.Binding == BINDING_HTTP_REDIRECT {
+		if err := msg.VerifySignature(certs); err != nil {
+			return nil, errors.Wrap(err, "VerifySignature")
+		}
+	} else {
+		return nil, errors.Wrapf(ErrSAMLSignatureMissing, "%s binding", msg.Binding)
+	}
+	if err := checkIssuer(req.Issuer, spMetadata.EntityId); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
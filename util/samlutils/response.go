@@ -122,101 +122,7 @@ func NewResponse(input SSAMLResponseInput) Response {
 			Version:      SAML2_VERSION,
 			IssueInstant: now,
 			Issuer:       issuer,
-			Signature: &Signature{
-				XMLName: xml.Name{
-					Space: XMLNS_DS,
-					Local: "Signature",
-				},
-				SignedInfo: SignedInfo{
-					XMLName: xml.Name{
-						Space: XMLNS_DS,
-						Local: "SignedInfo",
-					},
-					CanonicalizationMethod: EncryptionMethod{
-						XMLName: xml.Name{
-							Space: XMLNS_DS,
-							Local: "CanonicalizationMethod",
-						},
-						Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#",
-					},
-					SignatureMethod: EncryptionMethod{
-						XMLName: xml.Name{
-							Space: XMLNS_DS,
-							Local: "SignatureMethod",
-						},
-						Algorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
-					},
-					Reference: Reference{
-						XMLName: xml.Name{
-							Space: XMLNS_DS,
-							Local: "Reference",
-						},
-						URI: "#" + assertId,
-						Transforms: Transforms{
-							XMLName: xml.Name{
-								Space: XMLNS_DS,
-								Local: "Transforms",
-							},
-							Transforms: []EncryptionMethod{
-								{
-									XMLName: xml.Name{
-										Space: XMLNS_DS,
-										Local: "Transform",
-									},
-									Algorithm: "http://www.w3.org/2000/09/xmldsig#enveloped-signature",
-								},
-								{
-									XMLName: xml.Name{
-										Space: XMLNS_DS,
-										Local: "Transform",
-									},
-									Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#",
-								},
-							},
-						},
-						DigestMethod: EncryptionMethod{
-							XMLName: xml.Name{
-								Space: XMLNS_DS,
-								Local: "DigestMethod",
-							},
-							Algorithm: "http://www.w3.org/2001/04/xmlenc#sha256",
-						},
-						DigestValue: SSAMLValue{
-							XMLName: xml.Name{
-								Space: XMLNS_DS,
-								Local: "DigestValue",
-							},
-							Value: "",
-						},
-					},
-				},
-				SignatureValue: SSAMLValue{
-					XMLName: xml.Name{
-						Space: XMLNS_DS,
-						Local: "SignatureValue",
-					},
-					Value: "",
-				},
-				KeyInfo: KeyInfo{
-					XMLName: xml.Name{
-						Space: XMLNS_DS,
-						Local: "KeyInfo",
-					},
-					X509Data: &X509Data{
-						XMLName: xml.Name{
-							Space: XMLNS_DS,
-							Local: "X509Data",
-						},
-						X509Certificate: X509Certificate{
-							XMLName: xml.Name{
-								Space: XMLNS_DS,
-								Local: "X509Certificate",
-							},
-							Cert: input.IssuerCertString,
-						},
-					},
-				},
-			},
+			Signature:    newSignature(assertId, input.IssuerCertString),
 			Subject: Subject{
 				XMLName: xml.Name{
 					Space: XMLNS_ASSERT,
@@ -236,7 +142,7 @@ func NewResponse(input SSAMLResponseInput) Response {
 						Space: XMLNS_ASSERT,
 						Local: "SubjectConfirmation",
 					},
-					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+					Method: SUBJECT_CONFIRMATION_METHOD_BEARER,
 					SubjectConfirmationData: SubjectConfirmationData{
 						XMLName: xml.Name{
 							Space: XMLNS_ASSERT,
@@ -296,6 +202,11 @@ func NewResponse(input SSAMLResponseInput) Response {
 		},
 	}
 
+	if input.NameIdFormat == NAME_ID_FORMAT_PERSISTENT && len(input.RequestEntityId) > 0 {
+		// a persistent identifier is only meaningful to the SP it is issued to
+		resp.Assertion.Subject.NameID.SPNameQualifier = &input.RequestEntityId
+	}
+
 	if len(input.AudienceRestriction) > 0 {
 		resp.AddAudienceRestriction(input.AudienceRestriction)
 	}
@@ -337,19 +248,23 @@ func (r *Response) AddAttribute(name string, friendlyName string, nameFormat str
 	r.Assertion.AttributeStatement.Attributes = append(r.Assertion.AttributeStatement.Attributes, attr)
 }
 
-func (r *Response) AddAudienceRestriction(value string) {
+// AddAudienceRestriction adds an AudienceRestriction satisfied by any of
+// the audiences
+func (r *Response) AddAudienceRestriction(values ...string) {
 	restrict := AudienceRestriction{
 		XMLName: xml.Name{
 			Space: XMLNS_ASSERT,
 			Local: "AudienceRestriction",
 		},
-		Audience: Audience{
+	}
+	for _, value := range values {
+		restrict.Audiences = append(restrict.Audiences, Audience{
 			XMLName: xml.Name{
 				Space: XMLNS_ASSERT,
 				Local: "Audience",
 			},
 			Value: value,
-		},
+		})
 	}
 	r.Assertion.Conditions.AudienceRestrictions = append(r.Assertion.Conditions.AudienceRestrictions, restrict)
 }
@@ -361,21 +276,28 @@ func (saml *SSAMLInstance) UnmarshalResponse(xmlText []byte) (*Response, error)
 		return nil, errors.Wrap(err, "xml.Unmarshal response")
 	}
 	if resp.EncryptedAssertion != nil {
-		asserText, err := resp.EncryptedAssertion.EncryptedData.decryptData(saml.privateKey)
+		assertion, _, err := saml.decryptAssertion(resp.EncryptedAssertion)
 		if err != nil {
-			return nil, errors.Wrap(err, "EncryptedAssertion.EncryptedData.decryptData")
+			return nil, errors.Wrap(err, "decryptAssertion")
 		}
+		resp.Assertion = assertion
+	}
 
-		assertion := Assertion{}
-		err = xml.Unmarshal(asserText, &assertion)
-		if err != nil {
-			return nil, errors.Wrap(err, "xml.Unmarshal assertion")
-		}
+	return &resp, nil
+}
 
-		resp.Assertion = &assertion
+func (saml *SSAMLInstance) decryptAssertion(encrypted *EncryptedAssertion) (*Assertion, []byte, error) {
+	asserText, err := encrypted.EncryptedData.decryptData(saml.privateKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "EncryptedAssertion.EncryptedData.decryptData")
 	}
 
-	return &resp, nil
+	assertion := Assertion{}
+	err = xml.Unmarshal(asserText, &assertion)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "xml.Unmarshal assertion")
+	}
+	return &assertion, asserText, nil
 }
 
 func (samlResp Response) FetchAttribtues() map[string][]string {
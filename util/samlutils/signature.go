@@ -0,0 +1,196 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"strings"
+
+	"github.com/ma314smith/signedxml"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// newSignature returns the enveloped signature template of the element of
+// ID refId, to be filled by SignXML
+func newSignature(refId string, certString string) *Signature {
+	return &Signature{
+		XMLName: xml.Name{
+			Space: XMLNS_DS,
+			Local: "Signature",
+		},
+		SignedInfo: SignedInfo{
+			XMLName: xml.Name{
+				Space: XMLNS_DS,
+				Local: "SignedInfo",
+			},
+			CanonicalizationMethod: EncryptionMethod{
+				XMLName: xml.Name{
+					Space: XMLNS_DS,
+					Local: "CanonicalizationMethod",
+				},
+				Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#",
+			},
+			SignatureMethod: EncryptionMethod{
+				XMLName: xml.Name{
+					Space: XMLNS_DS,
+					Local: "SignatureMethod",
+				},
+				Algorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			},
+			Reference: Reference{
+				XMLName: xml.Name{
+					Space: XMLNS_DS,
+					Local: "Reference",
+				},
+				URI: "#" + refId,
+				Transforms: Transforms{
+					XMLName: xml.Name{
+						Space: XMLNS_DS,
+						Local: "Transforms",
+					},
+					Transforms: []EncryptionMethod{
+						{
+							XMLName: xml.Name{
+								Space: XMLNS_DS,
+								Local: "Transform",
+							},
+							Algorithm: "http://www.w3.org/2000/09/xmldsig#enveloped-signature",
+						},
+						{
+							XMLName: xml.Name{
+								Space: XMLNS_DS,
+								Local: "Transform",
+							},
+							Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#",
+						},
+					},
+				},
+				DigestMethod: EncryptionMethod{
+					XMLName: xml.Name{
+						Space: XMLNS_DS,
+						Local: "DigestMethod",
+					},
+					Algorithm: "http://www.w3.org/2001/04/xmlenc#sha256",
+				},
+				DigestValue: SSAMLValue{
+					XMLName: xml.Name{
+						Space: XMLNS_DS,
+						Local: "DigestValue",
+					},
+					Value: "",
+				},
+			},
+		},
+		SignatureValue: SSAMLValue{
+			XMLName: xml.Name{
+				Space: XMLNS_DS,
+				Local: "SignatureValue",
+			},
+			Value: "",
+		},
+		KeyInfo: KeyInfo{
+			XMLName: xml.Name{
+				Space: XMLNS_DS,
+				Local: "KeyInfo",
+			},
+			X509Data: &X509Data{
+				XMLName: xml.Name{
+					Space: XMLNS_DS,
+					Local: "X509Data",
+				},
+				X509Certificate: X509Certificate{
+					XMLName: xml.Name{
+						Space: XMLNS_DS,
+						Local: "X509Certificate",
+					},
+					Cert: certString,
+				},
+			},
+		},
+	}
+}
+
+// verifyXMLSignature checks that sig signs the element name of ID id in
+// xmlText with one of certs, and returns the signed element
+func verifyXMLSignature(certs []x509.Certificate, xmlText string, sig *Signature, name string, id string) (string, error) {
+	if sig.SignedInfo.Reference.URI != "#"+id {
+		return "", errors.Wrapf(ErrSAMLSignatureInvalid, "signature references %s instead of %s", sig.SignedInfo.Reference.URI, id)
+	}
+	if sig.KeyInfo.X509Data != nil && len(sig.KeyInfo.X509Data.X509Certificate.Cert) > 0 {
+		cert, err := parseCertString(sig.KeyInfo.X509Data.X509Certificate.Cert)
+		if err != nil {
+			return "", errors.Wrapf(ErrSAMLUntrustedCert, "invalid certificate: %s", err)
+		}
+		if !isTrustedCert(certs, cert) {
+			return "", errors.Wrapf(ErrSAMLUntrustedCert, "certificate %s not in metadata", cert.Subject)
+		}
+	}
+
+	validator, err := signedxml.NewValidator(xmlText)
+	if err != nil {
+		return "", errors.Wrap(err, "signedxml.NewValidator")
+	}
+	validator.Certificates = certs
+	refs, err := validator.ValidateReferences()
+	if err != nil {
+		return "", errors.Wrap(ErrSAMLSignatureInvalid, err.Error())
+	}
+	if len(refs) != 1 {
+		return "", errors.Wrapf(ErrSAMLSignatureInvalid, "expect exactly 1 signed reference, got %d", len(refs))
+	}
+	if err := checkSignedElement(refs[0], name, id); err != nil {
+		return "", err
+	}
+	return refs[0], nil
+}
+
+// checkSignedElement checks that the signed content is the element name of
+// ID id, so that a signature over another element is not accepted
+func checkSignedElement(signed string, name string, id string) error {
+	decoder := xml.NewDecoder(strings.NewReader(signed))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return errors.Wrapf(ErrSAMLSignatureInvalid, "invalid signed content: %s", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != name {
+			return errors.Wrapf(ErrSAMLSignatureInvalid, "signed element %s, expect %s", start.Name.Local, name)
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Space == "" && attr.Name.Local == "ID" {
+				if attr.Value != id {
+					return errors.Wrapf(ErrSAMLSignatureInvalid, "signed element ID %s, expect %s", attr.Value, id)
+				}
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrSAMLSignatureInvalid, "signed element %s without ID", name)
+	}
+}
+
+func isTrustedCert(certs []x509.Certificate, cert *x509.Certificate) bool {
+	for i := range certs {
+		if certs[i].Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
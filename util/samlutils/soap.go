@@ -0,0 +1,146 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	SOAP_ACTION_SAML = "http://www.oasis-open.org/committees/security"
+
+	soapEnvelopeHead = `<soap-env:Envelope xmlns:soap-env="` + XMLNS_SOAP + `"><soap-env:Body>`
+	soapEnvelopeTail = `</soap-env:Body></soap-env:Envelope>`
+)
+
+// soapEnvelope wraps the XML of a message into a SOAP 1.1 envelope
+func soapEnvelope(msg []byte) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString(soapEnvelopeHead)
+	buf.Write(msg)
+	buf.WriteString(soapEnvelopeTail)
+	return buf.Bytes()
+}
+
+// parseSoapBody returns the raw XML of the message in the Body of a SOAP
+// envelope
+func parseSoapBody(data []byte) ([]byte, error) {
+	body, err := rawChildElement(data, "Header")
+	if err != nil {
+		return nil, errors.Wrap(err, "Envelope")
+	}
+	if body == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no SOAP Body")
+	}
+	msg, err := rawChildElement(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Body")
+	}
+	if msg == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "empty SOAP Body")
+	}
+	return msg, nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if len(name.Space) == 0 {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// rawChildElement returns the original text of the first child element of
+// the root element of data whose local name is not one of skip, or nil if
+// there is none. The namespaces declared by the root element are copied to
+// the returned element, so that it can be parsed and verified on its own.
+func rawChildElement(data []byte, skip ...string) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	nsAttrs := make([]xml.Attr, 0)
+	var start int64
+	var child *xml.StartElement
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "RawToken")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1:
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" || (len(attr.Name.Space) == 0 && attr.Name.Local == "xmlns") {
+						nsAttrs = append(nsAttrs, attr)
+					}
+				}
+			case depth == 2 && child == nil:
+				skipped := false
+				for _, name := range skip {
+					if t.Name.Local == name {
+						skipped = true
+						break
+					}
+				}
+				if !skipped {
+					start = offset
+					t = t.Copy()
+					child = &t
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 1 && child != nil {
+				raw := data[start:dec.InputOffset()]
+				return addNamespaceAttrs(raw, child, nsAttrs), nil
+			}
+			if depth == 0 {
+				return nil, nil
+			}
+		}
+	}
+}
+
+// addNamespaceAttrs inserts into the start tag of raw the namespace
+// declarations of nsAttrs that elem does not redeclare
+func addNamespaceAttrs(raw []byte, elem *xml.StartElement, nsAttrs []xml.Attr) []byte {
+	declared := make(map[xml.Name]bool)
+	for _, attr := range elem.Attr {
+		declared[attr.Name] = true
+	}
+	buf := bytes.Buffer{}
+	pos := 1 + len(qualifiedName(elem.Name))
+	buf.Write(raw[:pos])
+	for _, attr := range nsAttrs {
+		if declared[attr.Name] {
+			continue
+		}
+		buf.WriteString(" ")
+		buf.WriteString(qualifiedName(attr.Name))
+		buf.WriteString(`="`)
+		xml.EscapeText(&buf, []byte(attr.Value))
+		buf.WriteString(`"`)
+	}
+	buf.Write(raw[pos:])
+	return buf.Bytes()
+}
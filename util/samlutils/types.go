@@ -109,6 +109,7 @@ type EncryptionMethod struct {
 	Algorithm string `xml:"Algorithm,attr"`
 
 	DigestMethod *DigestMethod `xml:"DigestMethod"`
+	MGF          *DigestMethod `xml:"MGF"`
 }
 
 type KeyDescriptor struct {
@@ -229,7 +230,9 @@ type EntityDescriptor struct {
 	XMLName xml.Name
 
 	// Id *string `xml:"ID,attr"`
-	EntityId string `xml:"entityID,attr"`
+	EntityId      string  `xml:"entityID,attr"`
+	ValidUntil    *string `xml:"validUntil,attr"`
+	CacheDuration *string `xml:"cacheDuration,attr"`
 
 	Extensions *Extensions `xml:"Extensions"`
 	Signature  *Signature  `xml:"Signature"`
@@ -240,6 +243,21 @@ type EntityDescriptor struct {
 	Organization *Organization `xml:"Organization"`
 }
 
+type EntitiesDescriptor struct {
+	XMLName xml.Name
+
+	ID            *string `xml:"ID,attr"`
+	Name          *string `xml:"Name,attr"`
+	ValidUntil    *string `xml:"validUntil,attr"`
+	CacheDuration *string `xml:"cacheDuration,attr"`
+
+	Signature  *Signature  `xml:"Signature"`
+	Extensions *Extensions `xml:"Extensions"`
+
+	EntitiesDescriptors []EntitiesDescriptor `xml:"EntitiesDescriptor"`
+	EntityDescriptors   []EntityDescriptor   `xml:"EntityDescriptor"`
+}
+
 func (ed EntityDescriptor) String() string {
 	str, _ := xml.MarshalIndent(ed, "", "  ")
 	return string(str)
@@ -289,6 +307,7 @@ type AuthnRequest struct {
 	Version                     string `xml:"Version,attr"`
 
 	Issuer       Issuer       `xml:"Issuer"`
+	Signature    *Signature   `xml:"Signature"`
 	NameIDPolicy NameIDPolicy `xml:"NameIDPolicy"`
 }
 
@@ -320,8 +339,9 @@ type Response struct {
 	IssueInstant string  `xml:"IssueInstant,attr"`
 	Destination  string  `xml:"Destination,attr"`
 
-	Issuer Issuer `xml:"Issuer"`
-	Status Status `xml:"Status"`
+	Issuer    Issuer     `xml:"Issuer"`
+	Signature *Signature `xml:"Signature"`
+	Status    Status     `xml:"Status"`
 
 	Assertion          *Assertion          `xml:"Assertion"`
 	EncryptedAssertion *EncryptedAssertion `xml:"EncryptedAssertion"`
@@ -353,8 +373,9 @@ type Subject struct {
 type NameID struct {
 	XMLName xml.Name
 
-	Format        string  `xml:"Format,attr"`
-	NameQualifier *string `xml:"NameQualifier,attr"`
+	Format          string  `xml:"Format,attr"`
+	NameQualifier   *string `xml:"NameQualifier,attr"`
+	SPNameQualifier *string `xml:"SPNameQualifier,attr"`
 
 	Value string `xml:",innerxml"`
 }
@@ -388,7 +409,9 @@ type Conditions struct {
 type AudienceRestriction struct {
 	XMLName xml.Name
 
-	Audience Audience `xml:"Audience"`
+	// Audiences replaces the former single Audience field, a restriction
+	// is satisfied by any of them
+	Audiences []Audience `xml:"Audience"`
 }
 
 type Audience struct {
@@ -486,10 +509,76 @@ type CipherValue struct {
 type EncryptedKey struct {
 	XMLName xml.Name
 
-	Id        string `xml:"Id,attr"`
-	Recipient string `xml:"Recipient,attr"`
+	Id        string `xml:"Id,attr,omitempty"`
+	Recipient string `xml:"Recipient,attr,omitempty"`
 
 	EncryptionMethod EncryptionMethod `xml:"EncryptionMethod"`
 	KeyInfo          KeyInfo          `xml:"KeyInfo"`
 	CipherData       CipherData       `xml:"CipherData"`
 }
+
+type SessionIndex struct {
+	XMLName xml.Name
+
+	Index string `xml:",innerxml"`
+}
+
+type LogoutRequest struct {
+	XMLName xml.Name
+
+	ID           string  `xml:"ID,attr"`
+	Version      string  `xml:"Version,attr"`
+	IssueInstant string  `xml:"IssueInstant,attr"`
+	Destination  string  `xml:"Destination,attr"`
+	NotOnOrAfter *string `xml:"NotOnOrAfter,attr"`
+	Reason       *string `xml:"Reason,attr"`
+
+	Issuer         Issuer         `xml:"Issuer"`
+	Signature      *Signature     `xml:"Signature"`
+	NameID         NameID         `xml:"NameID"`
+	SessionIndexes []SessionIndex `xml:"SessionIndex"`
+}
+
+type LogoutResponse struct {
+	XMLName xml.Name
+
+	ID           string  `xml:"ID,attr"`
+	InResponseTo *string `xml:"InResponseTo,attr"`
+	Version      string  `xml:"Version,attr"`
+	IssueInstant string  `xml:"IssueInstant,attr"`
+	Destination  string  `xml:"Destination,attr"`
+
+	Issuer    Issuer     `xml:"Issuer"`
+	Signature *Signature `xml:"Signature"`
+	Status    Status     `xml:"Status"`
+}
+
+type ArtifactResolve struct {
+	XMLName xml.Name
+
+	ID           string `xml:"ID,attr"`
+	Version      string `xml:"Version,attr"`
+	IssueInstant string `xml:"IssueInstant,attr"`
+	Destination  string `xml:"Destination,attr,omitempty"`
+
+	Issuer    Issuer     `xml:"Issuer"`
+	Signature *Signature `xml:"Signature"`
+	Artifact  SSAMLValue `xml:"Artifact"`
+}
+
+type ArtifactResponse struct {
+	XMLName xml.Name
+
+	ID           string  `xml:"ID,attr"`
+	InResponseTo *string `xml:"InResponseTo,attr"`
+	Version      string  `xml:"Version,attr"`
+	IssueInstant string  `xml:"IssueInstant,attr"`
+
+	Issuer    Issuer     `xml:"Issuer"`
+	Signature *Signature `xml:"Signature"`
+	Status    Status     `xml:"Status"`
+
+	// Message is the raw XML of the resolved protocol message, empty if
+	// the artifact is unknown
+	Message []byte `xml:",innerxml"`
+}
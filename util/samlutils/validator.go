@@ -0,0 +1,470 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"sync"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/cache"
+	"yunion.io/x/pkg/util/clock"
+)
+
+const (
+	DefaultClockSkew  = 3 * time.Minute
+	DefaultRequestTTL = 10 * time.Minute
+	DefaultReplayTTL  = time.Hour
+)
+
+type SSAMLResponseValidatorInput struct {
+	// IdpMetadata is the EntityDescriptor of the trusted IdP, the assertions
+	// must be signed with the cert of one of its signing KeyDescriptors
+	IdpMetadata EntityDescriptor
+
+	// SpEntityId is the expected audience of the assertions
+	SpEntityId string
+	// AssertionConsumerServiceURL is the expected recipient, not checked if empty
+	AssertionConsumerServiceURL string
+
+	// SAML decrypts the encrypted assertions, may be nil if the IdP does not
+	// encrypt assertions
+	SAML *SSAMLInstance
+
+	// ClockSkew is the tolerated clock difference with the IdP
+	ClockSkew time.Duration
+	// RequestTTL is how long an issued AuthnRequest ID remains acceptable
+	RequestTTL time.Duration
+	// ReplayTTL is how long the consumed assertion IDs are remembered at
+	// least, an ID is kept until the assertion expires if later
+	ReplayTTL time.Duration
+
+	// AllowIdpInitiated accepts unsolicited responses without InResponseTo
+	AllowIdpInitiated bool
+}
+
+// SSAMLResponseValidator performs the SP-side validation of the responses
+// of an IdP: signature against the IdP metadata, issuer, status, time window,
+// audience, recipient, InResponseTo and assertion replay.
+type SSAMLResponseValidator struct {
+	idpEntityId string
+	certs       []x509.Certificate
+
+	spEntityId string
+	acsUrl     string
+
+	saml *SSAMLInstance
+
+	clockSkew         time.Duration
+	allowIdpInitiated bool
+
+	clock        clock.Clock
+	requestIds   *sIdCache
+	assertionIds *sIdCache
+}
+
+type sIdEntry struct {
+	id     string
+	expire time.Time
+}
+
+func idEntryKeyFunc(obj interface{}) (string, error) {
+	return obj.(*sIdEntry).id, nil
+}
+
+// sIdCache remembers the IDs of the issued requests or the accepted
+// messages until they expire, at least for ttl. The checks and updates are
+// atomic so that an ID is accepted only once by concurrent validations
+type sIdCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	store     cache.Store
+	nextPurge time.Time
+}
+
+func newIdCache(ttl time.Duration) *sIdCache {
+	return &sIdCache{
+		ttl:   ttl,
+		store: cache.NewStore(idEntryKeyFunc),
+	}
+}
+
+// Add adds the id, which expires after ttl
+func (c *sIdCache) Add(id string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.purge(now)
+	c.store.Add(&sIdEntry{id: id, expire: now.Add(c.ttl)})
+}
+
+// CheckAndAdd adds the id until expire, or ttl if later, and returns true
+// if it has not been seen
+func (c *sIdCache) CheckAndAdd(id string, now time.Time, expire time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.purge(now)
+	if c.exists(id, now) {
+		return false
+	}
+	if min := now.Add(c.ttl); expire.Before(min) {
+		expire = min
+	}
+	c.store.Add(&sIdEntry{id: id, expire: expire})
+	return true
+}
+
+// Take removes the id and returns true if it is present
+func (c *sIdCache) Take(id string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.exists(id, now) {
+		return false
+	}
+	c.store.Delete(&sIdEntry{id: id})
+	return true
+}
+
+func (c *sIdCache) exists(id string, now time.Time) bool {
+	obj, exist, _ := c.store.GetByKey(id)
+	return exist && now.Before(obj.(*sIdEntry).expire)
+}
+
+// purge drops the expired ids, at most once per ttl
+func (c *sIdCache) purge(now time.Time) {
+	if now.Before(c.nextPurge) {
+		return
+	}
+	for _, obj := range c.store.List() {
+		if entry := obj.(*sIdEntry); !now.Before(entry.expire) {
+			c.store.Delete(entry)
+		}
+	}
+	c.nextPurge = now.Add(c.ttl)
+}
+
+// GetSigningCertificates returns the certificates of the KeyDescriptors of
+// the SSO descriptor whose use is signing or unspecified.
+func (desc *SSODescriptor) GetSigningCertificates() ([]x509.Certificate, error) {
+	certs := make([]x509.Certificate, 0)
+	for _, kd := range desc.KeyDescriptors {
+		if len(kd.Use) > 0 && kd.Use != KEY_USE_SIGNING {
+			continue
+		}
+		if kd.KeyInfo.X509Data == nil {
+			continue
+		}
+		cert, err := parseCertString(kd.KeyInfo.X509Data.X509Certificate.Cert)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseCertString")
+		}
+		certs = append(certs, *cert)
+	}
+	return certs, nil
+}
+
+// GetSigningCertificates returns the signing certificates of both the IdP
+// and the SP descriptors of the entity.
+func (ed *EntityDescriptor) GetSigningCertificates() ([]x509.Certificate, error) {
+	certs := make([]x509.Certificate, 0)
+	for _, desc := range []*SSODescriptor{ed.IDPSSODescriptor, ed.SPSSODescriptor} {
+		if desc == nil {
+			continue
+		}
+		descCerts, err := desc.GetSigningCertificates()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, descCerts...)
+	}
+	return certs, nil
+}
+
+func parseCertString(certStr string) (*x509.Certificate, error) {
+	certStr = strings.Join(strings.Fields(certStr), "")
+	der, err := base64.StdEncoding.DecodeString(certStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "base64.StdEncoding.DecodeString")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "x509.ParseCertificate")
+	}
+	return cert, nil
+}
+
+func NewResponseValidator(input SSAMLResponseValidatorInput) (*SSAMLResponseValidator, error) {
+	if input.IdpMetadata.IDPSSODescriptor == nil {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no IDPSSODescriptor in IdP metadata")
+	}
+	certs, err := input.IdpMetadata.IDPSSODescriptor.GetSigningCertificates()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSigningCertificates")
+	}
+	if len(certs) == 0 {
+		return nil, errors.Wrap(errors.ErrInvalidFormat, "no signing certificate in IdP metadata")
+	}
+	if input.ClockSkew <= 0 {
+		input.ClockSkew = DefaultClockSkew
+	}
+	if input.RequestTTL <= 0 {
+		input.RequestTTL = DefaultRequestTTL
+	}
+	if input.ReplayTTL <= 0 {
+		input.ReplayTTL = DefaultReplayTTL
+	}
+	return &SSAMLResponseValidator{
+		idpEntityId: input.IdpMetadata.EntityId,
+		certs:       certs,
+
+		spEntityId: input.SpEntityId,
+		acsUrl:     input.AssertionConsumerServiceURL,
+
+		saml: input.SAML,
+
+		clockSkew:         input.ClockSkew,
+		allowIdpInitiated: input.AllowIdpInitiated,
+
+		clock:        clock.RealClock{},
+		requestIds:   newIdCache(input.RequestTTL),
+		assertionIds: newIdCache(input.ReplayTTL),
+	}, nil
+}
+
+// AddRequestId registers the ID of an issued AuthnRequest, so that the
+// response to it is accepted.
+func (v *SSAMLResponseValidator) AddRequestId(reqId string) {
+	v.requestIds.Add(reqId, v.clock.Now())
+}
+
+// ValidateResponse parses and validates a SAML response. The returned
+// Response only contains the signed content, with the encrypted assertion
+// decrypted. The errors can be classified with errors.Cause.
+func (v *SSAMLResponseValidator) ValidateResponse(xmlText []byte) (*Response, error) {
+	resp := Response{}
+	err := xml.Unmarshal(xmlText, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal response")
+	}
+
+	responseSigned := false
+	if resp.Signature != nil {
+		signed, err := verifyXMLSignature(v.certs, string(xmlText), resp.Signature, "Response", resp.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "response")
+		}
+		resp = Response{}
+		err = xml.Unmarshal([]byte(signed), &resp)
+		if err != nil {
+			return nil, errors.Wrap(err, "xml.Unmarshal signed response")
+		}
+		responseSigned = true
+	}
+
+	if !resp.IsSuccess() {
+		return nil, errors.Wrapf(ErrSAMLStatus, "status %s", resp.Status.StatusCode.Value)
+	}
+	// the Issuer of a Response is optional
+	if err := checkIssuer(resp.Issuer, v.idpEntityId); err != nil {
+		return nil, errors.Wrap(err, "response")
+	}
+
+	assertion := resp.Assertion
+	assertText := xmlText
+	if resp.EncryptedAssertion != nil {
+		if v.saml == nil {
+			return nil, errors.Wrap(ErrSAMLNoAssertion, "no key to decrypt EncryptedAssertion")
+		}
+		assertion, assertText, err = v.saml.decryptAssertion(resp.EncryptedAssertion)
+		if err != nil {
+			return nil, errors.Wrap(err, "decryptAssertion")
+		}
+	}
+	if assertion == nil {
+		return nil, ErrSAMLNoAssertion
+	}
+
+	if assertion.Signature != nil && !responseSigned {
+		signed, err := verifyXMLSignature(v.certs, string(assertText), assertion.Signature, "Assertion", assertion.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "assertion")
+		}
+		assertion = &Assertion{}
+		err = xml.Unmarshal([]byte(signed), assertion)
+		if err != nil {
+			return nil, errors.Wrap(err, "xml.Unmarshal signed assertion")
+		}
+	} else if !responseSigned {
+		return nil, ErrSAMLSignatureMissing
+	}
+	resp.Assertion = assertion
+	resp.EncryptedAssertion = nil
+
+	if err := v.checkAssertion(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func checkIssuer(issuer Issuer, entityId string) error {
+	iss := strings.TrimSpace(issuer.Issuer)
+	if len(iss) > 0 && iss != entityId {
+		return errors.Wrapf(ErrSAMLIssuer, "issuer %s, expect %s", iss, entityId)
+	}
+	return nil
+}
+
+// checkRequiredIssuer is checkIssuer for the elements that must carry an
+// Issuer, e.g. Assertion
+func checkRequiredIssuer(issuer Issuer, entityId string) error {
+	if len(strings.TrimSpace(issuer.Issuer)) == 0 {
+		return errors.Wrapf(ErrSAMLIssuer, "no issuer, expect %s", entityId)
+	}
+	return checkIssuer(issuer, entityId)
+}
+
+// checkAudience checks that any Audience of restrict is the entity
+func checkAudience(restrict AudienceRestriction, entityId string) error {
+	audiences := make([]string, 0, len(restrict.Audiences))
+	for _, audience := range restrict.Audiences {
+		aud := strings.TrimSpace(audience.Value)
+		if aud == entityId {
+			return nil
+		}
+		audiences = append(audiences, aud)
+	}
+	return errors.Wrapf(ErrSAMLAudience, "audiences %s, expect %s", strings.Join(audiences, ","), entityId)
+}
+
+// expireTime returns when a message valid until notOnOrAfter can no longer
+// be accepted, zero if notOnOrAfter is empty or invalid
+func expireTime(notOnOrAfter string, clockSkew time.Duration) time.Time {
+	tm, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+	if err != nil {
+		return time.Time{}
+	}
+	return tm.Add(clockSkew)
+}
+
+func checkTimeWindow(now time.Time, clockSkew time.Duration, notBefore *string, notOnOrAfter string) error {
+	if notBefore != nil && len(*notBefore) > 0 {
+		tm, err := time.Parse(time.RFC3339Nano, *notBefore)
+		if err != nil {
+			return errors.Wrapf(err, "invalid NotBefore %s", *notBefore)
+		}
+		if now.Add(clockSkew).Before(tm) {
+			return errors.Wrapf(ErrSAMLNotYetValid, "not before %s", *notBefore)
+		}
+	}
+	if len(notOnOrAfter) > 0 {
+		tm, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+		if err != nil {
+			return errors.Wrapf(err, "invalid NotOnOrAfter %s", notOnOrAfter)
+		}
+		if !now.Add(-clockSkew).Before(tm) {
+			return errors.Wrapf(ErrSAMLExpired, "not on or after %s", notOnOrAfter)
+		}
+	}
+	return nil
+}
+
+func (v *SSAMLResponseValidator) checkAssertion(resp *Response) error {
+	assertion := resp.Assertion
+	if err := checkRequiredIssuer(assertion.Issuer, v.idpEntityId); err != nil {
+		return errors.Wrap(err, "assertion")
+	}
+
+	now := v.clock.Now()
+	cond := assertion.Conditions
+	if err := checkTimeWindow(now, v.clockSkew, cond.NotBefore, cond.NotOnOrAfter); err != nil {
+		return errors.Wrap(err, "Conditions")
+	}
+	confirmation := assertion.Subject.SubjectConfirmation
+	confirmData := confirmation.SubjectConfirmationData
+	if confirmation.Method == SUBJECT_CONFIRMATION_METHOD_BEARER && len(confirmData.NotOnOrAfter) == 0 {
+		// a bearer assertion without expiry could be replayed forever
+		return errors.Wrap(ErrSAMLExpired, "bearer SubjectConfirmationData without NotOnOrAfter")
+	}
+	if err := checkTimeWindow(now, v.clockSkew, confirmData.NotBefore, confirmData.NotOnOrAfter); err != nil {
+		return errors.Wrap(err, "SubjectConfirmationData")
+	}
+
+	// every AudienceRestriction must contain the SP
+	if len(cond.AudienceRestrictions) == 0 {
+		return errors.Wrap(ErrSAMLAudience, "no AudienceRestriction")
+	}
+	for _, restrict := range cond.AudienceRestrictions {
+		if err := checkAudience(restrict, v.spEntityId); err != nil {
+			return err
+		}
+	}
+
+	if len(v.acsUrl) > 0 {
+		if len(confirmData.Recipient) > 0 && confirmData.Recipient != v.acsUrl {
+			return errors.Wrapf(ErrSAMLRecipient, "recipient %s, expect %s", confirmData.Recipient, v.acsUrl)
+		}
+		if len(resp.Destination) > 0 && resp.Destination != v.acsUrl {
+			return errors.Wrapf(ErrSAMLRecipient, "destination %s, expect %s", resp.Destination, v.acsUrl)
+		}
+	}
+
+	if err := v.checkInResponseTo(resp.InResponseTo, confirmData.InResponseTo); err != nil {
+		return err
+	}
+
+	if len(assertion.ID) == 0 {
+		return errors.Wrap(ErrSAMLReplayedAssertion, "assertion without ID")
+	}
+	// the assertion is remembered as long as it is valid
+	expire := expireTime(cond.NotOnOrAfter, v.clockSkew)
+	if confirmExpire := expireTime(confirmData.NotOnOrAfter, v.clockSkew); confirmExpire.After(expire) {
+		expire = confirmExpire
+	}
+	if !v.assertionIds.CheckAndAdd(assertion.ID, now, expire) {
+		return errors.Wrapf(ErrSAMLReplayedAssertion, "assertion %s", assertion.ID)
+	}
+
+	return nil
+}
+
+func (v *SSAMLResponseValidator) checkInResponseTo(respTo *string, confirmTo *string) error {
+	reqId := ""
+	if respTo != nil {
+		reqId = *respTo
+	}
+	if confirmTo != nil && len(*confirmTo) > 0 {
+		if len(reqId) > 0 && reqId != *confirmTo {
+			return errors.Wrapf(ErrSAMLInResponseTo, "response in response to %s, subject confirmation to %s", reqId, *confirmTo)
+		}
+		reqId = *confirmTo
+	}
+	if len(reqId) == 0 {
+		if !v.allowIdpInitiated {
+			return errors.Wrap(ErrSAMLInResponseTo, "unsolicited response")
+		}
+		return nil
+	}
+	// each request is answered only once
+	if !v.requestIds.Take(reqId, v.clock.Now()) {
+		return errors.Wrapf(ErrSAMLInResponseTo, "unknown request %s", reqId)
+	}
+	return nil
+}
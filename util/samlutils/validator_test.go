@@ -0,0 +1,390 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samlutils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/util/clock"
+	"yunion.io/x/pkg/util/seclib"
+)
+
+const (
+	testIdpEntityId = "https://saml.yunion.io/"
+	testSpEntityId  = "https://sp.yunion.io/"
+	testAcsUrl      = "https://sp.yunion.io/saml/acs"
+)
+
+func newTestValidator(t *testing.T) *SSAMLResponseValidator {
+	idp := NewIdpMetadata(SSAMLIdpMetadataInput{
+		EntityId:   testIdpEntityId,
+		CertString: certString,
+	})
+	v, err := NewResponseValidator(SSAMLResponseValidatorInput{
+		IdpMetadata:                 idp,
+		SpEntityId:                  testSpEntityId,
+		AssertionConsumerServiceURL: testAcsUrl,
+	})
+	if err != nil {
+		t.Fatalf("NewResponseValidator: %v", err)
+	}
+	return v
+}
+
+func newTestSignedResponse(t *testing.T, reqId string, modify func(resp *Response)) []byte {
+	resp := NewResponse(SSAMLResponseInput{
+		IssuerEntityId:              testIdpEntityId,
+		RequestEntityId:             testSpEntityId,
+		RequestID:                   reqId,
+		AssertionConsumerServiceURL: testAcsUrl,
+		IssuerCertString:            certString,
+	})
+	resp.AddAudienceRestriction(testSpEntityId)
+	if modify != nil {
+		modify(&resp)
+	}
+	respXml, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatalf("xml.Marshal: %v", err)
+	}
+	privateKey, err := seclib.DecodePrivateKey([]byte(privateKeyString))
+	if err != nil {
+		t.Fatalf("DecodePrivateKey: %v", err)
+	}
+	signed, err := SignXML(string(respXml), privateKey)
+	if err != nil {
+		t.Fatalf("SignXML: %v", err)
+	}
+	return []byte(signed)
+}
+
+func TestValidateResponse(t *testing.T) {
+	v := newTestValidator(t)
+	v.AddRequestId("_req1")
+
+	signed := newTestSignedResponse(t, "_req1", nil)
+	resp, err := v.ValidateResponse(signed)
+	if err != nil {
+		t.Fatalf("ValidateResponse: %v", err)
+	}
+	if resp.Assertion == nil || resp.Assertion.Signature != nil {
+		t.Errorf("expect the signed assertion without its signature")
+	}
+
+	// the same assertion again is a replay
+	v.AddRequestId("_req1")
+	if _, err := v.ValidateResponse(signed); errors.Cause(err) != ErrSAMLReplayedAssertion {
+		t.Errorf("expect replay error, got %v", err)
+	}
+}
+
+func TestValidateResponseReplayUntilExpiry(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	v := newTestValidator(t)
+	v.clock = fakeClock
+	v.AddRequestId("_req")
+	until := fakeClock.Now().Add(3 * DefaultReplayTTL).UTC().Format(time.RFC3339)
+	signed := newTestSignedResponse(t, "_req", func(resp *Response) {
+		resp.Assertion.Conditions.NotOnOrAfter = until
+		resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter = until
+	})
+	if _, err := v.ValidateResponse(signed); err != nil {
+		t.Fatalf("ValidateResponse: %v", err)
+	}
+	// the assertion is still valid after ReplayTTL
+	fakeClock.Step(2 * DefaultReplayTTL)
+	v.AddRequestId("_req")
+	if _, err := v.ValidateResponse(signed); errors.Cause(err) != ErrSAMLReplayedAssertion {
+		t.Errorf("expect replay error, got %v", err)
+	}
+}
+
+func TestValidateResponseErrors(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	cases := []struct {
+		name   string
+		reqId  string
+		modify func(resp *Response)
+		tamper func(signed string) string
+		step   time.Duration
+		want   error
+	}{
+		{
+			name:  "unknown request",
+			reqId: "_other",
+			want:  ErrSAMLInResponseTo,
+		},
+		{
+			name:  "unsolicited",
+			reqId: "",
+			want:  ErrSAMLInResponseTo,
+		},
+		{
+			name:  "expired",
+			reqId: "_req",
+			step:  10 * time.Minute,
+			want:  ErrSAMLExpired,
+		},
+		{
+			name:  "not yet valid",
+			reqId: "_req",
+			step:  -10 * time.Minute,
+			want:  ErrSAMLNotYetValid,
+		},
+		{
+			name:  "audience",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Assertion.Conditions.AudienceRestrictions[0].Audiences[0].Value = "https://other.sp/"
+			},
+			want: ErrSAMLAudience,
+		},
+		{
+			name:  "any audience",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.AddAudienceRestriction("https://other.sp/", testSpEntityId)
+			},
+		},
+		{
+			name:  "audience in one of restrictions",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.AddAudienceRestriction("https://other.sp/")
+			},
+			want: ErrSAMLAudience,
+		},
+		{
+			name:  "bearer without NotOnOrAfter",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter = ""
+			},
+			want: ErrSAMLExpired,
+		},
+		{
+			name:  "assertion without issuer",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Assertion.Issuer.Issuer = ""
+			},
+			want: ErrSAMLIssuer,
+		},
+		{
+			name:  "response issuer",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Issuer.Issuer = "https://evil.idp/"
+			},
+			want: ErrSAMLIssuer,
+		},
+		{
+			name:  "response without issuer",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Issuer.Issuer = ""
+			},
+		},
+		{
+			name:  "recipient",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient = "https://other.sp/acs"
+			},
+			want: ErrSAMLRecipient,
+		},
+		{
+			name:  "issuer",
+			reqId: "_req",
+			modify: func(resp *Response) {
+				resp.Assertion.Issuer.Issuer = "https://evil.idp/"
+			},
+			want: ErrSAMLIssuer,
+		},
+		{
+			name:  "tampered",
+			reqId: "_req",
+			tamper: func(signed string) string {
+				return strings.Replace(signed, testSpEntityId+"</", "https://other.sp/</", 1)
+			},
+			want: ErrSAMLSignatureInvalid,
+		},
+		{
+			name:  "untrusted certificate",
+			reqId: "_req",
+			tamper: func(signed string) string {
+				start := strings.Index(signed, "<X509Certificate")
+				start += strings.Index(signed[start:], ">") + 1
+				end := strings.Index(signed, "</X509Certificate>")
+				return signed[:start] + "MIIB" + signed[end:]
+			},
+			want: ErrSAMLUntrustedCert,
+		},
+	}
+	for _, c := range cases {
+		v := newTestValidator(t)
+		v.clock = fakeClock
+		v.AddRequestId("_req")
+		signed := string(newTestSignedResponse(t, c.reqId, c.modify))
+		if c.tamper != nil {
+			signed = c.tamper(signed)
+		}
+		fakeClock.SetTime(time.Now().Add(c.step))
+		_, err := v.ValidateResponse([]byte(signed))
+		if errors.Cause(err) != c.want {
+			t.Errorf("%s: expect %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestCheckSignedElement(t *testing.T) {
+	cases := []struct {
+		signed string
+		want   error
+	}{
+		{`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_resp"></samlp:Response>`, nil},
+		{`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_resp"></saml:Assertion>`, ErrSAMLSignatureInvalid},
+		{`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_other"></samlp:Response>`, ErrSAMLSignatureInvalid},
+		{`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:Response>`, ErrSAMLSignatureInvalid},
+		{``, ErrSAMLSignatureInvalid},
+	}
+	for _, c := range cases {
+		if err := checkSignedElement(c.signed, "Response", "_resp"); errors.Cause(err) != c.want {
+			t.Errorf("%s: expect %v, got %v", c.signed, c.want, err)
+		}
+	}
+}
+
+func TestValidateResponseUnsigned(t *testing.T) {
+	v := newTestValidator(t)
+	v.AddRequestId("_req")
+	resp := NewResponse(SSAMLResponseInput{
+		IssuerEntityId:              testIdpEntityId,
+		RequestID:                   "_req",
+		AssertionConsumerServiceURL: testAcsUrl,
+	})
+	resp.Assertion.Signature = nil
+	resp.AddAudienceRestriction(testSpEntityId)
+	respXml, _ := xml.Marshal(resp)
+	if _, err := v.ValidateResponse(respXml); errors.Cause(err) != ErrSAMLSignatureMissing {
+		t.Errorf("expect missing signature, got %v", err)
+	}
+}
+
+func TestValidateResponseConcurrentReplay(t *testing.T) {
+	for _, idpInitiated := range []bool{false, true} {
+		v := newTestValidator(t)
+		reqId := "_req"
+		if idpInitiated {
+			// only the assertion ID prevents the replay
+			v.allowIdpInitiated = true
+			reqId = ""
+		} else {
+			v.AddRequestId(reqId)
+		}
+		signed := newTestSignedResponse(t, reqId, nil)
+
+		const n = 16
+		results := make(chan error, n)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := v.ValidateResponse(signed)
+				results <- err
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+		accepted := 0
+		for err := range results {
+			if err == nil {
+				accepted++
+			}
+		}
+		if accepted != 1 {
+			t.Errorf("idp initiated %v: %d of %d concurrent validations accepted", idpInitiated, accepted, n)
+		}
+	}
+}
+
+func TestIdCacheConcurrent(t *testing.T) {
+	c := newIdCache(time.Minute)
+	now := time.Now()
+	const (
+		ids     = 1000
+		workers = 16
+	)
+	for i := 0; i < ids; i++ {
+		c.Add(fmt.Sprintf("_req%d", i), now)
+	}
+	var added, taken int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < ids; i++ {
+				if c.CheckAndAdd(fmt.Sprintf("_assertion%d", i), now, time.Time{}) {
+					atomic.AddInt32(&added, 1)
+				}
+				if c.Take(fmt.Sprintf("_req%d", i), now) {
+					atomic.AddInt32(&taken, 1)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if added != ids || taken != ids {
+		t.Errorf("%d of %d ids added, %d taken", added, ids, taken)
+	}
+}
+
+func TestIdCacheExpire(t *testing.T) {
+	c := newIdCache(time.Minute)
+	now := time.Now()
+	c.Add("_req", now)
+	if c.CheckAndAdd("_short", now, now.Add(time.Second)) != true || c.CheckAndAdd("_long", now, now.Add(time.Hour)) != true {
+		t.Fatalf("CheckAndAdd new ids")
+	}
+	now = now.Add(2 * time.Minute)
+	if c.Take("_req", now) {
+		t.Errorf("expired request id taken")
+	}
+	if !c.CheckAndAdd("_short", now, time.Time{}) {
+		t.Errorf("id expired after ttl not accepted")
+	}
+	if c.CheckAndAdd("_long", now, time.Time{}) {
+		t.Errorf("id kept until its expiry accepted again")
+	}
+	if keys := c.store.ListKeys(); len(keys) != 2 {
+		t.Errorf("expired ids not purged: %v", keys)
+	}
+}
@@ -25,8 +25,25 @@ import (
 	"yunion.io/x/pkg/utils"
 )
 
+// SVMDKExtent is an extent line of a descriptor, File is empty for the
+// ZERO extents
+type SVMDKExtent struct {
+	Access  string
+	Sectors int64
+	Type    string
+	File    string
+	// Offset is the sector offset in the file of the FLAT and VMFS extents
+	Offset int64
+}
+
 type SVMDKInfo struct {
+	// ExtentFile and ExtentType are of the first extent
 	ExtentFile       string
+	ExtentType       string
+	Extents          []SVMDKExtent
+	CreateType       string
+	ParentCID        string
+	ParentFileName   string
 	Heads            int64
 	Sectors          int64
 	Cylinders        int64
@@ -41,10 +58,31 @@ func (info SVMDKInfo) Size() int64 {
 	return info.Heads * info.Sectors * info.Cylinders * 512
 }
 
+// Capacity is the size of all extents
+func (info SVMDKInfo) Capacity() int64 {
+	sectors := int64(0)
+	for _, extent := range info.Extents {
+		sectors += extent.Sectors
+	}
+	return sectors * 512
+}
+
 const (
+	EXTENT_TYPE_FLAT        = "FLAT"
+	EXTENT_TYPE_SPARSE      = "SPARSE"
+	EXTENT_TYPE_ZERO        = "ZERO"
+	EXTENT_TYPE_VMFS        = "VMFS"
+	EXTENT_TYPE_VMFS_SPARSE = "VMFSSPARSE"
+	EXTENT_TYPE_VMFS_RDM    = "VMFSRDM"
+	EXTENT_TYPE_VMFS_RAW    = "VMFSRAW"
+	EXTENT_TYPE_SESPARSE    = "SESPARSE"
+
 	//RW 20971520 VMFS "89334fec-7013-46cb-8d7b-8271cbe1a175_1-flat.vmdk"
 	//RW 62914560 SESPARSE "89334fec-7013-46cb-8d7b-8271cbe1a175-sesparse.vmdk"
-	extentPatternString = `^RW \d+ (VMFS|SESPARSE)\w* \"(?P<fn>[^"]+)`
+	//RW 4192256 SPARSE "disk-s001.vmdk"
+	//RW 2048 FLAT "disk-flat.vmdk" 0
+	//RW 1024 ZERO
+	extentPatternString = `^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+\"(?P<fn>[^"]+)\"(?:\s+(\d+))?)?`
 )
 
 var (
@@ -64,7 +102,18 @@ func ParseStream(stream io.Reader) (*SVMDKInfo, error) {
 		matches := extentPatternRegexp.FindStringSubmatch(line)
 		if len(matches) > 0 {
 			// log.Debugf("%#v", matches)
-			info.ExtentFile = matches[2]
+			extent := SVMDKExtent{
+				Access: matches[1],
+				Type:   strings.ToUpper(matches[3]),
+				File:   matches[4],
+			}
+			extent.Sectors, _ = strconv.ParseInt(matches[2], 10, 64)
+			extent.Offset, _ = strconv.ParseInt(matches[5], 10, 64)
+			if !findExtent {
+				info.ExtentFile = extent.File
+				info.ExtentType = extent.Type
+			}
+			info.Extents = append(info.Extents, extent)
 			findExtent = true
 		} else {
 			equalPos := strings.IndexByte(line, '=')
@@ -74,6 +123,12 @@ func ParseStream(stream io.Reader) (*SVMDKInfo, error) {
 				switch key {
 				case "CID":
 					info.CID = value
+				case "parentCID":
+					info.ParentCID = value
+				case "parentFileNameHint":
+					info.ParentFileName = value
+				case "createType":
+					info.CreateType = value
 				case "ddb.uuid":
 					info.UUID = value
 				case "ddb.geometry.cylinders":
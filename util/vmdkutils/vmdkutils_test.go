@@ -56,3 +56,35 @@ func TestParseStream(t *testing.T) {
 		t.Errorf("should parse error")
 	}
 }
+
+func TestParseMultiExtents(t *testing.T) {
+	info, err := Parse(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="twoGbMaxExtentSparse"
+
+# Extent description
+RW 4192256 SPARSE "disk-s001.vmdk"
+RW 2048 FLAT "disk-flat.vmdk" 128
+RDONLY 1024 ZERO
+`)
+	if err != nil {
+		t.Fatalf("parse error %s", err)
+	}
+	if info.CreateType != "twoGbMaxExtentSparse" || info.ParentCID != "ffffffff" {
+		t.Errorf("info %#v", info)
+	}
+	if info.ExtentFile != "disk-s001.vmdk" || info.ExtentType != EXTENT_TYPE_SPARSE || len(info.Extents) != 3 {
+		t.Fatalf("extents %#v", info.Extents)
+	}
+	if e := info.Extents[1]; e.Type != EXTENT_TYPE_FLAT || e.File != "disk-flat.vmdk" || e.Offset != 128 || e.Sectors != 2048 {
+		t.Errorf("flat extent %#v", e)
+	}
+	if e := info.Extents[2]; e.Access != "RDONLY" || e.Type != EXTENT_TYPE_ZERO || e.File != "" {
+		t.Errorf("zero extent %#v", e)
+	}
+	if info.Capacity() != (4192256+2048+1024)*512 {
+		t.Errorf("capacity %d", info.Capacity())
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"yunion.io/x/pkg/util/clock"
+)
+
+// GaugeMetric represents a single numerical value that can arbitrarily go up
+// and down.
+type GaugeMetric interface {
+	Inc()
+	Dec()
+}
+
+// CounterMetric represents a single numerical value that only ever
+// goes up.
+type CounterMetric interface {
+	Inc()
+}
+
+// HistogramMetric counts individual observations.
+type HistogramMetric interface {
+	Observe(float64)
+}
+
+// MetricsProvider generates the metrics of named queues.
+type MetricsProvider interface {
+	// NewDepthMetric tracks the number of items waiting in the queue
+	NewDepthMetric(name string) GaugeMetric
+	// NewAddsMetric counts the items added to the queue
+	NewAddsMetric(name string) CounterMetric
+	// NewLatencyMetric observes how long, in seconds, an item waits in
+	// the queue before being handed out
+	NewLatencyMetric(name string) HistogramMetric
+	// NewWorkDurationMetric observes how long, in seconds, processing an
+	// item takes
+	NewWorkDurationMetric(name string) HistogramMetric
+	// NewRetriesMetric counts the items requeued by AddRateLimited
+	NewRetriesMetric(name string) CounterMetric
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Observe(float64) {}
+
+type noopMetricsProvider struct{}
+
+func (noopMetricsProvider) NewDepthMetric(name string) GaugeMetric            { return noopMetric{} }
+func (noopMetricsProvider) NewAddsMetric(name string) CounterMetric           { return noopMetric{} }
+func (noopMetricsProvider) NewLatencyMetric(name string) HistogramMetric      { return noopMetric{} }
+func (noopMetricsProvider) NewWorkDurationMetric(name string) HistogramMetric { return noopMetric{} }
+func (noopMetricsProvider) NewRetriesMetric(name string) CounterMetric        { return noopMetric{} }
+
+// queueMetrics is called by the queue with its lock held
+type queueMetrics interface {
+	add(item t)
+	get(item t)
+	done(item t)
+}
+
+type defaultQueueMetrics struct {
+	clock clock.Clock
+
+	depth        GaugeMetric
+	adds         CounterMetric
+	latency      HistogramMetric
+	workDuration HistogramMetric
+
+	addTimes        map[t]time.Time
+	processingStart map[t]time.Time
+}
+
+func (m *defaultQueueMetrics) add(item t) {
+	m.adds.Inc()
+	m.depth.Inc()
+	if _, exists := m.addTimes[item]; !exists {
+		m.addTimes[item] = m.clock.Now()
+	}
+}
+
+func (m *defaultQueueMetrics) get(item t) {
+	m.depth.Dec()
+	m.processingStart[item] = m.clock.Now()
+	if start, exists := m.addTimes[item]; exists {
+		m.latency.Observe(m.clock.Since(start).Seconds())
+		delete(m.addTimes, item)
+	}
+}
+
+func (m *defaultQueueMetrics) done(item t) {
+	if start, exists := m.processingStart[item]; exists {
+		m.workDuration.Observe(m.clock.Since(start).Seconds())
+		delete(m.processingStart, item)
+	}
+}
+
+type noopQueueMetrics struct{}
+
+func (noopQueueMetrics) add(item t)  {}
+func (noopQueueMetrics) get(item t)  {}
+func (noopQueueMetrics) done(item t) {}
+
+type queueMetricsFactory struct {
+	metricsProvider MetricsProvider
+
+	onlyOnce sync.Once
+}
+
+func (f *queueMetricsFactory) setProvider(mp MetricsProvider) {
+	f.onlyOnce.Do(func() {
+		f.metricsProvider = mp
+	})
+}
+
+func (f *queueMetricsFactory) newQueueMetrics(name string, clock clock.Clock) queueMetrics {
+	mp := f.metricsProvider
+	if len(name) == 0 || mp == (noopMetricsProvider{}) {
+		return noopQueueMetrics{}
+	}
+	return &defaultQueueMetrics{
+		clock:           clock,
+		depth:           mp.NewDepthMetric(name),
+		adds:            mp.NewAddsMetric(name),
+		latency:         mp.NewLatencyMetric(name),
+		workDuration:    mp.NewWorkDurationMetric(name),
+		addTimes:        map[t]time.Time{},
+		processingStart: map[t]time.Time{},
+	}
+}
+
+func newRetryMetrics(name string) CounterMetric {
+	mp := globalMetricsFactory.metricsProvider
+	if len(name) == 0 || mp == (noopMetricsProvider{}) {
+		return noopMetric{}
+	}
+	return mp.NewRetriesMetric(name)
+}
+
+var globalMetricsFactory = queueMetricsFactory{
+	metricsProvider: noopMetricsProvider{},
+}
+
+// SetProvider sets the metrics provider for all subsequently created named
+// queues. Only the first call has an effect.
+func SetProvider(metricsProvider MetricsProvider) {
+	globalMetricsFactory.setProvider(metricsProvider)
+}
+
+const workqueueSubsystem = "workqueue"
+
+type prometheusMetricsProvider struct {
+	depth        *prometheus.GaugeVec
+	adds         *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	workDuration *prometheus.HistogramVec
+	retries      *prometheus.CounterVec
+}
+
+// NewPrometheusMetricsProvider returns a MetricsProvider exporting queue
+// metrics labeled by queue name, registered with registerer.
+func NewPrometheusMetricsProvider(registerer prometheus.Registerer) MetricsProvider {
+	buckets := prometheus.ExponentialBuckets(10e-9, 10, 10)
+	p := &prometheusMetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: workqueueSubsystem,
+			Name:      "depth",
+			Help:      "Current depth of workqueue",
+		}, []string{"name"}),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: workqueueSubsystem,
+			Name:      "adds_total",
+			Help:      "Total number of adds handled by workqueue",
+		}, []string{"name"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: workqueueSubsystem,
+			Name:      "queue_duration_seconds",
+			Help:      "How long in seconds an item stays in workqueue before being requested",
+			Buckets:   buckets,
+		}, []string{"name"}),
+		workDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: workqueueSubsystem,
+			Name:      "work_duration_seconds",
+			Help:      "How long in seconds processing an item from workqueue takes",
+			Buckets:   buckets,
+		}, []string{"name"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: workqueueSubsystem,
+			Name:      "retries_total",
+			Help:      "Total number of retries handled by workqueue",
+		}, []string{"name"}),
+	}
+	registerer.MustRegister(p.depth, p.adds, p.latency, p.workDuration, p.retries)
+	return p
+}
+
+func (p *prometheusMetricsProvider) NewDepthMetric(name string) GaugeMetric {
+	return p.depth.WithLabelValues(name)
+}
+
+func (p *prometheusMetricsProvider) NewAddsMetric(name string) CounterMetric {
+	return p.adds.WithLabelValues(name)
+}
+
+func (p *prometheusMetricsProvider) NewLatencyMetric(name string) HistogramMetric {
+	return p.latency.WithLabelValues(name)
+}
+
+func (p *prometheusMetricsProvider) NewWorkDurationMetric(name string) HistogramMetric {
+	return p.workDuration.WithLabelValues(name)
+}
+
+func (p *prometheusMetricsProvider) NewRetriesMetric(name string) CounterMetric {
+	return p.retries.WithLabelValues(name)
+}
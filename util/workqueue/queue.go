@@ -0,0 +1,246 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workqueue
+
+import (
+	"container/heap"
+	"sync"
+
+	"yunion.io/x/pkg/util/clock"
+)
+
+// Interface is a work queue of keys for controllers.
+//  1. An item is processed by at most one worker at a time: an item added
+//     again while being processed is queued only after Done is called
+//  2. An item added several times before it is picked up by Get is only
+//     processed once, with the highest priority it was added with
+//  3. Items with higher priority are handed out first, items of equal
+//     priority in the order they were added
+type Interface interface {
+	Add(item interface{})
+	AddWithPriority(item interface{}, priority int)
+	Len() int
+	Get() (item interface{}, shutdown bool)
+	Done(item interface{})
+	ShutDown()
+	ShutDownWithDrain()
+	ShuttingDown() bool
+}
+
+// New constructs a new work queue.
+func New() *Type {
+	return NewNamed("")
+}
+
+// NewNamed constructs a new work queue reporting metrics under name.
+func NewNamed(name string) *Type {
+	rc := clock.RealClock{}
+	return newQueue(globalMetricsFactory.newQueueMetrics(name, rc))
+}
+
+func newQueue(metrics queueMetrics) *Type {
+	t := &Type{
+		queued:     map[t]*queueItem{},
+		dirty:      map[t]int{},
+		processing: map[t]struct{}{},
+		metrics:    metrics,
+	}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+type t interface{}
+
+type queueItem struct {
+	item     t
+	priority int
+	seq      uint64
+	index    int
+}
+
+// priorityQueue is a container/heap of queued items ordered by priority,
+// then by insertion order.
+type priorityQueue []*queueItem
+
+func (pq priorityQueue) Len() int { return len(pq) }
+
+func (pq priorityQueue) Less(i, j int) bool {
+	if pq[i].priority != pq[j].priority {
+		return pq[i].priority > pq[j].priority
+	}
+	return pq[i].seq < pq[j].seq
+}
+
+func (pq priorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *priorityQueue) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*pq)
+	*pq = append(*pq, item)
+}
+
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*pq = old[:n-1]
+	return item
+}
+
+// Type is a work queue (see the package documentation).
+type Type struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// queue holds the items waiting to be handed out
+	queue priorityQueue
+	// queued indexes the entries of queue by item
+	queued map[t]*queueItem
+	// dirty holds the items added while being processed, with the priority
+	// they should be queued with once Done is called
+	dirty map[t]int
+	// processing holds the items currently handed out to workers
+	processing map[t]struct{}
+
+	seq          uint64
+	shuttingDown bool
+
+	metrics queueMetrics
+}
+
+// Add marks item as needing processing with the default priority 0.
+func (q *Type) Add(item interface{}) {
+	q.AddWithPriority(item, 0)
+}
+
+// AddWithPriority marks item as needing processing. If the item is already
+// waiting, its priority is raised if needed.
+func (q *Type) AddWithPriority(item interface{}, priority int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if qi, ok := q.queued[item]; ok {
+		if priority > qi.priority {
+			qi.priority = priority
+			heap.Fix(&q.queue, qi.index)
+		}
+		return
+	}
+	if _, ok := q.processing[item]; ok {
+		if p, ok := q.dirty[item]; !ok || priority > p {
+			q.dirty[item] = priority
+		}
+		return
+	}
+	q.push(item, priority)
+	q.cond.Signal()
+}
+
+func (q *Type) push(item t, priority int) {
+	q.seq++
+	qi := &queueItem{
+		item:     item,
+		priority: priority,
+		seq:      q.seq,
+	}
+	heap.Push(&q.queue, qi)
+	q.queued[item] = qi
+	q.metrics.add(item)
+}
+
+// Len returns the current queue length, for informational purposes only. You
+// shouldn't e.g. gate a call to Add() or Get() on Len() being a particular
+// value, that can't be synchronized properly.
+func (q *Type) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.queue)
+}
+
+// Get blocks until it can return an item to be processed. If shutdown = true,
+// the caller should end their goroutine. You must call Done with item when you
+// have finished processing it.
+func (q *Type) Get() (item interface{}, shutdown bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.queue) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		// We must be shutting down.
+		return nil, true
+	}
+
+	qi := heap.Pop(&q.queue).(*queueItem)
+	delete(q.queued, qi.item)
+	q.processing[qi.item] = struct{}{}
+	q.metrics.get(qi.item)
+	return qi.item, false
+}
+
+// Done marks item as done processing, and if it has been marked as dirty again
+// while it was being processed, it will be re-added to the queue for
+// re-processing.
+func (q *Type) Done(item interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.metrics.done(item)
+	delete(q.processing, item)
+	if priority, ok := q.dirty[item]; ok {
+		delete(q.dirty, item)
+		q.push(item, priority)
+	}
+	// wake up both workers waiting for the re-added item and a pending
+	// ShutDownWithDrain waiting for processing to finish
+	q.cond.Broadcast()
+}
+
+// ShutDown will cause q to ignore all new items added to it and immediately
+// instruct the worker goroutines to exit once the queue is empty.
+func (q *Type) ShutDown() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain will cause q to ignore all new items added to it. It then
+// blocks until every item handed out by Get has been marked Done, so the
+// workers must keep running until Get reports shutdown.
+func (q *Type) ShutDownWithDrain() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+	for len(q.processing) != 0 || len(q.queue) != 0 {
+		q.cond.Wait()
+	}
+}
+
+// ShuttingDown returns true once ShutDown or ShutDownWithDrain was called.
+func (q *Type) ShuttingDown() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.shuttingDown
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workqueue
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/util/clock"
+	"yunion.io/x/pkg/util/wait"
+)
+
+func TestBasic(t *testing.T) {
+	q := New()
+
+	const producers = 50
+	producerWG := sync.WaitGroup{}
+	producerWG.Add(producers)
+	for i := 0; i < producers; i++ {
+		go func(i int) {
+			defer producerWG.Done()
+			for j := 0; j < 50; j++ {
+				q.Add(i)
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+
+	const consumers = 10
+	consumerWG := sync.WaitGroup{}
+	consumerWG.Add(consumers)
+	for i := 0; i < consumers; i++ {
+		go func(i int) {
+			defer consumerWG.Done()
+			for {
+				item, quit := q.Get()
+				if quit {
+					return
+				}
+				time.Sleep(3 * time.Millisecond)
+				q.Done(item)
+			}
+		}(i)
+	}
+
+	producerWG.Wait()
+	q.ShutDown()
+	q.Add("added after shutdown!")
+	consumerWG.Wait()
+	if q.Len() != 0 {
+		t.Errorf("Expected the queue to be empty, had: %v items", q.Len())
+	}
+}
+
+func TestAddWhileProcessing(t *testing.T) {
+	q := New()
+
+	q.Add("foo")
+	item, _ := q.Get()
+	// re-adding while processing must not hand it out concurrently
+	q.Add("foo")
+	q.Add("foo")
+	if q.Len() != 0 {
+		t.Fatalf("item being processed should not be queued, len %d", q.Len())
+	}
+	q.Done(item)
+	if q.Len() != 1 {
+		t.Fatalf("item should be requeued once after Done, len %d", q.Len())
+	}
+	item, _ = q.Get()
+	q.Done(item)
+	if q.Len() != 0 {
+		t.Fatalf("expected empty queue, len %d", q.Len())
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	q := New()
+	q.Add("foo")
+	q.Add("bar")
+	q.Add("foo")
+	if q.Len() != 2 {
+		t.Errorf("expected 2 items, got %d", q.Len())
+	}
+}
+
+func TestPriority(t *testing.T) {
+	q := New()
+	q.Add("low-1")
+	q.AddWithPriority("high", 10)
+	q.Add("low-2")
+	q.AddWithPriority("mid", 5)
+	// raising the priority of a queued item reorders it
+	q.AddWithPriority("low-2", 7)
+	// lowering is ignored
+	q.AddWithPriority("high", 1)
+
+	expected := []string{"high", "low-2", "mid", "low-1"}
+	for _, e := range expected {
+		item, _ := q.Get()
+		if item != e {
+			t.Errorf("expected %s, got %v", e, item)
+		}
+		q.Done(item)
+	}
+}
+
+func TestShutDownWithDrain(t *testing.T) {
+	q := New()
+	q.Add("foo")
+	q.Add("bar")
+
+	item, _ := q.Get()
+
+	drained := make(chan struct{})
+	go func() {
+		q.ShutDownWithDrain()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatalf("ShutDownWithDrain returned with items still processing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !q.ShuttingDown() {
+		t.Fatalf("queue should be shutting down")
+	}
+
+	q.Done(item)
+	// queued items are still handed out while draining
+	item, quit := q.Get()
+	if quit || item != "bar" {
+		t.Fatalf("expected bar, got %v %v", item, quit)
+	}
+	q.Done(item)
+
+	select {
+	case <-drained:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("ShutDownWithDrain did not return")
+	}
+	if _, quit := q.Get(); !quit {
+		t.Errorf("Get should report shutdown")
+	}
+}
+
+type testMetric struct {
+	lock         sync.Mutex
+	value        float64
+	observations int
+}
+
+func (m *testMetric) Inc() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value++
+}
+
+func (m *testMetric) Dec() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value--
+}
+
+func (m *testMetric) Observe(v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value = v
+	m.observations++
+}
+
+type testMetricsProvider struct {
+	depth, adds, latency, duration, retries testMetric
+}
+
+func (p *testMetricsProvider) NewDepthMetric(name string) GaugeMetric            { return &p.depth }
+func (p *testMetricsProvider) NewAddsMetric(name string) CounterMetric           { return &p.adds }
+func (p *testMetricsProvider) NewLatencyMetric(name string) HistogramMetric      { return &p.latency }
+func (p *testMetricsProvider) NewWorkDurationMetric(name string) HistogramMetric { return &p.duration }
+func (p *testMetricsProvider) NewRetriesMetric(name string) CounterMetric        { return &p.retries }
+
+func TestMetrics(t *testing.T) {
+	mp := &testMetricsProvider{}
+	c := clock.NewFakeClock(time.Now())
+	f := queueMetricsFactory{metricsProvider: mp}
+	q := newQueue(f.newQueueMetrics("test", c))
+
+	q.Add("foo")
+	q.Add("bar")
+	if mp.adds.value != 2 || mp.depth.value != 2 {
+		t.Errorf("expected adds=2 depth=2, got %v %v", mp.adds.value, mp.depth.value)
+	}
+
+	c.Step(50 * time.Millisecond)
+	item, _ := q.Get()
+	if mp.depth.value != 1 {
+		t.Errorf("expected depth 1, got %v", mp.depth.value)
+	}
+	if mp.latency.value != 0.05 {
+		t.Errorf("expected latency 0.05, got %v", mp.latency.value)
+	}
+
+	c.Step(30 * time.Millisecond)
+	q.Done(item)
+	if mp.duration.value != 0.03 {
+		t.Errorf("expected work duration 0.03, got %v", mp.duration.value)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workqueue
+
+import (
+	"testing"
+	"time"
+
+	"yunion.io/x/pkg/util/clock"
+)
+
+func TestRateLimitingQueue(t *testing.T) {
+	limiter := NewItemExponentialFailureRateLimiter(1*time.Millisecond, 1*time.Second)
+	fakeClock := clock.NewFakeClock(time.Now())
+	delayingQueue := newDelayingQueue(fakeClock, New())
+	queue := newRateLimitingQueue(delayingQueue, limiter, "")
+	defer queue.ShutDown()
+
+	queue.AddRateLimited("one")
+	waitEntry := <-delayingQueue.waitingForAddCh
+	if e, a := 1*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	queue.AddRateLimited("one")
+	waitEntry = <-delayingQueue.waitingForAddCh
+	if e, a := 2*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, queue.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	queue.AddRateLimited("two")
+	waitEntry = <-delayingQueue.waitingForAddCh
+	if e, a := 1*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	queue.Forget("one")
+	if e, a := 0, queue.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	queue.AddRateLimited("one")
+	waitEntry = <-delayingQueue.waitingForAddCh
+	if e, a := 1*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
+
+func TestItemExponentialFailureRateLimiter(t *testing.T) {
+	limiter := NewItemExponentialFailureRateLimiter(1*time.Millisecond, 1*time.Second)
+
+	for i, e := range []time.Duration{1, 2, 4, 8, 16} {
+		if a := limiter.When("one"); a != e*time.Millisecond {
+			t.Errorf("%d: expected %v, got %v", i, e*time.Millisecond, a)
+		}
+	}
+	if e, a := 5, limiter.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	for i := 0; i < 20; i++ {
+		limiter.When("one")
+	}
+	if e, a := 1*time.Second, limiter.When("one"); e != a {
+		t.Errorf("delay should be capped, expected %v, got %v", e, a)
+	}
+
+	limiter.Forget("one")
+	if e, a := 0, limiter.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
+
+func TestBucketRateLimiter(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	limiter := newBucketRateLimiter(fakeClock, 10, 2)
+
+	// the burst is available immediately
+	for i := 0; i < 2; i++ {
+		if a := limiter.When("one"); a != 0 {
+			t.Errorf("%d: expected no delay, got %v", i, a)
+		}
+	}
+	// then each reservation waits one more token
+	if e, a := 100*time.Millisecond, limiter.When("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 200*time.Millisecond, limiter.When("two"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	// refill never exceeds the burst
+	fakeClock.Step(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		if a := limiter.When("one"); a != 0 {
+			t.Errorf("%d: expected no delay, got %v", i, a)
+		}
+	}
+	if a := limiter.When("one"); a == 0 {
+		t.Errorf("expected a delay once the burst is used up")
+	}
+}
+
+func TestMaxOfRateLimiter(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	limiter := NewMaxOfRateLimiter(
+		NewItemExponentialFailureRateLimiter(1*time.Millisecond, 1*time.Second),
+		newBucketRateLimiter(fakeClock, 1, 1),
+	)
+
+	if e, a := 1*time.Millisecond, limiter.When("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 1*time.Second, limiter.When("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, limiter.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	limiter.Forget("one")
+	if e, a := 0, limiter.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}